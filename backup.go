@@ -20,16 +20,29 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 )
 
+// maxListSize bounds the size of the lists read from a backup, so that a corrupted size doesn't
+// make readFrom allocate an absurd amount of memory.
+const maxListSize = 4 << 30
+
 // flushThreshold determines when a buffer will be flushed. When performing a
 // backup/restore, the entries will be batched up until the total size of batch
 // is more than flushThreshold or entry size (without the value size) is more
@@ -47,10 +60,14 @@ const flushThreshold = 100 << 20
 // used to generate the backup, or if you wish to backup only a certain range
 // of keys, use Stream.Backup directly.
 func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	return db.newBackupStream(since).Backup(w, since)
+}
+
+func (db *DB) newBackupStream(since uint64) *Stream {
 	stream := db.NewStream()
 	stream.LogPrefix = "DB.Backup"
 	stream.SinceTs = since
-	return stream.Backup(w, since)
+	return stream
 }
 
 // Backup dumps a protobuf-encoded list of all entries in the database into the
@@ -62,7 +79,493 @@ func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
 //
 // This can be used to backup the data in a database at a given point in time.
 func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
-	stream.KeyToList = func(key []byte, itr *Iterator) (*pb.KVList, error) {
+	return stream.backup(context.Background(), w, since)
+}
+
+func (stream *Stream) backup(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	return stream.backupLists(ctx, since, func(list *pb.KVList) error {
+		return writeTo(list, w)
+	})
+}
+
+// backupLists streams the entries of the backup, newer than or equal to since, to write.
+func (stream *Stream) backupLists(ctx context.Context, since uint64,
+	write func(list *pb.KVList) error) (uint64, error) {
+	stream.KeyToList = stream.backupKeyToList(since)
+
+	var maxVersion uint64
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		out := list.Kv[:0]
+		for _, kv := range list.Kv {
+			if maxVersion < kv.Version {
+				maxVersion = kv.Version
+			}
+			if !kv.StreamDone {
+				// Don't pick stream done changes.
+				out = append(out, kv)
+			}
+		}
+		list.Kv = out
+		return write(list)
+	}
+
+	if err := stream.Orchestrate(ctx); err != nil {
+		return 0, err
+	}
+	return maxVersion, nil
+}
+
+// BackupOptions are the options of the backups made by BackupWithOptions. They are independent of
+// the options of the DB, so that the backups of an unencrypted DB can be encrypted.
+type BackupOptions struct {
+	// Compression is the compression of the backup, options.None or options.ZSTD.
+	Compression options.CompressionType
+	// ZSTDCompressionLevel is the ZSTD compression level of the backup.
+	ZSTDCompressionLevel int
+	// EncryptionKey encrypts and authenticates the backup with AES-GCM if not empty. It must be
+	// 16, 24 or 32 bytes long.
+	EncryptionKey []byte
+}
+
+// BackupWithOptions is like Backup, but compresses and encrypts the backup as specified by opt.
+// The compression and the encryption are written in the backup, so that Load and LoadWithOptions
+// can read it.
+func (db *DB) BackupWithOptions(w io.Writer, since uint64, opt BackupOptions) (uint64, error) {
+	return db.BackupContext(context.Background(), w, since, opt)
+}
+
+// BackupContext is like BackupWithOptions, but stops once ctx is done, returning ctx.Err(). The
+// backup written to w by then is incomplete, and must be discarded.
+func (db *DB) BackupContext(ctx context.Context, w io.Writer, since uint64,
+	opt BackupOptions) (uint64, error) {
+	return db.newBackupStream(since).backupWithOptions(ctx, w, since, opt)
+}
+
+// BackupWithOptions is like Backup, but compresses and encrypts the backup as specified by opt.
+func (stream *Stream) BackupWithOptions(w io.Writer, since uint64,
+	opt BackupOptions) (uint64, error) {
+	return stream.backupWithOptions(context.Background(), w, since, opt)
+}
+
+func (stream *Stream) backupWithOptions(ctx context.Context, w io.Writer, since uint64,
+	opt BackupOptions) (uint64, error) {
+	bw, err := newBackupWriter(w, opt)
+	if err != nil {
+		return 0, err
+	}
+	ts, err := stream.backupLists(ctx, since, bw.writeList)
+	if cerr := bw.Close(); err == nil {
+		err = cerr
+	}
+	return ts, err
+}
+
+// The backups made by BackupWithOptions start with a header, made of backupMagic, the version of
+// the format, the compression type and the encryption type. The encrypted backups then have the
+// IV and a check of the key. Since backupMagic can't be the size of a list, the backups made by
+// Backup, which start with the size of their first list, are told apart.
+//
+// Since the version 2 of the format, every list is followed by the CRC32 of its encoding, so that
+// the corrupted lists are detected, even if they decode.
+//
+// The backups encrypted with backupEncryptionAES are encrypted with AES-CTR, which doesn't
+// authenticate them. They are only read. The backups are now encrypted with
+// backupEncryptionAESGCM, in chunks sealed by sealWriter.
+const (
+	backupMagic            = "badgerbk"
+	backupFormatVersion    = 2
+	backupEncryptionAES    = 1
+	backupEncryptionAESGCM = 2
+	backupKeyCheckSize     = 16
+	backupChunkSize        = 64 << 10
+)
+
+// backupWriter compresses and encrypts a backup.
+type backupWriter struct {
+	io.Writer
+	zw *zstd.Encoder
+	sw *sealWriter
+}
+
+// writeList writes list, followed by its checksum.
+func (bw *backupWriter) writeList(list *pb.KVList) error {
+	return writeList(list, bw, true)
+}
+
+func newBackupWriter(w io.Writer, opt BackupOptions) (*backupWriter, error) {
+	if opt.Compression != options.None && opt.Compression != options.ZSTD {
+		return nil, errors.Errorf("Unsupported backup compression: %d", opt.Compression)
+	}
+	header := []byte(backupMagic)
+	header = append(header, backupFormatVersion, byte(opt.Compression), 0)
+	bw := &backupWriter{Writer: w}
+	if len(opt.EncryptionKey) > 0 {
+		iv, err := y.GenerateIV()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := aes.NewCipher(opt.EncryptionKey); err != nil {
+			return nil, err
+		}
+		header[len(header)-1] = backupEncryptionAESGCM
+		header = append(header, iv...)
+		header = append(header, backupKeyCheck(opt.EncryptionKey, iv)...)
+		bw.sw = &sealWriter{
+			w:     w,
+			chunk: backupChunk{key: opt.EncryptionKey, iv: iv, header: header},
+			buf:   make([]byte, 0, backupChunkSize),
+		}
+		bw.Writer = bw.sw
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	if opt.Compression == options.ZSTD {
+		level := zstd.EncoderLevelFromZstd(opt.ZSTDCompressionLevel)
+		zw, err := zstd.NewWriter(bw.Writer, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, err
+		}
+		bw.zw, bw.Writer = zw, zw
+	}
+	return bw, nil
+}
+
+// Close flushes the compressed data, and seals the last chunk of the encrypted data. It doesn't
+// close the underlying writer.
+func (bw *backupWriter) Close() error {
+	if bw.zw != nil {
+		if err := bw.zw.Close(); err != nil {
+			return err
+		}
+	}
+	if bw.sw != nil {
+		return bw.sw.Close()
+	}
+	return nil
+}
+
+// backupChunk seals and opens the chunks of a backup encrypted with backupEncryptionAESGCM. The IV
+// of a chunk is the IV of the backup, XORed with the index of the chunk. Its additional data is
+// the header of the backup, followed by whether it's the last chunk. So the chunks can't be
+// reordered, moved to another backup, or dropped from its end, without failing to open.
+type backupChunk struct {
+	key, iv, header []byte
+}
+
+func (c *backupChunk) ivAndAD(idx uint64, last bool) ([]byte, []byte) {
+	iv := y.Copy(c.iv)
+	binary.BigEndian.PutUint64(iv[8:], binary.BigEndian.Uint64(iv[8:])^idx)
+	ad := append(y.Copy(c.header), 0)
+	if last {
+		ad[len(ad)-1] = 1
+	}
+	return iv, ad
+}
+
+// sealWriter encrypts and authenticates the data written to it in chunks of backupChunkSize
+// bytes, so that they are authenticated before being loaded. Each chunk is written after whether
+// it's the last chunk, and the size of the sealed chunk. Close seals the last chunk.
+type sealWriter struct {
+	w     io.Writer
+	chunk backupChunk
+	buf   []byte
+	idx   uint64 // The index of the next chunk.
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(sw.buf) == cap(sw.buf) {
+			// Only seal a full chunk once there is more data, since the last one is sealed apart.
+			if err := sw.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+k]
+		n += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close seals the last chunk. It doesn't close the underlying writer.
+func (sw *sealWriter) Close() error {
+	return sw.seal(true)
+}
+
+func (sw *sealWriter) seal(last bool) error {
+	iv, ad := sw.chunk.ivAndAD(sw.idx, last)
+	out := make([]byte, 5, 5+len(sw.buf)+y.AEADTagSize)
+	out[0] = ad[len(ad)-1]
+	binary.LittleEndian.PutUint32(out[1:], uint32(len(sw.buf)+y.AEADTagSize))
+	out, err := y.Seal(out, sw.buf, ad, sw.chunk.key, iv)
+	if err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(out); err != nil {
+		return err
+	}
+	sw.buf = sw.buf[:0]
+	sw.idx++
+	return nil
+}
+
+// openReader reads the data written by sealWriter, opening the chunks as they are read. It
+// returns an ErrInvalidDump if a chunk fails to open, or if the chunks end before the last one.
+type openReader struct {
+	r     io.Reader
+	chunk backupChunk
+	buf   []byte // The opened data which wasn't read yet.
+	idx   uint64 // The index of the next chunk.
+	last  bool   // Set once the last chunk is opened.
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.buf) == 0 {
+		if or.last {
+			return 0, io.EOF
+		}
+		if err := or.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, or.buf)
+	or.buf = or.buf[n:]
+	return n, nil
+}
+
+func (or *openReader) open() error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(or.r, prefix[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrapf(ErrInvalidDump, "while reading chunk %d: %s", or.idx, err)
+	}
+	sz := binary.LittleEndian.Uint32(prefix[1:])
+	if prefix[0] > 1 || sz < y.AEADTagSize || sz > backupChunkSize+y.AEADTagSize {
+		return errors.Wrapf(ErrInvalidDump, "invalid header of chunk %d", or.idx)
+	}
+	sealed := make([]byte, sz)
+	if _, err := io.ReadFull(or.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrapf(ErrInvalidDump, "while reading chunk %d: %s", or.idx, err)
+	}
+	iv, ad := or.chunk.ivAndAD(or.idx, prefix[0] == 1)
+	buf, err := y.Open(sealed[:0], sealed, ad, or.chunk.key, iv)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidDump, "chunk %d: %s", or.idx, err)
+	}
+	or.buf = buf
+	or.idx++
+	if or.last = prefix[0] == 1; or.last {
+		// Nothing can follow the last chunk.
+		if n, _ := or.r.Read(prefix[:1]); n > 0 {
+			return errors.Wrap(ErrInvalidDump, "data after the last chunk")
+		}
+	}
+	return nil
+}
+
+// backupReader reads the lists of a backup, decrypted and decompressed.
+type backupReader struct {
+	io.Reader
+	// checksums is set if the lists are followed by their checksum.
+	checksums bool
+	close     func()
+}
+
+// readFrom reads the lists of the backup, like readFrom, and verifies their checksums if they
+// have any.
+func (br *backupReader) readFrom(fn func(list *pb.KVList) error) error {
+	return readLists(br, br.checksums, fn)
+}
+
+// newBackupReader returns a reader of the backup in r, decrypting and decompressing it as
+// described by its header. The backups without a header are read as is. The reader must be
+// closed once the backup is read.
+func newBackupReader(r io.Reader, key []byte) (*backupReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(backupMagic))
+	if err != nil || string(magic) != backupMagic {
+		// An empty backup, or one made by Backup.
+		return &backupReader{Reader: br, close: func() {}}, nil
+	}
+	header := make([]byte, len(backupMagic)+3)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	version, compression, encryption := header[len(backupMagic)],
+		options.CompressionType(header[len(backupMagic)+1]), header[len(backupMagic)+2]
+	if version < 1 || version > backupFormatVersion {
+		return nil, errors.Errorf("Unsupported backup format version: %d", version)
+	}
+
+	var rd io.Reader = br
+	switch encryption {
+	case 0:
+	case backupEncryptionAES, backupEncryptionAESGCM:
+		buf := make([]byte, aes.BlockSize+backupKeyCheckSize)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		iv, check := buf[:aes.BlockSize], buf[aes.BlockSize:]
+		if len(key) == 0 || !hmac.Equal(check, backupKeyCheck(key, iv)) {
+			return nil, ErrBackupKeyMismatch
+		}
+		if encryption == backupEncryptionAESGCM {
+			header = append(header, buf...)
+			rd = &openReader{r: br, chunk: backupChunk{key: key, iv: iv, header: header}}
+			break
+		}
+		s, err := y.XORStream(key, iv)
+		if err != nil {
+			return nil, err
+		}
+		rd = cipher.StreamReader{S: s, R: br}
+	default:
+		return nil, errors.Errorf("Unsupported backup encryption: %d", encryption)
+	}
+
+	checksums := version >= 2
+	switch compression {
+	case options.None:
+		return &backupReader{Reader: rd, checksums: checksums, close: func() {}}, nil
+	case options.ZSTD:
+		zr, err := zstd.NewReader(rd)
+		if err != nil {
+			return nil, err
+		}
+		return &backupReader{Reader: zr, checksums: checksums, close: zr.Close}, nil
+	default:
+		return nil, errors.Errorf("Unsupported backup compression: %d", compression)
+	}
+}
+
+// BackupSummary describes the entries of a backup, as returned by VerifyBackup. It doesn't depend
+// on how the entries are batched in lists, which varies between backups.
+type BackupSummary struct {
+	Entries int
+	Keys    int
+	// Deletes is the number of entries which are deletes.
+	Deletes int
+	// MinVersion and MaxVersion are the range of the versions of the entries.
+	MinVersion uint64
+	MaxVersion uint64
+	// Bytes is the size of the keys and values.
+	Bytes int64
+	// Checksummed is set if the lists of the backup have checksums, which were verified. The
+	// backups made by BackupWithOptions have them, but not the ones made by Backup.
+	Checksummed bool
+	// Checksum is the sum of the checksums of the entries, to compare the entries of backups. It
+	// doesn't depend on their order, which varies between backups, so the backups of the same
+	// entries have the same checksum.
+	Checksum uint64
+}
+
+// VerifyBackup reads a backup made by Backup or BackupWithOptions, without writing anything, and
+// returns the summary of its entries. It returns an error wrapping ErrInvalidDump if the backup
+// can't be loaded, because it is truncated within a list, its entries are invalid, or a list
+// doesn't match its checksum. A backup truncated between two lists can't be detected.
+func (db *DB) VerifyBackup(r io.Reader) (BackupSummary, error) {
+	return db.VerifyBackupWithOptions(r, BackupOptions{})
+}
+
+// VerifyBackupWithOptions is like VerifyBackup, with opt.EncryptionKey to decrypt the backup.
+func (db *DB) VerifyBackupWithOptions(r io.Reader, opt BackupOptions) (BackupSummary, error) {
+	var s BackupSummary
+	br, err := newBackupReader(r, opt.EncryptionKey)
+	if err != nil {
+		return s, err
+	}
+	defer br.close()
+	s.Checksummed = br.checksums
+
+	h := xxhash.New()
+	var num [8]byte
+	var lists int
+	err = br.readFrom(func(list *pb.KVList) error {
+		lists++
+		var prev *pb.KV
+		for i, kv := range list.Kv {
+			if err := verifyBackupKV(kv, prev); err != nil {
+				return errors.Wrapf(ErrInvalidDump, "list %d, entry %d: %s", lists, i, err)
+			}
+			if prev == nil || !bytes.Equal(prev.Key, kv.Key) {
+				s.Keys++
+			}
+			prev = kv
+
+			if s.Entries == 0 || kv.Version < s.MinVersion {
+				s.MinVersion = kv.Version
+			}
+			if kv.Version > s.MaxVersion {
+				s.MaxVersion = kv.Version
+			}
+			s.Entries++
+			if len(kv.Meta) > 0 && kv.Meta[0]&bitDelete > 0 {
+				s.Deletes++
+			}
+			s.Bytes += int64(len(kv.Key) + len(kv.Value))
+
+			h.Reset()
+			h.Write(kv.Key)
+			binary.BigEndian.PutUint64(num[:], kv.Version)
+			h.Write(num[:])
+			h.Write(kv.Value)
+			h.Write(kv.UserMeta)
+			h.Write(kv.Meta)
+			binary.BigEndian.PutUint64(num[:], kv.ExpiresAt)
+			h.Write(num[:])
+			s.Checksum += h.Sum64()
+		}
+		return nil
+	})
+	if err != nil && errors.Cause(err) != ErrInvalidDump && err != ErrBackupKeyMismatch {
+		err = errors.Wrapf(ErrInvalidDump, "list %d: %s", lists+1, err)
+	}
+	return s, err
+}
+
+// verifyBackupKV returns an error if kv can't be in a backup. prev is the entry before kv in its
+// list, if any.
+func verifyBackupKV(kv, prev *pb.KV) error {
+	switch {
+	case len(kv.Key) == 0:
+		return errors.New("empty key")
+	case len(kv.Meta) > 1 || len(kv.UserMeta) > 1+MaxUserMetadataSize:
+		return errors.New("invalid meta")
+	case kv.StreamDone:
+		return errors.New("unexpected stream done marker")
+	case prev != nil && bytes.Equal(prev.Key, kv.Key) && kv.Version >= prev.Version:
+		return errors.Errorf("version %d of key %x after version %d", kv.Version, kv.Key,
+			prev.Version)
+	}
+	return nil
+}
+
+// backupKeyCheck returns the check of key written in the header of the encrypted backups, so that
+// a wrong key is detected before loading garbage.
+func backupKeyCheck(key, iv []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(backupMagic))
+	h.Write(iv)
+	return h.Sum(nil)[:backupKeyCheckSize]
+}
+
+// backupKeyToList returns a KeyToList function which picks all the versions of a key newer than or
+// equal to since, along with its deletes and expiries.
+func (stream *Stream) backupKeyToList(since uint64) func(key []byte,
+	itr *Iterator) (*pb.KVList, error) {
+	return func(key []byte, itr *Iterator) (*pb.KVList, error) {
 		list := &pb.KVList{}
 		a := itr.Alloc
 		for ; itr.Valid(); itr.Next() {
@@ -89,13 +592,13 @@ func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 				}
 			}
 
-			// clear txn bits
-			meta := item.meta &^ (bitTxn | bitFinTxn)
+			// clear txn bits, and the user metadata bit, since the user metadata is in UserMeta.
+			meta := item.meta &^ (bitTxn | bitFinTxn | bitUserMetadata)
 			kv := y.NewKV(a)
 			*kv = pb.KV{
 				Key:       a.Copy(item.Key()),
 				Value:     valCopy,
-				UserMeta:  a.Copy([]byte{item.UserMeta()}),
+				UserMeta:  a.Copy(kvUserMeta(item.UserMeta(), item.UserMetadata())),
 				Version:   item.Version(),
 				ExpiresAt: item.ExpiresAt(),
 				Meta:      a.Copy([]byte{meta}),
@@ -119,34 +622,15 @@ func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 		}
 		return list, nil
 	}
-
-	var maxVersion uint64
-	stream.Send = func(buf *z.Buffer) error {
-		list, err := BufferToKVList(buf)
-		if err != nil {
-			return err
-		}
-		out := list.Kv[:0]
-		for _, kv := range list.Kv {
-			if maxVersion < kv.Version {
-				maxVersion = kv.Version
-			}
-			if !kv.StreamDone {
-				// Don't pick stream done changes.
-				out = append(out, kv)
-			}
-		}
-		list.Kv = out
-		return writeTo(list, w)
-	}
-
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		return 0, err
-	}
-	return maxVersion, nil
 }
 
 func writeTo(list *pb.KVList, w io.Writer) error {
+	return writeList(list, w, false)
+}
+
+// writeList writes the size of list and list to w, followed by the CRC32 of list if checksum is
+// set.
+func writeList(list *pb.KVList, w io.Writer, checksum bool) error {
 	if err := binary.Write(w, binary.LittleEndian, uint64(proto.Size(list))); err != nil {
 		return err
 	}
@@ -154,10 +638,63 @@ func writeTo(list *pb.KVList, w io.Writer) error {
 	if err != nil {
 		return err
 	}
+	if checksum {
+		buf = append(buf, y.U32ToBytes(crc32.Checksum(buf, y.CastagnoliCrcTable))...)
+	}
 	_, err = w.Write(buf)
 	return err
 }
 
+// readFrom reads the lists written by writeTo from r, and calls fn for each of them, until r
+// returns io.EOF.
+func readFrom(r io.Reader, fn func(list *pb.KVList) error) error {
+	return readLists(r, false, fn)
+}
+
+// readLists is like readFrom, but reads the lists written by writeList, with their checksums if
+// checksums is set, which it verifies.
+func readLists(r io.Reader, checksums bool, fn func(list *pb.KVList) error) error {
+	br := bufio.NewReaderSize(r, 16<<10)
+	unmarshalBuf := make([]byte, 1<<10)
+	for {
+		var sz uint64
+		err := binary.Read(br, binary.LittleEndian, &sz)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if sz > maxListSize {
+			return errors.Wrapf(ErrInvalidDump, "list of %d bytes", sz)
+		}
+
+		if cap(unmarshalBuf) < int(sz) {
+			unmarshalBuf = make([]byte, sz)
+		}
+
+		if _, err = io.ReadFull(br, unmarshalBuf[:sz]); err != nil {
+			return err
+		}
+		if checksums {
+			var sum [4]byte
+			if _, err = io.ReadFull(br, sum[:]); err != nil {
+				return err
+			}
+			if crc32.Checksum(unmarshalBuf[:sz], y.CastagnoliCrcTable) != y.BytesToU32(sum[:]) {
+				return errors.Wrapf(ErrInvalidDump, "checksum mismatch of a list of %d bytes", sz)
+			}
+		}
+
+		list := &pb.KVList{}
+		if err := proto.Unmarshal(unmarshalBuf[:sz], list); err != nil {
+			return err
+		}
+		if err := fn(list); err != nil {
+			return err
+		}
+	}
+}
+
 // KVLoader is used to write KVList objects in to badger. It can be used to restore a backup.
 type KVLoader struct {
 	db          *DB
@@ -178,21 +715,23 @@ func (db *DB) NewKVLoader(maxPendingWrites int) *KVLoader {
 
 // Set writes the key-value pair to the database.
 func (l *KVLoader) Set(kv *pb.KV) error {
-	var userMeta, meta byte
-	if len(kv.UserMeta) > 0 {
-		userMeta = kv.UserMeta[0]
-	}
+	var meta byte
 	if len(kv.Meta) > 0 {
 		meta = kv.Meta[0]
 	}
+	userMeta, md := parseKVUserMeta(kv.UserMeta)
+	if err := checkUserMetadata(md); err != nil {
+		return err
+	}
 	e := &Entry{
-		Key:       y.KeyWithTs(kv.Key, kv.Version),
-		Value:     kv.Value,
-		UserMeta:  userMeta,
-		ExpiresAt: kv.ExpiresAt,
-		meta:      meta,
+		Key:          y.KeyWithTs(kv.Key, kv.Version),
+		Value:        kv.Value,
+		UserMeta:     userMeta,
+		UserMetadata: md,
+		ExpiresAt:    kv.ExpiresAt,
+		meta:         meta &^ bitUserMetadata,
 	}
-	estimatedSize := e.estimateSizeAndSetThreshold(l.db.valueThreshold())
+	estimatedSize := e.estimateSizeAndSetThreshold(l.db.valueThresholdFor(e.Key))
 	// Flush entries if inserting the next entry would overflow the transactional limits.
 	if int64(len(l.entries))+1 >= l.db.opt.maxBatchCount ||
 		l.entriesSize+estimatedSize >= l.db.opt.maxBatchSize ||
@@ -241,43 +780,39 @@ func (l *KVLoader) Finish() error {
 // DB.Load() should be called on a database that is not running any other
 // concurrent transactions while it is running.
 func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
-	br := bufio.NewReaderSize(r, 16<<10)
-	unmarshalBuf := make([]byte, 1<<10)
-
-	ldr := db.NewKVLoader(maxPendingWrites)
-	for {
-		var sz uint64
-		err := binary.Read(br, binary.LittleEndian, &sz)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
+	return db.LoadWithOptions(r, maxPendingWrites, BackupOptions{})
+}
 
-		if cap(unmarshalBuf) < int(sz) {
-			unmarshalBuf = make([]byte, sz)
-		}
+// LoadWithOptions is like Load, but also loads the backups made by BackupWithOptions. The
+// compression of the backup is read from it, so only opt.EncryptionKey is used, to decrypt it.
+func (db *DB) LoadWithOptions(r io.Reader, maxPendingWrites int, opt BackupOptions) error {
+	return db.LoadContext(context.Background(), r, maxPendingWrites, opt)
+}
 
-		if _, err = io.ReadFull(br, unmarshalBuf[:sz]); err != nil {
-			return err
-		}
+// LoadContext is like LoadWithOptions, but stops once ctx is done, returning ctx.Err(). The
+// entries loaded by then are kept, so the backup should be loaded again into a new DB.
+func (db *DB) LoadContext(ctx context.Context, r io.Reader, maxPendingWrites int,
+	opt BackupOptions) error {
+	br, err := newBackupReader(r, opt.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	defer br.close()
 
-		list := &pb.KVList{}
-		if err := proto.Unmarshal(unmarshalBuf[:sz], list); err != nil {
+	ldr := db.NewKVLoader(maxPendingWrites)
+	err = br.readFrom(func(list *pb.KVList) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-
 		for _, kv := range list.Kv {
-			if err := ldr.Set(kv); err != nil {
+			if err := db.loadKV(ldr, kv); err != nil {
 				return err
 			}
-
-			// Update nextTxnTs, memtable stores this
-			// timestamp in badger head when flushed.
-			if kv.Version >= db.orc.nextTxnTs {
-				db.orc.nextTxnTs = kv.Version + 1
-			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	if err := ldr.Finish(); err != nil {
@@ -286,3 +821,45 @@ func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
 	db.orc.txnMark.Done(db.orc.nextTxnTs - 1)
 	return nil
 }
+
+// loadKV sets kv in ldr, and updates nextTxnTs so that kv is visible once loaded.
+func (db *DB) loadKV(ldr *KVLoader, kv *pb.KV) error {
+	if err := ldr.Set(kv); err != nil {
+		return err
+	}
+	// Update nextTxnTs, memtable stores this
+	// timestamp in badger head when flushed.
+	if kv.Version >= db.orc.nextTxnTs {
+		db.orc.nextTxnTs = kv.Version + 1
+	}
+	return nil
+}
+
+// BackupToURL is like Backup, but writes the backup to object storage, at an s3:// or gs:// URL,
+// instead of a local file. The object is only created if the backup succeeds. ctx cancels the
+// backup and the requests to object storage.
+func (db *DB) BackupToURL(ctx context.Context, rawurl string, since uint64,
+	opt objstore.Options) (uint64, error) {
+	w, err := objstore.NewWriter(ctx, rawurl, opt)
+	if err != nil {
+		return 0, err
+	}
+	ts, err := db.newBackupStream(since).backup(ctx, w, since)
+	if err != nil {
+		_ = w.Abort()
+		return 0, err
+	}
+	return ts, w.Close()
+}
+
+// LoadFromURL is like Load, but reads the backup from object storage, at an s3:// or gs:// URL.
+// ctx cancels the load and the requests to object storage.
+func (db *DB) LoadFromURL(ctx context.Context, rawurl string, maxPendingWrites int,
+	opt objstore.Options) error {
+	r, err := objstore.NewReader(ctx, rawurl, opt)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return db.LoadContext(ctx, r, maxPendingWrites, BackupOptions{})
+}
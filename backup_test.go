@@ -18,17 +18,27 @@ package badger
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -563,3 +573,319 @@ func TestBackupBitClear(t *testing.T) {
 		return nil
 	}))
 }
+
+func TestBackupToURL(t *testing.T) {
+	// A minimal object storage server, for the objects uploaded in a single request.
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			buf, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			objects[r.URL.Path] = buf
+		case http.MethodGet:
+			buf, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(buf)
+		}
+	}))
+	defer srv.Close()
+	opt := objstore.Options{Endpoint: srv.URL, AccessKeyID: "id", SecretAccessKey: "secret"}
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		_, err := db.BackupToURL(context.Background(), "s3://bucket/badger.bak", 0, opt)
+		require.NoError(t, err)
+	})
+	require.Contains(t, objects, "/bucket/badger.bak")
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.LoadFromURL(context.Background(), "s3://bucket/badger.bak", 16, opt))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+				require.NoError(t, err)
+				require.NoError(t, item.Value(func(val []byte) error {
+					require.Equal(t, []byte("value"), val)
+					return nil
+				}))
+			}
+			return nil
+		}))
+	})
+}
+
+func TestBackupWithOptions(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	value := bytes.Repeat([]byte("secret value "), 10)
+	var backups [][]byte
+	opts := []BackupOptions{
+		{},
+		{Compression: options.ZSTD, ZSTDCompressionLevel: 1},
+		{EncryptionKey: key},
+		{Compression: options.ZSTD, ZSTDCompressionLevel: 3, EncryptionKey: key},
+	}
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		for _, opt := range opts {
+			var buf bytes.Buffer
+			_, err := db.BackupWithOptions(&buf, 0, opt)
+			require.NoError(t, err)
+			backups = append(backups, buf.Bytes())
+		}
+	})
+	// The compressed backups are smaller, and the encrypted ones don't leak the values.
+	require.True(t, len(backups[1]) < len(backups[0]))
+	require.True(t, bytes.Contains(backups[0], value))
+	require.False(t, bytes.Contains(backups[2], value))
+
+	for i, opt := range opts {
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			if len(opt.EncryptionKey) > 0 {
+				err := db.Load(bytes.NewReader(backups[i]), 16)
+				require.Equal(t, ErrBackupKeyMismatch, err)
+				err = db.LoadWithOptions(bytes.NewReader(backups[i]), 16,
+					BackupOptions{EncryptionKey: []byte("fedcba9876543210")})
+				require.Equal(t, ErrBackupKeyMismatch, err)
+			}
+			// The compression is read from the backup.
+			require.NoError(t, db.LoadWithOptions(bytes.NewReader(backups[i]), 16,
+				BackupOptions{EncryptionKey: opt.EncryptionKey}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				for i := 0; i < 100; i++ {
+					item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+					require.NoError(t, err)
+					require.NoError(t, item.Value(func(val []byte) error {
+						require.Equal(t, value, val)
+						return nil
+					}))
+				}
+				return nil
+			}))
+		})
+	}
+}
+
+func TestBackupContext(t *testing.T) {
+	var backup bytes.Buffer
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), []byte("value"))
+		}))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := db.BackupContext(ctx, ioutil.Discard, 0, BackupOptions{})
+		require.Equal(t, context.Canceled, err)
+		_, err = db.BackupContext(context.Background(), &backup, 0, BackupOptions{})
+		require.NoError(t, err)
+	})
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := db.LoadContext(ctx, bytes.NewReader(backup.Bytes()), 16, BackupOptions{})
+		require.Equal(t, context.Canceled, err)
+		require.NoError(t, db.LoadContext(context.Background(),
+			bytes.NewReader(backup.Bytes()), 16, BackupOptions{}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), getItemValue(t, item))
+			return nil
+		}))
+	})
+}
+
+func TestBackupAuthentication(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	opt := BackupOptions{EncryptionKey: key}
+	var backup bytes.Buffer
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				val := make([]byte, 2<<10)
+				rand.Read(val)
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		_, err := db.BackupWithOptions(&backup, 0, opt)
+		require.NoError(t, err)
+	})
+
+	// Split the backup in its header and its sealed chunks.
+	data := backup.Bytes()
+	headerLen := len(backupMagic) + 3 + 16 + backupKeyCheckSize
+	var chunks [][]byte
+	for off := headerLen; off < len(data); {
+		sz := 5 + int(binary.LittleEndian.Uint32(data[off+1:]))
+		chunks = append(chunks, data[off:off+sz])
+		off += sz
+	}
+	require.Greater(t, len(chunks), 2)
+	join := func(chunks ...[]byte) []byte {
+		return append(append([]byte{}, data[:headerLen]...), bytes.Join(chunks, nil)...)
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 1
+	for name, corrupted := range map[string][]byte{
+		"flipped bit":     flipped,
+		"truncated":       data[:len(data)-1],
+		"no last chunk":   join(chunks[:len(chunks)-1]...),
+		"swapped chunks":  join(append([][]byte{chunks[1], chunks[0]}, chunks[2:]...)...),
+		"data after last": append(join(chunks...), chunks[0]...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+				_, err := db.VerifyBackupWithOptions(bytes.NewReader(corrupted), opt)
+				require.Equal(t, ErrInvalidDump, errors.Cause(err))
+				err = db.LoadWithOptions(bytes.NewReader(corrupted), 16, opt)
+				require.Equal(t, ErrInvalidDump, errors.Cause(err))
+			})
+		})
+	}
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.LoadWithOptions(bytes.NewReader(data), 16, opt))
+	})
+}
+
+func TestBackupUnauthenticated(t *testing.T) {
+	// The backups encrypted with AES-CTR are still read.
+	key := []byte("0123456789abcdef")
+	iv, err := y.GenerateIV()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	buf.WriteString(backupMagic)
+	buf.Write([]byte{backupFormatVersion, byte(options.None), backupEncryptionAES})
+	buf.Write(iv)
+	buf.Write(backupKeyCheck(key, iv))
+	s, err := y.XORStream(key, iv)
+	require.NoError(t, err)
+	list := &pb.KVList{Kv: []*pb.KV{{Key: []byte("key"), Value: []byte("value"), Version: 1}}}
+	require.NoError(t, writeList(list, cipher.StreamWriter{S: s, W: &buf}, true))
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.LoadWithOptions(&buf, 16, BackupOptions{EncryptionKey: key}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), item.Version())
+			return nil
+		}))
+	})
+}
+
+func TestVerifyBackup(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 3; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := 0; j < 10; j++ {
+					if err := txn.Set([]byte(fmt.Sprintf("key%02d", j)), []byte("value")); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Delete([]byte("key00"))
+		}))
+
+		var buf1, buf2 bytes.Buffer
+		_, err := db.Backup(&buf1, 0)
+		require.NoError(t, err)
+		opt := BackupOptions{Compression: options.ZSTD, EncryptionKey: []byte("0123456789abcdef")}
+		_, err = db.BackupWithOptions(&buf2, 0, opt)
+		require.NoError(t, err)
+
+		s, err := db.VerifyBackup(bytes.NewReader(buf1.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, 10, s.Keys)
+		// key00 only has its delete, the older versions being hidden by it.
+		require.Equal(t, 1+9*3, s.Entries)
+		require.Equal(t, 1, s.Deletes)
+		require.Equal(t, uint64(1), s.MinVersion)
+		require.Equal(t, uint64(4), s.MaxVersion)
+		require.NotZero(t, s.Checksum)
+		require.False(t, s.Checksummed)
+
+		// The summary doesn't depend on the format of the backup, but only the backups made by
+		// BackupWithOptions have checksums.
+		s2, err := db.VerifyBackupWithOptions(bytes.NewReader(buf2.Bytes()), opt)
+		require.NoError(t, err)
+		require.True(t, s2.Checksummed)
+		s.Checksummed = true
+		require.Equal(t, s, s2)
+		_, err = db.VerifyBackup(bytes.NewReader(buf2.Bytes()))
+		require.Equal(t, ErrBackupKeyMismatch, err)
+
+		// A backup truncated within a list is invalid.
+		_, err = db.VerifyBackup(bytes.NewReader(buf1.Bytes()[:buf1.Len()-3]))
+		require.Equal(t, ErrInvalidDump, errors.Cause(err))
+		// So is a backup whose list size is corrupted.
+		corrupted := append([]byte{}, buf1.Bytes()...)
+		corrupted[7] = 0xff
+		_, err = db.VerifyBackup(bytes.NewReader(corrupted))
+		require.Equal(t, ErrInvalidDump, errors.Cause(err))
+	})
+}
+
+func TestVerifyBackupChecksums(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), []byte("value"))
+		}))
+		var buf1, buf2 bytes.Buffer
+		_, err := db.Backup(&buf1, 0)
+		require.NoError(t, err)
+		_, err = db.BackupWithOptions(&buf2, 0, BackupOptions{})
+		require.NoError(t, err)
+
+		// A value corrupted in a list still decodes, so only the checksum of the list detects it.
+		corrupt := func(b []byte) []byte {
+			b = append([]byte{}, b...)
+			i := bytes.Index(b, []byte("value"))
+			require.True(t, i >= 0)
+			b[i] = 'V'
+			return b
+		}
+		s, err := db.VerifyBackup(bytes.NewReader(corrupt(buf1.Bytes())))
+		require.NoError(t, err)
+		require.False(t, s.Checksummed)
+		_, err = db.VerifyBackup(bytes.NewReader(corrupt(buf2.Bytes())))
+		require.Equal(t, ErrInvalidDump, errors.Cause(err))
+		require.Contains(t, err.Error(), "checksum mismatch")
+
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		db2, err := Open(getTestOptions(dir))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db2.Close()) }()
+		err = db2.LoadWithOptions(bytes.NewReader(corrupt(buf2.Bytes())), 10, BackupOptions{})
+		require.Equal(t, ErrInvalidDump, errors.Cause(err))
+	})
+}
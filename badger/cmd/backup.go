@@ -18,16 +18,21 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"math"
 	"os"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/spf13/cobra"
 )
 
 var bo = struct {
 	backupFile  string
 	numVersions int
+	compress    bool
+	keyPath     string
 }{}
 
 // backupCmd represents the backup command
@@ -39,7 +44,16 @@ var backupCmd = &cobra.Command{
 Iterates over each key-value pair, encodes it along with its metadata and
 version in protocol buffers and writes them to a file. This file can later be
 used by the restore command to create an identical copy of the
-database.`,
+database.
+
+The backup file can be an s3:// or gs:// URL, in which case the backup is
+streamed to object storage with a multipart upload. The credentials are read
+from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN for S3, and
+from the HMAC key in GCS_ACCESS_KEY_ID and GCS_SECRET_ACCESS_KEY for GCS.
+
+The backup can be compressed with ZSTD and encrypted with its own key, whether
+or not the database is encrypted. The restore command reads the compression
+from the backup, and needs the key to restore an encrypted backup.`,
 	RunE: doBackup,
 }
 
@@ -49,6 +63,11 @@ func init() {
 		"badger.bak", "File to backup to")
 	backupCmd.Flags().IntVarP(&bo.numVersions, "num-versions", "n",
 		0, "Number of versions to keep. A value <= 0 means keep all versions.")
+	backupCmd.Flags().BoolVar(&bo.compress, "compress", false,
+		"Compress the backup with ZSTD.")
+	backupCmd.Flags().StringVar(&bo.keyPath, "backup-key-file", "",
+		"Path of the key the backup is encrypted with, of 16, 24 or 32 bytes.")
+	addObjstoreFlags(backupCmd, true)
 }
 
 func doBackup(cmd *cobra.Command, args []string) error {
@@ -67,6 +86,31 @@ func doBackup(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
+	var bopt badger.BackupOptions
+	if bo.compress {
+		bopt.Compression = options.ZSTD
+		bopt.ZSTDCompressionLevel = 1
+	}
+	if bopt.EncryptionKey, err = getKey(bo.keyPath); err != nil {
+		return err
+	}
+
+	if objstore.IsURL(bo.backupFile) {
+		storeOpt, err := objstoreOptions(bo.backupFile)
+		if err != nil {
+			return err
+		}
+		w, err := objstore.NewWriter(context.Background(), bo.backupFile, storeOpt)
+		if err != nil {
+			return err
+		}
+		if _, err := db.BackupWithOptions(w, 0, bopt); err != nil {
+			_ = w.Abort()
+			return err
+		}
+		return w.Close()
+	}
+
 	// Create File
 	f, err := os.Create(bo.backupFile)
 	if err != nil {
@@ -74,7 +118,7 @@ func doBackup(cmd *cobra.Command, args []string) error {
 	}
 
 	bw := bufio.NewWriterSize(f, 64<<20)
-	if _, err = db.Backup(bw, 0); err != nil {
+	if _, err = db.BackupWithOptions(bw, 0, bopt); err != nil {
 		return err
 	}
 
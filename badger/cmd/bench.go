@@ -21,8 +21,9 @@ import (
 )
 
 var benchCmd = &cobra.Command{
-	Use:   "benchmark",
-	Short: "Benchmark Badger database.",
+	Use:     "benchmark",
+	Aliases: []string{"bench"},
+	Short:   "Benchmark Badger database.",
 	Long: `This command will benchmark Badger for different usecases. 
 	Useful for testing and performance analysis.`,
 }
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var compactOpt = struct {
+	keyRange string
+	toLevel  int
+	dryRun   bool
+	keyPath  string
+}{}
+
+var compactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Compact a key range of the LSM tree into a level.",
+	Long: `Compact the keys of a --range down to a level of the LSM tree, by merging the
+tables of each level holding keys of the range into the level below it. The
+progress, the bytes remaining and the estimated time left are printed after each
+level.
+
+The range is written as start..end, where the end is exclusive, and either of
+them can be left out. The keys are written like in the shell command: as plain
+words, or as hex with a 0x prefix.`,
+	RunE: doCompact,
+}
+
+func init() {
+	RootCmd.AddCommand(compactCmd)
+	compactCmd.Flags().StringVar(&compactOpt.keyRange, "range", "..",
+		"Range of the keys to compact, as start..end.")
+	compactCmd.Flags().IntVar(&compactOpt.toLevel, "to-level", 0,
+		"Level to compact the keys into. 0 for the last level.")
+	compactCmd.Flags().BoolVar(&compactOpt.dryRun, "dry-run", false,
+		"Only print the tables which would be compacted.")
+	compactCmd.Flags().StringVar(&compactOpt.keyPath, "encryption-key-file", "",
+		"Path of the encryption key file.")
+}
+
+func doCompact(cmd *cobra.Command, args []string) error {
+	start, end, err := parseKeyRange(compactOpt.keyRange)
+	if err != nil {
+		return err
+	}
+	encKey, err := getKey(compactOpt.keyPath)
+	if err != nil {
+		return err
+	}
+	db, err := badger.Open(badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithNumCompactors(0).
+		WithReadOnly(compactOpt.dryRun).
+		WithEncryptionKey(encKey).
+		WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	opt := badger.CompactRangeOptions{
+		Start:   start,
+		End:     end,
+		ToLevel: compactOpt.toLevel,
+		DryRun:  compactOpt.dryRun,
+		Progress: func(p badger.CompactProgress) {
+			printCompactProgress(os.Stdout, p)
+		},
+	}
+	steps, err := db.CompactRange(opt)
+	if err != nil {
+		return err
+	}
+	if compactOpt.dryRun {
+		printCompactSteps(os.Stdout, steps)
+	}
+	return nil
+}
+
+// parseKeyRange parses a key range written as start..end. A missing start or end is returned as
+// nil.
+func parseKeyRange(s string) ([]byte, []byte, error) {
+	i := strings.Index(s, "..")
+	if i < 0 {
+		return nil, nil, errors.Errorf("Invalid range %q, it must be written as start..end", s)
+	}
+	var keys [2][]byte
+	for j, k := range []string{s[:i], s[i+2:]} {
+		if k == "" {
+			continue
+		}
+		key, err := parseShellBytes(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[j] = key
+	}
+	return keys[0], keys[1], nil
+}
+
+func printCompactSteps(w io.Writer, steps []badger.CompactStep) {
+	if len(steps) == 0 {
+		fmt.Fprintln(w, "Nothing to compact.")
+		return
+	}
+	var total int64
+	for _, s := range steps {
+		fmt.Fprintf(w, "L%d -> L%d: %d tables (%s) with %d tables (%s)\n", s.Level, s.OutputLevel,
+			len(s.Tables), hbytes(s.Bytes), len(s.NextTables), hbytes(s.NextBytes))
+		total += s.Bytes + s.NextBytes
+	}
+	fmt.Fprintf(w, "Would compact %s.\n", hbytes(total))
+}
+
+// printCompactProgress prints the last level compacted, the size of the levels, and the bytes and
+// time remaining.
+func printCompactProgress(w io.Writer, p badger.CompactProgress) {
+	fmt.Fprintf(w, "L%d -> L%d done. Levels:", p.Level, p.OutputLevel)
+	for level, sz := range p.LevelSizes {
+		fmt.Fprintf(w, " L%d %s", level, hbytes(sz))
+	}
+	fmt.Fprintf(w, "\nCompacted %s in %s, %s remaining", hbytes(p.DoneBytes),
+		p.Elapsed.Round(time.Second), hbytes(p.RemainingBytes))
+	if p.RemainingBytes > 0 && p.ETA > 0 {
+		fmt.Fprintf(w, ", ETA %s", p.ETA.Round(time.Second))
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyRange(t *testing.T) {
+	tests := []struct {
+		s          string
+		start, end []byte
+	}{
+		{"a..b", []byte("a"), []byte("b")},
+		{"..b", nil, []byte("b")},
+		{"a..", []byte("a"), nil},
+		{"..", nil, nil},
+		{"0x00..0xff", []byte{0}, []byte{0xff}},
+	}
+	for _, tc := range tests {
+		start, end, err := parseKeyRange(tc.s)
+		require.NoError(t, err)
+		require.Equal(t, tc.start, start, tc.s)
+		require.Equal(t, tc.end, end, tc.s)
+	}
+	_, _, err := parseKeyRange("a-b")
+	require.Error(t, err)
+}
+
+func TestPrintCompact(t *testing.T) {
+	var buf bytes.Buffer
+	printCompactSteps(&buf, []badger.CompactStep{
+		{Level: 0, OutputLevel: 3, Tables: []uint64{1, 2}, Bytes: 2048, NextTables: []uint64{3},
+			NextBytes: 1024},
+		{Level: 3, OutputLevel: 6, Tables: []uint64{4}, Bytes: 100},
+	})
+	require.Equal(t, ""+
+		"L0 -> L3: 2 tables (2.0 KiB) with 1 tables (1.0 KiB)\n"+
+		"L3 -> L6: 1 tables (100 B) with 0 tables (0 B)\n"+
+		"Would compact 3.1 KiB.\n", buf.String())
+
+	buf.Reset()
+	printCompactProgress(&buf, badger.CompactProgress{
+		Level:          0,
+		OutputLevel:    3,
+		LevelSizes:     []int64{0, 0, 0, 4096},
+		DoneBytes:      1024,
+		RemainingBytes: 3072,
+		Elapsed:        2 * time.Second,
+		ETA:            6 * time.Second,
+	})
+	require.Equal(t, ""+
+		"L0 -> L3 done. Levels: L0 0 B L1 0 B L2 0 B L3 4.0 KiB\n"+
+		"Compacted 1.0 KiB in 2s, 3.0 KiB remaining, ETA 6s\n", buf.String())
+
+	buf.Reset()
+	printFlattenPlan(&buf, []badger.LevelInfo{
+		{Level: 0, NumTables: 2, Size: 2048},
+		{Level: 1},
+		{Level: 2, NumTables: 1, Size: 1024},
+		{Level: 3, NumTables: 4, Size: 8192},
+	})
+	require.Equal(t, ""+
+		"L0 -> L3: 2 tables (2.0 KiB)\n"+
+		"L2 -> L3: 1 tables (1.0 KiB)\n"+
+		"Would compact 3.0 KiB.\n", buf.String())
+}
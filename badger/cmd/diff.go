@@ -0,0 +1,326 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/spf13/cobra"
+)
+
+var diffOpt = struct {
+	prefix        string
+	keysOnly      bool
+	hash          bool
+	versions      bool
+	quiet         bool
+	maxValue      int
+	backupKeyPath string
+	keyPath       string
+}{}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <a> <b>",
+	Short: "Compare two backups or two Badger databases.",
+	Long: `Compare the latest versions of the keys of two backups made by the backup
+command, or of two DB directories, and print the keys added to b, removed from
+it, and changed in it. Each of a and b can be a directory, opened in read-only
+mode, or a file or s3:// or gs:// URL of a backup, which is loaded in a
+temporary directory first. It doesn't need --dir.
+
+The values are compared by their hash, along with their user meta and expiry
+and, with --versions, their versions. The command exits with status 1 if the
+keys differ, like diff does.`,
+	Args: cobra.ExactArgs(2),
+	// The DBs to compare are given as arguments, so --dir isn't needed.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+	RunE:              doDiff,
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVar(&diffOpt.prefix, "prefix", "", "Prefix of the keys to compare.")
+	diffCmd.Flags().BoolVar(&diffOpt.keysOnly, "keys-only", false,
+		"Only compare which keys are present, not their values.")
+	diffCmd.Flags().BoolVar(&diffOpt.hash, "hash", false,
+		"Print the hashes of the values instead of the values.")
+	diffCmd.Flags().BoolVar(&diffOpt.versions, "versions", false,
+		"Also report the keys whose latest versions differ.")
+	diffCmd.Flags().BoolVarP(&diffOpt.quiet, "quiet", "q", false, "Only print the summary.")
+	diffCmd.Flags().IntVar(&diffOpt.maxValue, "max-value", 64,
+		"Number of bytes of the values to print.")
+	diffCmd.Flags().StringVar(&diffOpt.backupKeyPath, "backup-key-file", "",
+		"Path of the key the backups are encrypted with, if they are encrypted.")
+	diffCmd.Flags().StringVar(&diffOpt.keyPath, "encryption-key-file", "",
+		"Path of the encryption key file of the DB directories.")
+	addObjstoreFlags(diffCmd, false)
+}
+
+func doDiff(cmd *cobra.Command, args []string) error {
+	differ, err := runDiff(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if differ {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func runDiff(pathA, pathB string) (bool, error) {
+	prefix, err := parseShellBytes(diffOpt.prefix)
+	if err != nil {
+		return false, err
+	}
+	a, closeA, err := openDiffDB(pathA)
+	if err != nil {
+		return false, err
+	}
+	defer closeA()
+	b, closeB, err := openDiffDB(pathB)
+	if err != nil {
+		return false, err
+	}
+	defer closeB()
+
+	d := &differ{
+		out:      os.Stdout,
+		prefix:   prefix,
+		keysOnly: diffOpt.keysOnly,
+		hash:     diffOpt.hash,
+		versions: diffOpt.versions,
+		quiet:    diffOpt.quiet,
+		maxValue: diffOpt.maxValue,
+	}
+	if err := d.diff(a, b); err != nil {
+		return false, err
+	}
+	d.printSummary()
+	return d.added+d.removed+d.changed > 0, nil
+}
+
+// openDiffDB opens the DB in the directory path in read-only mode, or loads the backup in the file
+// or URL path into a temporary DB. The function returned closes the DB, and removes the temporary
+// one.
+func openDiffDB(path string) (*badger.DB, func(), error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		encKey, err := getKey(diffOpt.keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		db, err := badger.Open(badger.DefaultOptions(path).
+			WithReadOnly(true).
+			WithEncryptionKey(encKey).
+			WithLoggingLevel(badger.WARNING))
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, func() { db.Close() }, nil
+	}
+
+	var bopt badger.BackupOptions
+	var err error
+	if bopt.EncryptionKey, err = getKey(diffOpt.backupKeyPath); err != nil {
+		return nil, nil, err
+	}
+	r, err := openBackupFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	dir, err := ioutil.TempDir("", "badger-diff")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	if err := db.LoadWithOptions(r, 256, bopt); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return db, cleanup, nil
+}
+
+// differ prints the differences between the keys of two DBs, and counts them.
+type differ struct {
+	out      io.Writer
+	prefix   []byte
+	keysOnly bool
+	hash     bool
+	versions bool
+	quiet    bool
+	maxValue int
+
+	added, removed, changed, same int
+}
+
+// diffItem is the latest version of a key, with the hash of its value.
+type diffItem struct {
+	version   uint64
+	userMeta  byte
+	expiresAt uint64
+	size      int64
+	hash      uint64
+	value     []byte
+}
+
+func (d *differ) diff(a, b *badger.DB) error {
+	txnA, txnB := a.NewTransaction(false), b.NewTransaction(false)
+	defer txnA.Discard()
+	defer txnB.Discard()
+	iopt := badger.DefaultIteratorOptions
+	iopt.Prefix = d.prefix
+	iopt.PrefetchValues = false
+	itA, itB := txnA.NewIterator(iopt), txnB.NewIterator(iopt)
+	defer itA.Close()
+	defer itB.Close()
+
+	itA.Rewind()
+	itB.Rewind()
+	for itA.Valid() || itB.Valid() {
+		var cmp int
+		switch {
+		case !itA.Valid():
+			cmp = 1
+		case !itB.Valid():
+			cmp = -1
+		default:
+			cmp = bytes.Compare(itA.Item().Key(), itB.Item().Key())
+		}
+
+		switch {
+		case cmp < 0:
+			ia, err := d.read(itA.Item())
+			if err != nil {
+				return err
+			}
+			d.removed++
+			d.printf("- %s%s\n", formatShellBytes(itA.Item().Key()), d.format(ia))
+			itA.Next()
+		case cmp > 0:
+			ib, err := d.read(itB.Item())
+			if err != nil {
+				return err
+			}
+			d.added++
+			d.printf("+ %s%s\n", formatShellBytes(itB.Item().Key()), d.format(ib))
+			itB.Next()
+		default:
+			ia, err := d.read(itA.Item())
+			if err != nil {
+				return err
+			}
+			ib, err := d.read(itB.Item())
+			if err != nil {
+				return err
+			}
+			if d.equal(ia, ib) {
+				d.same++
+			} else {
+				d.changed++
+				d.printf("~ %s%s ->%s\n", formatShellBytes(itA.Item().Key()), d.format(ia),
+					d.format(ib))
+			}
+			itA.Next()
+			itB.Next()
+		}
+	}
+	return nil
+}
+
+// read returns the latest version of the key of item. Its value is only kept if it is printed.
+func (d *differ) read(item *badger.Item) (diffItem, error) {
+	di := diffItem{
+		version:   item.Version(),
+		userMeta:  item.UserMeta(),
+		expiresAt: item.ExpiresAt(),
+	}
+	if d.keysOnly {
+		return di, nil
+	}
+	err := item.Value(func(val []byte) error {
+		di.hash = xxhash.Sum64(val)
+		di.size = int64(len(val))
+		if !d.hash && !d.quiet {
+			n := len(val)
+			if n > d.maxValue {
+				n = d.maxValue
+			}
+			di.value = append([]byte{}, val[:n]...)
+		}
+		return nil
+	})
+	return di, err
+}
+
+func (d *differ) equal(a, b diffItem) bool {
+	if d.versions && a.version != b.version {
+		return false
+	}
+	return d.keysOnly || (a.hash == b.hash && a.size == b.size && a.userMeta == b.userMeta &&
+		a.expiresAt == b.expiresAt)
+}
+
+// format returns the description of di printed after its key.
+func (d *differ) format(di diffItem) string {
+	var s string
+	if d.versions {
+		s += fmt.Sprintf(" @%d", di.version)
+	}
+	if d.keysOnly {
+		return s
+	}
+	if d.hash {
+		s += fmt.Sprintf(" #%016x", di.hash)
+	} else {
+		s += " " + formatShellBytes(di.value)
+		if di.size > int64(len(di.value)) {
+			s += fmt.Sprintf("... (%s)", hbytes(di.size))
+		}
+	}
+	if di.userMeta != 0 {
+		s += fmt.Sprintf(" meta=%d", di.userMeta)
+	}
+	if di.expiresAt > 0 {
+		s += fmt.Sprintf(" expires=%d", di.expiresAt)
+	}
+	return s
+}
+
+func (d *differ) printf(format string, args ...interface{}) {
+	if !d.quiet {
+		fmt.Fprintf(d.out, format, args...)
+	}
+}
+
+func (d *differ) printSummary() {
+	fmt.Fprintf(d.out, "%d added, %d removed, %d changed, %d same.\n",
+		d.added, d.removed, d.changed, d.same)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	open := func(kvs ...string) *badger.DB {
+		db, err := badger.Open(badger.DefaultOptions("").
+			WithInMemory(true).
+			WithLoggingLevel(badger.WARNING))
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(txn *badger.Txn) error {
+			for i := 0; i < len(kvs); i += 2 {
+				if err := txn.Set([]byte(kvs[i]), []byte(kvs[i+1])); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		return db
+	}
+	a := open("k1", "v1", "k2", "v2", "k3", "v3", "x", "1")
+	defer a.Close()
+	b := open("k2", "v2", "k3", "new", "k4", "v4", "x", "1")
+	defer b.Close()
+	// The version of x is 1 in a, and 2 in b.
+	require.NoError(t, b.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("x"), []byte("1"))
+	}))
+
+	run := func(d *differ) string {
+		var buf bytes.Buffer
+		d.out = &buf
+		require.NoError(t, d.diff(a, b))
+		d.printSummary()
+		return buf.String()
+	}
+	require.Equal(t, ""+
+		"- k1 v1\n"+
+		"~ k3 v3 -> new\n"+
+		"+ k4 v4\n"+
+		"1 added, 1 removed, 1 changed, 2 same.\n", run(&differ{maxValue: 64}))
+	require.Equal(t, ""+
+		"- k1 @1\n"+
+		"+ k4 @1\n"+
+		"~ x @1 -> @2\n"+
+		"1 added, 1 removed, 1 changed, 2 same.\n", run(&differ{keysOnly: true, versions: true}))
+	require.Equal(t, fmt.Sprintf(""+
+		"~ k3 #%016x -> #%016x\n"+
+		"0 added, 0 removed, 1 changed, 0 same.\n", xxhash.Sum64String("v3"),
+		xxhash.Sum64String("new")), run(&differ{prefix: []byte("k3"), hash: true}))
+	require.Equal(t, "1 added, 1 removed, 1 changed, 2 same.\n", run(&differ{quiet: true}))
+	require.Equal(t, ""+
+		"- k1 v... (2 B)\n"+
+		"~ k3 v... (2 B) -> n... (3 B)\n"+
+		"+ k4 v... (2 B)\n"+
+		"1 added, 1 removed, 1 changed, 2 same.\n", run(&differ{maxValue: 1}))
+}
+
+func TestOpenDiffDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("key"), []byte("value"))
+	}))
+	backup := filepath.Join(dir, "badger.bak")
+	f, err := os.Create(backup)
+	require.NoError(t, err)
+	_, err = db.Backup(f, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, db.Close())
+
+	// The backup is loaded in a temporary directory, and the directory opened in read-only mode.
+	fromBackup, closeBackup, err := openDiffDB(backup)
+	require.NoError(t, err)
+	defer closeBackup()
+	fromDir, closeDir, err := openDiffDB(dir)
+	require.NoError(t, err)
+	defer closeDir()
+
+	d := &differ{out: ioutil.Discard}
+	require.NoError(t, d.diff(fromBackup, fromDir))
+	require.Equal(t, 1, d.same)
+	require.Zero(t, d.added+d.removed+d.changed)
+}
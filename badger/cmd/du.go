@@ -0,0 +1,164 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var duOpt = struct {
+	prefixDepth int
+	separator   string
+	withVlog    bool
+	sortBy      string
+	readOnly    bool
+}{}
+
+var duCmd = &cobra.Command{
+	Use:   "du",
+	Short: "Report the disk usage of a Badger database per key prefix.",
+	Long: `Report the bytes used in the LSM tree, per level, and in the value log by the
+keys of each prefix of a Badger database, like du does for the directories.
+
+The prefix of a key is the part up to and including its --prefix-depth-th
+--separator, or its last separator if it has fewer of them. The keys without
+separator are counted under "". Without separator, the prefix of a key is its
+first --prefix-depth bytes.
+
+The tables whose keys have a single prefix are counted without being read. The
+other tables are read, as well as all of them with --vlog, but the value log
+isn't. The values in the value log which no table points to anymore are
+reported as unreferenced.`,
+	RunE: doDu,
+}
+
+func init() {
+	RootCmd.AddCommand(duCmd)
+	duCmd.Flags().IntVar(&duOpt.prefixDepth, "prefix-depth", 1,
+		"Number of separators ending the prefixes, or length of the prefixes without separator.")
+	duCmd.Flags().StringVar(&duOpt.separator, "separator", "/", "Separator of the key prefixes.")
+	duCmd.Flags().BoolVar(&duOpt.withVlog, "vlog", true,
+		"Report the value log usage, which requires reading all the tables.")
+	duCmd.Flags().StringVar(&duOpt.sortBy, "sort", "prefix", "Sort by prefix or by size.")
+	duCmd.Flags().BoolVar(&duOpt.readOnly, "read-only", true, "Open the DB in read-only mode.")
+}
+
+func doDu(cmd *cobra.Command, args []string) error {
+	if duOpt.prefixDepth <= 0 {
+		return errors.New("--prefix-depth must be positive")
+	}
+	if duOpt.sortBy != "prefix" && duOpt.sortBy != "size" {
+		return errors.Errorf("Invalid --sort: %s", duOpt.sortBy)
+	}
+	db, err := badger.Open(badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithReadOnly(duOpt.readOnly).
+		WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	prefixOf := keyPrefixAtDepth([]byte(duOpt.separator), duOpt.prefixDepth)
+	usage := db.DiskUsage(prefixOf, duOpt.withVlog)
+	_, vlogSize := db.Size()
+	printDiskUsage(os.Stdout, usage, duOpt.withVlog, duOpt.sortBy == "size", vlogSize)
+	return nil
+}
+
+// keyPrefixAtDepth returns a function returning the prefix of a key up to its depth-th separator.
+func keyPrefixAtDepth(separator []byte, depth int) func(key []byte) []byte {
+	if len(separator) == 0 {
+		return func(key []byte) []byte {
+			if len(key) > depth {
+				return key[:depth]
+			}
+			return key
+		}
+	}
+	return func(key []byte) []byte {
+		var end int
+		for i := 0; i < depth; i++ {
+			j := bytes.Index(key[end:], separator)
+			if j < 0 {
+				break
+			}
+			end += j + len(separator)
+		}
+		return key[:end]
+	}
+}
+
+func printDiskUsage(w io.Writer, usage []*badger.PrefixUsage, withVlog, bySize bool,
+	vlogSize int64) {
+	if bySize {
+		sort.SliceStable(usage, func(i, j int) bool {
+			return usage[i].LSMBytes+usage[i].VlogBytes > usage[j].LSMBytes+usage[j].VlogBytes
+		})
+	}
+	// Only the levels which have tables get a column.
+	var levels []int
+	total := &badger.PrefixUsage{Prefix: []byte("total")}
+	for _, u := range usage {
+		if total.LevelBytes == nil {
+			total.LevelBytes = make([]int64, len(u.LevelBytes))
+		}
+		for level, sz := range u.LevelBytes {
+			total.LevelBytes[level] += sz
+		}
+		total.Entries += u.Entries
+		total.LSMBytes += u.LSMBytes
+		total.VlogBytes += u.VlogBytes
+	}
+	for level, sz := range total.LevelBytes {
+		if sz > 0 {
+			levels = append(levels, level)
+		}
+	}
+
+	fmt.Fprintf(w, "%10s  %10s", "LSM", "VLOG")
+	for _, level := range levels {
+		fmt.Fprintf(w, "  %10s", fmt.Sprintf("L%d", level))
+	}
+	fmt.Fprintf(w, "  %10s  %s\n", "ENTRIES", "PREFIX")
+	row := func(u *badger.PrefixUsage, prefix string) {
+		vlog := "-"
+		if withVlog {
+			vlog = hbytes(u.VlogBytes)
+		}
+		fmt.Fprintf(w, "%10s  %10s", hbytes(u.LSMBytes), vlog)
+		for _, level := range levels {
+			fmt.Fprintf(w, "  %10s", hbytes(u.LevelBytes[level]))
+		}
+		fmt.Fprintf(w, "  %10d  %s\n", u.Entries, prefix)
+	}
+	for _, u := range usage {
+		row(u, formatShellBytes(u.Prefix))
+	}
+	row(total, "total")
+	if withVlog && vlogSize > total.VlogBytes {
+		fmt.Fprintf(w, "%10s  %10s  unreferenced by the tables\n", "", hbytes(vlogSize-total.VlogBytes))
+	}
+}
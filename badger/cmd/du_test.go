@@ -0,0 +1,62 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPrefixAtDepth(t *testing.T) {
+	tests := []struct {
+		separator string
+		depth     int
+		key       string
+		prefix    string
+	}{
+		{"/", 1, "tenant/users/1", "tenant/"},
+		{"/", 2, "tenant/users/1", "tenant/users/"},
+		{"/", 3, "tenant/users/1", "tenant/users/"},
+		{"/", 1, "nosep", ""},
+		{"::", 1, "a::b::c", "a::"},
+		{"", 2, "abc", "ab"},
+		{"", 4, "abc", "abc"},
+	}
+	for _, tc := range tests {
+		prefixOf := keyPrefixAtDepth([]byte(tc.separator), tc.depth)
+		require.Equal(t, tc.prefix, string(prefixOf([]byte(tc.key))), "%+v", tc)
+	}
+}
+
+func TestPrintDiskUsage(t *testing.T) {
+	usage := []*badger.PrefixUsage{
+		{Prefix: []byte("a/"), Entries: 10, LevelBytes: []int64{0, 100, 0, 2048}, LSMBytes: 2148},
+		{Prefix: []byte("b/"), Entries: 5, LevelBytes: []int64{0, 0, 0, 4096}, LSMBytes: 4096,
+			VlogBytes: 1000},
+	}
+	var buf bytes.Buffer
+	printDiskUsage(&buf, usage, true, true, 1500)
+	require.Equal(t, ""+
+		"       LSM        VLOG          L1          L3     ENTRIES  PREFIX\n"+
+		"   4.0 KiB      1000 B         0 B     4.0 KiB           5  b/\n"+
+		"   2.1 KiB         0 B       100 B     2.0 KiB          10  a/\n"+
+		"   6.1 KiB      1000 B       100 B     6.0 KiB          15  total\n"+
+		"                 500 B  unreferenced by the tables\n", buf.String())
+}
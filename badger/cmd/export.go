@@ -0,0 +1,126 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"math"
+	"os"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var eo = struct {
+	file          string
+	since         uint64
+	format        string
+	keyEncoding   string
+	valueEncoding string
+}{}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export Badger database to JSON or CSV.",
+	Long: `Export Badger database to line-delimited JSON or to CSV.
+
+Each entry is written on its own line with its key, value, version, expiry,
+user meta and whether it is a deletion, like the backup command writes them.
+The keys and the values are encoded in base64 or in hex. With --format=csv, the
+first line is a header with the names of the fields.
+
+The export can be read back with the import command, given the same format and
+encodings.`,
+	RunE: doExport,
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&eo.file, "file", "f", "badger.export",
+		"File to export to.")
+	exportCmd.Flags().Uint64Var(&eo.since, "since", 0,
+		"Only export the versions newer than or equal to this one.")
+	addExportFlags(exportCmd)
+}
+
+// addExportFlags adds the flags setting the format and the encodings of an export.
+func addExportFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&eo.format, "format", "json", "Format of the export, json or csv.")
+	cmd.Flags().StringVar(&eo.keyEncoding, "key-encoding", "base64",
+		"Encoding of the keys, base64 or hex.")
+	cmd.Flags().StringVar(&eo.valueEncoding, "value-encoding", "base64",
+		"Encoding of the values, base64 or hex.")
+}
+
+func exportOptions() (badger.ExportOptions, error) {
+	var opt badger.ExportOptions
+	switch eo.format {
+	case "json":
+		opt.Format = badger.JSONFormat
+	case "csv":
+		opt.Format = badger.CSVFormat
+	default:
+		return opt, errors.Errorf("Invalid export format: %s", eo.format)
+	}
+	encoding := func(s string) (badger.ExportEncoding, error) {
+		switch s {
+		case "base64":
+			return badger.Base64Encoding, nil
+		case "hex":
+			return badger.HexEncoding, nil
+		}
+		return 0, errors.Errorf("Invalid export encoding: %s", s)
+	}
+	var err error
+	if opt.KeyEncoding, err = encoding(eo.keyEncoding); err != nil {
+		return opt, err
+	}
+	opt.ValueEncoding, err = encoding(eo.valueEncoding)
+	return opt, err
+}
+
+func doExport(cmd *cobra.Command, args []string) error {
+	eopt, err := exportOptions()
+	if err != nil {
+		return err
+	}
+	db, err := badger.Open(badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithNumVersionsToKeep(math.MaxInt32))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.Create(eo.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bw := bufio.NewWriterSize(f, 4<<20)
+	if _, err := db.Export(bw, eo.since, eopt); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
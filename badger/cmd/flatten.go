@@ -18,7 +18,9 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"math"
+	"os"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/dgraph-io/badger/v3/options"
@@ -30,7 +32,9 @@ var flattenCmd = &cobra.Command{
 	Use:   "flatten",
 	Short: "Flatten the LSM tree.",
 	Long: `
-This command would compact all the LSM tables into one level.
+This command would compact all the LSM tables into one level. The progress, the
+bytes remaining and the estimated time left are printed after each compaction.
+With --dry-run, it only prints the levels which would be compacted.
 `,
 	RunE: flatten,
 }
@@ -40,6 +44,7 @@ var fo = struct {
 	numWorkers      int
 	numVersions     int
 	compressionType uint32
+	dryRun          bool
 }{}
 
 func init() {
@@ -55,6 +60,8 @@ func init() {
 	flattenCmd.Flags().Uint32VarP(&fo.compressionType, "compression", "", 1,
 		"Option to configure the compression type in output DB. "+
 			"0 to disable, 1 for Snappy, and 2 for ZSTD.")
+	flattenCmd.Flags().BoolVar(&fo.dryRun, "dry-run", false,
+		"Only print the levels which would be compacted.")
 }
 
 func flatten(cmd *cobra.Command, args []string) error {
@@ -77,7 +84,8 @@ func flatten(cmd *cobra.Command, args []string) error {
 		WithBlockCacheSize(100 << 20).
 		WithIndexCacheSize(200 << 20).
 		WithCompression(options.CompressionType(fo.compressionType)).
-		WithEncryptionKey(encKey)
+		WithEncryptionKey(encKey).
+		WithReadOnly(fo.dryRun)
 	fmt.Printf("Opening badger with options = %+v\n", opt)
 	db, err := badger.Open(opt)
 	if err != nil {
@@ -85,5 +93,34 @@ func flatten(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
-	return db.Flatten(fo.numWorkers)
+	if fo.dryRun {
+		printFlattenPlan(os.Stdout, db.Levels())
+		return nil
+	}
+	return db.FlattenWithProgress(fo.numWorkers, func(p badger.CompactProgress) {
+		printCompactProgress(os.Stdout, p)
+	})
+}
+
+// printFlattenPlan prints the levels which would be compacted into the last one holding tables.
+func printFlattenPlan(w io.Writer, levels []badger.LevelInfo) {
+	last := -1
+	for _, l := range levels {
+		if l.NumTables > 0 {
+			last = l.Level
+		}
+	}
+	var total int64
+	for _, l := range levels {
+		if l.NumTables == 0 || l.Level == last {
+			continue
+		}
+		fmt.Fprintf(w, "L%d -> L%d: %d tables (%s)\n", l.Level, last, l.NumTables, hbytes(l.Size))
+		total += l.Size
+	}
+	if total == 0 {
+		fmt.Fprintln(w, "Nothing to flatten.")
+		return
+	}
+	fmt.Fprintf(w, "Would compact %s.\n", hbytes(total))
 }
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/migrate"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var importOpt = struct {
+	sourceDir string
+	dumpFile  string
+	file      string
+	walDir    string
+	ttl       time.Duration
+}{}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import a LevelDB or RocksDB database, or a JSON or CSV export.",
+	Long: `Import a LevelDB or RocksDB database into a new Badger database.
+
+The tables and the write-ahead logs of the LevelDB or RocksDB directory are
+read directly, and the latest value of every key of the default column family
+is written to Badger. The source DB must be closed.
+
+For the RocksDB DBs which can't be read directly, like those using merge
+operators, import the output of "ldb --db=<dir> --hex scan" with --dump.
+
+Values written with the TTL support of RocksDB end with their timestamp. Pass
+the TTL of the DB with --ttl to remove the timestamps, and to expire the keys
+in Badger at the same time as in RocksDB.
+
+With --file, the JSON or CSV file written by the export command is imported
+instead, into a new or an existing Badger database. Pass the --format,
+--key-encoding and --value-encoding the export was made with.`,
+	RunE: doImport,
+}
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+	importCmd.Flags().StringVar(&importOpt.sourceDir, "source-dir", "",
+		"Directory of the LevelDB or RocksDB DB to import.")
+	importCmd.Flags().StringVar(&importOpt.dumpFile, "dump", "",
+		"File written by the ldb tool with --hex, to import instead of a directory.")
+	importCmd.Flags().StringVarP(&importOpt.file, "file", "f", "",
+		"File written by the export command, to import instead of a directory.")
+	importCmd.Flags().StringVar(&importOpt.walDir, "wal-dir", "",
+		"Directory of the write-ahead logs, if it isn't the source directory.")
+	importCmd.Flags().DurationVar(&importOpt.ttl, "ttl", 0,
+		"TTL the RocksDB DB was opened with, if it was opened with TTL support.")
+	addExportFlags(importCmd)
+}
+
+func doImport(cmd *cobra.Command, args []string) error {
+	var set int
+	for _, s := range []string{importOpt.sourceDir, importOpt.dumpFile, importOpt.file} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("Exactly one of --source-dir, --dump and --file must be set")
+	}
+	if importOpt.file != "" {
+		return doImportExport()
+	}
+	manifestFile := filepath.Join(sstDir, badger.ManifestFilename)
+	if _, err := os.Stat(manifestFile); err == nil {
+		return errors.New("Cannot import to an already existing database")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(sstDir).WithValueDir(vlogDir))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	opt := migrate.Options{WALDir: importOpt.walDir, TTL: importOpt.ttl}
+	start := time.Now()
+	var stats *migrate.Stats
+	if importOpt.sourceDir != "" {
+		stats, err = migrate.Import(db, importOpt.sourceDir, opt)
+	} else {
+		var f *os.File
+		if f, err = os.Open(importOpt.dumpFile); err != nil {
+			return err
+		}
+		defer f.Close()
+		stats, err = migrate.ImportDump(db, f, opt)
+	}
+	if err != nil {
+		return err
+	}
+	if stats.DroppedLogTail {
+		fmt.Println("A write-ahead log ends with a corrupt record, which was dropped.")
+	}
+	fmt.Printf("Imported %d keys (%s) from %d tables and %d logs in %s. "+
+		"Skipped %d deleted and %d expired keys.\n", stats.Keys,
+		humanize.IBytes(uint64(stats.Bytes)), stats.Tables, stats.Logs,
+		time.Since(start).Round(time.Millisecond), stats.Deleted, stats.Expired)
+	return nil
+}
+
+func doImportExport() error {
+	eopt, err := exportOptions()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(importOpt.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db, err := badger.Open(badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithNumVersionsToKeep(math.MaxInt32))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	if err := db.Import(bufio.NewReaderSize(f, 4<<20), 256, eopt); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %s in %s.\n", importOpt.file, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -80,7 +80,8 @@ func init() {
 		"truncation of value log files if they have corrupt data.")
 	infoCmd.Flags().StringVar(&opt.encryptionKey, "enc-key", "", "Use the provided encryption key")
 	infoCmd.Flags().StringVar(&opt.checksumVerificationMode, "cv-mode", "none",
-		"[none, table, block, tableAndBlock] Specifies when the db should verify checksum for SST.")
+		"[none, table, block, tableAndBlock, compaction] Specifies when the db should verify "+
+			"checksum for SST.")
 	infoCmd.Flags().BoolVar(&opt.discard, "discard", false,
 		"Parse and print DISCARD file from value logs.")
 	infoCmd.Flags().Uint16Var(&opt.externalMagicVersion, "external-magic", 0,
@@ -128,7 +129,7 @@ func handleInfo(cmd *cobra.Command, args []string) error {
 	// Open DB
 	db, err := badger.Open(bopt)
 	if err != nil {
-		return y.Wrap(err, "failed to open database")
+		return y.Wrap(err, "failed to open database, badger repair may fix it")
 	}
 	defer db.Close()
 
@@ -264,25 +265,13 @@ func dur(src, dst time.Time) string {
 	return humanize.RelTime(dst, src, "earlier", "later")
 }
 
-func getInfo(fileInfos []os.FileInfo, tid uint64) int64 {
-	fileName := table.IDToFilename(tid)
-	for _, fi := range fileInfos {
-		if filepath.Base(fi.Name()) == fileName {
-			return fi.Size()
-		}
-	}
-	return 0
-}
-
 func tableInfo(dir, valueDir string, db *badger.DB) {
 	// we want all tables with keys count here.
 	tables := db.Tables()
-	fileInfos, err := ioutil.ReadDir(dir)
-	y.Check(err)
 
 	fmt.Println()
 	// Total keys includes the internal keys as well.
-	fmt.Println("SSTable [Li, Id, Total Keys] " +
+	fmt.Println("SSTable [Li, Id, Total Keys, Tombstones] " +
 		"[Compression Ratio, StaleData Ratio, Uncompressed Size, Index Size, BF Size] " +
 		"[Left Key, Version -> Right Key, Version]")
 	totalIndex := uint64(0)
@@ -292,11 +281,11 @@ func tableInfo(dir, valueDir string, db *badger.DB) {
 		lk, lt := y.ParseKey(t.Left), y.ParseTs(t.Left)
 		rk, rt := y.ParseKey(t.Right), y.ParseTs(t.Right)
 
-		compressionRatio := float64(t.UncompressedSize) /
-			float64(getInfo(fileInfos, t.ID)-int64(t.IndexSz))
+		compressionRatio := t.CompressionRatio
 		staleDataRatio := float64(t.StaleDataSize) / float64(t.UncompressedSize)
-		fmt.Printf("SSTable [L%d, %03d, %07d] [%.2f, %.2f, %s, %s, %s] [%20X, v%d -> %20X, v%d]\n",
-			t.Level, t.ID, t.KeyCount, compressionRatio, staleDataRatio,
+		fmt.Printf("SSTable [L%d, %03d, %07d, %07d] [%.2f, %.2f, %s, %s, %s] "+
+			"[%20X, v%d -> %20X, v%d]\n",
+			t.Level, t.ID, t.KeyCount, t.TombstoneCount, compressionRatio, staleDataRatio,
 			hbytes(int64(t.UncompressedSize)), hbytes(int64(t.IndexSz)),
 			hbytes(int64(t.BloomFilterSize)), lk, lt, rk, rt)
 		totalIndex += uint64(t.IndexSz)
@@ -513,6 +502,8 @@ func checksumVerificationMode(cvMode string) options.ChecksumVerificationMode {
 		return options.OnBlockRead
 	case "tableAndblock":
 		return options.OnTableAndBlockRead
+	case "compaction":
+		return options.OnCompactionRead
 	default:
 		fmt.Printf("Invalid checksum verification mode: %s\n", cvMode)
 		os.Exit(1)
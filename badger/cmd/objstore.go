@@ -0,0 +1,84 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/spf13/cobra"
+)
+
+// objOpt are the options of the backup and restore commands for s3:// and gs:// URLs.
+var objOpt = struct {
+	endpoint        string
+	region          string
+	sse             string
+	kmsKeyID        string
+	customerKeyPath string
+	partSizeMB      int
+	concurrency     int
+	maxRetries      int
+}{}
+
+// addObjstoreFlags adds the flags of the object storage options to cmd. The flags only used to
+// write objects are added if write is true.
+func addObjstoreFlags(cmd *cobra.Command, write bool) {
+	cmd.Flags().StringVar(&objOpt.endpoint, "s3-endpoint", "",
+		"Endpoint of the object storage service, for S3-compatible services like MinIO.")
+	cmd.Flags().StringVar(&objOpt.region, "s3-region", "",
+		"Region of the bucket. It is read from AWS_REGION if not specified.")
+	cmd.Flags().StringVar(&objOpt.customerKeyPath, "sse-customer-key-file", "",
+		"Path of the 32 bytes key the backup is encrypted with on the server.")
+	cmd.Flags().IntVar(&objOpt.maxRetries, "max-retries", 5,
+		"Number of times a failed request to object storage is retried.")
+	if !write {
+		return
+	}
+	cmd.Flags().StringVar(&objOpt.sse, "sse", "",
+		"Server-side encryption of the backup, AES256 or aws:kms.")
+	cmd.Flags().StringVar(&objOpt.kmsKeyID, "sse-kms-key-id", "",
+		"KMS key the backup is encrypted with on the server.")
+	cmd.Flags().IntVar(&objOpt.partSizeMB, "part-size-mb", 64,
+		"Size of the parts of the multipart upload in MB.")
+	cmd.Flags().IntVar(&objOpt.concurrency, "upload-concurrency", 4,
+		"Number of parts uploaded concurrently.")
+}
+
+// objstoreOptions returns the options for rawurl, with the credentials read from the environment.
+func objstoreOptions(rawurl string) (objstore.Options, error) {
+	opt := objstore.DefaultOptions(rawurl)
+	opt.Endpoint = objOpt.endpoint
+	if objOpt.region != "" {
+		opt.Region = objOpt.region
+	}
+	opt.SSE = objOpt.sse
+	opt.KMSKeyID = objOpt.kmsKeyID
+	if objOpt.partSizeMB > 0 {
+		opt.PartSize = int64(objOpt.partSizeMB) << 20
+	}
+	if objOpt.concurrency > 0 {
+		opt.Concurrency = objOpt.concurrency
+	}
+	opt.MaxRetries = objOpt.maxRetries
+	if objOpt.customerKeyPath != "" {
+		key, err := getKey(objOpt.customerKeyPath)
+		if err != nil {
+			return opt, err
+		}
+		opt.CustomerKey = key
+	}
+	return opt, nil
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/spf13/cobra"
+)
+
+var repairOpt = struct {
+	rebuildManifest      bool
+	quarantineDir        string
+	dryRun               bool
+	keyPath              string
+	externalMagicVersion uint16
+}{}
+
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Repair a Badger database which can't be opened.",
+	Long: `Repair a Badger database which isn't open, so that it can be opened again:
+
+- The MANIFEST is rebuilt from the tables if it can't be read, or with
+  --rebuild-manifest. The tables which overlap others are put in level 0.
+- The tables which can't be read are moved to the --quarantine-dir, and removed
+  from the MANIFEST, along with the tables whose files are missing.
+- The value log and memtable files are truncated after their last valid entry.
+
+It prints what it found and fixed. With --dry-run, it only prints what it would
+fix. The data of the quarantined tables and of the truncated entries is lost.`,
+	RunE: doRepair,
+}
+
+func init() {
+	RootCmd.AddCommand(repairCmd)
+	repairCmd.Flags().BoolVar(&repairOpt.rebuildManifest, "rebuild-manifest", false,
+		"Rebuild the MANIFEST from the tables, even if it can be read.")
+	repairCmd.Flags().StringVar(&repairOpt.quarantineDir, "quarantine-dir", "quarantine",
+		"Directory the corrupt tables are moved to, relative to --dir.")
+	repairCmd.Flags().BoolVar(&repairOpt.dryRun, "dry-run", false,
+		"Only print what would be repaired.")
+	repairCmd.Flags().StringVar(&repairOpt.keyPath, "encryption-key-file", "",
+		"Path of the encryption key file.")
+	repairCmd.Flags().Uint16Var(&repairOpt.externalMagicVersion, "external-magic", 0,
+		"External magic number")
+}
+
+func doRepair(cmd *cobra.Command, args []string) error {
+	encKey, err := getKey(repairOpt.keyPath)
+	if err != nil {
+		return err
+	}
+	report, err := badger.Repair(badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithEncryptionKey(encKey).
+		WithExternalMagic(repairOpt.externalMagicVersion),
+		badger.RepairOptions{
+			RebuildManifest: repairOpt.rebuildManifest,
+			QuarantineDir:   repairOpt.quarantineDir,
+			DryRun:          repairOpt.dryRun,
+		})
+	if report != nil {
+		printRepairReport(os.Stdout, report, repairOpt.dryRun)
+	}
+	return err
+}
+
+func printRepairReport(w io.Writer, r *badger.RepairReport, dryRun bool) {
+	would := ""
+	if dryRun {
+		would = "would be "
+	}
+	if r.ManifestErr != nil {
+		fmt.Fprintf(w, "MANIFEST can't be read: %v\n", r.ManifestErr)
+	}
+	switch {
+	case r.ManifestRebuilt:
+		fmt.Fprintf(w, "MANIFEST %srebuilt from %d tables.\n", would, r.Tables)
+	case r.ManifestRewritten:
+		fmt.Fprintf(w, "MANIFEST %srewritten with %d tables.\n", would, r.Tables)
+	default:
+		fmt.Fprintf(w, "MANIFEST is valid, with %d tables.\n", r.Tables)
+	}
+	for _, id := range r.MissingTables {
+		fmt.Fprintf(w, "Table %d is missing, and %sremoved from the MANIFEST.\n", id, would)
+	}
+	for _, qt := range r.QuarantinedTables {
+		fmt.Fprintf(w, "Table %d %squarantined: %v\n", qt.ID, would, qt.Err)
+	}
+	if len(r.UnreferencedTables) > 0 {
+		fmt.Fprintf(w, "%d tables aren't in the MANIFEST, and will be deleted when the DB is opened.\n",
+			len(r.UnreferencedTables))
+	}
+	for _, l := range r.TruncatedLogs {
+		fmt.Fprintf(w, "%s %struncated from %s to %s.\n", l.Path, would, hbytes(l.Size),
+			hbytes(l.ValidSize))
+	}
+	if !r.ManifestRebuilt && !r.ManifestRewritten && len(r.QuarantinedTables) == 0 &&
+		len(r.TruncatedLogs) == 0 {
+		fmt.Fprintln(w, "Nothing to repair.")
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintRepairReport(t *testing.T) {
+	var buf bytes.Buffer
+	printRepairReport(&buf, &badger.RepairReport{Tables: 3}, false)
+	require.Equal(t, "MANIFEST is valid, with 3 tables.\nNothing to repair.\n", buf.String())
+
+	buf.Reset()
+	printRepairReport(&buf, &badger.RepairReport{
+		ManifestErr:       errors.New("bad magic"),
+		ManifestRebuilt:   true,
+		Tables:            2,
+		QuarantinedTables: []badger.QuarantinedTable{{ID: 7, Err: errors.New("bad checksum")}},
+		TruncatedLogs:     []badger.TruncatedLog{{Path: "000001.vlog", Size: 2048, ValidSize: 1024}},
+	}, true)
+	require.Equal(t, ""+
+		"MANIFEST can't be read: bad magic\n"+
+		"MANIFEST would be rebuilt from 2 tables.\n"+
+		"Table 7 would be quarantined: bad checksum\n"+
+		"000001.vlog would be truncated from 2.0 KiB to 1.0 KiB.\n", buf.String())
+
+	buf.Reset()
+	printRepairReport(&buf, &badger.RepairReport{
+		ManifestRewritten:  true,
+		MissingTables:      []uint64{4},
+		UnreferencedTables: []uint64{5, 6},
+	}, false)
+	require.Equal(t, ""+
+		"MANIFEST rewritten with 0 tables.\n"+
+		"Table 4 is missing, and removed from the MANIFEST.\n"+
+		"2 tables aren't in the MANIFEST, and will be deleted when the DB is opened.\n",
+		buf.String())
+}
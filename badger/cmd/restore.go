@@ -17,17 +17,21 @@
 package cmd
 
 import (
+	"context"
 	"errors"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/objstore"
 	"github.com/spf13/cobra"
 )
 
 var restoreFile string
 var maxPendingWrites int
+var restoreKeyPath string
 
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
@@ -40,7 +44,11 @@ DB.Backup() API method) and writes each key-value pair found in the file to
 the Badger database.
 
 Restore creates a new database, and currently does not work on an already
-existing database.`,
+existing database.
+
+The backup file can be an s3:// or gs:// URL, in which case the backup is
+streamed from object storage. The credentials are read from the environment,
+like for the backup command.`,
 	RunE: doRestore,
 }
 
@@ -52,6 +60,9 @@ func init() {
 	// and overall finish time.
 	restoreCmd.Flags().IntVarP(&maxPendingWrites, "max-pending-writes", "w",
 		256, "Max number of pending writes at any time while restore")
+	restoreCmd.Flags().StringVar(&restoreKeyPath, "backup-key-file", "",
+		"Path of the key the backup is encrypted with, if it is encrypted.")
+	addObjstoreFlags(restoreCmd, false)
 }
 
 func doRestore(cmd *cobra.Command, args []string) error {
@@ -74,13 +85,28 @@ func doRestore(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
-	// Open File
-	f, err := os.Open(restoreFile)
-	if err != nil {
+	var bopt badger.BackupOptions
+	if bopt.EncryptionKey, err = getKey(restoreKeyPath); err != nil {
 		return err
 	}
-	defer f.Close()
+
+	var r io.ReadCloser
+	if objstore.IsURL(restoreFile) {
+		storeOpt, err := objstoreOptions(restoreFile)
+		if err != nil {
+			return err
+		}
+		if r, err = objstore.NewReader(context.Background(), restoreFile, storeOpt); err != nil {
+			return err
+		}
+	} else {
+		// Open File
+		if r, err = os.Open(restoreFile); err != nil {
+			return err
+		}
+	}
+	defer r.Close()
 
 	// Run restore
-	return db.Load(f, maxPendingWrites)
+	return db.LoadWithOptions(r, maxPendingWrites, bopt)
 }
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/redisserve"
+	"github.com/dgraph-io/badger/v3/rpc"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the DB over the network.",
+	Long: `
+This command opens the DB and serves it over the network until it is interrupted. With --redis,
+it serves the GET, SET, DEL, EXPIRE, TTL, MGET and SCAN commands of the Redis protocol. With
+--grpc, it serves the gRPC service defined in rpc/rpc.proto.
+`,
+	RunE: serve,
+}
+
+var serveOpt = struct {
+	redisAddr string
+	grpcAddr  string
+	keyPath   string
+}{}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&serveOpt.redisAddr, "redis", "",
+		"Address to serve the Redis protocol on, like :6379.")
+	serveCmd.Flags().StringVar(&serveOpt.grpcAddr, "grpc", "",
+		"Address to serve the gRPC service on, like :9090.")
+	serveCmd.Flags().StringVarP(&serveOpt.keyPath, "encryption-key-file", "e", "",
+		"Path of the encryption key file.")
+}
+
+func serve(cmd *cobra.Command, args []string) error {
+	if serveOpt.redisAddr == "" && serveOpt.grpcAddr == "" {
+		return errors.New("--redis or --grpc must be specified")
+	}
+	encKey, err := getKey(serveOpt.keyPath)
+	if err != nil {
+		return err
+	}
+	db, err := badger.Open(badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithEncryptionKey(encKey).
+		WithIndexCacheSize(100 << 20))
+	if err != nil {
+		return y.Wrapf(err, "cannot open DB at %s", sstDir)
+	}
+	defer db.Close()
+
+	errCh := make(chan error, 2)
+	var redisSrv *redisserve.Server
+	if serveOpt.redisAddr != "" {
+		redisSrv = redisserve.NewServer(db)
+		go func() {
+			errCh <- redisSrv.ListenAndServe(serveOpt.redisAddr)
+		}()
+		fmt.Printf("Serving the Redis protocol on %s\n", serveOpt.redisAddr)
+	}
+	var grpcSrv *grpc.Server
+	if serveOpt.grpcAddr != "" {
+		lis, err := net.Listen("tcp", serveOpt.grpcAddr)
+		if err != nil {
+			return y.Wrapf(err, "cannot listen on %s", serveOpt.grpcAddr)
+		}
+		grpcSrv = grpc.NewServer()
+		rpc.RegisterBadgerServer(grpcSrv, rpc.NewServer(db))
+		go func() {
+			errCh <- grpcSrv.Serve(lis)
+		}()
+		fmt.Printf("Serving gRPC on %s\n", serveOpt.grpcAddr)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errCh:
+	case <-sigCh:
+		fmt.Println("Shutting down.")
+	}
+	if grpcSrv != nil {
+		grpcSrv.Stop()
+	}
+	if redisSrv != nil {
+		if cerr := redisSrv.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
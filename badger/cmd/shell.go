@@ -0,0 +1,535 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v3"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var shellOpt = struct {
+	managed       bool
+	readOnly      bool
+	readTs        uint64
+	encryptionKey string
+}{}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Inspect and modify a Badger database interactively.",
+	Long: `Open a Badger database and run commands on it read from the standard input.
+
+Keys and values are written as plain words, as double-quoted strings with Go
+escapes, or as hex with a 0x prefix. Type "help" for the list of commands.
+
+With --managed, the database is opened in managed mode. The reads are made at
+the read timestamp, the latest one by default, and the writes are committed at
+the commit timestamp, which must be set with "ts commit <ts>" before writing.
+Both can be changed with the ts command.`,
+	RunE: doShell,
+}
+
+func init() {
+	RootCmd.AddCommand(shellCmd)
+	shellCmd.Flags().BoolVar(&shellOpt.managed, "managed", false,
+		"Open the DB in managed mode, as the applications managing their timestamps do.")
+	shellCmd.Flags().BoolVar(&shellOpt.readOnly, "read-only", false,
+		"Open the DB in read-only mode.")
+	shellCmd.Flags().Uint64Var(&shellOpt.readTs, "read-ts", 0,
+		"Timestamp to read at in managed mode. Defaults to the latest one.")
+	shellCmd.Flags().StringVar(&shellOpt.encryptionKey, "enc-key", "",
+		"Use the provided encryption key.")
+}
+
+func doShell(cmd *cobra.Command, args []string) error {
+	if shellOpt.readTs > 0 && !shellOpt.managed {
+		return errors.New("--read-ts can only be set with --managed")
+	}
+	bopt := badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithReadOnly(shellOpt.readOnly).
+		WithEncryptionKey([]byte(shellOpt.encryptionKey)).
+		WithIndexCacheSize(100 << 20).
+		WithLoggingLevel(badger.WARNING)
+	var db *badger.DB
+	var err error
+	if shellOpt.managed {
+		db, err = badger.OpenManaged(bopt)
+	} else {
+		db, err = badger.Open(bopt)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sh := newShell(db, shellOpt.managed, os.Stdout)
+	sh.readTs = shellOpt.readTs
+	sh.prompt = "badger> "
+	return sh.run(os.Stdin)
+}
+
+// shell runs the commands of the shell command on a DB.
+type shell struct {
+	db      *badger.DB
+	managed bool
+	out     io.Writer
+	prompt  string
+	// readTs and commitTs are the timestamps of the reads and of the writes in managed mode. A
+	// zero readTs reads the latest versions.
+	readTs   uint64
+	commitTs uint64
+}
+
+type shellCommand struct {
+	usage string
+	help  string
+	run   func(sh *shell, args []string) error
+}
+
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"get":    {"get <key>", "Print the value of a key and its metadata.", (*shell).get},
+		"set":    {"set <key> <value> [ttl]", "Set a key, expiring after ttl if given.", (*shell).set},
+		"del":    {"del <key>", "Delete a key.", (*shell).del},
+		"scan":   {"scan [start] [limit]", "List the keys from start, 20 by default.", (*shell).scan},
+		"prefix": {"prefix <prefix> [limit]", "List the keys with a prefix, 20 by default.", (*shell).prefix},
+		"ttl": {"ttl <key> [ttl]", "Print the time left before a key expires, or set it. " +
+			"A ttl of 0 removes the expiry.", (*shell).ttl},
+		"info": {"info", "Print the sizes, the tables and the versions of the DB.", (*shell).info},
+		"ts": {"ts [read|commit <ts>]", "Print the timestamps of managed mode, or set one. " +
+			"A read ts of 0 reads the latest versions.", (*shell).ts},
+		"help": {"help", "Print this help.", (*shell).help},
+	}
+}
+
+func newShell(db *badger.DB, managed bool, out io.Writer) *shell {
+	return &shell{db: db, managed: managed, out: out}
+}
+
+// run runs the commands read from r until it ends or an exit command is read. The errors of the
+// commands are printed, and don't stop the shell.
+func (sh *shell) run(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for {
+		fmt.Fprint(sh.out, sh.prompt)
+		if !scanner.Scan() {
+			if sh.prompt != "" {
+				fmt.Fprintln(sh.out)
+			}
+			return scanner.Err()
+		}
+		args, err := splitShellLine(scanner.Text())
+		if err == nil && len(args) > 0 {
+			if args[0] == "exit" || args[0] == "quit" {
+				return nil
+			}
+			err = sh.exec(args)
+		}
+		if err != nil {
+			fmt.Fprintf(sh.out, "Error: %v\n", err)
+		}
+	}
+}
+
+func (sh *shell) exec(args []string) error {
+	cmd, ok := shellCommands[args[0]]
+	if !ok {
+		return errors.Errorf("unknown command %q, type \"help\" for the list of commands", args[0])
+	}
+	return cmd.run(sh, args[1:])
+}
+
+// splitShellLine splits a line in words separated by spaces. A word can be double-quoted, with the
+// escapes of Go strings.
+func splitShellLine(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+		end := 1
+		for ; end < len(line) && line[end] != '"'; end++ {
+			if line[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(line) {
+			return nil, errors.New("unterminated quoted string")
+		}
+		s, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid quoted string %s", line[:end+1])
+		}
+		// Mark the quoted words, so that a quoted "0x00" isn't read as hex.
+		args = append(args, "\x00"+s)
+		line = line[end+1:]
+	}
+}
+
+// parseShellBytes returns the bytes of a word of a command.
+func parseShellBytes(arg string) ([]byte, error) {
+	if strings.HasPrefix(arg, "\x00") {
+		return []byte(arg[1:]), nil
+	}
+	if strings.HasPrefix(arg, "0x") {
+		b, err := hex.DecodeString(arg[2:])
+		return b, errors.Wrapf(err, "invalid hex %s", arg)
+	}
+	return []byte(arg), nil
+}
+
+// formatShellBytes formats bytes like they can be written in a command.
+func formatShellBytes(b []byte) string {
+	if !utf8.Valid(b) {
+		return "0x" + hex.EncodeToString(b)
+	}
+	plain := len(b) > 0 && !bytes.HasPrefix(b, []byte("0x"))
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != ' ' {
+			return "0x" + hex.EncodeToString(b)
+		}
+		if r == ' ' || r == '"' || r == '\\' {
+			plain = false
+		}
+	}
+	if plain {
+		return string(b)
+	}
+	return strconv.Quote(string(b))
+}
+
+func shellArgs(args []string, min, max int, usage string) error {
+	if len(args) < min || len(args) > max {
+		return errors.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func parseShellTTL(arg string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(arg)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid ttl %s", arg)
+	}
+	if ttl < 0 {
+		return 0, errors.Errorf("invalid negative ttl %s", arg)
+	}
+	return ttl, nil
+}
+
+func (sh *shell) view(fn func(txn *badger.Txn) error) error {
+	if !sh.managed {
+		return sh.db.View(fn)
+	}
+	readTs := sh.readTs
+	if readTs == 0 {
+		readTs = math.MaxUint64
+	}
+	txn := sh.db.NewTransactionAt(readTs, false)
+	defer txn.Discard()
+	return fn(txn)
+}
+
+func (sh *shell) update(fn func(txn *badger.Txn) error) error {
+	if !sh.managed {
+		return sh.db.Update(fn)
+	}
+	if sh.commitTs == 0 {
+		return errors.New("the commit ts must be set with \"ts commit <ts>\" to write in managed mode")
+	}
+	txn := sh.db.NewTransactionAt(sh.commitTs, true)
+	defer txn.Discard()
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return txn.CommitAt(sh.commitTs, nil)
+}
+
+func (sh *shell) get(args []string) error {
+	if err := shellArgs(args, 1, 1, shellCommands["get"].usage); err != nil {
+		return err
+	}
+	key, err := parseShellBytes(args[0])
+	if err != nil {
+		return err
+	}
+	return sh.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.out, formatShellBytes(val))
+		fmt.Fprintf(sh.out, "version: %d, user meta: %d", item.Version(), item.UserMeta())
+		if exp := item.ExpiresAt(); exp > 0 {
+			fmt.Fprintf(sh.out, ", expires at: %s", time.Unix(int64(exp), 0).Format(time.RFC3339))
+		}
+		fmt.Fprintln(sh.out)
+		return nil
+	})
+}
+
+func (sh *shell) set(args []string) error {
+	if err := shellArgs(args, 2, 3, shellCommands["set"].usage); err != nil {
+		return err
+	}
+	key, err := parseShellBytes(args[0])
+	if err != nil {
+		return err
+	}
+	val, err := parseShellBytes(args[1])
+	if err != nil {
+		return err
+	}
+	e := badger.NewEntry(key, val)
+	if len(args) == 3 {
+		ttl, err := parseShellTTL(args[2])
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+	}
+	return sh.update(func(txn *badger.Txn) error {
+		return txn.SetEntry(e)
+	})
+}
+
+func (sh *shell) del(args []string) error {
+	if err := shellArgs(args, 1, 1, shellCommands["del"].usage); err != nil {
+		return err
+	}
+	key, err := parseShellBytes(args[0])
+	if err != nil {
+		return err
+	}
+	return sh.update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+}
+
+func (sh *shell) scan(args []string) error {
+	if err := shellArgs(args, 0, 2, shellCommands["scan"].usage); err != nil {
+		return err
+	}
+	var start []byte
+	if len(args) > 0 {
+		var err error
+		if start, err = parseShellBytes(args[0]); err != nil {
+			return err
+		}
+		args = args[1:]
+	}
+	return sh.list(start, nil, args)
+}
+
+func (sh *shell) prefix(args []string) error {
+	if err := shellArgs(args, 1, 2, shellCommands["prefix"].usage); err != nil {
+		return err
+	}
+	prefix, err := parseShellBytes(args[0])
+	if err != nil {
+		return err
+	}
+	return sh.list(prefix, prefix, args[1:])
+}
+
+// list prints the keys from start with the prefix, and the sizes of their values.
+func (sh *shell) list(start, prefix []byte, args []string) error {
+	limit := 20
+	if len(args) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(args[0]); err != nil || limit <= 0 {
+			return errors.Errorf("invalid limit %s", args[0])
+		}
+	}
+	return sh.view(func(txn *badger.Txn) error {
+		iopt := badger.DefaultIteratorOptions
+		iopt.PrefetchValues = false
+		iopt.Prefix = prefix
+		it := txn.NewIterator(iopt)
+		defer it.Close()
+
+		var n int
+		for it.Seek(start); it.Valid(); it.Next() {
+			if n == limit {
+				fmt.Fprintln(sh.out, "...")
+				return nil
+			}
+			item := it.Item()
+			fmt.Fprintf(sh.out, "%s (%s, version %d)\n", formatShellBytes(item.Key()),
+				humanize.IBytes(uint64(item.ValueSize())), item.Version())
+			n++
+		}
+		fmt.Fprintf(sh.out, "%d keys\n", n)
+		return nil
+	})
+}
+
+func (sh *shell) ttl(args []string) error {
+	if err := shellArgs(args, 1, 2, shellCommands["ttl"].usage); err != nil {
+		return err
+	}
+	key, err := parseShellBytes(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		return sh.view(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			if item.ExpiresAt() == 0 {
+				fmt.Fprintln(sh.out, "no expiry")
+				return nil
+			}
+			left := time.Until(time.Unix(int64(item.ExpiresAt()), 0)).Round(time.Second)
+			fmt.Fprintln(sh.out, left)
+			return nil
+		})
+	}
+
+	ttl, err := parseShellTTL(args[1])
+	if err != nil {
+		return err
+	}
+	// The expiry is part of the version, so the value is written again with the new one.
+	return sh.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		e := badger.NewEntry(key, val).WithMeta(item.UserMeta())
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		return txn.SetEntry(e)
+	})
+}
+
+func (sh *shell) info(args []string) error {
+	if err := shellArgs(args, 0, 0, shellCommands["info"].usage); err != nil {
+		return err
+	}
+	opt := sh.db.Opts()
+	lsm, vlog := sh.db.Size()
+	fmt.Fprintf(sh.out, "dir: %s, value dir: %s\n", opt.Dir, opt.ValueDir)
+	fmt.Fprintf(sh.out, "LSM size: %s, value log size: %s\n",
+		humanize.IBytes(uint64(lsm)), humanize.IBytes(uint64(vlog)))
+	levels := make(map[int]int)
+	for _, t := range sh.db.Tables() {
+		levels[t.Level]++
+	}
+	fmt.Fprintf(sh.out, "tables:")
+	for level := 0; level < opt.MaxLevels; level++ {
+		fmt.Fprintf(sh.out, " L%d: %d", level, levels[level])
+	}
+	fmt.Fprintln(sh.out)
+	fmt.Fprintf(sh.out, "max version: %d, read-only: %v, managed: %v\n",
+		sh.db.MaxVersion(), opt.ReadOnly, sh.managed)
+	if sh.managed {
+		return sh.ts(nil)
+	}
+	return nil
+}
+
+func (sh *shell) ts(args []string) error {
+	if !sh.managed {
+		return errors.New("the timestamps can only be used in managed mode")
+	}
+	if len(args) == 0 {
+		read := "latest"
+		if sh.readTs > 0 {
+			read = strconv.FormatUint(sh.readTs, 10)
+		}
+		commit := "unset"
+		if sh.commitTs > 0 {
+			commit = strconv.FormatUint(sh.commitTs, 10)
+		}
+		fmt.Fprintf(sh.out, "read ts: %s, commit ts: %s\n", read, commit)
+		return nil
+	}
+	if len(args) != 2 {
+		return errors.Errorf("usage: %s", shellCommands["ts"].usage)
+	}
+	ts, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errors.Errorf("invalid ts %s", args[1])
+	}
+	switch args[0] {
+	case "read":
+		sh.readTs = ts
+	case "commit":
+		if ts == 0 {
+			return errors.New("the commit ts can't be 0")
+		}
+		sh.commitTs = ts
+	default:
+		return errors.Errorf("usage: %s", shellCommands["ts"].usage)
+	}
+	return nil
+}
+
+func (sh *shell) help(args []string) error {
+	names := []string{"get", "set", "del", "scan", "prefix", "ttl", "info", "ts", "help"}
+	for _, name := range names {
+		cmd := shellCommands[name]
+		fmt.Fprintf(sh.out, "  %-26s %s\n", cmd.usage, cmd.help)
+	}
+	fmt.Fprintf(sh.out, "  %-26s %s\n", "exit", "Exit the shell.")
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func runShell(t *testing.T, sh *shell, script string) string {
+	var out bytes.Buffer
+	sh.out = &out
+	require.NoError(t, sh.run(strings.NewReader(script)))
+	return out.String()
+}
+
+func TestShell(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer db.Close()
+	sh := newShell(db, false, nil)
+
+	out := runShell(t, sh, `
+set user/1 alice
+set user/2 "bob smith"
+set 0x0001ff binary 1h
+set "0x" hex-lookalike
+get user/2
+get 0x0001ff
+ttl 0x0001ff
+ttl user/1
+scan user/ 1
+prefix user/
+del user/1
+get user/1
+del user/1
+ts
+bogus
+set onlykey
+exit
+get user/2
+`)
+	require.Contains(t, out, "\"bob smith\"\nversion: 2, user meta: 0\n")
+	require.Contains(t, out, "binary\nversion: 3, user meta: 0, expires at: ")
+	// The expiry has a precision of a second.
+	require.Regexp(t, "\n(59m59s|1h0m0s)\n", out)
+	require.Contains(t, out, "no expiry\n")
+	require.Contains(t, out, "user/1 (5 B, version 1)\n...\n")
+	require.Contains(t, out, "user/1 (5 B, version 1)\nuser/2 (9 B, version 2)\n2 keys\n")
+	require.Contains(t, out, "Error: Key not found\nError: Key not found\n")
+	require.Contains(t, out, "Error: the timestamps can only be used in managed mode\n")
+	require.Contains(t, out, "Error: unknown command \"bogus\"")
+	require.Contains(t, out, "Error: usage: set <key> <value> [ttl]\n")
+	// The commands after exit aren't run.
+	require.Equal(t, 1, strings.Count(out, "bob smith"))
+
+	out = runShell(t, sh, "scan\nttl 0x0001ff 0\nttl 0x0001ff\n")
+	require.Contains(t, out, "0x0001ff (6 B, version 3)\n\"0x\" (13 B, version 4)\nuser/2")
+	require.Contains(t, out, "no expiry\n")
+
+	require.Equal(t, []string{"a", "\x00b c", "\x00\"d\"", "0x01"},
+		func() []string { args, _ := splitShellLine(` a "b c"  "\"d\"" 0x01 `); return args }())
+	_, err = splitShellLine(`get "key`)
+	require.Error(t, err)
+}
+
+func TestShellManaged(t *testing.T) {
+	db, err := badger.OpenManaged(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer db.Close()
+	sh := newShell(db, true, nil)
+
+	out := runShell(t, sh, `
+set k v1
+ts commit 10
+set k v1
+ts commit 20
+set k v2
+get k
+ts read 15
+get k
+ts read 5
+get k
+ts
+`)
+	require.Contains(t, out, "Error: the commit ts must be set")
+	require.Contains(t, out, "v2\nversion: 20, user meta: 0\n")
+	require.Contains(t, out, "v1\nversion: 10, user meta: 0\n")
+	require.Contains(t, out, "Error: Key not found\n")
+	require.Contains(t, out, "read ts: 5, commit ts: 20\n")
+
+	out = runShell(t, sh, "ts read 0\ninfo\n")
+	require.Contains(t, out, "max version: 20, read-only: false, managed: true\n")
+	require.Contains(t, out, "read ts: latest, commit ts: 20\n")
+}
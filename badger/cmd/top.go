@@ -0,0 +1,293 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var topOpt = struct {
+	top        int
+	separator  string
+	prefixLen  int
+	sample     float64
+	withPrefix string
+	readOnly   bool
+}{}
+
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Report the largest keys, values and prefixes of a Badger database.",
+	Long: `Scan a Badger database and report its largest keys and values, its prefixes
+holding the most bytes and the most keys, and the keys with the most versions.
+
+The prefix of a key is the part up to and including the first --separator, or
+its first --prefix-len bytes if it has no separator. With --sample, only a
+fraction of the keys, picked by the hash of the key, is scanned, and the sizes
+reported are those of the sampled keys.`,
+	RunE: doTop,
+}
+
+func init() {
+	RootCmd.AddCommand(topCmd)
+	topCmd.Flags().IntVarP(&topOpt.top, "top", "n", 10, "Number of entries of each report.")
+	topCmd.Flags().StringVar(&topOpt.separator, "separator", "",
+		"Separator ending the prefixes of the keys, like \"/\".")
+	topCmd.Flags().IntVar(&topOpt.prefixLen, "prefix-len", 4,
+		"Length of the prefixes of the keys without separator.")
+	topCmd.Flags().Float64Var(&topOpt.sample, "sample", 1,
+		"Fraction of the keys to scan, between 0 and 1.")
+	topCmd.Flags().StringVar(&topOpt.withPrefix, "with-prefix", "",
+		"Hex of the prefix of the keys to scan.")
+	topCmd.Flags().BoolVar(&topOpt.readOnly, "read-only", true, "Open the DB in read-only mode.")
+}
+
+func doTop(cmd *cobra.Command, args []string) error {
+	if topOpt.top <= 0 {
+		return errors.New("--top must be positive")
+	}
+	if topOpt.sample <= 0 || topOpt.sample > 1 {
+		return errors.New("--sample must be in (0, 1]")
+	}
+	if topOpt.prefixLen <= 0 {
+		return errors.New("--prefix-len must be positive")
+	}
+	prefix, err := hex.DecodeString(topOpt.withPrefix)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode hex prefix: %s", topOpt.withPrefix)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithReadOnly(topOpt.readOnly).
+		WithNumVersionsToKeep(math.MaxInt32).
+		WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats := newTopStats(topOpt.top, []byte(topOpt.separator), topOpt.prefixLen)
+	start := time.Now()
+	if err := stats.scan(db, prefix, topOpt.sample); err != nil {
+		return err
+	}
+	stats.report(os.Stdout)
+	fmt.Printf("\nScanned in %s.\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// topEntry is an entry of a top-n report. Each key has at most one entry in each report.
+type topEntry struct {
+	key     []byte
+	version uint64
+	n       int64
+}
+
+// topHeap keeps the n entries with the largest values. It's a min-heap, whose root is the entry
+// to evict when a larger one is pushed.
+type topHeap struct {
+	n       int
+	entries []topEntry
+}
+
+func (h *topHeap) Len() int           { return len(h.entries) }
+func (h *topHeap) Less(i, j int) bool { return h.entries[i].n < h.entries[j].n }
+func (h *topHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *topHeap) Push(x interface{}) { h.entries = append(h.entries, x.(topEntry)) }
+func (h *topHeap) Pop() (x interface{}) {
+	x, h.entries = h.entries[len(h.entries)-1], h.entries[:len(h.entries)-1]
+	return x
+}
+
+// add adds an entry, copying its key if it's kept.
+func (h *topHeap) add(key []byte, version uint64, n int64) {
+	if len(h.entries) == h.n {
+		if h.entries[0].n >= n {
+			return
+		}
+		heap.Pop(h)
+	}
+	heap.Push(h, topEntry{key: append([]byte{}, key...), version: version, n: n})
+}
+
+// sorted returns the entries, the largest first.
+func (h *topHeap) sorted() []topEntry {
+	entries := append([]topEntry{}, h.entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].n > entries[j].n })
+	return entries
+}
+
+type prefixStats struct {
+	keys     int64
+	versions int64
+	bytes    int64
+}
+
+// topStats gathers the reports of the top command.
+type topStats struct {
+	separator []byte
+	prefixLen int
+
+	keys     int64
+	sampled  int64
+	versions int64
+	bytes    int64
+	prefixes map[string]*prefixStats
+
+	largestKeys   topHeap
+	largestValues topHeap
+	mostVersions  topHeap
+}
+
+func newTopStats(n int, separator []byte, prefixLen int) *topStats {
+	return &topStats{
+		separator:     separator,
+		prefixLen:     prefixLen,
+		prefixes:      make(map[string]*prefixStats),
+		largestKeys:   topHeap{n: n},
+		largestValues: topHeap{n: n},
+		mostVersions:  topHeap{n: n},
+	}
+}
+
+func (s *topStats) prefix(key []byte) []byte {
+	if len(s.separator) > 0 {
+		if i := bytes.Index(key, s.separator); i >= 0 {
+			return key[:i+len(s.separator)]
+		}
+	}
+	if len(key) > s.prefixLen {
+		return key[:s.prefixLen]
+	}
+	return key
+}
+
+// scan adds the versions of the keys with the prefix, sampling the given fraction of the keys.
+func (s *topStats) scan(db *badger.DB, prefix []byte, sample float64) error {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	iopt := badger.DefaultIteratorOptions
+	iopt.Prefix = prefix
+	iopt.PrefetchValues = false
+	iopt.AllVersions = true
+	it := txn.NewIterator(iopt)
+	defer it.Close()
+
+	threshold := uint64(sample * math.MaxUint64)
+	var key []byte
+	var latest, largestVersion uint64
+	var versions, size, largest int64
+	flush := func() {
+		if versions == 0 {
+			return
+		}
+		s.sampled++
+		s.versions += versions
+		s.bytes += size
+		s.largestKeys.add(key, latest, int64(len(key)))
+		s.largestValues.add(key, largestVersion, largest)
+		s.mostVersions.add(key, 0, versions)
+		p := s.prefix(key)
+		ps, ok := s.prefixes[string(p)]
+		if !ok {
+			ps = &prefixStats{}
+			s.prefixes[string(p)] = ps
+		}
+		ps.keys++
+		ps.versions += versions
+		ps.bytes += size
+		versions, size, largest = 0, 0, -1
+	}
+	largest = -1
+	var skip bool
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !bytes.Equal(item.Key(), key) {
+			flush()
+			key = item.KeyCopy(key)
+			s.keys++
+			skip = sample < 1 && xxhash.Sum64(key) > threshold
+		}
+		if skip {
+			continue
+		}
+		// The versions of a key are iterated from the latest one.
+		if versions == 0 {
+			latest = item.Version()
+		}
+		versions++
+		size += item.EstimatedSize()
+		if item.ValueSize() > largest {
+			largest, largestVersion = item.ValueSize(), item.Version()
+		}
+	}
+	flush()
+	return nil
+}
+
+func (s *topStats) report(w io.Writer) {
+	fmt.Fprintf(w, "Scanned %d keys", s.keys)
+	if s.sampled != s.keys {
+		fmt.Fprintf(w, ", sampled %d", s.sampled)
+	}
+	fmt.Fprintf(w, ": %d versions, %s.\n", s.versions, hbytes(s.bytes))
+
+	fmt.Fprintln(w, "\nLargest values, with the version having the largest one:")
+	for _, e := range s.largestValues.sorted() {
+		fmt.Fprintf(w, "  %10s  %s (version %d)\n", hbytes(e.n), formatShellBytes(e.key), e.version)
+	}
+	fmt.Fprintln(w, "\nLargest keys, with their latest version:")
+	for _, e := range s.largestKeys.sorted() {
+		fmt.Fprintf(w, "  %10s  %s (version %d)\n", hbytes(e.n), formatShellBytes(e.key), e.version)
+	}
+	fmt.Fprintln(w, "\nMost versions:")
+	for _, e := range s.mostVersions.sorted() {
+		fmt.Fprintf(w, "  %10d  %s\n", e.n, formatShellBytes(e.key))
+	}
+
+	byBytes, byKeys := topHeap{n: s.largestKeys.n}, topHeap{n: s.largestKeys.n}
+	for p, ps := range s.prefixes {
+		byBytes.add([]byte(p), 0, ps.bytes)
+		byKeys.add([]byte(p), 0, ps.keys)
+	}
+	printPrefixes := func(title string, h *topHeap) {
+		fmt.Fprintf(w, "\n%s:\n", title)
+		for _, e := range h.sorted() {
+			ps := s.prefixes[string(e.key)]
+			fmt.Fprintf(w, "  %10s  %8d keys  %8d versions  %5.1f%%  %s\n", hbytes(ps.bytes),
+				ps.keys, ps.versions, 100*float64(ps.bytes)/float64(s.bytes),
+				formatShellBytes(e.key))
+		}
+	}
+	printPrefixes("Largest prefixes by bytes", &byBytes)
+	printPrefixes("Largest prefixes by keys", &byKeys)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopStats(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithNumVersionsToKeep(math.MaxInt32).WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer db.Close()
+
+	set := func(key string, size int) {
+		require.NoError(t, db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(key), make([]byte, size))
+		}))
+	}
+	// Tenant a has a few large values, b many small ones, and c a key with many versions.
+	for i := 0; i < 3; i++ {
+		set(fmt.Sprintf("a/%d", i), 1000*(i+1))
+	}
+	for i := 0; i < 50; i++ {
+		set(fmt.Sprintf("b/%02d", i), 10)
+	}
+	for i := 0; i < 20; i++ {
+		set("c/counter", 8)
+	}
+	set("nosep", 1)
+
+	s := newTopStats(2, []byte("/"), 5)
+	require.NoError(t, s.scan(db, nil, 1))
+	require.Equal(t, int64(55), s.keys)
+	require.Equal(t, int64(55), s.sampled)
+	require.Equal(t, int64(74), s.versions)
+
+	values := s.largestValues.sorted()
+	require.Len(t, values, 2)
+	require.Equal(t, "a/2", string(values[0].key))
+	require.Equal(t, int64(3000), values[0].n)
+	require.Equal(t, "a/1", string(values[1].key))
+	versions := s.mostVersions.sorted()
+	require.Equal(t, "c/counter", string(versions[0].key))
+	require.Equal(t, int64(20), versions[0].n)
+	require.Equal(t, int64(1), versions[1].n)
+	keys := s.largestKeys.sorted()
+	require.Equal(t, "c/counter", string(keys[0].key))
+	require.Equal(t, uint64(73), keys[0].version)
+
+	require.Len(t, s.prefixes, 4)
+	require.Equal(t, int64(50), s.prefixes["b/"].keys)
+	require.Equal(t, int64(20), s.prefixes["c/"].versions)
+	require.Equal(t, int64(1), s.prefixes["nosep"].keys)
+
+	var buf bytes.Buffer
+	s.report(&buf)
+	out := buf.String()
+	require.Contains(t, out, "Scanned 55 keys: 74 versions")
+	require.Contains(t, out, "2.9 KiB  a/2 (version 3)\n")
+	require.Contains(t, out, "        20  c/counter\n")
+	require.Regexp(t, "Largest prefixes by bytes:\n .* a/\n", out)
+	require.Regexp(t, "Largest prefixes by keys:\n .* 50 keys .* b/\n", out)
+
+	// Sampling picks the same keys on every scan.
+	s1, s2 := newTopStats(2, nil, 2), newTopStats(2, nil, 2)
+	require.NoError(t, s1.scan(db, nil, 0.5))
+	require.NoError(t, s2.scan(db, nil, 0.5))
+	require.Equal(t, int64(55), s1.keys)
+	require.Less(t, s1.sampled, int64(55))
+	require.Greater(t, s1.sampled, int64(0))
+	require.Equal(t, s1.sampled, s2.sampled)
+	require.Equal(t, s1.bytes, s2.bytes)
+
+	s = newTopStats(2, nil, 2)
+	require.NoError(t, s.scan(db, []byte("b/"), 1))
+	require.Equal(t, int64(50), s.keys)
+}
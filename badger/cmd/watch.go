@@ -0,0 +1,233 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/rpc"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+var watchOpt = struct {
+	addr     string
+	prefixes []string
+	tail     int
+	since    uint64
+	maxValue int
+}{}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Print the mutations of a Badger database.",
+	Long: `Print the mutations of the keys with the given prefixes, or of all the keys.
+
+With --addr, the command connects to the gRPC service of "badger serve --grpc"
+and prints the mutations as they are committed, until it is interrupted. The
+deletions are printed as empty values, which the subscriptions don't tell apart.
+
+Otherwise, it opens the DB in read-only mode and prints its latest --tail
+mutations, or those newer than --since. A DB opened by another process for
+writing can't be opened, and its live mutations can only be watched with --addr.
+
+The prefixes and the keys are written like in the shell command: as plain
+words, or as hex with a 0x prefix.`,
+	RunE: doWatch,
+}
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+	watchCmd.Flags().StringVar(&watchOpt.addr, "addr", "",
+		"Address of the gRPC service to watch, like localhost:9090.")
+	watchCmd.Flags().StringSliceVar(&watchOpt.prefixes, "prefix", nil,
+		"Prefix of the keys to watch. Can be repeated.")
+	watchCmd.Flags().IntVar(&watchOpt.tail, "tail", 20,
+		"Number of latest mutations to print, without --addr.")
+	watchCmd.Flags().Uint64Var(&watchOpt.since, "since", 0,
+		"Print all the mutations newer than this version instead of the latest ones, "+
+			"without --addr.")
+	watchCmd.Flags().IntVar(&watchOpt.maxValue, "max-value", 64,
+		"Number of bytes of the values to print.")
+}
+
+func doWatch(cmd *cobra.Command, args []string) error {
+	var prefixes [][]byte
+	for _, p := range watchOpt.prefixes {
+		prefix, err := parseShellBytes(p)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	w := &mutationWriter{out: os.Stdout, maxValue: watchOpt.maxValue}
+
+	if watchOpt.addr == "" {
+		if watchOpt.tail <= 0 && watchOpt.since == 0 {
+			return errors.New("--tail must be positive")
+		}
+		db, err := badger.Open(badger.DefaultOptions(sstDir).
+			WithValueDir(vlogDir).
+			WithReadOnly(true).
+			WithLoggingLevel(badger.WARNING))
+		if err != nil {
+			return errors.Wrap(err, "cannot open the DB, use --addr if it's in use by a server")
+		}
+		defer db.Close()
+		return watchTail(db, prefixes, watchOpt.tail, watchOpt.since, w)
+	}
+
+	cc, err := grpc.Dial(watchOpt.addr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+	err = watchRemote(ctx, rpc.NewClient(cc), prefixes, w)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// watchRemote prints the mutations of the keys with the prefixes streamed by the gRPC service of
+// c, until ctx is done.
+func watchRemote(ctx context.Context, c *rpc.Client, prefixes [][]byte, w *mutationWriter) error {
+	matches := make([]*pb.Match, 0, len(prefixes))
+	for _, p := range prefixes {
+		matches = append(matches, &pb.Match{Prefix: p})
+	}
+	return c.Subscribe(ctx, matches, func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			w.write(kv.Key, kv.Value, kv.Version, kv.ExpiresAt, false)
+		}
+		return nil
+	})
+}
+
+type watchedMutation struct {
+	key, value []byte
+	version    uint64
+	expiresAt  uint64
+	deleted    bool
+}
+
+// watchTail prints the mutations of the keys with the prefixes newer than since, or the tail latest
+// ones if since is zero, in the order they were committed.
+func watchTail(db *badger.DB, prefixes [][]byte, tail int, since uint64,
+	w *mutationWriter) error {
+	if len(prefixes) == 0 {
+		prefixes = [][]byte{nil}
+	}
+	var mutations []watchedMutation
+	// trim keeps the latest mutations, first. The keys of a version are sorted in reverse, to be
+	// printed in order.
+	trim := func() {
+		sort.Slice(mutations, func(i, j int) bool {
+			if mutations[i].version != mutations[j].version {
+				return mutations[i].version > mutations[j].version
+			}
+			return bytes.Compare(mutations[i].key, mutations[j].key) > 0
+		})
+		if since == 0 && len(mutations) > tail {
+			mutations = mutations[:tail]
+		}
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		for _, prefix := range prefixes {
+			iopt := badger.DefaultIteratorOptions
+			iopt.Prefix = prefix
+			iopt.AllVersions = true
+			iopt.PrefetchValues = false
+			iopt.SinceTs = since
+			it := txn.NewIterator(iopt)
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				m := watchedMutation{
+					key:       item.KeyCopy(nil),
+					version:   item.Version(),
+					expiresAt: item.ExpiresAt(),
+					deleted:   item.IsDeletedOrExpired() && item.ExpiresAt() == 0,
+				}
+				if !m.deleted {
+					var err error
+					if m.value, err = item.ValueCopy(nil); err != nil {
+						it.Close()
+						return err
+					}
+				}
+				mutations = append(mutations, m)
+				if since == 0 && len(mutations) >= 2*tail {
+					trim()
+				}
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	trim()
+	for i := len(mutations) - 1; i >= 0; i-- {
+		m := mutations[i]
+		w.write(m.key, m.value, m.version, m.expiresAt, m.deleted)
+	}
+	return nil
+}
+
+// mutationWriter prints the mutations, one per line.
+type mutationWriter struct {
+	out      io.Writer
+	maxValue int
+}
+
+func (w *mutationWriter) write(key, value []byte, version, expiresAt uint64, deleted bool) {
+	if deleted {
+		fmt.Fprintf(w.out, "v%d DEL %s\n", version, formatShellBytes(key))
+		return
+	}
+	val := formatShellBytes(value)
+	if len(value) > w.maxValue {
+		val = fmt.Sprintf("%s... (%s)", formatShellBytes(value[:w.maxValue]),
+			hbytes(int64(len(value))))
+	}
+	fmt.Fprintf(w.out, "v%d SET %s = %s", version, formatShellBytes(key), val)
+	if expiresAt > 0 {
+		fmt.Fprintf(w.out, " expires at %s", time.Unix(int64(expiresAt), 0).Format(time.RFC3339))
+	}
+	fmt.Fprintln(w.out)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/rpc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestWatchTail(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte("a/1"), []byte("one")); err != nil {
+			return err
+		}
+		return txn.Set([]byte("b/1"), []byte("other"))
+	}))
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte("a/2"), bytes.Repeat([]byte("x"), 100)).
+			WithTTL(time.Hour))
+	}))
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("a/1"))
+	}))
+
+	var buf bytes.Buffer
+	w := &mutationWriter{out: &buf, maxValue: 4}
+	require.NoError(t, watchTail(db, [][]byte{[]byte("a/")}, 2, 0, w))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Regexp(t, `^v2 SET a/2 = xxxx\.\.\. \(100 B\) expires at `, lines[0])
+	require.Equal(t, "v3 DEL a/1", lines[1])
+
+	buf.Reset()
+	require.NoError(t, watchTail(db, nil, 0, 1, w))
+	require.Contains(t, buf.String(), "v2 SET a/2")
+	require.NotContains(t, buf.String(), "v1 ")
+
+	buf.Reset()
+	require.NoError(t, watchTail(db, nil, 10, 0, w))
+	require.True(t, strings.HasPrefix(buf.String(),
+		"v1 SET a/1 = one\nv1 SET b/1 = othe... (5 B)\nv2 SET a/2"), buf.String())
+}
+
+func TestWatchRemote(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer db.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	rpc.RegisterBadgerServer(s, rpc.NewServer(db))
+	go s.Serve(l)
+	defer s.Stop()
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+
+	var out syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- watchRemote(ctx, rpc.NewClient(cc), [][]byte{[]byte("a/")},
+			&mutationWriter{out: &out, maxValue: 64})
+	}()
+
+	// Write until the subscription has started.
+	require.Eventually(t, func() bool {
+		require.NoError(t, db.Update(func(txn *badger.Txn) error {
+			if err := txn.Set([]byte("b/1"), []byte("ignored")); err != nil {
+				return err
+			}
+			return txn.Set([]byte("a/1"), []byte("seen"))
+		}))
+		return strings.Contains(out.String(), "SET a/1 = seen\n")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NotContains(t, out.String(), "b/1")
+
+	cancel()
+	<-done
+}
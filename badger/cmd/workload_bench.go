@@ -0,0 +1,463 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+var workloadBenchCmd = &cobra.Command{
+	Use:   "workload",
+	Short: "Run YCSB-style workloads to benchmark Badger.",
+	Long: `
+This command runs the workloads given with --profiles one after the other on a Badger database, and
+prints the throughput and the latency percentiles of each of them. The profiles are:
+
+  fillseq     writes the keys in order.
+  fillrandom  writes the keys in random order.
+  readrandom  reads random keys.
+  scan        iterates over --scan-len keys from random keys.
+  mixed       reads random keys, or writes them, with the ratio of reads of --read-ratio.
+
+The keys are picked among --num ones, uniformly or following a zipfian distribution whose hottest
+keys are the smallest ones. Each profile runs --ops operations, or for --duration if it is set.
+Pass the options of the DB to tune with --badger, like "numcompactors=8; valuethreshold=256", and
+--seed to replay the same keys and values.
+`,
+	RunE: workloadBench,
+}
+
+var wlo = struct {
+	profiles     string
+	num          int
+	ops          int
+	duration     time.Duration
+	keySize      int
+	valSize      int
+	valSizeMax   int
+	distribution string
+	zipfS        float64
+	goroutines   int
+	readRatio    float64
+	scanLen      int
+	seed         int64
+	syncWrites   bool
+	badgerOpt    string
+}{}
+
+func init() {
+	benchCmd.AddCommand(workloadBenchCmd)
+	flags := workloadBenchCmd.Flags()
+	flags.StringVar(&wlo.profiles, "profiles", "fillrandom,readrandom",
+		"Comma-separated profiles to run: fillseq, fillrandom, readrandom, scan or mixed.")
+	flags.IntVar(&wlo.num, "num", 1000000, "Number of distinct keys.")
+	flags.IntVar(&wlo.ops, "ops", 0, "Number of operations of each profile. Defaults to --num.")
+	flags.DurationVarP(&wlo.duration, "duration", "d", 0,
+		"How long to run each profile, instead of --ops.")
+	flags.IntVarP(&wlo.keySize, "key-size", "k", 16, "Size of the keys, at least 8.")
+	flags.IntVar(&wlo.valSize, "val-size", 128, "Size of the values.")
+	flags.IntVar(&wlo.valSizeMax, "val-size-max", 0,
+		"If larger than --val-size, the values have a random size up to it.")
+	flags.StringVar(&wlo.distribution, "distribution", "uniform",
+		"Distribution of the keys, uniform or zipfian.")
+	flags.Float64Var(&wlo.zipfS, "zipf-s", 1.1, "Exponent of the zipfian distribution, above 1.")
+	flags.IntVarP(&wlo.goroutines, "goroutines", "g", 16, "Number of concurrent operations.")
+	flags.Float64Var(&wlo.readRatio, "read-ratio", 0.5, "Ratio of the reads of the mixed profile.")
+	flags.IntVar(&wlo.scanLen, "scan-len", 100, "Number of keys read by each scan.")
+	flags.Int64Var(&wlo.seed, "seed", 1, "Seed of the random keys and values.")
+	flags.BoolVar(&wlo.syncWrites, "sync", false, "Sync the writes to disk.")
+	flags.StringVar(&wlo.badgerOpt, "badger", "",
+		"Options of the DB, like \"numcompactors=8; compression=zstd:1\".")
+}
+
+// workloadConfig is the configuration of the workloads of the workload command.
+type workloadConfig struct {
+	num          int
+	ops          int
+	duration     time.Duration
+	keySize      int
+	valSize      int
+	valSizeMax   int
+	zipfian      bool
+	zipfS        float64
+	goroutines   int
+	readRatio    float64
+	scanLen      int
+	seed         int64
+	profileIndex int64
+}
+
+var workloadProfiles = map[string]func(w *workloadWorker) (read bool, err error){
+	"fillseq":    (*workloadWorker).fillSeq,
+	"fillrandom": (*workloadWorker).fillRandom,
+	"readrandom": (*workloadWorker).readRandom,
+	"scan":       (*workloadWorker).scan,
+	"mixed":      (*workloadWorker).mixed,
+}
+
+func workloadBench(cmd *cobra.Command, args []string) error {
+	cfg := workloadConfig{
+		num:        wlo.num,
+		ops:        wlo.ops,
+		duration:   wlo.duration,
+		keySize:    wlo.keySize,
+		valSize:    wlo.valSize,
+		valSizeMax: wlo.valSizeMax,
+		zipfS:      wlo.zipfS,
+		goroutines: wlo.goroutines,
+		readRatio:  wlo.readRatio,
+		scanLen:    wlo.scanLen,
+		seed:       wlo.seed,
+	}
+	switch wlo.distribution {
+	case "uniform":
+	case "zipfian":
+		cfg.zipfian = true
+	default:
+		return errors.Errorf("Invalid distribution: %s", wlo.distribution)
+	}
+	if cfg.ops == 0 {
+		cfg.ops = cfg.num
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	profiles := strings.Split(wlo.profiles, ",")
+	for _, p := range profiles {
+		if _, ok := workloadProfiles[p]; !ok {
+			return errors.Errorf("Invalid profile: %s", p)
+		}
+	}
+
+	opt := badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithSyncWrites(wlo.syncWrites).
+		WithLoggingLevel(badger.WARNING)
+	if wlo.badgerOpt != "" {
+		opt = opt.FromSuperFlag(wlo.badgerOpt)
+	}
+	fmt.Printf("Opening badger with options = %+v\n", opt)
+	db, err := badger.Open(opt)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	printWorkloadHeader(os.Stdout)
+	for i, p := range profiles {
+		cfg.profileIndex = int64(i)
+		res, err := runWorkload(db, cfg, p)
+		if err != nil {
+			return errors.Wrapf(err, "profile %s failed", p)
+		}
+		res.print(os.Stdout)
+	}
+	return nil
+}
+
+func (cfg *workloadConfig) validate() error {
+	switch {
+	case cfg.num <= 0:
+		return errors.New("--num must be positive")
+	case cfg.ops <= 0 && cfg.duration <= 0:
+		return errors.New("--ops or --duration must be positive")
+	case cfg.keySize < 8:
+		return errors.New("--key-size must be at least 8")
+	case cfg.valSize < 0:
+		return errors.New("--val-size can't be negative")
+	case cfg.zipfS <= 1:
+		return errors.New("--zipf-s must be above 1")
+	case cfg.goroutines <= 0:
+		return errors.New("--goroutines must be positive")
+	case cfg.readRatio < 0 || cfg.readRatio > 1:
+		return errors.New("--read-ratio must be in [0, 1]")
+	case cfg.scanLen <= 0:
+		return errors.New("--scan-len must be positive")
+	}
+	return nil
+}
+
+// workloadResult is the result of a profile.
+type workloadResult struct {
+	profile    string
+	ops        int64
+	reads      int64
+	found      int64
+	bytes      int64
+	elapsed    time.Duration
+	latency    []time.Duration // Sorted samples.
+	maxLatency time.Duration
+}
+
+// maxLatencySamples is the number of latencies sampled by each goroutine, to compute the
+// percentiles.
+const maxLatencySamples = 1 << 16
+
+// workloadWorker runs the operations of a goroutine.
+type workloadWorker struct {
+	db   *badger.DB
+	cfg  *workloadConfig
+	rng  *rand.Rand
+	zipf *rand.Zipf
+	key  []byte
+	val  []byte
+	// next is the index of the next key of fillseq, shared by the workers.
+	next *int64
+
+	ops, reads, found, bytes int64
+	samples                  []time.Duration
+	maxLatency               time.Duration
+}
+
+// runWorkload runs a profile on db, and returns its result.
+func runWorkload(db *badger.DB, cfg workloadConfig, profile string) (*workloadResult, error) {
+	op := workloadProfiles[profile]
+	var next int64
+	var remaining = int64(cfg.ops)
+	var stop int32
+	var wg sync.WaitGroup
+	workers := make([]*workloadWorker, cfg.goroutines)
+	errCh := make(chan error, cfg.goroutines)
+
+	start := time.Now()
+	for i := range workers {
+		// The seed depends on the profile and on the worker, for the same keys and values to be
+		// used by every run.
+		rng := rand.New(rand.NewSource(cfg.seed + 1000*cfg.profileIndex + int64(i)))
+		w := &workloadWorker{
+			db:   db,
+			cfg:  &cfg,
+			rng:  rng,
+			key:  make([]byte, cfg.keySize),
+			next: &next,
+		}
+		if cfg.zipfian {
+			w.zipf = rand.NewZipf(rng, cfg.zipfS, 1, uint64(cfg.num-1))
+		}
+		maxVal := cfg.valSize
+		if cfg.valSizeMax > maxVal {
+			maxVal = cfg.valSizeMax
+		}
+		w.val = make([]byte, maxVal)
+		rng.Read(w.val)
+		workers[i] = w
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				if cfg.duration > 0 {
+					if time.Since(start) >= cfg.duration {
+						return
+					}
+				} else if atomic.AddInt64(&remaining, -1) < 0 {
+					return
+				}
+				opStart := time.Now()
+				read, err := op(w)
+				if err != nil {
+					atomic.StoreInt32(&stop, 1)
+					errCh <- err
+					return
+				}
+				w.record(time.Since(opStart), read)
+			}
+		}()
+	}
+	wg.Wait()
+	res := &workloadResult{profile: profile, elapsed: time.Since(start)}
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+
+	for _, w := range workers {
+		res.ops += w.ops
+		res.reads += w.reads
+		res.found += w.found
+		res.bytes += w.bytes
+		res.latency = append(res.latency, w.samples...)
+		if w.maxLatency > res.maxLatency {
+			res.maxLatency = w.maxLatency
+		}
+	}
+	sort.Slice(res.latency, func(i, j int) bool { return res.latency[i] < res.latency[j] })
+	return res, nil
+}
+
+// record adds the latency of an operation, keeping a uniform sample of the latencies.
+func (w *workloadWorker) record(d time.Duration, read bool) {
+	w.ops++
+	if read {
+		w.reads++
+	}
+	if d > w.maxLatency {
+		w.maxLatency = d
+	}
+	if len(w.samples) < maxLatencySamples {
+		w.samples = append(w.samples, d)
+	} else if i := w.rng.Int63n(w.ops); i < maxLatencySamples {
+		w.samples[i] = d
+	}
+}
+
+// setKey sets w.key to the key of index i, zero-padded big-endian.
+func (w *workloadWorker) setKey(i uint64) []byte {
+	for j := range w.key[:len(w.key)-8] {
+		w.key[j] = 0
+	}
+	binary.BigEndian.PutUint64(w.key[len(w.key)-8:], i)
+	return w.key
+}
+
+func (w *workloadWorker) randomKey() []byte {
+	if w.zipf != nil {
+		return w.setKey(w.zipf.Uint64())
+	}
+	return w.setKey(uint64(w.rng.Intn(w.cfg.num)))
+}
+
+func (w *workloadWorker) value() []byte {
+	sz := w.cfg.valSize
+	if w.cfg.valSizeMax > sz {
+		sz += w.rng.Intn(w.cfg.valSizeMax - sz + 1)
+	}
+	// Start the value at a random offset of the random buffer, for the values to differ.
+	off := w.rng.Intn(len(w.val) - sz + 1)
+	return w.val[off : off+sz]
+}
+
+func (w *workloadWorker) set(key []byte) error {
+	val := w.value()
+	w.bytes += int64(len(key) + len(val))
+	return w.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+}
+
+func (w *workloadWorker) fillSeq() (bool, error) {
+	i := atomic.AddInt64(w.next, 1) - 1
+	return false, w.set(w.setKey(uint64(i % int64(w.cfg.num))))
+}
+
+func (w *workloadWorker) fillRandom() (bool, error) {
+	return false, w.set(w.randomKey())
+}
+
+func (w *workloadWorker) readRandom() (bool, error) {
+	key := w.randomKey()
+	err := w.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			w.found++
+			w.bytes += int64(len(key) + len(val))
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		err = nil
+	}
+	return true, err
+}
+
+func (w *workloadWorker) scan() (bool, error) {
+	key := w.randomKey()
+	err := w.db.View(func(txn *badger.Txn) error {
+		iopt := badger.DefaultIteratorOptions
+		iopt.PrefetchSize = w.cfg.scanLen
+		if iopt.PrefetchSize > 100 {
+			iopt.PrefetchSize = 100
+		}
+		it := txn.NewIterator(iopt)
+		defer it.Close()
+		n := 0
+		for it.Seek(key); it.Valid() && n < w.cfg.scanLen; it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				w.bytes += int64(len(it.Item().Key()) + len(val))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		if n > 0 {
+			w.found++
+		}
+		return nil
+	})
+	return true, err
+}
+
+func (w *workloadWorker) mixed() (bool, error) {
+	if w.rng.Float64() < w.cfg.readRatio {
+		return w.readRandom()
+	}
+	return w.fillRandom()
+}
+
+func printWorkloadHeader(out io.Writer) {
+	fmt.Fprintf(out, "%-11s %10s %9s %12s %10s %9s %9s %9s %9s %9s %7s\n", "PROFILE", "OPS",
+		"TIME", "OPS/SEC", "BYTES/SEC", "P50", "P95", "P99", "P99.9", "MAX", "FOUND")
+}
+
+// percentile returns the latency below which are the ratio p of the samples.
+func (r *workloadResult) percentile(p float64) time.Duration {
+	if len(r.latency) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(r.latency)))
+	if i >= len(r.latency) {
+		i = len(r.latency) - 1
+	}
+	return r.latency[i]
+}
+
+func (r *workloadResult) print(out io.Writer) {
+	secs := r.elapsed.Seconds()
+	found := "-"
+	if r.reads > 0 {
+		found = fmt.Sprintf("%.1f%%", 100*float64(r.found)/float64(r.reads))
+	}
+	lat := func(d time.Duration) string {
+		return d.Round(time.Microsecond).String()
+	}
+	fmt.Fprintf(out, "%-11s %10d %9s %12.0f %10s %9s %9s %9s %9s %9s %7s\n", r.profile, r.ops,
+		r.elapsed.Round(time.Millisecond), float64(r.ops)/secs,
+		humanize.IBytes(uint64(float64(r.bytes)/secs)), lat(r.percentile(0.5)),
+		lat(r.percentile(0.95)), lat(r.percentile(0.99)), lat(r.percentile(0.999)),
+		lat(r.maxLatency), found)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkloadProfiles(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer db.Close()
+
+	cfg := workloadConfig{num: 500, ops: 500, keySize: 16, valSize: 10, valSizeMax: 20,
+		zipfS: 1.1, goroutines: 4, readRatio: 0.5, scanLen: 10, seed: 1}
+	require.NoError(t, cfg.validate())
+
+	res, err := runWorkload(db, cfg, "fillseq")
+	require.NoError(t, err)
+	require.Equal(t, int64(500), res.ops)
+	require.Zero(t, res.reads)
+	// fillseq writes every key once.
+	var keys int
+	require.NoError(t, db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Len(t, it.Item().Key(), 16)
+			val, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.True(t, len(val) >= 10 && len(val) <= 20)
+			keys++
+		}
+		return nil
+	}))
+	require.Equal(t, 500, keys)
+
+	for _, p := range []string{"fillrandom", "readrandom", "scan", "mixed"} {
+		res, err := runWorkload(db, cfg, p)
+		require.NoError(t, err, p)
+		require.Equal(t, int64(500), res.ops, p)
+		require.Len(t, res.latency, 500)
+		require.True(t, res.percentile(0.5) <= res.percentile(0.99))
+		require.True(t, res.percentile(0.999) <= res.maxLatency)
+		switch p {
+		case "readrandom", "scan":
+			require.Equal(t, res.ops, res.reads, p)
+			require.Equal(t, res.reads, res.found, p)
+		case "mixed":
+			require.True(t, res.reads > 0 && res.reads < res.ops)
+		}
+	}
+
+	// The zipfian keys are skewed to the smallest ones.
+	cfg.zipfian = true
+	res, err = runWorkload(db, cfg, "readrandom")
+	require.NoError(t, err)
+	require.Equal(t, res.reads, res.found)
+
+	cfg.ops, cfg.duration = 0, 50*time.Millisecond
+	res, err = runWorkload(db, cfg, "mixed")
+	require.NoError(t, err)
+	require.NotZero(t, res.ops)
+
+	var buf bytes.Buffer
+	printWorkloadHeader(&buf)
+	res.print(&buf)
+	require.Regexp(t, "^PROFILE .* FOUND\nmixed +[0-9]+ ", buf.String())
+}
@@ -0,0 +1,20 @@
+module github.com/dgraph-io/badger/v3/badger
+
+go 1.12
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2
+	github.com/dgraph-io/badger/v3 v3.0.0
+	github.com/dgraph-io/badger/v3/rpc v0.0.0
+	github.com/dgraph-io/ristretto v0.1.1
+	github.com/dustin/go-humanize v1.0.0
+	github.com/pkg/errors v0.9.1
+	github.com/spf13/cobra v0.0.5
+	github.com/stretchr/testify v1.7.0
+	go.opencensus.io v0.22.5
+	google.golang.org/grpc v1.20.1
+)
+
+replace github.com/dgraph-io/badger/v3 => ../
+
+replace github.com/dgraph-io/badger/v3/rpc => ../rpc
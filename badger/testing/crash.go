@@ -0,0 +1,162 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+Package testing checks that a DB recovers from crashes. Its Driver runs a workload on a DB kept in
+a FaultFS, which fails some of the file operations, and cuts the power at random points. After
+each crash, the DB is opened again and the workload checks it holds what it wrote.
+
+	d := &testing.Driver{
+		Options:  badger.DefaultOptions("/badger").WithSyncWrites(true),
+		Workload: &testing.PrefixWorkload{Keys: 1000, ValueSize: 100},
+		Crashes:  50,
+		MaxSteps: 200,
+		Faults:   true,
+	}
+	if err := d.Run(); err != nil {
+		...
+	}
+*/
+package testing
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// Workload is what the Driver runs on the DB. Its steps are numbered from 0.
+type Workload interface {
+	// Step runs the step of the workload on db. It fails if the DB does.
+	Step(db *badger.DB, step int) error
+	// Check checks the invariants of db, recovered after a crash, and returns the number of steps
+	// it holds. The workload resumes from there.
+	Check(db *badger.DB) (int, error)
+}
+
+// Driver runs a Workload on a DB, which it crashes and opens again over and over.
+type Driver struct {
+	// Options are the options the DB is opened with. Their Dir and ValueDir are paths of the file
+	// systems of the Driver, and their FS is set by it.
+	Options badger.Options
+	// Workload is the workload run on the DB.
+	Workload Workload
+	// Crashes is the number of crashes, and MaxSteps the maximum number of steps run before each
+	// of them.
+	Crashes  int
+	MaxSteps int
+	// Faults makes an operation of the file system fail before half of the crashes. The steps
+	// run after it fails are still run, and must fail or succeed like usual.
+	Faults bool
+	// TornWrites tears the last write to the newest memtable WAL in half of the crashes. The WAL is
+	// mmap'ed, so a power cut keeps all the data written to it, unlike the data written to the
+	// other files since they were synced. The steps acknowledged before those crashes may be lost.
+	TornWrites bool
+	// Seed is the seed of the random choices of the Driver.
+	Seed int64
+	// NewFS returns an empty file system. It is y.NewMemFS if nil.
+	NewFS func() (y.FS, error)
+	// Logf, if set, logs the crashes.
+	Logf func(format string, args ...interface{})
+}
+
+func (d *Driver) logf(format string, args ...interface{}) {
+	if d.Logf != nil {
+		d.Logf(format, args...)
+	}
+}
+
+func (d *Driver) newFS() (y.FS, error) {
+	if d.NewFS != nil {
+		return d.NewFS()
+	}
+	return y.NewMemFS()
+}
+
+// Run runs the workload, and returns the first invariant the recovered DB breaks, or the error
+// opening it.
+func (d *Driver) Run() error {
+	rng := rand.New(rand.NewSource(d.Seed))
+	dirs := []string{d.Options.Dir}
+	if filepath.Clean(d.Options.ValueDir) != filepath.Clean(d.Options.Dir) {
+		dirs = append(dirs, d.Options.ValueDir)
+	}
+
+	fs, err := d.newFS()
+	if err != nil {
+		return err
+	}
+	ffs := NewFaultFS(fs)
+	db, err := badger.Open(d.Options.WithFS(ffs))
+	if err != nil {
+		return err
+	}
+	var step int
+	for crash := 0; crash < d.Crashes; crash++ {
+		if d.Faults && rng.Intn(2) == 0 {
+			op, n := Op(rng.Intn(int(numOps))), rng.Intn(5)+1
+			d.logf("Crash %d: failing %s %d", crash, op, n)
+			ffs.FailNth(op, n)
+		}
+		steps := rng.Intn(d.MaxSteps) + 1
+		acked := step
+		for i := 0; i < steps; i++ {
+			if err := d.Workload.Step(db, acked); err != nil {
+				d.logf("Crash %d: step %d failed: %v", crash, acked, err)
+				continue
+			}
+			acked++
+		}
+
+		dst, err := d.newFS()
+		if err != nil {
+			return err
+		}
+		if err := ffs.PowerCut(dst, dirs...); err != nil {
+			return errors.Wrapf(err, "crash %d: while cutting the power", crash)
+		}
+		torn := d.TornWrites && rng.Intn(2) == 0
+		if torn {
+			n := rng.Intn(64) + 1
+			d.logf("Crash %d: tearing %d bytes of the WAL", crash, n)
+			if err := TearLog(dst, d.Options.Dir, ".mem", n); err != nil {
+				return err
+			}
+		}
+		// The DB crashed, but it must still release its resources.
+		_ = db.Close()
+
+		ffs = NewFaultFS(dst)
+		if db, err = badger.Open(d.Options.WithFS(ffs)); err != nil {
+			return errors.Wrapf(err, "crash %d: while opening the DB", crash)
+		}
+		if step, err = d.Workload.Check(db); err != nil {
+			_ = db.Close()
+			return errors.Wrapf(err, "crash %d", crash)
+		}
+		d.logf("Crash %d: %d steps acknowledged, %d recovered", crash, acked, step)
+		if step < acked && !torn {
+			_ = db.Close()
+			return fmt.Errorf("crash %d: %d steps were acknowledged, but only %d were recovered",
+				crash, acked, step)
+		}
+	}
+	return db.Close()
+}
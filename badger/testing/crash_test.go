@@ -0,0 +1,169 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testing
+
+import (
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+func testDriver(t *testing.T, opt badger.Options) *Driver {
+	if _, err := y.NewMemFS(); err != nil {
+		t.Skip(err)
+	}
+	opt = opt.WithLoggingLevel(badger.ERROR).
+		WithMemTableSize(1 << 16).
+		WithValueThreshold(64).
+		WithValueLogFileSize(1 << 20).
+		WithBaseTableSize(1 << 14).
+		WithNumCompactors(2)
+	return &Driver{
+		Options:  opt,
+		Workload: &PrefixWorkload{Keys: 500, ValueSize: 100},
+		Crashes:  20,
+		MaxSteps: 300,
+		Logf:     t.Logf,
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	d := testDriver(t, badger.DefaultOptions("/badger").WithSyncWrites(true))
+	require.NoError(t, d.Run())
+}
+
+func TestCrashRecoveryFaults(t *testing.T) {
+	d := testDriver(t, badger.DefaultOptions("/badger").WithSyncWrites(true))
+	d.Faults = true
+	d.Seed = 1
+	require.NoError(t, d.Run())
+}
+
+func TestCrashRecoveryTornWrites(t *testing.T) {
+	d := testDriver(t, badger.DefaultOptions("/badger"))
+	d.TornWrites = true
+	d.Seed = 2
+	require.NoError(t, d.Run())
+}
+
+func TestPowerCut(t *testing.T) {
+	fs, err := y.NewMemFS()
+	if err != nil {
+		t.Skip(err)
+	}
+	ffs := NewFaultFS(fs)
+	require.NoError(t, ffs.MkdirAll("/dir", 0700))
+	write := func(name, data string) {
+		fd, err := ffs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		require.NoError(t, err)
+		_, err = fd.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, fd.Sync())
+		require.NoError(t, fd.Close())
+	}
+	read := func(fs y.FS, name string) string {
+		data, err := y.ReadFile(fs, name)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		require.NoError(t, err)
+		return string(data)
+	}
+	write("/dir/a", "a1")
+	write("/dir/b", "b1")
+	write("/dir/c", "c1")
+	require.NoError(t, ffs.SyncDir("/dir"))
+
+	// The changes since the sync are lost, but the data synced to the files is kept.
+	write("/dir/a", "a2")
+	write("/dir/d", "d1")
+	write("/dir/tmp", "b2")
+	require.NoError(t, ffs.Rename("/dir/tmp", "/dir/b"))
+	require.NoError(t, ffs.Remove("/dir/c"))
+	require.Equal(t, "b2", read(ffs, "/dir/b"))
+
+	ffs.FailNth(OpRemove, 2)
+	require.NoError(t, ffs.Remove("/dir/d"))
+	err = ffs.Remove("/dir/a")
+	require.Equal(t, ErrInjected, err.(*os.PathError).Err)
+	require.Equal(t, 3, ffs.Count(OpRemove))
+
+	dst, err := y.NewMemFS()
+	require.NoError(t, err)
+	require.NoError(t, ffs.PowerCut(dst, "/dir"))
+	require.Equal(t, "a2", read(dst, "/dir/a"))
+	require.Equal(t, "b1", read(dst, "/dir/b"))
+	require.Equal(t, "c1", read(dst, "/dir/c"))
+	require.Equal(t, "", read(dst, "/dir/d"))
+	require.Equal(t, "", read(dst, "/dir/tmp"))
+}
+
+func TestPowerCutUnsyncedWrites(t *testing.T) {
+	fs, err := y.NewMemFS()
+	if err != nil {
+		t.Skip(err)
+	}
+	ffs := NewFaultFS(fs)
+	require.NoError(t, ffs.MkdirAll("/dir", 0700))
+	fd, err := ffs.OpenFile("/dir/a", os.O_RDWR|os.O_CREATE, 0666)
+	require.NoError(t, err)
+	defer fd.Close()
+	require.NoError(t, ffs.SyncDir("/dir"))
+	_, err = fd.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	require.NoError(t, fd.Sync())
+
+	// The writes since the sync are rolled back, whether they overwrite the data or append to it.
+	_, err = fd.WriteAt([]byte("abc"), 2)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte("xyz"))
+	require.NoError(t, err)
+	_, err = fd.WriteAt([]byte("ABCDE"), 8)
+	require.NoError(t, err)
+
+	// The write and the sync which fail don't change the file.
+	ffs.FailNth(OpWrite, 1)
+	_, err = fd.WriteAt([]byte("fail"), 0)
+	require.Equal(t, ErrInjected, err.(*os.PathError).Err)
+	ffs.FailNth(OpSync, 1)
+	err = fd.Sync()
+	require.Equal(t, ErrInjected, err.(*os.PathError).Err)
+	require.Equal(t, 5, ffs.Count(OpWrite))
+
+	data, err := y.ReadFile(ffs, "/dir/a")
+	require.NoError(t, err)
+	require.Equal(t, "01abc567ABCDE", string(data))
+
+	dst, err := y.NewMemFS()
+	require.NoError(t, err)
+	require.NoError(t, ffs.PowerCut(dst, "/dir"))
+	data, err = y.ReadFile(dst, "/dir/a")
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(data))
+
+	// Once synced, the writes survive the power cut.
+	require.NoError(t, fd.Sync())
+	dst, err = y.NewMemFS()
+	require.NoError(t, err)
+	require.NoError(t, ffs.PowerCut(dst, "/dir"))
+	data, err = y.ReadFile(dst, "/dir/a")
+	require.NoError(t, err)
+	require.Equal(t, "01abc567ABCDE", string(data))
+}
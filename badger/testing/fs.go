@@ -0,0 +1,531 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testing
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// ErrInjected is the error returned by the operations a FaultFS fails.
+var ErrInjected = errors.New("injected fault")
+
+// Op is an operation of a file system, which a FaultFS can fail.
+type Op int
+
+const (
+	// OpOpen opens an existing file.
+	OpOpen Op = iota
+	// OpCreate opens a file with O_CREATE.
+	OpCreate
+	// OpRename renames a file.
+	OpRename
+	// OpRemove removes a file.
+	OpRemove
+	// OpSyncDir syncs a directory.
+	OpSyncDir
+	// OpWrite writes to a file, with Write or WriteAt.
+	OpWrite
+	// OpSync syncs a file.
+	OpSync
+
+	numOps
+)
+
+func (op Op) String() string {
+	return [...]string{"open", "create", "rename", "remove", "sync dir", "write", "sync"}[op]
+}
+
+// dirChange is a change of a directory which isn't synced yet, and is lost on a power cut.
+type dirChange struct {
+	op Op
+	// name is the file created, removed or renamed to, and oldname the file renamed from.
+	name, oldname string
+	// replaced is the file removed or replaced by the rename, if any. It is kept open, so that it
+	// can be restored.
+	replaced y.File
+}
+
+func (c dirChange) dir() string {
+	return filepath.Dir(c.name)
+}
+
+// unsyncedFile is the data written to a file since it was last synced, which is lost on a power
+// cut.
+type unsyncedFile struct {
+	// size is the size of the file when it was last synced.
+	size int64
+	// undo holds the data the writes overwrote, in the order of the writes.
+	undo []overwrite
+}
+
+type overwrite struct {
+	off  int64
+	data []byte
+}
+
+// FaultFS is a y.FS which fails the operations it is told to, and which can copy its files as
+// they would be found after a power cut.
+//
+// The files it opens wrap the ones of the underlying y.FS, so that their writes and syncs can fail
+// too, and a power cut loses the data written to them since they were last synced, as well as the
+// changes of the directories which weren't synced. The files which are mmap'ed, like the value log
+// files and the write-ahead logs of the memtables, are written to through their memory though, so
+// their data is always kept: use TearLog to lose the end of a log.
+type FaultFS struct {
+	fs y.FS
+
+	// frozen is write locked while a power cut copies the files, so that the directories and the
+	// data written to the files don't change meanwhile.
+	frozen sync.RWMutex
+
+	mu sync.Mutex
+	// counts is the number of times every operation was run, and failAt the count at which the
+	// operation fails next, or 0.
+	counts  [numOps]int
+	failAt  [numOps]int
+	changes []dirChange
+	// unsynced is the data written to the files since they were last synced, by clean path.
+	unsynced map[string]*unsyncedFile
+}
+
+// NewFaultFS returns a FaultFS keeping its files in fs.
+func NewFaultFS(fs y.FS) *FaultFS {
+	return &FaultFS{fs: fs, unsynced: make(map[string]*unsyncedFile)}
+}
+
+// FailNth makes the nth next operation op fail with ErrInjected. A single fault is injected into
+// every operation at a time, so it replaces the previous one.
+func (f *FaultFS) FailNth(op Op, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failAt[op] = f.counts[op] + n
+}
+
+// Count returns the number of times op was run, including the times it failed.
+func (f *FaultFS) Count(op Op) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[op]
+}
+
+// run counts op, and returns ErrInjected if it must fail.
+func (f *FaultFS) run(op Op) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[op]++
+	if f.counts[op] == f.failAt[op] {
+		f.failAt[op] = 0
+		return ErrInjected
+	}
+	return nil
+}
+
+func (f *FaultFS) addChange(c dirChange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.changes = append(f.changes, c)
+}
+
+// OpenFile opens a file, like os.OpenFile.
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (y.File, error) {
+	if flag&os.O_CREATE == 0 {
+		if err := f.run(OpOpen); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		fd, err := f.fs.OpenFile(name, flag, perm)
+		return f.wrap(fd, err, flag)
+	}
+
+	f.frozen.RLock()
+	defer f.frozen.RUnlock()
+	if err := f.run(OpCreate); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	_, serr := f.fs.Stat(name)
+	fd, err := f.fs.OpenFile(name, flag, perm)
+	if err == nil && os.IsNotExist(serr) {
+		f.addChange(dirChange{op: OpCreate, name: name})
+	}
+	return f.wrap(fd, err, flag)
+}
+
+func (f *FaultFS) wrap(fd y.File, err error, flag int) (y.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: fd, fs: f, synced: y.WritesSynced(flag)}, nil
+}
+
+// Rename renames a file, like os.Rename.
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	f.frozen.RLock()
+	defer f.frozen.RUnlock()
+	if err := f.run(OpRename); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	// The file replaced is kept open, like the one removed.
+	replaced, _ := f.fs.OpenFile(newpath, os.O_RDONLY, 0)
+	if err := f.fs.Rename(oldpath, newpath); err != nil {
+		if replaced != nil {
+			replaced.Close()
+		}
+		return err
+	}
+	f.addChange(dirChange{op: OpRename, name: newpath, oldname: oldpath, replaced: replaced})
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if u, ok := f.unsynced[oldpath]; ok {
+		f.unsynced[newpath] = u
+	} else {
+		delete(f.unsynced, newpath)
+	}
+	delete(f.unsynced, oldpath)
+	return nil
+}
+
+// Remove removes a file or an empty directory, like os.Remove.
+func (f *FaultFS) Remove(name string) error {
+	f.frozen.RLock()
+	defer f.frozen.RUnlock()
+	if err := f.run(OpRemove); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	var removed y.File
+	if fi, err := f.fs.Stat(name); err == nil && !fi.IsDir() {
+		removed, _ = f.fs.OpenFile(name, os.O_RDONLY, 0)
+	}
+	if err := f.fs.Remove(name); err != nil {
+		if removed != nil {
+			removed.Close()
+		}
+		return err
+	}
+	if removed != nil {
+		f.addChange(dirChange{op: OpRemove, name: name, replaced: removed})
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.unsynced, filepath.Clean(name))
+	return nil
+}
+
+// SyncDir syncs a directory, so that the changes of its entries survive a power cut.
+func (f *FaultFS) SyncDir(dir string) error {
+	f.frozen.RLock()
+	defer f.frozen.RUnlock()
+	if err := f.run(OpSyncDir); err != nil {
+		return &os.PathError{Op: "sync", Path: dir, Err: err}
+	}
+	if err := f.fs.SyncDir(dir); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir = filepath.Clean(dir)
+	changes := f.changes[:0]
+	for _, c := range f.changes {
+		if c.dir() != dir {
+			changes = append(changes, c)
+		} else if c.replaced != nil {
+			c.replaced.Close()
+		}
+	}
+	f.changes = changes
+	return nil
+}
+
+// Stat returns the FileInfo of a file, like os.Stat.
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return f.fs.Stat(name)
+}
+
+// ReadDir returns the entries of a directory, like ioutil.ReadDir.
+func (f *FaultFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return f.fs.ReadDir(dirname)
+}
+
+// MkdirAll creates a directory and its missing parents, like os.MkdirAll.
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return f.fs.MkdirAll(path, perm)
+}
+
+// PowerCut copies the files of dirs to dst, as they would be found after a power cut: the data
+// written to the files since they were last synced is rolled back, and the files created, renamed
+// or removed since their directory was last synced are removed, renamed back or restored. The
+// files don't change while they are copied, as if the DB using them stopped at once, except the
+// mmap'ed ones, which are still written to. So the MANIFEST and the KEYREGISTRY are copied first,
+// before the files they refer to.
+func (f *FaultFS) PowerCut(dst y.FS, dirs ...string) error {
+	f.frozen.Lock()
+	defer f.frozen.Unlock()
+
+	for _, dir := range dirs {
+		if err := dst.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		entries, err := f.fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		first := func(name string) bool {
+			return name == badger.ManifestFilename || name == badger.KeyRegistryFileName
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return first(entries[i].Name()) && !first(entries[j].Name())
+		})
+		for _, fi := range entries {
+			if fi.IsDir() {
+				continue
+			}
+			name := filepath.Join(dir, fi.Name())
+			src, err := f.fs.OpenFile(name, os.O_RDONLY, 0)
+			if os.IsNotExist(err) {
+				// The file was removed by the DB before the directories were frozen.
+				continue
+			} else if err != nil {
+				return err
+			}
+			err = copyFile(dst, name, src)
+			src.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	in := func(name string) bool {
+		for _, dir := range dirs {
+			if filepath.Dir(name) == filepath.Clean(dir) {
+				return true
+			}
+		}
+		return false
+	}
+	for name, u := range f.unsynced {
+		if !in(name) {
+			continue
+		}
+		if err := u.rollBack(dst, name); err != nil {
+			return errors.Wrapf(err, "while rolling back the writes to %s", name)
+		}
+	}
+	for i := len(f.changes) - 1; i >= 0; i-- {
+		c := f.changes[i]
+		if !in(c.name) {
+			continue
+		}
+		var err error
+		switch c.op {
+		case OpCreate:
+			if err = dst.Remove(c.name); os.IsNotExist(err) {
+				err = nil
+			}
+		case OpRename:
+			if err = dst.Rename(c.name, c.oldname); err == nil && c.replaced != nil {
+				err = copyFile(dst, c.name, c.replaced)
+			}
+		case OpRemove:
+			err = copyFile(dst, c.name, c.replaced)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "while undoing the %s of %s", c.op, c.name)
+		}
+	}
+	return nil
+}
+
+// rollBack rolls back the writes to the file name of dst.
+func (u *unsyncedFile) rollBack(dst y.FS, name string) error {
+	fd, err := dst.OpenFile(name, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i := len(u.undo) - 1; i >= 0 && err == nil; i-- {
+		_, err = fd.WriteAt(u.undo[i].data, u.undo[i].off)
+	}
+	if err == nil {
+		err = fd.Truncate(u.size)
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// faultFile is a file of a FaultFS.
+type faultFile struct {
+	y.File
+	fs *FaultFS
+	// synced is set if the file was opened with O_DSYNC, so that its writes are synced.
+	synced bool
+}
+
+// OSFile returns the *os.File of the file, if it has one, to be mmap'ed. The data written to its
+// memory isn't seen by the FaultFS.
+func (f *faultFile) OSFile() *os.File {
+	fd, _ := y.OSFile(f.File)
+	return fd
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.frozen.RLock()
+	defer f.fs.frozen.RUnlock()
+	if err := f.fs.run(OpWrite); err != nil {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.save(off, len(p)); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.frozen.RLock()
+	defer f.fs.frozen.RUnlock()
+	if err := f.fs.run(OpWrite); err != nil {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+	if err := f.save(off, len(p)); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// save saves the n bytes of the file at off, which are about to be overwritten, so that a power
+// cut rolls the write back.
+func (f *faultFile) save(off int64, n int) error {
+	if f.synced {
+		return nil
+	}
+	fi, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	name := filepath.Clean(f.Name())
+	u, ok := f.fs.unsynced[name]
+	if !ok {
+		u = &unsyncedFile{size: fi.Size()}
+		f.fs.unsynced[name] = u
+	}
+	// The data appended to the file is rolled back by truncating it.
+	if end := off + int64(n); off < fi.Size() {
+		if end > fi.Size() {
+			end = fi.Size()
+		}
+		data := make([]byte, end-off)
+		if _, err := f.File.ReadAt(data, off); err != nil && err != io.EOF {
+			return err
+		}
+		u.undo = append(u.undo, overwrite{off: off, data: data})
+	}
+	return nil
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.frozen.RLock()
+	defer f.fs.frozen.RUnlock()
+	if err := f.fs.run(OpSync); err != nil {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: err}
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	delete(f.fs.unsynced, filepath.Clean(f.Name()))
+	return nil
+}
+
+// copyFile copies src from its start to the file name of dst.
+func copyFile(dst y.FS, name string, src y.File) error {
+	fd, err := dst.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fd, io.NewSectionReader(src, 0, 1<<62)); err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "while copying %s", name)
+}
+
+// TearLog zeroes the last n bytes of the data of the last file of dir, in name order, with the
+// extension ext, as if the last write to it was torn by a power cut. The data of the file ends
+// with its last byte which isn't zero, which suits the log files badger preallocates.
+func TearLog(fs y.FS, dir, ext string, n int) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var name string
+	for _, fi := range entries {
+		if strings.HasSuffix(fi.Name(), ext) {
+			name = filepath.Join(dir, fi.Name())
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	fd, err := fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	data, err := ioutil.ReadAll(fd)
+	if err != nil {
+		return err
+	}
+	end := len(data)
+	for end > 0 && data[end-1] == 0 {
+		end--
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	if _, err := fd.WriteAt(make([]byte, end-start), int64(start)); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testing
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+// stepKey holds the number of steps a PrefixWorkload ran.
+var stepKey = []byte("!steps")
+
+// PrefixWorkload is a Workload whose every step sets a few random keys to the number of the step,
+// in a single transaction. A DB recovered after a crash must hold the keys written by the steps
+// up to some step, and nothing else.
+type PrefixWorkload struct {
+	// Keys is the number of keys written, and KeysPerStep the number of keys written by a step.
+	Keys        int
+	KeysPerStep int
+	// ValueSize is the size of the values.
+	ValueSize int
+	// Seed is the seed of the keys the steps write.
+	Seed int64
+}
+
+// keys returns the keys written by step.
+func (w *PrefixWorkload) keys(step int) [][]byte {
+	n := w.KeysPerStep
+	if n <= 0 {
+		n = 3
+	}
+	rng := rand.New(rand.NewSource(w.Seed + int64(step)))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%08d", rng.Intn(w.Keys)))
+	}
+	return keys
+}
+
+// value returns the value written by step.
+func (w *PrefixWorkload) value(step int) []byte {
+	val := []byte(fmt.Sprintf("%08d", step))
+	if len(val) < w.ValueSize {
+		val = append(val, bytes.Repeat([]byte{'v'}, w.ValueSize-len(val))...)
+	}
+	return val
+}
+
+// Step sets the keys of step to the number of the step.
+func (w *PrefixWorkload) Step(db *badger.DB, step int) error {
+	return db.Update(func(txn *badger.Txn) error {
+		for _, key := range w.keys(step) {
+			if err := txn.Set(key, w.value(step)); err != nil {
+				return err
+			}
+		}
+		return txn.Set(stepKey, []byte(strconv.Itoa(step+1)))
+	})
+}
+
+// Check checks that db holds the keys written by the steps up to the last one it holds.
+func (w *PrefixWorkload) Check(db *badger.DB) (int, error) {
+	var steps int
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(stepKey)
+		if err == badger.ErrKeyNotFound {
+			steps = 0
+		} else if err != nil {
+			return err
+		} else if err := item.Value(func(val []byte) error {
+			steps, err = strconv.Atoi(string(val))
+			return err
+		}); err != nil {
+			return err
+		}
+
+		want := make(map[string][]byte)
+		for step := 0; step < steps; step++ {
+			for _, key := range w.keys(step) {
+				want[string(key)] = w.value(step)
+			}
+		}
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte("key")})
+		defer it.Close()
+		var found int
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return errors.Wrapf(err, "while reading key %q", key)
+			}
+			if !bytes.Equal(val, want[string(key)]) {
+				return errors.Errorf("key %q is %.8q after %d steps, instead of %.8q",
+					key, val, steps, want[string(key)])
+			}
+			found++
+		}
+		if found != len(want) {
+			return errors.Errorf("%d keys were found after %d steps, instead of %d",
+				found, steps, len(want))
+		}
+		return nil
+	})
+	return steps, err
+}
@@ -98,9 +98,7 @@ func (wb *WriteBatch) callback(err error) {
 
 func (wb *WriteBatch) writeKV(kv *pb.KV) error {
 	e := Entry{Key: kv.Key, Value: kv.Value}
-	if len(kv.UserMeta) > 0 {
-		e.UserMeta = kv.UserMeta[0]
-	}
+	e.UserMeta, e.UserMetadata = parseKVUserMeta(kv.UserMeta)
 	y.AssertTrue(kv.Version != 0)
 	e.version = kv.Version
 	return wb.handleEntry(&e)
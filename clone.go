@@ -0,0 +1,291 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// maxCloneRounds is how many times CloneDir catches up with the changes of the tables of the DB it
+// clones, before it gives up.
+const maxCloneRounds = 10
+
+// CloneDir clones the DB in the directory src to dst, which must not exist. The DB must keep its
+// value log in src, and must not have remote tables.
+//
+// The tables, which are never modified, are hard links to those of src, or copies of them if dst
+// is on another file system. The other files are copied, since the DB modifies them: the value log
+// files can have holes punched in them, and the logs are truncated when the DB is opened.
+//
+// The DB can be open, in this process or in another one, while it is cloned. The clone has all the
+// writes done before CloneDir was called. The tables being compacted or flushed while the files
+// are copied, CloneDir catches up with the MANIFEST until it doesn't change while they are, and
+// fails if it keeps changing.
+func CloneDir(src, dst string) error {
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return y.Wrapf(err, "while creating %s", dst)
+	}
+	if err := cloneDir(src, dst); err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return nil
+}
+
+func cloneDir(src, dst string) error {
+	linked := make(map[uint64]struct{})
+	for round := 0; ; round++ {
+		if round == maxCloneRounds {
+			return errors.Errorf("the tables of %s kept changing while it was cloned", src)
+		}
+		done, err := cloneRound(src, dst, linked)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	return y.OSFS.SyncDir(dst)
+}
+
+// cloneRound copies the MANIFEST, links the tables in it, and copies the other files. It returns
+// true if the files are consistent: if the tables in the MANIFEST didn't change meanwhile, and no
+// file was deleted.
+func cloneRound(src, dst string, linked map[uint64]struct{}) (bool, error) {
+	if _, err := copyFile(filepath.Join(src, ManifestFilename),
+		filepath.Join(dst, ManifestFilename)); err != nil {
+		return false, err
+	}
+	mf, err := readDirManifest(dst)
+	if err != nil {
+		return false, err
+	}
+	done := true
+	for id, tm := range mf.Tables {
+		if tm.RemoteURL != "" {
+			// Its copy in object storage is deleted with the table of src.
+			return false, errors.Errorf("cannot clone the remote table %d", id)
+		}
+		if _, ok := linked[id]; ok {
+			continue
+		}
+		name := table.IDToFilename(id)
+		err := linkFile(filepath.Join(src, name), filepath.Join(dst, name))
+		switch {
+		case os.IsNotExist(err):
+			// It was compacted since the MANIFEST was copied.
+			done = false
+		case err != nil:
+			return false, err
+		default:
+			linked[id] = struct{}{}
+		}
+	}
+	for id := range linked {
+		if _, ok := mf.Tables[id]; !ok {
+			if err := os.Remove(filepath.Join(dst, table.IDToFilename(id))); err != nil {
+				return false, err
+			}
+			delete(linked, id)
+		}
+	}
+
+	copied, err := cloneLogs(src, dst)
+	if err != nil {
+		return false, err
+	}
+	done = done && copied
+
+	// The tables of the MANIFEST may have changed while the logs were copied. The memtables
+	// flushed since then would be missing.
+	current, err := readDirManifest(src)
+	if err != nil {
+		return false, err
+	}
+	if len(current.Tables) != len(mf.Tables) {
+		return false, nil
+	}
+	for id, tm := range current.Tables {
+		if mf.Tables[id] != tm {
+			return false, nil
+		}
+	}
+	return done, nil
+}
+
+// cloneLogs copies the files of src which aren't tables or the MANIFEST, and removes those of dst
+// which aren't in src anymore. The memtable WALs are copied before the value log files they point
+// to, and the KEYREGISTRY after the files encrypted with its keys. It returns false if a file was
+// deleted before it could be copied.
+func cloneLogs(src, dst string) (bool, error) {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return false, err
+	}
+	order := func(name string) int {
+		switch {
+		case strings.HasSuffix(name, memFileExt):
+			return 0
+		case strings.HasSuffix(name, ".vlog"):
+			return 1
+		case name == KeyRegistryFileName:
+			return 3
+		}
+		return 2
+	}
+	var names []string
+	for _, f := range files {
+		name := f.Name()
+		if _, ok := table.ParseFileID(name); ok || !f.Mode().IsRegular() ||
+			name == ManifestFilename || name == lockFile || strings.Contains(name, "REWRITE") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.SliceStable(names, func(i, j int) bool { return order(names[i]) < order(names[j]) })
+
+	done := true
+	want := make(map[string]struct{})
+	for _, name := range names {
+		copied, err := copyFile(filepath.Join(src, name), filepath.Join(dst, name))
+		if err != nil {
+			return false, err
+		}
+		if !copied {
+			done = false
+			continue
+		}
+		want[name] = struct{}{}
+	}
+
+	files, err = ioutil.ReadDir(dst)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if _, ok := table.ParseFileID(name); ok || name == ManifestFilename {
+			continue
+		}
+		if _, ok := want[name]; !ok {
+			if err := os.Remove(filepath.Join(dst, name)); err != nil {
+				return false, err
+			}
+		}
+	}
+	return done, nil
+}
+
+// readDirManifest reads the MANIFEST in dir, whatever its external magic version.
+func readDirManifest(dir string) (Manifest, error) {
+	fp, err := os.Open(filepath.Join(dir, ManifestFilename))
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer fp.Close()
+	var magic [8]byte
+	if _, err := io.ReadFull(fp, magic[:]); err != nil {
+		return Manifest{}, fileError(errBadMagic, fp.Name(), 0, err)
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return Manifest{}, err
+	}
+	mf, _, err := ReplayManifestFile(fp, y.BytesToU16(magic[4:6]))
+	return mf, err
+}
+
+// linkFile hard links dst to src, or copies src to dst if it can't be linked.
+func linkFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || os.IsNotExist(err) {
+		return err
+	}
+	// The link fails if dst is on another file system.
+	copied, err := copyFile(src, dst)
+	if err == nil && !copied {
+		return &os.PathError{Op: "copy", Path: src, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// copyFile copies src to dst, and syncs dst. It returns false if src doesn't exist.
+func copyFile(src, dst string) (bool, error) {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return false, y.Wrapf(err, "while copying %s", src)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return false, err
+	}
+	return true, out.Close()
+}
+
+// MoveDir moves the DB in the directory src to dst, which must not exist. The DB must keep its
+// value log in src, and must not be open. The directory is renamed if dst is on the same file
+// system. Otherwise, the DB is cloned to dst, as with CloneDir, and src is removed.
+func MoveDir(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return errors.Errorf("cannot move %s to %s: it already exists", src, dst)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	guard, err := acquireDirectoryLock(src, lockFile, false)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		// The pid file was moved with the directory.
+		_ = guard.release()
+		if err := os.Remove(filepath.Join(dst, lockFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return y.OSFS.SyncDir(filepath.Dir(dst))
+	}
+
+	// The DB can't change while it is locked, so it is cloned in a single round.
+	err = CloneDir(src, dst)
+	if rerr := guard.release(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func cloneTestWrite(t *testing.T, db *DB, from, to int) {
+	val := make([]byte, 2<<10)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := from; i < to; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%05d", i)), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func cloneTestCount(t *testing.T, db *DB) int {
+	var n int
+	require.NoError(t, db.View(func(txn *Txn) error {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.NoError(t, it.Item().Value(func([]byte) error { return nil }))
+			n++
+		}
+		return nil
+	}))
+	return n
+}
+
+func TestCloneDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	opt := getTestOptions(src).WithValueThreshold(1 << 10)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	cloneTestWrite(t, db, 0, 1000)
+	require.NoError(t, db.Flatten(1))
+	cloneTestWrite(t, db, 1000, 2000)
+
+	// The writes keep going while the DB is cloned.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 2000; ; i += 100 {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cloneTestWrite(t, db, i, i+100)
+		}
+	}()
+	require.NoError(t, CloneDir(src, dst))
+	close(stop)
+	wg.Wait()
+	require.Error(t, CloneDir(src, dst))
+
+	// The tables of the DB are shared with the clone, but not the changes to them.
+	require.NoError(t, db.DropAll())
+	clone, err := Open(opt.WithDir(dst).WithValueDir(dst))
+	require.NoError(t, err)
+	require.True(t, cloneTestCount(t, clone) >= 2000)
+	cloneTestWrite(t, clone, 0, 10)
+	require.NoError(t, clone.Close())
+	require.Zero(t, cloneTestCount(t, db))
+}
+
+func TestMoveDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	opt := getTestOptions(src)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	cloneTestWrite(t, db, 0, 1000)
+	// The DB can't be moved while it is open.
+	require.Error(t, MoveDir(src, dst))
+	require.NoError(t, db.Close())
+
+	require.NoError(t, MoveDir(src, dst))
+	_, err = os.Stat(src)
+	require.True(t, os.IsNotExist(err))
+	db, err = Open(opt.WithDir(dst).WithValueDir(dst))
+	require.NoError(t, err)
+	require.Equal(t, 1000, cloneTestCount(t, db))
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// CompactRangeOptions are the options of CompactRange.
+type CompactRangeOptions struct {
+	// Start and End bound the keys to compact. End is exclusive, and a nil Start or End leaves the
+	// range unbounded on that side.
+	Start, End []byte
+	// ToLevel is the level the keys are compacted into. Zero means the last level.
+	ToLevel int
+	// DryRun only returns the steps of the compaction, without running them.
+	DryRun bool
+	// Progress, if set, is called after each step of the compaction.
+	Progress func(CompactProgress)
+}
+
+// CompactStep is a step of a compaction of a key range: the tables of a level overlapping the range
+// are merged with the overlapping tables of the output level.
+type CompactStep struct {
+	Level       int
+	OutputLevel int
+	// Tables and Bytes are the IDs and the size of the tables of Level.
+	Tables []uint64
+	Bytes  int64
+	// NextTables and NextBytes are the IDs and the size of the tables of OutputLevel.
+	NextTables []uint64
+	NextBytes  int64
+}
+
+// CompactProgress is the progress of a compaction, reported after each of its steps.
+type CompactProgress struct {
+	// Level and OutputLevel are the levels of the last step.
+	Level       int
+	OutputLevel int
+	// LevelSizes is the size of each level after the last step.
+	LevelSizes []int64
+	// DoneBytes is the size of the tables compacted so far, and RemainingBytes an estimate of the
+	// size of the tables left to compact.
+	DoneBytes      int64
+	RemainingBytes int64
+	Elapsed        time.Duration
+	// ETA is the estimated time left, at the speed of the steps done so far.
+	ETA time.Duration
+}
+
+// CompactRange compacts the keys in a range down to a level. The levels are compacted from the top,
+// each into the first level below it holding keys of the range, so that the newer versions of the
+// keys are never moved below the older ones. It stops the other compactions while it runs.
+//
+// It returns the steps of the compaction. With DryRun, these are the steps planned on the current
+// levels, and each of them may end up compacting more tables, which the earlier steps moved into
+// its level.
+func (db *DB) CompactRange(opt CompactRangeOptions) ([]CompactStep, error) {
+	if opt.ToLevel == 0 {
+		opt.ToLevel = db.opt.MaxLevels - 1
+	}
+	if opt.ToLevel < 1 || opt.ToLevel >= db.opt.MaxLevels {
+		return nil, errors.Errorf("Invalid level to compact into: %d", opt.ToLevel)
+	}
+	if opt.Start != nil && opt.End != nil && bytes.Compare(opt.Start, opt.End) >= 0 {
+		return nil, errors.Errorf("Invalid range to compact: %q is not before %q",
+			opt.Start, opt.End)
+	}
+	if opt.DryRun {
+		return db.lc.planCompactRange(0, opt), nil
+	}
+
+	db.stopCompactions()
+	defer db.startCompactions()
+
+	var steps []CompactStep
+	var done int64
+	start := time.Now()
+	for l := 0; l < opt.ToLevel; l++ {
+		cd, ok := db.lc.pickCompactRange(l, opt)
+		if !ok {
+			continue
+		}
+		step := compactRangeStep(cd)
+		db.opt.Infof("Compacting range of level %d into level %d: %d tables, %d bytes\n",
+			step.Level, step.OutputLevel, len(step.Tables)+len(step.NextTables),
+			step.Bytes+step.NextBytes)
+		if err := db.lc.runCompactDef(-1, l, cd); err != nil {
+			return steps, err
+		}
+		steps = append(steps, step)
+		done += step.Bytes + step.NextBytes
+		if opt.Progress == nil {
+			continue
+		}
+		var remaining int64
+		for _, s := range db.lc.planCompactRange(l+1, opt) {
+			remaining += s.Bytes + s.NextBytes
+		}
+		elapsed := time.Since(start)
+		opt.Progress(CompactProgress{
+			Level:          step.Level,
+			OutputLevel:    step.OutputLevel,
+			LevelSizes:     db.lc.levelSizes(),
+			DoneBytes:      done,
+			RemainingBytes: remaining,
+			Elapsed:        elapsed,
+			ETA:            compactETA(elapsed, done, remaining),
+		})
+	}
+	return steps, nil
+}
+
+// planCompactRange returns the steps of CompactRange from the level l, on the current levels.
+func (s *levelsController) planCompactRange(l int, opt CompactRangeOptions) []CompactStep {
+	var steps []CompactStep
+	for ; l < opt.ToLevel; l++ {
+		if cd, ok := s.pickCompactRange(l, opt); ok {
+			steps = append(steps, compactRangeStep(cd))
+		}
+	}
+	return steps
+}
+
+// pickCompactRange picks the tables of the level l overlapping the range of opt, and the tables
+// overlapping them in the first level below l, up to opt.ToLevel, which has any. All the tables of
+// level 0 are picked if any of them overlaps the range, because they overlap each other.
+func (s *levelsController) pickCompactRange(l int, opt CompactRangeOptions) (compactDef, bool) {
+	cd := compactDef{thisLevel: s.levels[l], t: s.levelTargets()}
+
+	cd.thisLevel.RLock()
+	defer cd.thisLevel.RUnlock()
+	if l == 0 {
+		for _, t := range cd.thisLevel.tables {
+			if tableInRange(t, opt.Start, opt.End) {
+				cd.top = append(cd.top[:0], cd.thisLevel.tables...)
+				break
+			}
+		}
+	} else {
+		// The tables of the other levels are sorted, so the overlapping ones are consecutive.
+		for _, t := range cd.thisLevel.tables {
+			if tableInRange(t, opt.Start, opt.End) {
+				cd.top = append(cd.top, t)
+			}
+		}
+	}
+	if len(cd.top) == 0 {
+		return cd, false
+	}
+	cd.thisRange = getKeyRange(cd.top...)
+
+	// The levels in between have no keys in the range of the top tables, so these can skip them.
+	for next := l + 1; next <= opt.ToLevel; next++ {
+		cd.nextLevel = s.levels[next]
+		cd.nextLevel.RLock()
+		left, right := cd.nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+		cd.bot = append(cd.bot[:0], cd.nextLevel.tables[left:right]...)
+		cd.nextLevel.RUnlock()
+		if len(cd.bot) > 0 {
+			break
+		}
+	}
+	if len(cd.bot) == 0 {
+		cd.nextRange = cd.thisRange
+	} else {
+		cd.nextRange = getKeyRange(cd.bot...)
+	}
+	return cd, true
+}
+
+// tableInRange returns whether the table has keys in the range [start, end).
+func tableInRange(t *table.Table, start, end []byte) bool {
+	if end != nil && bytes.Compare(y.ParseKey(t.Smallest()), end) >= 0 {
+		return false
+	}
+	return start == nil || bytes.Compare(y.ParseKey(t.Biggest()), start) >= 0
+}
+
+func compactRangeStep(cd compactDef) CompactStep {
+	step := CompactStep{Level: cd.thisLevel.level, OutputLevel: cd.nextLevel.level}
+	step.Tables, step.Bytes = tableIDsAndSize(cd.top)
+	step.NextTables, step.NextBytes = tableIDsAndSize(cd.bot)
+	return step
+}
+
+func (s *levelsController) levelSizes() []int64 {
+	sizes := make([]int64, len(s.levels))
+	for i, l := range s.levels {
+		sizes[i] = l.getTotalSize()
+	}
+	return sizes
+}
+
+// compactETA estimates the time left to compact the remaining bytes, at the speed the done ones
+// were compacted.
+func compactETA(elapsed time.Duration, done, remaining int64) time.Duration {
+	if done <= 0 {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * float64(remaining) / float64(done))
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0).WithBaseTableSize(1 << 14)
+
+	n := 1000
+	// write writes all the keys, which are flushed to level 0 when the DB is reopened.
+	write := func(db *DB, round int) *DB {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				val := make([]byte, 100)
+				rand.Read(val)
+				val[0] = byte('0' + round)
+				if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+		db, err := Open(opt)
+		require.NoError(t, err)
+		return db
+	}
+	levelsInRange := func(db *DB, start, end []byte) map[int]int {
+		levels := make(map[int]int)
+		for _, ti := range db.Tables() {
+			if bytes.Compare(y.ParseKey(ti.Left), end) < 0 &&
+				bytes.Compare(y.ParseKey(ti.Right), start) >= 0 {
+				levels[ti.Level]++
+			}
+		}
+		return levels
+	}
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	db = write(db, 0)
+	_, err = db.CompactRange(CompactRangeOptions{})
+	require.NoError(t, err)
+	db = write(db, 1)
+	_, err = db.CompactRange(CompactRangeOptions{ToLevel: 3})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	start, end := []byte("key0200"), []byte("key0400")
+	require.Equal(t, 0, levelsInRange(db, start, end)[0])
+	require.NotZero(t, levelsInRange(db, start, end)[3])
+	require.NotZero(t, levelsInRange(db, start, end)[6])
+
+	_, err = db.CompactRange(CompactRangeOptions{ToLevel: 7})
+	require.Error(t, err)
+	_, err = db.CompactRange(CompactRangeOptions{Start: end, End: start})
+	require.Error(t, err)
+
+	// The dry run plans the compaction of the tables of level 3 in the range into level 6.
+	tables := db.Tables()
+	steps, err := db.CompactRange(CompactRangeOptions{Start: start, End: end, DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	require.Equal(t, 3, steps[0].Level)
+	require.Equal(t, 6, steps[0].OutputLevel)
+	require.Len(t, steps[0].Tables, levelsInRange(db, start, end)[3])
+	require.NotEmpty(t, steps[0].NextTables)
+	require.NotZero(t, steps[0].Bytes)
+	require.Equal(t, tables, db.Tables())
+
+	var progress []CompactProgress
+	done, err := db.CompactRange(CompactRangeOptions{Start: start, End: end,
+		Progress: func(p CompactProgress) { progress = append(progress, p) }})
+	require.NoError(t, err)
+	require.Equal(t, steps, done)
+	require.Len(t, progress, 1)
+	require.Equal(t, steps[0].Bytes+steps[0].NextBytes, progress[0].DoneBytes)
+	require.Zero(t, progress[0].RemainingBytes)
+	require.Len(t, progress[0].LevelSizes, opt.MaxLevels)
+
+	// The keys in the range are only left in level 6, and the other ones are still in level 3.
+	inRange := levelsInRange(db, start, end)
+	require.Zero(t, inRange[3])
+	require.NotZero(t, inRange[6])
+	require.NotZero(t, levelsInRange(db, []byte("key0600"), []byte("key0800"))[3])
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+			require.NoError(t, err)
+			require.Equal(t, byte('1'), getItemValue(t, item)[0])
+		}
+		return nil
+	}))
+}
+
+func TestFlattenWithProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	// The keys are written twice, to have tables in level 0 and in level 6.
+	for round := 0; round < 2; round++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+		db, err = Open(opt)
+		require.NoError(t, err)
+		if round == 0 {
+			_, err = db.CompactRange(CompactRangeOptions{})
+			require.NoError(t, err)
+		}
+	}
+	defer func() { require.NoError(t, db.Close()) }()
+
+	var progress []CompactProgress
+	require.NoError(t, db.FlattenWithProgress(1, func(p CompactProgress) {
+		progress = append(progress, p)
+	}))
+	require.NotEmpty(t, progress)
+	last := progress[len(progress)-1]
+	require.Equal(t, 0, progress[0].Level)
+	require.NotZero(t, last.DoneBytes)
+	require.Zero(t, last.RemainingBytes)
+	require.Zero(t, last.LevelSizes[0])
+}
+
+func TestFlattenContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	// The keys are written twice, to have tables in level 0 and in level 6.
+	for round := 0; round < 2; round++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+		db, err = Open(opt)
+		require.NoError(t, err)
+		if round == 0 {
+			_, err = db.CompactRange(CompactRangeOptions{})
+			require.NoError(t, err)
+		}
+	}
+	defer func() { require.NoError(t, db.Close()) }()
+
+	// A canceled flatten leaves the tables where they are.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, db.FlattenContext(ctx, 1, nil))
+	require.NotZero(t, db.lc.levelSizes()[0])
+
+	require.NoError(t, db.FlattenContext(context.Background(), 1, nil))
+	require.Zero(t, db.lc.levelSizes()[0])
+}
@@ -179,6 +179,13 @@ func (cs *compactStatus) delSize(l int) int64 {
 	return cs.levels[l].delSize
 }
 
+// numRunning returns the number of compactions running from or into level l.
+func (cs *compactStatus) numRunning(l int) int {
+	cs.RLock()
+	defer cs.RUnlock()
+	return len(cs.levels[l].ranges)
+}
+
 type thisAndNextLevelRLocked struct{}
 
 // compareAndAdd will check whether we can run this compactDef. That it doesn't overlap with any
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+const (
+	// conflictHalfLife is the time after which the conflict count of a key is halved.
+	conflictHalfLife = time.Minute
+	// maxConflictKeys is the maximum number of key fingerprints tracked by conflictStats.
+	maxConflictKeys = 1024
+)
+
+// ConflictKeyStat contains the conflict statistics of a single key.
+type ConflictKeyStat struct {
+	// Fingerprint is the hash of the key used for conflict detection.
+	Fingerprint uint64
+	// Key is the key which caused the conflicts. It is only set if the key could be resolved from
+	// the fingerprint, i.e. the aborted transaction also wrote to the key, or ConflictDetails is
+	// enabled.
+	Key []byte
+	// Count is the number of conflicts caused by this key, decayed exponentially over time with a
+	// half-life of one minute.
+	Count float64
+	// Total is the total number of conflicts caused by this key since it was first tracked.
+	Total uint64
+	// LastSeen is the time of the latest conflict caused by this key.
+	LastSeen time.Time
+}
+
+type conflictCounter struct {
+	key      []byte
+	count    float64
+	total    uint64
+	lastSeen time.Time
+}
+
+// decayed returns the value of the counter at time now.
+func (c *conflictCounter) decayed(now time.Time) float64 {
+	dt := now.Sub(c.lastSeen)
+	if dt <= 0 {
+		return c.count
+	}
+	return c.count * math.Exp2(-float64(dt)/float64(conflictHalfLife))
+}
+
+// conflictStats tracks the number of transaction aborts caused by each key fingerprint, so the
+// keys with most contention can be reported.
+type conflictStats struct {
+	sync.Mutex
+	counters map[uint64]*conflictCounter
+}
+
+func newConflictStats() *conflictStats {
+	return &conflictStats{counters: make(map[uint64]*conflictCounter)}
+}
+
+// record registers a conflict for the given fingerprints. keys are the keys of the fingerprints,
+// as returned by Txn.keysForFingerprints.
+func (cs *conflictStats) record(fps []uint64, keys [][]byte) {
+	now := time.Now()
+	cs.Lock()
+	defer cs.Unlock()
+	for i, fp := range fps {
+		c, ok := cs.counters[fp]
+		if !ok {
+			if len(cs.counters) >= maxConflictKeys {
+				cs.evictColdest(now)
+			}
+			c = &conflictCounter{}
+			cs.counters[fp] = c
+		}
+		c.count = c.decayed(now) + 1
+		c.total++
+		c.lastSeen = now
+		if c.key == nil {
+			c.key = keys[i]
+		}
+	}
+}
+
+// evictColdest removes the counter with the lowest decayed count. Must be called under cs.Lock.
+func (cs *conflictStats) evictColdest(now time.Time) {
+	var coldest uint64
+	min := math.MaxFloat64
+	for fp, c := range cs.counters {
+		if d := c.decayed(now); d < min {
+			coldest, min = fp, d
+		}
+	}
+	delete(cs.counters, coldest)
+}
+
+// top returns the stats of the n keys with highest decayed conflict count.
+func (cs *conflictStats) top(n int) []ConflictKeyStat {
+	now := time.Now()
+	cs.Lock()
+	out := make([]ConflictKeyStat, 0, len(cs.counters))
+	for fp, c := range cs.counters {
+		out = append(out, ConflictKeyStat{
+			Fingerprint: fp,
+			Key:         y.SafeCopy(nil, c.key),
+			Count:       c.decayed(now),
+			Total:       c.total,
+			LastSeen:    c.lastSeen,
+		})
+	}
+	cs.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Fingerprint < out[j].Fingerprint
+	})
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// ConflictError is returned on commit instead of ErrConflict when ConflictDetails is enabled. It
+// contains the keys read by the transaction which were modified by concurrently committed
+// transactions. errors.Is(err, ErrConflict) reports true for a ConflictError.
+type ConflictError struct {
+	// Fingerprints are the hashes of the conflicting keys.
+	Fingerprints []uint64
+	// Keys are the conflicting keys, in the same order as Fingerprints.
+	Keys [][]byte
+}
+
+func (e *ConflictError) Error() string {
+	var b strings.Builder
+	b.WriteString(ErrConflict.Error())
+	b.WriteString(". Conflicting keys:")
+	for _, k := range e.Keys {
+		fmt.Fprintf(&b, " %q", k)
+	}
+	return b.String()
+}
+
+// Is reports whether target is ErrConflict.
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Unwrap returns ErrConflict.
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// keysForFingerprints returns the keys read or written by the transaction which have the given
+// fingerprints, with nil for the fingerprints which have no such key. The keys read are only known
+// with ConflictDetails. The keys written are looked up in a map of their fingerprints, built only
+// if some fingerprints aren't among the keys read.
+func (txn *Txn) keysForFingerprints(fps []uint64) [][]byte {
+	keys := make([][]byte, len(fps))
+	var writes map[uint64]string
+	txn.readsLock.Lock()
+	defer txn.readsLock.Unlock()
+	for i, fp := range fps {
+		if key, ok := txn.readKeys[fp]; ok {
+			keys[i] = key
+			continue
+		}
+		if writes == nil {
+			writes = make(map[uint64]string, len(txn.pendingWrites))
+			for k := range txn.pendingWrites {
+				writes[z.MemHash([]byte(k))] = k
+			}
+		}
+		if k, ok := writes[fp]; ok {
+			keys[i] = []byte(k)
+		}
+	}
+	return keys
+}
+
+// ConflictStats returns the n keys which caused the most transaction conflicts recently, sorted in
+// decreasing order of their decayed conflict counts. A negative n returns all the tracked keys.
+// The stats are only collected when DetectConflicts is enabled.
+func (db *DB) ConflictStats(n int) []ConflictKeyStat {
+	return db.conflicts.top(n)
+}
+
+// hotConflictKeys is used to publish the top conflicting keys via expvar.
+func (db *DB) hotConflictKeys() interface{} {
+	type hotKey struct {
+		Fingerprint uint64
+		Key         string
+		Count       float64
+		Total       uint64
+	}
+	stats := db.ConflictStats(10)
+	out := make([]hotKey, 0, len(stats))
+	for _, s := range stats {
+		var key string
+		if s.Key != nil {
+			// Keys could be binary. Quote them so they are printable.
+			key = fmt.Sprintf("%q", s.Key)
+		}
+		out = append(out, hotKey{Fingerprint: s.Fingerprint, Key: key, Count: s.Count, Total: s.Total})
+	}
+	return out
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// tableCount is the number of the live keys of a table, i.e., the keys whose latest version in
+// the table is neither deleted nor expired.
+type tableCount struct {
+	keys     int // Number of the live user keys.
+	internal int // Number of the live badger internal keys.
+	// expiresAt is the earliest expiry of the live keys, 0 if none of them expires. The count is
+	// stale once that time has passed.
+	expiresAt uint64
+}
+
+func (c tableCount) valid(now uint64) bool {
+	return c.expiresAt == 0 || c.expiresAt > now
+}
+
+// tableCounts caches the counts of the tables, which are immutable, so that counting the keys of
+// a table has to read it only once.
+type tableCounts struct {
+	sync.Mutex
+	m map[uint64]cachedCount
+}
+
+// cachedCount is the count of a table. The table is kept along with it, as the IDs of the tables
+// are reused after DropAll, so that a count cached for a dropped table is never taken for the
+// count of a new table with the same ID.
+type cachedCount struct {
+	tableCount
+	t *table.Table
+}
+
+func newTableCounts() *tableCounts {
+	return &tableCounts{m: make(map[uint64]cachedCount)}
+}
+
+// get returns the count of the table, reading the table if the count isn't cached or is stale.
+func (tc *tableCounts) get(t *table.Table, now uint64) tableCount {
+	tc.Lock()
+	c, ok := tc.m[t.ID()]
+	tc.Unlock()
+	if ok && c.t == t && c.valid(now) {
+		return c.tableCount
+	}
+	count := countTable(t, now)
+	tc.Lock()
+	tc.m[t.ID()] = cachedCount{tableCount: count, t: t}
+	tc.Unlock()
+	return count
+}
+
+// forget drops the counts of the tables, once they're removed from the LSM tree.
+func (tc *tableCounts) forget(tables []*table.Table) {
+	if tc == nil {
+		return
+	}
+	tc.Lock()
+	defer tc.Unlock()
+	for _, t := range tables {
+		if c, ok := tc.m[t.ID()]; ok && c.t == t {
+			delete(tc.m, t.ID())
+		}
+	}
+}
+
+// countTable counts the live keys of the table. The versions of a key are sorted in descending
+// order, so the first version seen is the latest one.
+func countTable(t *table.Table, now uint64) tableCount {
+	var c tableCount
+	var last []byte
+	it := t.NewIterator(table.NOCACHE)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := y.ParseKey(it.Key())
+		if last != nil && bytes.Equal(key, last) {
+			continue
+		}
+		last = append(last[:0], key...)
+		vs := it.Value()
+		if vs.Meta&bitDelete > 0 || (vs.ExpiresAt > 0 && vs.ExpiresAt <= now) {
+			continue
+		}
+		if vs.ExpiresAt > 0 && (c.expiresAt == 0 || vs.ExpiresAt < c.expiresAt) {
+			c.expiresAt = vs.ExpiresAt
+		}
+		if bytes.HasPrefix(key, badgerPrefix) {
+			c.internal++
+		} else {
+			c.keys++
+		}
+	}
+	return c
+}
+
+// keySpan is the range of the user keys [left, right] of a table or a memtable.
+type keySpan struct {
+	left, right []byte
+	t           *table.Table // nil for the memtables and the pending writes.
+}
+
+// countableTables returns the tables, sorted by their keys, whose keys can be counted from their
+// cached counts. Such a table is the only source of the keys in its range, lies within the bounds
+// of the iteration, and has no version above the read timestamp.
+func (txn *Txn) countableTables(opt *IteratorOptions, tables [][]*table.Table,
+	memTables []*memTable) []*table.Table {
+	var spans []keySpan
+	for _, mt := range memTables {
+		first, last := mt.NewUniIterator(false), mt.NewUniIterator(true)
+		first.Rewind()
+		last.Rewind()
+		if first.Valid() && last.Valid() {
+			spans = append(spans, keySpan{
+				left: y.ParseKey(first.Key()), right: y.ParseKey(last.Key())})
+		}
+		first.Close()
+		last.Close()
+	}
+	for k := range txn.pendingWrites {
+		spans = append(spans, keySpan{left: []byte(k), right: []byte(k)})
+	}
+	for _, level := range tables {
+		for _, t := range level {
+			spans = append(spans, keySpan{
+				left: y.ParseKey(t.Smallest()), right: y.ParseKey(t.Biggest()), t: t})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return bytes.Compare(spans[i].left, spans[j].left) < 0
+	})
+
+	var out []*table.Table
+	var maxRight []byte // The largest right end of the spans before the current one.
+	for i, s := range spans {
+		overlaps := (i > 0 && bytes.Compare(maxRight, s.left) >= 0) ||
+			(i+1 < len(spans) && bytes.Compare(spans[i+1].left, s.right) <= 0)
+		if i == 0 || bytes.Compare(s.right, maxRight) > 0 {
+			maxRight = s.right
+		}
+		if overlaps || s.t == nil || s.t.MaxVersion() > txn.readTs {
+			continue
+		}
+		if !opt.inBounds(s.left) || !opt.inBounds(s.right) {
+			continue
+		}
+		out = append(out, s.t)
+	}
+	return out
+}
+
+// Count returns the number of the keys an iterator with the given options would iterate over.
+// Only the keys are read. The tables which are the only source of the keys in their range, and lie
+// within the bounds of the iteration, aren't iterated over, but counted from the number of their
+// live keys, which is computed once per table. Counting is much faster than iterating over the
+// keys as a result, unless AllVersions, DistinctPrefixLen or SinceTs is set, or a namespace is
+// banned.
+func (txn *Txn) Count(opt IteratorOptions) (int, error) {
+	if txn.discarded {
+		return 0, ErrDiscardedTxn
+	}
+	if txn.db.IsClosed() {
+		return 0, ErrDBClosed
+	}
+	opt.Reverse = false
+	opt.PrefetchValues = false
+	opt.setBounds()
+
+	var fast []*table.Table
+	if !opt.AllVersions && opt.DistinctPrefixLen == 0 && opt.SinceTs == 0 &&
+		len(txn.db.bannedNamespaces.all()) == 0 {
+		memTables, decr := txn.db.getMemTables()
+		defer decr()
+		tables := txn.db.lc.getTables(&opt)
+		defer func() {
+			for _, level := range tables {
+				_ = decrRefs(level)
+			}
+		}()
+		fast = txn.countableTables(&opt, tables, memTables)
+	}
+
+	it := txn.NewIterator(opt)
+	defer it.Close()
+	now := uint64(time.Now().Unix())
+	var count int
+	for it.Rewind(); it.Valid(); {
+		key := it.Item().Key()
+		for len(fast) > 0 && bytes.Compare(y.ParseKey(fast[0].Biggest()), key) < 0 {
+			// The iterator went past the table. All its keys are invisible, or it would have
+			// stopped on one of them.
+			fast = fast[1:]
+		}
+		if len(fast) == 0 || bytes.Compare(key, y.ParseKey(fast[0].Smallest())) < 0 {
+			count++
+			it.Next()
+			continue
+		}
+		// The iterator is within the range of the table. Count its keys, and skip over them.
+		t := fast[0]
+		fast = fast[1:]
+		c := txn.db.tableCounts.get(t, now)
+		count += c.keys
+		if opt.InternalAccess {
+			count += c.internal
+		}
+		// The key right after the biggest key of the table.
+		it.Seek(append(y.SafeCopy(nil, y.ParseKey(t.Biggest())), 0))
+	}
+	return count, nil
+}
+
+// CountKeys returns the number of the keys with the given prefix, at the latest read timestamp.
+// Deleted and expired keys are not counted. The keys are counted by a Stream, which goes over
+// many key ranges concurrently, without reading the values.
+func (db *DB) CountKeys(ctx context.Context, prefix []byte) (int, error) {
+	var count int64
+	st := db.NewStream()
+	st.Prefix = prefix
+	st.LogPrefix = "Badger.CountKeys"
+	st.ChooseKey = func(item *Item) bool {
+		if !item.IsDeletedOrExpired() {
+			atomic.AddInt64(&count, 1)
+		}
+		// Nothing is sent.
+		return false
+	}
+	st.Send = func(buf *z.Buffer) error {
+		return nil
+	}
+	if err := st.Orchestrate(ctx); err != nil {
+		return 0, err
+	}
+	return int(atomic.LoadInt64(&count)), nil
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0).WithBaseTableSize(1 << 14)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	expiresAt := time.Now().Unix() + 2
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 2000; i++ {
+			k := []byte(fmt.Sprintf("key%04d", i))
+			val := make([]byte, 100)
+			rand.Read(val)
+			e := NewEntry(k, val)
+			if i%100 == 0 {
+				e.ExpiresAt = uint64(expiresAt)
+			}
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	_, err = db.CompactRange(CompactRangeOptions{})
+	require.NoError(t, err)
+	require.Greater(t, len(db.Tables()), 4)
+
+	// Some keys in the memtable overlap the tables.
+	txnDelete(t, db, []byte("key0500"))
+	txnSet(t, db, []byte("key1500"), []byte("v"), 0)
+	txnSet(t, db, []byte("key9999"), []byte("v"), 0)
+
+	iterate := func(opt IteratorOptions) int {
+		var n int
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(opt)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				n++
+			}
+			return nil
+		}))
+		return n
+	}
+	check := func(opt IteratorOptions, expected int) {
+		require.Equal(t, expected, iterate(opt))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			n, err := txn.Count(opt)
+			require.NoError(t, err)
+			require.Equal(t, expected, n)
+			return nil
+		}))
+	}
+	check(DefaultIteratorOptions, 2000)
+	check(IteratorOptions{Prefix: []byte("key1")}, 1000)
+	check(IteratorOptions{LowerBound: []byte("key0100"), UpperBound: []byte("key1234")}, 1133)
+	check(IteratorOptions{AllVersions: true}, 2003)
+	require.Greater(t, len(db.tableCounts.m), 0)
+
+	n, err := db.CountKeys(context.Background(), []byte("key0"))
+	require.NoError(t, err)
+	require.Equal(t, 999, n)
+
+	// The cached counts become stale once the keys expire.
+	time.Sleep(time.Until(time.Unix(expiresAt, 0)))
+	check(DefaultIteratorOptions, 1982)
+	check(IteratorOptions{Prefix: []byte("key1")}, 991)
+	n, err = db.CountKeys(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, 1982, n)
+
+	// The pending writes of the transaction are counted too.
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	require.NoError(t, txn.Delete([]byte("key0001")))
+	require.NoError(t, txn.Set([]byte("key0000"), []byte("v")))
+	n, err = txn.Count(DefaultIteratorOptions)
+	require.NoError(t, err)
+	require.Equal(t, 1982, n)
+}
+
+func TestCountAfterDropAll(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		write := func(n int) {
+			buf := z.NewBuffer(10<<20, "test")
+			defer buf.Release()
+			for i := 0; i < n; i++ {
+				KVToBuffer(&pb.KV{
+					Key:     []byte(fmt.Sprintf("key%04d", i)),
+					Value:   []byte("v"),
+					Version: 1,
+				}, buf)
+			}
+			sw := db.NewStreamWriter()
+			require.NoError(t, sw.Prepare())
+			require.NoError(t, sw.Write(buf))
+			require.NoError(t, sw.Flush())
+		}
+		count := func() int {
+			var n int
+			require.NoError(t, db.View(func(txn *Txn) error {
+				var err error
+				n, err = txn.Count(DefaultIteratorOptions)
+				return err
+			}))
+			return n
+		}
+		write(100)
+		require.Equal(t, 100, count())
+		// The StreamWriter drops all the tables, whose IDs are reused by the new ones.
+		write(5)
+		require.Equal(t, 5, count())
+	})
+}
@@ -31,6 +31,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/dgraph-io/badger/v3/objstore"
 	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/skl"
@@ -60,6 +61,10 @@ type closers struct {
 	valueGC     *z.Closer
 	pub         *z.Closer
 	cacheHealth *z.Closer
+	expiry      *z.Closer
+	syncer      *z.Closer
+	memory      *z.Closer
+	scrub       *z.Closer // Tracks the running calls of Scrub, which Close interrupts.
 }
 
 type lockedKeys struct {
@@ -94,40 +99,90 @@ func (lk *lockedKeys) all() []uint64 {
 // DB is thread-safe.
 type DB struct {
 	lock sync.RWMutex // Guards list of inmemory tables, not individual reads and writes.
+	// Serializes the catch ups in Secondary mode.
+	catchUpLock sync.Mutex
+	// Serializes the calls to SetOptions.
+	setOptionsLock sync.Mutex
+	// Guards sequences, the journaled sequences, whose leases are released on Close.
+	sequencesLock sync.Mutex
+	sequences     []*Sequence
 
 	dirLockGuard *directoryLockGuard
 	// nil if Dir and ValueDir are the same
 	valueDirGuard *directoryLockGuard
+	// nil if LargeValueDir is not set
+	largeValueGuard *directoryLockGuard
+	// nil if TempSpillDir is not set
+	tempSpillDirGuard *directoryLockGuard
 
 	closers closers
 
 	mt  *memTable   // Our latest (actively written) in-memory table
 	imm []*memTable // Add here only AFTER pushing to flushChan.
 
+	// mem keeps the memory used within MemoryBudget.
+	mem memoryGovernor
+
 	// Initialized via openMemTables.
 	nextMemFid int
+	// openProgress reports the progress of Open.
+	openProgress *openProgress
+	// The paths of the WAL files of the flushed memtables, kept to be reused by the new ones. Nil
+	// unless NumRecycledWALs is set.
+	recycledWALs chan string
+	// recycleLock guards the recycling of the WAL files against noRecycle, which is set once they
+	// are removed by Close.
+	recycleLock sync.Mutex
+	noRecycle   bool
 
 	opt       Options
 	manifest  *manifestFile
 	lc        *levelsController
 	vlog      valueLog
 	writeCh   chan *request
+	chunkLock sync.RWMutex // Held exclusively while sending the chunks of a chunked txn.
 	sklCh     chan *handoverRequest
 	flushChan chan flushTask // For flushing memtables.
 	closeOnce sync.Once      // For closing DB only once.
 
 	blockWrites int32
 	isClosed    uint32
+	// writeStallStart is when the memtables last ran out of room for the writes, or zero if they
+	// have room. It is only used by writeRequests, to fail the writes after MaxWriteStall.
+	writeStallStart time.Time
 
 	orc              *oracle
+	conflicts        *conflictStats
+	keyLocks         *keyLocks
 	bannedNamespaces *lockedKeys
 	threshold        *vlogThreshold
+	tableCounts      *tableCounts // The cached counts of the live keys of the tables.
+	syncMark         *syncMark    // The writes synced to disk. See WaitForSync.
+
+	// funcVars publish the metrics computed by the DB. They are cleared by Close, so that the
+	// expvar maps don't keep the DB alive.
+	funcVars []*y.FuncVar
+	// hotKeysVar publishes the hot conflict keys. It's removed from the expvar map by Close.
+	hotKeysVar *y.FuncVar
 
 	pub        *publisher
 	registry   *KeyRegistry
 	blockCache *ristretto.Cache
-	indexCache *ristretto.Cache
-	allocPool  *z.AllocatorPool
+	// pinnedBlockCache holds the blocks of the tables in the top PinnedBlockCacheLevels levels,
+	// so they aren't evicted by the blocks of the lower levels.
+	pinnedBlockCache *ristretto.Cache
+	// compressedBlockCache holds the compressed blocks, to be decompressed on a block cache miss.
+	compressedBlockCache *ristretto.Cache
+	indexCache           *ristretto.Cache
+	// filterCache holds the bloom filters of encrypted tables, so they aren't evicted along with
+	// the indices.
+	filterCache *ristretto.Cache
+	allocPool   *table.ArenaPool
+
+	events eventListeners // Listeners added by AddEventListener.
+
+	slowLog slowLog     // Operations slower than Options.SlowLogThreshold.
+	health  healthState // Stalls and subsystem errors, reported by Health.
 }
 
 const (
@@ -139,11 +194,63 @@ func checkAndSetOptions(opt *Options) error {
 	// we cannot have just one compactor otherwise we will end up with all data
 	// on level 2.
 	if opt.NumCompactors == 1 {
-		return errors.New("Cannot have 1 compactor. Need at least 2")
+		return errorf(CodeInvalidArgument, "Cannot have 1 compactor. Need at least 2")
+	}
+	if opt.MaxSubcompactions < 0 {
+		return errorf(CodeInvalidArgument, "Invalid MaxSubcompactions %d, cannot be negative",
+			opt.MaxSubcompactions)
+	}
+	if opt.TieredSizeRatio < 0 {
+		return errorf(CodeInvalidArgument, "Invalid TieredSizeRatio %d, cannot be negative",
+			opt.TieredSizeRatio)
+	}
+	if opt.TTLCompactionRatio < 0 || opt.TTLCompactionRatio > 1 {
+		return errorf(CodeInvalidArgument, "Invalid TTLCompactionRatio %f, must be in range [0, 1]",
+			opt.TTLCompactionRatio)
+	}
+	if opt.CompactionGarbageRatio < 0 {
+		return errorf(CodeInvalidArgument, "Invalid CompactionGarbageRatio %f, cannot be negative",
+			opt.CompactionGarbageRatio)
 	}
 
+	if opt.FS == nil {
+		opt.FS = y.OSFS
+	}
 	if opt.InMemory && (opt.Dir != "" || opt.ValueDir != "") {
-		return errors.New("Cannot use badger in Disk-less mode with Dir or ValueDir set")
+		return errorf(CodeInvalidArgument, "Cannot use badger in Disk-less mode with Dir or ValueDir set")
+	}
+	if opt.TempSpillDir != "" && !opt.InMemory {
+		return errorf(CodeInvalidArgument, "TempSpillDir can only be used in InMemory mode")
+	}
+	if opt.RemoteTables != "" && (opt.InMemory || !objstore.IsURL(opt.RemoteTables)) {
+		return errorf(CodeInvalidArgument, "Invalid RemoteTables %q, must be an object storage URL, "+
+			"and the DB must not be InMemory", opt.RemoteTables)
+	}
+	if opt.MemoryBudget < 0 {
+		return errorf(CodeInvalidArgument, "Invalid MemoryBudget %d, must not be negative",
+			opt.MemoryBudget)
+	}
+	if opt.TableBuilderArenaSize < 0 {
+		return errorf(CodeInvalidArgument, "Invalid TableBuilderArenaSize %d, must not be negative",
+			opt.TableBuilderArenaSize)
+	}
+	if opt.NumFlushers < 1 {
+		return errorf(CodeInvalidArgument, "Invalid NumFlushers %d, must be positive", opt.NumFlushers)
+	}
+	if opt.WALSyncInterval < 0 {
+		return errorf(CodeInvalidArgument, "Invalid WALSyncInterval %s, must not be negative",
+			opt.WALSyncInterval)
+	}
+	if opt.NumRecycledWALs < 0 {
+		return errorf(CodeInvalidArgument, "Invalid NumRecycledWALs %d, must not be negative",
+			opt.NumRecycledWALs)
+	}
+	if opt.MemTableShards < 1 {
+		return errorf(CodeInvalidArgument, "Invalid MemTableShards %d, must be positive",
+			opt.MemTableShards)
+	}
+	if opt.EncryptionMode != options.AESCTR && opt.EncryptionMode != options.AESGCM {
+		return errorf(CodeInvalidArgument, "Invalid EncryptionMode %d", opt.EncryptionMode)
 	}
 	opt.maxBatchSize = (15 * opt.MemTableSize) / 100
 	opt.maxBatchCount = opt.maxBatchSize / int64(skl.MaxNodeSize)
@@ -151,19 +258,19 @@ func checkAndSetOptions(opt *Options) error {
 	// This is the maximum value, vlogThreshold can have if dynamic thresholding is enabled.
 	opt.maxValueThreshold = math.Min(maxValueThreshold, float64(opt.maxBatchSize))
 	if opt.VLogPercentile < 0.0 || opt.VLogPercentile > 1.0 {
-		return errors.New("vlogPercentile must be within range of 0.0-1.0")
+		return errorf(CodeInvalidArgument, "vlogPercentile must be within range of 0.0-1.0")
 	}
 
 	// We are limiting opt.ValueThreshold to maxValueThreshold for now.
 	if opt.ValueThreshold > maxValueThreshold {
-		return errors.Errorf("Invalid ValueThreshold, must be less or equal to %d",
+		return errorf(CodeInvalidArgument, "Invalid ValueThreshold, must be less or equal to %d",
 			maxValueThreshold)
 	}
 
 	// If ValueThreshold is greater than opt.maxBatchSize, we won't be able to push any data using
 	// the transaction APIs. Transaction batches entries into batches of size opt.maxBatchSize.
 	if opt.ValueThreshold > opt.maxBatchSize {
-		return errors.Errorf("Valuethreshold %d greater than max batch size of %d. Either "+
+		return errorf(CodeInvalidArgument, "Valuethreshold %d greater than max batch size of %d. Either "+
 			"reduce opt.ValueThreshold or increase opt.MaxTableSize.",
 			opt.ValueThreshold, opt.maxBatchSize)
 	}
@@ -173,12 +280,52 @@ func checkAndSetOptions(opt *Options) error {
 		return ErrValueLogSize
 	}
 
+	if opt.LargeValueDir != "" {
+		switch {
+		case opt.InMemory:
+			return errorf(CodeInvalidArgument, "Cannot use LargeValueDir in InMemory mode")
+		case opt.LargeValueDir == opt.Dir || opt.LargeValueDir == opt.ValueDir:
+			return errorf(CodeInvalidArgument, "LargeValueDir must be different from Dir and ValueDir")
+		case opt.LargeValueThreshold <= 0:
+			return errorf(CodeInvalidArgument, "Invalid LargeValueThreshold %d, must be positive",
+				opt.LargeValueThreshold)
+		}
+	}
+
+	if opt.ValueLogGCInterval > 0 && opt.ValueLogTargetSpaceAmp <= 1.0 {
+		return errorf(CodeInvalidArgument, "Invalid ValueLogTargetSpaceAmp %.2f, must be greater than 1",
+			opt.ValueLogTargetSpaceAmp)
+	}
+
+	if opt.BloomPrefixLength < 0 {
+		return errorf(CodeInvalidArgument, "Invalid BloomPrefixLength %d, must not be negative",
+			opt.BloomPrefixLength)
+	}
+	if opt.IndexPartitionSize < 0 {
+		return errorf(CodeInvalidArgument, "Invalid IndexPartitionSize %d, must not be negative",
+			opt.IndexPartitionSize)
+	}
+	if opt.PinnedBlockCacheLevels < 0 || opt.PinnedBlockCacheLevels > opt.MaxLevels {
+		return errorf(CodeInvalidArgument, "Invalid PinnedBlockCacheLevels %d, must be between 0 and %d",
+			opt.PinnedBlockCacheLevels, opt.MaxLevels)
+	}
+
+	if opt.Secondary {
+		if opt.InMemory {
+			return errorf(CodeInvalidArgument, "Cannot use Secondary mode in InMemory mode")
+		}
+		// The process which opened the DB read-write holds the directory locks.
+		opt.ReadOnly = true
+		opt.BypassLockGuard = true
+	}
 	if opt.ReadOnly {
 		// Do not perform compaction in read only mode.
 		opt.CompactL0OnClose = false
+		// Nor value log GC.
+		opt.ValueLogGCInterval = 0
 	}
 
-	needCache := (opt.Compression != options.None) || (len(opt.EncryptionKey) > 0)
+	needCache := (opt.Compression != options.None) || opt.encrypted()
 	if needCache && opt.BlockCacheSize == 0 {
 		panic("BlockCacheSize should be set since compression/encryption are enabled")
 	}
@@ -190,17 +337,19 @@ func Open(opt Options) (*DB, error) {
 	if err := checkAndSetOptions(&opt); err != nil {
 		return nil, err
 	}
-	var dirLockGuard, valueDirLockGuard *directoryLockGuard
+	var dirLockGuard, valueDirLockGuard, largeValueDirLockGuard *directoryLockGuard
+	var tempSpillDirLockGuard *directoryLockGuard
 
 	// Create directories and acquire lock on it only if badger is not running in InMemory mode.
 	// We don't have any directories/files in InMemory mode so we don't need to acquire
-	// any locks on them.
+	// any locks on them. The locks are only taken on the disk, the other file systems can't be
+	// shared with another process.
 	if !opt.InMemory {
 		if err := createDirs(opt); err != nil {
 			return nil, err
 		}
 		var err error
-		if !opt.BypassLockGuard {
+		if !opt.BypassLockGuard && opt.FS == y.OSFS {
 			dirLockGuard, err = acquireDirectoryLock(opt.Dir, lockFile, opt.ReadOnly)
 			if err != nil {
 				return nil, err
@@ -229,9 +378,44 @@ func Open(opt Options) (*DB, error) {
 					}
 				}()
 			}
+			if opt.LargeValueDir != "" {
+				largeValueDirLockGuard, err = acquireDirectoryLock(opt.LargeValueDir, lockFile,
+					opt.ReadOnly)
+				if err != nil {
+					return nil, err
+				}
+				defer func() {
+					if largeValueDirLockGuard != nil {
+						_ = largeValueDirLockGuard.release()
+					}
+				}()
+			}
+		}
+	}
+
+	if opt.TempSpillDir != "" {
+		var err error
+		if tempSpillDirLockGuard, err = openTempSpillDir(opt); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if tempSpillDirLockGuard != nil {
+				_ = tempSpillDirLockGuard.release()
+			}
+		}()
+	}
+
+	if opt.MemTableMmapDir != "" {
+		if err := openMemTableMmapDir(opt); err != nil {
+			return nil, err
 		}
 	}
 
+	if opt.RecoverManifest && !opt.InMemory && !opt.ReadOnly {
+		if err := recoverManifest(opt); err != nil {
+			return nil, y.Wrapf(err, "while recovering the MANIFEST")
+		}
+	}
 	manifestFile, manifest, err := openOrCreateManifestFile(opt)
 	if err != nil {
 		return nil, err
@@ -242,20 +426,32 @@ func Open(opt Options) (*DB, error) {
 		}
 	}()
 
+	// In Secondary mode, the tables are opened by DB.catchUp.
+	numTables := len(manifest.Tables)
+	if opt.Secondary {
+		numTables = 0
+	}
 	db := &DB{
-		imm:              make([]*memTable, 0, opt.NumMemtables),
-		flushChan:        make(chan flushTask, opt.NumMemtables),
-		writeCh:          make(chan *request, kvWriteChCapacity),
-		sklCh:            make(chan *handoverRequest),
-		opt:              opt,
-		manifest:         manifestFile,
-		dirLockGuard:     dirLockGuard,
-		valueDirGuard:    valueDirLockGuard,
-		orc:              newOracle(opt),
-		pub:              newPublisher(),
-		allocPool:        z.NewAllocatorPool(8),
-		bannedNamespaces: &lockedKeys{keys: make(map[uint64]struct{})},
-		threshold:        initVlogThreshold(&opt),
+		openProgress:      newOpenProgress(opt.OnOpenProgress, numTables),
+		imm:               make([]*memTable, 0, opt.NumMemtables),
+		flushChan:         make(chan flushTask, opt.NumMemtables),
+		writeCh:           make(chan *request, kvWriteChCapacity),
+		sklCh:             make(chan *handoverRequest),
+		opt:               opt,
+		manifest:          manifestFile,
+		dirLockGuard:      dirLockGuard,
+		valueDirGuard:     valueDirLockGuard,
+		largeValueGuard:   largeValueDirLockGuard,
+		tempSpillDirGuard: tempSpillDirLockGuard,
+		orc:               newOracle(opt),
+		conflicts:         newConflictStats(),
+		keyLocks:          newKeyLocks(),
+		pub:               newPublisher(),
+		allocPool:         table.NewArenaPool(8, opt.TableBuilderArenaSize),
+		bannedNamespaces:  &lockedKeys{keys: make(map[uint64]struct{})},
+		threshold:         initVlogThreshold(&opt),
+		tableCounts:       newTableCounts(),
+		syncMark:          newSyncMark(),
 	}
 	// Cleanup all the goroutines started by badger in case of an error.
 	defer func() {
@@ -287,6 +483,48 @@ func Open(opt Options) (*DB, error) {
 		}
 	}
 
+	if opt.PinnedBlockCacheSize > 0 && opt.PinnedBlockCacheLevels > 0 {
+		numInCache := opt.PinnedBlockCacheSize / int64(opt.BlockSize)
+		if numInCache == 0 {
+			// Make the value of this variable at least one since the cache requires
+			// the number of counters to be greater than zero.
+			numInCache = 1
+		}
+
+		config := ristretto.Config{
+			NumCounters: numInCache * 8,
+			MaxCost:     opt.PinnedBlockCacheSize,
+			BufferItems: 64,
+			Metrics:     true,
+			OnExit:      table.BlockEvictHandler,
+		}
+		db.pinnedBlockCache, err = ristretto.NewCache(&config)
+		if err != nil {
+			return nil, y.Wrap(err, "failed to create pinned data cache")
+		}
+	}
+
+	if opt.CompressedBlockCacheSize > 0 {
+		// Blocks are usually compressed to about half their size.
+		numInCache := 2 * opt.CompressedBlockCacheSize / int64(opt.BlockSize)
+		if numInCache == 0 {
+			// Make the value of this variable at least one since the cache requires
+			// the number of counters to be greater than zero.
+			numInCache = 1
+		}
+
+		config := ristretto.Config{
+			NumCounters: numInCache * 8,
+			MaxCost:     opt.CompressedBlockCacheSize,
+			BufferItems: 64,
+			Metrics:     true,
+		}
+		db.compressedBlockCache, err = ristretto.NewCache(&config)
+		if err != nil {
+			return nil, y.Wrap(err, "failed to create compressed data cache")
+		}
+	}
+
 	if opt.IndexCacheSize > 0 {
 		// Index size is around 5% of the table size.
 		indexSz := int64(float64(opt.MemTableSize) * 0.05)
@@ -309,6 +547,28 @@ func Open(opt Options) (*DB, error) {
 		}
 	}
 
+	if opt.FilterCacheSize > 0 {
+		// Bloom filter size is around 1% of the table size.
+		filterSz := int64(float64(opt.MemTableSize) * 0.01)
+		numInCache := opt.FilterCacheSize / filterSz
+		if numInCache == 0 {
+			// Make the value of this variable at least one since the cache requires
+			// the number of counters to be greater than zero.
+			numInCache = 1
+		}
+
+		config := ristretto.Config{
+			NumCounters: numInCache * 8,
+			MaxCost:     opt.FilterCacheSize,
+			BufferItems: 64,
+			Metrics:     true,
+		}
+		db.filterCache, err = ristretto.NewCache(&config)
+		if err != nil {
+			return nil, y.Wrap(err, "failed to create filter cache")
+		}
+	}
+
 	db.closers.cacheHealth = z.NewCloser(1)
 	go db.monitorCache(db.closers.cacheHealth)
 
@@ -322,7 +582,9 @@ func Open(opt Options) (*DB, error) {
 		Dir:                           opt.Dir,
 		EncryptionKey:                 opt.EncryptionKey,
 		EncryptionKeyRotationDuration: opt.EncryptionKeyRotationDuration,
+		KeyProvider:                   opt.KeyProvider,
 		InMemory:                      opt.InMemory,
+		FS:                            opt.FS,
 	}
 
 	if db.registry, err = OpenKeyRegistry(krOpt); err != nil {
@@ -332,6 +594,9 @@ func Open(opt Options) (*DB, error) {
 	db.closers.updateSize = z.NewCloser(1)
 	go db.updateSize(db.closers.updateSize)
 
+	if opt.NumRecycledWALs > 0 && !opt.InMemory && !opt.ReadOnly && !opt.Secondary {
+		db.recycledWALs = make(chan string, opt.NumRecycledWALs)
+	}
 	if err := db.openMemTables(db.opt); err != nil {
 		return nil, y.Wrapf(err, "while opening memtables")
 	}
@@ -363,6 +628,11 @@ func Open(opt Options) (*DB, error) {
 			db.flushChan <- flushTask{mt: mt}
 		}
 	}
+	if opt.Secondary {
+		if err := db.catchUp(); err != nil {
+			return db, y.Wrapf(err, "while catching up")
+		}
+	}
 	// We do increment nextTxnTs below. So, no need to do it here.
 	db.orc.nextTxnTs = db.MaxVersion()
 	db.opt.Infof("Set nextTxnTs to %d", db.orc.nextTxnTs)
@@ -377,6 +647,10 @@ func Open(opt Options) (*DB, error) {
 	// In normal mode, we must update readMark so older versions of keys can be removed during
 	// compaction when run in offline mode via the flatten tool.
 	db.orc.readMark.Done(db.orc.nextTxnTs)
+	if db.orc.commits != nil {
+		// We don't know when the versions on disk were written. Consider them written now.
+		db.orc.commits.add(db.orc.nextTxnTs, time.Now())
+	}
 	db.orc.incrementNextTs()
 
 	go db.threshold.listenForValueThresholdUpdate()
@@ -385,19 +659,50 @@ func Open(opt Options) (*DB, error) {
 		return db, errors.Wrapf(err, "While setting banned keys")
 	}
 
+	if db.opt.MemoryBudget > 0 {
+		db.closers.memory = z.NewCloser(1)
+		go db.enforceMemoryBudget(db.closers.memory)
+	}
+
 	db.closers.writes = z.NewCloser(2)
 	go db.doWrites(db.closers.writes)
 	go db.handleHandovers(db.closers.writes)
 
+	if (db.opt.SyncWrites || db.opt.WALSyncInterval > 0) && !db.opt.InMemory && !db.opt.ReadOnly {
+		db.closers.syncer = z.NewCloser(1)
+		go db.syncer(db.closers.syncer)
+	}
+
 	if !db.opt.InMemory {
 		db.closers.valueGC = z.NewCloser(1)
 		go db.vlog.waitOnGC(db.closers.valueGC)
+		if db.opt.ValueLogGCInterval > 0 {
+			db.closers.valueGC.AddRunning(1)
+			go db.vlog.runGCScheduler(db.closers.valueGC)
+		}
 	}
 
 	db.closers.pub = z.NewCloser(1)
 	go db.pub.listenForUpdates(db.closers.pub)
 
+	db.closers.scrub = z.NewCloser(0)
+
+	if db.expiryIndexEnabled() && !db.opt.ReadOnly {
+		db.closers.expiry = z.NewCloser(1)
+		go db.runExpiryScanner(db.closers.expiry)
+	}
+
+	y.CacheMetricsSet(db.opt.MetricsEnabled, db.opt.Dir, db.newFuncVar(db.cacheMetrics))
+	if !db.opt.InMemory {
+		y.VlogSpaceAmpSet(db.opt.MetricsEnabled, db.opt.ValueDir,
+			db.newFuncVar(func() interface{} { return db.ValueLogSpaceAmplification() }))
+	}
+	db.hotKeysVar = db.newFuncVar(db.hotConflictKeys)
+	y.HotConflictKeysSet(db.opt.MetricsEnabled, db.opt.Dir, db.hotKeysVar)
+
 	valueDirLockGuard = nil
+	largeValueDirLockGuard = nil
+	tempSpillDirLockGuard = nil
 	dirLockGuard = nil
 	manifestFile = nil
 	return db, nil
@@ -476,7 +781,10 @@ func (db *DB) monitorCache(c *z.Closer) {
 		}
 
 		analyze("Block cache", db.BlockCacheMetrics())
+		analyze("Pinned block cache", db.PinnedBlockCacheMetrics())
+		analyze("Compressed block cache", db.CompressedBlockCacheMetrics())
 		analyze("Index cache", db.IndexCacheMetrics())
+		analyze("Filter cache", db.FilterCacheMetrics())
 		count++
 	}
 }
@@ -488,7 +796,10 @@ func (db *DB) cleanup() {
 	db.stopCompactions()
 
 	db.blockCache.Close()
+	db.pinnedBlockCache.Close()
+	db.compressedBlockCache.Close()
 	db.indexCache.Close()
+	db.filterCache.Close()
 	if db.closers.updateSize != nil {
 		db.closers.updateSize.Signal()
 	}
@@ -498,9 +809,15 @@ func (db *DB) cleanup() {
 	if db.closers.writes != nil {
 		db.closers.writes.Signal()
 	}
+	if db.closers.syncer != nil {
+		db.closers.syncer.Signal()
+	}
 	if db.closers.pub != nil {
 		db.closers.pub.Signal()
 	}
+	if db.closers.memory != nil {
+		db.closers.memory.Signal()
+	}
 
 	db.orc.Stop()
 
@@ -516,6 +833,22 @@ func (db *DB) BlockCacheMetrics() *ristretto.Metrics {
 	return nil
 }
 
+// PinnedBlockCacheMetrics returns the metrics for the underlying pinned block cache.
+func (db *DB) PinnedBlockCacheMetrics() *ristretto.Metrics {
+	if db.pinnedBlockCache != nil {
+		return db.pinnedBlockCache.Metrics
+	}
+	return nil
+}
+
+// CompressedBlockCacheMetrics returns the metrics for the underlying compressed block cache.
+func (db *DB) CompressedBlockCacheMetrics() *ristretto.Metrics {
+	if db.compressedBlockCache != nil {
+		return db.compressedBlockCache.Metrics
+	}
+	return nil
+}
+
 // IndexCacheMetrics returns the metrics for the underlying index cache.
 func (db *DB) IndexCacheMetrics() *ristretto.Metrics {
 	if db.indexCache != nil {
@@ -524,6 +857,35 @@ func (db *DB) IndexCacheMetrics() *ristretto.Metrics {
 	return nil
 }
 
+// FilterCacheMetrics returns the metrics for the underlying filter cache.
+func (db *DB) FilterCacheMetrics() *ristretto.Metrics {
+	if db.filterCache != nil {
+		return db.filterCache.Metrics
+	}
+	return nil
+}
+
+// cacheMetrics returns the hits, misses and evictions of each cache the DB was created with.
+func (db *DB) cacheMetrics() interface{} {
+	res := make(map[string]map[string]uint64)
+	add := func(name string, m *ristretto.Metrics) {
+		if m == nil {
+			return
+		}
+		res[name] = map[string]uint64{
+			"hits":      m.Hits(),
+			"misses":    m.Misses(),
+			"evictions": m.KeysEvicted(),
+		}
+	}
+	add("block", db.BlockCacheMetrics())
+	add("pinned_block", db.PinnedBlockCacheMetrics())
+	add("compressed_block", db.CompressedBlockCacheMetrics())
+	add("index", db.IndexCacheMetrics())
+	add("filter", db.FilterCacheMetrics())
+	return res
+}
+
 // Close closes a DB. It's crucial to call it to ensure all the pending updates make their way to
 // disk. Calling DB.Close() multiple times would still only close the DB once.
 func (db *DB) Close() error {
@@ -540,21 +902,47 @@ func (db *DB) IsClosed() bool {
 	return atomic.LoadUint32(&db.isClosed) == 1
 }
 
+// newFuncVar returns a FuncVar publishing the value returned by f, cleared when the DB is closed.
+func (db *DB) newFuncVar(f func() interface{}) *y.FuncVar {
+	v := y.NewFuncVar(f)
+	db.funcVars = append(db.funcVars, v)
+	return v
+}
+
 func (db *DB) close() (err error) {
 	defer db.allocPool.Release()
 
 	db.opt.Debugf("Closing database")
+	for _, v := range db.funcVars {
+		v.Clear()
+	}
+	y.HotConflictKeysDelete(db.opt.MetricsEnabled, db.opt.Dir, db.hotKeysVar)
 	db.opt.Infof("Lifetime L0 stalled for: %s\n", time.Duration(atomic.LoadInt64(&db.lc.l0stallsMs)))
 
+	// The writes are still accepted.
+	if seqErr := db.releaseSequences(); seqErr != nil {
+		err = y.Wrap(seqErr, "DB.Close")
+	}
+
+	db.chunkLock.Lock()
 	atomic.StoreInt32(&db.blockWrites, 1)
+	db.chunkLock.Unlock()
 
+	// Interrupt the scrubs, which read the files.
+	db.closers.scrub.SignalAndWait()
 	if !db.opt.InMemory {
 		// Stop value GC first.
 		db.closers.valueGC.SignalAndWait()
 	}
+	if db.closers.expiry != nil {
+		db.closers.expiry.SignalAndWait()
+	}
 
 	// Stop writes next.
 	db.closers.writes.SignalAndWait()
+	if db.closers.syncer != nil {
+		db.closers.syncer.SignalAndWait()
+	}
 
 	// Don't accept any more write.
 	close(db.writeCh)
@@ -562,6 +950,9 @@ func (db *DB) close() (err error) {
 
 	db.closers.pub.SignalAndWait()
 	db.closers.cacheHealth.Signal()
+	if db.closers.memory != nil {
+		db.closers.memory.SignalAndWait()
+	}
 
 	// Make sure that block writer is done pushing stuff into memtable!
 	// Otherwise, you will have a race condition: we are trying to flush memtables
@@ -569,7 +960,7 @@ func (db *DB) close() (err error) {
 	// trying to push stuff into the memtable. This will also resolve the value
 	// offset problem: as we push into memtable, we update value offsets there.
 	if db.mt != nil {
-		if db.mt.sl.Empty() {
+		if db.mt.Empty() {
 			// Remove the memtable if empty.
 			db.mt.DecrRef()
 		} else {
@@ -602,6 +993,9 @@ func (db *DB) close() (err error) {
 	}
 	db.stopMemoryFlush()
 	db.stopCompactions()
+	if walErr := db.removeRecycledWALs(); err == nil {
+		err = y.Wrap(walErr, "DB.Close")
+	}
 
 	// Force Compact L0
 	// We don't need to care about cstatus since no parallel compaction is running.
@@ -624,6 +1018,12 @@ func (db *DB) close() (err error) {
 	}
 
 	db.opt.Infof(db.LevelsToString())
+	if !db.opt.InMemory && !db.opt.ReadOnly && !db.opt.Secondary {
+		// The DB opens without it, so it is only logged if it can't be written.
+		if metaErr := db.lc.writeTableMeta(); metaErr != nil {
+			db.opt.Warningf("While writing %s: %v", TableMetaFileName, metaErr)
+		}
+	}
 	if lcErr := db.lc.close(); err == nil {
 		err = y.Wrap(lcErr, "DB.Close")
 	}
@@ -631,12 +1031,24 @@ func (db *DB) close() (err error) {
 	db.closers.updateSize.SignalAndWait()
 	db.orc.Stop()
 	db.blockCache.Close()
+	db.pinnedBlockCache.Close()
+	db.compressedBlockCache.Close()
 	db.indexCache.Close()
+	db.filterCache.Close()
 
 	atomic.StoreUint32(&db.isClosed, 1)
 	db.threshold.close()
 
 	if db.opt.InMemory {
+		if db.tempSpillDirGuard != nil {
+			// The tables were closed with the levels, so their files can be removed.
+			if spillErr := removeTempTables(db.opt.TempSpillDir); err == nil {
+				err = y.Wrap(spillErr, "DB.Close")
+			}
+			if guardErr := db.tempSpillDirGuard.release(); err == nil {
+				err = y.Wrap(guardErr, "DB.Close")
+			}
+		}
 		return
 	}
 
@@ -650,6 +1062,11 @@ func (db *DB) close() (err error) {
 			err = y.Wrap(guardErr, "DB.Close")
 		}
 	}
+	if db.largeValueGuard != nil {
+		if guardErr := db.largeValueGuard.release(); err == nil {
+			err = y.Wrap(guardErr, "DB.Close")
+		}
+	}
 	if manifestErr := db.manifest.close(); err == nil {
 		err = y.Wrap(manifestErr, "DB.Close")
 	}
@@ -728,6 +1145,11 @@ func (db *DB) getMemTables() ([]*memTable, func()) {
 // for "fooX" in all the levels of the LSM tree. This is expensive but it
 // removes the overhead of handling move keys completely.
 func (db *DB) get(key []byte) (y.ValueStruct, error) {
+	return db.getTraced(key, nil)
+}
+
+// getTraced works like get, recording each memtable and level looked up in gt.
+func (db *DB) getTraced(key []byte, gt *getTrace) (y.ValueStruct, error) {
 	if db.IsClosed() {
 		return y.ValueStruct{}, ErrDBClosed
 	}
@@ -739,11 +1161,13 @@ func (db *DB) get(key []byte) (y.ValueStruct, error) {
 
 	y.NumGetsAdd(db.opt.MetricsEnabled, 1)
 	for i := 0; i < len(tables); i++ {
-		vs := tables[i].sl.Get(key)
+		vs := tables[i].Get(key)
 		y.NumMemtableGetsAdd(db.opt.MetricsEnabled, 1)
 		if vs.Meta == 0 && vs.Value == nil {
+			gt.lookup(-1, false)
 			continue
 		}
+		gt.lookup(-1, true)
 		// Found the required version of the key, return immediately.
 		if vs.Version == version {
 			return vs, nil
@@ -752,7 +1176,7 @@ func (db *DB) get(key []byte) (y.ValueStruct, error) {
 			maxVs = vs
 		}
 	}
-	return db.lc.get(key, maxVs, 0)
+	return db.lc.get(key, maxVs, 0, gt)
 }
 
 var requestPool = sync.Pool{
@@ -764,41 +1188,107 @@ var requestPool = sync.Pool{
 func (db *DB) writeToLSM(b *request) error {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
+	// With multiple shards, the entries are put in one go, so the shards can be filled
+	// concurrently.
+	batch := len(db.mt.shards) > 1
+	var keys [][]byte
+	var values []y.ValueStruct
 	for i, entry := range b.Entries {
-		var err error
+		var vs y.ValueStruct
 		if db.opt.managedTxns || entry.skipVlogAndSetThreshold(db.valueThreshold()) {
 			// Will include deletion / tombstone case.
-			err = db.mt.Put(entry.Key,
-				y.ValueStruct{
-					Value: entry.Value,
-					// Ensure value pointer flag is removed. Otherwise, the value will fail
-					// to be retrieved during iterator prefetch. `bitValuePointer` is only
-					// known to be set in write to LSM when the entry is loaded from a backup
-					// with lower ValueThreshold and its value was stored in the value log.
-					Meta:      entry.meta &^ bitValuePointer,
-					UserMeta:  entry.UserMeta,
-					ExpiresAt: entry.ExpiresAt,
-				})
+			vs = y.ValueStruct{
+				Value: entry.Value,
+				// Ensure value pointer flag is removed. Otherwise, the value will fail
+				// to be retrieved during iterator prefetch. `bitValuePointer` is only
+				// known to be set in write to LSM when the entry is loaded from a backup
+				// with lower ValueThreshold and its value was stored in the value log.
+				Meta:      entry.meta &^ bitValuePointer,
+				UserMeta:  entry.UserMeta,
+				ExpiresAt: entry.ExpiresAt,
+			}
 		} else {
 			// Write pointer to Memtable.
-			err = db.mt.Put(entry.Key,
-				y.ValueStruct{
-					Value:     b.Ptrs[i].Encode(),
-					Meta:      entry.meta | bitValuePointer,
-					UserMeta:  entry.UserMeta,
-					ExpiresAt: entry.ExpiresAt,
-				})
+			vs = y.ValueStruct{
+				Value:     entry.encodedPointer(b.Ptrs[i]),
+				Meta:      entry.meta | bitValuePointer,
+				UserMeta:  entry.UserMeta,
+				ExpiresAt: entry.ExpiresAt,
+			}
 		}
-		if err != nil {
+		if batch {
+			keys = append(keys, entry.Key)
+			values = append(values, vs)
+			continue
+		}
+		if err := db.mt.Put(entry.Key, vs); err != nil {
 			return y.Wrapf(err, "while writing to memTable")
 		}
 	}
-	if db.opt.SyncWrites {
-		return db.mt.SyncWAL()
+	if batch {
+		if err := db.mt.PutBatch(keys, values); err != nil {
+			return y.Wrapf(err, "while writing to memTable")
+		}
 	}
 	return nil
 }
 
+// StallError is returned instead of ErrStalled when the writes have been stalled for longer than
+// Options.MaxWriteStall. It describes the stall. errors.Is(err, ErrStalled) reports true for a
+// StallError.
+type StallError struct {
+	// Reason is StallL0Tables if level 0 has NumLevelZeroTablesStall tables, so the memtables
+	// can't be flushed, or StallMemtables if the flushes are only behind.
+	Reason StallReason
+	// Duration is for how long the writes have been stalled.
+	Duration time.Duration
+	// L0Tables is the number of tables in level 0, and Memtables the number of memtables waiting
+	// to be flushed.
+	L0Tables  int
+	Memtables int
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("%s: stalled on %s for %s, with %d tables in level 0 and %d memtables "+
+		"to flush", ErrStalled, e.Reason, e.Duration.Round(time.Millisecond), e.L0Tables,
+		e.Memtables)
+}
+
+// Is reports whether target is ErrStalled.
+func (e *StallError) Is(target error) bool {
+	return target == ErrStalled
+}
+
+// Unwrap returns ErrStalled.
+func (e *StallError) Unwrap() error {
+	return ErrStalled
+}
+
+func (db *DB) newStallError() *StallError {
+	e := &StallError{
+		Reason:   StallMemtables,
+		Duration: time.Since(db.writeStallStart),
+		L0Tables: db.lc.levels[0].numTables(),
+	}
+	if e.L0Tables >= db.opt.NumLevelZeroTablesStall {
+		e.Reason = StallL0Tables
+	}
+	db.lock.RLock()
+	e.Memtables = len(db.imm)
+	db.lock.RUnlock()
+	return e
+}
+
+// syncMemTable syncs the WAL of the current memtable.
+func (db *DB) syncMemTable() error {
+	db.lock.RLock()
+	mt := db.mt
+	mt.IncrRef()
+	db.lock.RUnlock()
+	defer mt.DecrRef()
+	return mt.SyncWAL()
+}
+
 // writeRequests is called serially by only one goroutine.
 func (db *DB) writeRequests(reqs []*request) error {
 	if len(reqs) == 0 {
@@ -806,6 +1296,7 @@ func (db *DB) writeRequests(reqs []*request) error {
 	}
 
 	done := func(err error) {
+		db.health.record(SubsystemWrite, err)
 		for _, r := range reqs {
 			r.Err = err
 			r.Wg.Done()
@@ -827,9 +1318,30 @@ func (db *DB) writeRequests(reqs []*request) error {
 			continue
 		}
 		count += len(b.Entries)
+		if b.continued {
+			// The previous request reserved room for this one in the memtable.
+			if err := db.writeToLSM(b); err != nil {
+				done(err)
+				return y.Wrap(err, "writeRequests")
+			}
+			continue
+		}
 		var i uint64
 		var err error
-		for err = db.ensureRoomForWrite(); err == errNoRoom; err = db.ensureRoomForWrite() {
+		var stallStart time.Time
+		for err = db.ensureRoomForWrite(b.reserve); err == errNoRoom; err = db.ensureRoomForWrite(b.reserve) {
+			if db.writeStallStart.IsZero() {
+				db.writeStallStart = time.Now()
+			}
+			if max := db.opt.MaxWriteStall; max > 0 && time.Since(db.writeStallStart) >= max {
+				err = db.newStallError()
+				break
+			}
+			if i == 0 {
+				stallStart = time.Now()
+				db.events.stallBegin(StallInfo{Reason: StallMemtables})
+				db.health.stallBegin(StallMemtables)
+			}
 			i++
 			if i%100 == 0 {
 				db.opt.Debugf("Making room for writes")
@@ -839,6 +1351,13 @@ func (db *DB) writeRequests(reqs []*request) error {
 			// you will get a deadlock.
 			time.Sleep(10 * time.Millisecond)
 		}
+		if i > 0 {
+			db.events.stallEnd(StallInfo{Reason: StallMemtables, Duration: time.Since(stallStart)})
+			db.health.stallEnd(StallMemtables)
+		}
+		if _, stalled := err.(*StallError); !stalled {
+			db.writeStallStart = time.Time{}
+		}
 		if err != nil {
 			done(err)
 			return y.Wrap(err, "writeRequests")
@@ -848,32 +1367,99 @@ func (db *DB) writeRequests(reqs []*request) error {
 			return y.Wrap(err, "writeRequests")
 		}
 	}
+	// The WAL is synced once for the whole batch, unless all of its writes are async. The
+	// memtables rotated in the middle of the batch were synced before being rotated.
+	if db.opt.SyncWrites && !allAsync(reqs) {
+		if err := db.syncMemTable(); err != nil {
+			done(err)
+			return y.Wrap(err, "writeRequests")
+		}
+	}
+	// The writes are acked once counted, so WaitForSync waits for them to be synced.
+	atomic.AddUint64(&db.syncMark.written, 1)
+	if db.opt.SyncWrites && allAsync(reqs) {
+		db.syncMark.request()
+	}
 	done(nil)
 	db.opt.Debugf("%d entries written", count)
 	return nil
 }
 
 func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
+	db.chunkLock.RLock()
+	defer db.chunkLock.RUnlock()
+	return db.sendRequest(context.Background(), entries, 0, false, false)
+}
+
+// sendTxnToWriteCh is like sendToWriteCh, but gives up waiting for room in the write channel once
+// ctx is done. With async set, the request is acked before its writes are synced to disk.
+func (db *DB) sendTxnToWriteCh(ctx context.Context, entries []*Entry,
+	async bool) (*request, error) {
+	db.chunkLock.RLock()
+	defer db.chunkLock.RUnlock()
+	return db.sendRequest(ctx, entries, 0, false, async)
+}
+
+// sendChunksToWriteCh sends the chunks of a transaction as consecutive requests to the write
+// channel, so no other writes can get in between them. The first request reserves room for all
+// the chunks in the memtable, and the rest are written to the same memtable and WAL, so the
+// transaction is replayed atomically after a crash. ctx only applies to the first chunk, as the
+// transaction can't be stopped once it is partly sent.
+func (db *DB) sendChunksToWriteCh(ctx context.Context, chunks [][]*Entry, reserve int64,
+	async bool) ([]*request, error) {
+	db.chunkLock.Lock()
+	defer db.chunkLock.Unlock()
+	// blockWrites can't change while we hold chunkLock. So, if the first chunk is accepted, the
+	// rest of them would be accepted too.
+	reqs := make([]*request, 0, len(chunks))
+	for i, entries := range chunks {
+		if i > 0 {
+			ctx = context.Background()
+		}
+		req, err := db.sendRequest(ctx, entries, reserve, i > 0, async)
+		if err != nil {
+			y.AssertTrue(i == 0)
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+func (db *DB) sendRequest(ctx context.Context, entries []*Entry, reserve int64, continued,
+	async bool) (*request, error) {
 	if atomic.LoadInt32(&db.blockWrites) == 1 {
 		return nil, ErrBlockedWrites
 	}
 	var count, size int64
 	for _, e := range entries {
-		size += e.estimateSizeAndSetThreshold(db.valueThreshold())
+		size += e.estimateSizeAndSetThreshold(db.valueThresholdFor(e.Key))
 		count++
 	}
 	if count >= db.opt.maxBatchCount || size >= db.opt.maxBatchSize {
 		return nil, ErrTxnTooBig
 	}
+	for _, e := range entries {
+		e.encodeUserMetadata()
+	}
 
 	// We can only service one request because we need each txn to be stored in a contiguous section.
 	// Txns should not interleave among other txns or rewrites.
 	req := requestPool.Get().(*request)
 	req.reset()
 	req.Entries = entries
+	req.reserve = reserve
+	req.continued = continued
+	req.async = async
 	req.Wg.Add(1)
-	req.IncrRef()     // for db write
-	db.writeCh <- req // Handled in doWrites.
+	req.IncrRef() // for db write
+	select {
+	case db.writeCh <- req: // Handled in doWrites.
+	case <-ctx.Done():
+		req.Wg.Done()
+		req.DecrRef()
+		return nil, ctx.Err()
+	}
 	y.NumPutsAdd(db.opt.MetricsEnabled, int64(len(entries)))
 
 	return req, nil
@@ -897,7 +1483,8 @@ func (db *DB) doWrites(lc *z.Closer) {
 	pendingCh := make(chan struct{}, 1)
 
 	writeRequests := func(reqs []*request) {
-		if err := db.writeRequests(reqs); err != nil {
+		// The stalls are reported by the events and Health already.
+		if err := db.writeRequests(reqs); err != nil && !errors.Is(err, ErrStalled) {
 			db.opt.Errorf("writeRequests: %v", err)
 		}
 		<-pendingCh
@@ -908,6 +1495,8 @@ func (db *DB) doWrites(lc *z.Closer) {
 	y.PendingWritesSet(db.opt.MetricsEnabled, db.opt.Dir, reqLen)
 
 	reqs := make([]*request, 0, 10)
+	var size uint64            // The estimated size of reqs.
+	var delay <-chan time.Time // Fires once the batch has waited for CommitMaxDelay.
 	for {
 		var r *request
 		select {
@@ -915,16 +1504,33 @@ func (db *DB) doWrites(lc *z.Closer) {
 		case <-lc.HasBeenClosed():
 			goto closedCase
 		}
+		if db.opt.CommitMaxDelay > 0 {
+			delay = time.After(db.opt.CommitMaxDelay)
+		}
 
 		for {
 			reqs = append(reqs, r)
 			reqLen.Set(int64(len(reqs)))
+			size += estimateRequestSize(r)
 
-			if len(reqs) >= 3*kvWriteChCapacity {
+			if len(reqs) >= 3*kvWriteChCapacity ||
+				(db.opt.CommitMaxBatchBytes > 0 && size >= uint64(db.opt.CommitMaxBatchBytes)) {
 				pendingCh <- struct{}{} // blocking.
 				goto writeCase
 			}
 
+			if delay != nil {
+				// Keep batching the requests until the delay is over.
+				select {
+				case r = <-db.writeCh:
+					continue
+				case <-delay:
+					delay = nil
+				case <-lc.HasBeenClosed():
+					goto closedCase
+				}
+			}
+
 			select {
 			// Either push to pending, or continue to pick from writeCh.
 			case r = <-db.writeCh:
@@ -952,6 +1558,7 @@ func (db *DB) doWrites(lc *z.Closer) {
 	writeCase:
 		go writeRequests(reqs)
 		reqs = make([]*request, 0, 10)
+		size, delay = 0, nil
 		reqLen.Set(0)
 	}
 }
@@ -990,21 +1597,40 @@ func (db *DB) batchSetAsync(entries []*Entry, f func(error)) error {
 
 var errNoRoom = errors.New("No room for write")
 
-// ensureRoomForWrite is always called serially.
-func (db *DB) ensureRoomForWrite() error {
+// ensureRoomForWrite is always called serially. If reserve is non-zero, the memtable is also
+// rotated if it doesn't have room for reserve more bytes, unless it is empty.
+func (db *DB) ensureRoomForWrite(reserve int64) error {
 	var err error
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	y.AssertTrue(db.mt != nil) // A nil mt indicates that DB is being closed.
-	if !db.mt.isFull() {
-		return nil
+	if !db.mt.isFull() && (reserve == 0 || db.mt.Empty() || db.mt.hasRoomFor(reserve)) {
+		// Close to MemoryBudget, the memtable is flushed early, unless it is small or another one
+		// is being flushed already. Over the budget, the writes wait for that flush.
+		pressure := db.mem.getPressure()
+		if pressure == memoryOK || db.mt.MemSize() < db.memoryFlushSize() {
+			return nil
+		}
+		if len(db.imm) > 0 {
+			if pressure == memoryOver {
+				return errNoRoom
+			}
+			return nil
+		}
+	}
+	// The WAL is only synced at the end of the batch of writes otherwise, and this one might
+	// have written to it.
+	if db.opt.SyncWrites {
+		if err := db.mt.SyncWAL(); err != nil {
+			return y.Wrapf(err, "while syncing memtable")
+		}
 	}
 
 	select {
 	case db.flushChan <- flushTask{mt: db.mt}:
-		db.opt.Debugf("Flushing memtable, mt.size=%d size of flushChan: %d\n",
-			db.mt.sl.MemSize(), len(db.flushChan))
+		db.opt.logw(DEBUG, "Flushing memtable", "memtable_size", db.mt.MemSize(),
+			"flush_queue", len(db.flushChan))
 		// We manage to push this task. Let's modify imm.
 		db.imm = append(db.imm, db.mt)
 		db.mt, err = db.newMemTable()
@@ -1020,12 +1646,18 @@ func (db *DB) ensureRoomForWrite() error {
 }
 
 func (db *DB) handoverSkiplist(r *handoverRequest) error {
-	skl, callback := r.skl, r.callback
+	sl, callback := r.skl, r.callback
 	// If we have some data in db.mt, we should push that first, so the ordering of writes is
 	// maintained.
-	if !db.mt.sl.Empty() {
-		sz := db.mt.sl.MemSize()
+	if !db.mt.Empty() {
+		sz := db.mt.MemSize()
 		db.opt.Infof("Handover found %d B data in current memtable. Pushing to flushChan.", sz)
+		// A batch of writes might be going on, which syncs the WAL only at its end.
+		if db.opt.SyncWrites {
+			if err := db.mt.SyncWAL(); err != nil {
+				return y.Wrapf(err, "while syncing memtable")
+			}
+		}
 		var err error
 		select {
 		case db.flushChan <- flushTask{mt: db.mt}:
@@ -1039,10 +1671,10 @@ func (db *DB) handoverSkiplist(r *handoverRequest) error {
 		}
 	}
 
-	mt := &memTable{sl: skl}
+	mt := &memTable{shards: []*skl.Skiplist{sl}}
 
 	// Iterate over the skiplist and send the entries to the publisher.
-	it := skl.NewIterator()
+	it := sl.NewIterator()
 
 	var entries []*Entry
 	for it.SeekToFirst(); it.Valid(); it.Next() {
@@ -1093,6 +1725,13 @@ func arenaSize(opt Options) int64 {
 	return opt.MemTableSize + opt.maxBatchSize + opt.maxBatchCount*int64(skl.MaxNodeSize)
 }
 
+// shardArenaSize is the arena size of a skiplist shard of a memtable. Like arenaSize, it leaves
+// room for a whole batch on top of the size at which the memtable is full, as all the entries of
+// the batch could go to the same shard.
+func shardArenaSize(opt Options) int64 {
+	return shardSize(opt) + opt.maxBatchSize + opt.maxBatchCount*int64(skl.MaxNodeSize)
+}
+
 func (db *DB) NewSkiplist() *skl.Skiplist {
 	return skl.NewSkiplist(arenaSize(db.opt))
 }
@@ -1103,7 +1742,7 @@ func buildL0Table(ft flushTask, bopts table.Options) *table.Builder {
 	if ft.itr != nil {
 		iter = ft.itr
 	} else {
-		iter = ft.mt.sl.NewUniIterator(false)
+		iter = ft.mt.NewUniIterator(false)
 	}
 	defer iter.Close()
 
@@ -1131,8 +1770,26 @@ type flushTask struct {
 
 // handleFlushTask must be run serially.
 func (db *DB) handleFlushTask(ft flushTask) error {
+	timeStart := time.Now()
+	tbl, err := db.buildFlushTable(ft, db.lc.reserveFileID())
+	if err != nil || tbl == nil {
+		return err
+	}
+	// We own a ref on tbl.
+	err = db.lc.addLevel0Table(tbl) // This will incrRef
+	if err == nil {
+		db.flushDone(tbl, timeStart)
+	}
+	_ = tbl.DecrRef() // Releases our ref.
+	return err
+}
+
+// buildFlushTable builds the L0 table with the given file ID from the flush task. It returns a nil
+// table if there is nothing to flush.
+func (db *DB) buildFlushTable(ft flushTask, fileID uint64) (*table.Table, error) {
 	// ft.mt could be nil with ft.itr being the valid field.
-	bopts := buildTableOptions(db)
+	bopts := buildLevelTableOptions(db, 0)
+	bopts.TableID = fileID
 	builder := buildL0Table(ft, bopts)
 	defer builder.Close()
 
@@ -1141,10 +1798,9 @@ func (db *DB) handleFlushTask(ft flushTask) error {
 	// the items are skipped.
 	if builder.Empty() {
 		builder.Finish()
-		return nil
+		return nil, nil
 	}
 
-	fileID := db.lc.reserveFileID()
 	var tbl *table.Table
 	var err error
 	if db.opt.InMemory {
@@ -1154,21 +1810,113 @@ func (db *DB) handleFlushTask(ft flushTask) error {
 		tbl, err = table.CreateTable(table.NewFilename(fileID, db.opt.Dir), builder)
 	}
 	if err != nil {
-		return y.Wrap(err, "error while creating table")
+		return nil, y.Wrap(err, "error while creating table")
+	}
+	return tbl, nil
+}
+
+// flushDone reports the flush of the table, once it has been added to L0.
+func (db *DB) flushDone(tbl *table.Table, timeStart time.Time) {
+	info := FlushInfo{
+		TableID:  tbl.ID(),
+		Bytes:    tbl.Size(),
+		KeyCount: tbl.KeyCount(),
+		Duration: time.Since(timeStart),
+	}
+	db.opt.logw(DEBUG, "Flushed memtable", "table", info.TableID, "bytes", info.Bytes,
+		"keys", info.KeyCount, "duration", info.Duration.Round(time.Millisecond))
+	db.events.flushEnd(info)
+	y.FlushLatencyObserve(db.opt.MetricsEnabled, info.Duration)
+	db.recordSlow(SlowLogEntry{
+		Op:       SlowFlush,
+		Start:    timeStart,
+		Duration: info.Duration,
+		Bytes:    info.Bytes,
+	})
+}
+
+// flushJob is the flush of a shard of some memtables into an L0 table. The tables of the jobs are
+// built concurrently, but added to L0 in the order of the jobs, so that the newer versions of the
+// keys are always in the newer tables. The file IDs are reserved in that order too, as L0 is
+// sorted by file ID when the DB is opened. The memtables are only removed by the job of their last
+// shard.
+type flushJob struct {
+	ft     flushTask
+	mts    []*memTable
+	cbs    []func()
+	fileID uint64
+
+	start time.Time
+	tbl   *table.Table  // Set once done is closed. nil if there was nothing to flush.
+	done  chan struct{} // Closed once the table is built.
+}
+
+// buildFlushJob builds the table of the job. If there are errors, we'll retry indefinitely.
+func (db *DB) buildFlushJob(job *flushJob) {
+	defer close(job.done)
+	job.start = time.Now()
+	for {
+		tbl, err := db.buildFlushTable(job.ft, job.fileID)
+		db.health.record(SubsystemFlush, err)
+		if err == nil {
+			job.tbl = tbl
+			return
+		}
+		db.opt.logw(ERROR, "Flushing memtable failed. Retrying...", "error", err)
+		if !db.opt.InMemory {
+			// The table is rebuilt with the same file ID, to keep L0 in order. A failed attempt
+			// could have left the file behind.
+			_ = db.opt.FS.Remove(table.NewFilename(job.fileID, db.opt.Dir))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// installFlushJob adds the table of the job to L0, and removes the flushed memtables. It must be
+// called serially, in the order of the jobs.
+func (db *DB) installFlushJob(job *flushJob) {
+	<-job.done
+	if tbl := job.tbl; tbl != nil {
+		// We own a ref on tbl.
+		for {
+			err := db.lc.addLevel0Table(tbl) // This will incrRef
+			db.health.record(SubsystemFlush, err)
+			if err == nil {
+				break
+			}
+			db.opt.logw(ERROR, "Adding flushed table to L0 failed. Retrying...", "error", err)
+			time.Sleep(time.Second)
+		}
+		db.flushDone(tbl, job.start)
+		_ = tbl.DecrRef() // Releases our ref.
+	}
+
+	// Update s.imm. Need a lock.
+	db.lock.Lock()
+	// The jobs are installed in the order in which the memtables were pushed to flushChan, and
+	// the memtables are pushed in the order of db.imm, because we acquire a lock over DB when
+	// pushing to flushChan. So, the memtables of the job are at the head of db.imm.
+	// TODO: This logic is dirty AF. Any change and this could easily break.
+	for _, mt := range job.mts {
+		y.AssertTrue(mt == db.imm[0])
+		db.imm = db.imm[1:]
+		mt.DecrRef() // Return memory.
+	}
+	db.lock.Unlock()
+
+	for _, cb := range job.cbs {
+		if cb != nil {
+			cb()
+		}
 	}
-	// We own a ref on tbl.
-	err = db.lc.addLevel0Table(tbl) // This will incrRef
-	_ = tbl.DecrRef()               // Releases our ref.
-	return err
 }
 
-// flushMemtable must keep running until we send it an empty flushTask. If there
-// are errors during handling the flush task, we'll retry indefinitely.
+// flushMemtable must keep running until we send it an empty flushTask. Up to NumFlushers
+// tables are built concurrently.
 func (db *DB) flushMemtable(lc *z.Closer) error {
 	defer lc.Done()
 
 	var sz int64
-	var itrs []y.Iterator
 	var mts []*memTable
 	var cbs []func()
 	slurp := func() {
@@ -1178,12 +1926,10 @@ func (db *DB) flushMemtable(lc *z.Closer) error {
 				if more.mt == nil {
 					return
 				}
-				sl := more.mt.sl
-				itrs = append(itrs, sl.NewUniIterator(false))
 				mts = append(mts, more.mt)
 				cbs = append(cbs, more.cb)
 
-				sz += sl.MemSize()
+				sz += more.mt.MemSize()
 				if sz > db.opt.MemTableSize {
 					return
 				}
@@ -1193,62 +1939,81 @@ func (db *DB) flushMemtable(lc *z.Closer) error {
 		}
 	}
 
-	for ft := range db.flushChan {
+	// A slot is taken by every job, from before its memtables are picked, till it's installed.
+	slots := make(chan struct{}, db.opt.NumFlushers)
+	jobs := make(chan *flushJob, db.opt.NumFlushers)
+	installed := make(chan struct{})
+	go func() {
+		defer close(installed)
+		for job := range jobs {
+			db.installFlushJob(job)
+			<-slots
+		}
+	}()
+
+	for {
+		slots <- struct{}{}
+		ft, ok := <-db.flushChan
+		if !ok {
+			<-slots
+			break
+		}
 		if ft.mt == nil {
 			// We close db.flushChan now, instead of sending a nil ft.mt.
+			<-slots
 			continue
 		}
-		sz = ft.mt.sl.MemSize()
-		// Reset of itrs, mts etc. is being done below.
-		y.AssertTrue(len(itrs) == 0 && len(mts) == 0 && len(cbs) == 0)
-		itrs = append(itrs, ft.mt.sl.NewUniIterator(false))
+		sz = ft.mt.MemSize()
+		// Reset of mts etc. is being done below.
+		y.AssertTrue(len(mts) == 0 && len(cbs) == 0)
 		mts = append(mts, ft.mt)
 		cbs = append(cbs, ft.cb)
 
 		// Pick more memtables, so we can really fill up the L0 table.
 		slurp()
 
-		// db.opt.Infof("Picked %d memtables. Size: %d\n", len(itrs), sz)
-		ft.mt = nil
-		ft.itr = table.NewMergeIterator(itrs, false)
-		ft.cb = nil
-
-		for {
-			err := db.handleFlushTask(ft)
-			if err == nil {
-				// Update s.imm. Need a lock.
-				db.lock.Lock()
-				// This is a single-threaded operation. ft.mt corresponds to the head of
-				// db.imm list. Once we flush it, we advance db.imm. The next ft.mt
-				// which would arrive here would match db.imm[0], because we acquire a
-				// lock over DB when pushing to flushChan.
-				// TODO: This logic is dirty AF. Any change and this could easily break.
-				for _, mt := range mts {
-					y.AssertTrue(mt == db.imm[0])
-					db.imm = db.imm[1:]
-					mt.DecrRef() // Return memory.
-				}
-				db.lock.Unlock()
-
-				for _, cb := range cbs {
-					if cb != nil {
-						cb()
-					}
+		// Every shard is flushed into its own table, so that the shards are flushed concurrently.
+		// The versions of a key are all in the same shard, except in the skiplists handed over,
+		// which have a single shard. The lookups in L0 pick the latest version of all the tables
+		// anyway.
+		var shards int
+		for _, mt := range mts {
+			if len(mt.shards) > shards {
+				shards = len(mt.shards)
+			}
+		}
+		for i := 0; i < shards; i++ {
+			if i > 0 {
+				slots <- struct{}{}
+			}
+			var itrs []y.Iterator
+			for _, mt := range mts {
+				if itr := mt.shardIterator(i); itr != nil {
+					itrs = append(itrs, itr)
 				}
-				break
 			}
-			// Encountered error. Retry indefinitely.
-			db.opt.Errorf("Failure while flushing memtable to disk: %v. Retrying...\n", err)
-			time.Sleep(time.Second)
+			job := &flushJob{
+				ft:     flushTask{itr: table.NewMergeIterator(itrs, false)},
+				fileID: db.lc.reserveFileID(),
+				done:   make(chan struct{}),
+			}
+			if i == shards-1 {
+				job.mts, job.cbs = mts, cbs
+			}
+			jobs <- job
+			go db.buildFlushJob(job)
 		}
-		// Reset everything.
-		itrs, mts, cbs, sz = itrs[:0], mts[:0], cbs[:0], 0
+
+		// Reset everything. The last job owns the slices now.
+		mts, cbs, sz = nil, nil, 0
 	}
+	close(jobs)
+	<-installed
 	return nil
 }
 
-func exists(path string) (bool, error) {
-	_, err := os.Stat(path)
+func exists(fs y.FS, path string) (bool, error) {
+	_, err := fs.Stat(path)
 	if err == nil {
 		return true, nil
 	}
@@ -1270,23 +2035,26 @@ func (db *DB) calculateSize() {
 		return v
 	}
 
-	totalSize := func(dir string) (int64, int64) {
+	var totalSize func(dir string) (int64, int64)
+	totalSize = func(dir string) (int64, int64) {
 		var lsmSize, vlogSize int64
-		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
+		infos, err := db.opt.FS.ReadDir(dir)
+		if err != nil {
+			db.opt.Debugf("Got error while calculating total size of directory: %s", dir)
+		}
+		for _, info := range infos {
+			if info.IsDir() {
+				lsm, vlog := totalSize(filepath.Join(dir, info.Name()))
+				lsmSize += lsm
+				vlogSize += vlog
+				continue
 			}
-			ext := filepath.Ext(path)
-			switch ext {
+			switch filepath.Ext(info.Name()) {
 			case ".sst":
 				lsmSize += info.Size()
 			case ".vlog":
 				vlogSize += info.Size()
 			}
-			return nil
-		})
-		if err != nil {
-			db.opt.Debugf("Got error while calculating total size of directory: %s", dir)
 		}
 		return lsmSize, vlogSize
 	}
@@ -1297,6 +2065,10 @@ func (db *DB) calculateSize() {
 	if db.opt.ValueDir != db.opt.Dir {
 		_, vlogSize = totalSize(db.opt.ValueDir)
 	}
+	if db.opt.LargeValueDir != "" {
+		_, largeSize := totalSize(db.opt.LargeValueDir)
+		vlogSize += largeSize
+	}
 	y.VlogSizeSet(db.opt.MetricsEnabled, db.opt.ValueDir, newInt(vlogSize))
 }
 
@@ -1330,7 +2102,9 @@ func (db *DB) updateSize(lc *z.Closer) {
 // can discard at least discardRatio space of that file, it would be rewritten.
 //
 // If a call to RunValueLogGC results in no rewrites, then an ErrNoRewrite is
-// thrown indicating that the call resulted in no file rewrites.
+// thrown indicating that the call resulted in no file rewrites. Otherwise, the
+// returned ValueLogGCResult describes the files rewritten and the space
+// reclaimed.
 //
 // We recommend setting discardRatio to 0.5, thus indicating that a file be
 // rewritten if half the space can be discarded.  This results in a lifetime
@@ -1346,16 +2120,55 @@ func (db *DB) updateSize(lc *z.Closer) {
 //
 // Note: Every time GC is run, it would produce a spike of activity on the LSM
 // tree.
-func (db *DB) RunValueLogGC(discardRatio float64) error {
+func (db *DB) RunValueLogGC(discardRatio float64) (ValueLogGCResult, error) {
+	return db.RunValueLogGCContext(context.Background(), discardRatio)
+}
+
+// RunValueLogGCContext is like RunValueLogGC, but stops once ctx is done, returning ctx.Err().
+// The live entries of the file being rewritten which were moved by then stay in the newer files,
+// and the file is kept, so that it can be rewritten by a later GC.
+func (db *DB) RunValueLogGCContext(ctx context.Context, discardRatio float64) (
+	ValueLogGCResult, error) {
 	if db.opt.InMemory {
-		return ErrGCInMemoryMode
+		return ValueLogGCResult{}, ErrGCInMemoryMode
 	}
 	if discardRatio >= 1.0 || discardRatio <= 0.0 {
-		return ErrInvalidRequest
+		return ValueLogGCResult{}, ErrInvalidRequest
 	}
 
 	// Pick a log file and run GC
-	return db.vlog.runGC(discardRatio)
+	res, err := db.vlog.runGC(ctx, discardRatio)
+	if err == ErrNoRewrite && db.vlog.large != nil {
+		res, err = db.vlog.large.runGC(ctx, discardRatio)
+	}
+	db.events.valueLogGC(ValueLogGCInfo{ValueLogGCResult: res, Err: err})
+	db.health.Lock()
+	db.health.lastGC = time.Now()
+	db.health.Unlock()
+	// A canceled GC doesn't tell whether the value log is healthy.
+	canceled := err != nil && err == ctx.Err()
+	if err == ErrNoRewrite {
+		db.health.record(SubsystemValueLogGC, nil)
+	} else if err != ErrRejected && !canceled {
+		db.health.record(SubsystemValueLogGC, err)
+	}
+	return res, err
+}
+
+// ValueLogSpaceAmplification returns the ratio of the size of the value log files to the size of
+// the live data in them. It is estimated from the discard stats collected during compactions, and
+// can be used to check whether value log GC is keeping up with the writes. It returns 1 if the
+// value log is empty, or in InMemory mode.
+func (db *DB) ValueLogSpaceAmplification() float64 {
+	if db.opt.InMemory {
+		return 1
+	}
+	if db.vlog.large == nil {
+		return db.vlog.spaceAmplification()
+	}
+	total, discard := db.vlog.spaceUsage()
+	largeTotal, largeDiscard := db.vlog.large.spaceUsage()
+	return spaceAmp(total+largeTotal, discard+largeDiscard)
 }
 
 // Size returns the size of lsm and value log files in bytes. It can be used to decide how often to
@@ -1378,6 +2191,47 @@ type Sequence struct {
 	next      uint64
 	leased    uint64
 	bandwidth uint64
+	journal   bool
+}
+
+// SequenceOptions are the options of GetSequenceWithOptions.
+type SequenceOptions struct {
+	// Bandwidth sets the size of the lease, determining how many Next() requests can be served
+	// from memory.
+	Bandwidth uint64
+	// Journal makes the sequence write the next value to its key on each Next, along with the
+	// lease. The unused leased values are then released when the DB is closed, and they are
+	// reused by GetSequence after a crash, instead of being skipped. Each Next runs a transaction,
+	// so this suits the sequences whose values are taken rarely, with a small bandwidth.
+	Journal bool
+}
+
+// The value of a sequence key is the end of its lease, followed by the next value of the sequence
+// if it is journaled.
+func encodeSequence(leased, next uint64, journal bool) []byte {
+	if !journal {
+		return y.U64ToBytes(leased)
+	}
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, leased)
+	binary.BigEndian.PutUint64(buf[8:], next)
+	return buf
+}
+
+// readSequence returns the end of the lease stored in the item, and the next value of the sequence
+// if it is journaled.
+func readSequence(item *Item) (leased, next uint64, journaled bool, err error) {
+	err = item.Value(func(v []byte) error {
+		if len(v) < 8 {
+			return errors.Errorf("Invalid value of sequence key %q", item.Key())
+		}
+		leased = binary.BigEndian.Uint64(v)
+		if len(v) >= 16 {
+			next, journaled = binary.BigEndian.Uint64(v[8:]), true
+		}
+		return nil
+	})
+	return leased, next, journaled, err
 }
 
 // Next would return the next integer in the sequence, updating the lease by running a transaction
@@ -1392,9 +2246,66 @@ func (seq *Sequence) Next() (uint64, error) {
 	}
 	val := seq.next
 	seq.next++
+	if seq.journal {
+		if err := seq.writeJournal(); err != nil {
+			// The value is skipped, as it might have been journaled.
+			return 0, err
+		}
+	}
 	return val, nil
 }
 
+// writeJournal writes the next value of the sequence to its key, if its lease is still the last
+// one.
+func (seq *Sequence) writeJournal() error {
+	return seq.db.RunTxnWithRetry(context.Background(), DefaultTxnRetryOptions,
+		func(txn *Txn) error {
+			item, err := txn.Get(seq.key)
+			if err != nil {
+				return err
+			}
+			leased, _, _, err := readSequence(item)
+			if err != nil || leased != seq.leased {
+				// Another lease was taken since, so the values of this one can't be released.
+				return err
+			}
+			return txn.SetEntry(NewEntry(seq.key, encodeSequence(seq.leased, seq.next, true)))
+		})
+}
+
+// Peek returns the integer the next call to Next would return, without taking it. If the lease is
+// used up, it reads the value the next lease would start from.
+func (seq *Sequence) Peek() (uint64, error) {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	if seq.next < seq.leased {
+		return seq.next, nil
+	}
+	var next uint64
+	err := seq.db.View(func(txn *Txn) error {
+		var err error
+		next, err = seq.leaseStart(txn)
+		return err
+	})
+	return next, err
+}
+
+// SetNext makes the sequence return v on the next call to Next, dropping its lease. If v is lower
+// than the values already taken, they will be returned again. The leases of the other sequences
+// of the same key aren't dropped, so they keep returning their leased values.
+func (seq *Sequence) SetNext(v uint64) error {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	err := seq.db.Update(func(txn *Txn) error {
+		return txn.SetEntry(NewEntry(seq.key, encodeSequence(v, v, seq.journal)))
+	})
+	if err != nil {
+		return err
+	}
+	seq.next, seq.leased = v, v
+	return nil
+}
+
 // Release the leased sequence to avoid wasted integers. This should be done right
 // before closing the associated DB. However it is valid to use the sequence after
 // it was released, causing a new lease with full bandwidth.
@@ -1406,19 +2317,12 @@ func (seq *Sequence) Release() error {
 		if err != nil {
 			return err
 		}
-
-		var num uint64
-		if err := item.Value(func(v []byte) error {
-			num = binary.BigEndian.Uint64(v)
-			return nil
-		}); err != nil {
+		num, _, _, err := readSequence(item)
+		if err != nil {
 			return err
 		}
-
 		if num == seq.leased {
-			var buf [8]byte
-			binary.BigEndian.PutUint64(buf[:], seq.next)
-			return txn.SetEntry(NewEntry(seq.key, buf[:]))
+			return txn.SetEntry(NewEntry(seq.key, encodeSequence(seq.next, 0, false)))
 		}
 
 		return nil
@@ -1430,29 +2334,38 @@ func (seq *Sequence) Release() error {
 	return nil
 }
 
+// leaseStart returns the value the next lease of the sequence starts from.
+func (seq *Sequence) leaseStart(txn *Txn) (uint64, error) {
+	item, err := txn.Get(seq.key)
+	switch {
+	case err == ErrKeyNotFound:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	leased, next, journaled, err := readSequence(item)
+	if err != nil {
+		return 0, err
+	}
+	if journaled && !seq.db.sequenceInUse(seq) {
+		// The process which took the lease stopped without releasing it, so its unused values
+		// can be taken again.
+		return next, nil
+	}
+	return leased, nil
+}
+
 func (seq *Sequence) updateLease() error {
 	return seq.db.Update(func(txn *Txn) error {
-		item, err := txn.Get(seq.key)
-		switch {
-		case err == ErrKeyNotFound:
-			seq.next = 0
-		case err != nil:
+		next, err := seq.leaseStart(txn)
+		if err != nil {
 			return err
-		default:
-			var num uint64
-			if err := item.Value(func(v []byte) error {
-				num = binary.BigEndian.Uint64(v)
-				return nil
-			}); err != nil {
-				return err
-			}
-			seq.next = num
 		}
+		seq.next = next
 
 		lease := seq.next + seq.bandwidth
-		var buf [8]byte
-		binary.BigEndian.PutUint64(buf[:], lease)
-		if err = txn.SetEntry(NewEntry(seq.key, buf[:])); err != nil {
+		if err = txn.SetEntry(NewEntry(seq.key,
+			encodeSequence(lease, seq.next, seq.journal))); err != nil {
 			return err
 		}
 		seq.leased = lease
@@ -1467,6 +2380,11 @@ func (seq *Sequence) updateLease() error {
 //
 // GetSequence is not supported on ManagedDB. Calling this would result in a panic.
 func (db *DB) GetSequence(key []byte, bandwidth uint64) (*Sequence, error) {
+	return db.GetSequenceWithOptions(key, SequenceOptions{Bandwidth: bandwidth})
+}
+
+// GetSequenceWithOptions is like GetSequence, but it takes the options of the sequence.
+func (db *DB) GetSequenceWithOptions(key []byte, opt SequenceOptions) (*Sequence, error) {
 	if db.opt.managedTxns {
 		panic("Cannot use GetSequence with managedDB=true.")
 	}
@@ -1474,7 +2392,7 @@ func (db *DB) GetSequence(key []byte, bandwidth uint64) (*Sequence, error) {
 	switch {
 	case len(key) == 0:
 		return nil, ErrEmptyKey
-	case bandwidth == 0:
+	case opt.Bandwidth == 0:
 		return nil, ErrZeroBandwidth
 	}
 	seq := &Sequence{
@@ -1482,10 +2400,45 @@ func (db *DB) GetSequence(key []byte, bandwidth uint64) (*Sequence, error) {
 		key:       key,
 		next:      0,
 		leased:    0,
-		bandwidth: bandwidth,
+		bandwidth: opt.Bandwidth,
+		journal:   opt.Journal,
+	}
+	if err := seq.updateLease(); err != nil {
+		return seq, err
+	}
+	if seq.journal {
+		db.sequencesLock.Lock()
+		db.sequences = append(db.sequences, seq)
+		db.sequencesLock.Unlock()
+	}
+	return seq, nil
+}
+
+// sequenceInUse returns true if a journaled sequence of the same key as seq, other than seq, was
+// opened since the DB was.
+func (db *DB) sequenceInUse(seq *Sequence) bool {
+	db.sequencesLock.Lock()
+	defer db.sequencesLock.Unlock()
+	for _, s := range db.sequences {
+		if s != seq && bytes.Equal(s.key, seq.key) {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseSequences releases the leases of the journaled sequences.
+func (db *DB) releaseSequences() error {
+	db.sequencesLock.Lock()
+	sequences := db.sequences
+	db.sequences = nil
+	db.sequencesLock.Unlock()
+	for _, seq := range sequences {
+		if err := seq.Release(); err != nil {
+			return y.Wrapf(err, "while releasing sequence %q", seq.key)
+		}
 	}
-	err := seq.updateLease()
-	return seq, err
+	return nil
 }
 
 // Tables gets the TableInfo objects from the level controller. If withKeysCount
@@ -1553,8 +2506,8 @@ func (db *DB) Ranges(prefix []byte, numRanges int) []*keyRange {
 				return
 			}
 			count := 0
-			iter := mt.sl.NewIterator()
-			for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			iter := mt.NewUniIterator(false)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
 				if count%maxPerSplit == 0 {
 					// Add a split every maxPerSplit keys.
 					if bytes.HasPrefix(iter.Key(), prefix) {
@@ -1678,7 +2631,20 @@ func (db *DB) startMemoryFlush() {
 // stopped. Ideally, no writes are going on during Flatten. Otherwise, it would create competition
 // between flattening the tree and new tables being created at level zero.
 func (db *DB) Flatten(workers int) error {
+	return db.FlattenWithProgress(workers, nil)
+}
+
+// FlattenWithProgress is like Flatten, but calls progress, if not nil, after each compaction. The
+// remaining bytes it reports are the size of the levels above the last one holding tables.
+func (db *DB) FlattenWithProgress(workers int, progress func(CompactProgress)) error {
+	return db.FlattenContext(context.Background(), workers, progress)
+}
 
+// FlattenContext is like FlattenWithProgress, but stops once ctx is done, returning ctx.Err().
+// The compactions which are running by then are completed first, so the tree is left consistent,
+// only less flat.
+func (db *DB) FlattenContext(ctx context.Context, workers int,
+	progress func(CompactProgress)) error {
 	db.stopCompactions()
 	defer db.startCompactions()
 
@@ -1714,8 +2680,56 @@ func (db *DB) Flatten(workers int) error {
 		return humanize.IBytes(uint64(sz))
 	}
 
+	// remainingBytes is the size of the levels above the last one holding tables.
+	remainingBytes := func() int64 {
+		var sizes []int64
+		for _, sz := range db.lc.levelSizes() {
+			if sz > 0 {
+				sizes = append(sizes, sz)
+			}
+		}
+		var remaining int64
+		for i := 0; i < len(sizes)-1; i++ {
+			remaining += sizes[i]
+		}
+		return remaining
+	}
+	var done int64
+	start := time.Now()
+	compactLevel := func(cp compactionPriority) error {
+		before := db.lc.levels[cp.level].getTotalSize()
+		outputLevel := cp.level + 1
+		if cp.level == 0 {
+			outputLevel = db.lc.levelTargets().baseLevel
+		}
+		if err := compactAway(cp); err != nil {
+			return err
+		}
+		if progress == nil {
+			return nil
+		}
+		if moved := before - db.lc.levels[cp.level].getTotalSize(); moved > 0 {
+			done += moved
+		}
+		remaining := remainingBytes()
+		elapsed := time.Since(start)
+		progress(CompactProgress{
+			Level:          cp.level,
+			OutputLevel:    outputLevel,
+			LevelSizes:     db.lc.levelSizes(),
+			DoneBytes:      done,
+			RemainingBytes: remaining,
+			Elapsed:        elapsed,
+			ETA:            compactETA(elapsed, done, remaining),
+		})
+		return nil
+	}
+
 	t := db.lc.levelTargets()
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		db.opt.Infof("\n")
 		var levels []int
 		for i, l := range db.lc.levels {
@@ -1732,22 +2746,25 @@ func (db *DB) Flatten(workers int) error {
 				db.opt.Infof("All tables consolidated into one level. Flattening done.\n")
 				return nil
 			}
-			if err := compactAway(prios[0]); err != nil {
+			if err := compactLevel(prios[0]); err != nil {
 				return err
 			}
 			continue
 		}
 		// Create an artificial compaction priority, to ensure that we compact the level.
 		cp := compactionPriority{level: levels[0], score: 1.71}
-		if err := compactAway(cp); err != nil {
+		if err := compactLevel(cp); err != nil {
 			return err
 		}
 	}
 }
 
 func (db *DB) blockWrite() error {
-	// Stop accepting new writes.
-	if !atomic.CompareAndSwapInt32(&db.blockWrites, 0, 1) {
+	// Stop accepting new writes. Take chunkLock so we don't block a chunked txn halfway.
+	db.chunkLock.Lock()
+	blocked := atomic.CompareAndSwapInt32(&db.blockWrites, 0, 1)
+	db.chunkLock.Unlock()
+	if !blocked {
 		return ErrBlockedWrites
 	}
 
@@ -1866,8 +2883,11 @@ func (db *DB) dropAll() (func(), error) {
 	db.lc.nextFileID = 1
 	db.opt.Infof("Deleted %d value log files. DropAll done.\n", num)
 	db.blockCache.Clear()
+	db.pinnedBlockCache.Clear()
+	db.compressedBlockCache.Clear()
 	db.indexCache.Clear()
-	db.threshold.Clear(db.opt)
+	db.filterCache.Clear()
+	db.threshold.Clear()
 	return resume, nil
 }
 
@@ -1878,8 +2898,12 @@ func (db *DB) dropAll() (func(), error) {
 // - Stream the given prefixes at a given ts.
 // - Write them to skiplist at the specified ts and handover that skiplist to DB.
 func (db *DB) DropPrefixNonBlocking(prefixes ...[]byte) error {
+	return db.dropPrefixNonBlocking(context.Background(), prefixes...)
+}
+
+func (db *DB) dropPrefixNonBlocking(ctx context.Context, prefixes ...[]byte) error {
 	if db.opt.ReadOnly {
-		return errors.New("Attempting to drop data in read-only mode.")
+		return errorf(CodeReadOnly, "Attempting to drop data in read-only mode.")
 	}
 
 	if len(prefixes) == 0 {
@@ -1959,7 +2983,7 @@ func (db *DB) DropPrefixNonBlocking(prefixes ...[]byte) error {
 			}
 			return handover(false)
 		}
-		if err := stream.Orchestrate(context.Background()); err != nil {
+		if err := stream.Orchestrate(ctx); err != nil {
 			return err
 		}
 		// Flush the remaining skiplists if any.
@@ -1968,7 +2992,13 @@ func (db *DB) DropPrefixNonBlocking(prefixes ...[]byte) error {
 
 	// Iterate over all the prefixes and logically drop them.
 	for _, prefix := range prefixes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := dropPrefix(prefix); err != nil {
+			if cerr := ctx.Err(); cerr != nil {
+				return cerr
+			}
 			return errors.Wrapf(err, "While dropping prefix: %#x", prefix)
 		}
 	}
@@ -1981,10 +3011,20 @@ func (db *DB) DropPrefixNonBlocking(prefixes ...[]byte) error {
 // the prefixes by blocking the writes or doing a logical drop.
 // See DropPrefixBlocking and DropPrefixNonBlocking for more information.
 func (db *DB) DropPrefix(prefixes ...[]byte) error {
+	return db.DropPrefixContext(context.Background(), prefixes...)
+}
+
+// DropPrefixContext is like DropPrefix, but stops once ctx is done, returning ctx.Err(). A
+// logical drop stops between the batches of delete markers, so some of the keys may have been
+// dropped by then. A blocking drop can only be stopped before it blocks the writes.
+func (db *DB) DropPrefixContext(ctx context.Context, prefixes ...[]byte) error {
 	if db.opt.AllowStopTheWorld {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		return db.DropPrefixBlocking(prefixes...)
 	}
-	return db.DropPrefixNonBlocking(prefixes...)
+	return db.dropPrefixNonBlocking(ctx, prefixes...)
 }
 
 // DropPrefix would drop all the keys with the provided prefix. It does this in the following way:
@@ -1999,6 +3039,14 @@ func (db *DB) DropPrefix(prefixes ...[]byte) error {
 //   - Compact rest of the levels, Li->Li, picking tables which have Kp.
 //   - Resume memtable flushes, compactions and writes.
 func (db *DB) DropPrefixBlocking(prefixes ...[]byte) error {
+	return db.dropPrefixBlocking(prefixes, false)
+}
+
+// dropPrefixBlocking drops the keys with the given prefixes, as DropPrefixBlocking. The prefixes
+// without any live key are skipped, unless they're shredded. Then, their deleted and expired keys
+// are removed from the tables too, and the value log is rotated, so that all the files holding
+// their values can be rewritten.
+func (db *DB) dropPrefixBlocking(prefixes [][]byte, shred bool) error {
 	if len(prefixes) == 0 {
 		return nil
 	}
@@ -2009,9 +3057,15 @@ func (db *DB) DropPrefixBlocking(prefixes ...[]byte) error {
 	}
 	defer f()
 
-	var filtered [][]byte
-	if filtered, err = db.filterPrefixesToDrop(prefixes); err != nil {
-		return err
+	filtered := prefixes
+	if !shred {
+		if filtered, err = db.filterPrefixesToDrop(prefixes); err != nil {
+			return err
+		}
+	} else if !db.opt.InMemory {
+		if err := db.vlog.rotate(); err != nil {
+			return err
+		}
 	}
 	// If there is no prefix for which the data already exist, do not do anything.
 	if len(filtered) == 0 {
@@ -2024,7 +3078,7 @@ func (db *DB) DropPrefixBlocking(prefixes ...[]byte) error {
 
 	db.imm = append(db.imm, db.mt)
 	for _, memtable := range db.imm {
-		if memtable.sl.Empty() {
+		if memtable.Empty() {
 			memtable.DecrRef()
 			continue
 		}
@@ -2133,12 +3187,30 @@ type KVList = pb.KVList
 // The given function will be called with a new KVList containing the modified keys and the
 // corresponding values.
 func (db *DB) Subscribe(ctx context.Context, cb func(kv *KVList) error, matches []pb.Match) error {
+	return db.subscribe(ctx, cb, matches, nil)
+}
+
+// SubscribeMatchers works like Subscribe, but the keys are selected by the given KeyMatchers
+// instead of prefixes. Use KeyRange, KeyRegexp and KeyGlob to build the matchers. A key is sent to
+// the callback if any of the matchers accepts it. Filtering is done by the publisher, so keys which
+// don't match are never sent to the subscriber. At least one matcher must be passed, otherwise
+// ErrInvalidRequest is returned.
+func (db *DB) SubscribeMatchers(ctx context.Context, cb func(kv *KVList) error,
+	matchers ...KeyMatcher) error {
+	if len(matchers) == 0 {
+		return ErrInvalidRequest
+	}
+	return db.subscribe(ctx, cb, nil, matchers)
+}
+
+func (db *DB) subscribe(ctx context.Context, cb func(kv *KVList) error, matches []pb.Match,
+	matchers []KeyMatcher) error {
 	if cb == nil {
 		return ErrNilCallback
 	}
 
 	c := z.NewCloser(1)
-	s := db.pub.newSubscriber(c, matches)
+	s := db.pub.newSubscriber(c, matches, matchers, false)
 	slurp := func(batch *pb.KVList) error {
 		for {
 			select {
@@ -2194,19 +3266,80 @@ func (db *DB) Subscribe(ctx context.Context, cb func(kv *KVList) error, matches
 
 // shouldEncrypt returns bool, which tells whether to encrypt or not.
 func (db *DB) shouldEncrypt() bool {
-	return len(db.opt.EncryptionKey) > 0
+	return db.opt.encrypted()
+}
+
+// RotateMasterKey rotates the master key of Options.KeyProvider, and re-encrypts the key registry
+// with its new version. The data keys, and the data they encrypt, are left unchanged.
+func (db *DB) RotateMasterKey() error {
+	if db.opt.KeyProvider == nil {
+		return errorf(CodeInvalidArgument, "Cannot rotate the master key without a KeyProvider")
+	}
+	if db.opt.ReadOnly {
+		return errorf(CodeReadOnly, "Attempting to rotate the master key in read-only mode.")
+	}
+	if _, err := db.opt.KeyProvider.Rotate(); err != nil {
+		return y.Wrapf(err, "while rotating the master key")
+	}
+	return db.registry.refreshMasterKey()
+}
+
+// tableDir returns the directory the table files are written to, which is TempSpillDir in
+// InMemory mode.
+func (db *DB) tableDir() string {
+	if db.opt.InMemory {
+		return db.opt.TempSpillDir
+	}
+	return db.opt.Dir
+}
+
+// openTempSpillDir creates and locks the TempSpillDir of opt, and removes the tables left there by
+// a DB which wasn't closed.
+func openTempSpillDir(opt Options) (*directoryLockGuard, error) {
+	if err := os.MkdirAll(opt.TempSpillDir, 0700); err != nil {
+		return nil, y.Wrapf(err, "while creating TempSpillDir %q", opt.TempSpillDir)
+	}
+	var guard *directoryLockGuard
+	if !opt.BypassLockGuard {
+		var err error
+		if guard, err = acquireDirectoryLock(opt.TempSpillDir, lockFile, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := removeTempTables(opt.TempSpillDir); err != nil {
+		if guard != nil {
+			_ = guard.release()
+		}
+		return nil, err
+	}
+	return guard, nil
+}
+
+// removeTempTables removes the tables spilled to dir, which are temporary, like the rest of an
+// InMemory DB.
+func removeTempTables(dir string) error {
+	for id := range getIDMap(y.OSFS, dir) {
+		if err := os.Remove(table.NewFilename(id, dir)); err != nil {
+			return y.Wrapf(err, "while removing spilled table %d", id)
+		}
+	}
+	return nil
 }
 
 func (db *DB) syncDir(dir string) error {
 	if db.opt.InMemory {
 		return nil
 	}
-	return syncDir(dir)
+	return db.opt.FS.SyncDir(dir)
 }
 
 func createDirs(opt Options) error {
-	for _, path := range []string{opt.Dir, opt.ValueDir} {
-		dirExists, err := exists(path)
+	paths := []string{opt.Dir, opt.ValueDir}
+	if opt.LargeValueDir != "" {
+		paths = append(paths, opt.LargeValueDir)
+	}
+	for _, path := range paths {
+		dirExists, err := exists(opt.FS, path)
 		if err != nil {
 			return y.Wrapf(err, "Invalid Dir: %q", path)
 		}
@@ -2215,7 +3348,7 @@ func createDirs(opt Options) error {
 				return errors.Errorf("Cannot find directory %q for read-only open", path)
 			}
 			// Try to create the directory
-			err = os.MkdirAll(path, 0700)
+			err = opt.FS.MkdirAll(path, 0700)
 			if err != nil {
 				return y.Wrapf(err, "Error Creating Dir: %q", path)
 			}
@@ -2257,9 +3390,127 @@ func (db *DB) StreamDB(outOptions Options) error {
 	return nil
 }
 
-// Opts returns a copy of the DB options.
+// Opts returns a copy of the DB options. The options changed with SetOptions have their current
+// values.
 func (db *DB) Opts() Options {
-	return db.opt
+	opt := db.opt
+	if db.lc != nil {
+		opt.NumCompactors = db.lc.getNumCompactors()
+		opt.CompactionRateLimit = atomic.LoadInt64(&db.lc.compactionLimiter.bytesPerSec)
+	}
+	if !opt.InMemory {
+		opt.ValueThreshold = atomic.LoadInt64(&db.threshold.optThreshold)
+	}
+	for i, c := range db.mutableCaches(&opt) {
+		if c.cache == nil {
+			continue
+		}
+		// The caches shrunk to stay within MemoryBudget keep the sizes set by the options.
+		if size, shrunk := db.mem.cacheSize(i); shrunk {
+			*c.size = size
+		} else {
+			*c.size = c.cache.MaxCost()
+		}
+	}
+	return opt
+}
+
+// mutableCache is a cache whose size can be changed with SetOptions.
+type mutableCache struct {
+	name  string
+	size  *int64 // The option which sets its size.
+	cache *ristretto.Cache
+}
+
+// mutableCaches returns the caches whose size can be changed with SetOptions, along with the
+// options of opt which set their sizes.
+func (db *DB) mutableCaches(opt *Options) []mutableCache {
+	return []mutableCache{
+		{"BlockCacheSize", &opt.BlockCacheSize, db.blockCache},
+		{"IndexCacheSize", &opt.IndexCacheSize, db.indexCache},
+		{"FilterCacheSize", &opt.FilterCacheSize, db.filterCache},
+		{"PinnedBlockCacheSize", &opt.PinnedBlockCacheSize, db.pinnedBlockCache},
+		{"CompressedBlockCacheSize", &opt.CompressedBlockCacheSize, db.compressedBlockCache},
+	}
+}
+
+// SetOptions changes the options which can be changed while the DB is open, without reopening
+// it: NumCompactors, CompactionRateLimit, ValueThreshold, and the sizes of the caches the DB was
+// opened with (BlockCacheSize, IndexCacheSize, FilterCacheSize, PinnedBlockCacheSize and
+// CompressedBlockCacheSize). The other options of opt are ignored, so opt is usually built from
+// the current options:
+//
+//	err := db.SetOptions(db.Opts().WithNumCompactors(8).WithCompactionRateLimit(64 << 20))
+//
+// All the options are validated before any of them is changed. A cache can't be added or removed:
+// only the size of a cache the DB was opened with can be changed. ValueThreshold can't be
+// changed in InMemory mode or when VLogPercentile is set, and NumCompactors can't be changed in
+// ReadOnly mode. When NumCompactors is lowered, the extra compactors stop once their current
+// compaction is done.
+func (db *DB) SetOptions(opt Options) error {
+	db.setOptionsLock.Lock()
+	defer db.setOptionsLock.Unlock()
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	cur := db.Opts()
+
+	if opt.NumCompactors != cur.NumCompactors {
+		switch {
+		case db.opt.ReadOnly:
+			return errorf(CodeReadOnly, "Cannot change NumCompactors in ReadOnly mode")
+		case opt.NumCompactors < 0:
+			return errorf(CodeInvalidArgument, "Invalid NumCompactors %d, cannot be negative",
+				opt.NumCompactors)
+		case opt.NumCompactors == 1:
+			return errorf(CodeInvalidArgument, "Cannot have 1 compactor. Need at least 2")
+		}
+	}
+	if opt.CompactionRateLimit < 0 {
+		return errorf(CodeInvalidArgument, "Invalid CompactionRateLimit %d, cannot be negative",
+			opt.CompactionRateLimit)
+	}
+	if opt.ValueThreshold != cur.ValueThreshold {
+		switch {
+		case db.opt.InMemory:
+			return errorf(CodeInvalidArgument, "Cannot change ValueThreshold in InMemory mode")
+		case db.opt.VLogPercentile > 0:
+			return errorf(CodeInvalidArgument, "Cannot change ValueThreshold when VLogPercentile is set")
+		case float64(opt.ValueThreshold) > db.opt.maxValueThreshold:
+			return errorf(CodeInvalidArgument, "Invalid ValueThreshold %d, must be less or equal to %d",
+				opt.ValueThreshold, int64(db.opt.maxValueThreshold))
+		}
+	}
+	caches := db.mutableCaches(&opt)
+	curCaches := db.mutableCaches(&cur)
+	for i, c := range caches {
+		if *c.size == *curCaches[i].size {
+			continue
+		}
+		if c.cache == nil {
+			return errorf(CodeInvalidArgument,
+				"Cannot change %s, the DB was opened without the cache", c.name)
+		}
+		if *c.size <= 0 {
+			return errorf(CodeInvalidArgument, "Invalid %s %d, must be positive", c.name, *c.size)
+		}
+	}
+
+	if opt.NumCompactors != cur.NumCompactors {
+		db.lc.setNumCompactors(opt.NumCompactors)
+	}
+	if opt.CompactionRateLimit != cur.CompactionRateLimit {
+		db.lc.compactionLimiter.setRate(opt.CompactionRateLimit)
+	}
+	if opt.ValueThreshold != cur.ValueThreshold {
+		db.threshold.set(opt.ValueThreshold)
+	}
+	for i, c := range caches {
+		if *c.size != *curCaches[i].size {
+			db.mem.setCacheSize(i, c.cache, *c.size)
+		}
+	}
+	return nil
 }
 
 type CacheType int
@@ -2267,9 +3518,13 @@ type CacheType int
 const (
 	BlockCache CacheType = iota
 	IndexCache
+	FilterCache
+	PinnedBlockCache
+	CompressedBlockCache
 )
 
-// CacheMaxCost updates the max cost of the given cache (either block or index cache).
+// CacheMaxCost updates the max cost of the given cache (either block, index, filter, pinned
+// block or compressed block cache).
 // The call will have an effect only if the DB was created with the cache. Otherwise it is
 // a no-op. If you pass a negative value, the function will return the current value
 // without updating it.
@@ -2284,8 +3539,14 @@ func (db *DB) CacheMaxCost(cache CacheType, maxCost int64) (int64, error) {
 			return db.blockCache.MaxCost(), nil
 		case IndexCache:
 			return db.indexCache.MaxCost(), nil
+		case FilterCache:
+			return db.filterCache.MaxCost(), nil
+		case PinnedBlockCache:
+			return db.pinnedBlockCache.MaxCost(), nil
+		case CompressedBlockCache:
+			return db.compressedBlockCache.MaxCost(), nil
 		default:
-			return 0, errors.Errorf("invalid cache type")
+			return 0, errorf(CodeInvalidArgument, "invalid cache type")
 		}
 	}
 
@@ -2296,8 +3557,17 @@ func (db *DB) CacheMaxCost(cache CacheType, maxCost int64) (int64, error) {
 	case IndexCache:
 		db.indexCache.UpdateMaxCost(maxCost)
 		return maxCost, nil
+	case FilterCache:
+		db.filterCache.UpdateMaxCost(maxCost)
+		return maxCost, nil
+	case PinnedBlockCache:
+		db.pinnedBlockCache.UpdateMaxCost(maxCost)
+		return maxCost, nil
+	case CompressedBlockCache:
+		db.compressedBlockCache.UpdateMaxCost(maxCost)
+		return maxCost, nil
 	default:
-		return 0, errors.Errorf("invalid cache type")
+		return 0, errorf(CodeInvalidArgument, "invalid cache type")
 	}
 }
 
@@ -286,7 +286,7 @@ func TestBigKeyValuePairs(t *testing.T) {
 		var loops int
 		var err error
 		for err == nil {
-			err = db.RunValueLogGC(0.5)
+			_, err = db.RunValueLogGC(0.5)
 			require.NotRegexp(t, regexp.MustCompile("truncate"), err)
 			loops++
 		}
@@ -610,7 +610,7 @@ func TestL0GCBug(t *testing.T) {
 	// one value log file is garbage collected.
 	success := 0
 	for i := 0; i < 10; i++ {
-		err := db1.RunValueLogGC(0.01)
+		_, err := db1.RunValueLogGC(0.01)
 		if err == nil {
 			success++
 		}
@@ -1150,3 +1150,25 @@ func TestDropPrefixNonBlockingNoError(t *testing.T) {
 	require.NoError(t, db.DropPrefixNonBlocking(prefixes...))
 	closer2.SignalAndWait()
 }
+
+func TestDropPrefixContext(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("aaa"), []byte("value"))
+		}))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.Equal(t, context.Canceled, db.DropPrefixContext(ctx, []byte("aa")))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("aaa"))
+			return err
+		}))
+
+		require.NoError(t, db.DropPrefixContext(context.Background(), []byte("aa")))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("aaa"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+	})
+}
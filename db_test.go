@@ -37,8 +37,10 @@ import (
 
 	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/table"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
 )
 
 // summary is produced when DB is closed. Currently it is used only for testing.
@@ -499,7 +501,7 @@ func BenchmarkDbGrowth(b *testing.B) {
 		require.NoError(b, txn.Commit())
 		require.NoError(b, db.Flatten(1))
 		for {
-			err = db.RunValueLogGC(discardRatio)
+			_, err = db.RunValueLogGC(discardRatio)
 			if err == ErrNoRewrite {
 				break
 			} else {
@@ -819,7 +821,7 @@ func TestLoad(t *testing.T) {
 		summary := kv.lc.getSummary()
 
 		// Check that files are garbage collected.
-		idMap := getIDMap(dir)
+		idMap := getIDMap(y.OSFS, dir)
 		for fileID := range idMap {
 			// Check that name is in summary.filenames.
 			require.True(t, summary.fileIDs[fileID], "%d", fileID)
@@ -1677,6 +1679,88 @@ func TestTestSequence2(t *testing.T) {
 	})
 }
 
+func TestSequencePeekSetNext(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		seq, err := db.GetSequence([]byte("key"), 2)
+		require.NoError(t, err)
+		for i := uint64(0); i < 5; i++ {
+			peek, err := seq.Peek()
+			require.NoError(t, err)
+			require.Equal(t, i, peek)
+			num, err := seq.Next()
+			require.NoError(t, err)
+			require.Equal(t, i, num)
+		}
+
+		require.NoError(t, seq.SetNext(100))
+		peek, err := seq.Peek()
+		require.NoError(t, err)
+		require.Equal(t, uint64(100), peek)
+		num, err := seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(100), num)
+
+		// A new sequence of the key starts after the lease.
+		seq2, err := db.GetSequence([]byte("key"), 2)
+		require.NoError(t, err)
+		num, err = seq2.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(102), num)
+	})
+}
+
+func TestSequenceJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	next := func(seq *Sequence, want uint64) {
+		num, err := seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, num)
+	}
+	seq, err := db.GetSequenceWithOptions(key, SequenceOptions{Bandwidth: 1000, Journal: true})
+	require.NoError(t, err)
+	next(seq, 0)
+	next(seq, 1)
+
+	// The lease is held by a journaled sequence, so the other sequences take another one.
+	seq2, err := db.GetSequence(key, 10)
+	require.NoError(t, err)
+	next(seq2, 1000)
+	require.NoError(t, seq2.Release())
+
+	seq, err = db.GetSequenceWithOptions(key, SequenceOptions{Bandwidth: 1000, Journal: true})
+	require.NoError(t, err)
+	next(seq, 1001)
+	next(seq, 1002)
+
+	// The leases aren't released, as if the process crashed. The journal of the last one is used
+	// by the next sequence.
+	db.sequences = nil
+	seq, err = db.GetSequence(key, 10)
+	require.NoError(t, err)
+	next(seq, 1003)
+	require.NoError(t, seq.Release())
+
+	// The journaled sequences are released on Close.
+	seq, err = db.GetSequenceWithOptions(key, SequenceOptions{Bandwidth: 1000, Journal: true})
+	require.NoError(t, err)
+	next(seq, 1004)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	seq, err = db.GetSequence(key, 10)
+	require.NoError(t, err)
+	next(seq, 1005)
+}
+
 func TestReadOnly(t *testing.T) {
 	t.Skipf("TODO: ReadOnly needs truncation, so this fails")
 
@@ -2075,6 +2159,181 @@ func TestForceFlushMemtable(t *testing.T) {
 		fmt.Sprintf("expected fid: %d, actual fid: %d", 2, db.nextMemFid))
 }
 
+func TestMemTableShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithMemTableSize(1 << 20).WithMemTableShards(4).
+		WithValueThreshold(1 << 10)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	write := func(from, to int, version string) {
+		batch := db.NewWriteBatch()
+		for i := from; i < to; i++ {
+			require.NoError(t, batch.Set(key(i), []byte(fmt.Sprintf("%s-%d", version, i))))
+		}
+		require.NoError(t, batch.Flush())
+	}
+	check := func(n int, version func(i int) string) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%s-%d", version(i), i), string(getItemValue(t, item)))
+			}
+			for _, reverse := range []bool{false, true} {
+				iopt := DefaultIteratorOptions
+				iopt.Reverse = reverse
+				it := txn.NewIterator(iopt)
+				var count int
+				var last []byte
+				for it.Rewind(); it.Valid(); it.Next() {
+					k := it.Item().KeyCopy(nil)
+					if last != nil {
+						require.Equal(t, reverse, bytes.Compare(k, last) < 0)
+					}
+					last = k
+					count++
+				}
+				it.Close()
+				require.Equal(t, n, count)
+			}
+			return nil
+		}))
+	}
+
+	write(0, 5000, "v1")
+	require.Len(t, db.mt.shards, 4)
+	for _, sl := range db.mt.shards {
+		require.False(t, sl.Empty())
+	}
+	check(5000, func(int) string { return "v1" })
+
+	// The newer versions of the keys shadow the older ones, across the memtables and the tables.
+	write(0, 20000, "v2")
+	write(0, 1000, "v3")
+	version := func(i int) string {
+		if i < 1000 {
+			return "v3"
+		}
+		return "v2"
+	}
+	check(20000, version)
+	require.NotEmpty(t, db.Tables())
+	require.NoError(t, db.Close())
+
+	// The WAL is replayed into a different number of shards.
+	db, err = Open(opt.WithMemTableShards(2))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(20000, version)
+
+	// A chunked transaction must fit in one shard.
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	require.NoError(t, txn.EnableAutoChunking())
+	var txnErr error
+	for i := 0; txnErr == nil && i < 10000; i++ {
+		txnErr = txn.Set(key(i), make([]byte, 100))
+	}
+	require.Equal(t, ErrTxnTooBig, txnErr)
+	require.Less(t, txn.memtableSize(txn.count, txn.size), shardSize(db.opt))
+}
+
+func TestMemTableShardsMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	mmapDir := filepath.Join(dir, "arenas")
+	opt := getTestOptions(dir).WithMemTableSize(1 << 20).WithMemTableShards(4).
+		WithMemTableMmapDir(mmapDir).WithValueThreshold(1 << 10).WithNumLevelZeroTables(50).
+		WithNumLevelZeroTablesStall(100)
+	// The arenas left by a crash are removed.
+	require.NoError(t, os.MkdirAll(mmapDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mmapDir, "00099-0.arena"), nil, 0600))
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	arenas := func() []string {
+		paths, err := filepath.Glob(filepath.Join(mmapDir, "*.arena"))
+		require.NoError(t, err)
+		return paths
+	}
+	require.Len(t, arenas(), 4)
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// Closing the DB flushes the memtable, and deletes its arenas.
+	require.NoError(t, db.Close())
+	require.Empty(t, arenas())
+
+	// Every shard of the memtable was flushed into its own table.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Len(t, db.Tables(), 4)
+	var keys uint32
+	for _, ti := range db.Tables() {
+		require.Equal(t, 0, ti.Level)
+		keys += ti.KeyCount
+	}
+	require.Equal(t, uint32(100), keys)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("key042"))
+		return err
+	}))
+}
+
+func TestConcurrentFlushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	// Without compactions, all the flushed tables stay in L0, whose order decides which versions
+	// of the keys are the latest ones.
+	opt := getTestOptions(dir).WithMemTableSize(1 << 20).WithValueThreshold(1 << 10).
+		WithNumFlushers(4).WithNumCompactors(0).WithNumLevelZeroTablesStall(1000)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	n, rounds := 2000, 20
+	for r := 0; r < rounds; r++ {
+		batch := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			val := append([]byte(fmt.Sprintf("%04d-", r)), bytes.Repeat([]byte("x"), 200)...)
+			require.NoError(t, batch.Set(key(i), val))
+		}
+		require.NoError(t, batch.Flush())
+	}
+	check := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%04d", rounds-1), string(getItemValue(t, item)[:4]))
+			}
+			return nil
+		}))
+	}
+	check()
+	require.NoError(t, db.Close())
+
+	// L0 is sorted by file ID on open, which must match the order of the flushes.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Greater(t, len(db.lc.levels[0].tables), 4)
+	check()
+}
+
 func TestVerifyChecksum(t *testing.T) {
 	testVerfiyCheckSum := func(t *testing.T, opt Options) {
 		path, err := ioutil.TempDir("", "badger-test")
@@ -2127,6 +2386,74 @@ func TestVerifyChecksum(t *testing.T) {
 	})
 }
 
+func TestEncryptionMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithEncryptionKey([]byte("badgerkey16bytes")).
+		WithBlockCacheSize(10 << 20).WithIndexCacheSize(10 << 20).WithValueThreshold(64)
+	write := func(db *DB, from, to int) {
+		val := make([]byte, 128)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := from; i < to; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	check := func(db *DB, n int) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+				require.NoError(t, err)
+				require.Len(t, getItemValue(t, item), 128)
+			}
+			return nil
+		}))
+	}
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	write(db, 0, 500)
+	require.NoError(t, db.Close())
+
+	// The DB is switched to AES-GCM. The new value log files and the tables written by the
+	// compactions use it, while the older ones are still read with AES-CTR.
+	opt = opt.WithEncryptionMode(options.AESGCM)
+	db, err = Open(opt)
+	require.NoError(t, err)
+	write(db, 500, 1000)
+	check(db, 1000)
+	db.vlog.filesLock.RLock()
+	fids := db.vlog.sortedFids()
+	require.False(t, db.vlog.filesMap[fids[0]].aead)
+	require.True(t, db.vlog.filesMap[fids[len(fids)-1]].aead)
+	db.vlog.filesLock.RUnlock()
+	require.NoError(t, db.Flatten(1))
+	_, err = db.CompactRange(CompactRangeOptions{})
+	require.NoError(t, err)
+	var n int
+	for _, l := range db.lc.levels {
+		for _, tbl := range l.tables {
+			require.Equal(t, options.AESGCM, tbl.EncryptionMode())
+			n++
+		}
+	}
+	require.NotZero(t, n)
+	require.NoError(t, db.Close())
+
+	// The mode of the tables is kept in the MANIFEST.
+	db, err = Open(opt.WithEncryptionMode(options.AESCTR))
+	require.NoError(t, err)
+	check(db, 1000)
+	require.NoError(t, db.Close())
+
+	_, err = Open(opt.WithEncryptionMode(3))
+	require.Error(t, err)
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	os.Exit(m.Run())
@@ -2165,6 +2492,74 @@ func TestWriteInemory(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestInMemorySpill(t *testing.T) {
+	test := func(t *testing.T, budget int64, spilled bool) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		// A table left by a DB which wasn't closed is removed.
+		require.NoError(t, ioutil.WriteFile(table.NewFilename(1, dir), []byte("stale"), 0600))
+
+		opt := DefaultOptions("").
+			WithInMemory(true).
+			WithTempSpillDir(dir).
+			WithMemoryBudget(budget).
+			WithMemTableSize(1 << 20).
+			WithValueThreshold(1 << 10).
+			WithNumCompactors(0).
+			WithLoggingLevel(WARNING)
+		db, err := Open(opt)
+		require.NoError(t, err)
+		require.Empty(t, getIDMap(y.OSFS, dir))
+
+		wb := db.NewWriteBatch()
+		for i := 0; i < 4000; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			require.NoError(t, wb.Set(key, []byte(fmt.Sprintf("%01000d", i))))
+		}
+		require.NoError(t, wb.Flush())
+		require.Eventually(t, func() bool {
+			db.lock.RLock()
+			defer db.lock.RUnlock()
+			return len(db.imm) == 0 && db.lc.levels[0].numTables() > 0
+		}, 10*time.Second, 10*time.Millisecond)
+		_, err = db.CompactRange(CompactRangeOptions{})
+		require.NoError(t, err)
+
+		// The memtables and level 0 stay in memory, the other levels spill past the budget.
+		var ids []uint64
+		for _, ti := range db.Tables() {
+			if ti.Level > 0 {
+				ids = append(ids, ti.ID)
+			}
+		}
+		require.NotEmpty(t, ids)
+		onDisk := getIDMap(y.OSFS, dir)
+		if spilled {
+			require.Len(t, onDisk, len(ids))
+			for _, id := range ids {
+				require.Contains(t, onDisk, id)
+			}
+			require.Zero(t, db.lc.memSize()-db.lc.levels[0].getMemSize())
+		} else {
+			require.Empty(t, onDisk)
+		}
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 4000; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%01000d", i), string(getItemValue(t, item)))
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+		require.Empty(t, getIDMap(y.OSFS, dir))
+	}
+	t.Run("spill", func(t *testing.T) { test(t, 0, true) })
+	t.Run("in memory", func(t *testing.T) { test(t, 1<<30, false) })
+}
+
 func TestMinCacheSize(t *testing.T) {
 	opt := DefaultOptions("").
 		WithInMemory(true).
@@ -2185,7 +2580,8 @@ func TestUpdateMaxCost(t *testing.T) {
 
 	ops := getTestOptions(dir).
 		WithBlockCacheSize(1 << 20).
-		WithIndexCacheSize(2 << 20)
+		WithIndexCacheSize(2 << 20).
+		WithFilterCacheSize(1 << 20)
 	db, err := Open(ops)
 	require.NoError(t, err)
 
@@ -2206,6 +2602,58 @@ func TestUpdateMaxCost(t *testing.T) {
 	cost, err = db.CacheMaxCost(IndexCache, -1)
 	require.NoError(t, err)
 	require.Equal(t, int64(4<<20), cost)
+	_, err = db.CacheMaxCost(FilterCache, 2<<20)
+	require.NoError(t, err)
+	cost, err = db.CacheMaxCost(FilterCache, -1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2<<20), cost)
+	require.NotNil(t, db.FilterCacheMetrics())
+}
+
+func TestIOBackend(t *testing.T) {
+	backend := y.NewIOBackend()
+	defer backend.Close()
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithIOBackend(backend).WithValueThreshold(32)
+
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf("%064d", i))
+	}
+	db, err := Open(opt)
+	require.NoError(t, err)
+	n := 1000
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), val(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		iopt := DefaultIteratorOptions
+		iopt.PrefetchSize = 64
+		it := txn.NewIterator(iopt)
+		defer it.Close()
+		var i int
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, val(i), getItemValue(t, it.Item()))
+			i++
+		}
+		require.Equal(t, n, i)
+
+		item, err := txn.Get([]byte("key0500"))
+		require.NoError(t, err)
+		require.Equal(t, val(500), getItemValue(t, item))
+		return nil
+	}))
 }
 
 func TestOpenDBReadOnly(t *testing.T) {
@@ -2576,3 +3024,89 @@ func TestCompactL0OnClose(t *testing.T) {
 		}
 	})
 }
+
+func TestMemFS(t *testing.T) {
+	fs, err := y.NewMemFS()
+	if err != nil {
+		t.Skip(err)
+	}
+	opt := getTestOptions("/badger").WithFS(fs)
+	opt.ValueThreshold = 32
+	opt.ValueLogFileSize = 1 << 20
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	val := make([]byte, 1<<10)
+	for i := 0; i < 1000; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%04d", i)), val, 0)
+	}
+	require.NoError(t, db.Flatten(1))
+	require.NoError(t, db.Close())
+
+	_, err = os.Stat("/badger")
+	require.True(t, os.IsNotExist(err))
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 1000; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+			require.NoError(t, err)
+			got, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, val, got)
+		}
+		return nil
+	}))
+}
+
+func TestMaxWriteStall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	// Without compactors, level 0 fills up, and the memtables can't be flushed.
+	opt := getTestOptions(dir).
+		WithNumCompactors(0).
+		WithNumLevelZeroTables(1).
+		WithNumLevelZeroTablesStall(2).
+		WithNumMemtables(1).
+		WithMemTableSize(64 << 10).
+		WithValueThreshold(1 << 10).
+		WithMaxWriteStall(100 * time.Millisecond)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	val := make([]byte, 1<<10)
+	set := func(i int) error {
+		return db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("key%06d", i)), val)
+		})
+	}
+	var i int
+	for ; i < 10000; i++ {
+		if err = set(i); err != nil {
+			break
+		}
+	}
+	require.True(t, errors.Is(err, ErrStalled), "error: %v", err)
+	require.Equal(t, CodeStalled, ErrorCode(err))
+	var serr *StallError
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, StallL0Tables, serr.Reason)
+	require.Equal(t, 2, serr.L0Tables)
+	require.True(t, serr.Duration >= 100*time.Millisecond)
+
+	// The stall isn't over, so the next write fails right away.
+	start := time.Now()
+	require.True(t, errors.Is(set(i), ErrStalled))
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+
+	// The writes go through again once level 0 is compacted.
+	require.NoError(t, db.Flatten(1))
+	require.Eventually(t, func() bool { return set(i) == nil }, 5*time.Second, 10*time.Millisecond)
+
+	// Compact level 0 again, so that Close can flush the memtables.
+	require.NoError(t, db.Flatten(1))
+}
@@ -18,9 +18,7 @@
 
 package badger
 
-// OpenDir opens a directory in windows with write access for syncing.
 import (
-	"os"
 	"path/filepath"
 	"syscall"
 
@@ -37,29 +35,6 @@ const (
 	FILE_FLAG_DELETE_ON_CLOSE = 0x04000000
 )
 
-func openDir(path string) (*os.File, error) {
-	fd, err := openDirWin(path)
-	if err != nil {
-		return nil, err
-	}
-	return os.NewFile(uintptr(fd), path), nil
-}
-
-func openDirWin(path string) (fd syscall.Handle, err error) {
-	if len(path) == 0 {
-		return syscall.InvalidHandle, syscall.ERROR_FILE_NOT_FOUND
-	}
-	pathp, err := syscall.UTF16PtrFromString(path)
-	if err != nil {
-		return syscall.InvalidHandle, err
-	}
-	access := uint32(syscall.GENERIC_READ | syscall.GENERIC_WRITE)
-	sharemode := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE)
-	createmode := uint32(syscall.OPEN_EXISTING)
-	fl := uint32(syscall.FILE_FLAG_BACKUP_SEMANTICS)
-	return syscall.CreateFile(pathp, access, sharemode, nil, createmode, fl, 0)
-}
-
 // DirectoryLockGuard holds a lock on the directory.
 type directoryLockGuard struct {
 	h    syscall.Handle
@@ -104,7 +79,3 @@ func (g *directoryLockGuard) release() error {
 	g.path = ""
 	return syscall.CloseHandle(g.h)
 }
-
-// Windows doesn't support syncing directories to the file system. See
-// https://github.com/dgraph-io/badger/issues/699#issuecomment-504133587 for more details.
-func syncDir(dir string) error { return nil }
@@ -41,9 +41,26 @@ const discardFname string = "DISCARD"
 
 func InitDiscardStats(opt Options) (*discardStats, error) {
 	fname := filepath.Join(opt.ValueDir, discardFname)
+	if opt.FS == nil {
+		opt.FS = y.OSFS
+	}
 
-	// 1GB file can store 67M discard entries. Each entry is 16 bytes.
-	mf, err := z.OpenMmapFile(fname, os.O_CREATE|os.O_RDWR, 1<<20)
+	var mf *z.MmapFile
+	var err error
+	if opt.Secondary {
+		// The file is updated by the process which opened the DB read-write, so a copy is used.
+		data, rerr := y.ReadFile(opt.FS, fname)
+		if rerr != nil && !os.IsNotExist(rerr) {
+			return nil, y.Wrapf(rerr, "while reading file: %s\n", discardFname)
+		}
+		if len(data) < 1<<20 {
+			data = append(data, make([]byte, 1<<20-len(data))...)
+		}
+		mf = &z.MmapFile{Data: data}
+	} else {
+		// 1GB file can store 67M discard entries. Each entry is 16 bytes.
+		mf, err = y.OpenMmapFile(opt.FS, fname, os.O_CREATE|os.O_RDWR, 1<<20)
+	}
 	lf := &discardStats{
 		MmapFile: mf,
 		opt:      opt,
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// PrefixUsage is the disk usage of the keys with a prefix, as returned by DiskUsage.
+type PrefixUsage struct {
+	Prefix []byte
+	// Entries is the number of entries in the tables, counting every version of the keys.
+	Entries int64
+	// LevelBytes is the on-disk size of the entries in the tables of each level, and LSMBytes is
+	// its sum.
+	LevelBytes []int64
+	LSMBytes   int64
+	// VlogBytes is the size of the values in the value log the entries point to. It is zero if
+	// DiskUsage is called without withValueLog.
+	VlogBytes int64
+}
+
+// DiskUsage returns the disk usage of the keys grouped by prefixOf(key), sorted by prefix. Like
+// EstimateSize, it relies on the boundaries of the tables: a table whose smallest and biggest keys
+// have the same prefix is counted for this prefix without being read. The other tables are read,
+// and their size shared between the prefixes of their entries. With withValueLog, all the tables
+// are read to sum the sizes of the values their entries point to in the value log, but the value
+// log itself isn't read.
+//
+// The entries still in the memtables aren't counted, nor are the values in the value log which no
+// table points to anymore, and which are reclaimed by the value log GC.
+func (db *DB) DiskUsage(prefixOf func(key []byte) []byte, withValueLog bool) []*PrefixUsage {
+	usage := make(map[string]*PrefixUsage)
+	get := func(prefix []byte) *PrefixUsage {
+		u, ok := usage[string(prefix)]
+		if !ok {
+			u = &PrefixUsage{
+				Prefix:     append([]byte{}, prefix...),
+				LevelBytes: make([]int64, db.opt.MaxLevels),
+			}
+			usage[string(prefix)] = u
+		}
+		return u
+	}
+
+	levels := db.lc.getTables(&IteratorOptions{})
+	defer func() {
+		for _, tables := range levels {
+			_ = decrRefs(tables)
+		}
+	}()
+	for level, tables := range levels {
+		for _, t := range tables {
+			first := prefixOf(y.ParseKey(t.Smallest()))
+			if !withValueLog && bytes.Equal(first, prefixOf(y.ParseKey(t.Biggest()))) {
+				u := get(first)
+				u.Entries += int64(t.KeyCount())
+				u.LevelBytes[level] += int64(t.OnDiskSize())
+				continue
+			}
+			tableDiskUsage(t, level, prefixOf, get, withValueLog)
+		}
+	}
+
+	result := make([]*PrefixUsage, 0, len(usage))
+	for _, u := range usage {
+		for _, sz := range u.LevelBytes {
+			u.LSMBytes += sz
+		}
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].Prefix, result[j].Prefix) < 0
+	})
+	return result
+}
+
+// tableDiskUsage reads the entries of a table, sharing its on-disk size between their prefixes in
+// proportion to their encoded sizes, and summing the sizes of their values in the value log if
+// withValueLog is set.
+func tableDiskUsage(t *table.Table, level int, prefixOf func(key []byte) []byte,
+	get func(prefix []byte) *PrefixUsage, withValueLog bool) {
+	sizes := make(map[*PrefixUsage]int64)
+	var total int64
+	var u *PrefixUsage
+	it := t.NewIterator(0)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		// The consecutive keys mostly share their prefix, which is looked up once.
+		if prefix := prefixOf(y.ParseKey(it.Key())); u == nil || !bytes.Equal(prefix, u.Prefix) {
+			u = get(prefix)
+		}
+		vs := it.Value()
+		sz := int64(len(it.Key())) + int64(vs.EncodedSize())
+		sizes[u] += sz
+		total += sz
+		u.Entries++
+		if withValueLog && vs.Meta&bitValuePointer > 0 {
+			var vp valuePointer
+			vp.Decode(vs.Value)
+			u.VlogBytes += int64(vp.Len)
+		}
+	}
+	if total == 0 {
+		return
+	}
+	var shared int64
+	for u, sz := range sizes {
+		share := int64(t.OnDiskSize()) * sz / total
+		u.LevelBytes[level] += share
+		shared += share
+	}
+	// Give the rounding leftover to the last prefix, so that the table is fully counted.
+	u.LevelBytes[level] += int64(t.OnDiskSize()) - shared
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(100)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	// The streams are written to distinct tables, each with the keys of a single prefix.
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	buf := z.NewBuffer(10<<20, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for i := 0; i < 100; i++ {
+		KVToBuffer(&pb.KV{Key: []byte(fmt.Sprintf("a/%03d", i)), Value: make([]byte, 10),
+			Version: 1, StreamId: 1}, buf)
+		KVToBuffer(&pb.KV{Key: []byte(fmt.Sprintf("b/%03d", i)), Value: make([]byte, 30),
+			Version: 1, StreamId: 2}, buf)
+	}
+	require.NoError(t, sw.Write(buf))
+	require.NoError(t, sw.Flush())
+
+	// These are flushed to a level 0 table holding both prefixes when the DB is closed. The values
+	// of c/ are stored in the value log.
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("a/new%d", i)), []byte("v")); err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(fmt.Sprintf("c/%d", i)), make([]byte, 200)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	prefixOf := func(key []byte) []byte {
+		if i := bytes.IndexByte(key, '/'); i >= 0 {
+			return key[:i+1]
+		}
+		return key
+	}
+	var lsm int64
+	for _, ti := range db.Tables() {
+		lsm += int64(ti.OnDiskSize)
+	}
+
+	for _, withValueLog := range []bool{false, true} {
+		usage := db.DiskUsage(prefixOf, withValueLog)
+		// The internal keys, like the one of the banned namespaces, have their own prefix.
+		var prefixes []string
+		var total int64
+		byPrefix := make(map[string]*PrefixUsage)
+		for _, u := range usage {
+			prefixes = append(prefixes, string(u.Prefix))
+			byPrefix[string(u.Prefix)] = u
+			total += u.LSMBytes
+			var sum int64
+			for _, sz := range u.LevelBytes {
+				sum += sz
+			}
+			require.Equal(t, u.LSMBytes, sum)
+		}
+		require.Subset(t, prefixes, []string{"a/", "b/", "c/"})
+		require.Equal(t, lsm, total)
+
+		a, b, c := byPrefix["a/"], byPrefix["b/"], byPrefix["c/"]
+		require.Equal(t, int64(110), a.Entries)
+		require.Equal(t, int64(100), b.Entries)
+		require.Equal(t, int64(10), c.Entries)
+		require.NotZero(t, a.LevelBytes[0])
+		require.Zero(t, b.LevelBytes[0])
+		require.Greater(t, b.LSMBytes, a.LSMBytes-a.LevelBytes[0])
+		if withValueLog {
+			// The value pointers have the size of the entries in the value log, with their headers,
+			// keys and checksums.
+			require.Greater(t, c.VlogBytes, int64(10*200))
+			require.Less(t, c.VlogBytes, int64(10*(200+64)))
+		} else {
+			require.Zero(t, c.VlogBytes)
+		}
+		require.Zero(t, a.VlogBytes)
+		require.Zero(t, b.VlogBytes)
+	}
+}
@@ -17,8 +17,11 @@
 package badger
 
 import (
+	"fmt"
 	"math"
 
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
 	"github.com/pkg/errors"
 )
 
@@ -30,97 +33,287 @@ const (
 var (
 	// ErrValueLogSize is returned when opt.ValueLogFileSize option is not within the valid
 	// range.
-	ErrValueLogSize = errors.New("Invalid ValueLogFileSize, must be in range [1MB, 2GB)")
+	ErrValueLogSize = newError(CodeInvalidArgument,
+		"Invalid ValueLogFileSize, must be in range [1MB, 2GB)")
 
 	// ErrKeyNotFound is returned when key isn't found on a txn.Get.
-	ErrKeyNotFound = errors.New("Key not found")
+	ErrKeyNotFound = newError(CodeKeyNotFound, "Key not found")
 
 	// ErrTxnTooBig is returned if too many writes are fit into a single transaction.
-	ErrTxnTooBig = errors.New("Txn is too big to fit into one request")
+	ErrTxnTooBig = newError(CodeTxnTooBig, "Txn is too big to fit into one request")
 
 	// ErrConflict is returned when a transaction conflicts with another transaction. This can
 	// happen if the read rows had been updated concurrently by another transaction.
-	ErrConflict = errors.New("Transaction Conflict. Please retry")
+	ErrConflict = newError(CodeConflict, "Transaction Conflict. Please retry")
 
 	// ErrReadOnlyTxn is returned if an update function is called on a read-only transaction.
-	ErrReadOnlyTxn = errors.New("No sets or deletes are allowed in a read-only transaction")
+	ErrReadOnlyTxn = newError(CodeReadOnly,
+		"No sets or deletes are allowed in a read-only transaction")
 
 	// ErrDiscardedTxn is returned if a previously discarded transaction is re-used.
-	ErrDiscardedTxn = errors.New("This transaction has been discarded. Create a new one")
+	ErrDiscardedTxn = newError(CodeInvalidArgument,
+		"This transaction has been discarded. Create a new one")
+
+	// ErrInvalidSavepoint is returned if a transaction is rolled back to a savepoint which doesn't
+	// belong to it, or which is no longer valid.
+	ErrInvalidSavepoint = newError(CodeInvalidArgument, "Invalid savepoint for this transaction")
+
+	// ErrDeadlock is returned by Txn.Lock if acquiring the locks would cause a deadlock.
+	ErrDeadlock = newError(CodeConflict, "Deadlock detected while acquiring key locks")
 
 	// ErrEmptyKey is returned if an empty key is passed on an update function.
-	ErrEmptyKey = errors.New("Key cannot be empty")
+	ErrEmptyKey = newError(CodeInvalidArgument, "Key cannot be empty")
 
 	// ErrInvalidKey is returned if the key has a special !badger! prefix,
 	// reserved for internal usage.
-	ErrInvalidKey = errors.New("Key is using a reserved !badger! prefix")
+	ErrInvalidKey = newError(CodeInvalidArgument, "Key is using a reserved !badger! prefix")
 
 	// ErrBannedKey is returned if the read/write key belongs to any banned namespace.
-	ErrBannedKey = errors.New("Key is using the banned prefix")
+	ErrBannedKey = newError(CodeInvalidArgument, "Key is using the banned prefix")
 
 	// ErrThresholdZero is returned if threshold is set to zero, and value log GC is called.
 	// In such a case, GC can't be run.
-	ErrThresholdZero = errors.New(
+	ErrThresholdZero = newError(CodeInvalidArgument,
 		"Value log GC can't run because threshold is set to zero")
 
 	// ErrNoRewrite is returned if a call for value log GC doesn't result in a log file rewrite.
-	ErrNoRewrite = errors.New(
+	ErrNoRewrite = newError(CodeRejected,
 		"Value log GC attempt didn't result in any cleanup")
 
 	// ErrRejected is returned if a value log GC is called either while another GC is running, or
 	// after DB::Close has been called.
-	ErrRejected = errors.New("Value log GC request rejected")
+	ErrRejected = newError(CodeRejected, "Value log GC request rejected")
 
 	// ErrInvalidRequest is returned if the user request is invalid.
-	ErrInvalidRequest = errors.New("Invalid request")
+	ErrInvalidRequest = newError(CodeInvalidArgument, "Invalid request")
 
 	// ErrManagedTxn is returned if the user tries to use an API which isn't
 	// allowed due to external management of transactions, when using ManagedDB.
-	ErrManagedTxn = errors.New(
+	ErrManagedTxn = newError(CodeUnsupported,
 		"Invalid API request. Not allowed to perform this action using ManagedDB")
 
 	// ErrNamespaceMode is returned if the user tries to use an API which is allowed only when
 	// NamespaceOffset is non-negative.
-	ErrNamespaceMode = errors.New(
+	ErrNamespaceMode = newError(CodeUnsupported,
 		"Invalid API request. Not allowed to perform this action when NamespaceMode is not set.")
 
 	// ErrInvalidDump if a data dump made previously cannot be loaded into the database.
-	ErrInvalidDump = errors.New("Data dump cannot be read")
+	ErrInvalidDump = newError(CodeCorruption, "Data dump cannot be read")
 
 	// ErrZeroBandwidth is returned if the user passes in zero bandwidth for sequence.
-	ErrZeroBandwidth = errors.New("Bandwidth must be greater than zero")
+	ErrZeroBandwidth = newError(CodeInvalidArgument, "Bandwidth must be greater than zero")
 
 	// ErrWindowsNotSupported is returned when opt.ReadOnly is used on Windows
-	ErrWindowsNotSupported = errors.New("Read-only mode is not supported on Windows")
+	ErrWindowsNotSupported = newError(CodeUnsupported, "Read-only mode is not supported on Windows")
 
 	// ErrPlan9NotSupported is returned when opt.ReadOnly is used on Plan 9
-	ErrPlan9NotSupported = errors.New("Read-only mode is not supported on Plan 9")
+	ErrPlan9NotSupported = newError(CodeUnsupported, "Read-only mode is not supported on Plan 9")
+
+	// ErrManifestMissing is returned by Open if the MANIFEST is missing, but the directory has
+	// tables. Without the MANIFEST, the tables would be deleted. Options.RecoverManifest rebuilds it
+	// from the tables instead.
+	ErrManifestMissing = newError(CodeCorruption,
+		"MANIFEST not found, but the directory has tables. Set Options.RecoverManifest to rebuild it")
 
 	// ErrTruncateNeeded is returned when the value log gets corrupt, and requires truncation of
 	// corrupt data to allow Badger to run properly.
-	ErrTruncateNeeded = errors.New(
+	ErrTruncateNeeded = newError(CodeCorruption,
 		"Log truncate required to run DB. This might result in data loss")
 
 	// ErrBlockedWrites is returned if the user called DropAll. During the process of dropping all
 	// data from Badger, we stop accepting new writes, by returning this error.
-	ErrBlockedWrites = errors.New("Writes are blocked, possibly due to DropAll or Close")
+	ErrBlockedWrites = newError(CodeStalled, "Writes are blocked, possibly due to DropAll or Close")
+
+	// ErrStalled is returned when the writes have been stalled for longer than
+	// Options.MaxWriteStall. The error returned is a StallError.
+	ErrStalled = newError(CodeStalled, "Writes stalled for longer than MaxWriteStall")
 
 	// ErrNilCallback is returned when subscriber's callback is nil.
-	ErrNilCallback = errors.New("Callback cannot be nil")
+	ErrNilCallback = newError(CodeInvalidArgument, "Callback cannot be nil")
 
 	// ErrEncryptionKeyMismatch is returned when the storage key is not
 	// matched with the key previously given.
-	ErrEncryptionKeyMismatch = errors.New("Encryption key mismatch")
+	ErrEncryptionKeyMismatch = newError(CodeEncryption, "Encryption key mismatch")
 
 	// ErrInvalidDataKeyID is returned if the datakey id is invalid.
-	ErrInvalidDataKeyID = errors.New("Invalid datakey id")
+	ErrInvalidDataKeyID = newError(CodeEncryption, "Invalid datakey id")
 
 	// ErrInvalidEncryptionKey is returned if length of encryption keys is invalid.
-	ErrInvalidEncryptionKey = errors.New("Encryption key's length should be" +
+	ErrInvalidEncryptionKey = newError(CodeInvalidArgument, "Encryption key's length should be"+
 		"either 16, 24, or 32 bytes")
 	// ErrGCInMemoryMode is returned when db.RunValueLogGC is called in in-memory mode.
-	ErrGCInMemoryMode = errors.New("Cannot run value log GC when DB is opened in InMemory mode")
+	ErrGCInMemoryMode = newError(CodeUnsupported,
+		"Cannot run value log GC when DB is opened in InMemory mode")
 
 	// ErrDBClosed is returned when a get operation is performed after closing the DB.
-	ErrDBClosed = errors.New("DB Closed")
+	ErrDBClosed = newError(CodeClosed, "DB Closed")
+
+	// ErrLogCompacted is returned by EntryLog if the requested entries were removed by Compact.
+	ErrLogCompacted = newError(CodeInvalidArgument, "Requested entries are compacted")
+
+	// ErrLogUnavailable is returned by EntryLog if the requested entries are after its last entry.
+	ErrLogUnavailable = newError(CodeInvalidArgument, "Requested entries are unavailable")
+
+	// ErrLogHole is returned by EntryLog.Append if the entries would leave a hole in the log.
+	ErrLogHole = newError(CodeInvalidArgument,
+		"Entries must be appended right after the last entry")
+
+	// ErrBackupKeyMismatch is returned when loading an encrypted backup without the key it was
+	// encrypted with.
+	ErrBackupKeyMismatch = newError(CodeEncryption, "Backup encryption key mismatch")
+
+	// ErrNotSecondary is returned by DB.CatchUp if the DB isn't opened in Secondary mode.
+	ErrNotSecondary = newError(CodeUnsupported, "DB is not opened in Secondary mode")
+
+	// ErrCorruptFile is returned, along with the path of the file, if corrupt data is found in a
+	// file, like by DB.Scrub.
+	ErrCorruptFile = newError(CodeCorruption, "Corrupt data")
+
+	// ErrExpiryIndexDisabled is returned by the APIs which need the expiry index, if
+	// Options.ExpiryScanInterval isn't set, or the DB is in managed mode.
+	ErrExpiryIndexDisabled = newError(CodeUnsupported, "Expiry index is not enabled")
+)
+
+// Code is the class of an Error, on which the applications can branch.
+type Code int
+
+const (
+	// CodeUnknown is the Code of the errors which aren't Errors, as returned by ErrorCode.
+	CodeUnknown Code = iota
+	// CodeInvalidArgument is the Code of the errors of the invalid options, keys and requests.
+	CodeInvalidArgument
+	// CodeKeyNotFound is the Code of ErrKeyNotFound.
+	CodeKeyNotFound
+	// CodeConflict is the Code of the errors of the transactions which conflict with others, and
+	// can be retried.
+	CodeConflict
+	// CodeTxnTooBig is the Code of ErrTxnTooBig.
+	CodeTxnTooBig
+	// CodeReadOnly is the Code of the errors of the writes to a read-only transaction or DB.
+	CodeReadOnly
+	// CodeStalled is the Code of the errors of the writes which are blocked, and can be retried
+	// later.
+	CodeStalled
+	// CodeRejected is the Code of the errors of the requests which weren't run, or had nothing to
+	// do, like a value log GC which rewrote no file.
+	CodeRejected
+	// CodeClosed is the Code of ErrDBClosed.
+	CodeClosed
+	// CodeUnsupported is the Code of the errors of the APIs which aren't supported in the mode
+	// the DB is opened in, or on the platform.
+	CodeUnsupported
+	// CodeEncryption is the Code of the errors of the mismatching encryption keys.
+	CodeEncryption
+	// CodeCorruption is the Code of the errors of the corrupt data. It is also the Code returned
+	// by ErrorCode for y.ErrChecksumMismatch.
+	CodeCorruption
 )
+
+func (c Code) String() string {
+	switch c {
+	case CodeInvalidArgument:
+		return "invalid argument"
+	case CodeKeyNotFound:
+		return "key not found"
+	case CodeConflict:
+		return "conflict"
+	case CodeTxnTooBig:
+		return "txn too big"
+	case CodeReadOnly:
+		return "read only"
+	case CodeStalled:
+		return "stalled"
+	case CodeRejected:
+		return "rejected"
+	case CodeClosed:
+		return "closed"
+	case CodeUnsupported:
+		return "unsupported"
+	case CodeEncryption:
+		return "encryption"
+	case CodeCorruption:
+		return "corruption"
+	}
+	return "unknown"
+}
+
+// Error is an error returned by badger, with the Code of its class. The exported Err variables
+// are Errors, which can still be compared with ==. An Error derived from one of them, to locate
+// the data in a file, satisfies errors.Is with it.
+type Error struct {
+	Code Code
+	// Path and Offset locate the data the error is about, if it is about a file. Path is empty
+	// otherwise, and Offset is -1 if the error isn't about a specific offset.
+	Path   string
+	Offset int64
+
+	msg  string
+	err  error  // The cause, if any.
+	base *Error // The Error it is derived from, if any.
+}
+
+func newError(code Code, msg string) error {
+	return &Error{Code: code, Offset: -1, msg: msg}
+}
+
+// errorf returns an Error with the given code, and a message formatted like fmt.Sprintf.
+func errorf(code Code, format string, args ...interface{}) error {
+	return &Error{Code: code, Offset: -1, msg: fmt.Sprintf(format, args...)}
+}
+
+// fileError returns an Error derived from base, which must be an Error, about the data at offset
+// in the file path, caused by err. err can be nil.
+func fileError(base error, path string, offset int64, err error) error {
+	b := base.(*Error)
+	return &Error{Code: b.Code, Path: path, Offset: offset, msg: b.msg, err: err, base: b}
+}
+
+// tableError returns err as an Error derived from ErrCorruptFile if it is a table.CorruptError, or
+// err otherwise.
+func tableError(err error) error {
+	var ce *table.CorruptError
+	if errors.As(err, &ce) {
+		return fileError(ErrCorruptFile, ce.Path, ce.Offset, ce.Err)
+	}
+	return err
+}
+
+func (e *Error) Error() string {
+	msg := e.msg
+	if e.Path != "" {
+		msg += " in file " + e.Path
+		if e.Offset >= 0 {
+			msg += fmt.Sprintf(" at offset %d", e.Offset)
+		}
+	}
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the cause of the error, if any.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is the Error e is derived from.
+func (e *Error) Is(target error) bool {
+	return e.base != nil && target == error(e.base)
+}
+
+// ErrorCode returns the Code of the first Error in the chain of err, or CodeCorruption if err is
+// a checksum mismatch or a table.CorruptError. It returns CodeUnknown if err is nil, or if it
+// isn't an Error.
+func ErrorCode(err error) Code {
+	var e *Error
+	switch {
+	case err == nil:
+		return CodeUnknown
+	case errors.As(err, &e):
+		return e.Code
+	case errors.Is(err, y.ErrChecksumMismatch), errors.As(err, new(*table.CorruptError)):
+		return CodeCorruption
+	}
+	return CodeUnknown
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCode(t *testing.T) {
+	require.Equal(t, CodeUnknown, ErrorCode(nil))
+	require.Equal(t, CodeUnknown, ErrorCode(errors.New("foo")))
+	require.Equal(t, CodeKeyNotFound, ErrorCode(ErrKeyNotFound))
+	require.Equal(t, CodeConflict, ErrorCode(y.Wrapf(ErrConflict, "while committing")))
+	require.Equal(t, CodeTxnTooBig, ErrorCode(errors.Wrap(ErrTxnTooBig, "while setting")))
+	require.Equal(t, CodeCorruption, ErrorCode(y.Wrap(y.ErrChecksumMismatch, "while reading")))
+	require.Equal(t, CodeCorruption, ErrorCode(&ValueChecksumError{Path: "000001.vlog"}))
+	require.Equal(t, "corruption", CodeCorruption.String())
+
+	// The Errors derived from the exported ones are still found by errors.Is.
+	cause := errors.New("end offset: 10 < size: 20")
+	err := y.Wrapf(fileError(ErrTruncateNeeded, "00001.mem", 10, cause), "while opening")
+	require.True(t, errors.Is(err, ErrTruncateNeeded))
+	require.False(t, errors.Is(err, ErrCorruptFile))
+	require.True(t, errors.Is(err, cause))
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, CodeCorruption, e.Code)
+	require.Equal(t, "00001.mem", e.Path)
+	require.Equal(t, int64(10), e.Offset)
+	require.Contains(t, err.Error(),
+		"required to run DB. This might result in data loss in file 00001.mem at offset 10: "+
+			"end offset: 10 < size: 20")
+}
+
+func TestErrorCodeManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	fp, err := os.OpenFile(filepath.Join(dir, ManifestFilename), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = fp.WriteAt([]byte{'X'}, 3)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	_, err = Open(getTestOptions(dir))
+	require.Equal(t, CodeCorruption, ErrorCode(err))
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, filepath.Join(dir, ManifestFilename), e.Path)
+}
+
+func TestErrorCodeTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key"), []byte("value"))
+	}))
+	require.NoError(t, db.Close())
+	matches, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	// The length of the checksum of the index, at the end of the table, is out of range.
+	fp, err := os.OpenFile(matches[0], os.O_RDWR, 0)
+	require.NoError(t, err)
+	fi, err := fp.Stat()
+	require.NoError(t, err)
+	_, err = fp.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, fi.Size()-4)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	_, err = Open(getTestOptions(dir))
+	require.True(t, errors.Is(err, ErrCorruptFile))
+	require.Equal(t, CodeCorruption, ErrorCode(err))
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, matches[0], e.Path)
+	require.Equal(t, fi.Size()-4, e.Offset)
+}
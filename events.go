@@ -0,0 +1,241 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/table"
+)
+
+// CompactionInfo describes a compaction, as reported to an EventListener.
+type CompactionInfo struct {
+	// CompactorID is the ID of the compactor running the compaction.
+	CompactorID int
+	// Level is the level the tables are compacted from, and OutputLevel the level they are
+	// compacted into. They are the same for the compactions within a level.
+	Level       int
+	OutputLevel int
+	// InputTables are the IDs of the tables compacted, from both levels. InputBytes is their size.
+	InputTables []uint64
+	InputBytes  int64
+	// OutputTables are the IDs of the tables built by the compaction. OutputBytes is their size.
+	// Both are only set once the compaction is done.
+	OutputTables []uint64
+	OutputBytes  int64
+	// Duration is the time taken by the compaction. It is only set once the compaction is done.
+	Duration time.Duration
+	// Err is the error the compaction failed with, if any.
+	Err error
+}
+
+// FlushInfo describes the flush of memtables to a level 0 table.
+type FlushInfo struct {
+	// TableID is the ID of the table built. Bytes and KeyCount are its size and its number of keys.
+	TableID  uint64
+	Bytes    int64
+	KeyCount uint32
+	// Duration is the time taken to build the table and add it to level 0, including any stall.
+	Duration time.Duration
+}
+
+// StallReason is the reason the writes were stalled for.
+type StallReason int
+
+const (
+	// StallL0Tables means a flush waits for level 0 to have fewer than NumLevelZeroTablesStall
+	// tables.
+	StallL0Tables StallReason = iota
+	// StallMemtables means the writes wait for the memtables to be flushed, because
+	// NumMemtables of them are full.
+	StallMemtables
+)
+
+func (r StallReason) String() string {
+	switch r {
+	case StallL0Tables:
+		return "L0 tables"
+	case StallMemtables:
+		return "memtables"
+	}
+	return "unknown"
+}
+
+// StallInfo describes a stall of the writes.
+type StallInfo struct {
+	Reason StallReason
+	// Duration is the time the writes were stalled for. It is only set once the stall has ended.
+	Duration time.Duration
+}
+
+// ValueLogGCInfo describes a run of RunValueLogGC.
+type ValueLogGCInfo struct {
+	ValueLogGCResult
+	// Err is the error returned by RunValueLogGC, if any. It is ErrNoRewrite if no file was
+	// rewritten.
+	Err error
+}
+
+// ExpiredKey describes a key removed by a compaction because it expired.
+type ExpiredKey struct {
+	Key       []byte
+	Version   uint64
+	ExpiresAt uint64
+	UserMeta  byte
+}
+
+// EventListener has the callbacks to be run on the events of a DB. Any of them can be nil.
+//
+// The callbacks are run synchronously, by the goroutine doing the work. They should return
+// quickly, and they must not call into the DB, otherwise they could delay or deadlock it.
+type EventListener struct {
+	// OnCompactionBegin and OnCompactionEnd are run before and after each compaction.
+	OnCompactionBegin func(info CompactionInfo)
+	OnCompactionEnd   func(info CompactionInfo)
+	// OnFlushEnd is run after memtables were flushed to a level 0 table.
+	OnFlushEnd func(info FlushInfo)
+	// OnStallBegin and OnStallEnd are run when the writes start and stop being stalled.
+	OnStallBegin func(info StallInfo)
+	OnStallEnd   func(info StallInfo)
+	// OnValueLogGC is run after each call to RunValueLogGC.
+	OnValueLogGC func(info ValueLogGCInfo)
+	// OnExpired is run after a compaction removed keys whose latest version expired, or
+	// PurgeExpired deleted them, with those keys. A key is only removed by the compactions once
+	// they reach it, which can be long after it expired, and it can be reported after it was set
+	// again, by a write not compacted yet. See Options.ExpiryScanInterval to remove them sooner.
+	OnExpired func(keys []ExpiredKey)
+}
+
+// eventListeners is the list of the listeners added to the DB.
+type eventListeners struct {
+	sync.RWMutex
+	list []EventListener
+}
+
+func (e *eventListeners) add(l EventListener) {
+	e.Lock()
+	defer e.Unlock()
+	e.list = append(e.list, l)
+}
+
+// each runs fn for each of the listeners.
+func (e *eventListeners) each(fn func(l *EventListener)) {
+	e.RLock()
+	defer e.RUnlock()
+	for i := range e.list {
+		fn(&e.list[i])
+	}
+}
+
+func (e *eventListeners) compactionBegin(info CompactionInfo) {
+	e.each(func(l *EventListener) {
+		if l.OnCompactionBegin != nil {
+			l.OnCompactionBegin(info)
+		}
+	})
+}
+
+func (e *eventListeners) compactionEnd(info CompactionInfo) {
+	e.each(func(l *EventListener) {
+		if l.OnCompactionEnd != nil {
+			l.OnCompactionEnd(info)
+		}
+	})
+}
+
+func (e *eventListeners) flushEnd(info FlushInfo) {
+	e.each(func(l *EventListener) {
+		if l.OnFlushEnd != nil {
+			l.OnFlushEnd(info)
+		}
+	})
+}
+
+func (e *eventListeners) stallBegin(info StallInfo) {
+	e.each(func(l *EventListener) {
+		if l.OnStallBegin != nil {
+			l.OnStallBegin(info)
+		}
+	})
+}
+
+func (e *eventListeners) stallEnd(info StallInfo) {
+	e.each(func(l *EventListener) {
+		if l.OnStallEnd != nil {
+			l.OnStallEnd(info)
+		}
+	})
+}
+
+func (e *eventListeners) valueLogGC(info ValueLogGCInfo) {
+	e.each(func(l *EventListener) {
+		if l.OnValueLogGC != nil {
+			l.OnValueLogGC(info)
+		}
+	})
+}
+
+func (e *eventListeners) expired(keys []ExpiredKey) {
+	e.each(func(l *EventListener) {
+		if l.OnExpired != nil {
+			l.OnExpired(keys)
+		}
+	})
+}
+
+// hasExpiredListener returns true if a listener has OnExpired set, so that the expired keys are
+// only collected when they are reported.
+func (e *eventListeners) hasExpiredListener() bool {
+	found := false
+	e.each(func(l *EventListener) {
+		found = found || l.OnExpired != nil
+	})
+	return found
+}
+
+// expiredKeys collects the keys removed by the subcompactions of a compaction because they
+// expired.
+type expiredKeys struct {
+	sync.Mutex
+	keys []ExpiredKey
+}
+
+func (e *expiredKeys) add(keys []ExpiredKey) {
+	e.Lock()
+	defer e.Unlock()
+	e.keys = append(e.keys, keys...)
+}
+
+// tableIDsAndSize returns the IDs and the total size of the tables.
+func tableIDsAndSize(tables ...[]*table.Table) ([]uint64, int64) {
+	var ids []uint64
+	var size int64
+	for _, tbls := range tables {
+		for _, t := range tbls {
+			ids = append(ids, t.ID())
+			size += t.Size()
+		}
+	}
+	return ids, size
+}
+
+// AddEventListener adds a listener for the events of the DB, like compactions, flushes, write
+// stalls, value log GCs and expired keys. The listener gets the events which happen after it was added.
+func (db *DB) AddEventListener(l EventListener) {
+	db.events.add(l)
+}
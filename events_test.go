@@ -0,0 +1,159 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithCompactL0OnClose(true)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var begins, ends []CompactionInfo
+	var flushes []FlushInfo
+	var gcs []ValueLogGCInfo
+	db.AddEventListener(EventListener{
+		OnCompactionBegin: func(info CompactionInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			begins = append(begins, info)
+		},
+		OnCompactionEnd: func(info CompactionInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			ends = append(ends, info)
+		},
+		OnFlushEnd: func(info FlushInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			flushes = append(flushes, info)
+		},
+		OnValueLogGC: func(info ValueLogGCInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			gcs = append(gcs, info)
+		},
+	})
+	// A listener without callbacks is fine.
+	db.AddEventListener(EventListener{})
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	_, err = db.RunValueLogGC(0.5)
+	require.Equal(t, ErrNoRewrite, err)
+	// Closing the DB flushes the memtable, and compacts L0.
+	require.NoError(t, db.Close())
+
+	require.Len(t, gcs, 1)
+	require.Equal(t, ErrNoRewrite, gcs[0].Err)
+
+	require.Len(t, flushes, 1)
+	require.Equal(t, uint32(100), flushes[0].KeyCount)
+	require.Greater(t, flushes[0].Bytes, int64(0))
+
+	require.Len(t, begins, 1)
+	require.Len(t, ends, 1)
+	require.Equal(t, 0, begins[0].Level)
+	require.Equal(t, []uint64{flushes[0].TableID}, begins[0].InputTables)
+	require.Equal(t, flushes[0].Bytes, begins[0].InputBytes)
+	require.Empty(t, begins[0].OutputTables)
+
+	end := ends[0]
+	require.NoError(t, end.Err)
+	require.Equal(t, begins[0].InputTables, end.InputTables)
+	require.Equal(t, 0, end.Level)
+	require.NotEqual(t, 0, end.OutputLevel)
+	require.Len(t, end.OutputTables, 1)
+	require.Greater(t, end.OutputBytes, int64(0))
+	require.Greater(t, int64(end.Duration), int64(0))
+}
+
+func TestEventListenerExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	past := uint64(time.Now().Unix()) - 10
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			e := NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("value")).WithMeta(byte(i))
+			switch {
+			case i < 5:
+				e.ExpiresAt = past
+			case i < 8:
+				e = e.WithTTL(time.Hour)
+			}
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		// Deleted, not expired.
+		return txn.Delete([]byte("key009"))
+	}))
+	// Closing the DB flushes the memtable.
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	var mu sync.Mutex
+	var expired []ExpiredKey
+	db.AddEventListener(EventListener{
+		OnExpired: func(keys []ExpiredKey) {
+			mu.Lock()
+			defer mu.Unlock()
+			expired = append(expired, keys...)
+		},
+	})
+	_, err = db.CompactRange(CompactRangeOptions{})
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, expired, 5)
+	for i, k := range expired {
+		require.Equal(t, fmt.Sprintf("key%03d", i), string(k.Key))
+		require.Equal(t, past, k.ExpiresAt)
+		require.Equal(t, byte(i), k.UserMeta)
+		require.NotZero(t, k.Version)
+	}
+}
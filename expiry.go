@@ -0,0 +1,214 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// The expiry index has an entry for each version of a key written with an expiry, whose key is
+// expiryIndexPrefix, the big-endian ExpiresAt and the key. So the entries of the expired keys are
+// at the start of the index.
+var expiryIndexPrefix = []byte("!badger!expiry!")
+
+// expiryPurgeBatch is the number of index entries handled per transaction by PurgeExpired.
+const expiryPurgeBatch = 1000
+
+func expiryIndexKey(expiresAt uint64, key []byte) []byte {
+	out := make([]byte, len(expiryIndexPrefix)+8+len(key))
+	n := copy(out, expiryIndexPrefix)
+	binary.BigEndian.PutUint64(out[n:], expiresAt)
+	copy(out[n+8:], key)
+	return out
+}
+
+// parseExpiryIndexKey returns the expiry and the key of an index entry.
+func parseExpiryIndexKey(ik []byte) (uint64, []byte) {
+	ik = ik[len(expiryIndexPrefix):]
+	return binary.BigEndian.Uint64(ik), ik[8:]
+}
+
+func (db *DB) expiryIndexEnabled() bool {
+	return db.opt.ExpiryScanInterval > 0 && !db.opt.managedTxns
+}
+
+// expiredEntry is an entry of the expiry index whose expiry has passed.
+type expiredEntry struct {
+	indexKey  []byte
+	key       []byte
+	expiresAt uint64
+}
+
+// expiredEntries returns up to n entries of the expiry index, from start on, whose expiry is at or
+// before now. It also returns the index key to resume from, which is nil if there are no more.
+func expiredEntries(txn *Txn, start []byte, now uint64, n int) ([]expiredEntry, []byte) {
+	opt := DefaultIteratorOptions
+	opt.Prefix = expiryIndexPrefix
+	opt.PrefetchValues = false
+	opt.InternalAccess = true
+	it := txn.NewIterator(opt)
+	defer it.Close()
+
+	var entries []expiredEntry
+	for it.Seek(start); it.Valid(); it.Next() {
+		ik := it.Item().KeyCopy(nil)
+		if len(entries) == n {
+			return entries, ik
+		}
+		expiresAt, key := parseExpiryIndexKey(ik)
+		if expiresAt > now {
+			break
+		}
+		entries = append(entries, expiredEntry{indexKey: ik, key: key, expiresAt: expiresAt})
+	}
+	return entries, nil
+}
+
+// checkExpired returns the latest version of the key of the entry, if it is the version the entry
+// indexes. Otherwise, the key was deleted or set again since, and the entry is stale.
+func checkExpired(txn *Txn, e expiredEntry) (ExpiredKey, bool) {
+	opt := DefaultIteratorOptions
+	opt.AllVersions = true
+	opt.PrefetchValues = false
+	it := txn.NewKeyIterator(e.key, opt)
+	defer it.Close()
+	it.Rewind()
+	if !it.Valid() {
+		return ExpiredKey{}, false
+	}
+	item := it.Item()
+	if item.meta&bitDelete > 0 || item.ExpiresAt() != e.expiresAt {
+		return ExpiredKey{}, false
+	}
+	return ExpiredKey{
+		Key:       e.key,
+		Version:   item.Version(),
+		ExpiresAt: item.ExpiresAt(),
+		UserMeta:  item.UserMeta(),
+	}, true
+}
+
+// PurgeExpired deletes the keys which expired, along with their entries in the expiry index. The
+// deleted keys are reported to the OnExpired event listeners, and their count is returned. The
+// entries which conflicted with concurrent writes are left for the next call.
+//
+// It requires the expiry index, which is enabled by Options.ExpiryScanInterval. It is run at
+// each interval, so it only needs to be called to purge the keys sooner.
+func (db *DB) PurgeExpired() (int, error) {
+	if !db.expiryIndexEnabled() {
+		return 0, ErrExpiryIndexDisabled
+	}
+	now := uint64(time.Now().Unix())
+	purged := 0
+	start := expiryIndexPrefix
+	for start != nil {
+		n, next, err := db.purgeExpiredBatch(start, now)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+		start = next
+	}
+	return purged, nil
+}
+
+// purgeExpiredBatch deletes the keys of a batch of entries of the expiry index, from start on. It
+// returns the number of keys deleted, and the index key to resume from.
+func (db *DB) purgeExpiredBatch(start []byte, now uint64) (int, []byte, error) {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	txn.internal = true
+
+	entries, next := expiredEntries(txn, start, now, expiryPurgeBatch)
+	var expired []ExpiredKey
+	for _, e := range entries {
+		if err := txn.Delete(e.indexKey); err != nil {
+			return 0, nil, err
+		}
+		ek, ok := checkExpired(txn, e)
+		if !ok {
+			continue
+		}
+		if err := txn.Delete(e.key); err != nil {
+			return 0, nil, err
+		}
+		expired = append(expired, ek)
+	}
+	if len(entries) == 0 {
+		return 0, nil, nil
+	}
+	switch err := txn.Commit(); {
+	case errors.Is(err, ErrConflict):
+		return 0, next, nil
+	case err != nil:
+		return 0, nil, err
+	}
+	y.NumExpiredPurgedAdd(db.opt.MetricsEnabled, int64(len(expired)))
+	if len(expired) > 0 {
+		db.events.expired(expired)
+	}
+	return len(expired), next, nil
+}
+
+// CountExpired returns the number of keys which expired, but haven't been deleted by PurgeExpired
+// yet. It requires the expiry index, which is enabled by Options.ExpiryScanInterval.
+func (db *DB) CountExpired() (int, error) {
+	if !db.expiryIndexEnabled() {
+		return 0, ErrExpiryIndexDisabled
+	}
+	now := uint64(time.Now().Unix())
+	count := 0
+	err := db.View(func(txn *Txn) error {
+		for start := expiryIndexPrefix; start != nil; {
+			var entries []expiredEntry
+			entries, start = expiredEntries(txn, start, now, expiryPurgeBatch)
+			for _, e := range entries {
+				if _, ok := checkExpired(txn, e); ok {
+					count++
+				}
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// runExpiryScanner runs PurgeExpired at each ExpiryScanInterval.
+func (db *DB) runExpiryScanner(c *z.Closer) {
+	defer c.Done()
+
+	ticker := time.NewTicker(db.opt.ExpiryScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.HasBeenClosed():
+			return
+		case <-ticker.C:
+			n, err := db.PurgeExpired()
+			if err != nil {
+				db.opt.logw(WARNING, "Expiry scan failed", "purged", n, "error", err)
+				continue
+			}
+			db.opt.logw(DEBUG, "Expiry scan done", "purged", n)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	opt := getTestOptions("").WithExpiryScanInterval(time.Hour)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		var mu sync.Mutex
+		var reported []ExpiredKey
+		db.AddEventListener(EventListener{
+			OnExpired: func(keys []ExpiredKey) {
+				mu.Lock()
+				defer mu.Unlock()
+				reported = append(reported, keys...)
+			},
+		})
+
+		past := uint64(time.Now().Unix()) - 10
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 20; i++ {
+				e := NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+				switch {
+				case i < 10:
+					e.ExpiresAt = past
+				case i < 15:
+					e = e.WithTTL(time.Hour)
+				}
+				if err := txn.SetEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			// Set again without an expiry, and deleted.
+			if err := txn.Set([]byte("key008"), []byte("value")); err != nil {
+				return err
+			}
+			return txn.Delete([]byte("key009"))
+		}))
+
+		n, err := db.CountExpired()
+		require.NoError(t, err)
+		require.Equal(t, 8, n)
+		n, err = db.PurgeExpired()
+		require.NoError(t, err)
+		require.Equal(t, 8, n)
+		n, err = db.CountExpired()
+		require.NoError(t, err)
+		require.Zero(t, n)
+		n, err = db.PurgeExpired()
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		mu.Lock()
+		require.Len(t, reported, 8)
+		for i, k := range reported {
+			require.Equal(t, fmt.Sprintf("key%03d", i), string(k.Key))
+			require.Equal(t, past, k.ExpiresAt)
+		}
+		mu.Unlock()
+
+		// The expired versions were deleted, and the index is empty.
+		require.NoError(t, db.View(func(txn *Txn) error {
+			iopt := DefaultIteratorOptions
+			iopt.AllVersions = true
+			it := txn.NewIterator(iopt)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				if item.ExpiresAt() == past {
+					require.True(t, item.IsDeletedOrExpired())
+				}
+			}
+
+			iopt.InternalAccess = true
+			iopt.Prefix = expiryIndexPrefix
+			iopt.AllVersions = false
+			idx := txn.NewIterator(iopt)
+			defer idx.Close()
+			count := 0
+			for idx.Rewind(); idx.Valid(); idx.Next() {
+				count++
+			}
+			// The entries of the keys expiring in an hour.
+			require.Equal(t, 5, count)
+			return nil
+		}))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("key008"))
+			require.NoError(t, err)
+			return nil
+		}))
+	})
+}
+
+func TestPurgeExpiredConflictDetails(t *testing.T) {
+	opt := getTestOptions("").WithExpiryScanInterval(time.Hour).WithConflictDetails(true)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		n := 5 * expiryPurgeBatch
+		past := uint64(time.Now().Unix()) - 10
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				e := NewEntry([]byte(fmt.Sprintf("key%05d", i)), []byte("value"))
+				e.ExpiresAt = past
+				if err := txn.SetEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		// The keys are set again while they are purged. The batches which conflict, with a
+		// *ConflictError, are skipped instead of failing the purge.
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i = (i + 1) % n {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					return txn.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value"))
+				}))
+			}
+		}()
+		for i := 0; i < 10; i++ {
+			_, err := db.PurgeExpired()
+			require.NoError(t, err)
+		}
+		close(done)
+		wg.Wait()
+	})
+}
+
+func TestExpiryScanner(t *testing.T) {
+	opt := getTestOptions("").WithExpiryScanInterval(10 * time.Millisecond)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte("key"), []byte("value")).WithTTL(time.Second))
+		}))
+		n, err := db.CountExpired()
+		require.NoError(t, err)
+		require.Zero(t, n)
+		require.Eventually(t, func() bool {
+			var deleted bool
+			require.NoError(t, db.View(func(txn *Txn) error {
+				iopt := DefaultIteratorOptions
+				iopt.AllVersions = true
+				it := txn.NewKeyIterator([]byte("key"), iopt)
+				defer it.Close()
+				it.Rewind()
+				deleted = it.Valid() && it.Item().meta&bitDelete > 0
+				return nil
+			}))
+			return deleted
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestExpiryIndexDisabled(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		_, err := db.PurgeExpired()
+		require.Equal(t, ErrExpiryIndexDisabled, err)
+		_, err = db.CountExpired()
+		require.Equal(t, ErrExpiryIndexDisabled, err)
+	})
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// ExportFormat is the format of the exports made by Export.
+type ExportFormat int
+
+const (
+	// JSONFormat writes a JSON object per line.
+	JSONFormat ExportFormat = iota
+	// CSVFormat writes a CSV record per line, after a header line.
+	CSVFormat
+)
+
+// ExportEncoding is the encoding of the keys or of the values of an export.
+type ExportEncoding int
+
+const (
+	// Base64Encoding encodes with the standard base64 encoding, with padding.
+	Base64Encoding ExportEncoding = iota
+	// HexEncoding encodes in lowercase hexadecimal.
+	HexEncoding
+)
+
+// ExportOptions are the options of Export and Import. An export must be imported with the options
+// it was exported with.
+type ExportOptions struct {
+	Format        ExportFormat
+	KeyEncoding   ExportEncoding
+	ValueEncoding ExportEncoding
+}
+
+// exportRecord is a KV of an export. The CSV records have the fields in this order.
+type exportRecord struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Version   uint64 `json:"version"`
+	ExpiresAt uint64 `json:"expires_at,omitempty"`
+	UserMeta  byte   `json:"user_meta,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	// UserMetadata is encoded like the value.
+	UserMetadata string `json:"user_metadata,omitempty"`
+}
+
+// The user_metadata column is optional on import, for the exports made before it was added.
+var exportCSVHeader = []string{"key", "value", "version", "expires_at", "user_meta", "deleted",
+	"user_metadata"}
+
+func (e ExportEncoding) encode(b []byte) (string, error) {
+	switch e {
+	case Base64Encoding:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case HexEncoding:
+		return hex.EncodeToString(b), nil
+	}
+	return "", errors.Errorf("Unknown export encoding: %d", e)
+}
+
+func (e ExportEncoding) decode(s string) ([]byte, error) {
+	switch e {
+	case Base64Encoding:
+		return base64.StdEncoding.DecodeString(s)
+	case HexEncoding:
+		return hex.DecodeString(s)
+	}
+	return nil, errors.Errorf("Unknown export encoding: %d", e)
+}
+
+// Export writes the entries of the database newer than or equal to since to w, in line-delimited
+// JSON or in CSV, so that they can be read by tools which can't read the backups. Like Backup, it
+// writes all the versions of the keys and the deletions, and returns the version of the last
+// entry written. The lines aren't sorted by key. The export can be read back with Import.
+func (db *DB) Export(w io.Writer, since uint64, opt ExportOptions) (uint64, error) {
+	stream := db.NewStream()
+	stream.LogPrefix = "DB.Export"
+	stream.SinceTs = since
+	return stream.Export(w, since, opt)
+}
+
+// Export is like DB.Export, but exports the entries picked by the stream.
+func (stream *Stream) Export(w io.Writer, since uint64, opt ExportOptions) (uint64, error) {
+	if opt.Format != JSONFormat && opt.Format != CSVFormat {
+		return 0, errors.Errorf("Unknown export format: %d", opt.Format)
+	}
+	stream.KeyToList = stream.backupKeyToList(since)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	cw := csv.NewWriter(bw)
+	if opt.Format == CSVFormat {
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return 0, err
+		}
+	}
+	var maxVersion uint64
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			if kv.StreamDone {
+				continue
+			}
+			if maxVersion < kv.Version {
+				maxVersion = kv.Version
+			}
+			rec := exportRecord{Version: kv.Version, ExpiresAt: kv.ExpiresAt}
+			if rec.Key, err = opt.KeyEncoding.encode(kv.Key); err != nil {
+				return err
+			}
+			if rec.Value, err = opt.ValueEncoding.encode(kv.Value); err != nil {
+				return err
+			}
+			userMeta, md := parseKVUserMeta(kv.UserMeta)
+			rec.UserMeta = userMeta
+			if len(md) > 0 {
+				if rec.UserMetadata, err = opt.ValueEncoding.encode(md); err != nil {
+					return err
+				}
+			}
+			rec.Deleted = len(kv.Meta) > 0 && kv.Meta[0]&bitDelete > 0
+			if opt.Format == JSONFormat {
+				err = enc.Encode(&rec)
+			} else {
+				err = cw.Write([]string{rec.Key, rec.Value,
+					strconv.FormatUint(rec.Version, 10), strconv.FormatUint(rec.ExpiresAt, 10),
+					strconv.Itoa(int(rec.UserMeta)), strconv.FormatBool(rec.Deleted),
+					rec.UserMetadata})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := stream.Orchestrate(context.Background()); err != nil {
+		return 0, err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return 0, err
+	}
+	return maxVersion, bw.Flush()
+}
+
+// Import writes the entries of an export made by Export to the database. Like Load, it should be
+// called on a database that is not running any other concurrent transactions.
+func (db *DB) Import(r io.Reader, maxPendingWrites int, opt ExportOptions) error {
+	ldr := db.NewKVLoader(maxPendingWrites)
+	add := func(rec *exportRecord, line int) error {
+		kv := &pb.KV{
+			Version:   rec.Version,
+			ExpiresAt: rec.ExpiresAt,
+		}
+		md, err := opt.ValueEncoding.decode(rec.UserMetadata)
+		if err != nil {
+			return errors.Wrapf(err, "invalid user metadata on line %d", line)
+		}
+		kv.UserMeta = kvUserMeta(rec.UserMeta, md)
+		if kv.Key, err = opt.KeyEncoding.decode(rec.Key); err != nil {
+			return errors.Wrapf(err, "invalid key on line %d", line)
+		}
+		if len(kv.Key) == 0 {
+			return errors.Wrapf(ErrEmptyKey, "on line %d", line)
+		}
+		if kv.Version == 0 {
+			return errors.Errorf("invalid version 0 on line %d", line)
+		}
+		if kv.Value, err = opt.ValueEncoding.decode(rec.Value); err != nil {
+			return errors.Wrapf(err, "invalid value on line %d", line)
+		}
+		if rec.Deleted {
+			kv.Meta = []byte{bitDelete}
+		}
+		return db.loadKV(ldr, kv)
+	}
+
+	switch opt.Format {
+	case JSONFormat:
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		for line := 1; ; line++ {
+			var rec exportRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.Wrapf(err, "invalid record on line %d", line)
+			}
+			if err := add(&rec, line); err != nil {
+				return err
+			}
+		}
+	case CSVFormat:
+		cr := csv.NewReader(r)
+		// The number of fields is set by the header.
+		cr.FieldsPerRecord = 0
+		cr.ReuseRecord = true
+		for line := 1; ; line++ {
+			fields, err := cr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if line == 1 {
+				if len(fields) < len(exportCSVHeader)-1 || len(fields) > len(exportCSVHeader) {
+					return errors.Errorf("invalid CSV header: %v", fields)
+				}
+				for i, name := range fields {
+					if exportCSVHeader[i] != name {
+						return errors.Errorf("invalid CSV header: %v", fields)
+					}
+				}
+				continue
+			}
+			rec, err := parseCSVRecord(fields)
+			if err != nil {
+				return errors.Wrapf(err, "invalid record on line %d", line)
+			}
+			if err := add(rec, line); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("Unknown export format: %d", opt.Format)
+	}
+
+	if err := ldr.Finish(); err != nil {
+		return err
+	}
+	db.orc.txnMark.Done(db.orc.nextTxnTs - 1)
+	return nil
+}
+
+func parseCSVRecord(fields []string) (*exportRecord, error) {
+	rec := &exportRecord{Key: fields[0], Value: fields[1]}
+	var err error
+	if rec.Version, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+		return nil, err
+	}
+	if rec.ExpiresAt, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+		return nil, err
+	}
+	userMeta, err := strconv.ParseUint(fields[4], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	rec.UserMeta = byte(userMeta)
+	if rec.Deleted, err = strconv.ParseBool(fields[5]); err != nil {
+		return nil, err
+	}
+	if len(fields) > 6 {
+		rec.UserMetadata = fields[6]
+	}
+	return rec, nil
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	type kvState struct {
+		value     string
+		version   uint64
+		expiresAt uint64
+		userMeta  byte
+		metadata  string
+	}
+	read := func(db *DB) map[string]kvState {
+		kvs := make(map[string]kvState)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				kvs[string(item.Key())] = kvState{string(getItemValue(t, item)), item.Version(),
+					item.ExpiresAt(), item.UserMeta(), string(item.UserMetadata())}
+			}
+			return nil
+		}))
+		return kvs
+	}
+
+	opt := getTestOptions("").WithInMemory(true)
+	src, err := Open(opt)
+	require.NoError(t, err)
+	defer src.Close()
+	require.NoError(t, src.Update(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if err := txn.Set([]byte(key), []byte("old-"+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, src.Update(func(txn *Txn) error {
+		e := NewEntry([]byte("key-1"), []byte("new,\"value\"\n")).WithMeta(7).
+			WithTTL(time.Hour).WithUserMetadata([]byte("origin=test"))
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+		return txn.Delete([]byte("key-2"))
+	}))
+	expected := read(src)
+	require.Len(t, expected, 99)
+
+	for _, format := range []ExportFormat{JSONFormat, CSVFormat} {
+		for _, encoding := range []ExportEncoding{Base64Encoding, HexEncoding} {
+			eopt := ExportOptions{Format: format, KeyEncoding: encoding, ValueEncoding: encoding}
+			t.Run(fmt.Sprintf("%+v", eopt), func(t *testing.T) {
+				var buf bytes.Buffer
+				version, err := src.Export(&buf, 0, eopt)
+				require.NoError(t, err)
+				require.Equal(t, src.MaxVersion(), version)
+
+				dst, err := Open(opt)
+				require.NoError(t, err)
+				defer dst.Close()
+				require.NoError(t, dst.Import(&buf, 16, eopt))
+				require.Equal(t, expected, read(dst))
+				// The versions loaded are visible to the new transactions.
+				require.Equal(t, version, dst.orc.readTs())
+			})
+		}
+	}
+
+	dst, err := Open(opt)
+	require.NoError(t, err)
+	defer dst.Close()
+	jopt := ExportOptions{Format: JSONFormat, KeyEncoding: HexEncoding, ValueEncoding: HexEncoding}
+	for _, bad := range []string{
+		`{"key":"zz","value":"","version":1}`,
+		`{"key":"","value":"","version":1}`,
+		`{"key":"6b","value":"","version":0}`,
+		`{"key":"6b","value":"","version":1,"extra":1}`,
+	} {
+		require.Error(t, dst.Import(strings.NewReader(bad), 16, jopt), bad)
+	}
+	copt := ExportOptions{Format: CSVFormat}
+	require.Error(t, dst.Import(strings.NewReader("k,v,version\n"), 16, copt))
+	require.Error(t, dst.Import(strings.NewReader(
+		"key,value,version,expires_at,user_meta,deleted\naw==,,1,0,0,maybe\n"), 16, copt))
+}
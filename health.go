@@ -0,0 +1,224 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// The subsystems of the DB whose errors are reported by DB.Health.
+const (
+	SubsystemCompaction = "compaction"
+	SubsystemFlush      = "flush"
+	SubsystemWrite      = "write"
+	SubsystemValueLogGC = "value_log_gc"
+)
+
+// Health is the status of a DB, as returned by DB.Health.
+type Health struct {
+	// Healthy is true if there are no Problems.
+	Healthy bool
+	// Problems describes why the DB isn't healthy: it is closed, its writes are stalled, or some
+	// of its subsystems are failing.
+	Problems []string
+
+	Closed bool
+	// L0Tables is the number of tables in level 0. The writes are stalled once it reaches
+	// L0StallThreshold, which is Options.NumLevelZeroTablesStall.
+	L0Tables         int
+	L0StallThreshold int
+	Levels           []LevelHealth
+	ValueLog         ValueLogHealth
+	// Caches are the hit ratios of the caches the DB was created with, keyed by cache name.
+	Caches map[string]CacheHealth
+	// Stalls are the write stalls in progress.
+	Stalls []StallHealth
+	// Subsystems has the status of each subsystem which ran since the DB was opened, keyed by
+	// the Subsystem constants.
+	Subsystems map[string]SubsystemHealth
+}
+
+// LevelHealth is the compaction status of a level.
+type LevelHealth struct {
+	Level     int
+	NumTables int
+	Size      int64
+	// Score is the compaction score of the level. A compaction is pending if it is at least 1.
+	Score             float64
+	CompactionPending bool
+	// CompactionsRunning is the number of compactions running from or into this level.
+	CompactionsRunning int
+}
+
+// ValueLogHealth is the value log GC backlog.
+type ValueLogHealth struct {
+	// TotalBytes is the size of the value log files, and DiscardBytes the size of the data in
+	// them which can be reclaimed by RunValueLogGC.
+	TotalBytes         int64
+	DiscardBytes       int64
+	SpaceAmplification float64
+	// LastGC is when RunValueLogGC last ran. It is zero if it didn't run since the DB was opened.
+	LastGC time.Time
+}
+
+// CacheHealth are the hits and misses of a cache.
+type CacheHealth struct {
+	Hits     uint64
+	Misses   uint64
+	HitRatio float64
+}
+
+// StallHealth is a write stall in progress.
+type StallHealth struct {
+	Reason StallReason
+	Since  time.Time
+}
+
+// SubsystemHealth is the status of a subsystem.
+type SubsystemHealth struct {
+	// Failing is true if the last run of the subsystem failed.
+	Failing       bool
+	LastSuccess   time.Time
+	LastError     error
+	LastErrorTime time.Time
+}
+
+// healthState tracks the state of the DB which can't be read from its structures, for Health.
+type healthState struct {
+	sync.Mutex
+	stalls     map[StallReason]time.Time
+	subsystems map[string]SubsystemHealth
+	lastGC     time.Time
+}
+
+// record records the result of a run of the subsystem.
+func (h *healthState) record(subsystem string, err error) {
+	now := time.Now()
+	h.Lock()
+	defer h.Unlock()
+	if h.subsystems == nil {
+		h.subsystems = make(map[string]SubsystemHealth)
+	}
+	s := h.subsystems[subsystem]
+	s.Failing = err != nil
+	if err != nil {
+		s.LastError, s.LastErrorTime = err, now
+	} else {
+		s.LastSuccess = now
+	}
+	h.subsystems[subsystem] = s
+}
+
+func (h *healthState) stallBegin(reason StallReason) {
+	h.Lock()
+	defer h.Unlock()
+	if h.stalls == nil {
+		h.stalls = make(map[StallReason]time.Time)
+	}
+	h.stalls[reason] = time.Now()
+}
+
+func (h *healthState) stallEnd(reason StallReason) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.stalls, reason)
+}
+
+// Health returns the status of the DB, to be used by readiness probes. It only reads in-memory
+// state, so it is cheap to call. It returns an error if ctx is done before it is finished.
+func (db *DB) Health(ctx context.Context) (Health, error) {
+	h := Health{Closed: db.IsClosed()}
+	if h.Closed {
+		h.Problems = append(h.Problems, "DB is closed")
+		return h, ctx.Err()
+	}
+
+	h.L0StallThreshold = db.opt.NumLevelZeroTablesStall
+	for _, l := range db.Levels() {
+		h.Levels = append(h.Levels, LevelHealth{
+			Level:              l.Level,
+			NumTables:          l.NumTables,
+			Size:               l.Size,
+			Score:              l.Score,
+			CompactionPending:  l.Score >= 1,
+			CompactionsRunning: db.lc.cstatus.numRunning(l.Level),
+		})
+	}
+	if len(h.Levels) > 0 {
+		h.L0Tables = h.Levels[0].NumTables
+	}
+	if err := ctx.Err(); err != nil {
+		return h, err
+	}
+
+	if !db.opt.InMemory {
+		h.ValueLog.TotalBytes, h.ValueLog.DiscardBytes = db.vlog.spaceUsage()
+		if db.vlog.large != nil {
+			total, discard := db.vlog.large.spaceUsage()
+			h.ValueLog.TotalBytes += total
+			h.ValueLog.DiscardBytes += discard
+		}
+	}
+	h.ValueLog.SpaceAmplification = spaceAmp(h.ValueLog.TotalBytes, h.ValueLog.DiscardBytes)
+
+	h.Caches = make(map[string]CacheHealth)
+	addCache := func(name string, m *ristretto.Metrics) {
+		if m != nil {
+			h.Caches[name] = CacheHealth{Hits: m.Hits(), Misses: m.Misses(), HitRatio: m.Ratio()}
+		}
+	}
+	addCache("block", db.BlockCacheMetrics())
+	addCache("pinned_block", db.PinnedBlockCacheMetrics())
+	addCache("compressed_block", db.CompressedBlockCacheMetrics())
+	addCache("index", db.IndexCacheMetrics())
+	addCache("filter", db.FilterCacheMetrics())
+
+	db.health.Lock()
+	h.ValueLog.LastGC = db.health.lastGC
+	for reason, since := range db.health.stalls {
+		h.Stalls = append(h.Stalls, StallHealth{Reason: reason, Since: since})
+	}
+	h.Subsystems = make(map[string]SubsystemHealth, len(db.health.subsystems))
+	for name, s := range db.health.subsystems {
+		h.Subsystems[name] = s
+	}
+	db.health.Unlock()
+	sort.Slice(h.Stalls, func(i, j int) bool { return h.Stalls[i].Reason < h.Stalls[j].Reason })
+
+	for _, s := range h.Stalls {
+		h.Problems = append(h.Problems, fmt.Sprintf("writes stalled on %s since %s",
+			s.Reason, s.Since.Format(time.RFC3339)))
+	}
+	var names []string
+	for name := range h.Subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if s := h.Subsystems[name]; s.Failing {
+			h.Problems = append(h.Problems, fmt.Sprintf("%s failing: %v", name, s.LastError))
+		}
+	}
+	h.Healthy = len(h.Problems) == 0
+	return h, ctx.Err()
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("foo"), []byte("bar"))
+	}))
+	_, err = db.RunValueLogGC(0.5)
+	require.Equal(t, ErrNoRewrite, err)
+
+	h, err := db.Health(context.Background())
+	require.NoError(t, err)
+	require.True(t, h.Healthy, "problems: %v", h.Problems)
+	require.False(t, h.Closed)
+	require.Equal(t, opt.NumLevelZeroTablesStall, h.L0StallThreshold)
+	require.Len(t, h.Levels, opt.MaxLevels)
+	require.Empty(t, h.Stalls)
+	require.Contains(t, h.Caches, "block")
+	require.False(t, h.ValueLog.LastGC.IsZero())
+	require.False(t, h.Subsystems[SubsystemWrite].Failing)
+	require.False(t, h.Subsystems[SubsystemWrite].LastSuccess.IsZero())
+	require.False(t, h.Subsystems[SubsystemValueLogGC].LastSuccess.IsZero())
+
+	// A failing subsystem and a write stall make the DB unhealthy, until they recover.
+	db.health.record(SubsystemCompaction, errors.New("disk full"))
+	db.health.stallBegin(StallL0Tables)
+	h, err = db.Health(context.Background())
+	require.NoError(t, err)
+	require.False(t, h.Healthy)
+	require.Len(t, h.Problems, 2)
+	require.Contains(t, h.Problems[1], "disk full")
+	require.Equal(t, StallL0Tables, h.Stalls[0].Reason)
+
+	db.health.record(SubsystemCompaction, nil)
+	db.health.stallEnd(StallL0Tables)
+	h, err = db.Health(context.Background())
+	require.NoError(t, err)
+	require.True(t, h.Healthy, "problems: %v", h.Problems)
+	require.EqualError(t, h.Subsystems[SubsystemCompaction].LastError, "disk full")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.Health(ctx)
+	require.Equal(t, context.Canceled, err)
+
+	require.NoError(t, db.Close())
+	h, err = db.Health(context.Background())
+	require.NoError(t, err)
+	require.True(t, h.Closed)
+	require.False(t, h.Healthy)
+}
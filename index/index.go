@@ -0,0 +1,345 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package index maintains secondary indexes of the key-value pairs of a Badger DB. Each index is
+// declared with an Extractor, which returns the values a key-value pair is indexed by. The index
+// entries are written and deleted in the same transaction as the pairs, so the indexes can't get
+// out of sync with the data, and they can be queried with an Iterator.
+//
+//	ix, err := index.New(nil, map[string]index.Extractor{
+//		"email": func(key, val []byte) [][]byte { return [][]byte{emailOf(val)} },
+//	})
+//	err = db.Update(func(txn *badger.Txn) error {
+//		return ix.Set(txn, []byte("user/1"), user)
+//	})
+//	err = db.View(func(txn *badger.Txn) error {
+//		keys, err := ix.Lookup(txn, "email", []byte("alice@example.com"))
+//		...
+//	})
+//
+// The index entries are stored in the same DB, under a prefix which the keys of the data must not
+// have. The pairs must be written with the Indexer, and not directly with the transaction.
+package index
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+var (
+	// DefaultPrefix is the prefix of the index entries, if New is given none.
+	DefaultPrefix = []byte("!badger-index!")
+
+	// ErrIndexKey is returned when a key has the prefix of the index entries.
+	ErrIndexKey = errors.New("index: Key has the prefix of the index entries")
+	// ErrUnknownIndex is returned when querying an index which wasn't declared.
+	ErrUnknownIndex = errors.New("index: Unknown index")
+)
+
+// Extractor returns the values a key-value pair is indexed by. It returns nil if the pair isn't
+// indexed. The values are copied, so they can point into val.
+type Extractor func(key, val []byte) [][]byte
+
+// Indexer maintains the index entries of the key-value pairs written with it. It is safe for
+// concurrent use.
+type Indexer struct {
+	prefix     []byte
+	extractors map[string]Extractor
+	names      []string // The names of the indexes, sorted.
+}
+
+// New returns an Indexer which maintains the given indexes, keyed by their names. Their entries
+// are stored under prefix, or DefaultPrefix if it is empty.
+func New(prefix []byte, extractors map[string]Extractor) (*Indexer, error) {
+	if len(prefix) == 0 {
+		prefix = DefaultPrefix
+	}
+	ix := &Indexer{
+		prefix:     append([]byte{}, prefix...),
+		extractors: make(map[string]Extractor, len(extractors)),
+	}
+	for name, extract := range extractors {
+		if name == "" {
+			return nil, errors.New("index: Empty index name")
+		}
+		if extract == nil {
+			return nil, errors.Errorf("index: Nil extractor for index %q", name)
+		}
+		ix.extractors[name] = extract
+		ix.names = append(ix.names, name)
+	}
+	sort.Strings(ix.names)
+	return ix, nil
+}
+
+// Set sets the key to the value in txn, and updates its index entries.
+func (ix *Indexer) Set(txn *badger.Txn, key, val []byte) error {
+	return ix.SetEntry(txn, badger.NewEntry(key, val))
+}
+
+// SetEntry sets the entry in txn, and updates the index entries of its key. The index entries
+// expire along with the entry.
+func (ix *Indexer) SetEntry(txn *badger.Txn, e *badger.Entry) error {
+	if bytes.HasPrefix(e.Key, ix.prefix) {
+		return ErrIndexKey
+	}
+	old, err := ix.current(txn, e.Key)
+	if err != nil {
+		return err
+	}
+	if err := ix.update(txn, e.Key, old, e.Value, true, e.ExpiresAt); err != nil {
+		return err
+	}
+	return txn.SetEntry(e)
+}
+
+// Delete deletes the key in txn, along with its index entries.
+func (ix *Indexer) Delete(txn *badger.Txn, key []byte) error {
+	if bytes.HasPrefix(key, ix.prefix) {
+		return ErrIndexKey
+	}
+	old, err := ix.current(txn, key)
+	if err != nil {
+		return err
+	}
+	if err := ix.update(txn, key, old, nil, false, 0); err != nil {
+		return err
+	}
+	return txn.Delete(key)
+}
+
+// current returns the current value of the key, or nil if it isn't set.
+func (ix *Indexer) current(txn *badger.Txn, key []byte) (*[]byte, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &val, nil
+}
+
+// update deletes the index entries of the old value of the key which the new value doesn't have,
+// and sets the ones of the new value. old is nil if the key isn't set, and set is false if the key
+// is deleted.
+func (ix *Indexer) update(txn *badger.Txn, key []byte, old *[]byte, val []byte, set bool,
+	expiresAt uint64) error {
+	for _, name := range ix.names {
+		extract := ix.extractors[name]
+		var newValues map[string]struct{}
+		if set {
+			newValues = make(map[string]struct{})
+			for _, v := range extract(key, val) {
+				newValues[string(v)] = struct{}{}
+			}
+		}
+		if old != nil {
+			for _, v := range extract(key, *old) {
+				if _, ok := newValues[string(v)]; ok {
+					continue
+				}
+				if err := txn.Delete(ix.entryKey(name, v, key)); err != nil {
+					return err
+				}
+			}
+		}
+		// The entries of the values the old value has too are set again, for their TTL.
+		for v := range newValues {
+			e := badger.NewEntry(ix.entryKey(name, []byte(v), key), nil)
+			e.ExpiresAt = expiresAt
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Lookup returns the keys indexed by value in the index.
+func (ix *Indexer) Lookup(txn *badger.Txn, name string, value []byte) ([][]byte, error) {
+	// The value followed by a 0x00 byte is the first one after it.
+	end := append(value[:len(value):len(value)], 0)
+	it, err := ix.NewIterator(txn, name, Range{Start: value, End: end})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var keys [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, append([]byte{}, it.Key()...))
+	}
+	return keys, nil
+}
+
+// Range is a range of index values. Start is inclusive, and End is exclusive. A nil bound means
+// the range is unbounded on that side.
+type Range struct {
+	Start []byte
+	End   []byte
+}
+
+// Iterator iterates over the keys of an index, in the order of their index values, and then of
+// the keys. A key is returned once for each of its index values in the range.
+type Iterator struct {
+	txn    *badger.Txn
+	it     *badger.Iterator
+	prefix []byte // The prefix of the entries of the index.
+	start  []byte
+	end    []byte
+
+	key   []byte
+	value []byte
+}
+
+// NewIterator returns an iterator over the keys of the index whose index values are in r. It must
+// be closed after use.
+func (ix *Indexer) NewIterator(txn *badger.Txn, name string, r Range) (*Iterator, error) {
+	if _, ok := ix.extractors[name]; !ok {
+		return nil, ErrUnknownIndex
+	}
+	prefix := appendEscaped(append([]byte{}, ix.prefix...), []byte(name))
+	it := &Iterator{
+		txn:    txn,
+		prefix: prefix,
+		start:  prefix,
+	}
+	if r.Start != nil {
+		it.start = appendEscaped(append([]byte{}, prefix...), r.Start)
+	}
+	if r.End != nil {
+		it.end = appendEscaped(append([]byte{}, prefix...), r.End)
+	}
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	opt.Prefix = prefix
+	it.it = txn.NewIterator(opt)
+	return it, nil
+}
+
+// Rewind seeks to the first key of the range.
+func (it *Iterator) Rewind() {
+	it.it.Seek(it.start)
+	it.parse()
+}
+
+// Next moves to the next key.
+func (it *Iterator) Next() {
+	it.it.Next()
+	it.parse()
+}
+
+// Valid returns false once all the keys of the range have been returned.
+func (it *Iterator) Valid() bool {
+	return it.key != nil
+}
+
+// parse parses the entry the iterator is at, or clears the key if it is past the range.
+func (it *Iterator) parse() {
+	it.key, it.value = nil, nil
+	for ; it.it.ValidForPrefix(it.prefix); it.it.Next() {
+		k := it.it.Item().Key()
+		if it.end != nil && bytes.Compare(k, it.end) >= 0 {
+			return
+		}
+		value, key, ok := readEscaped(k[len(it.prefix):])
+		if !ok || len(key) == 0 {
+			// Not written by the Indexer.
+			continue
+		}
+		it.key, it.value = key, value
+		return
+	}
+}
+
+// Key returns the key. It is only valid until Next is called.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// IndexValue returns the index value of the key.
+func (it *Iterator) IndexValue() []byte {
+	return it.value
+}
+
+// Item returns the item of the key.
+func (it *Iterator) Item() (*badger.Item, error) {
+	return it.txn.Get(it.key)
+}
+
+// Close closes the iterator.
+func (it *Iterator) Close() {
+	it.it.Close()
+}
+
+// entryKey returns the key of the index entry of key, for the index value v of the index.
+func (ix *Indexer) entryKey(name string, v, key []byte) []byte {
+	out := make([]byte, 0, len(ix.prefix)+len(name)+len(v)+len(key)+8)
+	out = append(out, ix.prefix...)
+	out = appendEscaped(out, []byte(name))
+	out = appendEscaped(out, v)
+	return append(out, key...)
+}
+
+// The names and values are escaped, so that they can be followed by other fields while keeping
+// their order: each 0x00 byte is written as 0x00 0xff, and the end is marked by 0x00 0x01.
+const (
+	escapeByte    = 0x00
+	escapedEscape = 0xff
+	terminator    = 0x01
+)
+
+// appendEscaped appends the escaped b to dst.
+func appendEscaped(dst, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, c)
+		if c == escapeByte {
+			dst = append(dst, escapedEscape)
+		}
+	}
+	return append(dst, escapeByte, terminator)
+}
+
+// readEscaped reads an escaped field from the start of b. It returns the field and the rest of b.
+func readEscaped(b []byte) ([]byte, []byte, bool) {
+	var out []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] != escapeByte {
+			out = append(out, b[i])
+			continue
+		}
+		if i+1 == len(b) {
+			return nil, nil, false
+		}
+		i++
+		switch b[i] {
+		case escapedEscape:
+			out = append(out, escapeByte)
+		case terminator:
+			return out, b[i+1:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
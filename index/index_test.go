@@ -0,0 +1,164 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package index
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// The values of the tests are "city,tag,tag...".
+func testIndexer(t *testing.T) *Indexer {
+	ix, err := New(nil, map[string]Extractor{
+		"city": func(key, val []byte) [][]byte {
+			return bytes.Split(val, []byte(","))[:1]
+		},
+		"tag": func(key, val []byte) [][]byte {
+			return bytes.Split(val, []byte(","))[1:]
+		},
+	})
+	require.NoError(t, err)
+	return ix
+}
+
+func TestIndexer(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	ix := testIndexer(t)
+
+	lookup := func(name, value string) []string {
+		var keys []string
+		require.NoError(t, db.View(func(txn *badger.Txn) error {
+			found, err := ix.Lookup(txn, name, []byte(value))
+			require.NoError(t, err)
+			for _, k := range found {
+				keys = append(keys, string(k))
+			}
+			return nil
+		}))
+		return keys
+	}
+
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		require.NoError(t, ix.Set(txn, []byte("alice"), []byte("paris,a,b")))
+		require.NoError(t, ix.Set(txn, []byte("bob"), []byte("paris,b")))
+		require.NoError(t, ix.Set(txn, []byte("carol"), []byte("rome,a,a")))
+		// The index entries of the transaction are visible to it.
+		keys, err := ix.Lookup(txn, "tag", []byte("a"))
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		return nil
+	}))
+	require.Equal(t, []string{"alice", "bob"}, lookup("city", "paris"))
+	require.Equal(t, []string{"alice", "carol"}, lookup("tag", "a"))
+	require.Equal(t, []string{"alice", "bob"}, lookup("tag", "b"))
+	require.Empty(t, lookup("city", "par"))
+
+	// The old index entries are deleted.
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		require.NoError(t, ix.Set(txn, []byte("alice"), []byte("rome,b")))
+		return ix.Delete(txn, []byte("bob"))
+	}))
+	require.Equal(t, []string(nil), lookup("city", "paris"))
+	require.Equal(t, []string{"alice", "carol"}, lookup("city", "rome"))
+	require.Equal(t, []string{"carol"}, lookup("tag", "a"))
+	require.Equal(t, []string{"alice"}, lookup("tag", "b"))
+
+	// The index entries of a discarded transaction are discarded with it.
+	txn := db.NewTransaction(true)
+	require.NoError(t, ix.Set(txn, []byte("dave"), []byte("rome")))
+	txn.Discard()
+	require.Equal(t, []string{"alice", "carol"}, lookup("city", "rome"))
+
+	require.NoError(t, db.View(func(txn *badger.Txn) error {
+		_, err := ix.Lookup(txn, "country", []byte("it"))
+		require.Equal(t, ErrUnknownIndex, err)
+		return nil
+	}))
+	require.Equal(t, ErrIndexKey, db.Update(func(txn *badger.Txn) error {
+		return ix.Set(txn, append(DefaultPrefix, "key"...), nil)
+	}))
+}
+
+func TestIndexerRange(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	ix := testIndexer(t)
+
+	cities := map[string]string{
+		"k1": "berlin",
+		"k2": "lisbon",
+		"k3": "lisbon\x00x",
+		"k4": "madrid",
+		"k5": "rome",
+		"k6": "",
+	}
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		for k, city := range cities {
+			require.NoError(t, ix.Set(txn, []byte(k), []byte(city)))
+		}
+		return nil
+	}))
+
+	scan := func(r Range) []string {
+		var got []string
+		require.NoError(t, db.View(func(txn *badger.Txn) error {
+			it, err := ix.NewIterator(txn, "city", r)
+			require.NoError(t, err)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.Equal(t, cities[string(it.Key())], string(it.IndexValue()))
+				item, err := it.Item()
+				require.NoError(t, err)
+				require.Equal(t, it.Key(), item.Key())
+				got = append(got, string(it.Key()))
+			}
+			return nil
+		}))
+		return got
+	}
+	require.Equal(t, []string{"k6", "k1", "k2", "k3", "k4", "k5"}, scan(Range{}))
+	require.Equal(t, []string{"k2", "k3", "k4"},
+		scan(Range{Start: []byte("lisbon"), End: []byte("rome")}))
+	require.Equal(t, []string{"k2"}, scan(Range{Start: []byte("lisbon"), End: []byte("lisbon\x00")}))
+	require.Equal(t, []string{"k4", "k5"}, scan(Range{Start: []byte("m")}))
+	require.Equal(t, []string{"k6", "k1"}, scan(Range{End: []byte("c")}))
+}
+
+func TestEscaped(t *testing.T) {
+	values := [][]byte{nil, {0}, {0, 0}, {0, 1}, {1}, []byte("a"), []byte("a\x00"), []byte("ab")}
+	var prev []byte
+	for _, v := range values {
+		enc := appendEscaped(nil, v)
+		require.True(t, bytes.Compare(prev, enc) < 0, "%q", v)
+		prev = enc
+
+		got, rest, ok := readEscaped(append(enc, "rest"...))
+		require.True(t, ok)
+		require.Equal(t, string(v), string(got))
+		require.Equal(t, "rest", string(rest))
+	}
+	_, _, ok := readEscaped([]byte("a\x00"))
+	require.False(t, ok)
+}
@@ -18,8 +18,11 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"math"
 	"sort"
 	"sync"
@@ -28,6 +31,7 @@ import (
 
 	"github.com/dgraph-io/badger/v3/table"
 	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
 
 	"github.com/dgraph-io/badger/v3/y"
 )
@@ -56,6 +60,15 @@ type Item struct {
 	status   prefetchStatus
 	meta     byte // We need to store meta to know about bitValuePointer.
 	userMeta byte
+	// userMetadata is the user metadata stored after the value, or value pointer, in vptr.
+	userMetadata []byte
+	// release unlocks the value log file the value returned by ValueUnsafe aliases.
+	release func()
+	// iterated is set for the items of an iterator, which releases them as it moves on. The items
+	// of Txn.Get are released by the transaction instead.
+	iterated bool
+	// bufSize is the size of slice accounted in the memory used by the iterators.
+	bufSize int64
 }
 
 // String returns a string representation of Item
@@ -130,6 +143,93 @@ func (item *Item) ValueCopy(dst []byte) ([]byte, error) {
 	return y.SafeCopy(dst, buf), err
 }
 
+// ValueUnsafe returns the value of the item without copying it. The returned slice aliases the
+// memory of the item, or the memory map of the value log file, and must not be modified.
+//
+// The value is only valid until the iterator which returned the item moves on, i.e., until the
+// next call to Next, Seek, Rewind or Close, or for an item returned by Txn.Get, until the
+// transaction is discarded or committed. It must be consumed, or copied, before then. Until then,
+// the value log file the value is read from is kept read locked, so it can't be garbage collected.
+// A value read from the value log file being written is copied, so it doesn't hold up the writes.
+// Use Value or ValueCopy if these rules are too restrictive.
+func (item *Item) ValueUnsafe() ([]byte, error) {
+	item.wg.Wait()
+	if item.status == prefetched {
+		return item.val, item.err
+	}
+	if !item.hasValue() {
+		return nil, nil
+	}
+	if item.meta&bitValuePointer == 0 {
+		// The value is stored in vptr, which the item owns.
+		return item.vptr, nil
+	}
+	item.releaseValue()
+	buf, cb, err := item.yieldItemValue()
+	if err != nil {
+		runCallback(cb)
+		return nil, err
+	}
+	if cb == nil {
+		return buf, nil
+	}
+	var vp valuePointer
+	vp.Decode(item.vptr)
+	if item.txn.db.vlog.writable(vp.Fid) {
+		// The file being written is remapped, under its write lock, once it is full. Holding its
+		// read lock would stall the writes, so the value is copied instead.
+		val := item.slice.Resize(len(buf))
+		copy(val, buf)
+		cb()
+		return val, nil
+	}
+	item.release = cb
+	if !item.iterated {
+		if len(item.txn.unsafeItems) == 0 {
+			// Like for an iterator, the value log files are not deleted while the values are held.
+			item.txn.db.vlog.incrIteratorCount()
+		}
+		item.txn.unsafeItems = append(item.txn.unsafeItems, item)
+	}
+	return buf, nil
+}
+
+// releaseValue unlocks the value log file read by ValueUnsafe, if any.
+func (item *Item) releaseValue() {
+	if item.release != nil {
+		item.release()
+		item.release = nil
+	}
+}
+
+// ValueReader returns a reader which streams the value of the item. Unlike Value and ValueCopy, a
+// value stored in the value log is read from the log file incrementally, so large values don't need
+// to be held in memory as a whole. If VerifyValueChecksum is set, the checksum of the value is
+// verified once the reader reaches the end of the value. A value encrypted with options.AESGCM is
+// decrypted and authenticated as a whole by ValueReader instead.
+//
+// The reader must be closed after use. Until then, the value log file it reads from can't be
+// garbage collected, and DB.Close blocks.
+func (item *Item) ValueReader() (io.ReadCloser, error) {
+	item.wg.Wait()
+	if item.status == prefetched {
+		if item.err != nil {
+			return nil, item.err
+		}
+		return ioutil.NopCloser(bytes.NewReader(item.val)), nil
+	}
+	if !item.hasValue() || item.meta&bitValuePointer == 0 {
+		buf, _, err := item.yieldItemValue()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	var vp valuePointer
+	vp.Decode(item.vptr)
+	return item.txn.db.vlog.newValueReader(vp, item.userMetadataSize())
+}
+
 func (item *Item) hasValue() bool {
 	if item.meta == 0 && item.vptr == nil {
 		// key not found
@@ -162,13 +262,25 @@ func (item *Item) yieldItemValue() ([]byte, func(), error) {
 	if (item.meta & bitValuePointer) == 0 {
 		val := item.slice.Resize(len(item.vptr))
 		copy(val, item.vptr)
+		item.accountBuffer()
 		return val, nil, nil
 	}
 
 	var vp valuePointer
 	vp.Decode(item.vptr)
 	db := item.txn.db
+	span := db.startSpan("Badger.ValueLogRead")
+	if span.IsRecording() {
+		span.SetAttributes(
+			intAttr("fid", int64(vp.Fid)),
+			intAttr("bytes", int64(vp.Len)))
+	}
 	result, cb, err := db.vlog.Read(vp, item.slice)
+	span.End(err)
+	item.accountBuffer()
+	if err == nil {
+		result, _ = splitUserMetadata(item.meta, result)
+	}
 	if err != nil {
 		db.opt.Logger.Errorf("Unable to read: Key: %v, Version : %v, meta: %v, userMeta: %v"+
 			" Error: %v", key, item.version, item.meta, item.userMeta, err)
@@ -197,6 +309,14 @@ func (item *Item) yieldItemValue() ([]byte, func(), error) {
 				item.Key(), item.version, item.meta, item.userMeta, vp)
 		}
 	}
+	if err != nil {
+		// Declared within the branch, as it escapes to the heap, to allocate it on errors only.
+		var cerr *ValueChecksumError
+		if errors.As(err, &cerr) {
+			// A corrupted value must not be mistaken for an empty one.
+			return nil, cb, err
+		}
+	}
 	// Don't return error if we cannot read the value. Just log the error.
 	return result, cb, nil
 }
@@ -219,6 +339,28 @@ func (item *Item) prefetchValue() {
 	buf := item.slice.Resize(len(val))
 	copy(buf, val)
 	item.val = buf
+	item.accountBuffer()
+}
+
+// accountBuffer accounts the growth of the value buffer of an item of an iterator in the memory
+// used by the iterators, which is kept within MemoryBudget.
+func (item *Item) accountBuffer() {
+	if !item.iterated {
+		return
+	}
+	if size := int64(item.slice.Cap()); size != item.bufSize {
+		item.txn.db.mem.addIteratorBuffers(size - item.bufSize)
+		item.bufSize = size
+	}
+}
+
+// releaseBuffer removes the value buffer of an item of a closed iterator from the memory used by
+// the iterators.
+func (item *Item) releaseBuffer() {
+	if item.bufSize != 0 {
+		item.txn.db.mem.addIteratorBuffers(-item.bufSize)
+		item.bufSize = 0
+	}
 }
 
 // EstimatedSize returns the approximate size of the key-value pair.
@@ -261,7 +403,7 @@ func (item *Item) ValueSize() int64 {
 	klen := int64(len(item.key) + 8) // 8 bytes for timestamp.
 	// 6 bytes are for the approximate length of the header. Since header is encoded in varint, we
 	// cannot find the exact length of header without fetching it.
-	return int64(vp.Len) - klen - 6 - crc32.Size
+	return int64(vp.Len) - klen - 6 - crc32.Size - int64(item.userMetadataSize())
 }
 
 // UserMeta returns the userMeta set by the user. Typically, this byte, optionally set by the user
@@ -270,6 +412,23 @@ func (item *Item) UserMeta() byte {
 	return item.userMeta
 }
 
+// UserMetadata returns the user metadata set with Entry.WithUserMetadata, or nil if there is none.
+// It doesn't read the value.
+//
+// UserMetadata is only valid as long as item is valid, or transaction is valid. If you need to use
+// it outside its validity, please copy it.
+func (item *Item) UserMetadata() []byte {
+	return item.userMetadata
+}
+
+// userMetadataSize returns the number of bytes the user metadata takes after the value.
+func (item *Item) userMetadataSize() uint32 {
+	if item.meta&bitUserMetadata == 0 {
+		return 0
+	}
+	return uint32(len(item.userMetadata)) + 1
+}
+
 // ExpiresAt returns a Unix time value indicating when the item will be
 // considered expired. 0 indicates that the item will never expire.
 func (item *Item) ExpiresAt() uint64 {
@@ -331,6 +490,117 @@ type IteratorOptions struct {
 	prefixIsKey bool   // If set, use the prefix for bloom filter lookup.
 	Prefix      []byte // Only iterate over this given prefix.
 	SinceTs     uint64 // Only read data that has version > SinceTs.
+
+	// DistinctPrefixLen, if greater than zero, makes the iterator return only the first key for
+	// every distinct prefix made of the first DistinctPrefixLen bytes of the keys. Keys shorter
+	// than that are their own prefix. After returning a key, Next seeks past all the other keys
+	// with the same prefix, so listing the distinct prefixes (e.g., tenants) doesn't need a scan
+	// over every key. In reverse iteration, the last key of every prefix is returned.
+	DistinctPrefixLen int
+
+	// Scan marks the iteration as a large scan, like a backup or an analytical query. The blocks
+	// it reads from the levels below Options.PinnedBlockCacheLevels are not added to the block
+	// cache, so that the scan doesn't evict the hot blocks. Blocks already in the cache are
+	// still used.
+	Scan bool
+
+	// ReuseItems avoids the allocations made for every item when prefetching values. The values
+	// stored in the LSM tree are copied right away, and the ones in the value log are read by a
+	// few goroutines of the iterator, instead of a goroutine for every item. The items and their
+	// buffers are recycled as the iterator moves, so neither the items nor the slices returned by
+	// Key and Value may be retained after Next. KeyCopy and ValueCopy remain safe.
+	ReuseItems bool
+
+	// LowerBound and UpperBound, if set, restrict the iteration to the keys in [LowerBound,
+	// UpperBound). Together with Prefix, they are used to skip the tables and the blocks which
+	// can't have any key within the range, and are honored by Seek and Rewind in both directions.
+	LowerBound []byte
+	UpperBound []byte
+
+	// Context, if set, cancels the iteration once it is done. The iterator then becomes invalid,
+	// Err returns the error of the context, and the values which weren't prefetched yet aren't
+	// read, so that Item.Value returns the error too.
+	Context context.Context
+
+	// lower and upper are the bounds of the iteration, as derived from LowerBound, UpperBound and
+	// Prefix by setBounds.
+	lower, upper []byte
+}
+
+// prefixSuccessor returns the smallest key greater than all the keys with the given prefix. It
+// returns nil if there's no such key, i.e., the prefix is made of 0xFF bytes only.
+func prefixSuccessor(prefix []byte) []byte {
+	next := y.SafeCopy(nil, prefix)
+	for len(next) > 0 && next[len(next)-1] == 0xFF {
+		next = next[:len(next)-1]
+	}
+	if len(next) == 0 {
+		return nil
+	}
+	next[len(next)-1]++
+	return next
+}
+
+// setBounds computes the bounds of the iteration, narrowing LowerBound and UpperBound down to the
+// range of the keys with the Prefix.
+func (opt *IteratorOptions) setBounds() {
+	opt.lower, opt.upper = opt.LowerBound, opt.UpperBound
+	if len(opt.lower) == 0 {
+		opt.lower = nil
+	}
+	if len(opt.upper) == 0 {
+		opt.upper = nil
+	}
+	if len(opt.Prefix) == 0 {
+		return
+	}
+	var end []byte
+	if opt.prefixIsKey {
+		// The prefix is the key itself. The key followed by a zero byte comes right after it.
+		end = append(y.SafeCopy(nil, opt.Prefix), 0)
+	} else {
+		end = prefixSuccessor(opt.Prefix)
+	}
+	if opt.lower == nil || bytes.Compare(opt.Prefix, opt.lower) > 0 {
+		opt.lower = opt.Prefix
+	}
+	if end != nil && (opt.upper == nil || bytes.Compare(end, opt.upper) < 0) {
+		opt.upper = end
+	}
+}
+
+// inBounds tells whether the key, without the timestamp, is within the bounds of the iteration.
+func (opt *IteratorOptions) inBounds(key []byte) bool {
+	if opt.lower != nil && bytes.Compare(key, opt.lower) < 0 {
+		return false
+	}
+	return opt.upper == nil || bytes.Compare(key, opt.upper) < 0
+}
+
+// overlapsBounds tells whether the table could have a key within the bounds of the iteration.
+func (opt *IteratorOptions) overlapsBounds(t table.TableInterface) bool {
+	if opt.upper != nil && bytes.Compare(y.ParseKey(t.Smallest()), opt.upper) >= 0 {
+		return false
+	}
+	return opt.lower == nil || bytes.Compare(y.ParseKey(t.Biggest()), opt.lower) >= 0
+}
+
+// tablesInBounds returns the tables, sorted by their keys, which overlap the bounds of the
+// iteration.
+func (opt *IteratorOptions) tablesInBounds(all []*table.Table) []*table.Table {
+	if opt.lower != nil {
+		sIdx := sort.Search(len(all), func(i int) bool {
+			return bytes.Compare(y.ParseKey(all[i].Biggest()), opt.lower) >= 0
+		})
+		all = all[sIdx:]
+	}
+	if opt.upper != nil {
+		eIdx := sort.Search(len(all), func(i int) bool {
+			return bytes.Compare(y.ParseKey(all[i].Smallest()), opt.upper) >= 0
+		})
+		all = all[:eIdx]
+	}
+	return all
 }
 
 func (opt *IteratorOptions) compareToPrefix(key []byte) int {
@@ -347,6 +617,9 @@ func (opt *IteratorOptions) pickTable(t table.TableInterface) bool {
 	if t.MaxVersion() < opt.SinceTs {
 		return false
 	}
+	if !opt.overlapsBounds(t) {
+		return false
+	}
 	if len(opt.Prefix) == 0 {
 		return true
 	}
@@ -361,6 +634,9 @@ func (opt *IteratorOptions) pickTable(t table.TableInterface) bool {
 	if opt.prefixIsKey && t.DoesNotHave(y.Hash(opt.Prefix)) {
 		return false
 	}
+	if !opt.prefixIsKey && t.DoesNotHavePrefix(opt.Prefix) {
+		return false
+	}
 	return true
 }
 
@@ -381,6 +657,7 @@ func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
 		return out
 	}
 
+	all = opt.tablesInBounds(all)
 	if len(opt.Prefix) == 0 {
 		out := make([]*table.Table, len(all))
 		copy(out, all)
@@ -401,8 +678,14 @@ func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
 		eIdx := sort.Search(len(filtered), func(i int) bool {
 			return opt.compareToPrefix(filtered[i].Smallest()) > 0
 		})
-		out := make([]*table.Table, len(filtered[:eIdx]))
-		copy(out, filtered[:eIdx])
+		out := make([]*table.Table, 0, eIdx)
+		for _, t := range filtered[:eIdx] {
+			// Tables built with prefix bloom filters can be skipped if they don't have the prefix.
+			if t.DoesNotHavePrefix(opt.Prefix) {
+				continue
+			}
+			out = append(out, t)
+		}
 		return filterTables(out)
 	}
 
@@ -427,6 +710,18 @@ func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
 	return filterTables(out)
 }
 
+// boundedIterator wraps the merge iterator, and becomes invalid as soon as it moves out of the
+// bounds of the iteration. This stops the iteration at the end of the range, instead of parsing the
+// keys beyond it, which might be many if they are deleted or not visible at the read timestamp.
+type boundedIterator struct {
+	y.Iterator
+	opt *IteratorOptions
+}
+
+func (bi *boundedIterator) Valid() bool {
+	return bi.Iterator.Valid() && bi.opt.inBounds(y.ParseKey(bi.Iterator.Key()))
+}
+
 // DefaultIteratorOptions contains default options when iterating over Badger key-value stores.
 var DefaultIteratorOptions = IteratorOptions{
 	PrefetchValues: true,
@@ -458,8 +753,19 @@ type Iterator struct {
 
 	latestTs uint64
 	Alloc    *z.Allocator
+
+	// fetchCh passes the items whose values are to be prefetched to the fetchers, with the
+	// ReuseItems option. It's nil until the first value is prefetched.
+	fetchCh chan *Item
+
+	// err is the error of the context of the iterator, once it is done.
+	err error
 }
 
+// numValueFetchers is the number of goroutines prefetching values from the value log, with the
+// ReuseItems option.
+const numValueFetchers = 8
+
 // NewIterator returns a new iterator. Depending upon the options, either only keys, or both
 // key-value pairs would be fetched. The keys are returned in lexicographically sorted order.
 // Using prefetch is recommended if you're doing a long running iteration, for performance.
@@ -480,6 +786,7 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 
 	// Keep track of the number of active iterators.
 	atomic.AddInt32(&txn.numIterators, 1)
+	opt.setBounds()
 
 	// TODO: If Prefix is set, only pick those memtables which have keys with
 	// the prefix.
@@ -491,7 +798,7 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 		iters = append(iters, itr)
 	}
 	for i := 0; i < len(tables); i++ {
-		iters = append(iters, tables[i].sl.NewUniIterator(opt.Reverse))
+		iters = append(iters, tables[i].NewUniIterator(opt.Reverse))
 	}
 	iters = append(iters, txn.db.lc.iterators(&opt)...) // This will increment references.
 	res := &Iterator{
@@ -500,6 +807,9 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 		opt:    opt,
 		readTs: txn.readTs,
 	}
+	if res.iitr != nil && (res.opt.lower != nil || res.opt.upper != nil) {
+		res.iitr = &boundedIterator{Iterator: res.iitr, opt: &res.opt}
+	}
 	return res
 }
 
@@ -519,7 +829,7 @@ func (txn *Txn) NewKeyIterator(key []byte, opt IteratorOptions) *Iterator {
 func (it *Iterator) newItem() *Item {
 	item := it.waste.pop()
 	if item == nil {
-		item = &Item{slice: new(y.Slice), txn: it.txn}
+		item = &Item{slice: new(y.Slice), txn: it.txn, iterated: true}
 	}
 	return item
 }
@@ -532,6 +842,25 @@ func (it *Iterator) Item() *Item {
 	return it.item
 }
 
+// Err returns the error of IteratorOptions.Context if the iteration was stopped because the
+// context is done, or nil otherwise. Check it once Valid returns false, to tell an iteration
+// which went through all the keys from one which was canceled.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// canceled reports whether the context of the iterator is done, and keeps its error if so.
+func (it *Iterator) canceled() bool {
+	if it.opt.Context == nil {
+		return false
+	}
+	if err := it.opt.Context.Err(); err != nil {
+		it.err = err
+		return true
+	}
+	return false
+}
+
 // Valid returns false when iteration is done.
 func (it *Iterator) Valid() bool {
 	if it.item == nil {
@@ -540,7 +869,7 @@ func (it *Iterator) Valid() bool {
 	if it.opt.prefixIsKey {
 		return bytes.Equal(it.item.key, it.opt.Prefix)
 	}
-	return bytes.HasPrefix(it.item.key, it.opt.Prefix)
+	return bytes.HasPrefix(it.item.key, it.opt.Prefix) && it.opt.inBounds(it.item.key)
 }
 
 // ValidForPrefix returns false when iteration is done
@@ -567,11 +896,21 @@ func (it *Iterator) Close() {
 		item := l.pop()
 		for item != nil {
 			item.wg.Wait()
+			item.releaseValue()
+			item.releaseBuffer()
 			item = l.pop()
 		}
 	}
+	if it.item != nil {
+		it.item.wg.Wait()
+		it.item.releaseValue()
+		it.item.releaseBuffer()
+	}
 	waitFor(it.waste)
 	waitFor(it.data)
+	if it.fetchCh != nil {
+		close(it.fetchCh)
+	}
 
 	// TODO: We could handle this error.
 	_ = it.txn.db.vlog.decrIteratorCount()
@@ -584,10 +923,54 @@ func (it *Iterator) Next() {
 	if it.iitr == nil {
 		return
 	}
+	if it.opt.DistinctPrefixLen > 0 && it.item != nil {
+		it.skipToNextPrefix()
+		return
+	}
+	it.next()
+}
+
+// skipToNextPrefix moves the iterator to the first key which doesn't share the DistinctPrefixLen
+// bytes long prefix of the current key.
+func (it *Iterator) skipToNextPrefix() {
+	prefix := it.item.key
+	if len(prefix) > it.opt.DistinctPrefixLen {
+		prefix = prefix[:it.opt.DistinctPrefixLen]
+	}
+	prefix = y.SafeCopy(nil, prefix)
+	it.item.wg.Wait()
+	it.item.releaseValue()
+	it.waste.push(it.item)
+	it.item = nil
+
+	if it.opt.Reverse {
+		// All the keys with the prefix are >= prefix. Seek would land on the prefix itself if
+		// it is a key, so step over it.
+		it.Seek(prefix)
+		for it.Valid() && bytes.HasPrefix(it.item.key, prefix) {
+			it.next()
+		}
+		return
+	}
+
+	next := prefixSuccessor(prefix)
+	if next == nil {
+		// No key can follow this prefix. We're done.
+		return
+	}
+	it.Seek(next)
+}
+
+func (it *Iterator) next() {
 	// Reuse current item
 	it.item.wg.Wait() // Just cleaner to wait before pushing to avoid doing ref counting.
 	it.scanned += len(it.item.key) + len(it.item.val) + len(it.item.vptr) + 2
+	it.item.releaseValue()
 	it.waste.push(it.item)
+	if it.canceled() {
+		it.item = nil
+		return
+	}
 
 	// Set next item to current
 	it.item = it.data.pop()
@@ -719,27 +1102,65 @@ func (it *Iterator) fill(item *Item) {
 	item.key = y.SafeCopy(item.key, y.ParseKey(it.iitr.Key()))
 
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
+	item.vptr, item.userMetadata = splitUserMetadata(item.meta, item.vptr)
 	item.val = nil
+	if it.opt.PrefetchValues && it.opt.ReuseItems {
+		it.fetchValue(item)
+		return
+	}
 	if it.opt.PrefetchValues {
 		item.wg.Add(1)
 		go func() {
 			// FIXME we are not handling errors here.
-			item.prefetchValue()
+			it.prefetchValue(item)
 			item.wg.Done()
 		}()
 	}
 }
 
+// fetchValue prefetches the value of the item for the ReuseItems option.
+func (it *Iterator) fetchValue(item *Item) {
+	if item.meta&bitValuePointer == 0 {
+		// The value is right there. Copying it is cheaper than handing it over.
+		item.prefetchValue()
+		return
+	}
+	if it.fetchCh == nil {
+		it.fetchCh = make(chan *Item, numValueFetchers)
+		for i := 0; i < numValueFetchers; i++ {
+			go func(ch chan *Item) {
+				for item := range ch {
+					it.prefetchValue(item)
+					item.wg.Done()
+				}
+			}(it.fetchCh)
+		}
+	}
+	item.wg.Add(1)
+	it.fetchCh <- item
+}
+
+// prefetchValue prefetches the value of the item, unless the context of the iterator is done.
+func (it *Iterator) prefetchValue(item *Item) {
+	if ctx := it.opt.Context; ctx != nil && ctx.Err() != nil {
+		item.err = ctx.Err()
+		item.status = prefetched
+		return
+	}
+	item.prefetchValue()
+}
+
 func (it *Iterator) prefetch() {
 	prefetchSize := 2
 	if it.opt.PrefetchValues && it.opt.PrefetchSize > 1 {
 		prefetchSize = it.opt.PrefetchSize
 	}
 
+	span := it.txn.db.startSpan("Badger.Iterator.Prefetch")
 	i := it.iitr
 	var count int
 	it.item = nil
-	for i.Valid() {
+	for i.Valid() && !it.canceled() {
 		if !it.parseItem() {
 			continue
 		}
@@ -748,11 +1169,22 @@ func (it *Iterator) prefetch() {
 			break
 		}
 	}
+	if it.err != nil && it.item != nil {
+		it.item.wg.Wait()
+		it.item.releaseValue()
+		it.waste.push(it.item)
+		it.item = nil
+	}
+	if span.IsRecording() {
+		span.SetAttributes(intAttr("items", int64(count)))
+	}
+	span.End(nil)
 }
 
 // Seek would seek to the provided key if present. If absent, it would seek to the next
 // smallest key greater than the provided key if iterating in the forward direction.
-// Behavior would be reversed if iterating backwards.
+// Behavior would be reversed if iterating backwards, i.e., it would seek to the largest key smaller
+// than or equal to the provided key. An empty key is the same as Rewind.
 func (it *Iterator) Seek(key []byte) uint64 {
 	if it.iitr == nil {
 		return it.latestTs
@@ -760,13 +1192,29 @@ func (it *Iterator) Seek(key []byte) uint64 {
 	if len(key) > 0 {
 		it.txn.addReadKey(key)
 	}
+	if it.item != nil {
+		it.item.releaseValue()
+	}
 	for i := it.data.pop(); i != nil; i = it.data.pop() {
 		i.wg.Wait()
+		i.releaseValue()
 		it.waste.push(i)
 	}
 
 	it.lastKey = it.lastKey[:0]
-	if len(key) == 0 {
+	if it.opt.Reverse && it.opt.upper != nil &&
+		(len(key) == 0 || bytes.Compare(key, it.opt.upper) >= 0) {
+		// The smallest version of the upper bound comes right after all the keys below it.
+		it.iitr.Seek(y.KeyWithTs(it.opt.upper, math.MaxUint64))
+		it.prefetch()
+		return it.latestTs
+	}
+	if !it.opt.Reverse && it.opt.lower != nil && bytes.Compare(key, it.opt.lower) < 0 {
+		key = it.opt.lower
+	}
+	// In reverse, the prefix is the smallest key to iterate over, not the one to start from. If
+	// the prefix has no upper bound, i.e., it's made of 0xFF bytes, start from the last key.
+	if len(key) == 0 && !it.opt.Reverse {
 		key = it.opt.Prefix
 	}
 	if len(key) == 0 {
@@ -789,7 +1237,54 @@ func (it *Iterator) Seek(key []byte) uint64 {
 
 // Rewind would rewind the iterator cursor all the way to zero-th position, which would be the
 // smallest key if iterating forward, and largest if iterating backward. It does not keep track of
-// whether the cursor started with a Seek().
+// whether the cursor started with a Seek(). With a Prefix, Rewind goes to the largest key with the
+// prefix when iterating backward, so there's no need to seek to the prefix followed by 0xFF bytes.
 func (it *Iterator) Rewind() {
 	it.Seek(nil)
 }
+
+// SeekToFirst moves the iterator to the smallest key, irrespective of the direction of the
+// iteration. When iterating backward, the iterator becomes invalid after the following Next.
+func (it *Iterator) SeekToFirst() {
+	if !it.opt.Reverse {
+		it.Rewind()
+		return
+	}
+	it.seekToEnd()
+}
+
+// SeekToLast moves the iterator to the largest key, irrespective of the direction of the
+// iteration. When iterating forward, the iterator becomes invalid after the following Next.
+func (it *Iterator) SeekToLast() {
+	if it.opt.Reverse {
+		it.Rewind()
+		return
+	}
+	it.seekToEnd()
+}
+
+// seekToEnd moves the iterator to the key at the far end of the iteration, i.e., the largest key
+// when iterating forward. The key is found by an iterator going in the opposite direction, as the
+// merge iterator only goes one way.
+func (it *Iterator) seekToEnd() {
+	if it.iitr == nil {
+		return
+	}
+	opt := it.opt
+	opt.Reverse = !opt.Reverse
+	opt.PrefetchValues = false
+	opt.DistinctPrefixLen = 0
+	other := it.txn.NewIterator(opt)
+	other.Rewind()
+	var key []byte
+	if other.Valid() {
+		key = other.Item().KeyCopy(nil)
+	}
+	other.Close()
+	if key == nil {
+		// There's no key to iterate over.
+		it.Rewind()
+		return
+	}
+	it.Seek(key)
+}
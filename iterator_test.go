@@ -18,6 +18,7 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -26,6 +27,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/table"
@@ -37,10 +39,11 @@ type tableMock struct {
 	left, right []byte
 }
 
-func (tm *tableMock) Smallest() []byte             { return tm.left }
-func (tm *tableMock) Biggest() []byte              { return tm.right }
-func (tm *tableMock) DoesNotHave(hash uint32) bool { return false }
-func (tm *tableMock) MaxVersion() uint64           { return math.MaxUint64 }
+func (tm *tableMock) Smallest() []byte                     { return tm.left }
+func (tm *tableMock) Biggest() []byte                      { return tm.right }
+func (tm *tableMock) DoesNotHave(hash uint32) bool         { return false }
+func (tm *tableMock) DoesNotHavePrefix(prefix []byte) bool { return false }
+func (tm *tableMock) MaxVersion() uint64                   { return math.MaxUint64 }
 
 func TestPickTables(t *testing.T) {
 	opt := DefaultIteratorOptions
@@ -124,6 +127,83 @@ func TestPickSortTables(t *testing.T) {
 	require.Equal(t, y.ParseKey(filtered[0].Biggest()), []byte("abc"))
 }
 
+func TestPickPrefixBloomTables(t *testing.T) {
+	opts := table.Options{ChkMode: options.OnTableAndBlockRead, BloomPrefixLength: 3}
+	t1 := buildTable(t, [][]string{{"aaa1", "v"}, {"ccc1", "v"}}, opts)
+	defer t1.DecrRef()
+	t2 := buildTable(t, [][]string{{"bbb1", "v"}, {"bbb2", "v"}}, opts)
+	defer t2.DecrRef()
+	tables := []*table.Table{t1, t2}
+
+	opt := DefaultIteratorOptions
+	opt.Prefix = []byte("bbb")
+	require.False(t, opt.pickTable(t1))
+	require.True(t, opt.pickTable(t2))
+	require.Equal(t, []*table.Table{t2}, opt.pickTables(tables))
+
+	// Only the first BloomPrefixLength bytes of a longer prefix are looked up.
+	opt.Prefix = []byte("bbb2")
+	require.Equal(t, []*table.Table{t2}, opt.pickTables(tables))
+
+	// Shorter prefixes can't use the bloom filter.
+	opt.Prefix = []byte("bb")
+	require.Equal(t, []*table.Table{t1, t2}, opt.pickTables(tables))
+
+	// Tables built without prefixes in the bloom filter are picked based on their key range.
+	t3 := buildTable(t, [][]string{{"aaa1", "v"}, {"ccc1", "v"}}, table.Options{})
+	defer t3.DecrRef()
+	opt.Prefix = []byte("bbb")
+	require.True(t, opt.pickTable(t3))
+}
+
+func TestIterateBloomPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithBloomPrefixLength(4)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for _, tenant := range []string{"aaaa", "cccc", "eeee"} {
+		txn := db.NewTransaction(true)
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("%s%04d", tenant, i))
+			require.NoError(t, txn.SetEntry(NewEntry(k, []byte("v"))))
+		}
+		require.NoError(t, txn.Commit())
+	}
+	// Closing the DB flushes the memtable to a table which overlaps with all the prefixes.
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Equal(t, 1, len(db.Tables()))
+
+	count := func(prefix string) int {
+		opt := DefaultIteratorOptions
+		opt.Prefix = []byte(prefix)
+		var n int
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(opt)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				n++
+			}
+			return nil
+		}))
+		return n
+	}
+	require.Equal(t, 100, count("cccc"))
+	require.Equal(t, 10, count("eeee005"))
+	require.Equal(t, 0, count("bbbb"))
+	require.Equal(t, 300, count(""))
+
+	tables := db.lc.levels[0].tables
+	require.False(t, tables[0].DoesNotHavePrefix([]byte("cccc")))
+	require.True(t, tables[0].DoesNotHavePrefix([]byte("bbbb")))
+}
+
 func TestIterateSinceTs(t *testing.T) {
 	bkey := func(i int) []byte {
 		return []byte(fmt.Sprintf("%04d", i))
@@ -178,6 +258,393 @@ func TestIterateSinceTsWithPendingWrites(t *testing.T) {
 	})
 }
 
+func TestIterateDistinctPrefix(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		tff := "t\xff/a"
+		// Keys whose prefix is all 0xFF bytes have no successor.
+		ffx, ffy := "\xff\xffx", "\xff\xffy"
+		keys := []string{"t1", "t1/a", "t1/b", "t2/a", "t2/b", "t2/c", tff, "u3/a", "u3/b", ffx, ffy}
+		batch := db.NewWriteBatch()
+		for _, k := range keys {
+			require.NoError(t, batch.Set([]byte(k), []byte("v")))
+		}
+		require.NoError(t, batch.Flush())
+
+		collect := func(opt IteratorOptions) []string {
+			var out []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				it := txn.NewIterator(opt)
+				defer it.Close()
+				for it.Rewind(); it.Valid(); it.Next() {
+					out = append(out, string(it.Item().Key()))
+				}
+				return nil
+			}))
+			return out
+		}
+
+		opt := DefaultIteratorOptions
+		opt.DistinctPrefixLen = 2
+		require.Equal(t, []string{"t1", "t2/a", tff, "u3/a", ffx}, collect(opt))
+
+		opt.Reverse = true
+		require.Equal(t, []string{ffy, "u3/b", tff, "t2/c", "t1/b"}, collect(opt))
+
+		opt = DefaultIteratorOptions
+		opt.Prefix = []byte("t")
+		opt.DistinctPrefixLen = 2
+		require.Equal(t, []string{"t1", "t2/a", tff}, collect(opt))
+	})
+}
+
+func TestIterateBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	write := func(from, to int) {
+		batch := db.NewWriteBatch()
+		for i := from; i < to; i++ {
+			k := []byte(fmt.Sprintf("k%04d", i))
+			require.NoError(t, batch.Set(k, k))
+		}
+		require.NoError(t, batch.Flush())
+	}
+	// The first half of the keys goes to the tables, the second half stays in the memtable.
+	write(0, 500)
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	write(500, 1000)
+
+	collect := func(opt IteratorOptions, seek string) []string {
+		var out []string
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(opt)
+			defer it.Close()
+			for it.Seek([]byte(seek)); it.Valid(); it.Next() {
+				out = append(out, string(it.Item().Key()))
+			}
+			return nil
+		}))
+		return out
+	}
+	keys := func(from, to int) []string {
+		var out []string
+		for i := from; i < to; i++ {
+			out = append(out, fmt.Sprintf("k%04d", i))
+		}
+		return out
+	}
+	reversed := func(in []string) []string {
+		out := make([]string, 0, len(in))
+		for i := len(in) - 1; i >= 0; i-- {
+			out = append(out, in[i])
+		}
+		return out
+	}
+
+	iopt := DefaultIteratorOptions
+	iopt.LowerBound = []byte("k0490")
+	iopt.UpperBound = []byte("k0510")
+	require.Equal(t, keys(490, 510), collect(iopt, ""))
+	require.Equal(t, keys(490, 510), collect(iopt, "a"))
+	require.Equal(t, keys(500, 510), collect(iopt, "k0500"))
+	require.Empty(t, collect(iopt, "k0510"))
+
+	iopt.Reverse = true
+	require.Equal(t, reversed(keys(490, 510)), collect(iopt, ""))
+	require.Equal(t, reversed(keys(490, 510)), collect(iopt, "z"))
+	require.Equal(t, reversed(keys(490, 500)), collect(iopt, "k0499"))
+	require.Empty(t, collect(iopt, "k0489"))
+
+	// The bounds are narrowed down to the prefix.
+	iopt = DefaultIteratorOptions
+	iopt.Prefix = []byte("k04")
+	iopt.UpperBound = []byte("k0405")
+	require.Equal(t, keys(400, 405), collect(iopt, ""))
+	iopt.Reverse = true
+	require.Equal(t, reversed(keys(400, 405)), collect(iopt, ""))
+
+	// Rewinding in reverse starts from the last key with the prefix.
+	iopt.UpperBound = nil
+	require.Equal(t, reversed(keys(400, 500)), collect(iopt, ""))
+}
+
+func TestIterateReversePrefix(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		keys := []string{"a", "ab", "ab\x00", "abc", "abd", "ac", "\xff\xff", "\xff\xff\x01"}
+		batch := db.NewWriteBatch()
+		for _, k := range keys {
+			require.NoError(t, batch.Set([]byte(k), []byte("v")))
+		}
+		require.NoError(t, batch.Flush())
+
+		collect := func(prefix, seek string) []string {
+			var out []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				opt := DefaultIteratorOptions
+				opt.Reverse = true
+				opt.Prefix = []byte(prefix)
+				it := txn.NewIterator(opt)
+				defer it.Close()
+				for it.Seek([]byte(seek)); it.Valid(); it.Next() {
+					out = append(out, string(it.Item().Key()))
+				}
+				return nil
+			}))
+			return out
+		}
+
+		// Rewind starts from the last key with the prefix, and stops at the prefix itself.
+		require.Equal(t, []string{"abd", "abc", "ab\x00", "ab"}, collect("ab", ""))
+		require.Equal(t, []string{"\xff\xff\x01", "\xff\xff"}, collect("\xff\xff", ""))
+		require.Empty(t, collect("b", ""))
+
+		// Seek goes to the largest key smaller than or equal to the given one.
+		require.Equal(t, []string{"abc", "ab\x00", "ab"}, collect("ab", "abc"))
+		require.Equal(t, []string{"ab\x00", "ab"}, collect("ab", "abb"))
+		require.Equal(t, []string{"abd", "abc", "ab\x00", "ab"}, collect("ab", "b"))
+		require.Equal(t, []string{"ab"}, collect("ab", "ab"))
+		require.Empty(t, collect("ab", "aa"))
+		require.Equal(t, []string{"ac", "abd", "abc", "ab\x00", "ab", "a"}, collect("", "zz"))
+		require.Empty(t, collect("", "0"))
+	})
+}
+
+func TestIteratorSeekToFirstAndLast(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for _, k := range []string{"a", "b1", "b2", "b3", "c"} {
+			txnSet(t, db, []byte(k), []byte("v"), 0)
+		}
+		txnDelete(t, db, []byte("b3"))
+
+		check := func(opt IteratorOptions, first, last string) {
+			require.NoError(t, db.View(func(txn *Txn) error {
+				it := txn.NewIterator(opt)
+				defer it.Close()
+				for i := 0; i < 2; i++ {
+					it.SeekToLast()
+					require.True(t, it.Valid())
+					require.Equal(t, last, string(it.Item().Key()))
+					it.SeekToFirst()
+					require.True(t, it.Valid())
+					require.Equal(t, first, string(it.Item().Key()))
+				}
+				// Iterating forward from the last key, or backward from the first one, ends.
+				if opt.Reverse {
+					it.SeekToFirst()
+				} else {
+					it.SeekToLast()
+				}
+				it.Next()
+				require.False(t, it.Valid())
+				return nil
+			}))
+		}
+		check(DefaultIteratorOptions, "a", "c")
+		check(IteratorOptions{Reverse: true}, "a", "c")
+		check(IteratorOptions{Prefix: []byte("b")}, "b1", "b2")
+		check(IteratorOptions{Prefix: []byte("b"), Reverse: true}, "b1", "b2")
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(IteratorOptions{Prefix: []byte("d")})
+			defer it.Close()
+			it.SeekToLast()
+			require.False(t, it.Valid())
+			it.SeekToFirst()
+			require.False(t, it.Valid())
+			return nil
+		}))
+	})
+}
+
+func TestIteratorReuseItems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(64)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	n := 2000
+	value := func(i int) []byte {
+		// Half of the values go to the value log.
+		if i%2 == 0 {
+			return bytes.Repeat([]byte{byte(i)}, 100)
+		}
+		return []byte(fmt.Sprintf("%d", i))
+	}
+	batch := db.NewWriteBatch()
+	for i := 0; i < n; i++ {
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%04d", i)), value(i)))
+	}
+	require.NoError(t, batch.Flush())
+
+	iopt := DefaultIteratorOptions
+	iopt.ReuseItems = true
+	require.NoError(t, db.View(func(txn *Txn) error {
+		it := txn.NewIterator(iopt)
+		defer it.Close()
+		var i int
+		var copies [][]byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			require.Equal(t, fmt.Sprintf("key%04d", i), string(item.Key()))
+			require.Equal(t, value(i), getItemValue(t, item))
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			copies = append(copies, val)
+			i++
+		}
+		require.Equal(t, n, i)
+		// The copies aren't affected by the recycling of the items.
+		for i, val := range copies {
+			require.Equal(t, value(i), val)
+		}
+		return nil
+	}))
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	allocs := testing.AllocsPerRun(5, func() {
+		it := txn.NewIterator(iopt)
+		for it.Rewind(); it.Valid(); it.Next() {
+			_ = it.Item().Value(func(val []byte) error { return nil })
+		}
+		it.Close()
+	})
+	require.Less(t, allocs/float64(n), 0.5)
+}
+
+func TestItemValueUnsafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(64)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	n := 100
+	value := func(i int) []byte {
+		// Half of the values go to the value log.
+		if i%2 == 0 {
+			return bytes.Repeat([]byte{byte(i)}, 100)
+		}
+		return []byte(fmt.Sprintf("%d", i))
+	}
+	batch := db.NewWriteBatch()
+	for i := 0; i < n; i++ {
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%04d", i)), value(i)))
+	}
+	require.NoError(t, batch.Flush())
+	// The values are read from a value log file which is no longer written.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	for _, prefetch := range []bool{false, true} {
+		iopt := DefaultIteratorOptions
+		iopt.PrefetchValues = prefetch
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(iopt)
+			defer it.Close()
+			var i int
+			var prev *Item
+			for it.Rewind(); it.Valid(); it.Next() {
+				// The value read by the previous item has been released.
+				if prev != nil {
+					require.Nil(t, prev.release)
+				}
+				item := it.Item()
+				val, err := item.ValueUnsafe()
+				require.NoError(t, err)
+				require.Equal(t, value(i), val)
+				prev = item
+				i++
+			}
+			require.Equal(t, n, i)
+			return nil
+		}))
+	}
+
+	txn := db.NewTransaction(false)
+	var items []*Item
+	for i := 0; i < 4; i++ {
+		item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+		require.NoError(t, err)
+		val, err := item.ValueUnsafe()
+		require.NoError(t, err)
+		require.Equal(t, value(i), val)
+		items = append(items, item)
+	}
+	// Only the values read from the value log are held until the end of the transaction.
+	require.Len(t, txn.unsafeItems, 2)
+	txn.Discard()
+	for _, item := range items {
+		require.Nil(t, item.release)
+	}
+}
+
+func TestItemValueUnsafeWritableFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(64).WithValueLogFileSize(1 << 20)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	value := bytes.Repeat([]byte("a"), 100)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key"), value)
+	}))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueUnsafe()
+			if err != nil {
+				return err
+			}
+			// The value was read from the file being written, so it's copied.
+			if item.release != nil || len(txn.unsafeItems) != 0 {
+				return fmt.Errorf("value log file held by ValueUnsafe")
+			}
+			// Fill up the value log file while the value is held.
+			big := make([]byte, 1<<10)
+			for i := 0; i < 2<<10; i++ {
+				if err := db.Update(func(txn *Txn) error {
+					return txn.Set([]byte(fmt.Sprintf("big%04d", i)), big)
+				}); err != nil {
+					return err
+				}
+			}
+			if !bytes.Equal(value, val) {
+				return fmt.Errorf("value changed")
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Minute):
+		t.Fatal("writes stalled by ValueUnsafe")
+	}
+	require.Greater(t, len(db.vlog.filesMap), 1)
+}
+
 func TestIteratePrefix(t *testing.T) {
 	if !*manual {
 		t.Skip("Skipping test meant to be run manually.")
@@ -292,6 +759,57 @@ func TestIteratePrefix(t *testing.T) {
 }
 
 // Sanity test to verify the iterator does not crash the db in readonly mode if data does not exist.
+func TestIteratorContext(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		for _, reuse := range []bool{false, true} {
+			ctx, cancel := context.WithCancel(context.Background())
+			opt := DefaultIteratorOptions
+			opt.Context = ctx
+			opt.ReuseItems = reuse
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				var count int
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					if count++; count == 10 {
+						cancel()
+					}
+				}
+				require.Equal(t, 10, count)
+				require.Equal(t, context.Canceled, itr.Err())
+
+				// The iterator is invalid from the start once the context is done.
+				itr2 := txn.NewIterator(opt)
+				defer itr2.Close()
+				itr2.Rewind()
+				require.False(t, itr2.Valid())
+				require.Equal(t, context.Canceled, itr2.Err())
+				return nil
+			}))
+		}
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			itr := txn.NewIterator(DefaultIteratorOptions)
+			defer itr.Close()
+			var count int
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				count++
+			}
+			require.Equal(t, 100, count)
+			require.NoError(t, itr.Err())
+			return nil
+		}))
+	})
+}
+
 func TestIteratorReadOnlyWithNoData(t *testing.T) {
 	dir, err := ioutil.TempDir(".", "badger-test")
 	y.Check(err)
@@ -415,3 +933,67 @@ func BenchmarkIteratePrefixSingleKey(b *testing.B) {
 		}
 	})
 }
+
+func TestIteratePinnedBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).
+		WithPinnedBlockCacheSize(1 << 20).
+		WithPinnedBlockCacheLevels(1)
+
+	var n int
+	write := func(compact bool) *DB {
+		db, err := Open(opt.WithCompactL0OnClose(compact))
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("key%04d", n))
+				if err := txn.Set(k, []byte("value")); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+
+		db, err = Open(opt)
+		require.NoError(t, err)
+		return db
+	}
+	iterate := func(db *DB, scan bool) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			iopt := DefaultIteratorOptions
+			iopt.Scan = scan
+			it := txn.NewIterator(iopt)
+			defer it.Close()
+			var count int
+			for it.Rewind(); it.Valid(); it.Next() {
+				count++
+			}
+			require.Equal(t, n, count)
+			return nil
+		}))
+		db.blockCache.Wait()
+		db.pinnedBlockCache.Wait()
+	}
+
+	// A scan doesn't add the blocks of the tables below L0 to the block cache.
+	db := write(true)
+	require.Zero(t, db.lc.levels[0].numTables())
+	iterate(db, true)
+	require.Zero(t, db.BlockCacheMetrics().KeysAdded())
+	iterate(db, false)
+	require.Greater(t, db.BlockCacheMetrics().KeysAdded(), uint64(0))
+	require.Zero(t, db.PinnedBlockCacheMetrics().KeysAdded())
+	require.NoError(t, db.Close())
+
+	// The blocks of the L0 tables are cached in the pinned cache, even by a scan.
+	db = write(false)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Equal(t, 1, db.lc.levels[0].numTables())
+	iterate(db, true)
+	require.Greater(t, db.PinnedBlockCacheMetrics().KeysAdded(), uint64(0))
+	require.Zero(t, db.BlockCacheMetrics().KeysAdded())
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// KeyProvider provides the master key encrypting the data keys of the key registry, in place of
+// Options.EncryptionKey. It lets the master key be kept in a KMS, Vault or an HSM, instead of in a
+// file next to the DB.
+//
+// Each version of the master key has an ID, which is stored in plain text in the key registry, so
+// that the version which encrypted it can be fetched when the DB is opened. The versions of the
+// master key are cached by ID, so they must not change.
+type KeyProvider interface {
+	// GetKey returns the version of the master key with the given ID, or the current version if
+	// the ID is empty, along with its ID. The key must be 16, 24 or 32 bytes long.
+	GetKey(id string) (string, []byte, error)
+	// Rotate creates a new version of the master key, which becomes the current one, and returns
+	// its ID.
+	Rotate() (string, error)
+}
+
+// cachedKeyProvider caches the versions of the master key fetched from a KeyProvider. The current
+// version is always fetched, to pick up its rotation.
+type cachedKeyProvider struct {
+	KeyProvider
+
+	sync.Mutex
+	keys map[string][]byte
+}
+
+// cacheKeys returns p caching the versions of the master key it provides.
+func cacheKeys(p KeyProvider) KeyProvider {
+	if _, ok := p.(*cachedKeyProvider); ok || p == nil {
+		return p
+	}
+	return &cachedKeyProvider{KeyProvider: p, keys: make(map[string][]byte)}
+}
+
+func (p *cachedKeyProvider) GetKey(id string) (string, []byte, error) {
+	if id != "" {
+		p.Lock()
+		key, ok := p.keys[id]
+		p.Unlock()
+		if ok {
+			return id, key, nil
+		}
+	}
+	kid, key, err := p.KeyProvider.GetKey(id)
+	if err != nil {
+		return "", nil, y.Wrapf(err, "while getting the master key %q", id)
+	}
+	switch {
+	case kid == "" || len(kid) > math.MaxUint16:
+		return "", nil, errors.Errorf("invalid master key ID %q", kid)
+	case id != "" && kid != id:
+		return "", nil, errors.Errorf("got the master key %q instead of %q", kid, id)
+	case len(key) != 16 && len(key) != 24 && len(key) != 32:
+		return "", nil, y.Wrapf(ErrInvalidEncryptionKey, "master key %q", kid)
+	}
+	p.Lock()
+	p.keys[kid] = key
+	p.Unlock()
+	return kid, key, nil
+}
+
+// keyProviderMagic starts the key registries encrypted with a master key of a KeyProvider. It is
+// followed by the length of the ID of the master key, and the ID.
+var keyProviderMagic = []byte("BdgKProv")
+
+// writeMasterKeyID writes the ID of the master key encrypting the key registry to w.
+func writeMasterKeyID(w io.Writer, id string) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(len(id)))
+	y.Check2(w.Write(keyProviderMagic))
+	y.Check2(w.Write(buf[:]))
+	y.Check2(io.WriteString(w, id))
+}
+
+// readMasterKeyID reads the ID of the master key encrypting the key registry from r. It returns
+// an empty ID, and seeks r back to its start, if the key registry wasn't encrypted with a master
+// key of a KeyProvider.
+func readMasterKeyID(r io.ReadSeeker) (string, error) {
+	magic := make([]byte, len(keyProviderMagic))
+	if _, err := io.ReadFull(r, magic); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", y.Wrapf(err, "while reading the master key ID")
+	}
+	if !bytes.Equal(magic, keyProviderMagic) {
+		_, err := r.Seek(0, io.SeekStart)
+		return "", err
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return "", y.Wrapf(err, "while reading the master key ID")
+	}
+	id := make([]byte, binary.BigEndian.Uint16(buf[:]))
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", y.Wrapf(err, "while reading the master key ID")
+	}
+	return string(id), nil
+}
@@ -25,7 +25,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v3/pb"
@@ -49,8 +51,17 @@ type KeyRegistry struct {
 	dataKeys    map[uint64]*pb.DataKey
 	lastCreated int64 //lastCreated is the timestamp(seconds) of the last data key generated.
 	nextKeyID   uint64
-	fp          *os.File
+	// latestKeyID is the ID of the last data key generated, which isn't the data key of a prefix.
+	latestKeyID uint64
+	fp          y.File
 	opt         KeyRegistryOptions
+	// masterKey encrypts the data keys. It is the EncryptionKey, or the version masterKeyID of
+	// the master key of the KeyProvider.
+	masterKeyID string
+	masterKey   []byte
+	// prefixKeys holds the data keys of the prefixes, sorted by prefix, as a []*pb.DataKey. It is
+	// replaced under the lock, so that it can be read without it.
+	prefixKeys atomic.Value
 }
 
 type KeyRegistryOptions struct {
@@ -59,20 +70,37 @@ type KeyRegistryOptions struct {
 	EncryptionKey                 []byte
 	EncryptionKeyRotationDuration time.Duration
 	InMemory                      bool
+	// KeyProvider provides the master key, in place of EncryptionKey. EncryptionKey is only used
+	// to read a key registry which wasn't encrypted with a master key of the KeyProvider, which is
+	// then re-encrypted with the current one.
+	KeyProvider KeyProvider
+	// FS is the file system Dir is in. The file system of the OS is used if it is nil.
+	FS y.FS
+}
+
+func (opt KeyRegistryOptions) fs() y.FS {
+	if opt.FS == nil {
+		return y.OSFS
+	}
+	return opt.FS
 }
 
 // newKeyRegistry returns KeyRegistry.
 func newKeyRegistry(opt KeyRegistryOptions) *KeyRegistry {
-	return &KeyRegistry{
+	kr := &KeyRegistry{
 		dataKeys:  make(map[uint64]*pb.DataKey),
 		nextKeyID: 0,
 		opt:       opt,
+		masterKey: opt.EncryptionKey,
 	}
+	kr.prefixKeys.Store([]*pb.DataKey(nil))
+	return kr
 }
 
 // OpenKeyRegistry opens key registry if it exists, otherwise it'll create key registry
 // and returns key registry.
 func OpenKeyRegistry(opt KeyRegistryOptions) (*KeyRegistry, error) {
+	opt.KeyProvider = cacheKeys(opt.KeyProvider)
 	// sanity check the encryption key length.
 	if len(opt.EncryptionKey) > 0 {
 		switch len(opt.EncryptionKey) {
@@ -84,7 +112,11 @@ func OpenKeyRegistry(opt KeyRegistryOptions) (*KeyRegistry, error) {
 	}
 	// If db is opened in InMemory mode, we don't need to write key registry to the disk.
 	if opt.InMemory {
-		return newKeyRegistry(opt), nil
+		kr := newKeyRegistry(opt)
+		if err := kr.fetchMasterKey(""); err != nil {
+			return nil, err
+		}
+		return kr, nil
 	}
 	path := filepath.Join(opt.Dir, KeyRegistryFileName)
 	var flags y.Flags
@@ -93,13 +125,16 @@ func OpenKeyRegistry(opt KeyRegistryOptions) (*KeyRegistry, error) {
 	} else {
 		flags |= y.Sync
 	}
-	fp, err := y.OpenExistingFile(path, flags)
+	fp, err := y.OpenExistingFileFS(opt.fs(), path, flags)
 	// OpenExistingFile just open file.
 	// So checking whether the file exist or not. If not
 	// We'll create new keyregistry.
 	if os.IsNotExist(err) {
 		// Creating new registry file if not exist.
 		kr := newKeyRegistry(opt)
+		if err := kr.fetchMasterKey(""); err != nil {
+			return nil, err
+		}
 		if opt.ReadOnly {
 			return kr, nil
 		}
@@ -107,7 +142,7 @@ func OpenKeyRegistry(opt KeyRegistryOptions) (*KeyRegistry, error) {
 		if err := WriteKeyRegistry(kr, opt); err != nil {
 			return nil, y.Wrapf(err, "Error while writing key registry.")
 		}
-		fp, err = y.OpenExistingFile(path, flags)
+		fp, err = y.OpenExistingFileFS(opt.fs(), path, flags)
 		if err != nil {
 			return nil, y.Wrapf(err, "Error while opening newly created key registry.")
 		}
@@ -126,20 +161,120 @@ func OpenKeyRegistry(opt KeyRegistryOptions) (*KeyRegistry, error) {
 		return kr, fp.Close()
 	}
 	kr.fp = fp
+	if err := kr.refreshMasterKey(); err != nil {
+		kr.fp.Close()
+		return nil, err
+	}
 	return kr, nil
 }
 
+// fetchMasterKey fetches the version of the master key of the KeyProvider with the given ID, or
+// the current version if the ID is empty.
+func (kr *KeyRegistry) fetchMasterKey(id string) error {
+	if kr.opt.KeyProvider == nil {
+		return nil
+	}
+	kid, key, err := kr.opt.KeyProvider.GetKey(id)
+	if err != nil {
+		return err
+	}
+	kr.masterKeyID, kr.masterKey = kid, key
+	return nil
+}
+
+// currentMasterKey fetches the current version of the master key of the KeyProvider. It is
+// called without holding the lock, since the KeyProvider may have to call a KMS.
+func (kr *KeyRegistry) currentMasterKey() (string, []byte, error) {
+	if kr.opt.KeyProvider == nil {
+		return "", nil, nil
+	}
+	return kr.opt.KeyProvider.GetKey("")
+}
+
+// refreshMasterKey re-encrypts the key registry with the current master key of the KeyProvider,
+// if it was rotated since the key registry was written.
+func (kr *KeyRegistry) refreshMasterKey() error {
+	id, key, err := kr.currentMasterKey()
+	if err != nil {
+		return err
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	return kr.setMasterKey(id, key)
+}
+
+// setMasterKey re-encrypts the key registry with the given version of the master key of the
+// KeyProvider, if it isn't the one it is encrypted with. The caller must hold the lock.
+func (kr *KeyRegistry) setMasterKey(id string, key []byte) error {
+	if kr.opt.KeyProvider == nil || id == kr.masterKeyID {
+		return nil
+	}
+	oldID, oldKey := kr.masterKeyID, kr.masterKey
+	kr.masterKeyID, kr.masterKey = id, key
+	if kr.opt.InMemory {
+		return nil
+	}
+	if err := kr.rewrite(); err != nil {
+		kr.masterKeyID, kr.masterKey = oldID, oldKey
+		return y.Wrapf(err, "while re-encrypting the key registry with the master key %q", id)
+	}
+	return nil
+}
+
+// rewrite rewrites the key registry file with the data keys of kr. The caller must hold the lock.
+func (kr *KeyRegistry) rewrite() error {
+	if err := WriteKeyRegistry(kr, kr.opt); err != nil {
+		return err
+	}
+	// The data keys are appended to the new file.
+	fp, err := y.OpenExistingFileFS(kr.opt.fs(), filepath.Join(kr.opt.Dir, KeyRegistryFileName),
+		y.Sync)
+	if err != nil {
+		return y.Wrapf(err, "Error while opening rewritten key registry.")
+	}
+	if _, err := fp.Seek(0, io.SeekEnd); err != nil {
+		fp.Close()
+		return y.Wrapf(err, "Error while seeking rewritten key registry.")
+	}
+	if kr.fp != nil {
+		kr.fp.Close()
+	}
+	kr.fp = fp
+	return nil
+}
+
+// encryptionKey returns the master key encrypting the data keys.
+func (kr *KeyRegistry) encryptionKey() []byte {
+	kr.RLock()
+	defer kr.RUnlock()
+	return kr.masterKey
+}
+
+// reload reads the data keys added to a read-only key registry since it was opened.
+func (kr *KeyRegistry) reload() error {
+	fresh, err := OpenKeyRegistry(kr.opt)
+	if err != nil {
+		return err
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	for id, dk := range fresh.dataKeys {
+		kr.dataKeys[id] = dk
+	}
+	return nil
+}
+
 // keyRegistryIterator reads all the datakey from the key registry
 type keyRegistryIterator struct {
 	encryptionKey []byte
-	fp            *os.File
+	fp            y.File
 	// lenCrcBuf contains crc buf and data length to move forward.
 	lenCrcBuf [8]byte
 }
 
 // newKeyRegistryIterator returns iterator which will allow you to iterate
 // over the data key of the key registry.
-func newKeyRegistryIterator(fp *os.File, encryptionKey []byte) (*keyRegistryIterator, error) {
+func newKeyRegistryIterator(fp y.File, encryptionKey []byte) (*keyRegistryIterator, error) {
 	return &keyRegistryIterator{
 		encryptionKey: encryptionKey,
 		fp:            fp,
@@ -148,7 +283,7 @@ func newKeyRegistryIterator(fp *os.File, encryptionKey []byte) (*keyRegistryIter
 }
 
 // validRegistry checks that given encryption key is valid or not.
-func validRegistry(fp *os.File, encryptionKey []byte) error {
+func validRegistry(fp y.File, encryptionKey []byte) error {
 	iv := make([]byte, aes.BlockSize)
 	var err error
 	if _, err = fp.Read(iv); err != nil {
@@ -209,12 +344,25 @@ func (kri *keyRegistryIterator) next() (*pb.DataKey, error) {
 }
 
 // readKeyRegistry will read the key registry file and build the key registry struct.
-func readKeyRegistry(fp *os.File, opt KeyRegistryOptions) (*KeyRegistry, error) {
-	itr, err := newKeyRegistryIterator(fp, opt.EncryptionKey)
+func readKeyRegistry(fp y.File, opt KeyRegistryOptions) (*KeyRegistry, error) {
+	id, err := readMasterKeyID(fp)
 	if err != nil {
 		return nil, err
 	}
 	kr := newKeyRegistry(opt)
+	if id != "" {
+		if opt.KeyProvider == nil {
+			return nil, y.Wrapf(ErrEncryptionKeyMismatch,
+				"the key registry is encrypted with the master key %q of a KeyProvider", id)
+		}
+		if err := kr.fetchMasterKey(id); err != nil {
+			return nil, err
+		}
+	}
+	itr, err := newKeyRegistryIterator(fp, kr.masterKey)
+	if err != nil {
+		return nil, err
+	}
 	var dk *pb.DataKey
 	dk, err = itr.next()
 	for err == nil && dk != nil {
@@ -222,7 +370,12 @@ func readKeyRegistry(fp *os.File, opt KeyRegistryOptions) (*KeyRegistry, error)
 			// Set the maximum key ID for next key ID generation.
 			kr.nextKeyID = dk.KeyId
 		}
-		if dk.CreatedAt > kr.lastCreated {
+		if len(dk.Prefix) > 0 {
+			kr.setPrefixKey(dk)
+		} else if dk.KeyId > kr.latestKeyID {
+			kr.latestKeyID = dk.KeyId
+		}
+		if len(dk.Prefix) == 0 && dk.CreatedAt > kr.lastCreated {
 			// Set the last generated key timestamp.
 			kr.lastCreated = dk.CreatedAt
 		}
@@ -243,6 +396,11 @@ Structure of Key Registry.
 +-------------------+---------------------+--------------------+--------------+------------------+
 |     IV            | Sanity Text         | DataKey1           | DataKey2     | ...              |
 +-------------------+---------------------+--------------------+--------------+------------------+
+
+It is preceded by the ID of the master key if it is encrypted with a master key of a KeyProvider.
++-------------------+---------------------+--------------------+
+| keyProviderMagic  | Master Key ID Len   | Master Key ID      |
++-------------------+---------------------+--------------------+
 */
 
 // WriteKeyRegistry will rewrite the existing key registry file with new one.
@@ -251,11 +409,17 @@ func WriteKeyRegistry(reg *KeyRegistry, opt KeyRegistryOptions) error {
 	buf := &bytes.Buffer{}
 	iv, err := y.GenerateIV()
 	y.Check(err)
+	storageKey := opt.EncryptionKey
+	if opt.KeyProvider != nil && reg.masterKeyID != "" {
+		// The registry is encrypted with its master key of the KeyProvider.
+		writeMasterKeyID(buf, reg.masterKeyID)
+		storageKey = reg.masterKey
+	}
 	// Encrypt sanity text if the encryption key is presents.
 	eSanity := sanityText
-	if len(opt.EncryptionKey) > 0 {
+	if len(storageKey) > 0 {
 		var err error
-		eSanity, err = y.XORBlockAllocate(eSanity, opt.EncryptionKey, iv)
+		eSanity, err = y.XORBlockAllocate(eSanity, storageKey, iv)
 		if err != nil {
 			return y.Wrapf(err, "Error while encrpting sanity text in WriteKeyRegistry")
 		}
@@ -265,13 +429,13 @@ func WriteKeyRegistry(reg *KeyRegistry, opt KeyRegistryOptions) error {
 	// Write all the datakeys to the buf.
 	for _, k := range reg.dataKeys {
 		// Writing the datakey to the given buffer.
-		if err := storeDataKey(buf, opt.EncryptionKey, *k); err != nil {
+		if err := storeDataKey(buf, storageKey, *k); err != nil {
 			return y.Wrapf(err, "Error while storing datakey in WriteKeyRegistry")
 		}
 	}
 	tmpPath := filepath.Join(opt.Dir, KeyRegistryRewriteFileName)
 	// Open temporary file to write the data and do atomic rename.
-	fp, err := y.OpenTruncFile(tmpPath, true)
+	fp, err := y.OpenTruncFileFS(opt.fs(), tmpPath, true)
 	if err != nil {
 		return y.Wrapf(err, "Error while opening tmp file in WriteKeyRegistry")
 	}
@@ -288,11 +452,11 @@ func WriteKeyRegistry(reg *KeyRegistry, opt KeyRegistryOptions) error {
 		return y.Wrapf(err, "Error while closing tmp file in WriteKeyRegistry")
 	}
 	// Rename to the original file.
-	if err = os.Rename(tmpPath, filepath.Join(opt.Dir, KeyRegistryFileName)); err != nil {
+	if err = opt.fs().Rename(tmpPath, filepath.Join(opt.Dir, KeyRegistryFileName)); err != nil {
 		return y.Wrapf(err, "Error while renaming file in WriteKeyRegistry")
 	}
 	// Sync Dir.
-	return syncDir(opt.Dir)
+	return opt.fs().SyncDir(opt.Dir)
 }
 
 // DataKey returns datakey of the given key id.
@@ -314,7 +478,7 @@ func (kr *KeyRegistry) DataKey(id uint64) (*pb.DataKey, error) {
 // period. If the last generated datakey lifetime exceeds the rotation period.
 // It'll create new datakey.
 func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
-	if len(kr.opt.EncryptionKey) == 0 {
+	if len(kr.encryptionKey()) == 0 {
 		// nil is for no encryption.
 		return nil, nil
 	}
@@ -324,7 +488,7 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 		// Time diffrence from the last generated time.
 		diff := time.Since(time.Unix(kr.lastCreated, 0))
 		if diff < kr.opt.EncryptionKeyRotationDuration {
-			return kr.dataKeys[kr.nextKeyID], true
+			return kr.dataKeys[kr.latestKeyID], true
 		}
 		return nil, false
 	}
@@ -335,6 +499,11 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 		// If less than EncryptionKeyRotationDuration, returns the last generated key.
 		return key, nil
 	}
+	// The master key is rotated along with the data keys.
+	mkID, mk, err := kr.currentMasterKey()
+	if err != nil {
+		return nil, err
+	}
 	kr.Lock()
 	defer kr.Unlock()
 	// Key might have generated by another go routine. So,
@@ -342,7 +511,22 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 	if key, valid := validKey(); valid {
 		return key, nil
 	}
-	k := make([]byte, len(kr.opt.EncryptionKey))
+	if err := kr.setMasterKey(mkID, mk); err != nil {
+		return nil, err
+	}
+	dk, err := kr.newDataKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	kr.lastCreated = dk.CreatedAt
+	kr.latestKeyID = dk.KeyId
+	return dk, nil
+}
+
+// newDataKey generates a data key, for the given prefix if it isn't empty, and stores it. The
+// caller must hold the lock.
+func (kr *KeyRegistry) newDataKey(prefix []byte) (*pb.DataKey, error) {
+	k := make([]byte, len(kr.masterKey))
 	iv, err := y.GenerateIV()
 	if err != nil {
 		return nil, err
@@ -358,8 +542,8 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 		Data:      k,
 		CreatedAt: time.Now().Unix(),
 		Iv:        iv,
+		Prefix:    prefix,
 	}
-	kr.lastCreated = dk.CreatedAt
 	kr.dataKeys[kr.nextKeyID] = &dk
 	// Don't store the datakey on file if badger is running in InMemory mode.
 	if kr.opt.InMemory {
@@ -367,18 +551,124 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 
 	}
 	// Store the datekey.
-	if err = storeDataKey(kr.fp, kr.opt.EncryptionKey, dk); err != nil {
+	if err = storeDataKey(kr.fp, kr.masterKey, dk); err != nil {
 		return nil, err
 	}
 	return &dk, nil
 }
 
+// AddPrefixKey generates a data key for the keys with the given prefix, and returns it. It returns
+// the existing data key of the prefix if it has one. The prefix must not be a prefix of another
+// prefix with a data key, or the other way around.
+func (kr *KeyRegistry) AddPrefixKey(prefix []byte) (*pb.DataKey, error) {
+	if len(prefix) == 0 {
+		return nil, errors.New("Cannot add a data key for an empty prefix")
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	if len(kr.masterKey) == 0 {
+		return nil, errors.New("No encryption key found. Cannot add data key")
+	}
+	for _, dk := range kr.prefixKeys.Load().([]*pb.DataKey) {
+		switch {
+		case bytes.Equal(dk.Prefix, prefix):
+			return dk, nil
+		case bytes.HasPrefix(dk.Prefix, prefix) || bytes.HasPrefix(prefix, dk.Prefix):
+			return nil, errors.Errorf("The prefix %q overlaps with the prefix %q of data key %d",
+				prefix, dk.Prefix, dk.KeyId)
+		}
+	}
+	dk, err := kr.newDataKey(y.SafeCopy(nil, prefix))
+	if err != nil {
+		return nil, err
+	}
+	kr.setPrefixKey(dk)
+	return dk, nil
+}
+
+// setPrefixKey makes dk the data key of its prefix. The caller must hold the lock, or be the
+// only user of the key registry.
+func (kr *KeyRegistry) setPrefixKey(dk *pb.DataKey) {
+	old := kr.prefixKeys.Load().([]*pb.DataKey)
+	keys := make([]*pb.DataKey, 0, len(old)+1)
+	for _, k := range old {
+		if !bytes.Equal(k.Prefix, dk.Prefix) {
+			keys = append(keys, k)
+		}
+	}
+	keys = append(keys, dk)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i].Prefix, keys[j].Prefix) < 0 })
+	kr.prefixKeys.Store(keys)
+}
+
+// detachPrefixKey stops using the data key of the given prefix for the new tables, and returns
+// it. It returns nil if the prefix has no data key.
+func (kr *KeyRegistry) detachPrefixKey(prefix []byte) *pb.DataKey {
+	kr.Lock()
+	defer kr.Unlock()
+	old := kr.prefixKeys.Load().([]*pb.DataKey)
+	for i, dk := range old {
+		if bytes.Equal(dk.Prefix, prefix) {
+			keys := append(append([]*pb.DataKey{}, old[:i]...), old[i+1:]...)
+			kr.prefixKeys.Store(keys)
+			return dk
+		}
+	}
+	return nil
+}
+
+// reattachPrefixKey undoes detachPrefixKey.
+func (kr *KeyRegistry) reattachPrefixKey(dk *pb.DataKey) {
+	kr.Lock()
+	defer kr.Unlock()
+	kr.setPrefixKey(dk)
+}
+
+// removeDataKey destroys the data key with the given ID, which was detached from its prefix. The
+// data encrypted with it can't be decrypted anymore.
+func (kr *KeyRegistry) removeDataKey(id uint64) error {
+	kr.Lock()
+	defer kr.Unlock()
+	dk, ok := kr.dataKeys[id]
+	if !ok {
+		return nil
+	}
+	delete(kr.dataKeys, id)
+	if kr.opt.InMemory {
+		return nil
+	}
+	if err := kr.rewrite(); err != nil {
+		kr.dataKeys[id] = dk
+		return y.Wrapf(err, "while removing data key %d", id)
+	}
+	return nil
+}
+
+// prefixDataKey returns the data key of the prefix of key, or nil if it has none.
+func (kr *KeyRegistry) prefixDataKey(key []byte) *pb.DataKey {
+	if kr == nil {
+		return nil
+	}
+	keys := kr.prefixKeys.Load().([]*pb.DataKey)
+	if len(keys) == 0 {
+		return nil
+	}
+	// The prefixes don't overlap, so the prefix of key can only be the last one before it.
+	i := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i].Prefix, key) > 0 })
+	if i > 0 && bytes.HasPrefix(key, keys[i-1].Prefix) {
+		return keys[i-1]
+	}
+	return nil
+}
+
 func (kr *KeyRegistry) AddKey(dk pb.DataKey) (uint64, error) {
 	// If we don't have a encryption key, we cannot store the datakey.
-	if len(kr.opt.EncryptionKey) == 0 {
+	if len(kr.masterKey) == 0 {
 		return 0, errors.New("No encryption key found. Cannot add data key")
 	}
 
+	// The data keys of the prefixes of another DB are plain data keys in this one.
+	dk.Prefix = nil
 	if _, ok := kr.dataKeys[dk.KeyId]; !ok {
 		// If KeyId does not exists already, then use the next available KeyId to store data key.
 		kr.nextKeyID++
@@ -390,7 +680,7 @@ func (kr *KeyRegistry) AddKey(dk pb.DataKey) (uint64, error) {
 		return dk.KeyId, nil
 	}
 	// Store the datakey.
-	return dk.KeyId, storeDataKey(kr.fp, kr.opt.EncryptionKey, dk)
+	return dk.KeyId, storeDataKey(kr.fp, kr.masterKey, dk)
 }
 
 // Close closes the key registry.
@@ -16,10 +16,14 @@
 package badger
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"sync"
 	"testing"
 
+	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/stretchr/testify/require"
 )
 
@@ -157,3 +161,203 @@ func TestKeyRegistryInMemory(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, kr.Close())
 }
+
+// testKeyProvider is a KeyProvider keeping the versions of the master key in memory.
+type testKeyProvider struct {
+	sync.Mutex
+	keys    map[string][]byte
+	current string
+	gets    int
+	// block, if set, is sent to by GetKey, which then waits to receive from it.
+	block chan struct{}
+}
+
+func newTestKeyProvider(t *testing.T) *testKeyProvider {
+	p := &testKeyProvider{keys: make(map[string][]byte)}
+	_, err := p.Rotate()
+	require.NoError(t, err)
+	return p
+}
+
+func (p *testKeyProvider) GetKey(id string) (string, []byte, error) {
+	p.Lock()
+	block := p.block
+	p.Unlock()
+	if block != nil {
+		block <- struct{}{}
+		<-block
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.gets++
+	if id == "" {
+		id = p.current
+	}
+	key, ok := p.keys[id]
+	if !ok {
+		return "", nil, errors.New("no such key")
+	}
+	return id, key, nil
+}
+
+func (p *testKeyProvider) Rotate() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.current = fmt.Sprintf("key-%d", len(p.keys)+1)
+	p.keys[p.current] = key
+	return p.current, nil
+}
+
+func TestKeyProviderRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	p := newTestKeyProvider(t)
+	opt := getRegistryTestOptions(dir, nil)
+	opt.KeyProvider = p
+
+	kr, err := OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	require.Equal(t, "key-1", kr.masterKeyID)
+	dk, err := kr.LatestDataKey()
+	require.NoError(t, err)
+	require.NoError(t, kr.Close())
+
+	// The registry is re-encrypted with the rotated master key when it is opened, and the data keys
+	// are kept.
+	_, err = p.Rotate()
+	require.NoError(t, err)
+	kr, err = OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	require.Equal(t, "key-2", kr.masterKeyID)
+	// And when a new data key is created.
+	_, err = p.Rotate()
+	require.NoError(t, err)
+	kr.lastCreated = 0
+	dk1, err := kr.LatestDataKey()
+	require.NoError(t, err)
+	require.Equal(t, "key-3", kr.masterKeyID)
+	require.NoError(t, kr.Close())
+
+	// The previous versions of the master key aren't needed anymore.
+	delete(p.keys, "key-1")
+	delete(p.keys, "key-2")
+	kr, err = OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	for _, want := range []*pb.DataKey{dk, dk1} {
+		got, err := kr.DataKey(want.KeyId)
+		require.NoError(t, err)
+		require.Equal(t, want.Data, got.Data)
+	}
+	require.NoError(t, kr.Close())
+
+	// The versions of the master key are cached when the registry is reloaded.
+	opt.ReadOnly = true
+	kr, err = OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	gets := p.gets
+	require.NoError(t, kr.reload())
+	require.Equal(t, gets, p.gets)
+	require.NoError(t, kr.Close())
+
+	// The registry can't be read without the KeyProvider.
+	_, err = OpenKeyRegistry(getRegistryTestOptions(dir, nil))
+	require.Equal(t, CodeEncryption, ErrorCode(err))
+}
+
+func TestKeyProviderUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	p := newTestKeyProvider(t)
+	opt := getRegistryTestOptions(dir, nil)
+	opt.KeyProvider = p
+
+	kr, err := OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, kr.Close()) }()
+	dk, err := kr.LatestDataKey()
+	require.NoError(t, err)
+
+	// The data keys can be read while a new one waits for the master key.
+	_, err = p.Rotate()
+	require.NoError(t, err)
+	p.Lock()
+	p.block = make(chan struct{})
+	p.Unlock()
+	kr.Lock()
+	kr.lastCreated = 0
+	kr.Unlock()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := kr.LatestDataKey()
+		errCh <- err
+	}()
+	<-p.block
+	got, err := kr.DataKey(dk.KeyId)
+	require.NoError(t, err)
+	require.Equal(t, dk.Data, got.Data)
+	p.block <- struct{}{}
+	require.NoError(t, <-errCh)
+	require.Equal(t, "key-2", kr.masterKeyID)
+}
+
+func TestKeyProviderMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	encryptionKey := make([]byte, 16)
+	_, err = rand.Read(encryptionKey)
+	require.NoError(t, err)
+
+	opt := getRegistryTestOptions(dir, encryptionKey)
+	kr, err := OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	dk, err := kr.LatestDataKey()
+	require.NoError(t, err)
+	require.NoError(t, kr.Close())
+
+	// The registry encrypted with the EncryptionKey is re-encrypted with the master key of the
+	// KeyProvider.
+	opt.KeyProvider = newTestKeyProvider(t)
+	kr, err = OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	require.NoError(t, kr.Close())
+	opt.EncryptionKey = nil
+	kr, err = OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	got, err := kr.DataKey(dk.KeyId)
+	require.NoError(t, err)
+	require.Equal(t, dk.Data, got.Data)
+	require.NoError(t, kr.Close())
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	p := newTestKeyProvider(t)
+	opt := getTestOptions(dir).WithKeyProvider(p).WithBlockCacheSize(10 << 20).
+		WithIndexCacheSize(10 << 20)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	h := testHelper{db: db, t: t}
+	h.writeRange(0, 99)
+	require.NoError(t, db.RotateMasterKey())
+	require.NoError(t, db.Close())
+
+	delete(p.keys, "key-1")
+	db, err = Open(opt)
+	require.NoError(t, err)
+	h.db = db
+	h.readRange(0, 99)
+	require.NoError(t, db.Close())
+
+	_, err = Open(getTestOptions(dir))
+	require.Error(t, err)
+}
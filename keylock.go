@@ -0,0 +1,161 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// keyLocks is an in-memory table of exclusive key locks held by transactions. Keys are locked by
+// their fingerprints, so two different keys could share a lock, which is harmless.
+type keyLocks struct {
+	sync.Mutex
+	owners  map[uint64]*Txn          // Fingerprint to the txn holding its lock.
+	waiting map[*Txn]uint64          // Txn to the fingerprint it is waiting for.
+	waitChs map[uint64]chan struct{} // Closed when the lock of the fingerprint is released.
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{
+		owners:  make(map[uint64]*Txn),
+		waiting: make(map[*Txn]uint64),
+		waitChs: make(map[uint64]chan struct{}),
+	}
+}
+
+// acquire blocks until txn holds the lock of fp. It returns ErrDeadlock if waiting for the lock
+// would never finish, because its holder is waiting (directly or not) for a lock held by txn.
+func (kl *keyLocks) acquire(txn *Txn, fp uint64) error {
+	kl.Lock()
+	defer kl.Unlock()
+	for {
+		owner, ok := kl.owners[fp]
+		switch {
+		case !ok:
+			kl.owners[fp] = txn
+			txn.locks = append(txn.locks, fp)
+			return nil
+		case owner == txn:
+			return nil
+		}
+		// Follow the chain of waiting txns, starting at the owner. Each txn waits for at most one
+		// lock, so we either reach a txn which isn't waiting, or find a cycle back to txn.
+		for o := owner; o != nil; {
+			if o == txn {
+				return ErrDeadlock
+			}
+			wfp, ok := kl.waiting[o]
+			if !ok {
+				break
+			}
+			o = kl.owners[wfp]
+		}
+
+		ch, ok := kl.waitChs[fp]
+		if !ok {
+			ch = make(chan struct{})
+			kl.waitChs[fp] = ch
+		}
+		kl.waiting[txn] = fp
+		kl.Unlock()
+		<-ch
+		kl.Lock()
+		delete(kl.waiting, txn)
+	}
+}
+
+// release releases all the locks held by txn.
+func (kl *keyLocks) release(txn *Txn) {
+	if len(txn.locks) == 0 {
+		return
+	}
+	kl.Lock()
+	defer kl.Unlock()
+	for _, fp := range txn.locks {
+		delete(kl.owners, fp)
+		if ch, ok := kl.waitChs[fp]; ok {
+			close(ch)
+			delete(kl.waitChs, fp)
+		}
+	}
+	txn.locks = nil
+}
+
+// Lock acquires exclusive locks on the given keys, blocking until they are released by the other
+// transactions holding them. The locks are held in memory until the transaction is committed or
+// discarded. Keys which should be updated by many concurrent transactions, like counters, can be
+// locked first to serialize the transactions, instead of retrying them on ErrConflict.
+//
+// The keys are locked in sorted order. If a transaction needs to wait for a lock held by a
+// transaction which is itself waiting for a lock held by the first one, ErrDeadlock is returned.
+// The locks acquired before that stay held, so the transaction should be discarded.
+//
+// Lock should be called before doing any reads or writes in the transaction. In that case the read
+// timestamp of the transaction is moved forward once the locks are acquired, so it sees the writes
+// of the transactions which held the locks before it, and doesn't conflict with them.
+//
+// Locks are local to this DB instance. They are not visible to other processes and they don't
+// persist across restarts.
+func (txn *Txn) Lock(keys ...[]byte) error {
+	switch {
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	}
+	fps := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		if len(key) == 0 {
+			return ErrEmptyKey
+		}
+		fps = append(fps, z.MemHash(key))
+	}
+	sort.Slice(fps, func(i, j int) bool { return fps[i] < fps[j] })
+
+	numLocks := len(txn.locks)
+	for _, fp := range fps {
+		if err := txn.db.keyLocks.acquire(txn, fp); err != nil {
+			return err
+		}
+	}
+	// The previous holders of the locks could have committed after our read timestamp was picked,
+	// even if we didn't have to wait for them.
+	if len(txn.locks) > numLocks {
+		txn.refreshReadTs()
+	}
+	return nil
+}
+
+// refreshReadTs moves the read timestamp of the txn forward, if it hasn't read or written
+// anything yet.
+func (txn *Txn) refreshReadTs() {
+	orc := txn.db.orc
+	txn.readsLock.Lock()
+	numReads := len(txn.reads)
+	txn.readsLock.Unlock()
+	if orc.isManaged || numReads > 0 || len(txn.pendingWrites) > 0 ||
+		atomic.LoadInt32(&txn.numIterators) > 0 {
+		return
+	}
+	orc.doneRead(txn)
+	txn.doneRead = false
+	txn.readTs = orc.readTs()
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxnLockCounter(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("counter")
+		const n = 50
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Pick the read timestamp before locking, for the lock to be useful.
+				txn := db.NewTransaction(true)
+				defer txn.Discard()
+				require.NoError(t, txn.Lock(key))
+				count, err := readUint64(txn, key)
+				require.NoError(t, err)
+				var buf [8]byte
+				binary.BigEndian.PutUint64(buf[:], count+1)
+				require.NoError(t, txn.Set(key, buf[:]))
+				// No retries: commits must never conflict.
+				require.NoError(t, txn.Commit())
+			}()
+		}
+		wg.Wait()
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			count, err := readUint64(txn, key)
+			require.Equal(t, uint64(n), count)
+			return err
+		}))
+	})
+}
+
+func TestTxnLockDeadlock(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		a, b := []byte("a"), []byte("b")
+		txn1 := db.NewTransaction(true)
+		defer txn1.Discard()
+		txn2 := db.NewTransaction(true)
+		require.NoError(t, txn1.Lock(a))
+		require.NoError(t, txn2.Lock(b))
+		// Locking a key twice is fine.
+		require.NoError(t, txn2.Lock(b))
+
+		errCh := make(chan error)
+		go func() { errCh <- txn1.Lock(b) }()
+		// Wait until txn1 is blocked on b.
+		for {
+			db.keyLocks.Lock()
+			_, ok := db.keyLocks.waiting[txn1]
+			db.keyLocks.Unlock()
+			if ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		require.Equal(t, ErrDeadlock, txn2.Lock(a))
+		txn2.Discard()
+		require.NoError(t, <-errCh)
+		require.Len(t, txn1.locks, 2)
+
+		rtxn := db.NewTransaction(false)
+		defer rtxn.Discard()
+		require.Equal(t, ErrReadOnlyTxn, rtxn.Lock(a))
+		require.Equal(t, ErrEmptyKey, txn1.Lock(nil))
+	})
+}
@@ -0,0 +1,129 @@
+//go:build !purego
+// +build !purego
+
+// Copyright 2022 Dgraph Labs, Inc. and Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "textflag.h"
+
+// func compareKeys(key1, key2 []byte) int
+//
+// The keys without their timestamps are compared 32 and then 16 bytes at a time with SSE2, which
+// every amd64 CPU has, then 8 bytes at a time, and then a byte at a time. The first bytes which
+// differ decide, and otherwise the shortest key is the smallest. If the keys are equal, the big
+// endian timestamps are compared as words.
+TEXT ·compareKeys(SB), NOSPLIT, $0-56
+	MOVQ key1_base+0(FP), SI
+	MOVQ key1_len+8(FP), AX
+	MOVQ key2_base+24(FP), DI
+	MOVQ key2_len+32(FP), BX
+	SUBQ $8, AX
+	SUBQ $8, BX
+	LEAQ (SI)(AX*1), R8 // The timestamp of key1.
+	LEAQ (DI)(BX*1), R9 // The timestamp of key2.
+	MOVQ AX, CX
+	CMPQ BX, CX
+	CMOVQLT BX, CX      // CX is the length of the shortest key.
+
+loop32:
+	CMPQ CX, $32
+	JB   loop16
+	MOVOU (SI), X0
+	MOVOU 16(SI), X1
+	MOVOU (DI), X2
+	MOVOU 16(DI), X3
+	PCMPEQB X2, X0
+	PCMPEQB X3, X1
+	PAND X1, X0
+	PMOVMSKB X0, DX
+	XORL $0xffff, DX
+	JNE  loop16         // The 16 byte loop finds the bytes which differ.
+	ADDQ $32, SI
+	ADDQ $32, DI
+	SUBQ $32, CX
+	JMP  loop32
+
+loop16:
+	CMPQ CX, $16
+	JB   loop8
+	MOVOU (SI), X0
+	MOVOU (DI), X1
+	PCMPEQB X1, X0
+	PMOVMSKB X0, DX
+	XORL $0xffff, DX    // The bits of the bytes which differ.
+	JNE  diff16
+	ADDQ $16, SI
+	ADDQ $16, DI
+	SUBQ $16, CX
+	JMP  loop16
+
+diff16:
+	BSFL DX, DX
+	MOVBLZX (SI)(DX*1), R10
+	MOVBLZX (DI)(DX*1), R11
+	CMPL R10, R11
+	JA   gt
+	JMP  lt
+
+loop8:
+	CMPQ CX, $8
+	JB   loop1
+	MOVQ (SI), R10
+	MOVQ (DI), R11
+	CMPQ R10, R11
+	JNE  diffWord
+	ADDQ $8, SI
+	ADDQ $8, DI
+	SUBQ $8, CX
+
+loop1:
+	TESTQ CX, CX
+	JE   lengths
+	MOVBLZX (SI), R10
+	MOVBLZX (DI), R11
+	CMPL R10, R11
+	JA   gt
+	JB   lt
+	INCQ SI
+	INCQ DI
+	DECQ CX
+	JMP  loop1
+
+lengths:
+	CMPQ AX, BX
+	JA   gt
+	JB   lt
+	MOVQ (R8), R10
+	MOVQ (R9), R11
+	CMPQ R10, R11
+	JE   eq
+
+diffWord:
+	// The words are loaded little endian, so they are swapped to compare their first bytes first.
+	BSWAPQ R10
+	BSWAPQ R11
+	CMPQ R10, R11
+	JA   gt
+
+lt:
+	MOVQ $-1, ret+48(FP)
+	RET
+
+gt:
+	MOVQ $1, ret+48(FP)
+	RET
+
+eq:
+	MOVQ $0, ret+48(FP)
+	RET
@@ -0,0 +1,99 @@
+//go:build !purego
+// +build !purego
+
+// Copyright 2022 Dgraph Labs, Inc. and Contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "textflag.h"
+
+// func compareKeys(key1, key2 []byte) int
+//
+// The keys without their timestamps are compared 16 bytes at a time, as pairs of words, then 8
+// bytes at a time, and then a byte at a time. The first bytes which differ decide, and otherwise
+// the shortest key is the smallest. If the keys are equal, the big endian timestamps are compared
+// as words.
+TEXT ·compareKeys(SB), NOSPLIT, $0-56
+	MOVD key1_base+0(FP), R0
+	MOVD key1_len+8(FP), R1
+	MOVD key2_base+24(FP), R2
+	MOVD key2_len+32(FP), R3
+	SUB  $8, R1
+	SUB  $8, R3
+	ADD  R0, R1, R4        // The timestamp of key1.
+	ADD  R2, R3, R5        // The timestamp of key2.
+	CMP  R3, R1
+	CSEL LT, R1, R3, R6    // R6 is the length of the shortest key.
+
+loop16:
+	CMP   $16, R6
+	BLT   loop8
+	LDP.P 16(R0), (R7, R8)
+	LDP.P 16(R2), (R9, R10)
+	SUB   $16, R6
+	CMP   R9, R7
+	BNE   diffWord
+	CMP   R10, R8
+	BEQ   loop16
+	MOVD  R8, R7
+	MOVD  R10, R9
+	B     diffWord
+
+loop8:
+	CMP    $8, R6
+	BLT    loop1
+	MOVD.P 8(R0), R7
+	MOVD.P 8(R2), R9
+	SUB    $8, R6
+	CMP    R9, R7
+	BNE    diffWord
+
+loop1:
+	CBZ     R6, lengths
+	MOVBU.P 1(R0), R7
+	MOVBU.P 1(R2), R9
+	SUB     $1, R6
+	CMP     R9, R7
+	BHI     gt
+	BLO     lt
+	B       loop1
+
+lengths:
+	CMP  R3, R1
+	BHI  gt
+	BLO  lt
+	MOVD (R4), R7
+	MOVD (R5), R9
+	CMP  R9, R7
+	BEQ  eq
+
+diffWord:
+	// The words are loaded little endian, so they are swapped to compare their first bytes first.
+	REV R7, R7
+	REV R9, R9
+	CMP R9, R7
+	BHI gt
+
+lt:
+	MOVD $-1, R7
+	MOVD R7, ret+48(FP)
+	RET
+
+gt:
+	MOVD $1, R7
+	MOVD R7, ret+48(FP)
+	RET
+
+eq:
+	MOVD ZR, ret+48(FP)
+	RET
@@ -0,0 +1,47 @@
+//go:build (amd64 || arm64) && !purego
+// +build amd64 arm64
+// +build !purego
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kv
+
+// CompareKeys checks the key without timestamp and checks the timestamp if keyNoTs
+// is same.
+// a<timestamp> would be sorted higher than aa<timestamp> if we use bytes.compare
+// All keys should have timestamp.
+//
+// It is written in assembly on amd64 and arm64, where it compares the keys 16 bytes at a time, with
+// SSE2 on amd64 and pairs of words on arm64, and the timestamps as a single word, in one call
+// instead of the two calls to bytes.Compare of the pure Go version. Keys of asmMaxKeySize bytes and
+// more are compared by bytes.Compare, which uses AVX2 for them where it can. Build with the purego
+// tag to use the pure Go version instead.
+func CompareKeys(key1, key2 []byte) int {
+	// The assembly doesn't check the lengths of the keys.
+	_, _ = key1[len(key1)-8], key2[len(key2)-8]
+	if len(key1) >= asmMaxKeySize && len(key2) >= asmMaxKeySize {
+		return compareKeysGeneric(key1, key2)
+	}
+	return compareKeys(key1, key2)
+}
+
+// asmMaxKeySize is the size, timestamp included, from which bytes.Compare is faster than the
+// assembly, on the amd64 CPUs with AVX2.
+const asmMaxKeySize = 72
+
+//go:noescape
+func compareKeys(key1, key2 []byte) int
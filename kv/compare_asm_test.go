@@ -0,0 +1,48 @@
+//go:build (amd64 || arm64) && !purego
+// +build amd64 arm64
+// +build !purego
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kv
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompareKeysAsm checks the assembly with the long keys CompareKeys doesn't pass to it.
+func TestCompareKeysAsm(t *testing.T) {
+	randKey := func() []byte {
+		key := make([]byte, rand.Intn(160))
+		for i := range key {
+			key[i] = byte(rand.Intn(2)) * 0xff
+		}
+		return KeyWithTs(key, uint64(rand.Intn(3))<<uint(rand.Intn(64)))
+	}
+	for i := 0; i < 100000; i++ {
+		key1, key2 := randKey(), randKey()
+		// Most keys share a long prefix.
+		if rand.Intn(2) == 0 {
+			key2 = append(append([]byte{}, key1[:len(key1)*3/4]...), key2...)
+		}
+		require.Equal(t, compareKeysGeneric(key1, key2), compareKeys(key1, key2),
+			"%x %x", key1, key2)
+	}
+}
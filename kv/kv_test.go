@@ -0,0 +1,82 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeVarintForZero(t *testing.T) {
+	siz := sizeVarint(0)
+	require.Equal(t, 1, siz)
+}
+
+func TestCompareKeys(t *testing.T) {
+	// Keys of all lengths around the words compared, which share prefixes of all lengths.
+	randKey := func() []byte {
+		key := make([]byte, rand.Intn(80))
+		for i := range key {
+			key[i] = byte(rand.Intn(3)) * 0x7f
+		}
+		return KeyWithTs(key, uint64(rand.Intn(3))<<uint(rand.Intn(64)))
+	}
+	for i := 0; i < 200000; i++ {
+		key1, key2 := randKey(), randKey()
+		require.Equal(t, compareKeysGeneric(key1, key2), CompareKeys(key1, key2),
+			"%x %x", key1, key2)
+		require.Zero(t, CompareKeys(key1, append([]byte{}, key1...)))
+	}
+	require.Panics(t, func() { CompareKeys([]byte("short"), KeyWithTs(nil, 1)) })
+}
+
+// TestImports checks that the package only depends on the standard library, so that package skl
+// doesn't depend on the rest of Badger.
+func TestImports(t *testing.T) {
+	pkg, err := build.ImportDir(".", 0)
+	require.NoError(t, err)
+	for _, imp := range pkg.Imports {
+		require.False(t, strings.Contains(strings.Split(imp, "/")[0], "."), imp)
+	}
+}
+
+func BenchmarkCompareKeys(b *testing.B) {
+	for _, sz := range []int{8, 16, 32, 128} {
+		// The keys share a prefix of sz bytes, and differ after it.
+		key1 := KeyWithTs(append(bytes.Repeat([]byte("a"), sz), 'a'), 1)
+		key2 := KeyWithTs(append(bytes.Repeat([]byte("a"), sz), 'b'), 1)
+		for _, impl := range []struct {
+			name    string
+			compare func(key1, key2 []byte) int
+		}{
+			{"CompareKeys", CompareKeys},
+			{"generic", compareKeysGeneric},
+		} {
+			b.Run(fmt.Sprintf("prefix=%d/%s", sz, impl.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					impl.compare(key1, key2)
+				}
+			})
+		}
+	}
+}
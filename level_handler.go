@@ -35,6 +35,12 @@ type levelHandler struct {
 	tables         []*table.Table
 	totalSize      int64
 	totalStaleSize int64
+	// memSize is the size of the tables kept in memory, in InMemory mode.
+	memSize int64
+	// garbage has the estimated garbage size of every table, only tracked if
+	// CompactionGarbageRatio is set.
+	garbage          map[uint64]int64
+	totalGarbageSize int64
 
 	// The following are initialized once and const.
 	level    int
@@ -52,20 +58,40 @@ func (s *levelHandler) getTotalStaleSize() int64 {
 	return s.totalStaleSize
 }
 
+func (s *levelHandler) getTotalGarbageSize() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.totalGarbageSize
+}
+
 func (s *levelHandler) getTotalSize() int64 {
 	s.RLock()
 	defer s.RUnlock()
 	return s.totalSize
 }
 
+func (s *levelHandler) getMemSize() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.memSize
+}
+
 // initTables replaces s.tables with given tables. This is done during loading.
 func (s *levelHandler) initTables(tables []*table.Table) {
 	s.Lock()
 	defer s.Unlock()
+	s.setTables(tables)
+}
 
+// setTables replaces s.tables with given tables. This should be called while holding the lock on
+// the level.
+func (s *levelHandler) setTables(tables []*table.Table) {
 	s.tables = tables
 	s.totalSize = 0
 	s.totalStaleSize = 0
+	s.memSize = 0
+	s.garbage = make(map[uint64]int64)
+	s.totalGarbageSize = 0
 	for _, t := range tables {
 		s.addSize(t)
 	}
@@ -107,6 +133,7 @@ func (s *levelHandler) deleteTables(toDel []*table.Table) error {
 
 	s.Unlock() // Unlock s _before_ we DecrRef our tables, which can be slow.
 
+	s.db.tableCounts.forget(toDel)
 	return decrRefs(toDel)
 }
 
@@ -145,6 +172,7 @@ func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) error {
 		return y.CompareKeys(s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
 	})
 	s.Unlock() // s.Unlock before we DecrRef tables -- that can be slow.
+	s.db.tableCounts.forget(toDel)
 	return decrRefs(toDel)
 }
 
@@ -187,6 +215,7 @@ func newLevelHandler(db *DB, level int) *levelHandler {
 		level:    level,
 		strLevel: fmt.Sprintf("l%d", level),
 		db:       db,
+		garbage:  make(map[uint64]int64),
 	}
 }
 
@@ -212,13 +241,29 @@ func (s *levelHandler) tryAddLevel0Table(t *table.Table) bool {
 func (s *levelHandler) addSize(t *table.Table) {
 	s.totalSize += t.Size()
 	s.totalStaleSize += int64(t.StaleDataSize())
+	if t.IsInmemory {
+		s.memSize += t.Size()
+	}
+	if s.db.opt.CompactionGarbageRatio > 0 {
+		g := tableGarbageSize(t)
+		s.garbage[t.ID()] = g
+		s.totalGarbageSize += g
+	}
 }
 
 // This should be called while holding the lock on the level.
 func (s *levelHandler) subtractSize(t *table.Table) {
 	s.totalSize -= t.Size()
 	s.totalStaleSize -= int64(t.StaleDataSize())
+	if t.IsInmemory {
+		s.memSize -= t.Size()
+	}
+	if g, ok := s.garbage[t.ID()]; ok {
+		delete(s.garbage, t.ID())
+		s.totalGarbageSize -= g
+	}
 }
+
 func (s *levelHandler) numTables() int {
 	s.RLock()
 	defer s.RUnlock()
@@ -314,24 +359,31 @@ func (s *levelHandler) iterators(opt *IteratorOptions) []y.Iterator {
 	if opt.Reverse {
 		topt = table.REVERSED
 	}
+	if opt.Scan && s.level >= s.db.opt.PinnedBlockCacheLevels {
+		topt |= table.NOCACHE
+	}
 	if s.level == 0 {
 		// Remember to add in reverse order!
 		// The newer table at the end of s.tables should be added first as it takes precedence.
 		// Level 0 tables are not in key sorted order, so we need to consider them one by one.
-		var out []*table.Table
-		for _, t := range s.tables {
-			if opt.pickTable(t) {
-				out = append(out, t)
+		var out []y.Iterator
+		for i := len(s.tables) - 1; i >= 0; i-- {
+			if t := s.tables[i]; opt.pickTable(t) {
+				it := t.NewIterator(topt)
+				it.SetBounds(opt.lower, opt.upper)
+				out = append(out, it)
 			}
 		}
-		return iteratorsReversed(out, topt)
+		return out
 	}
 
 	tables := opt.pickTables(s.tables)
 	if len(tables) == 0 {
 		return nil
 	}
-	return []y.Iterator{table.NewConcatIterator(tables, topt)}
+	it := table.NewConcatIterator(tables, topt)
+	it.SetBounds(opt.lower, opt.upper)
+	return []y.Iterator{it}
 }
 
 func (s *levelHandler) getTables(opt *IteratorOptions) []*table.Table {
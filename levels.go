@@ -23,7 +23,6 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"os"
 	"sort"
 	"strings"
 	"sync"
@@ -36,6 +35,7 @@ import (
 	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/table"
 	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
 )
@@ -49,6 +49,16 @@ type levelsController struct {
 	kv     *DB
 
 	cstatus compactStatus
+
+	// numCompactors is the number of compactors which should run. It is read atomically, and
+	// written with compactorsLock held.
+	numCompactors int32
+	// compactorsLock guards the compactors which are running, and the closer they were started
+	// with.
+	compactorsLock    sync.Mutex
+	compactors        map[int]struct{}
+	compactorsCloser  *z.Closer
+	compactionLimiter compactionLimiter
 }
 
 // revertToManifest checks that all necessary table files exist and removes all table files not
@@ -67,7 +77,7 @@ func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
 		if _, ok := mf.Tables[id]; !ok {
 			kv.opt.Debugf("Table file %d not referenced in MANIFEST\n", id)
 			filename := table.NewFilename(id, kv.opt.Dir)
-			if err := os.Remove(filename); err != nil {
+			if err := kv.opt.FS.Remove(filename); err != nil {
 				return y.Wrapf(err, "While removing table %d", id)
 			}
 		}
@@ -79,9 +89,11 @@ func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
 func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 	y.AssertTrue(db.opt.NumLevelZeroTablesStall > db.opt.NumLevelZeroTables)
 	s := &levelsController{
-		kv:     db,
-		levels: make([]*levelHandler, db.opt.MaxLevels),
+		kv:            db,
+		levels:        make([]*levelHandler, db.opt.MaxLevels),
+		numCompactors: int32(db.opt.NumCompactors),
 	}
+	s.compactionLimiter.setRate(db.opt.CompactionRateLimit)
 	s.cstatus.tables = make(map[uint64]struct{})
 	s.cstatus.levels = make([]*levelCompactStatus, db.opt.MaxLevels)
 
@@ -90,22 +102,34 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 		s.cstatus.levels[i] = new(levelCompactStatus)
 	}
 
-	if db.opt.InMemory {
+	// In Secondary mode, the tables are opened by DB.catchUp.
+	if db.opt.InMemory || db.opt.Secondary {
 		return s, nil
 	}
 	// Compare manifest against directory, check for existent/non-existent files, and remove.
-	if err := revertToManifest(db, mf, getIDMap(db.opt.Dir)); err != nil {
+	if err := revertToManifest(db, mf, getIDMap(db.opt.FS, db.opt.Dir)); err != nil {
 		return nil, err
 	}
 
+	// The sidecar is only a cache: the tables without a valid entry are opened as usual. It is
+	// removed once read, so that it is only used if the DB was closed since it was written.
+	metas, err := readTableMeta(db)
+	if err != nil {
+		db.opt.Warningf("Ignoring %s: %v", TableMetaFileName, err)
+	}
+	if (metas != nil || err != nil) && !db.opt.ReadOnly {
+		if err := removeTableMeta(db); err != nil {
+			return nil, err
+		}
+	}
+
 	var mu sync.Mutex
 	tables := make([][]*table.Table, db.opt.MaxLevels)
 	var maxFileID uint64
 
-	// We found that using 3 goroutines allows disk throughput to be utilized to its max.
 	// Disk utilization is the main thing we should focus on, while trying to read the data. That's
 	// the one factor that remains constant between HDD and SSD.
-	throttle := y.NewThrottle(3)
+	throttle := y.NewThrottle(db.opt.numOpenWorkers())
 
 	start := time.Now()
 	var numOpened int32
@@ -113,7 +137,6 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 	defer tick.Stop()
 
 	for fileID, tf := range mf.Tables {
-		fname := table.NewFilename(fileID, db.opt.Dir)
 		select {
 		case <-tick.C:
 			db.opt.Infof("%d tables out of %d opened in %s\n", atomic.LoadInt32(&numOpened),
@@ -127,35 +150,21 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 		if fileID > maxFileID {
 			maxFileID = fileID
 		}
-		go func(fname string, tf TableManifest) {
+		go func(fileID uint64, tf TableManifest) {
 			var rerr error
 			defer func() {
-				throttle.Done(rerr)
 				atomic.AddInt32(&numOpened, 1)
+				db.openProgress.update(func(p *OpenProgress) { p.TablesOpened++ })
+				throttle.Done(rerr)
 			}()
-			dk, err := db.registry.DataKey(tf.KeyID)
-			if err != nil {
-				rerr = y.Wrapf(err, "Error while reading datakey")
-				return
-			}
-			topt := buildTableOptions(db)
-			// Explicitly set Compression and DataKey based on how the table was generated.
-			topt.Compression = tf.Compression
-			topt.DataKey = dk
-
-			mf, err := z.OpenMmapFile(fname, db.opt.getFileFlags(), 0)
-			if err != nil {
-				rerr = y.Wrapf(err, "Opening file: %q", fname)
-				return
-			}
-			t, err := table.OpenTable(mf, topt)
+			t, err := s.openTable(fileID, tf, metas[fileID])
 			if err != nil {
 				if strings.HasPrefix(err.Error(), "CHECKSUM_MISMATCH:") {
 					db.opt.Errorf(err.Error())
-					db.opt.Errorf("Ignoring table %s", mf.Fd.Name())
+					db.opt.Errorf("Ignoring table %d", fileID)
 					// Do not set rerr. We will continue without this table.
 				} else {
-					rerr = y.Wrapf(err, "Opening table: %q", fname)
+					rerr = y.Wrapf(err, "Opening table %d", fileID)
 				}
 				return
 			}
@@ -163,7 +172,7 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 			mu.Lock()
 			tables[tf.Level] = append(tables[tf.Level], t)
 			mu.Unlock()
-		}(fname, tf)
+		}(fileID, tf)
 	}
 	if err := throttle.Finish(); err != nil {
 		closeAllTables(tables)
@@ -184,7 +193,7 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 
 	// Sync directory (because we have at least removed some files, or previously created the
 	// manifest file).
-	if err := syncDir(db.opt.Dir); err != nil {
+	if err := db.opt.FS.SyncDir(db.opt.Dir); err != nil {
 		_ = s.close()
 		return nil, err
 	}
@@ -192,6 +201,35 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 	return s, nil
 }
 
+// openTable opens the table fileID of the MANIFEST. If meta isn't nil, it is the table.Meta the
+// table had when the DB was closed. The error of table.OpenTable is returned as is, except that
+// the corrupt data is returned as an Error derived from ErrCorruptFile.
+func (s *levelsController) openTable(fileID uint64, tf TableManifest,
+	meta *table.Meta) (*table.Table, error) {
+	db := s.kv
+	dk, err := db.registry.DataKey(tf.KeyID)
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while reading datakey")
+	}
+	topt := buildLevelTableOptions(db, int(tf.Level))
+	// Explicitly set Compression, EncryptionMode and DataKey based on how the table was generated.
+	topt.Compression = tf.Compression
+	topt.EncryptionMode = tf.EncryptionMode
+	topt.DataKey = dk
+
+	fname := table.NewFilename(fileID, db.opt.Dir)
+	mf, err := y.OpenMmapFile(db.opt.FS, fname, db.opt.getFileFlags(), 0)
+	if err != nil {
+		return nil, y.Wrapf(err, "Opening file: %q", fname)
+	}
+	var rf table.RemoteFile
+	if tf.RemoteURL != "" {
+		rf = &remoteFile{url: tf.RemoteURL, opt: db.opt.RemoteTablesOptions}
+	}
+	t, err := table.OpenTableWithMeta(mf, rf, meta, topt)
+	return t, tableError(err)
+}
+
 // Closes the tables, for cleanup in newLevelsController.  (We Close() instead of using DecrRef()
 // because that would delete the underlying files.)  We ignore errors, which is OK because tables
 // are read-only.
@@ -245,9 +283,12 @@ func (s *levelsController) dropTree() (int, error) {
 	for _, l := range s.levels {
 		l.Lock()
 		l.totalSize = 0
+		l.garbage = make(map[uint64]int64)
+		l.totalGarbageSize = 0
 		l.tables = l.tables[:0]
 		l.Unlock()
 	}
+	s.kv.tableCounts.forget(all)
 	for _, table := range all {
 		if err := table.DecrRef(); err != nil {
 			return 0, err
@@ -349,13 +390,64 @@ func (s *levelsController) dropPrefixes(prefixes [][]byte) error {
 }
 
 func (s *levelsController) startCompact(lc *z.Closer) {
-	n := s.kv.opt.NumCompactors
-	lc.AddRunning(n - 1)
-	for i := 0; i < n; i++ {
-		go s.runCompactor(i, lc)
+	s.compactorsLock.Lock()
+	defer s.compactorsLock.Unlock()
+	// The compactors of the previous closer have all returned.
+	s.compactors = make(map[int]struct{})
+	s.compactorsCloser = lc
+	s.startCompactors()
+	// The closer is created with a count of one.
+	lc.Done()
+}
+
+// startCompactors starts the compactors up to numCompactors which aren't running. It must be
+// called with compactorsLock held.
+func (s *levelsController) startCompactors() {
+	lc := s.compactorsCloser
+	for id := 0; id < s.getNumCompactors(); id++ {
+		if _, ok := s.compactors[id]; ok {
+			continue
+		}
+		s.compactors[id] = struct{}{}
+		lc.AddRunning(1)
+		go s.runCompactor(id, lc)
 	}
 }
 
+// getNumCompactors returns the number of compactors which should run.
+func (s *levelsController) getNumCompactors() int {
+	return int(atomic.LoadInt32(&s.numCompactors))
+}
+
+// setNumCompactors changes the number of compactors which run. The new compactors are started
+// right away, while the extra ones stop once they are done with their current compaction.
+func (s *levelsController) setNumCompactors(n int) {
+	s.compactorsLock.Lock()
+	defer s.compactorsLock.Unlock()
+	atomic.StoreInt32(&s.numCompactors, int32(n))
+	if s.compactorsCloser == nil {
+		return
+	}
+	select {
+	case <-s.compactorsCloser.HasBeenClosed():
+		// The compactions are stopped. They are started again with n compactors.
+	default:
+		s.startCompactors()
+	}
+}
+
+// retireCompactor returns true if compactor id is beyond numCompactors, in which case it must
+// return.
+func (s *levelsController) retireCompactor(id int) bool {
+	s.compactorsLock.Lock()
+	defer s.compactorsLock.Unlock()
+	if id < s.getNumCompactors() {
+		return false
+	}
+	delete(s.compactors, id)
+	return true
+}
+
 type targets struct {
 	baseLevel int
 	targetSz  []int64
@@ -429,6 +521,17 @@ func (s *levelsController) levelTargets() targets {
 	if b < len(lvl)-1 && lvl[b].getTotalSize() == 0 && lvl[b+1].getTotalSize() < t.targetSz[b+1] {
 		t.baseLevel++
 	}
+
+	// With the tiered compaction, the levels don't follow the size targets. L0 must never be
+	// compacted below a level, which has more recent data.
+	if s.kv.opt.CompactionStyle == options.TieredCompaction {
+		for i := 1; i < t.baseLevel; i++ {
+			if lvl[i].getTotalSize() > 0 {
+				t.baseLevel = i
+				break
+			}
+		}
+	}
 	return t
 }
 
@@ -462,8 +565,7 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 		return prios
 	}
 
-	run := func(p compactionPriority) bool {
-		err := s.doCompact(id, p)
+	done := func(err error) bool {
 		switch err {
 		case nil:
 			return true
@@ -474,7 +576,13 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 		}
 		return false
 	}
+	run := func(p compactionPriority) bool {
+		return done(s.doCompact(id, p))
+	}
 	runOnce := func() bool {
+		if s.kv.opt.CompactionStyle == options.TieredCompaction {
+			return done(s.doTieredCompact(id))
+		}
 		prios := s.pickCompactLevels()
 		if id == 0 {
 			// Worker ID zero prefers to compact L0 always.
@@ -502,20 +610,61 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 		run(p)
 
 	}
-	count := 0
+	// Merging tiny tables is a low priority job. It is only run by the last compactor, once it has
+	// been idle for a while.
+	tryMergeTinyTables := func() {
+		for l := 1; l < len(s.levels); l++ {
+			if err := s.mergeTinyTables(id, l); err == nil {
+				return
+			} else if err != errFillTables {
+				s.kv.opt.Warningf("While merging tiny tables: %v\n", err)
+			}
+		}
+	}
+	// Dropping the expired tables is run by the last compactor every 10s.
+	tryTTLCompaction := func() {
+		for l := 1; l < len(s.levels); l++ {
+			if _, err := s.dropExpiredTables(l); err != nil {
+				s.kv.opt.Warningf("While dropping expired tables: %v\n", err)
+			}
+		}
+		for l := 1; l < len(s.levels); l++ {
+			if err := s.ttlCompact(id, l); err == nil {
+				return
+			} else if err != errFillTables {
+				s.kv.opt.Warningf("While running TTL compaction: %v\n", err)
+			}
+		}
+	}
+	count, idle, ttlCount := 0, 0, 0
 	ticker := time.NewTicker(50 * time.Millisecond)
 	defer ticker.Stop()
 	for {
 		select {
 		// Can add a done channel or other stuff.
 		case <-ticker.C:
+			if s.retireCompactor(id) {
+				return
+			}
 			count++
+			if s.kv.opt.TTLCompactionRatio > 0 && id == s.getNumCompactors()-1 {
+				if ttlCount++; ttlCount >= 200 {
+					tryTTLCompaction()
+					ttlCount = 0
+				}
+			}
 			// Each ticker is 50ms so 50*200=10seconds.
 			if s.kv.opt.LmaxCompaction && id == 2 && count >= 200 {
 				tryLmaxToLmaxCompaction()
 				count = 0
+			} else if runOnce() {
+				idle = 0
 			} else {
-				runOnce()
+				idle++
+				if s.kv.opt.MergeTinyTables && id == s.getNumCompactors()-1 && idle >= 200 {
+					tryMergeTinyTables()
+					idle = 0
+				}
 			}
 		case <-lc.HasBeenClosed():
 			return
@@ -535,6 +684,68 @@ func (s *levelsController) lastLevel() *levelHandler {
 	return s.levels[len(s.levels)-1]
 }
 
+// keepInMemory returns true if a new table of level lev should be kept in memory. In InMemory mode,
+// all the tables are, unless TempSpillDir is set, in which case the tables below level 0 are
+// written to it once the tables in memory exceed MemoryBudget.
+func (s *levelsController) keepInMemory(lev int) bool {
+	if !s.kv.opt.InMemory {
+		return false
+	}
+	if s.kv.opt.TempSpillDir == "" || lev == 0 {
+		return true
+	}
+	return s.memSize() < s.kv.opt.MemoryBudget
+}
+
+// keepRemote returns true if the tables compacted into lev are written to object storage, as set by
+// Options.RemoteTables.
+func (s *levelsController) keepRemote(lev int) bool {
+	return s.kv.opt.RemoteTables != "" && lev == len(s.levels)-1
+}
+
+// compactionLimiter limits the rate at which the compactions write tables, as set by
+// Options.CompactionRateLimit.
+type compactionLimiter struct {
+	bytesPerSec int64 // Atomic
+
+	sync.Mutex
+	next time.Time // When the bytes written so far are within the rate.
+}
+
+func (l *compactionLimiter) setRate(bytesPerSec int64) {
+	l.Lock()
+	defer l.Unlock()
+	atomic.StoreInt64(&l.bytesPerSec, bytesPerSec)
+	// The bytes written at the previous rate don't delay the next ones.
+	l.next = time.Time{}
+}
+
+// wait records that n bytes were written, and sleeps until they are within the rate.
+func (l *compactionLimiter) wait(n int64) {
+	rate := atomic.LoadInt64(&l.bytesPerSec)
+	if rate <= 0 {
+		return
+	}
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.Unlock()
+	time.Sleep(d)
+}
+
+// memSize returns the size of the tables kept in memory.
+func (s *levelsController) memSize() int64 {
+	var size int64
+	for _, l := range s.levels {
+		size += l.getMemSize()
+	}
+	return size
+}
+
 // pickCompactLevel determines which level to compact.
 // Based on: https://github.com/facebook/rocksdb/wiki/Leveled-Compaction
 func (s *levelsController) pickCompactLevels() (prios []compactionPriority) {
@@ -559,7 +770,16 @@ func (s *levelsController) pickCompactLevels() (prios []compactionPriority) {
 
 		l := s.levels[i]
 		sz := l.getTotalSize() - delSize
-		addPriority(i, float64(sz)/float64(t.targetSz[i]))
+		score := float64(sz) / float64(t.targetSz[i])
+		if ratio := s.kv.opt.CompactionGarbageRatio; ratio > 0 && sz > 0 {
+			// Compact the levels with a lot of garbage even if they are within their target size,
+			// so that the deleted and overwritten data frees the disk space sooner.
+			garbage := float64(l.getTotalGarbageSize()) / float64(l.getTotalSize())
+			if gscore := garbage / ratio; gscore > score {
+				score = gscore
+			}
+		}
+		addPriority(i, score)
 	}
 	y.AssertTrue(len(prios) == len(s.levels))
 
@@ -678,6 +898,10 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 		// Denotes if the first key is a series of duplicate keys had
 		// "DiscardEarlierVersions" set
 		firstKeyHasDiscardSet bool
+		// The keys removed because their latest version expired.
+		expired []ExpiredKey
+		// The data key of the prefix of the keys of the table being built, if it has one.
+		prefixKey *pb.DataKey
 	)
 
 	addKeys := func(builder *table.Builder) {
@@ -704,7 +928,8 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 				}
 			}
 
-			if !y.SameKey(it.Key(), lastKey) {
+			firstVersion := !y.SameKey(it.Key(), lastKey)
+			if firstVersion {
 				firstKeyHasDiscardSet = false
 				if len(kr.right) > 0 && y.CompareKeys(it.Key(), kr.right) >= 0 {
 					break
@@ -715,6 +940,10 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 					// not divided across multiple tables at the same level.
 					break
 				}
+				if s.kv.registry.prefixDataKey(it.Key()) != prefixKey {
+					// The keys of a prefix with a data key are kept in their own tables.
+					break
+				}
 				lastKey = y.SafeCopy(lastKey, it.Key())
 				numVersions = 0
 				firstKeyHasDiscardSet = it.Value().Meta&BitDiscardEarlierVersions > 0
@@ -776,6 +1005,14 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 						// If no overlap, we can skip all the versions, by continuing here.
 						numSkips++
 						updateStats(vs)
+						if cd.expired != nil && firstVersion && vs.Meta&bitDelete == 0 {
+							expired = append(expired, ExpiredKey{
+								Key:       y.ParseKey(y.SafeCopy(nil, it.Key())),
+								Version:   version,
+								ExpiresAt: vs.ExpiresAt,
+								UserMeta:  vs.UserMeta,
+							})
+						}
 						continue // Skip adding this key.
 					}
 				}
@@ -799,8 +1036,9 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 				builder.Add(it.Key(), vs, vp.Len)
 			}
 		}
-		s.kv.opt.Debugf("[%d] LOG Compact. Added %d keys. Skipped %d keys. Iteration took: %v",
-			cd.compactorId, numKeys, numSkips, time.Since(timeStart).Round(time.Millisecond))
+		s.kv.opt.logw(DEBUG, "Compaction iteration done", "compactor", cd.compactorId,
+			"keys_added", numKeys, "keys_skipped", numSkips,
+			"duration", time.Since(timeStart).Round(time.Millisecond))
 	} // End of function: addKeys
 
 	if len(kr.left) > 0 {
@@ -813,9 +1051,16 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 			break
 		}
 
-		bopts := buildTableOptions(s.kv)
+		bopts := buildLevelTableOptions(s.kv, cd.nextLevel.level)
 		// Set TableSize to the target file size for that level.
 		bopts.TableSize = uint64(cd.t.fileSz[cd.nextLevel.level])
+		bopts.DirectIO = s.kv.opt.CompactionDirectIO
+		// The keys of a prefix with a data key are encrypted with it.
+		if prefixKey = s.kv.registry.prefixDataKey(it.Key()); prefixKey != nil {
+			bopts.DataKey = prefixKey
+		}
+		fileID := s.reserveFileID()
+		bopts.TableID = fileID
 		builder := table.NewTableBuilder(bopts)
 
 		// This would do the iteration and add keys to builder.
@@ -840,10 +1085,13 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 			defer builder.Close()
 
 			var tbl *table.Table
-			if s.kv.opt.InMemory {
+			if s.keepInMemory(cd.nextLevel.level) {
 				tbl, err = table.OpenInMemoryTable(builder.Finish(), fileID, &bopts)
+			} else if s.keepRemote(cd.nextLevel.level) {
+				fname := table.NewFilename(fileID, s.kv.tableDir())
+				tbl, err = table.CreateRemoteTable(fname, builder, newRemoteFile(s.kv.opt, fileID))
 			} else {
-				fname := table.NewFilename(fileID, s.kv.opt.Dir)
+				fname := table.NewFilename(fileID, s.kv.tableDir())
 				tbl, err = table.CreateTable(fname, builder)
 			}
 
@@ -851,11 +1099,15 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 			if err != nil {
 				return
 			}
+			s.compactionLimiter.wait(tbl.Size())
 			res <- tbl
-		}(builder, s.reserveFileID())
+		}(builder, fileID)
 	}
 	s.kv.vlog.updateDiscardStats(discardStats)
 	s.kv.opt.Debugf("Discard stats: %v", discardStats)
+	if len(expired) > 0 {
+		cd.expired.add(expired)
+	}
 }
 
 // compactBuildTables merges topTables and botTables to form a list of new tables.
@@ -891,18 +1143,24 @@ func (s *levelsController) compactBuildTables(
 		}
 	}
 
+	topt := table.NOCACHE | table.VERIFY
+	if s.kv.opt.CompactionDirectIO && !s.kv.opt.InMemory {
+		topt |= table.DIRECT
+	}
 	newIterator := func() []y.Iterator {
 		// Create iterators across all the tables involved first.
 		var iters []y.Iterator
 		switch {
 		case lev == 0:
-			iters = append(iters, iteratorsReversed(topTables, table.NOCACHE)...)
-		case len(topTables) > 0:
-			y.AssertTrue(len(topTables) == 1)
-			iters = []y.Iterator{topTables[0].NewIterator(table.NOCACHE)}
+			iters = append(iters, iteratorsReversed(topTables, topt)...)
+		case len(topTables) == 1:
+			iters = []y.Iterator{topTables[0].NewIterator(topt)}
+		case len(topTables) > 1:
+			// The tiered compaction merges all the tables of the level, which don't overlap.
+			iters = []y.Iterator{table.NewConcatIterator(topTables, topt)}
 		}
 		// Next level has level>=1 and we can use ConcatIterator as key ranges do not overlap.
-		return append(iters, table.NewConcatIterator(valid, table.NOCACHE))
+		return append(iters, table.NewConcatIterator(valid, topt))
 	}
 
 	res := make(chan *table.Table, 3)
@@ -959,8 +1217,10 @@ func (s *levelsController) compactBuildTables(
 func buildChangeSet(cd *compactDef, newTables []*table.Table) pb.ManifestChangeSet {
 	changes := []*pb.ManifestChange{}
 	for _, table := range newTables {
-		changes = append(changes,
-			newCreateChange(table.ID(), cd.nextLevel.level, table.KeyID(), table.CompressionType()))
+		change := newCreateChange(table.ID(), cd.nextLevel.level, table.KeyID(),
+			table.CompressionType(), table.EncryptionMode())
+		change.RemoteUrl = table.RemoteURL()
+		changes = append(changes, change)
 	}
 	for _, table := range cd.top {
 		// Add a delete change only if the table is not in memory.
@@ -1041,19 +1301,48 @@ type compactDef struct {
 	thisSize int64
 
 	dropPrefixes [][]byte
+
+	// expired collects the keys removed because they expired. It is nil if they aren't reported
+	// to the event listeners.
+	expired *expiredKeys
 }
 
 // addSplits can allow us to run multiple sub-compactions in parallel across the split key ranges.
 func (s *levelsController) addSplits(cd *compactDef) {
 	cd.splits = cd.splits[:0]
+	maxSplits := s.kv.opt.MaxSubcompactions
+	if maxSplits <= 1 {
+		return
+	}
+	s.addTableSplits(cd, maxSplits)
+
+	// With few tables in the bottom level, like in a compaction of a few huge tables, split the
+	// key range by size instead, so that it still runs in parallel.
+	var total int64
+	for _, t := range cd.allTables() {
+		total += t.Size()
+	}
+	n := int((total + cd.t.fileSz[cd.nextLevel.level] - 1) / cd.t.fileSz[cd.nextLevel.level])
+	if n > maxSplits {
+		n = maxSplits
+	}
+	if len(cd.splits) < n {
+		s.addSizeSplits(cd, n, total)
+	}
+}
+
+// addTableSplits splits the key range of the compaction at the boundaries of the tables in the
+// bottom level, into at most maxSplits ranges.
+func (s *levelsController) addTableSplits(cd *compactDef, maxSplits int) {
+	cd.splits = cd.splits[:0]
 
 	// Let's say we have 10 tables in cd.bot and min width = 3. Then, we'll pick
 	// 0, 1, 2 (pick), 3, 4, 5 (pick), 6, 7, 8 (pick), 9 (pick, because last table).
 	// This gives us 4 picks for 10 tables.
 	// In an edge case, 142 tables in bottom led to 48 splits. That's too many splits, because it
 	// then uses up a lot of memory for table builder.
-	// We should keep it so we have at max 5 splits.
-	width := int(math.Ceil(float64(len(cd.bot)) / 5.0))
+	// We should keep it so we have at max maxSplits splits.
+	width := int(math.Ceil(float64(len(cd.bot)) / float64(maxSplits)))
 	if width < 3 {
 		width = 3
 	}
@@ -1087,6 +1376,54 @@ func (s *levelsController) addSplits(cd *compactDef) {
 	}
 }
 
+// addSizeSplits splits the key range of the compaction into n ranges of about the same size,
+// using the block boundaries of all the tables involved. total is the size of the tables.
+func (s *levelsController) addSizeSplits(cd *compactDef, n int, total int64) {
+	cd.splits = cd.splits[:0]
+
+	type sample struct {
+		key  []byte
+		size int64 // Approximate size of the data from key to the next sample of the table.
+	}
+	var samples []sample
+	for _, t := range cd.allTables() {
+		keys := t.KeySplits(4*n, nil)
+		if len(keys) == 0 {
+			continue
+		}
+		sz := t.Size() / int64(len(keys))
+		for _, k := range keys {
+			samples = append(samples, sample{key: []byte(k), size: sz})
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return y.CompareKeys(samples[i].key, samples[j].key) < 0
+	})
+
+	skr := cd.thisRange
+	skr.extend(cd.nextRange)
+	var before int64
+	var prev []byte
+	for _, smp := range samples {
+		if len(cd.splits) == n-1 {
+			break
+		}
+		// Like in addTableSplits, right must have ts=maxUint64, so that all the versions of a key
+		// are in the same split.
+		right := y.KeyWithTs(y.ParseKey(smp.key), math.MaxUint64)
+		if prev != nil && y.CompareKeys(right, prev) > 0 &&
+			before >= total*int64(len(cd.splits)+1)/int64(n) {
+			skr.right = right
+			cd.splits = append(cd.splits, skr)
+			skr.left = skr.right
+		}
+		prev = right
+		before += smp.size
+	}
+	skr.right = []byte{}
+	cd.splits = append(cd.splits, skr)
+}
+
 func (cd *compactDef) lockLevels() {
 	cd.thisLevel.RLock()
 	cd.nextLevel.RLock()
@@ -1266,6 +1603,25 @@ func (s *levelsController) sortByHeuristic(tables []*table.Table, cd *compactDef
 	})
 }
 
+// sortByGarbage sorts tables in decreasing order of the fraction of their data which is garbage,
+// so we compact the tables freeing the most space first. The order of the tables with the same
+// fraction is kept. This function should be called with lock on cd.thisLevel.
+func (s *levelsController) sortByGarbage(tables []*table.Table, cd *compactDef) {
+	if len(tables) == 0 || cd.nextLevel == nil {
+		return
+	}
+
+	density := make(map[uint64]float64, len(tables))
+	for _, t := range tables {
+		if sz := t.Size(); sz > 0 {
+			density[t.ID()] = float64(cd.thisLevel.garbage[t.ID()]) / float64(sz)
+		}
+	}
+	sort.SliceStable(tables, func(i, j int) bool {
+		return density[tables[i].ID()] > density[tables[j].ID()]
+	})
+}
+
 // This function should be called with lock on levels.
 func (s *levelsController) fillMaxLevelTables(tables []*table.Table, cd *compactDef) bool {
 	sortedTables := make([]*table.Table, len(tables))
@@ -1367,7 +1723,15 @@ func (s *levelsController) fillTables(cd *compactDef) bool {
 	// We pick tables, so we compact older tables first. This is similar to
 	// kOldestLargestSeqFirst in RocksDB.
 	s.sortByHeuristic(tables, cd)
+	if s.kv.opt.CompactionGarbageRatio > 0 {
+		s.sortByGarbage(tables, cd)
+	}
+	return s.fillFirstTable(cd, tables)
+}
 
+// fillFirstTable fills cd with the first of the tables, which can be compacted along with the
+// tables it overlaps with in cd.nextLevel. This function should be called with lock on levels.
+func (s *levelsController) fillFirstTable(cd *compactDef, tables []*table.Table) bool {
 	for _, t := range tables {
 		cd.thisSize = t.Size()
 		cd.thisRange = getKeyRange(t)
@@ -1402,6 +1766,233 @@ func (s *levelsController) fillTables(cd *compactDef) bool {
 	return false
 }
 
+const (
+	// A table is tiny if it is smaller than 1/tinyTableRatio of the target file size of its level.
+	tinyTableRatio = 4
+	// minTinyTables is the minimum number of adjacent tiny tables that are worth merging.
+	minTinyTables = 4
+)
+
+// fillTinyTables picks a run of adjacent tiny tables in cd.thisLevel, which can be merged into
+// tables of the target file size without moving them to the next level.
+func (s *levelsController) fillTinyTables(cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	tables := cd.thisLevel.tables
+	needSz := cd.t.fileSz[cd.thisLevel.level]
+	for i := 0; i < len(tables); {
+		j, sz := i, int64(0)
+		for j < len(tables) && tables[j].Size() < needSz/tinyTableRatio &&
+			sz+tables[j].Size() <= needSz {
+			sz += tables[j].Size()
+			j++
+		}
+		if j-i >= minTinyTables {
+			cd.top = []*table.Table{tables[i]}
+			cd.bot = append([]*table.Table{}, tables[i+1:j]...)
+			cd.thisSize = sz
+			// Use the same range for this and next level, so that the compaction status has
+			// the entire range marked, and it gets removed on completion.
+			cd.thisRange = getKeyRange(tables[i:j]...)
+			cd.nextRange = cd.thisRange
+			if s.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+				return true
+			}
+		}
+		if j == i {
+			j++
+		}
+		i = j
+	}
+	cd.top, cd.bot = nil, nil
+	return false
+}
+
+// mergeTinyTables merges a run of adjacent tiny tables on level l into bigger tables on the same
+// level. Small flushes could leave behind lots of tiny tables, which increase the per table
+// overhead and the number of iterators needed to read a level. Unlike a regular compaction, this
+// doesn't need to rewrite any tables from the next level.
+func (s *levelsController) mergeTinyTables(id, l int) error {
+	y.AssertTrue(l > 0 && l < len(s.levels))
+	_, span := otrace.StartSpan(context.Background(), "Badger.MergeTinyTables")
+	defer span.End()
+
+	cd := compactDef{
+		compactorId: id,
+		span:        span,
+		t:           s.levelTargets(),
+		thisLevel:   s.levels[l],
+		nextLevel:   s.levels[l],
+	}
+	if !s.fillTinyTables(&cd) {
+		return errFillTables
+	}
+	defer s.cstatus.delete(cd) // Remove the ranges from compaction status.
+
+	if err := s.runCompactDef(id, l, cd); err != nil {
+		s.kv.opt.logw(WARNING, "Merging tiny tables failed", "compactor", id, "level", l,
+			"error", err)
+		return err
+	}
+	s.kv.opt.logw(DEBUG, "Merged tiny tables", "compactor", id, "level", l,
+		"tables", len(cd.top)+len(cd.bot))
+	return nil
+}
+
+// dropExpiredTables deletes the tables on level l, whose entries have all expired, without
+// rewriting them. It returns the number of tables deleted.
+func (s *levelsController) dropExpiredTables(l int) (int, error) {
+	y.AssertTrue(l > 0 && l < len(s.levels))
+	lh := s.levels[l]
+	now := uint64(time.Now().Unix())
+	discardTs := s.kv.orc.discardAtOrBelow()
+
+	var cds []compactDef
+	var toDel []*table.Table
+	lh.RLock()
+	for _, t := range lh.tables {
+		if _, _, count, _ := tableExpiry(t); count != uint64(t.KeyCount()) ||
+			expiredFraction(t, now) < 1 {
+			continue
+		}
+		// The versions above discardTs could still be read by some transactions.
+		if t.MaxVersion() > discardTs {
+			continue
+		}
+		// A compaction would keep the expired keys, if the levels below have older versions of
+		// them. Otherwise, those versions would become visible again.
+		if s.checkOverlap([]*table.Table{t}, l+1) {
+			continue
+		}
+		cd := compactDef{
+			thisLevel: lh,
+			nextLevel: lh,
+			top:       []*table.Table{t},
+			thisSize:  t.Size(),
+			thisRange: getKeyRange(t),
+		}
+		cd.nextRange = cd.thisRange
+		if s.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, cd) {
+			cds = append(cds, cd)
+			toDel = append(toDel, t)
+		}
+	}
+	lh.RUnlock()
+	defer func() {
+		for _, cd := range cds {
+			s.cstatus.delete(cd)
+		}
+	}()
+	if len(toDel) == 0 {
+		return 0, nil
+	}
+
+	changes := make([]*pb.ManifestChange, 0, len(toDel))
+	for _, t := range toDel {
+		changes = append(changes, newDeleteChange(t.ID()))
+	}
+	if err := s.kv.manifest.addChanges(changes); err != nil {
+		return 0, err
+	}
+	if !s.kv.opt.InMemory {
+		// Let the value log know about the values of the deleted tables, like a compaction would.
+		discardStats := make(map[uint32]int64)
+		for _, t := range toDel {
+			it := t.NewIterator(table.NOCACHE)
+			for it.Rewind(); it.Valid(); it.Next() {
+				if vs := it.Value(); vs.Meta&bitValuePointer > 0 {
+					var vp valuePointer
+					vp.Decode(vs.Value)
+					discardStats[vp.Fid] += int64(vp.Len)
+				}
+			}
+			it.Close()
+		}
+		s.kv.vlog.updateDiscardStats(discardStats)
+	}
+	if err := lh.deleteTables(toDel); err != nil {
+		return 0, err
+	}
+	ids, size := tableIDsAndSize(toDel)
+	s.kv.opt.logw(INFO, "Deleted expired tables", "level", l, "tables", ids, "bytes", size)
+	return len(toDel), nil
+}
+
+// fillExpiredTables fills cd with the table on cd.thisLevel, which has the biggest fraction of
+// expired keys, as long as the fraction is at least TTLCompactionRatio.
+func (s *levelsController) fillExpiredTables(cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	now := uint64(time.Now().Unix())
+	discardTs := s.kv.orc.discardAtOrBelow()
+	expired := make(map[uint64]float64)
+	var tables []*table.Table
+	for _, t := range cd.thisLevel.tables {
+		// The compaction can't drop the versions above discardTs.
+		if t.MaxVersion() > discardTs {
+			continue
+		}
+		if frac := expiredFraction(t, now); frac >= s.kv.opt.TTLCompactionRatio {
+			expired[t.ID()] = frac
+			tables = append(tables, t)
+		}
+	}
+	sort.SliceStable(tables, func(i, j int) bool {
+		return expired[tables[i].ID()] > expired[tables[j].ID()]
+	})
+
+	if cd.thisLevel != cd.nextLevel {
+		return s.fillFirstTable(cd, tables)
+	}
+	// On the last level, rewrite the table in place.
+	for _, t := range tables {
+		cd.top = []*table.Table{t}
+		cd.bot = []*table.Table{}
+		cd.thisSize = t.Size()
+		cd.thisRange = getKeyRange(t)
+		cd.nextRange = cd.thisRange
+		if s.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+			return true
+		}
+	}
+	cd.top, cd.bot = nil, nil
+	return false
+}
+
+// ttlCompact compacts the table on level l with the most expired keys, so that the disk space of
+// the expired entries is reclaimed without waiting for the level to be compacted. The table is
+// compacted into the next level, or rewritten if l is the last level.
+func (s *levelsController) ttlCompact(id, l int) error {
+	y.AssertTrue(l > 0 && l < len(s.levels))
+	_, span := otrace.StartSpan(context.Background(), "Badger.TTLCompaction")
+	defer span.End()
+
+	cd := compactDef{
+		compactorId: id,
+		span:        span,
+		t:           s.levelTargets(),
+		thisLevel:   s.levels[l],
+		nextLevel:   s.levels[l],
+	}
+	if !cd.thisLevel.isLastLevel() {
+		cd.nextLevel = s.levels[l+1]
+	}
+	if !s.fillExpiredTables(&cd) {
+		return errFillTables
+	}
+	defer s.cstatus.delete(cd) // Remove the ranges from compaction status.
+
+	if err := s.runCompactDef(id, l, cd); err != nil {
+		s.kv.opt.logw(WARNING, "TTL compaction failed", "compactor", id, "level", l,
+			"error", err)
+		return err
+	}
+	s.kv.opt.logw(DEBUG, "TTL compaction done", "compactor", id, "level", l)
+	return nil
+}
+
 func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 	if len(cd.t.fileSz) == 0 {
 		return errors.New("Filesizes cannot be zero. Targets are not set")
@@ -1411,6 +2002,41 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 	thisLevel := cd.thisLevel
 	nextLevel := cd.nextLevel
 
+	info := CompactionInfo{CompactorID: id, Level: thisLevel.level, OutputLevel: nextLevel.level}
+	info.InputTables, info.InputBytes = tableIDsAndSize(cd.top, cd.bot)
+	s.kv.events.compactionBegin(info)
+	span := s.kv.startSpan("Badger.Compaction",
+		intAttr("compactor", int64(id)),
+		intAttr("level", int64(info.Level)),
+		intAttr("output_level", int64(info.OutputLevel)),
+		intAttr("input_tables", int64(len(info.InputTables))),
+		intAttr("input_bytes", info.InputBytes))
+	var newTables []*table.Table
+	defer func() {
+		info.OutputTables, info.OutputBytes = tableIDsAndSize(newTables)
+		info.Duration = time.Since(timeStart)
+		info.Err = err
+		s.kv.events.compactionEnd(info)
+		s.kv.health.record(SubsystemCompaction, err)
+		if err == nil {
+			y.CompactionLatencyObserve(s.kv.opt.MetricsEnabled, info.Duration)
+		}
+		s.kv.recordSlow(SlowLogEntry{
+			Op:          SlowCompaction,
+			Start:       timeStart,
+			Duration:    info.Duration,
+			Bytes:       info.InputBytes,
+			Level:       info.Level,
+			OutputLevel: info.OutputLevel,
+			Err:         err,
+		})
+
+		span.SetAttributes(
+			intAttr("output_tables", int64(len(info.OutputTables))),
+			intAttr("output_bytes", info.OutputBytes))
+		span.End(err)
+	}()
+
 	y.AssertTrue(len(cd.splits) == 0)
 	if thisLevel.level == nextLevel.level {
 		// don't do anything for L0 -> L0 and Lmax -> Lmax.
@@ -1420,6 +2046,9 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 	if len(cd.splits) == 0 {
 		cd.splits = append(cd.splits, keyRange{})
 	}
+	if s.kv.events.hasExpiredListener() {
+		cd.expired = &expiredKeys{}
+	}
 
 	// Table should never be moved directly between levels, always be rewritten to allow discarding
 	// invalid versions.
@@ -1449,22 +2078,20 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 	if err := thisLevel.deleteTables(cd.top); err != nil {
 		return err
 	}
+	if cd.expired != nil && len(cd.expired.keys) > 0 {
+		s.kv.events.expired(cd.expired.keys)
+	}
 
 	// Note: For level 0, while doCompact is running, it is possible that new tables are added.
 	// However, the tables are added only to the end, so it is ok to just delete the first table.
 
-	from := append(tablesToString(cd.top), tablesToString(cd.bot)...)
-	to := tablesToString(newTables)
 	if dur := time.Since(timeStart); dur > 2*time.Second {
-		var expensive string
-		if dur > time.Second {
-			expensive = " [E]"
-		}
-		s.kv.opt.Infof("[%d]%s LOG Compact %d->%d (%d, %d -> %d tables with %d splits)."+
-			" [%s] -> [%s], took %v\n",
-			id, expensive, thisLevel.level, nextLevel.level, len(cd.top), len(cd.bot),
-			len(newTables), len(cd.splits), strings.Join(from, " "), strings.Join(to, " "),
-			dur.Round(time.Millisecond))
+		to, toSize := tableIDsAndSize(newTables)
+		s.kv.opt.logw(INFO, "Expensive compaction", "compactor", id,
+			"level", thisLevel.level, "output_level", nextLevel.level,
+			"input_tables", info.InputTables, "input_bytes", info.InputBytes,
+			"output_tables", to, "output_bytes", toSize, "splits", len(cd.splits),
+			"duration", dur.Round(time.Millisecond))
 	}
 
 	if cd.thisLevel.level != 0 && len(newTables) > 2*s.kv.opt.LevelSizeMultiplier {
@@ -1529,14 +2156,113 @@ func (s *levelsController) doCompact(id int, p compactionPriority) error {
 	span.Annotatef(nil, "Compaction: %+v", cd)
 	if err := s.runCompactDef(id, l, cd); err != nil {
 		// This compaction couldn't be done successfully.
-		s.kv.opt.Warningf("[Compactor: %d] LOG Compact FAILED with error: %+v: %+v", id, err, cd)
+		s.kv.opt.logw(WARNING, "Compaction failed", "compactor", id,
+			"level", cd.thisLevel.level, "output_level", cd.nextLevel.level, "error", err)
 		return err
 	}
 
-	s.kv.opt.Debugf("[Compactor: %d] Compaction for level: %d DONE", id, cd.thisLevel.level)
+	s.kv.opt.logw(DEBUG, "Compaction done", "compactor", id, "level", cd.thisLevel.level)
 	return nil
 }
 
+// pickTieredLevels returns the pairs of levels the tiered compaction can merge, in the order they
+// should be tried. Every level is a single sorted run, the lower levels having the older data.
+// L0 is picked once it has enough tables. It is merged into the first non-empty level if that
+// level has about the same size, or if there is no empty level above it. Otherwise, it is moved to
+// the empty level right above it, starting a new run. Any other level is merged into the next
+// non-empty level once both have about the same size.
+func (s *levelsController) pickTieredLevels() (pairs [][2]int) {
+	var runs []int
+	sizes := make([]int64, len(s.levels))
+	for i, l := range s.levels {
+		sizes[i] = l.getTotalSize()
+		if i > 0 && sizes[i] > 0 {
+			runs = append(runs, i)
+		}
+	}
+	ratio := float64(100+s.kv.opt.TieredSizeRatio) / 100
+	similar := func(newer, older int) bool {
+		return float64(sizes[newer])*ratio >= float64(sizes[older])
+	}
+
+	if s.levels[0].numTables() >= s.kv.opt.NumLevelZeroTables {
+		switch {
+		case len(runs) == 0:
+			pairs = append(pairs, [2]int{0, len(s.levels) - 1})
+		case runs[0] == 1 || similar(0, runs[0]):
+			pairs = append(pairs, [2]int{0, runs[0]})
+		default:
+			pairs = append(pairs, [2]int{0, runs[0] - 1})
+		}
+	}
+	for i := 0; i+1 < len(runs); i++ {
+		if similar(runs[i], runs[i+1]) {
+			pairs = append(pairs, [2]int{runs[i], runs[i+1]})
+		}
+	}
+	return pairs
+}
+
+// fillTieredTables fills cd with all the tables of cd.thisLevel and cd.nextLevel. It returns false
+// if any of the levels is already being compacted, or if the levels have changed since they were
+// picked.
+func (s *levelsController) fillTieredTables(cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	if len(cd.thisLevel.tables) == 0 {
+		return false
+	}
+	// The levels in between must still be empty, otherwise we would move older data above them.
+	for i := cd.thisLevel.level + 1; i < cd.nextLevel.level; i++ {
+		if s.levels[i].getTotalSize() > 0 {
+			return false
+		}
+	}
+	cd.top = make([]*table.Table, len(cd.thisLevel.tables))
+	copy(cd.top, cd.thisLevel.tables)
+	cd.bot = make([]*table.Table, len(cd.nextLevel.tables))
+	copy(cd.bot, cd.nextLevel.tables)
+	for _, t := range cd.top {
+		cd.thisSize += t.Size()
+	}
+	// Compact the whole key range of both levels, so that no other compaction runs on them.
+	cd.thisRange = infRange
+	cd.nextRange = infRange
+	return s.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, *cd)
+}
+
+// doTieredCompact runs a compaction picked by pickTieredLevels.
+func (s *levelsController) doTieredCompact(id int) error {
+	for _, pair := range s.pickTieredLevels() {
+		_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
+		cd := compactDef{
+			compactorId: id,
+			span:        span,
+			t:           s.levelTargets(),
+			thisLevel:   s.levels[pair[0]],
+			nextLevel:   s.levels[pair[1]],
+		}
+		if !s.fillTieredTables(&cd) {
+			span.End()
+			continue
+		}
+
+		span.Annotatef(nil, "Tiered compaction: %+v", cd)
+		err := s.runCompactDef(id, pair[0], cd)
+		s.cstatus.delete(cd)
+		span.End()
+		if err != nil {
+			s.kv.opt.logw(WARNING, "Tiered compaction failed", "compactor", id,
+				"level", pair[0], "error", err)
+			return err
+		}
+		s.kv.opt.logw(DEBUG, "Tiered compaction done", "compactor", id, "level", pair[0])
+		return nil
+	}
+	return errFillTables
+}
+
 func (s *levelsController) addLevel0Table(t *table.Table) error {
 	// Add table to manifest file only if it is not opened in memory. We don't want to add a table
 	// to the manifest file if it exists only in memory.
@@ -1544,9 +2270,12 @@ func (s *levelsController) addLevel0Table(t *table.Table) error {
 		// We update the manifest _before_ the table becomes part of a levelHandler, because at that
 		// point it could get used in some compaction.  This ensures the manifest file gets updated in
 		// the proper order. (That means this update happens before that of some compaction which
-		// deletes the table.)
+		// deletes the table.) The directory entry of the table must be visible before.
+		if err := s.kv.syncDir(s.kv.opt.Dir); err != nil {
+			return err
+		}
 		err := s.kv.manifest.addChanges([]*pb.ManifestChange{
-			newCreateChange(t.ID(), 0, t.KeyID(), t.CompressionType()),
+			newCreateChange(t.ID(), 0, t.KeyID(), t.CompressionType(), t.EncryptionMode()),
 		})
 		if err != nil {
 			return err
@@ -1556,12 +2285,16 @@ func (s *levelsController) addLevel0Table(t *table.Table) error {
 	for !s.levels[0].tryAddLevel0Table(t) {
 		// Before we unstall, we need to make sure that level 0 is healthy.
 		timeStart := time.Now()
+		s.kv.events.stallBegin(StallInfo{Reason: StallL0Tables})
+		s.kv.health.stallBegin(StallL0Tables)
 		for s.levels[0].numTables() >= s.kv.opt.NumLevelZeroTablesStall {
 			time.Sleep(10 * time.Millisecond)
 		}
 		dur := time.Since(timeStart)
+		s.kv.events.stallEnd(StallInfo{Reason: StallL0Tables, Duration: dur})
+		s.kv.health.stallEnd(StallL0Tables)
 		if dur > time.Second {
-			s.kv.opt.Infof("L0 was stalled for %s\n", dur.Round(time.Millisecond))
+			s.kv.opt.logw(INFO, "L0 was stalled", "duration", dur.Round(time.Millisecond))
 		}
 		atomic.AddInt64(&s.l0stallsMs, int64(dur.Round(time.Millisecond)))
 	}
@@ -1577,8 +2310,8 @@ func (s *levelsController) close() error {
 // get searches for a given key in all the levels of the LSM tree. It returns
 // key version <= the expected version (maxVs). If not found, it returns an empty
 // y.ValueStruct.
-func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int) (
-	y.ValueStruct, error) {
+func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int,
+	gt *getTrace) (y.ValueStruct, error) {
 	if s.kv.IsClosed() {
 		return y.ValueStruct{}, ErrDBClosed
 	}
@@ -1595,11 +2328,13 @@ func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int)
 		}
 		vs, err := h.get(key) // Calls h.RLock() and h.RUnlock().
 		if err != nil {
-			return y.ValueStruct{}, y.Wrapf(err, "get key: %q", key)
+			return y.ValueStruct{}, y.Wrapf(tableError(err), "get key: %q", key)
 		}
 		if vs.Value == nil && vs.Meta == 0 {
+			gt.lookup(h.level, false)
 			continue
 		}
+		gt.lookup(h.level, true)
 		if vs.Version == version {
 			return vs, nil
 		}
@@ -1644,8 +2379,8 @@ func (s *levelsController) iterators(opt *IteratorOptions) []y.Iterator {
 type TableInfo struct {
 	ID               uint64
 	Level            int
-	Left             []byte
-	Right            []byte
+	Left             []byte // Smallest key in the table, with its version.
+	Right            []byte // Biggest key in the table, with its version.
 	KeyCount         uint32 // Number of keys in the table
 	OnDiskSize       uint32
 	StaleDataSize    uint32
@@ -1653,6 +2388,22 @@ type TableInfo struct {
 	MaxVersion       uint64
 	IndexSz          int
 	BloomFilterSize  int
+	// TombstoneCount is the number of delete markers in the table. It is zero for the tables built
+	// before tombstones were counted.
+	TombstoneCount uint64
+	// MinExpiresAt and MaxExpiresAt are the smallest and the biggest expiry of the entries with a
+	// TTL in the table. Both are zero if no entry has a TTL, or for the tables built before the
+	// expiry was recorded.
+	MinExpiresAt uint64
+	MaxExpiresAt uint64
+	// CreatedAt is the modification time of the table file.
+	CreatedAt time.Time
+	// CompressionRatio is the ratio of the uncompressed size of the data blocks to their size on
+	// disk.
+	CompressionRatio float64
+	// Properties are the custom properties returned by the TablePropertiesCollectors when the
+	// table was built.
+	Properties map[string][]byte
 }
 
 func (s *levelsController) getTableInfo() (result []TableInfo) {
@@ -1671,7 +2422,27 @@ func (s *levelsController) getTableInfo() (result []TableInfo) {
 				BloomFilterSize:  t.BloomFilterSize(),
 				UncompressedSize: t.UncompressedSize(),
 				MaxVersion:       t.MaxVersion(),
+				CreatedAt:        t.CreatedAt,
 			}
+			if dataSize := t.Size() - int64(t.IndexSize()); dataSize > 0 {
+				info.CompressionRatio = float64(t.UncompressedSize()) / float64(dataSize)
+			}
+			props, err := t.Properties()
+			if err != nil {
+				s.kv.opt.Warningf("Unable to read properties of table %d: %v", t.ID(), err)
+			}
+			if v, ok := props[tombstonesProperty]; ok {
+				info.TombstoneCount = y.BytesToU64(v)
+				delete(props, tombstonesProperty)
+			}
+			if minExp, maxExp, _, ok := decodeExpiry(props[expiryProperty]); ok {
+				info.MinExpiresAt, info.MaxExpiresAt = minExp, maxExp
+				delete(props, expiryProperty)
+			}
+			if len(props) == 0 {
+				props = nil
+			}
+			info.Properties = props
 			result = append(result, info)
 		}
 		l.RUnlock()
@@ -1685,6 +2456,114 @@ func (s *levelsController) getTableInfo() (result []TableInfo) {
 	return
 }
 
+// tombstonesProperty is the table property which has the number of delete markers in a table.
+const tombstonesProperty = "badger.tombstones"
+
+// tombstoneCollector counts the delete markers added to a table.
+type tombstoneCollector struct {
+	count uint64
+}
+
+func (c *tombstoneCollector) Add(key []byte, version uint64, value y.ValueStruct) {
+	if value.Meta&bitDelete > 0 {
+		c.count++
+	}
+}
+
+func (c *tombstoneCollector) Finish() map[string][]byte {
+	return map[string][]byte{tombstonesProperty: y.U64ToBytes(c.count)}
+}
+
+// expiryProperty is the table property which has the smallest and the biggest expiry of the
+// entries with a TTL, followed by the number of these entries.
+const expiryProperty = "badger.expiry"
+
+// expiryCollector collects the expiry of the entries with a TTL added to a table.
+type expiryCollector struct {
+	min, max, count uint64
+}
+
+func (c *expiryCollector) Add(key []byte, version uint64, value y.ValueStruct) {
+	// Compactions never discard the entries inserted by the merge operator.
+	if value.ExpiresAt == 0 || value.Meta&bitMergeEntry > 0 {
+		return
+	}
+	if c.count == 0 || value.ExpiresAt < c.min {
+		c.min = value.ExpiresAt
+	}
+	if value.ExpiresAt > c.max {
+		c.max = value.ExpiresAt
+	}
+	c.count++
+}
+
+func (c *expiryCollector) Finish() map[string][]byte {
+	buf := make([]byte, 0, 24)
+	for _, v := range []uint64{c.min, c.max, c.count} {
+		buf = append(buf, y.U64ToBytes(v)...)
+	}
+	return map[string][]byte{expiryProperty: buf}
+}
+
+// decodeExpiry decodes the value of expiryProperty. ok is false if v isn't a valid value.
+func decodeExpiry(v []byte) (minExp, maxExp, count uint64, ok bool) {
+	if len(v) != 24 {
+		return 0, 0, 0, false
+	}
+	return y.BytesToU64(v[:8]), y.BytesToU64(v[8:16]), y.BytesToU64(v[16:]), true
+}
+
+// tableExpiry returns the expiry recorded by the expiryCollector for the table. ok is false if
+// the table has no expiry recorded.
+func tableExpiry(t *table.Table) (minExp, maxExp, count uint64, ok bool) {
+	props, err := t.Properties()
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return decodeExpiry(props[expiryProperty])
+}
+
+// expiredFraction estimates the fraction of the keys of the table, which have expired by now. It
+// assumes the expiry of the entries with a TTL is evenly spread between the smallest and the
+// biggest one.
+func expiredFraction(t *table.Table, now uint64) float64 {
+	minExp, maxExp, count, ok := tableExpiry(t)
+	if !ok || count == 0 || t.KeyCount() == 0 || now < minExp {
+		return 0
+	}
+	frac := 1.0
+	if now < maxExp {
+		frac = float64(now-minExp) / float64(maxExp-minExp)
+	}
+	return frac * float64(count) / float64(t.KeyCount())
+}
+
+// tableGarbageSize estimates the size of the data a compaction of the table would reclaim. That is
+// its stale data, plus the data its delete markers shadow in the levels below, assuming the
+// entries there have the average size of the entries of the table.
+func tableGarbageSize(t *table.Table) int64 {
+	garbage := int64(t.StaleDataSize())
+	props, err := t.Properties()
+	if err != nil || t.KeyCount() == 0 {
+		return garbage
+	}
+	if v, ok := props[tombstonesProperty]; ok {
+		garbage += int64(y.BytesToU64(v)) * t.Size() / int64(t.KeyCount())
+	}
+	return garbage
+}
+
+// tablePropertiesCollectors returns the user provided collectors, followed by the collectors of
+// the properties reported in TableInfo.
+func tablePropertiesCollectors(
+	user []table.TablePropertiesCollectorFactory) []table.TablePropertiesCollectorFactory {
+	out := make([]table.TablePropertiesCollectorFactory, 0, len(user)+2)
+	out = append(out, user...)
+	return append(out,
+		func() table.TablePropertiesCollector { return &tombstoneCollector{} },
+		func() table.TablePropertiesCollector { return &expiryCollector{} })
+}
+
 type LevelInfo struct {
 	Level          int
 	NumTables      int
@@ -1771,20 +2650,37 @@ func (lc *levelsController) AddTable(
 	// TODO: Encryption / Decryption might be required for the table, if the sender and receiver
 	// don't have same encryption mode. See if inplace encryption/decryption can be done.
 	// Tables are sent in the sorted order, so no need to sort them here.
-	encrypted := len(lc.kv.opt.EncryptionKey) > 0
+	encrypted := lc.kv.opt.encrypted()
 	y.AssertTrue((dk != nil && encrypted) || (dk == nil && !encrypted))
 	// The keyId is zero if there is no encryption.
-	opts := buildTableOptions(lc.kv)
+	opts := buildLevelTableOptions(lc.kv, lev)
 	opts.Compression = options.CompressionType(change.Compression)
+	opts.EncryptionMode = options.EncryptionMode(change.EncryptionAlgo)
 	opts.DataKey = dk
 
 	fileID := lc.reserveFileID()
-	fname := table.NewFilename(fileID, lc.kv.opt.Dir)
+	fname := table.NewFilename(fileID, lc.kv.tableDir())
 
 	// kv.Value is owned by the z.buffer. Ensure that we copy this buffer.
 	var tbl *table.Table
 	var err error
-	if lc.kv.opt.InMemory {
+	if dk != nil && opts.EncryptionMode == options.AESGCM {
+		// The table ID is authenticated with the blocks, so the table is rebuilt for fileID.
+		opts.TableID = fileID
+		builder, err := rebuildTable(kv.Value, change.Id, opts)
+		if err != nil {
+			return errors.Wrap(err, "while rebuilding table from buffer")
+		}
+		if lc.keepInMemory(lev) {
+			tbl, err = table.OpenInMemoryTable(builder.Finish(), fileID, &opts)
+		} else {
+			tbl, err = table.CreateTable(fname, builder)
+		}
+		builder.Close()
+		if err != nil {
+			return errors.Wrap(err, "while creating rebuilt table")
+		}
+	} else if lc.keepInMemory(lev) {
 		if tbl, err = table.OpenInMemoryTable(y.Copy(kv.Value), fileID, &opts); err != nil {
 			return errors.Wrap(err, "while creating in-memory table from buffer")
 		}
@@ -1807,3 +2703,42 @@ func (lc *levelsController) AddTable(
 	y.AssertTrue(change.Op == pb.ManifestChange_CREATE)
 	return lc.kv.manifest.addChanges([]*pb.ManifestChange{change})
 }
+
+// rebuildTable returns a builder with the keys of the AES-GCM table in data, which was built with
+// the ID srcID. The table is opened with its own index cache and no other caches, so that it
+// doesn't clash with a local table with the same ID.
+func rebuildTable(data []byte, srcID uint64, opts table.Options) (*table.Builder, error) {
+	indexCache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e3,
+		MaxCost:     int64(len(data)) + 1,
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer indexCache.Close()
+
+	srcOpts := opts
+	srcOpts.IndexCache = indexCache
+	srcOpts.BlockCache = nil
+	srcOpts.CompressedBlockCache = nil
+	srcOpts.FilterCache = nil
+	src, err := table.OpenInMemoryTable(data, srcID, &srcOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = src.DecrRef() }()
+
+	it := src.NewIterator(0)
+	defer it.Close()
+	builder := table.NewTableBuilder(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		vs := it.Value()
+		var vp valuePointer
+		if vs.Meta&bitValuePointer > 0 {
+			vp.Decode(vs.Value)
+		}
+		builder.Add(it.Key(), vs, vp.Len)
+	}
+	return builder, nil
+}
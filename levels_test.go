@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -48,7 +49,11 @@ func createAndOpenWithOptions(db *DB, td []keyValVersion, level int, opts *table
 		bopts := buildTableOptions(db)
 		opts = &bopts
 	}
-	b := table.NewTableBuilder(*opts)
+	fileID := db.lc.reserveFileID()
+	bopts := *opts
+	bopts.TableID = fileID
+	opts = &bopts
+	b := table.NewTableBuilder(bopts)
 	defer b.Close()
 
 	// Add all keys and versions to the table.
@@ -57,7 +62,6 @@ func createAndOpenWithOptions(db *DB, td []keyValVersion, level int, opts *table
 		val := y.ValueStruct{Value: []byte(item.val), Meta: item.meta}
 		b.Add(key, val, 0)
 	}
-	fileID := db.lc.reserveFileID()
 	var tab *table.Table
 	var err error
 	if db.opt.InMemory {
@@ -71,7 +75,8 @@ func createAndOpenWithOptions(db *DB, td []keyValVersion, level int, opts *table
 		panic(err)
 	}
 	if err := db.manifest.addChanges([]*pb.ManifestChange{
-		newCreateChange(tab.ID(), level, tab.KeyID(), tab.CompressionType()),
+		newCreateChange(tab.ID(), level, tab.KeyID(), tab.CompressionType(),
+			tab.EncryptionMode()),
 	}); err != nil {
 		panic(err)
 	}
@@ -469,6 +474,216 @@ func TestCompaction(t *testing.T) {
 	})
 }
 
+func TestCompactionSizeSplits(t *testing.T) {
+	// Disable compactions and keep all versions of the keys.
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(math.MaxInt32)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// A single table in each level. The bottom level has a version of every key, so that the
+		// versions of a key are split across the two levels.
+		var l1, l2, expected []keyValVersion
+		for i := 0; i < 2000; i++ {
+			k := fmt.Sprintf("key%05d", i)
+			v := fmt.Sprintf("%0100d", i)
+			l1 = append(l1, keyValVersion{k, v, 2, 0})
+			l2 = append(l2, keyValVersion{k, v, 1, 0})
+			expected = append(expected, keyValVersion{k, v, 2, 0}, keyValVersion{k, v, 1, 0})
+		}
+		createAndOpen(db, l1, 1)
+		createAndOpen(db, l2, 2)
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[1],
+			nextLevel: db.lc.levels[2],
+			top:       db.lc.levels[1].tables,
+			bot:       db.lc.levels[2].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 2
+		cdef.t.fileSz[2] = 1 << 10
+
+		// A single bottom table doesn't have any table boundary to split at, so the key range is
+		// split by size.
+		db.lc.addSplits(&cdef)
+		require.Len(t, cdef.splits, opt.MaxSubcompactions)
+		for i, kr := range cdef.splits[1:] {
+			require.Equal(t, cdef.splits[i].right, kr.left)
+			require.Equal(t, uint64(math.MaxUint64), y.ParseTs(kr.left))
+			if i > 0 {
+				require.True(t, y.CompareKeys(cdef.splits[i].left, kr.left) < 0)
+			}
+		}
+		require.Empty(t, cdef.splits[len(cdef.splits)-1].right)
+
+		cdef.splits = nil
+		require.NoError(t, db.lc.runCompactDef(-1, 1, cdef))
+		require.Empty(t, db.lc.levels[1].tables)
+		getAllAndCheck(t, db, expected)
+	})
+}
+
+func TestTieredCompaction(t *testing.T) {
+	// Disable the compactors, so that the compactions are run by the test.
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumLevelZeroTables(2).
+		WithCompactionStyle(options.TieredCompaction)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		var l6, expected []keyValVersion
+		for i := 0; i < 1000; i++ {
+			kv := keyValVersion{fmt.Sprintf("a%04d", i), "foo", 1, 0}
+			l6 = append(l6, kv)
+			expected = append(expected, kv)
+		}
+		// createAndOpen doesn't account for the size of the tables, which the tiered compaction
+		// depends on.
+		create := func(td []keyValVersion, level int) {
+			createAndOpen(db, td, level)
+			lh := db.lc.levels[level]
+			lh.Lock()
+			lh.addSize(lh.tables[len(lh.tables)-1])
+			lh.Unlock()
+		}
+		create(l6, 6)
+		create([]keyValVersion{{"b1", "bar", 2, 0}}, 0)
+		require.Empty(t, db.lc.pickTieredLevels())
+		create([]keyValVersion{{"b2", "bar", 3, 0}}, 0)
+		expected = append(expected, keyValVersion{"b1", "bar", 2, 0}, keyValVersion{"b2", "bar", 3, 0})
+
+		// L0 is much smaller than L6, so it's moved to L5 as a new sorted run.
+		require.Equal(t, [][2]int{{0, 5}}, db.lc.pickTieredLevels())
+		require.NoError(t, db.lc.doTieredCompact(0))
+		require.Empty(t, db.lc.levels[0].tables)
+		require.Len(t, db.lc.levels[5].tables, 1)
+		require.Len(t, db.lc.levels[6].tables, 1)
+		require.Equal(t, errFillTables, db.lc.doTieredCompact(0))
+		getAllAndCheck(t, db, expected)
+
+		// The levels levelTargets() picks for L0 compactions must not be below L5.
+		require.Equal(t, 5, db.lc.levelTargets().baseLevel)
+
+		// With a big enough size ratio, L5 and L6 have about the same size and are merged.
+		db.opt.TieredSizeRatio = 1 << 20
+		require.Equal(t, [][2]int{{5, 6}}, db.lc.pickTieredLevels())
+		require.NoError(t, db.lc.doTieredCompact(0))
+		require.Empty(t, db.lc.levels[5].tables)
+		require.NotEmpty(t, db.lc.levels[6].tables)
+		getAllAndCheck(t, db, expected)
+	})
+}
+
+func TestCompactionGarbageRatio(t *testing.T) {
+	// Disable compactions, so that the test picks them.
+	opt := DefaultOptions("").WithNumCompactors(0).WithCompactionGarbageRatio(0.2)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// createAndOpenWithOptions doesn't account for the size of the tables, which includes their
+		// garbage.
+		create := func(td []keyValVersion, level int) {
+			createAndOpenWithOptions(db, td, level, nil)
+			lh := db.lc.levels[level]
+			lh.Lock()
+			lh.addSize(lh.tables[len(lh.tables)-1])
+			lh.Unlock()
+		}
+		var live, deleted []keyValVersion
+		for i := 0; i < 100; i++ {
+			live = append(live, keyValVersion{fmt.Sprintf("a%03d", i), "foo", 1, 0})
+			deleted = append(deleted, keyValVersion{fmt.Sprintf("b%03d", i), "", 2, bitDelete})
+		}
+		create(live, 1)
+		create(deleted, 1)
+		require.Zero(t, db.lc.levels[1].garbage[db.lc.levels[1].tables[0].ID()])
+		require.NotZero(t, db.lc.levels[1].garbage[db.lc.levels[1].tables[1].ID()])
+
+		// L1 is far below its target size, but half of it is garbage.
+		prios := db.lc.pickCompactLevels()
+		require.Len(t, prios, 1)
+		require.Equal(t, 1, prios[0].level)
+
+		// The table with the delete markers is newer, but it's compacted first.
+		cd := compactDef{
+			thisLevel: db.lc.levels[1],
+			nextLevel: db.lc.levels[2],
+			t:         db.lc.levelTargets(),
+		}
+		require.True(t, db.lc.fillTables(&cd))
+		require.Equal(t, db.lc.levels[1].tables[1].ID(), cd.top[0].ID())
+		db.lc.cstatus.delete(cd)
+
+		// Without the garbage ratio, L1 isn't compacted.
+		db.opt.CompactionGarbageRatio = 0
+		require.Empty(t, db.lc.pickCompactLevels())
+	})
+}
+
+func TestTTLCompaction(t *testing.T) {
+	// Disable compactions, so that the test runs them.
+	opt := DefaultOptions("").WithNumCompactors(0).WithTTLCompactionRatio(0.5)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		now := uint64(time.Now().Unix())
+		// create adds a table to the level, whose i-th key expires at expiresAt(i).
+		create := func(prefix string, level int, expiresAt func(i int) uint64) {
+			b := table.NewTableBuilder(buildTableOptions(db))
+			defer b.Close()
+			for i := 0; i < 100; i++ {
+				key := y.KeyWithTs([]byte(fmt.Sprintf("%s%03d", prefix, i)), 1)
+				b.Add(key, y.ValueStruct{Value: []byte("foo"), ExpiresAt: expiresAt(i)}, 0)
+			}
+			tab, err := table.CreateTable(table.NewFilename(db.lc.reserveFileID(), db.opt.Dir), b)
+			require.NoError(t, err)
+			require.NoError(t, db.manifest.addChanges([]*pb.ManifestChange{
+				newCreateChange(tab.ID(), level, tab.KeyID(), tab.CompressionType(), 0),
+			}))
+			lh := db.lc.levels[level]
+			lh.Lock()
+			lh.tables = append(lh.tables, tab)
+			lh.addSize(tab)
+			lh.Unlock()
+		}
+		create("a", 1, func(i int) uint64 { return now - 100 })
+		create("b", 1, func(i int) uint64 { return now - 100 })
+		// The expired keys of the second table are older versions of the keys in L6.
+		create("b", 6, func(i int) uint64 { return 0 })
+		// 80 keys of the last table have expired.
+		create("c", 6, func(i int) uint64 { return now - 795 + 10*uint64(i) })
+
+		// The versions above the discard timestamp are kept.
+		n, err := db.lc.dropExpiredTables(1)
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		db.SetDiscardTs(1)
+		n, err = db.lc.dropExpiredTables(1)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		require.Equal(t, 1, db.lc.levels[1].numTables())
+		require.Equal(t, "b000", string(y.ParseKey(db.lc.levels[1].tables[0].Smallest())))
+
+		for _, info := range db.Tables() {
+			if info.Level == 6 && info.KeyCount == 100 && info.MinExpiresAt > 0 {
+				require.Equal(t, now-795, info.MinExpiresAt)
+				require.Equal(t, now+195, info.MaxExpiresAt)
+			}
+		}
+
+		// The table with the expired keys is rewritten on the last level.
+		require.NoError(t, db.lc.ttlCompact(-1, 6))
+		require.Equal(t, 2, db.lc.levels[6].numTables())
+		require.NoError(t, db.lc.validate())
+		for _, tab := range db.lc.levels[6].tables {
+			if bytes.HasPrefix(y.ParseKey(tab.Smallest()), []byte("c")) {
+				require.Equal(t, uint32(20), tab.KeyCount())
+			}
+		}
+		// No table is expired enough to be compacted again.
+		require.Equal(t, errFillTables, db.lc.ttlCompact(-1, 6))
+
+		// The compaction status must be clean after the compactions.
+		require.Equal(t, 0, len(db.lc.cstatus.tables))
+	})
+}
+
 func TestCompactionTwoVersions(t *testing.T) {
 	// Disable compactions and keep two versions of each key.
 	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(2)
@@ -1142,6 +1357,37 @@ func TestSameLevel(t *testing.T) {
 	})
 }
 
+func TestMergeTinyTables(t *testing.T) {
+	opt := DefaultOptions("")
+	opt.NumCompactors = 0
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		var all []keyValVersion
+		addTable := func(key string) {
+			kv := []keyValVersion{{key, "bar", 2, 0}, {key + "foo", "baz", 1, 0}}
+			createAndOpen(db, kv, 6)
+			all = append(all, kv...)
+		}
+		for _, k := range []string{"A", "B", "C"} {
+			addTable(k)
+		}
+		// Three tables are too few to be worth merging.
+		require.Equal(t, errFillTables, db.lc.mergeTinyTables(-1, 6))
+
+		for _, k := range []string{"D", "E"} {
+			addTable(k)
+		}
+		require.NoError(t, db.lc.mergeTinyTables(-1, 6))
+		require.Equal(t, 1, db.lc.levels[6].numTables())
+		require.NoError(t, db.lc.validate())
+		getAllAndCheck(t, db, all)
+
+		// The compaction status must be clean after the merge.
+		require.Equal(t, 0, len(db.lc.cstatus.levels[6].ranges))
+		require.Equal(t, 0, len(db.lc.cstatus.tables))
+	})
+}
+
 func TestTableContainsPrefix(t *testing.T) {
 	opts := table.Options{
 		BlockSize:          4 * 1024,
@@ -1217,7 +1463,7 @@ func TestStaleDataCleanup(t *testing.T) {
 		for i := byte(1); i < 5; i++ {
 			tab := buildStaleTable(i)
 			require.NoError(t, db.manifest.addChanges([]*pb.ManifestChange{
-				newCreateChange(tab.ID(), level, 0, tab.CompressionType()),
+				newCreateChange(tab.ID(), level, 0, tab.CompressionType(), 0),
 			}))
 			tab.CreatedAt = time.Now().Add(-10 * time.Hour)
 			// Add table to the given level.
@@ -1304,6 +1550,19 @@ func TestStreamWithFullCopy(t *testing.T) {
 			require.Greater(t, len(db.registry.dataKeys), 1)
 		})
 	})
+	t.Run("with authenticated encryption", func(t *testing.T) {
+		opts := dbopts
+		opts.IndexCacheSize = 1 << 20
+		opts.BlockCacheSize = 1 << 20
+		opts.EncryptionKey = encKey
+		opts.EncryptionKeyRotationDuration = 0
+		opts.EncryptionMode = options.AESGCM
+		runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+			// The receiver gives the tables other IDs, so it rebuilds them.
+			db.lc.reserveFileID()
+			test(db, opts)
+		})
+	})
 	t.Run("stream from in-memory to persistent", func(t *testing.T) {
 		opts := dbopts
 		opts.IndexCacheSize = 1 << 20
@@ -1320,3 +1579,180 @@ func TestStreamWithFullCopy(t *testing.T) {
 		})
 	})
 }
+
+// tenantCollector counts the entries of every tenant, which is the part of the key before ':'.
+type tenantCollector map[string]uint64
+
+func (c tenantCollector) Add(key []byte, version uint64, value y.ValueStruct) {
+	if i := bytes.IndexByte(key, ':'); i > 0 {
+		c[string(key[:i])]++
+	}
+}
+
+func (c tenantCollector) Finish() map[string][]byte {
+	props := make(map[string][]byte, len(c))
+	for tenant, n := range c {
+		props["tenant."+tenant] = y.U64ToBytes(n)
+	}
+	return props
+}
+
+func TestTablePropertiesCollectors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithTablePropertiesCollectors(func() table.TablePropertiesCollector {
+		return tenantCollector{}
+	})
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 30; i++ {
+			tenant := "foo"
+			if i%3 == 0 {
+				tenant = "bar"
+			}
+			k := []byte(fmt.Sprintf("%s:%02d", tenant, i))
+			if err := txn.SetEntry(NewEntry(k, []byte("v"))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// Closing the DB flushes the memtable to a table.
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	tables := db.Tables()
+	require.Len(t, tables, 1)
+	require.Equal(t, y.U64ToBytes(10), tables[0].Properties["tenant.bar"])
+	require.Equal(t, y.U64ToBytes(20), tables[0].Properties["tenant.foo"])
+}
+
+func TestTableInfoMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("key%03d", i))
+			if i%4 == 0 {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := txn.Set(k, []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	tables := db.Tables()
+	require.Len(t, tables, 1)
+	info := tables[0]
+	require.Equal(t, uint64(25), info.TombstoneCount)
+	require.Nil(t, info.Properties)
+	require.False(t, info.CreatedAt.IsZero())
+	require.Greater(t, info.CompressionRatio, 0.0)
+	require.Equal(t, []byte("key000"), y.ParseKey(info.Left))
+	require.Equal(t, []byte("key099"), y.ParseKey(info.Right))
+}
+
+func TestLevelChecksumVerificationModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).
+		WithBlockChecksumAlgorithm(options.XXHash64).
+		WithLevelChecksumVerificationModes(options.OnBlockRead, options.OnCompactionRead)
+	require.Equal(t, options.OnBlockRead, opt.checksumVerificationMode(0))
+	require.Equal(t, options.OnCompactionRead, opt.checksumVerificationMode(1))
+	require.Equal(t, opt.ChecksumVerificationMode, opt.checksumVerificationMode(2))
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	n := 1000
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.Flatten(1))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+			if err != nil {
+				return err
+			}
+			if err := item.Value(func(val []byte) error {
+				require.Equal(t, []byte("value"), val)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func TestCompactionDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithCompactionDirectIO(true)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	n := 1000
+	for b := 0; b < 2; b++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				k := []byte(fmt.Sprintf("key%04d", i))
+				if err := txn.Set(k, []byte(fmt.Sprintf("value%d-%d", b, i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		// Write each batch to its own table in L0.
+		require.NoError(t, db.Close())
+		db, err = Open(opt)
+		require.NoError(t, err)
+	}
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Equal(t, 2, db.lc.levels[0].numTables())
+	require.NoError(t, db.lc.doCompact(0, compactionPriority{level: 0, score: 1.0}))
+	require.Zero(t, db.lc.levels[0].numTables())
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+			if err != nil {
+				return err
+			}
+			require.Equal(t, []byte(fmt.Sprintf("value1-%d", i)), getItemValue(t, item))
+		}
+		return nil
+	}))
+}
@@ -17,8 +17,10 @@
 package badger
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 // Logger is implemented by any logging system that is used for standard logs.
@@ -29,6 +31,53 @@ type Logger interface {
 	Debugf(string, ...interface{})
 }
 
+// StructuredLogger is implemented by any logging system which supports structured logs. The
+// events of the compactions, the flushes and the value log GC are logged with Log, along with
+// machine-readable fields.
+type StructuredLogger interface {
+	// Log logs the message msg at the given level. keysAndValues are the fields of the message, as
+	// alternating keys and values. The keys are strings.
+	Log(level LogLevel, msg string, keysAndValues ...interface{})
+}
+
+// logw logs a structured message to the StructuredLogger specified in opts. If there is none, the
+// message is logged to the Logger, followed by its fields formatted as key=value pairs.
+func (opt *Options) logw(level LogLevel, msg string, keysAndValues ...interface{}) {
+	if opt.StructuredLogger != nil {
+		opt.StructuredLogger.Log(level, msg, keysAndValues...)
+		return
+	}
+	if opt.Logger == nil {
+		return
+	}
+	line := formatFields(msg, keysAndValues)
+	switch level {
+	case DEBUG:
+		opt.Logger.Debugf("%s", line)
+	case INFO:
+		opt.Logger.Infof("%s", line)
+	case WARNING:
+		opt.Logger.Warningf("%s", line)
+	default:
+		opt.Logger.Errorf("%s", line)
+	}
+}
+
+// formatFields formats msg followed by the fields as key=value pairs. A key without a value is
+// formatted as key=<missing>.
+func formatFields(msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var val interface{} = "<missing>"
+		if i+1 < len(keysAndValues) {
+			val = keysAndValues[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], val)
+	}
+	return b.String()
+}
+
 // Errorf logs an ERROR log message to the logger specified in opts or to the
 // global logger if no logger is specified in opts.
 func (opt *Options) Errorf(format string, v ...interface{}) {
@@ -62,21 +111,36 @@ func (opt *Options) Debugf(format string, v ...interface{}) {
 	opt.Logger.Debugf(format, v...)
 }
 
-type loggingLevel int
+// LogLevel is the level of a log message.
+type LogLevel int
 
 const (
-	DEBUG loggingLevel = iota
+	DEBUG LogLevel = iota
 	INFO
 	WARNING
 	ERROR
 )
 
+func (l LogLevel) String() string {
+	switch l {
+	case DEBUG:
+		return "DEBUG"
+	case INFO:
+		return "INFO"
+	case WARNING:
+		return "WARNING"
+	case ERROR:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
 type defaultLog struct {
 	*log.Logger
-	level loggingLevel
+	level LogLevel
 }
 
-func defaultLogger(level loggingLevel) *defaultLog {
+func defaultLogger(level LogLevel) *defaultLog {
 	return &defaultLog{Logger: log.New(os.Stderr, "badger ", log.LstdFlags), level: level}
 }
 
@@ -69,3 +69,31 @@ func TestNoDbLog(t *testing.T) {
 	opt.Warningf("test")
 	require.Equal(t, "WARNING: test", l.output)
 }
+
+type mockStructuredLogger struct {
+	level  LogLevel
+	msg    string
+	fields []interface{}
+}
+
+func (l *mockStructuredLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	l.level, l.msg, l.fields = level, msg, keysAndValues
+}
+
+// Test that structured logs go to the StructuredLogger, or are formatted for the Logger.
+func TestStructuredLog(t *testing.T) {
+	l := &mockLogger{}
+	opt := Options{Logger: l}
+	opt.logw(WARNING, "Compaction failed", "level", 1, "error", "foo")
+	require.Equal(t, "WARNING: Compaction failed level=1 error=foo", l.output)
+	opt.logw(INFO, "Odd fields", "key")
+	require.Equal(t, "INFO: Odd fields key=<missing>", l.output)
+
+	sl := &mockStructuredLogger{}
+	opt.StructuredLogger = sl
+	opt.logw(DEBUG, "Flushed memtable", "table", 3)
+	require.Equal(t, DEBUG, sl.level)
+	require.Equal(t, "Flushed memtable", sl.msg)
+	require.Equal(t, []interface{}{"table", 3}, sl.fields)
+	require.Equal(t, "INFO: Odd fields key=<missing>", l.output)
+}
@@ -0,0 +1,11 @@
+module github.com/dgraph-io/badger/v3/logging
+
+go 1.12
+
+require (
+	github.com/dgraph-io/badger/v3 v3.0.0
+	github.com/stretchr/testify v1.7.0
+	go.uber.org/zap v1.16.0
+)
+
+replace github.com/dgraph-io/badger/v3 => ../
@@ -0,0 +1,60 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// SlogLogger adapts a slog logger to the Logger and the StructuredLogger of Badger.
+type SlogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a SlogLogger writing to l.
+func NewSlogLogger(l *slog.Logger) *SlogLogger {
+	return &SlogLogger{l: l}
+}
+
+func (s *SlogLogger) Errorf(f string, v ...interface{})   { s.l.Error(fmt.Sprintf(f, v...)) }
+func (s *SlogLogger) Warningf(f string, v ...interface{}) { s.l.Warn(fmt.Sprintf(f, v...)) }
+func (s *SlogLogger) Infof(f string, v ...interface{})    { s.l.Info(fmt.Sprintf(f, v...)) }
+func (s *SlogLogger) Debugf(f string, v ...interface{})   { s.l.Debug(fmt.Sprintf(f, v...)) }
+
+// Log logs msg with the fields keysAndValues, as slog attributes.
+func (s *SlogLogger) Log(level badger.LogLevel, msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slogLevel(level), msg, keysAndValues...)
+}
+
+func slogLevel(level badger.LogLevel) slog.Level {
+	switch level {
+	case badger.DEBUG:
+		return slog.LevelDebug
+	case badger.INFO:
+		return slog.LevelInfo
+	case badger.WARNING:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+)
+
+// ZapLogger adapts a zap logger to the Logger and the StructuredLogger of Badger.
+type ZapLogger struct {
+	l *zap.SugaredLogger
+}
+
+// NewZapLogger returns a ZapLogger writing to l.
+func NewZapLogger(l *zap.Logger) *ZapLogger {
+	return &ZapLogger{l: l.Sugar()}
+}
+
+func (z *ZapLogger) Errorf(f string, v ...interface{})   { z.l.Errorf(f, v...) }
+func (z *ZapLogger) Warningf(f string, v ...interface{}) { z.l.Warnf(f, v...) }
+func (z *ZapLogger) Infof(f string, v ...interface{})    { z.l.Infof(f, v...) }
+func (z *ZapLogger) Debugf(f string, v ...interface{})   { z.l.Debugf(f, v...) }
+
+// Log logs msg with the fields keysAndValues, as zap fields.
+func (z *ZapLogger) Log(level badger.LogLevel, msg string, keysAndValues ...interface{}) {
+	switch level {
+	case badger.DEBUG:
+		z.l.Debugw(msg, keysAndValues...)
+	case badger.INFO:
+		z.l.Infow(msg, keysAndValues...)
+	case badger.WARNING:
+		z.l.Warnw(msg, keysAndValues...)
+	default:
+		z.l.Errorw(msg, keysAndValues...)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestZapLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var l badger.StructuredLogger = NewZapLogger(zap.New(core))
+
+	l.Log(badger.WARNING, "Compaction failed", "level", 1, "compactor", 2)
+	entries := logs.TakeAll()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	require.Equal(t, "Compaction failed", entries[0].Message)
+	require.Equal(t, map[string]interface{}{"level": int64(1), "compactor": int64(2)},
+		entries[0].ContextMap())
+
+	var pl badger.Logger = NewZapLogger(zap.New(core))
+	pl.Infof("Opened %d tables", 3)
+	entries = logs.TakeAll()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.InfoLevel, entries[0].Level)
+	require.Equal(t, "Opened 3 tables", entries[0].Message)
+}
@@ -1,6 +1,7 @@
 package badger
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -846,7 +847,8 @@ func TestZeroDiscardStats(t *testing.T) {
 			// Ensure we have some valid fids.
 			require.True(t, len(fids) > 2)
 			fid := fids[0]
-			require.NoError(t, db.vlog.rewrite(db.vlog.filesMap[fid]))
+			_, _, err := db.vlog.rewrite(context.Background(), db.vlog.filesMap[fid])
+			require.NoError(t, err)
 			// All data should still be present.
 			require.Equal(t, int(N), numKeys(db))
 
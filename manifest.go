@@ -73,12 +73,17 @@ type TableManifest struct {
 	Level       uint8
 	KeyID       uint64
 	Compression options.CompressionType
+	// EncryptionMode is how the table is encrypted, if KeyID isn't zero.
+	EncryptionMode options.EncryptionMode
+	// RemoteURL is the URL of the table in object storage, if it is a remote table.
+	RemoteURL string
 }
 
 // manifestFile holds the file pointer (and other info) about the manifest file, which is a log
 // file we append to.
 type manifestFile struct {
-	fp        *os.File
+	fp        y.File
+	fs        y.FS
 	directory string
 
 	// The external magic number used by the application running badger.
@@ -95,6 +100,12 @@ type manifestFile struct {
 
 	// Used to indicate if badger was opened in InMemory mode.
 	inMemory bool
+
+	// size is the size of the file. It is rewritten once it's bigger than rewriteSize, and twice as
+	// big as it was after the last rewrite, rewrittenSize.
+	size          int64
+	rewriteSize   int64
+	rewrittenSize int64
 }
 
 const (
@@ -110,7 +121,9 @@ const (
 func (m *Manifest) asChanges() []*pb.ManifestChange {
 	changes := make([]*pb.ManifestChange, 0, len(m.Tables))
 	for id, tm := range m.Tables {
-		changes = append(changes, newCreateChange(id, int(tm.Level), tm.KeyID, tm.Compression))
+		change := newCreateChange(id, int(tm.Level), tm.KeyID, tm.Compression, tm.EncryptionMode)
+		change.RemoteUrl = tm.RemoteURL
+		changes = append(changes, change)
 	}
 	return changes
 }
@@ -129,11 +142,16 @@ func openOrCreateManifestFile(opt Options) (
 	if opt.InMemory {
 		return &manifestFile{inMemory: true, manifest: createManifest()}, Manifest{}, nil
 	}
-	return helpOpenOrCreateManifestFile(opt.Dir, opt.ReadOnly, opt.ExternalMagicVersion,
-		manifestDeletionsRewriteThreshold)
+	mf, m, err := helpOpenOrCreateManifestFile(opt.FS, opt.Dir, opt.ReadOnly,
+		opt.ExternalMagicVersion, manifestDeletionsRewriteThreshold)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	mf.rewriteSize = opt.ManifestRewriteSize
+	return mf, m, nil
 }
 
-func helpOpenOrCreateManifestFile(dir string, readOnly bool, extMagic uint16,
+func helpOpenOrCreateManifestFile(fs y.FS, dir string, readOnly bool, extMagic uint16,
 	deletionsThreshold int) (*manifestFile, Manifest, error) {
 
 	path := filepath.Join(dir, ManifestFilename)
@@ -141,7 +159,8 @@ func helpOpenOrCreateManifestFile(dir string, readOnly bool, extMagic uint16,
 	if readOnly {
 		flags |= y.ReadOnly
 	}
-	fp, err := y.OpenExistingFile(path, flags) // We explicitly sync in addChanges, outside the lock.
+	// We explicitly sync in addChanges, outside the lock.
+	fp, err := y.OpenExistingFileFS(fs, path, flags)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return nil, Manifest{}, err
@@ -149,23 +168,37 @@ func helpOpenOrCreateManifestFile(dir string, readOnly bool, extMagic uint16,
 		if readOnly {
 			return nil, Manifest{}, fmt.Errorf("no manifest found, required for read-only db")
 		}
+		// The tables not in the MANIFEST are deleted by Open.
+		if ids, err := tableIDs(fs, dir); err != nil {
+			return nil, Manifest{}, err
+		} else if len(ids) > 0 {
+			return nil, Manifest{}, ErrManifestMissing
+		}
 		m := createManifest()
-		fp, netCreations, err := helpRewrite(dir, &m, extMagic)
+		fp, netCreations, err := helpRewrite(fs, dir, &m, extMagic)
 		if err != nil {
 			return nil, Manifest{}, err
 		}
 		y.AssertTrue(netCreations == 0)
+		fi, err := fp.Stat()
+		if err != nil {
+			_ = fp.Close()
+			return nil, Manifest{}, err
+		}
 		mf := &manifestFile{
 			fp:                        fp,
+			fs:                        fs,
 			directory:                 dir,
 			externalMagic:             extMagic,
 			manifest:                  m.clone(),
 			deletionsRewriteThreshold: deletionsThreshold,
+			size:                      fi.Size(),
+			rewrittenSize:             fi.Size(),
 		}
 		return mf, m, nil
 	}
 
-	manifest, truncOffset, err := ReplayManifestFile(fp, extMagic)
+	manifest, truncOffset, err := replayManifestFile(fp, extMagic)
 	if err != nil {
 		_ = fp.Close()
 		return nil, Manifest{}, err
@@ -185,10 +218,12 @@ func helpOpenOrCreateManifestFile(dir string, readOnly bool, extMagic uint16,
 
 	mf := &manifestFile{
 		fp:                        fp,
+		fs:                        fs,
 		directory:                 dir,
 		externalMagic:             extMagic,
 		manifest:                  manifest.clone(),
 		deletionsRewriteThreshold: deletionsThreshold,
+		size:                      truncOffset,
 	}
 	return mf, manifest, nil
 }
@@ -219,9 +254,10 @@ func (mf *manifestFile) addChanges(changesParam []*pb.ManifestChange) error {
 	if mf.inMemory {
 		return nil
 	}
-	// Rewrite manifest if it'd shrink by 1/10 and it's big enough to care
+	// Rewrite manifest if it'd shrink by 1/10 and it's big enough to care, or if it's too big.
 	if mf.manifest.Deletions > mf.deletionsRewriteThreshold &&
-		mf.manifest.Deletions > manifestDeletionsRatio*(mf.manifest.Creations-mf.manifest.Deletions) {
+		mf.manifest.Deletions > manifestDeletionsRatio*(mf.manifest.Creations-mf.manifest.Deletions) ||
+		mf.rewriteSize > 0 && mf.size > mf.rewriteSize && mf.size > 2*mf.rewrittenSize {
 		if err := mf.rewrite(); err != nil {
 			return err
 		}
@@ -233,13 +269,14 @@ func (mf *manifestFile) addChanges(changesParam []*pb.ManifestChange) error {
 		if _, err := mf.fp.Write(buf); err != nil {
 			return err
 		}
+		mf.size += int64(len(buf))
 	}
 
 	return syncFunc(mf.fp)
 }
 
 // this function is saved here to allow injection of fake filesystem latency at test time.
-var syncFunc = func(f *os.File) error { return f.Sync() }
+var syncFunc = func(f y.File) error { return f.Sync() }
 
 // Has to be 4 bytes.  The value can never change, ever, anyway.
 var magicText = [4]byte{'B', 'd', 'g', 'r'}
@@ -247,10 +284,10 @@ var magicText = [4]byte{'B', 'd', 'g', 'r'}
 // The magic version number. It is allocated 2 bytes, so it's value must be <= math.MaxUint16
 const badgerMagicVersion = 8
 
-func helpRewrite(dir string, m *Manifest, extMagic uint16) (*os.File, int, error) {
+func helpRewrite(fs y.FS, dir string, m *Manifest, extMagic uint16) (y.File, int, error) {
 	rewritePath := filepath.Join(dir, manifestRewriteFilename)
 	// We explicitly sync.
-	fp, err := y.OpenTruncFile(rewritePath, false)
+	fp, err := y.OpenTruncFileFS(fs, rewritePath, false)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -294,10 +331,10 @@ func helpRewrite(dir string, m *Manifest, extMagic uint16) (*os.File, int, error
 		return nil, 0, err
 	}
 	manifestPath := filepath.Join(dir, ManifestFilename)
-	if err := os.Rename(rewritePath, manifestPath); err != nil {
+	if err := fs.Rename(rewritePath, manifestPath); err != nil {
 		return nil, 0, err
 	}
-	fp, err = y.OpenExistingFile(manifestPath, 0)
+	fp, err = y.OpenExistingFileFS(fs, manifestPath, 0)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -305,7 +342,7 @@ func helpRewrite(dir string, m *Manifest, extMagic uint16) (*os.File, int, error
 		fp.Close()
 		return nil, 0, err
 	}
-	if err := syncDir(dir); err != nil {
+	if err := fs.SyncDir(dir); err != nil {
 		fp.Close()
 		return nil, 0, err
 	}
@@ -319,13 +356,19 @@ func (mf *manifestFile) rewrite() error {
 	if err := mf.fp.Close(); err != nil {
 		return err
 	}
-	fp, netCreations, err := helpRewrite(mf.directory, &mf.manifest, mf.externalMagic)
+	fp, netCreations, err := helpRewrite(mf.fs, mf.directory, &mf.manifest, mf.externalMagic)
 	if err != nil {
 		return err
 	}
 	mf.fp = fp
 	mf.manifest.Creations = netCreations
 	mf.manifest.Deletions = 0
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	mf.size = fi.Size()
+	mf.rewrittenSize = mf.size
 
 	return nil
 }
@@ -350,8 +393,10 @@ func (r *countingReader) ReadByte() (b byte, err error) {
 }
 
 var (
-	errBadMagic    = errors.New("manifest has bad magic")
-	errBadChecksum = errors.New("manifest has checksum mismatch")
+	errBadMagic     = newError(CodeCorruption, "manifest has bad magic")
+	errBadChecksum  = newError(CodeCorruption, "manifest has checksum mismatch")
+	errBadLength    = newError(CodeCorruption, "manifest has a change set longer than the file")
+	errBadChangeSet = newError(CodeCorruption, "manifest has an invalid change set")
 )
 
 // ReplayManifestFile reads the manifest file and constructs two manifest objects.  (We need one
@@ -360,14 +405,19 @@ var (
 // truncated at that point before further appends are made (if there is a partial entry after
 // that).  In normal conditions, truncOffset is the file size.
 func ReplayManifestFile(fp *os.File, extMagic uint16) (Manifest, int64, error) {
+	return replayManifestFile(fp, extMagic)
+}
+
+// replayManifestFile is ReplayManifestFile for a file of a y.FS.
+func replayManifestFile(fp y.File, extMagic uint16) (Manifest, int64, error) {
 	r := countingReader{wrapped: bufio.NewReader(fp)}
 
 	var magicBuf [8]byte
 	if _, err := io.ReadFull(&r, magicBuf[:]); err != nil {
-		return Manifest{}, 0, errBadMagic
+		return Manifest{}, 0, fileError(errBadMagic, fp.Name(), 0, err)
 	}
 	if !bytes.Equal(magicBuf[0:4], magicText[:]) {
-		return Manifest{}, 0, errBadMagic
+		return Manifest{}, 0, fileError(errBadMagic, fp.Name(), 0, nil)
 	}
 
 	extVersion := y.BytesToU16(magicBuf[4:6])
@@ -407,9 +457,8 @@ func ReplayManifestFile(fp *os.File, extMagic uint16) (Manifest, int64, error) {
 		length := y.BytesToU32(lenCrcBuf[0:4])
 		// Sanity check to ensure we don't over-allocate memory.
 		if length > uint32(stat.Size()) {
-			return Manifest{}, 0, errors.Errorf(
-				"Buffer length: %d greater than file size: %d. Manifest file might be corrupted",
-				length, stat.Size())
+			return Manifest{}, 0, fileError(errBadLength, fp.Name(), offset, errors.Errorf(
+				"Buffer length: %d greater than file size: %d", length, stat.Size()))
 		}
 		var buf = make([]byte, length)
 		if _, err := io.ReadFull(&r, buf); err != nil {
@@ -419,16 +468,16 @@ func ReplayManifestFile(fp *os.File, extMagic uint16) (Manifest, int64, error) {
 			return Manifest{}, 0, err
 		}
 		if crc32.Checksum(buf, y.CastagnoliCrcTable) != y.BytesToU32(lenCrcBuf[4:8]) {
-			return Manifest{}, 0, errBadChecksum
+			return Manifest{}, 0, fileError(errBadChecksum, fp.Name(), offset, nil)
 		}
 
 		var changeSet pb.ManifestChangeSet
 		if err := proto.Unmarshal(buf, &changeSet); err != nil {
-			return Manifest{}, 0, err
+			return Manifest{}, 0, fileError(errBadChangeSet, fp.Name(), offset, err)
 		}
 
 		if err := applyChangeSet(&build, &changeSet); err != nil {
-			return Manifest{}, 0, err
+			return Manifest{}, 0, fileError(errBadChangeSet, fp.Name(), offset, err)
 		}
 	}
 
@@ -442,9 +491,11 @@ func applyManifestChange(build *Manifest, tc *pb.ManifestChange) error {
 			return fmt.Errorf("MANIFEST invalid, table %d exists", tc.Id)
 		}
 		build.Tables[tc.Id] = TableManifest{
-			Level:       uint8(tc.Level),
-			KeyID:       tc.KeyId,
-			Compression: options.CompressionType(tc.Compression),
+			Level:          uint8(tc.Level),
+			KeyID:          tc.KeyId,
+			Compression:    options.CompressionType(tc.Compression),
+			RemoteURL:      tc.RemoteUrl,
+			EncryptionMode: options.EncryptionMode(tc.EncryptionAlgo),
 		}
 		for len(build.Levels) <= int(tc.Level) {
 			build.Levels = append(build.Levels, levelManifest{make(map[uint64]struct{})})
@@ -476,15 +527,14 @@ func applyChangeSet(build *Manifest, changeSet *pb.ManifestChangeSet) error {
 	return nil
 }
 
-func newCreateChange(
-	id uint64, level int, keyID uint64, c options.CompressionType) *pb.ManifestChange {
+func newCreateChange(id uint64, level int, keyID uint64, c options.CompressionType,
+	mode options.EncryptionMode) *pb.ManifestChange {
 	return &pb.ManifestChange{
-		Id:    id,
-		Op:    pb.ManifestChange_CREATE,
-		Level: uint32(level),
-		KeyId: keyID,
-		// Hard coding it, since we're supporting only AES for now.
-		EncryptionAlgo: pb.EncryptionAlgo_aes,
+		Id:             id,
+		Op:             pb.ManifestChange_CREATE,
+		Level:          uint32(level),
+		KeyId:          keyID,
+		EncryptionAlgo: pb.EncryptionAlgo(mode),
 		Compression:    uint32(c),
 	}
 }
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -215,7 +216,7 @@ func TestManifestRewrite(t *testing.T) {
 	require.NoError(t, err)
 	defer removeDir(dir)
 	deletionsThreshold := 10
-	mf, m, err := helpOpenOrCreateManifestFile(dir, false, 0, deletionsThreshold)
+	mf, m, err := helpOpenOrCreateManifestFile(y.OSFS, dir, false, 0, deletionsThreshold)
 	defer func() {
 		if mf != nil {
 			mf.close()
@@ -226,13 +227,13 @@ func TestManifestRewrite(t *testing.T) {
 	require.Equal(t, 0, m.Deletions)
 
 	err = mf.addChanges([]*pb.ManifestChange{
-		newCreateChange(0, 0, 0, 0),
+		newCreateChange(0, 0, 0, 0, 0),
 	})
 	require.NoError(t, err)
 
 	for i := uint64(0); i < uint64(deletionsThreshold*3); i++ {
 		ch := []*pb.ManifestChange{
-			newCreateChange(i+1, 0, 0, 0),
+			newCreateChange(i+1, 0, 0, 0, 0),
 			newDeleteChange(i),
 		}
 		err := mf.addChanges(ch)
@@ -241,13 +242,52 @@ func TestManifestRewrite(t *testing.T) {
 	err = mf.close()
 	require.NoError(t, err)
 	mf = nil
-	mf, m, err = helpOpenOrCreateManifestFile(dir, false, 0, deletionsThreshold)
+	mf, m, err = helpOpenOrCreateManifestFile(y.OSFS, dir, false, 0, deletionsThreshold)
 	require.NoError(t, err)
 	require.Equal(t, map[uint64]TableManifest{
 		uint64(deletionsThreshold * 3): {Level: 0},
 	}, m.Tables)
 }
 
+func TestManifestRewriteSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	// The deletions never rewrite the MANIFEST, but its size does.
+	mf, _, err := helpOpenOrCreateManifestFile(y.OSFS, dir, false, 0, math.MaxInt32)
+	require.NoError(t, err)
+	defer func() {
+		if mf != nil {
+			mf.close()
+		}
+	}()
+	mf.rewriteSize = 4 << 10
+
+	require.NoError(t, mf.addChanges([]*pb.ManifestChange{newCreateChange(0, 0, 0, 0, 0)}))
+	var rewrites int
+	for i := uint64(0); i < 1000; i++ {
+		size := mf.size
+		require.NoError(t, mf.addChanges([]*pb.ManifestChange{
+			newCreateChange(i+1, 0, 0, 0, 0),
+			newDeleteChange(i),
+		}))
+		if mf.size < size {
+			rewrites++
+		}
+		require.True(t, mf.size <= 4<<10+64)
+	}
+	require.True(t, rewrites > 0)
+	fi, err := os.Stat(filepath.Join(dir, ManifestFilename))
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), mf.size)
+
+	require.NoError(t, mf.close())
+	mf = nil
+	mf, m, err := helpOpenOrCreateManifestFile(y.OSFS, dir, false, 0, math.MaxInt32)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]TableManifest{1000: {Level: 0}}, m.Tables)
+}
+
 func TestConcurrentManifestCompaction(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger-test")
 	require.NoError(t, err)
@@ -257,19 +297,19 @@ func TestConcurrentManifestCompaction(t *testing.T) {
 	deletionsThreshold := 1
 
 	// overwrite the sync function to make this race condition easily reproducible
-	syncFunc = func(f *os.File) error {
+	syncFunc = func(f y.File) error {
 		// effectively making the Sync() take around 1s makes this reproduce every time
 		time.Sleep(1 * time.Second)
 		return f.Sync()
 	}
 
-	mf, _, err := helpOpenOrCreateManifestFile(dir, false, 0, deletionsThreshold)
+	mf, _, err := helpOpenOrCreateManifestFile(y.OSFS, dir, false, 0, deletionsThreshold)
 	require.NoError(t, err)
 
 	cs := &pb.ManifestChangeSet{}
 	for i := uint64(0); i < 1000; i++ {
 		cs.Changes = append(cs.Changes,
-			newCreateChange(i, 0, 0, 0),
+			newCreateChange(i, 0, 0, 0, 0),
 			newDeleteChange(i),
 		)
 	}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// MemoryUsage is the memory accounted against Options.MemoryBudget, as returned by
+// DB.MemoryUsage.
+type MemoryUsage struct {
+	// Budget is Options.MemoryBudget. The memory isn't limited if it is 0.
+	Budget int64
+	// Memtables is the size of the skiplists of the memtables, including those waiting to be
+	// flushed.
+	Memtables int64
+	// Tables is the size of the tables kept in memory in InMemory mode. It isn't part of the
+	// Total, as the tables can't be released to stay within the budget. Instead, they're spilled
+	// to Options.TempSpillDir beyond the budget.
+	Tables int64
+	// Caches is the cost of the entries of the block, index and filter caches.
+	Caches int64
+	// Iterators is the size of the buffers the open iterators copied the values into.
+	Iterators int64
+	// CacheScale is the fraction of their sizes the caches are shrunk to, to stay within the
+	// budget. It is 1 if they aren't shrunk.
+	CacheScale float64
+}
+
+// Total returns the memory accounted against the budget.
+func (u MemoryUsage) Total() int64 {
+	return u.Memtables + u.Caches + u.Iterators
+}
+
+const (
+	// memoryCheckInterval is how often the memory is checked against the budget.
+	memoryCheckInterval = 100 * time.Millisecond
+	// maxCacheShift is how much the caches can be shrunk: down to 1/16th of their sizes.
+	maxCacheShift = 4
+)
+
+// The memory pressure, as set by enforceMemoryBudget.
+const (
+	// memoryOK is below 3/4 of the budget, where the caches grow back to their sizes.
+	memoryOK int32 = iota
+	// memoryHigh is above 9/10 of the budget. The memtables are flushed early, and the caches
+	// shrunk.
+	memoryHigh
+	// memoryOver is above the budget. The writes also wait for the memtables being flushed.
+	memoryOver
+)
+
+// memoryGovernor keeps the memory used by the DB within Options.MemoryBudget.
+type memoryGovernor struct {
+	// iterators is the size of the value buffers of the open iterators.
+	iterators int64
+	// pressure is one of the memory pressure constants.
+	pressure int32
+
+	sync.Mutex
+	// cacheShift is how many times the caches have been halved.
+	cacheShift uint
+	// cacheSizes are the sizes of the caches, as set by the options, while they are shrunk. They
+	// are in the order of mutableCaches.
+	cacheSizes []int64
+}
+
+func (g *memoryGovernor) addIteratorBuffers(delta int64) {
+	atomic.AddInt64(&g.iterators, delta)
+}
+
+func (g *memoryGovernor) getPressure() int32 {
+	return atomic.LoadInt32(&g.pressure)
+}
+
+// MemoryUsage returns the memory used by the memtables, the caches and the iterators of the DB,
+// which is kept within Options.MemoryBudget. The memory used by the Go runtime, the table indices
+// outside of the index cache, and the pending writes isn't accounted.
+func (db *DB) MemoryUsage() MemoryUsage {
+	u := MemoryUsage{
+		Budget:     db.opt.MemoryBudget,
+		Iterators:  atomic.LoadInt64(&db.mem.iterators),
+		CacheScale: 1,
+	}
+	db.lock.RLock()
+	if db.mt != nil {
+		u.Memtables += db.mt.MemSize()
+	}
+	for _, mt := range db.imm {
+		u.Memtables += mt.MemSize()
+	}
+	db.lock.RUnlock()
+	if db.opt.InMemory && db.lc != nil {
+		u.Tables = db.lc.memSize()
+	}
+	for _, c := range db.mutableCaches(&Options{}) {
+		u.Caches += cacheCost(c.cache)
+	}
+	db.mem.Lock()
+	u.CacheScale = 1 / float64(int64(1)<<db.mem.cacheShift)
+	db.mem.Unlock()
+	return u
+}
+
+// cacheCost returns the cost of the entries in the cache.
+func cacheCost(c *ristretto.Cache) int64 {
+	if c == nil || c.Metrics == nil {
+		return 0
+	}
+	cost := int64(c.Metrics.CostAdded()) - int64(c.Metrics.CostEvicted())
+	if cost < 0 {
+		return 0
+	}
+	if max := c.MaxCost(); cost > max {
+		// The entries deleted, rather than evicted, aren't subtracted.
+		return max
+	}
+	return cost
+}
+
+// enforceMemoryBudget checks the memory used by the DB against Options.MemoryBudget, and sets the
+// memory pressure which makes the writes flush the memtables early. It also shrinks the caches
+// while the memory is high, and grows them back once it is low again.
+func (db *DB) enforceMemoryBudget(lc *z.Closer) {
+	defer lc.Done()
+
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	budget := db.opt.MemoryBudget
+	for {
+		select {
+		case <-ticker.C:
+		case <-lc.HasBeenClosed():
+			return
+		}
+
+		total := db.MemoryUsage().Total()
+		switch {
+		case total > budget:
+			atomic.StoreInt32(&db.mem.pressure, memoryOver)
+			db.resizeCaches(1)
+		case total > budget*9/10:
+			atomic.StoreInt32(&db.mem.pressure, memoryHigh)
+			db.resizeCaches(1)
+		case total < budget*3/4:
+			atomic.StoreInt32(&db.mem.pressure, memoryOK)
+			db.resizeCaches(-1)
+		}
+	}
+}
+
+// resizeCaches halves the caches if shift is 1, or doubles them back if it is -1, within the
+// sizes set by the options.
+func (db *DB) resizeCaches(shift int) {
+	db.mem.Lock()
+	defer db.mem.Unlock()
+	g := &db.mem
+	switch {
+	case shift > 0 && g.cacheShift == maxCacheShift, shift < 0 && g.cacheShift == 0:
+		return
+	case g.cacheShift == 0:
+		// The caches aren't shrunk yet, so their sizes are those set by the options.
+		g.cacheSizes = g.cacheSizes[:0]
+		for _, c := range db.mutableCaches(&Options{}) {
+			var size int64
+			if c.cache != nil {
+				size = c.cache.MaxCost()
+			}
+			g.cacheSizes = append(g.cacheSizes, size)
+		}
+	}
+	g.cacheShift = uint(int(g.cacheShift) + shift)
+	for i, c := range db.mutableCaches(&Options{}) {
+		if c.cache != nil {
+			c.cache.UpdateMaxCost(g.shrunkCacheSize(i))
+		}
+	}
+	db.opt.Debugf("Caches resized to 1/%d of their sizes to stay within MemoryBudget",
+		1<<g.cacheShift)
+}
+
+// shrunkCacheSize returns the size of the i-th cache of mutableCaches, once shrunk. g must be
+// locked.
+func (g *memoryGovernor) shrunkCacheSize(i int) int64 {
+	size := g.cacheSizes[i] >> g.cacheShift
+	if size < 1 {
+		return 1
+	}
+	return size
+}
+
+// cacheSize returns the size set by the options of the i-th cache of mutableCaches, and whether
+// the caches are shrunk. If they aren't, the size of the cache is its max cost.
+func (g *memoryGovernor) cacheSize(i int) (int64, bool) {
+	g.Lock()
+	defer g.Unlock()
+	if g.cacheShift == 0 {
+		return 0, false
+	}
+	return g.cacheSizes[i], true
+}
+
+// setCacheSize sets the size of the i-th cache of mutableCaches, and shrinks it as much as the
+// other caches are.
+func (g *memoryGovernor) setCacheSize(i int, c *ristretto.Cache, size int64) {
+	g.Lock()
+	defer g.Unlock()
+	if g.cacheShift == 0 {
+		c.UpdateMaxCost(size)
+		return
+	}
+	g.cacheSizes[i] = size
+	c.UpdateMaxCost(g.shrunkCacheSize(i))
+}
+
+// memoryFlushSize returns the size the memtable must have been filled to, to be flushed early
+// because of the memory pressure.
+func (db *DB) memoryFlushSize() int64 {
+	return db.opt.MemTableSize / 8
+}
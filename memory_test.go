@@ -0,0 +1,131 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	opt := getTestOptions("").WithValueThreshold(1 << 10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		val := make([]byte, 4<<10)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		u := db.MemoryUsage()
+		require.Zero(t, u.Budget)
+		require.True(t, u.Memtables > 0)
+		require.Zero(t, u.Iterators)
+		require.Equal(t, 1.0, u.CacheScale)
+
+		// The prefetched values are accounted until the iterator is closed.
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		it := txn.NewIterator(DefaultIteratorOptions)
+		var n int
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.NoError(t, it.Item().Value(func([]byte) error { return nil }))
+			n++
+		}
+		require.Equal(t, 100, n)
+		require.True(t, db.MemoryUsage().Iterators >= int64(len(val)))
+		it.Close()
+		require.Zero(t, db.MemoryUsage().Iterators)
+	})
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const cacheSize = 16 << 20
+	opt := getTestOptions("").
+		WithMemTableSize(16 << 20).
+		WithBlockCacheSize(cacheSize).
+		WithMemoryBudget(1 << 20)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		val := make([]byte, 1<<10)
+		write := func(i int) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := 0; j < 1000; j++ {
+					if err := txn.Set([]byte(fmt.Sprintf("key%d-%04d", i, j)), val); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		for i := 0; i < 4; i++ {
+			write(i)
+		}
+
+		// The caches are shrunk, and the memtable is flushed by the next write once it has
+		// 1/8th of MemTableSize, long before it is full.
+		require.Eventually(t, func() bool {
+			return db.MemoryUsage().CacheScale == 1.0/16
+		}, 10*time.Second, 10*time.Millisecond)
+		write(4)
+		require.Eventually(t, func() bool {
+			return db.MemoryUsage().Memtables < 4<<20
+		}, 10*time.Second, 10*time.Millisecond)
+		require.True(t, db.Levels()[0].NumTables > 0)
+		size, err := db.CacheMaxCost(BlockCache, -1)
+		require.NoError(t, err)
+		require.Equal(t, int64(cacheSize/16), size)
+		// The options still have the size of the cache, and changing it keeps it shrunk.
+		require.Equal(t, int64(cacheSize), db.Opts().BlockCacheSize)
+		require.NoError(t, db.SetOptions(db.Opts().WithBlockCacheSize(2*cacheSize)))
+		require.Equal(t, int64(2*cacheSize), db.Opts().BlockCacheSize)
+		size, err = db.CacheMaxCost(BlockCache, -1)
+		require.NoError(t, err)
+		require.Equal(t, int64(2*cacheSize/16), size)
+	})
+}
+
+func TestMemoryBudgetInMemory(t *testing.T) {
+	opt := getTestOptions("").
+		WithInMemory(true).
+		WithMemTableSize(1 << 20).
+		WithValueThreshold(1 << 10).
+		WithMemoryBudget(8 << 20)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for i := 0; i < 200; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := 0; j < 100; j++ {
+					val := make([]byte, 512)
+					rand.Read(val)
+					if err := txn.Set([]byte(fmt.Sprintf("key%03d-%03d", i, j)), val); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		// The tables kept in memory exceed the budget, but they don't keep the memory pressure up.
+		require.Eventually(t, func() bool {
+			return db.MemoryUsage().Tables > 8<<20 && db.mem.getPressure() == memoryOK
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+}
@@ -25,7 +25,6 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -34,8 +33,10 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/skl"
+	"github.com/dgraph-io/badger/v3/table"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
@@ -44,9 +45,12 @@ import (
 // memTable structure stores a skiplist and a corresponding WAL. Writes to memTable are written
 // both to the WAL and the skiplist. On a crash, the WAL is replayed to bring the skiplist back to
 // its pre-crash form.
+//
+// The skiplist is split into MemTableShards shards, picked by the hash of the keys, so that the
+// shards can be written to concurrently. All the versions of a key are in the same shard.
 type memTable struct {
 	// TODO: Give skiplist z.Calloc'd []byte.
-	sl         *skl.Skiplist
+	shards     []*skl.Skiplist
 	wal        *logFile
 	maxVersion uint64
 	opt        Options
@@ -54,13 +58,85 @@ type memTable struct {
 }
 
 func (db *DB) openMemTables(opt Options) error {
-	// We don't need to open any tables in in-memory mode.
-	if db.opt.InMemory {
+	// We don't need to open any tables in in-memory mode. In Secondary mode, they are opened by
+	// DB.catchUp.
+	if db.opt.InMemory || db.opt.Secondary {
 		return nil
 	}
-	files, err := ioutil.ReadDir(db.opt.Dir)
+	fids, err := memFids(db.opt.FS, db.opt.Dir)
+	if err != nil {
+		return err
+	}
+	var logBytes int64
+	sizes := make([]int64, len(fids))
+	for i, fid := range fids {
+		fi, err := db.opt.FS.Stat(db.mtFilePath(fid))
+		if err != nil {
+			return y.Wrapf(err, "while opening fid: %d", fid)
+		}
+		sizes[i] = fi.Size()
+		logBytes += sizes[i]
+	}
+	db.openProgress.update(func(p *OpenProgress) { p.LogBytes = logBytes })
+
+	// The memtables are replayed concurrently, but added to imm in the order of their IDs.
+	flags := os.O_RDWR
+	if db.opt.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	mts := make([]*memTable, len(fids))
+	throttle := y.NewThrottle(db.opt.numOpenWorkers())
+	for i, fid := range fids {
+		if err := throttle.Do(); err != nil {
+			break
+		}
+		go func(i, fid int) {
+			mt, err := db.openMemTable(fid, flags)
+			if err != nil {
+				err = y.Wrapf(err, "while opening fid: %d", fid)
+			} else {
+				mts[i] = mt
+				db.openProgress.update(func(p *OpenProgress) { p.LogBytesReplayed += sizes[i] })
+			}
+			throttle.Done(err)
+		}(i, fid)
+	}
+	if err := throttle.Finish(); err != nil {
+		for _, mt := range mts {
+			if mt == nil {
+				continue
+			}
+			// The WALs are kept, to be replayed by the next open.
+			wal := mt.wal
+			mt.shards[0].OnClose = func() { _ = wal.Close(-1) }
+			mt.DecrRef()
+		}
+		return err
+	}
+	for _, mt := range mts {
+		// If this memtable is empty we don't need to add it. This is a
+		// memtable that was completely truncated.
+		if mt.Empty() {
+			mt.DecrRef()
+			continue
+		}
+		// These should no longer be written to. So, make them part of the imm.
+		db.imm = append(db.imm, mt)
+	}
+	if len(fids) != 0 {
+		db.nextMemFid = fids[len(fids)-1]
+	}
+	db.nextMemFid++
+	return nil
+}
+
+const memFileExt string = ".mem"
+
+// memFids returns the sorted IDs of the memtable files in dir.
+func memFids(fs y.FS, dir string) ([]int, error) {
+	files, err := fs.ReadDir(dir)
 	if err != nil {
-		return errFile(err, db.opt.Dir, "Unable to open mem dir.")
+		return nil, errFile(err, dir, "Unable to open mem dir.")
 	}
 
 	var fids []int
@@ -71,7 +147,7 @@ func (db *DB) openMemTables(opt Options) error {
 		fsz := len(file.Name())
 		fid, err := strconv.ParseInt(file.Name()[:fsz-len(memFileExt)], 10, 64)
 		if err != nil {
-			return errFile(err, file.Name(), "Unable to parse log id.")
+			return nil, errFile(err, file.Name(), "Unable to parse log id.")
 		}
 		fids = append(fids, int(fid))
 	}
@@ -80,46 +156,76 @@ func (db *DB) openMemTables(opt Options) error {
 	sort.Slice(fids, func(i, j int) bool {
 		return fids[i] < fids[j]
 	})
-	for _, fid := range fids {
-		flags := os.O_RDWR
-		if db.opt.ReadOnly {
-			flags = os.O_RDONLY
+	return fids, nil
+}
+
+const arenaFileExt = ".arena"
+
+// newShards returns the skiplist shards of the memtable with the ID fid. Their arenas are
+// memory-mapped from files in MemTableMmapDir if it's set.
+func (db *DB) newShards(fid int) ([]*skl.Skiplist, error) {
+	shards := make([]*skl.Skiplist, db.opt.MemTableShards)
+	for i := range shards {
+		if db.opt.MemTableMmapDir == "" {
+			shards[i] = skl.NewSkiplist(shardArenaSize(db.opt))
+			continue
 		}
-		mt, err := db.openMemTable(fid, flags)
+		path := filepath.Join(db.opt.MemTableMmapDir,
+			fmt.Sprintf("%05d-%d%s", fid, i, arenaFileExt))
+		sl, err := skl.NewSkiplistMmap(path, shardArenaSize(db.opt))
 		if err != nil {
-			return y.Wrapf(err, "while opening fid: %d", fid)
-		}
-		// If this memtable is empty we don't need to add it. This is a
-		// memtable that was completely truncated.
-		if mt.sl.Empty() {
-			mt.DecrRef()
-			continue
+			for _, sl := range shards[:i] {
+				sl.DecrRef()
+			}
+			return nil, y.Wrapf(err, "while creating arena: %s", path)
 		}
-		// These should no longer be written to. So, make them part of the imm.
-		db.imm = append(db.imm, mt)
+		shards[i] = sl
 	}
-	if len(fids) != 0 {
-		db.nextMemFid = fids[len(fids)-1]
+	return shards, nil
+}
+
+// openMemTableMmapDir creates the MemTableMmapDir of opt, and removes the arenas left there by a
+// DB which wasn't closed.
+func openMemTableMmapDir(opt Options) error {
+	if err := os.MkdirAll(opt.MemTableMmapDir, 0700); err != nil {
+		return y.Wrapf(err, "while creating MemTableMmapDir %q", opt.MemTableMmapDir)
+	}
+	paths, err := filepath.Glob(filepath.Join(opt.MemTableMmapDir, "*"+arenaFileExt))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return y.Wrapf(err, "while removing arena: %s", path)
+		}
 	}
-	db.nextMemFid++
 	return nil
 }
 
-const memFileExt string = ".mem"
-
 func (db *DB) openMemTable(fid, flags int) (*memTable, error) {
 	filepath := db.mtFilePath(fid)
-	s := skl.NewSkiplist(arenaSize(db.opt))
+	shards, err := db.newShards(fid)
+	if err != nil {
+		return nil, err
+	}
 	mt := &memTable{
-		sl:  s,
-		opt: db.opt,
-		buf: &bytes.Buffer{},
+		shards: shards,
+		opt:    db.opt,
+		buf:    &bytes.Buffer{},
 	}
 	// We don't need to create the wal for the skiplist in in-memory mode so return the mt.
 	if db.opt.InMemory {
 		return mt, z.NewFile
 	}
 
+	// A new memtable takes over a recycled WAL file, if there is one.
+	var recycled bool
+	if flags&os.O_CREATE != 0 {
+		if recycled, err = db.reuseWAL(filepath); err != nil {
+			mt.DecrRef()
+			return nil, y.Wrapf(err, "While reusing WAL for memtable: %s", filepath)
+		}
+	}
 	mt.wal = &logFile{
 		fid:      uint32(fid),
 		path:     filepath,
@@ -129,12 +235,34 @@ func (db *DB) openMemTable(fid, flags int) (*memTable, error) {
 	}
 	lerr := mt.wal.open(filepath, flags, 2*db.opt.MemTableSize)
 	if lerr != z.NewFile && lerr != nil {
+		mt.DecrRef()
 		return nil, y.Wrapf(lerr, "While opening memtable: %s", filepath)
 	}
+	if recycled && lerr == nil {
+		// The file was reset when it was recycled, so it's as good as a new one.
+		lerr = z.NewFile
+	} else if lerr == z.NewFile {
+		// The writes to the file would be lost with its directory entry.
+		if err := db.syncDir(db.opt.Dir); err != nil {
+			mt.DecrRef()
+			return nil, y.Wrapf(err, "While creating memtable: %s", filepath)
+		}
+	}
 
 	// Have a callback set to delete WAL when skiplist reference count goes down to zero. That is,
-	// when it gets flushed to L0.
-	s.OnClose = func() {
+	// when it gets flushed to L0. The references of all the shards are taken and released
+	// together, so the first one is enough.
+	mt.shards[0].OnClose = func() {
+		if db.opt.Secondary {
+			// The file belongs to the process which opened the DB read-write.
+			if err := mt.wal.Close(-1); err != nil {
+				db.opt.Errorf("while closing file: %s, err: %v", filepath, err)
+			}
+			return
+		}
+		if db.recycleWAL(mt.wal) {
+			return
+		}
 		if err := mt.wal.Delete(); err != nil {
 			db.opt.Errorf("while deleting file: %s, err: %v", filepath, err)
 		}
@@ -143,7 +271,7 @@ func (db *DB) openMemTable(fid, flags int) (*memTable, error) {
 	if lerr == z.NewFile {
 		return mt, lerr
 	}
-	err := mt.UpdateSkipList()
+	err = mt.UpdateSkipList()
 	return mt, y.Wrapf(err, "while updating skiplist")
 }
 
@@ -163,17 +291,150 @@ func (db *DB) newMemTable() (*memTable, error) {
 	return nil, errors.Errorf("File %s already exists", mt.wal.Fd.Name())
 }
 
+// recycleWAL resets the WAL of a flushed memtable, and keeps the file to be reused by a new
+// memtable, if there's room for it. It returns false if the WAL is left to be deleted.
+func (db *DB) recycleWAL(lf *logFile) bool {
+	// The WALs truncated on replay are too small to be reused.
+	if db.recycledWALs == nil || len(db.recycledWALs) == cap(db.recycledWALs) ||
+		int64(len(lf.Data)) != 2*db.opt.MemTableSize {
+		return false
+	}
+	lf.writeAt = vlogHeaderSize
+	if err := lf.bootstrap(); err != nil {
+		db.opt.Errorf("while resetting file: %s, err: %v", lf.path, err)
+		return false
+	}
+	// Closing the file syncs it, so that it can't replay its old entries after a crash.
+	err := lf.Close(-1)
+	if err == nil {
+		db.recycleLock.Lock()
+		defer db.recycleLock.Unlock()
+		if !db.noRecycle {
+			select {
+			case db.recycledWALs <- lf.path:
+				return true
+			default:
+				// Another flusher took the last room.
+			}
+		}
+	} else {
+		db.opt.Errorf("while closing file: %s, err: %v", lf.path, err)
+	}
+	if err := db.opt.FS.Remove(lf.path); err != nil {
+		db.opt.Errorf("while deleting file: %s, err: %v", lf.path, err)
+	}
+	return true
+}
+
+// reuseWAL renames a recycled WAL file to path, if there is one. It returns whether it did.
+func (db *DB) reuseWAL(path string) (bool, error) {
+	var old string
+	select {
+	case old = <-db.recycledWALs:
+	default:
+		return false, nil
+	}
+	if err := db.opt.FS.Rename(old, path); err != nil {
+		return false, y.Wrapf(err, "while renaming %s to %s", old, path)
+	}
+	// The memtables are replayed in the order of their IDs, so the new one must stick.
+	return true, db.syncDir(db.opt.Dir)
+}
+
+// removeRecycledWALs deletes the recycled WAL files which weren't reused. The WALs of the memtables
+// released afterwards are deleted instead of being recycled.
+func (db *DB) removeRecycledWALs() error {
+	db.recycleLock.Lock()
+	defer db.recycleLock.Unlock()
+	db.noRecycle = true
+	for {
+		select {
+		case path := <-db.recycledWALs:
+			if err := db.opt.FS.Remove(path); err != nil {
+				return y.Wrapf(err, "while deleting file: %s", path)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
 func (db *DB) mtFilePath(fid int) string {
 	return filepath.Join(db.opt.Dir, fmt.Sprintf("%05d%s", fid, memFileExt))
 }
 
 func (mt *memTable) SyncWAL() error {
+	// The memtables handed over in managed mode have no WAL.
+	if mt.wal == nil {
+		return nil
+	}
 	return mt.wal.Sync()
 }
 
+// shardSize is the size of the skiplist shards of a memtable, at which the memtable is full.
+func shardSize(opt Options) int64 {
+	return opt.MemTableSize / int64(opt.MemTableShards)
+}
+
+// shardIndex returns the index of the skiplist shard the versions of the key go to.
+func (mt *memTable) shardIndex(key []byte) int {
+	if len(mt.shards) == 1 {
+		return 0
+	}
+	return int(z.MemHash(y.ParseKey(key)) % uint64(len(mt.shards)))
+}
+
+func (mt *memTable) shard(key []byte) *skl.Skiplist {
+	return mt.shards[mt.shardIndex(key)]
+}
+
+// Empty returns true if the memtable has no entries.
+func (mt *memTable) Empty() bool {
+	for _, sl := range mt.shards {
+		if !sl.Empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// MemSize returns the memory used by the skiplists of the memtable.
+func (mt *memTable) MemSize() int64 {
+	var sz int64
+	for _, sl := range mt.shards {
+		sz += sl.MemSize()
+	}
+	return sz
+}
+
+// Get returns the latest version of the key up to the version of the key, like Skiplist.Get.
+func (mt *memTable) Get(key []byte) y.ValueStruct {
+	return mt.shard(key).Get(key)
+}
+
+// shardIterator returns an iterator over the entries of the shard idx, or nil if the memtable
+// has no such shard.
+func (mt *memTable) shardIterator(idx int) y.Iterator {
+	if idx >= len(mt.shards) {
+		return nil
+	}
+	return mt.shards[idx].NewUniIterator(false)
+}
+
+// NewUniIterator returns an iterator over the entries of all the shards.
+func (mt *memTable) NewUniIterator(reversed bool) y.Iterator {
+	iters := make([]y.Iterator, 0, len(mt.shards))
+	for _, sl := range mt.shards {
+		iters = append(iters, sl.NewUniIterator(reversed))
+	}
+	return table.NewMergeIterator(iters, reversed)
+}
+
 func (mt *memTable) isFull() bool {
-	if mt.sl.MemSize() >= mt.opt.MemTableSize {
-		return true
+	for _, sl := range mt.shards {
+		if sl.MemSize() >= shardSize(mt.opt) {
+			return true
+		}
 	}
 	if mt.opt.InMemory {
 		// InMemory mode doesn't have any WAL.
@@ -182,7 +443,83 @@ func (mt *memTable) isFull() bool {
 	return int64(mt.wal.writeAt) >= mt.opt.MemTableSize
 }
 
+// hasRoomFor returns true if sz more bytes can be written to the memtable before it is full.
+func (mt *memTable) hasRoomFor(sz int64) bool {
+	// All the writes could go to the same shard.
+	for _, sl := range mt.shards {
+		if sl.MemSize()+sz >= shardSize(mt.opt) {
+			return false
+		}
+	}
+	return mt.opt.InMemory || int64(mt.wal.writeAt)+sz < mt.opt.MemTableSize
+}
+
 func (mt *memTable) Put(key []byte, value y.ValueStruct) error {
+	if err := mt.writeWAL(key, value); err != nil {
+		return err
+	}
+	// We insert the finish marker in the WAL but not in the memtable.
+	if value.Meta&bitFinTxn > 0 {
+		return nil
+	}
+
+	// Write to skiplist and update maxVersion encountered.
+	mt.shard(key).Put(key, value)
+	if ts := y.ParseTs(key); ts > mt.maxVersion {
+		mt.maxVersion = ts
+	}
+	return nil
+}
+
+// parallelPutThreshold is the number of entries of a batch from which the shards of a memtable
+// are written to concurrently. Smaller batches aren't worth the goroutines.
+const parallelPutThreshold = 256
+
+// PutBatch puts the entries in the memtable, like Put. The entries are written to the WAL one by
+// one, and then to the shards, concurrently if the batch is large enough.
+func (mt *memTable) PutBatch(keys [][]byte, values []y.ValueStruct) error {
+	if len(mt.shards) == 1 || len(keys) < parallelPutThreshold {
+		for i := range keys {
+			if err := mt.Put(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The shard of every entry, -1 for the ones which don't go to the skiplist.
+	shards := make([]int, len(keys))
+	for i, key := range keys {
+		if err := mt.writeWAL(key, values[i]); err != nil {
+			return err
+		}
+		if values[i].Meta&bitFinTxn > 0 {
+			shards[i] = -1
+			continue
+		}
+		shards[i] = mt.shardIndex(key)
+		if ts := y.ParseTs(key); ts > mt.maxVersion {
+			mt.maxVersion = ts
+		}
+	}
+	var wg sync.WaitGroup
+	for idx, sl := range mt.shards {
+		wg.Add(1)
+		go func(idx int, sl *skl.Skiplist) {
+			defer wg.Done()
+			for i, shard := range shards {
+				if shard == idx {
+					sl.Put(keys[i], values[i])
+				}
+			}
+		}(idx, sl)
+	}
+	wg.Wait()
+	return nil
+}
+
+// writeWAL appends the entry to the WAL.
+func (mt *memTable) writeWAL(key []byte, value y.ValueStruct) error {
 	entry := &Entry{
 		Key:       key,
 		Value:     value.Value,
@@ -199,41 +536,42 @@ func (mt *memTable) Put(key []byte, value y.ValueStruct) error {
 			return y.Wrapf(err, "cannot write entry to WAL file")
 		}
 	}
-	// We insert the finish marker in the WAL but not in the memtable.
-	if entry.meta&bitFinTxn > 0 {
-		return nil
-	}
-
-	// Write to skiplist and update maxVersion encountered.
-	mt.sl.Put(key, value)
-	if ts := y.ParseTs(entry.Key); ts > mt.maxVersion {
-		mt.maxVersion = ts
-	}
 	return nil
 }
 
 func (mt *memTable) UpdateSkipList() error {
-	if mt.wal == nil || mt.sl == nil {
+	if mt.wal == nil || len(mt.shards) == 0 {
 		return nil
 	}
-	endOff, err := mt.wal.iterate(true, 0, mt.replayFunction(mt.opt))
+	// The replay starts from the end of the entries replayed before, in Secondary mode.
+	endOff, err := mt.wal.iterate(true, mt.wal.writeAt, mt.replayFunction(mt.opt))
 	if err != nil {
 		return y.Wrapf(err, "while iterating wal: %s", mt.wal.Fd.Name())
 	}
+	mt.wal.writeAt = endOff
+	if mt.opt.Secondary {
+		// The next entries may not be written yet. They are replayed by the next catch up.
+		return nil
+	}
 	if endOff < mt.wal.size && mt.opt.ReadOnly {
-		return y.Wrapf(ErrTruncateNeeded, "end offset: %d < size: %d", endOff, mt.wal.size)
+		return fileError(ErrTruncateNeeded, mt.wal.path, int64(endOff),
+			errors.Errorf("end offset: %d < size: %d", endOff, mt.wal.size))
 	}
 	return mt.wal.Truncate(int64(endOff))
 }
 
 // IncrRef increases the refcount
 func (mt *memTable) IncrRef() {
-	mt.sl.IncrRef()
+	for _, sl := range mt.shards {
+		sl.IncrRef()
+	}
 }
 
 // DecrRef decrements the refcount, deallocating the Skiplist when done using it
 func (mt *memTable) DecrRef() {
-	mt.sl.DecrRef()
+	for _, sl := range mt.shards {
+		sl.DecrRef()
+	}
 }
 
 func (mt *memTable) replayFunction(opt Options) func(Entry, valuePointer) error {
@@ -255,7 +593,7 @@ func (mt *memTable) replayFunction(opt Options) func(Entry, valuePointer) error
 		// This is already encoded correctly. Value would be either a vptr, or a full value
 		// depending upon how big the original value was. Skiplist makes a copy of the key and
 		// value.
-		mt.sl.Put(e.Key, v)
+		mt.shard(e.Key).Put(e.Key, v)
 		return nil
 	}
 }
@@ -273,9 +611,15 @@ type logFile struct {
 	size     uint32
 	dataKey  *pb.DataKey
 	baseIV   []byte
+	aead     bool // The entries are encrypted with AES-GCM, instead of AES-CTR.
+	seeded   bool // The checksums of the entries are seeded with baseIV.
 	registry *KeyRegistry
 	writeAt  uint32
 	opt      Options
+	file     y.BackendFile // Reads the entries if Options.IOBackend is set. Nil otherwise.
+	// runlock is lock.RUnlock, set once when opening the file, as creating the method value
+	// allocates, which adds up when reading a value for every item of an iteration.
+	runlock func()
 }
 
 func (lf *logFile) Truncate(end int64) error {
@@ -289,11 +633,17 @@ func (lf *logFile) Truncate(end int64) error {
 	return lf.MmapFile.Truncate(end)
 }
 
+// Delete removes the log file. It isn't truncated, so that it can still be read by a DB opened in
+// Secondary mode which has it open.
+func (lf *logFile) Delete() error {
+	return y.DeleteMmapFile(lf.opt.FS, lf.MmapFile)
+}
+
 // encodeEntry will encode entry to the buf
 // layout of entry
-// +--------+-----+-------+-------+
-// | header | key | value | crc32 |
-// +--------+-----+-------+-------+
+// +--------+-----+-------+-----------------------+-------+
+// | header | key | value | tag (if AES-GCM mode) | crc32 |
+// +--------+-----+-------+-----------------------+-------+
 func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int, error) {
 	h := header{
 		klen:      uint32(len(e.Key)),
@@ -304,6 +654,9 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 	}
 
 	hash := crc32.New(y.CastagnoliCrcTable)
+	if lf.seeded {
+		y.Check2(hash.Write(lf.baseIV))
+	}
 	writer := io.MultiWriter(buf, hash)
 
 	// encode header.
@@ -311,7 +664,18 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 	sz := h.Encode(headerEnc[:])
 	y.Check2(writer.Write(headerEnc[:sz]))
 	// we'll encrypt only key and value.
-	if lf.encryptionEnabled() {
+	if lf.aead {
+		// The header is authenticated along with the key and the value.
+		eBuf := make([]byte, 0, len(e.Key)+len(e.Value)+y.AEADTagSize)
+		eBuf = append(eBuf, e.Key...)
+		eBuf = append(eBuf, e.Value...)
+		ad := lf.additionalData(headerEnc[:sz], offset)
+		eBuf, err := y.Seal(eBuf[:0], eBuf, ad, lf.dataKey.Data, lf.generateIV(offset))
+		if err != nil {
+			return 0, y.Wrapf(err, "Error while encoding entry for vlog.")
+		}
+		y.Check2(writer.Write(eBuf))
+	} else if lf.encryptionEnabled() {
 		// TODO: no need to allocate the bytes. we can calculate the encrypted buf one by one
 		// since we're using ctr mode of AES encryption. Ordering won't changed. Need some
 		// refactoring in XORBlock which will work like stream cipher.
@@ -332,7 +696,7 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
 	y.Check2(buf.Write(crcBuf[:]))
 	// return encoded length.
-	return len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + len(crcBuf), nil
+	return len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + lf.tagSize() + len(crcBuf), nil
 }
 
 func (lf *logFile) writeEntry(buf *bytes.Buffer, e *Entry, opt Options) error {
@@ -354,9 +718,12 @@ func (lf *logFile) decodeEntry(buf []byte, offset uint32) (*Entry, error) {
 	kv := buf[hlen:]
 	if lf.encryptionEnabled() {
 		var err error
+		if lf.aead {
+			kv = kv[:int(h.klen+h.vlen)+y.AEADTagSize]
+		}
 		// No need to worry about mmap. because, XORBlock allocates a byte array to do the
 		// xor. So, the given slice is not being mutated.
-		if kv, err = lf.decryptKV(kv, offset); err != nil {
+		if kv, err = lf.decryptKV(buf[:hlen], kv, offset); err != nil {
 			return nil, err
 		}
 	}
@@ -371,10 +738,36 @@ func (lf *logFile) decodeEntry(buf []byte, offset uint32) (*Entry, error) {
 	return e, nil
 }
 
-func (lf *logFile) decryptKV(buf []byte, offset uint32) ([]byte, error) {
+// decryptKV decrypts the key and the value of the entry at offset, which has the given encoded
+// header. In AES-GCM mode, buf must end with the tag, and the entry is authenticated.
+func (lf *logFile) decryptKV(header, buf []byte, offset uint32) ([]byte, error) {
+	if lf.aead {
+		ad := lf.additionalData(header, offset)
+		return y.Open(nil, buf, ad, lf.dataKey.Data, lf.generateIV(offset))
+	}
 	return y.XORBlockAllocate(buf, lf.dataKey.Data, lf.generateIV(offset))
 }
 
+// additionalData returns the AES-GCM additional data of the entry at offset with the given
+// encoded header. Besides the header, it binds the entry to the fid and the offset, so that
+// entries can't be swapped within the file or copied into another one.
+func (lf *logFile) additionalData(header []byte, offset uint32) []byte {
+	ad := make([]byte, len(header)+8)
+	n := copy(ad, header)
+	binary.BigEndian.PutUint32(ad[n:], lf.fid)
+	binary.BigEndian.PutUint32(ad[n+4:], offset)
+	return ad
+}
+
+// tagSize returns the size of the authentication tag following the key and the value of the
+// entries.
+func (lf *logFile) tagSize() int {
+	if lf.aead {
+		return y.AEADTagSize
+	}
+	return 0
+}
+
 // KeyID returns datakey's ID.
 func (lf *logFile) keyID() uint64 {
 	if lf.dataKey == nil {
@@ -404,6 +797,13 @@ func (lf *logFile) read(p valuePointer) (buf []byte, err error) {
 		// dropAll and iterations are running simultaneously.
 		int64(offset+valsz) > int64(lfsz) {
 		err = y.ErrEOF
+	} else if lf.file != nil {
+		buf = make([]byte, valsz)
+		if err = lf.file.ReadAt(buf, int64(offset)); err != nil {
+			buf = nil
+		} else {
+			nbr = int64(valsz)
+		}
 	} else {
 		buf = lf.Data[offset : offset+valsz]
 		nbr = int64(valsz)
@@ -447,7 +847,8 @@ func (lf *logFile) doneWriting(offset uint32) error {
 }
 
 // iterate iterates over log file. It doesn't not allocate new memory for every kv pair.
-// Therefore, the kv pair is only valid for the duration of fn call.
+// Therefore, the kv pair is only valid for the duration of fn call. It returns the end of the last
+// valid entry, even if it fails to read the next one.
 func (lf *logFile) iterate(readOnly bool, offset uint32, fn logEntry) (uint32, error) {
 	if offset == 0 {
 		// If offset is set to zero, let's advance past the encryption key header.
@@ -481,7 +882,7 @@ loop:
 		case err == io.ErrUnexpectedEOF || err == errTruncate:
 			break loop
 		case err != nil:
-			return 0, err
+			return validEndOffset, err
 		case e == nil:
 			continue
 		case e.isZero():
@@ -489,7 +890,7 @@ loop:
 		}
 
 		var vp valuePointer
-		vp.Len = uint32(int(e.hlen) + len(e.Key) + len(e.Value) + crc32.Size)
+		vp.Len = uint32(int(e.hlen) + len(e.Key) + len(e.Value) + lf.tagSize() + crc32.Size)
 		read.recordOffset += vp.Len
 
 		vp.Offset = e.offset
@@ -516,17 +917,23 @@ loop:
 			lastCommit = 0
 			validEndOffset = read.recordOffset
 
+			var stop bool
 			for i, e := range entries {
 				vp := vptrs[i]
 				if err := fn(*e, vp); err != nil {
 					if err == errStop {
-						break
+						// The rest of the transaction is still passed to fn.
+						stop = true
+						continue
 					}
 					return 0, errFile(err, lf.path, "Iteration function")
 				}
 			}
 			entries = entries[:0]
 			vptrs = vptrs[:0]
+			if stop {
+				break loop
+			}
 
 		default:
 			if lastCommit != 0 {
@@ -538,7 +945,7 @@ loop:
 
 			if err := fn(*e, vp); err != nil {
 				if err == errStop {
-					break
+					break loop
 				}
 				return 0, errFile(err, lf.path, "Iteration function")
 			}
@@ -553,12 +960,13 @@ func (lf *logFile) zeroNextEntry() {
 }
 
 func (lf *logFile) open(path string, flags int, fsize int64) error {
-	mf, ferr := z.OpenMmapFile(path, flags, int(fsize))
+	mf, ferr := y.OpenMmapFile(lf.opt.FS, path, flags, int(fsize))
 	lf.MmapFile = mf
+	lf.runlock = lf.lock.RUnlock
 
 	if ferr == z.NewFile {
 		if err := lf.bootstrap(); err != nil {
-			os.Remove(path)
+			lf.opt.FS.Remove(path)
 			return err
 		}
 		lf.size = vlogHeaderSize
@@ -567,6 +975,9 @@ func (lf *logFile) open(path string, flags int, fsize int64) error {
 		return y.Wrapf(ferr, "while opening file: %s", path)
 	}
 	lf.size = uint32(len(lf.Data))
+	if lf.opt.IOBackend != nil {
+		lf.file = lf.opt.IOBackend.NewFile(lf.Fd)
+	}
 
 	if lf.size < vlogHeaderSize {
 		// Every vlog file should have at least vlogHeaderSize. If it is less than vlogHeaderSize
@@ -581,6 +992,9 @@ func (lf *logFile) open(path string, flags int, fsize int64) error {
 	y.AssertTruef(vlogHeaderSize == copy(buf, lf.Data),
 		"Unable to copy from %s, size %d", path, lf.size)
 	keyID := binary.BigEndian.Uint64(buf[:8])
+	lf.aead = keyID&aeadKeyIDBit != 0
+	lf.seeded = keyID&seededKeyIDBit != 0
+	keyID &^= aeadKeyIDBit | seededKeyIDBit
 	// retrieve datakey.
 	if dk, err := lf.registry.DataKey(keyID); err != nil {
 		return y.Wrapf(err, "While opening vlog file %d", lf.fid)
@@ -594,6 +1008,16 @@ func (lf *logFile) open(path string, flags int, fsize int64) error {
 	return ferr
 }
 
+// aeadKeyIDBit is set in the key id of the header of the log files whose entries are encrypted
+// with AES-GCM.
+const aeadKeyIDBit = uint64(1) << 63
+
+// seededKeyIDBit is set in the key id of the header of the WAL files whose entry checksums are
+// seeded with their base IV. A WAL file is recycled by writing a new header over it, with a new
+// base IV, so the entries left from before can't pass their checksum if they're exposed by a lost
+// write after a crash.
+const seededKeyIDBit = uint64(1) << 62
+
 // bootstrap will initialize the log file with key id and baseIV.
 // The below figure shows the layout of log file.
 // +----------------+------------------+------------------+
@@ -608,13 +1032,22 @@ func (lf *logFile) bootstrap() error {
 		return y.Wrapf(err, "Error while retrieving datakey in logFile.bootstarp")
 	}
 	lf.dataKey = dk
+	lf.aead = dk != nil && lf.opt.EncryptionMode == options.AESGCM
+	lf.seeded = !lf.isValueLog()
 
 	// We'll always preserve vlogHeaderSize for key id and baseIV.
 	buf := make([]byte, vlogHeaderSize)
 
 	// write key id to the buf.
 	// key id will be zero if the logfile is in plain text.
-	binary.BigEndian.PutUint64(buf[:8], lf.keyID())
+	keyID := lf.keyID()
+	if lf.aead {
+		keyID |= aeadKeyIDBit
+	}
+	if lf.seeded {
+		keyID |= seededKeyIDBit
+	}
+	binary.BigEndian.PutUint64(buf[:8], keyID)
 	// generate base IV. It'll be used with offset of the vptr to encrypt the entry.
 	if _, err := cryptorand.Read(buf[8:]); err != nil {
 		return y.Wrapf(err, "Error while creating base IV, while creating logfile")
@@ -0,0 +1,12 @@
+module github.com/dgraph-io/badger/v3/metrics
+
+go 1.12
+
+require (
+	github.com/dgraph-io/badger/v3 v3.0.0
+	github.com/dgraph-io/ristretto v0.1.1
+	github.com/prometheus/client_golang v1.0.0
+	github.com/stretchr/testify v1.7.0
+)
+
+replace github.com/dgraph-io/badger/v3 => ../
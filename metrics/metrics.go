@@ -0,0 +1,347 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package metrics exports the metrics of Badger as Prometheus collectors.
+//
+// NewExpvarCollector exports the process wide counters and latency histograms Badger publishes with
+// expvar, which are only updated if Options.MetricsEnabled is set. The buckets of the histograms
+// can be changed with y.SetLatencyBuckets. NewCollector exports the metrics of a single DB, like
+// its caches, levels, compactions and write stalls. Handler serves both of them over HTTP.
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "badger_v3"
+
+// expvarMetric describes how an expvar published by Badger is exported.
+type expvarMetric struct {
+	name      string
+	help      string
+	valueType prometheus.ValueType
+	// label is the name of the label for the keys of an expvar.Map. It is empty for an expvar.Int.
+	label string
+}
+
+var expvarMetrics = []expvarMetric{
+	{"badger_v3_disk_reads_total", "Number of disk reads.", prometheus.CounterValue, ""},
+	{"badger_v3_disk_writes_total", "Number of disk writes.", prometheus.CounterValue, ""},
+	{"badger_v3_read_bytes", "Number of bytes read from disk.", prometheus.CounterValue, ""},
+	{"badger_v3_written_bytes", "Number of bytes written to disk.", prometheus.CounterValue, ""},
+	{"badger_v3_lsm_level_gets_total", "Number of gets per LSM level.",
+		prometheus.CounterValue, "level"},
+	{"badger_v3_lsm_bloom_hits_total", "Number of bloom filter hits.",
+		prometheus.CounterValue, "type"},
+	{"badger_v3_gets_total", "Number of gets.", prometheus.CounterValue, ""},
+	{"badger_v3_puts_total", "Number of puts.", prometheus.CounterValue, ""},
+	{"badger_v3_blocked_puts_total", "Number of blocked puts.", prometheus.CounterValue, ""},
+	{"badger_v3_memtable_gets_total", "Number of memtable gets.", prometheus.CounterValue, ""},
+	{"badger_v3_lsm_size_bytes", "Size of the LSM tree in bytes.", prometheus.GaugeValue, "dir"},
+	{"badger_v3_vlog_size_bytes", "Size of the value log in bytes.", prometheus.GaugeValue, "dir"},
+	{"badger_v3_pending_writes_total", "Number of pending writes.", prometheus.GaugeValue, "dir"},
+	{"badger_v3_compactions_current", "Number of tables being compacted.",
+		prometheus.GaugeValue, ""},
+	{"badger_v3_txn_conflicts_total", "Number of transaction conflicts.",
+		prometheus.CounterValue, ""},
+	{"badger_v3_vlog_space_amplification", "Space amplification of the value log.",
+		prometheus.GaugeValue, "dir"},
+	{"badger_v3_vlog_gc_rewrites_total", "Number of value log files rewritten by GC.",
+		prometheus.CounterValue, ""},
+}
+
+// latencyMetrics are the names and the help of the latency histograms published by Badger.
+var latencyMetrics = [][2]string{
+	{"badger_v3_get_latency_seconds", "Latency of the gets."},
+	{"badger_v3_commit_latency_seconds", "Latency of the transaction commits."},
+	{"badger_v3_flush_latency_seconds", "Latency of the memtable flushes."},
+	{"badger_v3_compaction_latency_seconds", "Latency of the compactions."},
+	{"badger_v3_vlog_sync_latency_seconds", "Latency of the value log syncs."},
+}
+
+type expvarCollector struct {
+	descs        []*prometheus.Desc
+	latencyDescs []*prometheus.Desc
+}
+
+// NewExpvarCollector returns a collector of the counters and the latency histograms Badger
+// publishes with expvar. They are shared by all the DBs of the process, and only updated by the
+// DBs with MetricsEnabled set.
+func NewExpvarCollector() prometheus.Collector {
+	c := &expvarCollector{}
+	for _, m := range expvarMetrics {
+		var labels []string
+		if m.label != "" {
+			labels = []string{m.label}
+		}
+		c.descs = append(c.descs, prometheus.NewDesc(m.name, m.help, labels, nil))
+	}
+	for _, m := range latencyMetrics {
+		c.latencyDescs = append(c.latencyDescs, prometheus.NewDesc(m[0], m[1], nil, nil))
+	}
+	return c
+}
+
+func (c *expvarCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+	for _, d := range c.latencyDescs {
+		ch <- d
+	}
+}
+
+func (c *expvarCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, m := range expvarMetrics {
+		switch v := expvar.Get(m.name).(type) {
+		case *expvar.Int:
+			ch <- prometheus.MustNewConstMetric(c.descs[i], m.valueType, float64(v.Value()))
+		case *expvar.Map:
+			v.Do(func(kv expvar.KeyValue) {
+				// The values are expvar.Int, or expvar.Func returning a number. Skip the others.
+				val, err := strconv.ParseFloat(kv.Value.String(), 64)
+				if err != nil {
+					return
+				}
+				ch <- prometheus.MustNewConstMetric(c.descs[i], m.valueType, val, kv.Key)
+			})
+		}
+	}
+	for i, m := range latencyMetrics {
+		if h, ok := expvar.Get(m[0]).(*y.Histogram); ok {
+			buckets, count, sum := h.Snapshot()
+			ch <- prometheus.MustNewConstHistogram(c.latencyDescs[i], count, sum, buckets)
+		}
+	}
+}
+
+// Collector collects the metrics of a DB. Use NewCollector to create it.
+type Collector struct {
+	db *badger.DB
+
+	cacheHits        *prometheus.Desc
+	cacheMisses      *prometheus.Desc
+	cacheKeysAdded   *prometheus.Desc
+	cacheKeysEvicted *prometheus.Desc
+	cacheCostAdded   *prometheus.Desc
+	cacheCostEvicted *prometheus.Desc
+	levelSize        *prometheus.Desc
+	levelTables      *prometheus.Desc
+	levelScore       *prometheus.Desc
+	txnConflicts     *prometheus.Desc
+
+	compactions            *prometheus.CounterVec
+	compactionErrors       *prometheus.CounterVec
+	compactionsRunning     *prometheus.GaugeVec
+	compactionReadBytes    *prometheus.CounterVec
+	compactionWrittenBytes *prometheus.CounterVec
+	compactionDuration     *prometheus.HistogramVec
+	flushes                prometheus.Counter
+	flushBytes             prometheus.Counter
+	stalls                 *prometheus.CounterVec
+	stalled                *prometheus.GaugeVec
+	stallSeconds           *prometheus.CounterVec
+	vlogGCRuns             prometheus.Counter
+	vlogGCRewrites         prometheus.Counter
+	vlogGCReclaimedBytes   prometheus.Counter
+}
+
+// NewCollector returns a collector of the metrics of db. It adds an event listener to db, to count
+// its compactions, flushes, write stalls and value log GCs, so it should be called once per DB.
+func NewCollector(db *badger.DB) *Collector {
+	name := func(n string) string { return prometheus.BuildFQName(namespace, "", n) }
+	cache := func(n, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name("cache_"+n), help, []string{"cache"}, nil)
+	}
+	level := func(n, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name("level_"+n), help, []string{"level"}, nil)
+	}
+	counter := func(n, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Name: name(n), Help: help})
+	}
+	counterVec := func(n, help, label string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name(n), Help: help},
+			[]string{label})
+	}
+	gaugeVec := func(n, help, label string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name(n), Help: help},
+			[]string{label})
+	}
+
+	c := &Collector{
+		db:               db,
+		cacheHits:        cache("hits_total", "Number of cache hits."),
+		cacheMisses:      cache("misses_total", "Number of cache misses."),
+		cacheKeysAdded:   cache("keys_added_total", "Number of keys added to the cache."),
+		cacheKeysEvicted: cache("keys_evicted_total", "Number of keys evicted from the cache."),
+		cacheCostAdded:   cache("cost_added_total", "Total cost of the keys added to the cache."),
+		cacheCostEvicted: cache("cost_evicted_total",
+			"Total cost of the keys evicted from the cache."),
+		levelSize:   level("size_bytes", "Size of the tables of the level in bytes."),
+		levelTables: level("tables", "Number of tables of the level."),
+		levelScore:  level("score", "Compaction score of the level."),
+		txnConflicts: prometheus.NewDesc(name("txn_conflicts_recent"),
+			"Number of recent transaction conflicts, decayed with a half-life of one minute.",
+			nil, nil),
+
+		compactions: counterVec("compactions_total",
+			"Number of compactions, by the level compacted.", "level"),
+		compactionErrors: counterVec("compaction_errors_total",
+			"Number of failed compactions, by the level compacted.", "level"),
+		compactionsRunning: gaugeVec("compactions_running",
+			"Number of running compactions, by the level compacted.", "level"),
+		compactionReadBytes: counterVec("compaction_read_bytes_total",
+			"Size of the tables compacted, by the level compacted.", "level"),
+		compactionWrittenBytes: counterVec("compaction_written_bytes_total",
+			"Size of the tables built by compactions, by the level compacted.", "level"),
+		compactionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name("compaction_duration_seconds"),
+			Help:    "Duration of the compactions, by the level compacted.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}, []string{"level"}),
+		flushes:    counter("flushes_total", "Number of memtable flushes."),
+		flushBytes: counter("flush_bytes_total", "Size of the level 0 tables built by flushes."),
+		stalls:     counterVec("stalls_total", "Number of write stalls, by reason.", "reason"),
+		stalled: gaugeVec("stalled",
+			"Whether the writes are stalled, by reason.", "reason"),
+		stallSeconds: counterVec("stall_seconds_total",
+			"Time the writes were stalled for, by reason.", "reason"),
+		vlogGCRuns: counter("vlog_gc_runs_total", "Number of value log GC runs."),
+		vlogGCRewrites: counter("vlog_gc_files_rewritten_total",
+			"Number of value log files rewritten by GC."),
+		vlogGCReclaimedBytes: counter("vlog_gc_reclaimed_bytes_total",
+			"Estimated disk space reclaimed by value log GC."),
+	}
+	db.AddEventListener(badger.EventListener{
+		OnCompactionBegin: func(info badger.CompactionInfo) {
+			c.compactionsRunning.WithLabelValues(strconv.Itoa(info.Level)).Inc()
+		},
+		OnCompactionEnd: func(info badger.CompactionInfo) {
+			l := strconv.Itoa(info.Level)
+			c.compactionsRunning.WithLabelValues(l).Dec()
+			c.compactions.WithLabelValues(l).Inc()
+			if info.Err != nil {
+				c.compactionErrors.WithLabelValues(l).Inc()
+				return
+			}
+			c.compactionReadBytes.WithLabelValues(l).Add(float64(info.InputBytes))
+			c.compactionWrittenBytes.WithLabelValues(l).Add(float64(info.OutputBytes))
+			c.compactionDuration.WithLabelValues(l).Observe(info.Duration.Seconds())
+		},
+		OnFlushEnd: func(info badger.FlushInfo) {
+			c.flushes.Inc()
+			c.flushBytes.Add(float64(info.Bytes))
+		},
+		OnStallBegin: func(info badger.StallInfo) {
+			c.stalls.WithLabelValues(info.Reason.String()).Inc()
+			c.stalled.WithLabelValues(info.Reason.String()).Set(1)
+		},
+		OnStallEnd: func(info badger.StallInfo) {
+			c.stalled.WithLabelValues(info.Reason.String()).Set(0)
+			c.stallSeconds.WithLabelValues(info.Reason.String()).Add(info.Duration.Seconds())
+		},
+		OnValueLogGC: func(info badger.ValueLogGCInfo) {
+			c.vlogGCRuns.Inc()
+			c.vlogGCRewrites.Add(float64(info.FilesRewritten))
+			c.vlogGCReclaimedBytes.Add(float64(info.BytesReclaimed))
+		},
+	})
+	return c
+}
+
+// collectors returns the collectors updated by the event listener.
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.compactions, c.compactionErrors, c.compactionsRunning, c.compactionReadBytes,
+		c.compactionWrittenBytes, c.compactionDuration, c.flushes, c.flushBytes, c.stalls,
+		c.stalled, c.stallSeconds, c.vlogGCRuns, c.vlogGCRewrites, c.vlogGCReclaimedBytes,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.cacheHits, c.cacheMisses, c.cacheKeysAdded, c.cacheKeysEvicted, c.cacheCostAdded,
+		c.cacheCostEvicted, c.levelSize, c.levelTables, c.levelScore, c.txnConflicts,
+	} {
+		ch <- d
+	}
+	for _, col := range c.collectors() {
+		col.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	cache := func(name string, m *ristretto.Metrics) {
+		// The metrics are nil if the cache is disabled.
+		if m == nil {
+			return
+		}
+		counter := func(d *prometheus.Desc, v uint64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), name)
+		}
+		counter(c.cacheHits, m.Hits())
+		counter(c.cacheMisses, m.Misses())
+		counter(c.cacheKeysAdded, m.KeysAdded())
+		counter(c.cacheKeysEvicted, m.KeysEvicted())
+		counter(c.cacheCostAdded, m.CostAdded())
+		counter(c.cacheCostEvicted, m.CostEvicted())
+	}
+	cache("block", c.db.BlockCacheMetrics())
+	cache("pinned_block", c.db.PinnedBlockCacheMetrics())
+	cache("compressed_block", c.db.CompressedBlockCacheMetrics())
+	cache("index", c.db.IndexCacheMetrics())
+	cache("filter", c.db.FilterCacheMetrics())
+
+	if !c.db.IsClosed() {
+		for _, l := range c.db.Levels() {
+			level := strconv.Itoa(l.Level)
+			ch <- prometheus.MustNewConstMetric(c.levelSize, prometheus.GaugeValue,
+				float64(l.Size), level)
+			ch <- prometheus.MustNewConstMetric(c.levelTables, prometheus.GaugeValue,
+				float64(l.NumTables), level)
+			ch <- prometheus.MustNewConstMetric(c.levelScore, prometheus.GaugeValue,
+				l.Score, level)
+		}
+	}
+
+	var conflicts float64
+	for _, s := range c.db.ConflictStats(-1) {
+		conflicts += s.Count
+	}
+	ch <- prometheus.MustNewConstMetric(c.txnConflicts, prometheus.GaugeValue, conflicts)
+
+	for _, col := range c.collectors() {
+		col.Collect(ch)
+	}
+}
+
+// Handler returns an HTTP handler serving the metrics of db, along with the expvar counters of
+// Badger, in the Prometheus text format.
+func Handler(db *badger.DB) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(db), NewExpvarCollector())
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
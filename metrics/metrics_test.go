@@ -0,0 +1,119 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func openDB(t *testing.T, dir string) *badger.DB {
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		for i := 0; i < 100; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return db
+}
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db := openDB(t, dir)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	c := NewCollector(db)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c, NewExpvarCollector())
+
+	_, err = db.RunValueLogGC(0.5)
+	require.Equal(t, badger.ErrNoRewrite, err)
+	require.Equal(t, 1.0, testutil.ToFloat64(c.vlogGCRuns))
+	require.Equal(t, 0.0, testutil.ToFloat64(c.vlogGCRewrites))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	for _, name := range []string{
+		"badger_v3_cache_hits_total",
+		"badger_v3_level_tables",
+		"badger_v3_txn_conflicts_recent",
+		"badger_v3_vlog_gc_runs_total",
+		"badger_v3_puts_total",
+		"badger_v3_lsm_size_bytes",
+		"badger_v3_get_latency_seconds",
+		"badger_v3_compaction_latency_seconds",
+	} {
+		require.True(t, names[name], "missing metric %s", name)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db := openDB(t, dir)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	rec := httptest.NewRecorder()
+	Handler(db).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, rec.Code)
+	require.Contains(t, rec.Body.String(), `badger_v3_level_tables{level="0"}`)
+	require.Contains(t, rec.Body.String(), `badger_v3_cache_hits_total{cache="block"}`)
+}
+
+func TestClosedDBMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db := openDB(t, dir)
+
+	ampl := expvar.Get("badger_v3_vlog_space_amplification").(*expvar.Map).Get(dir)
+	require.NotNil(t, ampl)
+	require.NotEqual(t, "null", ampl.String())
+
+	// The metrics computed by the DB mustn't be computed, nor keep the DB alive, once it's closed.
+	require.NoError(t, db.Close())
+	for _, name := range []string{
+		"badger_v3_vlog_space_amplification",
+		"badger_v3_cache_metrics",
+	} {
+		v := expvar.Get(name).(*expvar.Map).Get(dir)
+		require.NotNil(t, v, name)
+		require.Equal(t, "null", v.String(), name)
+	}
+	// The hot conflict keys are removed.
+	require.Nil(t, expvar.Get("badger_v3_hot_conflict_keys").(*expvar.Map).Get(dir))
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package migrate
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The write-ahead logs and the MANIFEST are split in blocks of logBlockSize bytes, and their
+// records in fragments which don't cross the blocks. A fragment has a header made of a checksum,
+// the length and the type of the fragment, followed by the number of the log for the recyclable
+// logs of RocksDB.
+const (
+	logBlockSize           = 32 << 10
+	logHeaderSize          = 7
+	recyclableHeaderSize   = 11
+	zeroFragment           = 0
+	fullFragment           = 1
+	firstFragment          = 2
+	middleFragment         = 3
+	lastFragment           = 4
+	recyclableFullFragment = 5
+	recyclableLastFragment = 8
+)
+
+// errCorruptLog is returned by logReader when a fragment is invalid. It is expected at the end
+// of the write-ahead logs of a DB which crashed.
+var errCorruptLog = errors.New("corrupt log record")
+
+// logReader reads the records of a log.
+type logReader struct {
+	r      io.Reader
+	number uint64
+	buf    [logBlockSize]byte
+	block  []byte
+	off    int
+}
+
+func newLogReader(r io.Reader, number uint64) *logReader {
+	return &logReader{r: r, number: number}
+}
+
+// next returns the next record, or io.EOF at the end of the log. The record is only valid until
+// the next call.
+func (r *logReader) next() ([]byte, error) {
+	var rec []byte
+	inRecord := false
+	for {
+		if len(r.block)-r.off < logHeaderSize {
+			// The rest of the block is padding.
+			n, err := io.ReadFull(r.r, r.buf[:])
+			if n == 0 {
+				if err == io.EOF && inRecord {
+					// The log ends in the middle of a record.
+					return nil, errCorruptLog
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return nil, io.EOF
+				}
+				return nil, err
+			}
+			r.block, r.off = r.buf[:n], 0
+			continue
+		}
+		b := r.block[r.off:]
+		length := int(binary.LittleEndian.Uint16(b[4:]))
+		typ := b[6]
+		if typ == zeroFragment && length == 0 {
+			// RocksDB preallocates the logs, so the rest of the block is empty.
+			r.off = len(r.block)
+			continue
+		}
+		hdr := logHeaderSize
+		if typ >= recyclableFullFragment && typ <= recyclableLastFragment {
+			hdr = recyclableHeaderSize
+		}
+		if len(b) < hdr+length {
+			return nil, errCorruptLog
+		}
+		if crc32.Checksum(b[6:hdr+length], crcTable) != unmaskCRC(binary.LittleEndian.Uint32(b)) {
+			return nil, errCorruptLog
+		}
+		if hdr == recyclableHeaderSize && binary.LittleEndian.Uint32(b[7:]) != uint32(r.number) {
+			// The fragment was written before the log was recycled.
+			return nil, io.EOF
+		}
+		frag := b[hdr : hdr+length]
+		r.off += hdr + length
+
+		if typ >= recyclableFullFragment && typ <= recyclableLastFragment {
+			typ -= recyclableFullFragment - fullFragment
+		}
+		switch typ {
+		case fullFragment:
+			if inRecord {
+				return nil, errCorruptLog
+			}
+			return frag, nil
+		case firstFragment:
+			if inRecord {
+				return nil, errCorruptLog
+			}
+			rec = append(rec[:0], frag...)
+			inRecord = true
+		case middleFragment, lastFragment:
+			if !inRecord {
+				return nil, errCorruptLog
+			}
+			rec = append(rec, frag...)
+			if typ == lastFragment {
+				return rec, nil
+			}
+		default:
+			return nil, errors.Errorf("log fragments of type %d are not supported", typ)
+		}
+	}
+}
+
+// The types of the records of a write batch, which are also the types of the entries of the
+// tables.
+const (
+	typeDeletion         = 0x0
+	typeValue            = 0x1
+	typeMerge            = 0x2
+	typeLogData          = 0x3
+	typeCFDeletion       = 0x4
+	typeCFValue          = 0x5
+	typeCFMerge          = 0x6
+	typeSingleDeletion   = 0x7
+	typeCFSingleDeletion = 0x8
+	typeNoop             = 0xD
+	typeCFRangeDeletion  = 0xE
+	typeRangeDeletion    = 0xF
+)
+
+// cfTypes are the types of the records of the default column family matching those of the
+// records of the other column families.
+var cfTypes = map[byte]byte{
+	typeCFDeletion:       typeDeletion,
+	typeCFValue:          typeValue,
+	typeCFSingleDeletion: typeSingleDeletion,
+}
+
+// decodeBatch calls fn with the entries of the default column family in the write batch rec.
+func decodeBatch(rec []byte, fn func(e *entry) error) error {
+	if len(rec) < 12 {
+		return errors.New("write batch too short")
+	}
+	seq := binary.LittleEndian.Uint64(rec)
+	count := binary.LittleEndian.Uint32(rec[8:])
+	b := rec[12:]
+	readBytes := func() ([]byte, error) {
+		n, m := binary.Uvarint(b)
+		if m <= 0 || uint64(len(b)-m) < n {
+			return nil, errors.New("invalid write batch")
+		}
+		v := b[m : m+int(n)]
+		b = b[m+int(n):]
+		return v, nil
+	}
+	var found uint32
+	for len(b) > 0 {
+		typ := b[0]
+		b = b[1:]
+		var cf uint64
+		switch typ {
+		case typeCFDeletion, typeCFValue, typeCFSingleDeletion:
+			var n int
+			if cf, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("invalid write batch")
+			}
+			b = b[n:]
+			typ = cfTypes[typ]
+		case typeDeletion, typeValue, typeSingleDeletion:
+		case typeLogData:
+			if _, err := readBytes(); err != nil {
+				return err
+			}
+			continue
+		case typeNoop:
+			continue
+		case typeMerge, typeCFMerge:
+			return errors.New("merge operands are not supported")
+		case typeRangeDeletion, typeCFRangeDeletion:
+			return errors.New("range deletions are not supported")
+		default:
+			return errors.Errorf("write batch records of type %d are not supported", typ)
+		}
+		key, err := readBytes()
+		if err != nil {
+			return err
+		}
+		e := &entry{key: append([]byte{}, key...), seq: seq + uint64(found), kind: typ}
+		if typ == typeValue {
+			value, err := readBytes()
+			if err != nil {
+				return err
+			}
+			e.value = append([]byte{}, value...)
+		}
+		found++
+		if cf != 0 {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if found != count {
+		return errors.Errorf("write batch has %d records instead of %d", found, count)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package migrate
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The tags of the fields of the edits of the MANIFEST. The tags from 100 are only used by RocksDB.
+const (
+	tagComparator      = 1
+	tagLogNumber       = 2
+	tagNextFileNumber  = 3
+	tagLastSequence    = 4
+	tagCompactPointer  = 5
+	tagDeletedFile     = 6
+	tagNewFile         = 7
+	tagPrevLogNumber   = 9
+	tagMinLogToKeep    = 10
+	tagNewFile2        = 100
+	tagNewFile3        = 102
+	tagNewFile4        = 103
+	tagColumnFamily    = 200
+	tagColumnFamilyAdd = 201
+	tagColumnFamilyDel = 202
+	tagMaxColumnFamily = 203
+	tagInAtomicGroup   = 300
+	// The fields with this bit set can be skipped by the versions which don't know them.
+	tagSafeIgnoreMask = 1 << 13
+
+	// The custom fields of tagNewFile4 end with newFileTerminate. Those with
+	// newFileNonSafeIgnoreMask set can't be skipped.
+	newFileTerminate         = 1
+	newFilePathID            = 2
+	newFileNonSafeIgnoreMask = 1 << 6
+)
+
+// fileMeta is a table of the DB.
+type fileMeta struct {
+	level      int
+	largestSeq uint64
+}
+
+// dbState is the state of the default column family of a DB, read from its MANIFEST.
+type dbState struct {
+	comparator    string
+	logNumber     uint64
+	prevLogNumber uint64
+	files         map[uint64]fileMeta
+}
+
+func isBytewise(comparator string) bool {
+	return comparator == "" || comparator == "leveldb.BytewiseComparator"
+}
+
+// readManifest reads the current MANIFEST of the DB in dir.
+func readManifest(dir string) (*dbState, error) {
+	current, err := ioutil.ReadFile(filepath.Join(dir, "CURRENT"))
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading the CURRENT file")
+	}
+	name := strings.TrimSpace(string(current))
+	if !strings.HasPrefix(name, "MANIFEST-") {
+		return nil, errors.Errorf("invalid CURRENT file: %q", current)
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	state := &dbState{files: make(map[uint64]fileMeta)}
+	r := newLogReader(f, 0)
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading %s", name)
+		}
+		if err := state.apply(rec); err != nil {
+			return nil, errors.Wrapf(err, "while reading %s", name)
+		}
+	}
+	if !isBytewise(state.comparator) {
+		return nil, errors.Errorf("comparator %s is not supported", state.comparator)
+	}
+	return state, nil
+}
+
+// apply applies the version edit rec to the state, if it edits the default column family.
+func (s *dbState) apply(rec []byte) error {
+	b := rec
+	invalid := errors.New("invalid version edit")
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, invalid
+		}
+		b = b[n:]
+		return v, nil
+	}
+	readBytes := func() ([]byte, error) {
+		n, err := uvarint()
+		if err != nil || uint64(len(b)) < n {
+			return nil, invalid
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+
+	var cf uint64
+	var comparator []byte
+	var logNumber, prevLogNumber *uint64
+	added := make(map[uint64]fileMeta)
+	var deleted []uint64
+	for len(b) > 0 {
+		tag, err := uvarint()
+		if err != nil {
+			return err
+		}
+		switch {
+		case tag == tagComparator:
+			if comparator, err = readBytes(); err != nil {
+				return err
+			}
+		case tag == tagLogNumber || tag == tagPrevLogNumber:
+			v, err := uvarint()
+			if err != nil {
+				return err
+			}
+			if tag == tagLogNumber {
+				logNumber = &v
+			} else {
+				prevLogNumber = &v
+			}
+		case tag == tagNextFileNumber || tag == tagLastSequence || tag == tagMinLogToKeep ||
+			tag == tagMaxColumnFamily || tag == tagInAtomicGroup:
+			if _, err := uvarint(); err != nil {
+				return err
+			}
+		case tag == tagCompactPointer:
+			if _, err := uvarint(); err != nil {
+				return err
+			}
+			if _, err := readBytes(); err != nil {
+				return err
+			}
+		case tag == tagDeletedFile:
+			if _, err := uvarint(); err != nil {
+				return err
+			}
+			num, err := uvarint()
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, num)
+		case tag == tagNewFile || tag == tagNewFile2 || tag == tagNewFile3 || tag == tagNewFile4:
+			num, meta, err := s.readNewFile(tag, uvarint, readBytes)
+			if err != nil {
+				return err
+			}
+			added[num] = meta
+		case tag == tagColumnFamily:
+			if cf, err = uvarint(); err != nil {
+				return err
+			}
+		case tag == tagColumnFamilyAdd:
+			if _, err := readBytes(); err != nil {
+				return err
+			}
+		case tag == tagColumnFamilyDel:
+		case tag&tagSafeIgnoreMask != 0:
+			if _, err := readBytes(); err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("version edit field %d is not supported", tag)
+		}
+	}
+	if cf != 0 {
+		return nil
+	}
+	if comparator != nil {
+		s.comparator = string(comparator)
+	}
+	if logNumber != nil {
+		s.logNumber = *logNumber
+	}
+	if prevLogNumber != nil {
+		s.prevLogNumber = *prevLogNumber
+	}
+	for _, num := range deleted {
+		delete(s.files, num)
+	}
+	for num, meta := range added {
+		s.files[num] = meta
+	}
+	return nil
+}
+
+func (s *dbState) readNewFile(tag uint64, uvarint func() (uint64, error),
+	readBytes func() ([]byte, error)) (uint64, fileMeta, error) {
+	var meta fileMeta
+	level, err := uvarint()
+	if err != nil {
+		return 0, meta, err
+	}
+	meta.level = int(level)
+	num, err := uvarint()
+	if err != nil {
+		return 0, meta, err
+	}
+	if tag == tagNewFile3 {
+		pathID, err := uvarint()
+		if err != nil {
+			return 0, meta, err
+		}
+		if pathID != 0 {
+			return 0, meta, errors.Errorf("table %d isn't in the DB directory", num)
+		}
+	}
+	// The file size, and the smallest and largest keys.
+	if _, err := uvarint(); err != nil {
+		return 0, meta, err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := readBytes(); err != nil {
+			return 0, meta, err
+		}
+	}
+	if tag == tagNewFile {
+		return num, meta, nil
+	}
+	// The smallest and largest sequence numbers.
+	if _, err := uvarint(); err != nil {
+		return 0, meta, err
+	}
+	if meta.largestSeq, err = uvarint(); err != nil {
+		return 0, meta, err
+	}
+	if tag != tagNewFile4 {
+		return num, meta, nil
+	}
+	for {
+		field, err := uvarint()
+		if err != nil {
+			return 0, meta, err
+		}
+		if field == newFileTerminate {
+			return num, meta, nil
+		}
+		v, err := readBytes()
+		if err != nil {
+			return 0, meta, err
+		}
+		switch {
+		case field == newFilePathID:
+			if len(v) != 1 || v[0] != 0 {
+				return 0, meta, errors.Errorf("table %d isn't in the DB directory", num)
+			}
+		case field&newFileNonSafeIgnoreMask != 0:
+			return 0, meta, errors.Errorf("table field %d is not supported", field)
+		}
+	}
+}
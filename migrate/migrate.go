@@ -0,0 +1,466 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+Package migrate imports the data of LevelDB and RocksDB databases into Badger.
+
+Import reads the tables, the write-ahead logs and the MANIFEST of a LevelDB or RocksDB directory
+directly, without needing LevelDB or RocksDB, and bulk loads the latest value of every key with a
+StreamWriter. Only the default column family is imported. The DB must have been closed, and must
+use the default bytewise comparator. Block based tables are supported with no, Snappy, zlib or
+ZSTD compression, up to the format version 5. Merge operands, range deletions and blob files are
+not supported.
+
+ImportDump imports the output of the ldb tool of RocksDB run with --hex, which can be used for
+the DBs which Import doesn't support:
+
+	ldb --db=/path/to/db --hex scan > dump.txt
+*/
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// Options are the options of Import and ImportDump.
+type Options struct {
+	// WALDir is the directory of the write-ahead logs, if it isn't the directory of the DB.
+	WALDir string
+	// TTL is the TTL the RocksDB DB was opened with, with DBWithTTL. If it is set, the values end
+	// with the time they were written at, which is removed, and the keys expire once the TTL has
+	// elapsed since then. The keys which already expired are skipped.
+	TTL time.Duration
+	// Version is the version the keys are written at. Defaults to 1.
+	Version uint64
+}
+
+// Stats are the statistics of an import.
+type Stats struct {
+	// Tables and Logs are the number of tables and write-ahead logs read.
+	Tables int
+	Logs   int
+	// Keys is the number of keys imported. Deleted is the number of keys skipped because their
+	// latest version is a deletion, and Expired the number of keys skipped because they expired.
+	Keys    int
+	Deleted int
+	Expired int
+	// Bytes is the size of the keys and values imported.
+	Bytes int64
+	// DroppedLogTail is set if a write-ahead log ends with a corrupt record, which happens when
+	// the DB crashed while writing it. Like LevelDB and RocksDB do, the rest of the log is
+	// dropped.
+	DroppedLogTail bool
+}
+
+// entry is a version of a key, read from a table or a write-ahead log.
+type entry struct {
+	key   []byte
+	seq   uint64
+	kind  byte
+	value []byte
+}
+
+// parseInternalKey parses a key of a table, made of the user key and of 8 bytes with the
+// sequence number and the type of the entry.
+func parseInternalKey(key []byte) (*entry, error) {
+	if len(key) < 8 {
+		return nil, errors.New("invalid internal key")
+	}
+	n := len(key) - 8
+	tag := binary.LittleEndian.Uint64(key[n:])
+	e := &entry{key: append([]byte{}, key[:n]...), seq: tag >> 8, kind: byte(tag)}
+	switch e.kind {
+	case typeDeletion, typeValue, typeSingleDeletion:
+	case typeMerge:
+		return nil, errors.New("merge operands are not supported")
+	default:
+		return nil, errors.Errorf("entries of type %d are not supported", e.kind)
+	}
+	return e, nil
+}
+
+// source is a source of entries, sorted by key and by decreasing sequence number. Next returns
+// nil at the end.
+type source interface {
+	Next() (*entry, error)
+}
+
+// memSource is a source of entries read from the write-ahead logs.
+type memSource struct {
+	entries []*entry
+}
+
+func (s *memSource) Next() (*entry, error) {
+	if len(s.entries) == 0 {
+		return nil, nil
+	}
+	e := s.entries[0]
+	s.entries = s.entries[1:]
+	return e, nil
+}
+
+func entryLess(a, b *entry) bool {
+	if c := bytes.Compare(a.key, b.key); c != 0 {
+		return c < 0
+	}
+	return a.seq > b.seq
+}
+
+type heapItem struct {
+	e   *entry
+	src source
+}
+
+type entryHeap []heapItem
+
+func (h entryHeap) Len() int            { return len(h) }
+func (h entryHeap) Less(i, j int) bool  { return entryLess(h[i].e, h[j].e) }
+func (h entryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// mergeSources calls fn with the latest version of each key of the sources, in key order.
+func mergeSources(sources []source, fn func(e *entry) error) error {
+	h := &entryHeap{}
+	for _, src := range sources {
+		e, err := src.Next()
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			*h = append(*h, heapItem{e: e, src: src})
+		}
+	}
+	heap.Init(h)
+	var last *entry
+	for h.Len() > 0 {
+		top := &(*h)[0]
+		e := top.e
+		next, err := top.src.Next()
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			heap.Pop(h)
+		} else {
+			top.e = next
+			heap.Fix(h, 0)
+		}
+		if last != nil && bytes.Equal(last.key, e.key) {
+			// An older version of the key.
+			continue
+		}
+		last = e
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import imports the LevelDB or RocksDB database in dir into db. All the data of db is deleted
+// first, so db should be a new DB.
+func Import(db *badger.DB, dir string, opt Options) (*Stats, error) {
+	state, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{}
+	var sources []source
+
+	nums := make([]uint64, 0, len(state.files))
+	for num := range state.files {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	for _, num := range nums {
+		path, err := tablePath(dir, num)
+		if err != nil {
+			return nil, err
+		}
+		t, err := openTable(path, state.files[num].largestSeq)
+		if err != nil {
+			return nil, err
+		}
+		defer t.Close()
+		sources = append(sources, t.iterator())
+		stats.Tables++
+	}
+
+	walDir := opt.WALDir
+	if walDir == "" {
+		walDir = dir
+	}
+	mem, err := readLogs(walDir, state, stats)
+	if err != nil {
+		return nil, err
+	}
+	sources = append(sources, mem)
+
+	w, err := newWriter(db, opt, stats)
+	if err != nil {
+		return nil, err
+	}
+	defer w.cancel()
+	err = mergeSources(sources, func(e *entry) error {
+		if e.kind != typeValue {
+			stats.Deleted++
+			return nil
+		}
+		return w.add(e.key, e.value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, w.finish()
+}
+
+func tablePath(dir string, num uint64) (string, error) {
+	for _, ext := range []string{"ldb", "sst"} {
+		path := filepath.Join(dir, fmt.Sprintf("%06d.%s", num, ext))
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf("table %06d is missing from %s", num, dir)
+}
+
+// readLogs reads the entries of the write-ahead logs which weren't written to the tables yet.
+func readLogs(dir string, state *dbState, stats *Stats) (*memSource, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint64
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if num >= state.logNumber || num == state.prevLogNumber {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	mem := &memSource{}
+	for _, num := range nums {
+		if err := readLog(filepath.Join(dir, fmt.Sprintf("%06d.log", num)), num, mem,
+			stats); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(mem.entries, func(i, j int) bool { return entryLess(mem.entries[i], mem.entries[j]) })
+	return mem, nil
+}
+
+func readLog(path string, num uint64, mem *memSource, stats *Stats) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stats.Logs++
+	r := newLogReader(bufio.NewReader(f), num)
+	for {
+		rec, err := r.next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == errCorruptLog:
+			stats.DroppedLogTail = true
+			return nil
+		case err != nil:
+			return errors.Wrapf(err, "while reading %s", path)
+		}
+		err = decodeBatch(rec, func(e *entry) error {
+			mem.entries = append(mem.entries, e)
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "while reading %s", path)
+		}
+	}
+}
+
+// ImportDump imports into db the keys and values of r, written by the ldb tool of RocksDB with
+// the --hex flag. The lines are either "0xKEY ==> 0xVALUE", like the dump command writes, or
+// "0xKEY : 0xVALUE", like the scan command writes, and the keys must be sorted. The other lines
+// are skipped. All the data of db is deleted first, so db should be a new DB.
+func ImportDump(db *badger.DB, r io.Reader, opt Options) (*Stats, error) {
+	stats := &Stats{}
+	w, err := newWriter(db, opt, stats)
+	if err != nil {
+		return nil, err
+	}
+	defer w.cancel()
+
+	var last []byte
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<30)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if !strings.HasPrefix(text, "0x") {
+			continue
+		}
+		sep := " ==> "
+		if !strings.Contains(text, sep) {
+			sep = " : "
+		}
+		parts := strings.SplitN(text, sep, 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid dump line %d", line)
+		}
+		key, err := parseHex(parts[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key on dump line %d", line)
+		}
+		value, err := parseHex(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value on dump line %d", line)
+		}
+		if last != nil && bytes.Compare(last, key) >= 0 {
+			return nil, errors.Errorf("the keys of the dump aren't sorted, on line %d", line)
+		}
+		last = key
+		if err := w.add(key, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return stats, w.finish()
+}
+
+func parseHex(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "0x") {
+		return nil, errors.New("missing 0x prefix")
+	}
+	return hex.DecodeString(s[2:])
+}
+
+// writeBatchSize is the size of the buffers written to the StreamWriter.
+const writeBatchSize = 16 << 20
+
+// writer writes the sorted keys with a StreamWriter.
+type writer struct {
+	sw    *badger.StreamWriter
+	buf   *z.Buffer
+	opt   Options
+	stats *Stats
+	now   uint64
+}
+
+func newWriter(db *badger.DB, opt Options, stats *Stats) (*writer, error) {
+	if opt.Version == 0 {
+		opt.Version = 1
+	}
+	sw := db.NewStreamWriter()
+	if err := sw.Prepare(); err != nil {
+		sw.Cancel()
+		return nil, err
+	}
+	return &writer{
+		sw:    sw,
+		buf:   z.NewBuffer(writeBatchSize, "migrate.writer"),
+		opt:   opt,
+		stats: stats,
+		now:   uint64(time.Now().Unix()),
+	}, nil
+}
+
+func (w *writer) add(key, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("empty keys can't be imported")
+	}
+	kv := &pb.KV{Key: key, Value: value, Version: w.opt.Version, StreamId: 1}
+	if w.opt.TTL > 0 {
+		if len(value) < 4 {
+			return errors.Errorf("the value of key %x has no timestamp", key)
+		}
+		n := len(value) - 4
+		kv.Value = value[:n]
+		kv.ExpiresAt = uint64(binary.LittleEndian.Uint32(value[n:])) +
+			uint64(w.opt.TTL/time.Second)
+		if kv.ExpiresAt <= w.now {
+			w.stats.Expired++
+			return nil
+		}
+	}
+	badger.KVToBuffer(kv, w.buf)
+	w.stats.Keys++
+	w.stats.Bytes += int64(len(kv.Key) + len(kv.Value))
+	if w.buf.LenNoPadding() >= writeBatchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *writer) flush() error {
+	if w.buf.LenNoPadding() == 0 {
+		return nil
+	}
+	if err := w.sw.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.buf.Release(); err != nil {
+		return err
+	}
+	w.buf = z.NewBuffer(writeBatchSize, "migrate.writer")
+	return nil
+}
+
+func (w *writer) finish() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.sw.Flush()
+}
+
+// cancel releases the writer. It is a no-op once finish was called.
+func (w *writer) cancel() {
+	w.sw.Cancel()
+	_ = w.buf.Release()
+}
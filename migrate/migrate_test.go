@@ -0,0 +1,609 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package migrate
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+)
+
+// The builders below write the files of LevelDB and RocksDB DBs, following their formats.
+
+func maskCRC(c uint32) uint32 {
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+func putUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func putBytes(b, v []byte) []byte {
+	return append(putUvarint(b, uint64(len(v))), v...)
+}
+
+func internalKey(key string, seq uint64, kind byte) []byte {
+	var tag [8]byte
+	binary.LittleEndian.PutUint64(tag[:], seq<<8|uint64(kind))
+	return append([]byte(key), tag[:]...)
+}
+
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	last     []byte
+	n        int
+	// deltaValue omits the length of the values, like in the delta encoded index blocks.
+	deltaValue bool
+}
+
+func (b *blockBuilder) add(key, value []byte) {
+	shared := 0
+	if b.n%2 == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.last) && key[shared] == b.last[shared] {
+			shared++
+		}
+	}
+	b.buf = putUvarint(b.buf, uint64(shared))
+	b.buf = putUvarint(b.buf, uint64(len(key)-shared))
+	if !b.deltaValue {
+		b.buf = putUvarint(b.buf, uint64(len(value)))
+	}
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.last = append(b.last[:0], key...)
+	b.n++
+}
+
+// finish returns the block. If buckets is not 0, the block has a hash index of that many buckets.
+func (b *blockBuilder) finish(buckets int) []byte {
+	out := b.buf
+	for _, r := range b.restarts {
+		out = append(out, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[len(out)-4:], r)
+	}
+	num := uint32(len(b.restarts))
+	if buckets > 0 {
+		out = append(out, bytes.Repeat([]byte{0xff}, buckets)...)
+		out = append(out, byte(buckets), byte(buckets>>8))
+		num |= 1 << 31
+	}
+	out = append(out, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[len(out)-4:], num)
+	return out
+}
+
+type tableOptions struct {
+	rocksdb       bool
+	formatVersion uint32
+	compression   byte
+	deltaIndex    bool
+	partitioned   bool
+	hashIndex     bool
+	ingested      bool
+}
+
+type tableWriter struct {
+	t   *testing.T
+	opt tableOptions
+	buf []byte
+}
+
+func (w *tableWriter) writeBlock(data []byte, compression byte) blockHandle {
+	switch compression {
+	case snappyCompression:
+		data = snappy.Encode(nil, data)
+	case zlibCompression:
+		var out bytes.Buffer
+		if w.opt.formatVersion >= 2 {
+			out.Write(putUvarint(nil, uint64(len(data))))
+		}
+		fw, err := flate.NewWriter(&out, flate.DefaultCompression)
+		require.NoError(w.t, err)
+		_, err = fw.Write(data)
+		require.NoError(w.t, err)
+		require.NoError(w.t, fw.Close())
+		data = out.Bytes()
+	case zstdCompression:
+		out, err := y.ZSTDCompress(nil, data, 1)
+		require.NoError(w.t, err)
+		if w.opt.formatVersion >= 2 {
+			out = append(putUvarint(nil, uint64(len(data))), out...)
+		}
+		data = out
+	}
+	h := blockHandle{offset: uint64(len(w.buf)), size: uint64(len(data))}
+	w.buf = append(w.buf, data...)
+	w.buf = append(w.buf, compression)
+	crc := crc32.Checksum(w.buf[h.offset:], crcTable)
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(w.buf[len(w.buf)-4:], maskCRC(crc))
+	return h
+}
+
+func encodeHandle(h blockHandle) []byte {
+	return putUvarint(putUvarint(nil, h.offset), h.size)
+}
+
+// writeIndex writes an index block of the handles, with the given last keys.
+func (w *tableWriter) writeIndex(keys [][]byte, handles []blockHandle) blockHandle {
+	b := &blockBuilder{deltaValue: w.opt.deltaIndex}
+	for i, h := range handles {
+		if w.opt.deltaIndex && i%2 == 1 {
+			var buf [binary.MaxVarintLen64]byte
+			n := binary.PutVarint(buf[:], int64(h.size)-int64(handles[i-1].size))
+			b.add(keys[i], buf[:n])
+		} else {
+			b.add(keys[i], encodeHandle(h))
+		}
+	}
+	return w.writeBlock(b.finish(0), noCompression)
+}
+
+func writeTable(t *testing.T, path string, entries []*entry, opt tableOptions) {
+	w := &tableWriter{t: t, opt: opt}
+	var keys [][]byte
+	var handles []blockHandle
+	for i := 0; i < len(entries); i += 3 {
+		b := &blockBuilder{}
+		var last []byte
+		for _, e := range entries[i:min(i+3, len(entries))] {
+			last = internalKey(string(e.key), e.seq, e.kind)
+			b.add(last, e.value)
+		}
+		buckets := 0
+		if opt.hashIndex {
+			buckets = 3
+		}
+		handles = append(handles, w.writeBlock(b.finish(buckets), opt.compression))
+		keys = append(keys, last)
+	}
+
+	var index blockHandle
+	if opt.partitioned {
+		// A partition with the first half of the blocks, and another with the rest.
+		var pkeys [][]byte
+		var partitions []blockHandle
+		half := (len(handles) + 1) / 2
+		for _, r := range [][2]int{{0, half}, {half, len(handles)}} {
+			if r[0] < r[1] {
+				partitions = append(partitions, w.writeIndex(keys[r[0]:r[1]], handles[r[0]:r[1]]))
+				pkeys = append(pkeys, keys[r[1]-1])
+			}
+		}
+		index = w.writeIndex(pkeys, partitions)
+	} else {
+		index = w.writeIndex(keys, handles)
+	}
+
+	meta := &blockBuilder{}
+	if opt.rocksdb {
+		props := map[string][]byte{
+			"rocksdb.comparator":                   []byte("leveldb.BytewiseComparator"),
+			"rocksdb.block.based.table.index.type": {0, 0, 0, 0},
+		}
+		if opt.deltaIndex {
+			props["rocksdb.index.value.is.delta.encoded"] = putUvarint(nil, 1)
+		}
+		if opt.partitioned {
+			props["rocksdb.block.based.table.index.type"] = []byte{partitionedIndex, 0, 0, 0}
+		}
+		if opt.ingested {
+			props["rocksdb.external_sst_file.version"] = []byte{2, 0, 0, 0}
+			props["rocksdb.external_sst_file.global_seqno"] = make([]byte, 8)
+		}
+		var names []string
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pb := &blockBuilder{}
+		for _, name := range names {
+			pb.add([]byte(name), props[name])
+		}
+		meta.add([]byte("rocksdb.properties"), encodeHandle(w.writeBlock(pb.finish(0),
+			noCompression)))
+	}
+	metaindex := w.writeBlock(meta.finish(0), noCompression)
+
+	var footer []byte
+	if opt.rocksdb {
+		footer = append(footer, checksumCRC32C)
+	}
+	footer = append(footer, encodeHandle(metaindex)...)
+	footer = append(footer, encodeHandle(index)...)
+	if opt.rocksdb {
+		footer = append(footer, make([]byte, 41-len(footer))...)
+		footer = append(footer, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(footer[len(footer)-4:], opt.formatVersion)
+		footer = append(footer, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(footer[len(footer)-8:], blockBasedMagic)
+	} else {
+		footer = append(footer, make([]byte, 40-len(footer))...)
+		footer = append(footer, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(footer[len(footer)-8:], legacyMagic)
+	}
+	require.NoError(t, ioutil.WriteFile(path, append(w.buf, footer...), 0644))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// writeLog writes the records to a log, fragmented in blocks. If number is not 0, the fragments
+// are those of the recyclable logs.
+func writeLog(t *testing.T, path string, number uint32, records [][]byte) {
+	var out []byte
+	hdr := logHeaderSize
+	if number != 0 {
+		hdr = recyclableHeaderSize
+	}
+	for _, rec := range records {
+		first := true
+		for {
+			left := logBlockSize - len(out)%logBlockSize
+			if left < hdr {
+				out = append(out, make([]byte, left)...)
+				continue
+			}
+			n := min(len(rec), left-hdr)
+			frag := rec[:n]
+			rec = rec[n:]
+			var typ byte
+			switch {
+			case first && len(rec) == 0:
+				typ = fullFragment
+			case first:
+				typ = firstFragment
+			case len(rec) == 0:
+				typ = lastFragment
+			default:
+				typ = middleFragment
+			}
+			if number != 0 {
+				typ += recyclableFullFragment - fullFragment
+			}
+			h := make([]byte, hdr)
+			binary.LittleEndian.PutUint16(h[4:], uint16(n))
+			h[6] = typ
+			if number != 0 {
+				binary.LittleEndian.PutUint32(h[7:], number)
+			}
+			crc := crc32.Checksum(append(h[6:hdr:hdr], frag...), crcTable)
+			binary.LittleEndian.PutUint32(h, maskCRC(crc))
+			out = append(out, h...)
+			out = append(out, frag...)
+			first = false
+			if len(rec) == 0 {
+				break
+			}
+		}
+	}
+	require.NoError(t, ioutil.WriteFile(path, out, 0644))
+}
+
+func encodeBatch(seq uint64, entries ...*entry) []byte {
+	b := make([]byte, 12)
+	binary.LittleEndian.PutUint64(b, seq)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(entries)))
+	for _, e := range entries {
+		b = append(b, e.kind)
+		if e.kind >= typeCFDeletion && e.kind <= typeCFSingleDeletion {
+			b = putUvarint(b, 1)
+		}
+		b = putBytes(b, e.key)
+		if e.kind == typeValue || e.kind == typeCFValue {
+			b = putBytes(b, e.value)
+		}
+	}
+	return b
+}
+
+type versionEdit []byte
+
+func (e versionEdit) uvarint(tag, v uint64) versionEdit {
+	return putUvarint(putUvarint(e, tag), v)
+}
+
+func (e versionEdit) newFile(level, num uint64) versionEdit {
+	e = e.uvarint(tagNewFile, level)
+	e = putUvarint(e, num)
+	e = putUvarint(e, 1000)
+	e = putBytes(e, []byte("a"))
+	return putBytes(e, []byte("z"))
+}
+
+func (e versionEdit) newFile4(level, num, seq uint64) versionEdit {
+	e = e.uvarint(tagNewFile4, level)
+	e = putUvarint(e, num)
+	e = putUvarint(e, 1000)
+	e = putBytes(e, []byte("a"))
+	e = putBytes(e, []byte("z"))
+	e = putUvarint(e, seq)
+	e = putUvarint(e, seq)
+	// The path id, an ignorable field, and the end of the fields.
+	e = putBytes(putUvarint(e, newFilePathID), []byte{0})
+	e = putBytes(putUvarint(e, 33), []byte("checksum"))
+	return putUvarint(e, newFileTerminate)
+}
+
+func writeManifest(t *testing.T, dir string, edits ...versionEdit) {
+	records := make([][]byte, len(edits))
+	for i, e := range edits {
+		records[i] = e
+	}
+	writeLog(t, filepath.Join(dir, "MANIFEST-000002"), 0, records)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "CURRENT"),
+		[]byte("MANIFEST-000002\n"), 0644))
+}
+
+func kv(key string, seq uint64, value string) *entry {
+	return &entry{key: []byte(key), seq: seq, kind: typeValue, value: []byte(value)}
+}
+
+func del(key string, seq uint64) *entry {
+	return &entry{key: []byte(key), seq: seq, kind: typeDeletion}
+}
+
+func readDB(t *testing.T, db *badger.DB) map[string]string {
+	kvs := make(map[string]string)
+	require.NoError(t, db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			kvs[string(it.Item().Key())] = string(v)
+		}
+		return nil
+	}))
+	return kvs
+}
+
+func openDB(t *testing.T) *badger.DB {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).
+		WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	return db
+}
+
+func TestImportLevelDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var old []*entry
+	expected := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		old = append(old, kv(key, uint64(10+i), "old-"+key))
+		expected[key] = "old-" + key
+	}
+	old = append([]*entry{kv("a", 1, "a1"), kv("b", 2, "b1"), kv("c", 3, "c1"),
+		kv("d", 4, "d1")}, old...)
+	writeTable(t, filepath.Join(dir, "000005.ldb"), old,
+		tableOptions{compression: snappyCompression})
+	// The table was compacted away, so its keys aren't imported.
+	writeTable(t, filepath.Join(dir, "000006.ldb"), []*entry{kv("zombie", 5, "z")},
+		tableOptions{})
+	writeTable(t, filepath.Join(dir, "000007.sst"), []*entry{
+		del("b", 200), kv("c", 201, "c2"), kv("k050", 202, "new"),
+	}, tableOptions{})
+
+	big := strings.Repeat("x", 100<<10)
+	writeLog(t, filepath.Join(dir, "000004.log"), 0, [][]byte{
+		encodeBatch(100, kv("stale", 0, "s")),
+	})
+	writeLog(t, filepath.Join(dir, "000008.log"), 0, [][]byte{
+		encodeBatch(300, kv("e", 0, "e1"), del("a", 0), kv("k010", 0, "log")),
+		encodeBatch(303, kv("big", 0, big),
+			&entry{key: []byte("other-cf"), kind: typeCFValue, value: []byte("v")}),
+	})
+	// The log ends with a truncated record.
+	f, err := os.OpenFile(filepath.Join(dir, "000008.log"), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 100, 0, fullFragment, 5})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	del6 := putUvarint(putUvarint(putUvarint(nil, tagDeletedFile), 1), 6)
+	writeManifest(t, dir,
+		versionEdit(putBytes(putUvarint(nil, tagComparator), []byte("leveldb.BytewiseComparator"))).
+			newFile(1, 5).newFile(1, 6),
+		versionEdit(del6).newFile(0, 7).uvarint(tagLogNumber, 8).uvarint(tagLastSequence, 300),
+	)
+
+	db := openDB(t)
+	defer db.Close()
+	stats, err := Import(db, dir, Options{})
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Tables)
+	require.Equal(t, 1, stats.Logs)
+	require.True(t, stats.DroppedLogTail)
+	require.Equal(t, 2, stats.Deleted)
+
+	expected["c"] = "c2"
+	expected["d"] = "d1"
+	expected["e"] = "e1"
+	expected["k050"] = "new"
+	expected["k010"] = "log"
+	expected["big"] = big
+	require.Equal(t, expected, readDB(t, db))
+	require.Equal(t, len(expected), stats.Keys)
+}
+
+func TestImportRocksDB(t *testing.T) {
+	for _, opt := range []tableOptions{
+		{rocksdb: true, formatVersion: 5, compression: zstdCompression, deltaIndex: true,
+			hashIndex: true},
+		{rocksdb: true, formatVersion: 2, compression: zlibCompression, partitioned: true},
+		{rocksdb: true, formatVersion: 4, deltaIndex: true, partitioned: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", opt), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rocksdb")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// The values end with the time they were written at, for a TTL of an hour.
+			now := uint32(time.Now().Unix())
+			ttlValue := func(v string, ts uint32) string {
+				var b [4]byte
+				binary.LittleEndian.PutUint32(b[:], ts)
+				return v + string(b[:])
+			}
+			var entries []*entry
+			expected := make(map[string]string)
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("key%03d", i)
+				ts := now
+				if i%10 == 0 {
+					ts = now - 2*3600
+				} else {
+					expected[key] = "value-" + key
+				}
+				entries = append(entries, kv(key, uint64(i+1), ttlValue("value-"+key, ts)))
+			}
+			writeTable(t, filepath.Join(dir, "000010.sst"), entries, opt)
+			ingestOpt := opt
+			ingestOpt.ingested = true
+			// The entries of an ingested table have the sequence number in the MANIFEST.
+			writeTable(t, filepath.Join(dir, "000011.sst"),
+				[]*entry{kv("key001", 0, ttlValue("ingested", now))}, ingestOpt)
+			expected["key001"] = "ingested"
+
+			writeLog(t, filepath.Join(dir, "000012.log"), 12, [][]byte{
+				encodeBatch(500, kv("key002", 0, ttlValue("from-log", now))),
+			})
+			cf := versionEdit(nil).uvarint(tagColumnFamily, 1)
+			cf = putBytes(putUvarint(cf, tagColumnFamilyAdd), []byte("other"))
+			writeManifest(t, dir,
+				versionEdit(putBytes(putUvarint(nil, tagComparator),
+					[]byte("leveldb.BytewiseComparator"))).uvarint(tagNextFileNumber, 13),
+				cf.newFile4(0, 99, 1),
+				versionEdit(nil).newFile4(6, 10, 50).newFile4(0, 11, 400).
+					uvarint(tagLogNumber, 12).uvarint(tagMinLogToKeep, 12),
+				putBytes(putUvarint(nil, tagSafeIgnoreMask|1), []byte("db-id")),
+			)
+			expected["key002"] = "from-log"
+
+			db := openDB(t)
+			defer db.Close()
+			stats, err := Import(db, dir, Options{TTL: time.Hour})
+			require.NoError(t, err)
+			require.Equal(t, 5, stats.Expired)
+			require.Equal(t, expected, readDB(t, db))
+			require.NoError(t, db.View(func(txn *badger.Txn) error {
+				item, err := txn.Get([]byte("key003"))
+				require.NoError(t, err)
+				require.Equal(t, uint64(now)+3600, item.ExpiresAt())
+				return nil
+			}))
+		})
+	}
+}
+
+func TestImportUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocksdb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeManifest(t, dir, versionEdit(putBytes(putUvarint(nil, tagComparator),
+		[]byte("rocksdb.ReverseBytewiseComparator"))))
+	db := openDB(t)
+	defer db.Close()
+	_, err = Import(db, dir, Options{})
+	require.Error(t, err)
+
+	writeManifest(t, dir, versionEdit(nil).newFile(0, 1))
+	writeTable(t, filepath.Join(dir, "000001.sst"), []*entry{
+		{key: []byte("k"), seq: 1, kind: typeMerge, value: []byte("v")},
+	}, tableOptions{rocksdb: true, formatVersion: 2})
+	_, err = Import(db, dir, Options{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "merge")
+}
+
+func TestImportDump(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	dump := "0x6B31 ==> 0x7631\n0x6B32 ==> 0x\nKeys in range: 2\n"
+	stats, err := ImportDump(db, strings.NewReader(dump), Options{})
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Keys)
+	require.Equal(t, map[string]string{"k1": "v1", "k2": ""}, readDB(t, db))
+
+	db2 := openDB(t)
+	defer db2.Close()
+	scan := "0x6B33 : 0x7633\n0x6B34 : 0x7634\n"
+	_, err = ImportDump(db2, strings.NewReader(scan), Options{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"k3": "v3", "k4": "v4"}, readDB(t, db2))
+
+	db3 := openDB(t)
+	defer db3.Close()
+	_, err = ImportDump(db3, strings.NewReader("0x02 : 0x00\n0x01 : 0x00\n"), Options{})
+	require.Error(t, err)
+}
+
+// TestImportFixtures imports the DBs written by LevelDB and RocksDB themselves, with
+// testdata/gen.py.
+func TestImportFixtures(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "*", "expected.txt"))
+	require.NoError(t, err)
+	if len(dirs) == 0 {
+		t.Skip("No fixtures in testdata: write them with testdata/gen.py")
+	}
+	for _, expected := range dirs {
+		dir := filepath.Dir(expected)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			f, err := os.Open(expected)
+			require.NoError(t, err)
+			defer f.Close()
+			want := openDB(t)
+			defer want.Close()
+			_, err = ImportDump(want, f, Options{})
+			require.NoError(t, err)
+
+			db := openDB(t)
+			defer db.Close()
+			stats, err := Import(db, filepath.Join(dir, "db"), Options{})
+			require.NoError(t, err)
+			require.NotZero(t, stats.Tables)
+			require.Equal(t, readDB(t, want), readDB(t, db))
+		})
+	}
+}
@@ -0,0 +1,501 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package migrate
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+const (
+	blockTrailerSize = 5
+	// A LevelDB footer, also used by RocksDB tables of format version 0, is made of the handles of
+	// the metaindex and the index blocks, padded to 40 bytes, and of the magic number. The
+	// footer of the later RocksDB formats starts with the checksum type, and has the format
+	// version before the magic number.
+	legacyFooterSize = 48
+	footerSize       = 53
+
+	legacyMagic           = 0xdb4775248b80fb57
+	blockBasedMagic       = 0x88e241b785f4cff7
+	plainTableMagic       = 0x8242229663bf9564
+	legacyPlainTableMagic = 0x4f3418eb7a8f13b8
+	cuckooTableMagic      = 0x926789d0c5f17873
+
+	// The index types of RocksDB tables.
+	binarySearchIndex   = 0
+	hashSearchIndex     = 1
+	partitionedIndex    = 2
+	firstKeyIndex       = 3
+	maxFormatVersion    = 5
+	checksumNone        = 0
+	checksumCRC32C      = 1
+	checksumXXHash64    = 3
+	noCompression       = 0
+	snappyCompression   = 1
+	zlibCompression     = 2
+	zstdCompression     = 7
+	zstdCompressionPrev = 0x40
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// unmaskCRC reverses the masking of the checksums stored by LevelDB and RocksDB.
+func unmaskCRC(c uint32) uint32 {
+	rot := c - 0xa282ead8
+	return rot>>17 | rot<<15
+}
+
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func decodeHandle(b []byte) (blockHandle, int, error) {
+	offset, n := binary.Uvarint(b)
+	if n <= 0 {
+		return blockHandle{}, 0, errors.New("invalid block handle")
+	}
+	size, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return blockHandle{}, 0, errors.New("invalid block handle")
+	}
+	return blockHandle{offset: offset, size: size}, n + m, nil
+}
+
+// sstable is a LevelDB table, or a RocksDB block based table.
+type sstable struct {
+	f             *os.File
+	name          string
+	rocksdb       bool
+	formatVersion uint32
+	checksum      byte
+	// deltaIndex is set if the values of the index blocks are delta encoded, and partitioned if
+	// the index is split in partitions.
+	deltaIndex  bool
+	partitioned bool
+	// seq is the sequence number of all the entries of a file ingested in RocksDB, if set.
+	seq    uint64
+	index  blockHandle
+	blocks []blockHandle
+}
+
+// openTable opens the table at path. largestSeq is the largest sequence number of the table in
+// the MANIFEST, which is the sequence number of the entries of the tables ingested in RocksDB.
+func openTable(path string, largestSeq uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{f: f, name: path}
+	if err := t.init(largestSeq); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "while opening table %s", path)
+	}
+	return t, nil
+}
+
+func (t *sstable) init(largestSeq uint64) error {
+	fi, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size < legacyFooterSize {
+		return errors.New("file too short to be a table")
+	}
+	var magic [8]byte
+	if _, err := t.f.ReadAt(magic[:], size-8); err != nil {
+		return err
+	}
+	var footer []byte
+	switch m := binary.LittleEndian.Uint64(magic[:]); m {
+	case legacyMagic:
+		footer = make([]byte, legacyFooterSize)
+		t.checksum = checksumCRC32C
+	case blockBasedMagic:
+		if size < footerSize {
+			return errors.New("file too short to be a table")
+		}
+		footer = make([]byte, footerSize)
+		t.rocksdb = true
+	case plainTableMagic, legacyPlainTableMagic, cuckooTableMagic:
+		return errors.New("only block based tables are supported")
+	default:
+		return errors.Errorf("not a LevelDB or RocksDB table, magic number %x", m)
+	}
+	if _, err := t.f.ReadAt(footer, size-int64(len(footer))); err != nil {
+		return err
+	}
+	handles := footer
+	if t.rocksdb {
+		t.checksum = footer[0]
+		handles = footer[1:]
+		t.formatVersion = binary.LittleEndian.Uint32(footer[footerSize-12:])
+		if t.formatVersion > maxFormatVersion {
+			return errors.Errorf("table format version %d is not supported", t.formatVersion)
+		}
+	}
+	metaindex, n, err := decodeHandle(handles)
+	if err != nil {
+		return err
+	}
+	if t.index, _, err = decodeHandle(handles[n:]); err != nil {
+		return err
+	}
+	if err := t.readMeta(metaindex, largestSeq); err != nil {
+		return err
+	}
+	if t.partitioned {
+		partitions, err := t.indexHandles(t.index)
+		if err != nil {
+			return err
+		}
+		for _, p := range partitions {
+			blocks, err := t.indexHandles(p)
+			if err != nil {
+				return err
+			}
+			t.blocks = append(t.blocks, blocks...)
+		}
+	} else if t.blocks, err = t.indexHandles(t.index); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readMeta reads the properties of RocksDB tables, which tell how the index is encoded.
+func (t *sstable) readMeta(metaindex blockHandle, largestSeq uint64) error {
+	b, err := t.readBlock(metaindex)
+	if err != nil {
+		return err
+	}
+	var props *blockHandle
+	err = b.iterate(func(key, value []byte) error {
+		switch string(key) {
+		case "rocksdb.properties", "rocksdb.stats":
+			h, _, err := decodeHandle(value)
+			props = &h
+			return err
+		case "rocksdb.range_del":
+			return errors.New("range deletions are not supported")
+		}
+		return nil
+	})
+	if err != nil || props == nil {
+		return err
+	}
+	t.rocksdb = true
+	if b, err = t.readBlock(*props); err != nil {
+		return err
+	}
+	var ingested bool
+	var globalSeq uint64
+	err = b.iterate(func(key, value []byte) error {
+		switch string(key) {
+		case "rocksdb.comparator":
+			if !isBytewise(string(value)) {
+				return errors.Errorf("comparator %s is not supported", value)
+			}
+		case "rocksdb.index.value.is.delta.encoded":
+			v, _ := binary.Uvarint(value)
+			t.deltaIndex = v > 0
+		case "rocksdb.block.based.table.index.type":
+			if len(value) != 4 {
+				return errors.New("invalid index type property")
+			}
+			switch binary.LittleEndian.Uint32(value) {
+			case binarySearchIndex, hashSearchIndex:
+			case partitionedIndex:
+				t.partitioned = true
+			case firstKeyIndex:
+				return errors.New("indexes with the first keys of the blocks are not supported")
+			default:
+				return errors.Errorf("index type %d is not supported",
+					binary.LittleEndian.Uint32(value))
+			}
+		case "rocksdb.external_sst_file.version":
+			ingested = true
+		case "rocksdb.external_sst_file.global_seqno":
+			if len(value) == 8 {
+				globalSeq = binary.LittleEndian.Uint64(value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ingested {
+		// The entries of an ingested file have the sequence number it was ingested at, recorded
+		// in the MANIFEST by the recent versions, and in the file by the older ones.
+		t.seq = largestSeq
+		if t.seq == 0 {
+			t.seq = globalSeq
+		}
+	}
+	return nil
+}
+
+// indexHandles returns the handles of the blocks listed in the index block at h.
+func (t *sstable) indexHandles(h blockHandle) ([]blockHandle, error) {
+	b, err := t.readBlock(h)
+	if err != nil {
+		return nil, err
+	}
+	var handles []blockHandle
+	if !t.deltaIndex {
+		err = b.iterate(func(_, value []byte) error {
+			h, _, err := decodeHandle(value)
+			handles = append(handles, h)
+			return err
+		})
+		return handles, err
+	}
+	// The first entry of each restart interval has the full handle, and the other entries the
+	// difference between the size of their block and of the previous one. The blocks follow
+	// each other, so the offset is that of the previous block plus its size and trailer.
+	err = b.iterateDelta(func(value []byte, restart bool) (int, error) {
+		if restart {
+			h, n, err := decodeHandle(value)
+			handles = append(handles, h)
+			return n, err
+		}
+		if len(handles) == 0 {
+			return 0, errors.New("invalid delta encoded index")
+		}
+		delta, n := binary.Varint(value)
+		if n <= 0 {
+			return 0, errors.New("invalid delta encoded index")
+		}
+		prev := handles[len(handles)-1]
+		handles = append(handles, blockHandle{
+			offset: prev.offset + prev.size + blockTrailerSize,
+			size:   uint64(int64(prev.size) + delta),
+		})
+		return n, nil
+	})
+	return handles, err
+}
+
+// readBlock reads the block at h, checks its checksum and decompresses it.
+func (t *sstable) readBlock(h blockHandle) (*block, error) {
+	buf := make([]byte, h.size+blockTrailerSize)
+	if _, err := t.f.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, errors.Wrapf(err, "while reading block at %d", h.offset)
+	}
+	data, typ := buf[:h.size], buf[h.size]
+	sum := binary.LittleEndian.Uint32(buf[h.size+1:])
+	switch t.checksum {
+	case checksumNone:
+	case checksumCRC32C:
+		if crc32.Checksum(buf[:h.size+1], crcTable) != unmaskCRC(sum) {
+			return nil, errors.Errorf("checksum mismatch in block at %d", h.offset)
+		}
+	case checksumXXHash64:
+		if uint32(xxhash.Sum64(buf[:h.size+1])) != sum {
+			return nil, errors.Errorf("checksum mismatch in block at %d", h.offset)
+		}
+	default:
+		// The other checksums aren't verified.
+	}
+	data, err := t.decompress(data, typ)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while decompressing block at %d", h.offset)
+	}
+	return parseBlock(data)
+}
+
+func (t *sstable) decompress(data []byte, typ byte) ([]byte, error) {
+	// From the format version 2, RocksDB prefixes the blocks compressed with zlib or zstd with
+	// their decompressed size.
+	stripSize := func() []byte {
+		if t.formatVersion >= 2 {
+			if _, n := binary.Uvarint(data); n > 0 {
+				return data[n:]
+			}
+		}
+		return data
+	}
+	switch typ {
+	case noCompression:
+		return data, nil
+	case snappyCompression:
+		return snappy.Decode(nil, data)
+	case zlibCompression:
+		// LevelDB uses this type for zstd, and RocksDB for zlib.
+		if !t.rocksdb && bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+			return y.ZSTDDecompress(nil, data)
+		}
+		// RocksDB compresses without the zlib header by default.
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(stripSize())))
+	case zstdCompression, zstdCompressionPrev:
+		return y.ZSTDDecompress(nil, stripSize())
+	default:
+		return nil, errors.Errorf("compression type %d is not supported", typ)
+	}
+}
+
+func (t *sstable) Close() error {
+	return t.f.Close()
+}
+
+// iterator returns a source iterating over the entries of the table.
+func (t *sstable) iterator() *tableSource {
+	return &tableSource{t: t}
+}
+
+// tableSource is a source of the entries of a table, reading one block at a time.
+type tableSource struct {
+	t       *sstable
+	next    int
+	entries []*entry
+}
+
+func (s *tableSource) Next() (*entry, error) {
+	for len(s.entries) == 0 {
+		if s.next == len(s.t.blocks) {
+			return nil, nil
+		}
+		b, err := s.t.readBlock(s.t.blocks[s.next])
+		if err != nil {
+			return nil, errors.Wrapf(err, "in table %s", s.t.name)
+		}
+		s.next++
+		err = b.iterate(func(key, value []byte) error {
+			e, err := parseInternalKey(key)
+			if err != nil {
+				return err
+			}
+			if s.t.seq > 0 {
+				e.seq = s.t.seq
+			}
+			e.value = value
+			s.entries = append(s.entries, e)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "in table %s", s.t.name)
+		}
+	}
+	e := s.entries[0]
+	s.entries[0] = nil
+	s.entries = s.entries[1:]
+	return e, nil
+}
+
+// block is a block of a table. The entries are followed by the offsets of the restart points,
+// where the keys are written in full instead of sharing a prefix with the previous key.
+type block struct {
+	data     []byte
+	restarts []uint32
+}
+
+func parseBlock(b []byte) (*block, error) {
+	if len(b) < 4 {
+		return nil, errors.New("block too short")
+	}
+	end := len(b) - 4
+	num := binary.LittleEndian.Uint32(b[end:])
+	if num&(1<<31) != 0 {
+		// RocksDB data blocks with a hash index have the hash buckets and their number between
+		// the restart points and the footer.
+		num &^= 1 << 31
+		if end < 2 {
+			return nil, errors.New("block too short")
+		}
+		buckets := int(binary.LittleEndian.Uint16(b[end-2:]))
+		end -= 2 + buckets
+	}
+	if end < 0 || uint64(end) < 4*uint64(num) {
+		return nil, errors.New("invalid number of restart points in block")
+	}
+	end -= 4 * int(num)
+	restarts := make([]uint32, num)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(b[end+4*i:])
+	}
+	return &block{data: b[:end], restarts: restarts}, nil
+}
+
+// iterate calls fn with each key and value of the block. The key is only valid during the call.
+func (b *block) iterate(fn func(key, value []byte) error) error {
+	var key []byte
+	for off := 0; off < len(b.data); {
+		var hdr [3]uint64
+		for i := range hdr {
+			v, n := binary.Uvarint(b.data[off:])
+			if n <= 0 {
+				return errors.New("invalid block entry")
+			}
+			hdr[i] = v
+			off += n
+		}
+		shared, unshared, valueLen := hdr[0], hdr[1], hdr[2]
+		if shared > uint64(len(key)) || uint64(len(b.data)-off) < unshared+valueLen {
+			return errors.New("invalid block entry")
+		}
+		key = append(key[:shared], b.data[off:off+int(unshared)]...)
+		off += int(unshared)
+		if err := fn(key, b.data[off:off+int(valueLen)]); err != nil {
+			return err
+		}
+		off += int(valueLen)
+	}
+	return nil
+}
+
+// iterateDelta iterates over a block whose values are delta encoded, and so whose entries don't
+// have the length of the value. fn is called with the data following the key, and whether the
+// entry is a restart point, and returns the length of the value.
+func (b *block) iterateDelta(fn func(value []byte, restart bool) (int, error)) error {
+	next := 0
+	for off := 0; off < len(b.data); {
+		restart := next < len(b.restarts) && uint32(off) == b.restarts[next]
+		if restart {
+			next++
+		}
+		var hdr [2]uint64
+		for i := range hdr {
+			v, n := binary.Uvarint(b.data[off:])
+			if n <= 0 {
+				return errors.New("invalid block entry")
+			}
+			hdr[i] = v
+			off += n
+		}
+		if uint64(len(b.data)-off) < hdr[1] {
+			return errors.New("invalid block entry")
+		}
+		off += int(hdr[1])
+		n, err := fn(b.data[off:], restart)
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+#!/usr/bin/env python3
+#
+# Writes the LevelDB and RocksDB fixtures imported by TestImportFixtures, with the real libraries,
+# so that the importer is tested against the files they write, and not only against the files the
+# tests build from their reading of the formats. Run it from its directory, and commit the
+# directories it writes:
+#
+#   pip install plyvel rocksdict
+#   ./gen.py
+#
+# Every fixture is a directory with the DB, in db/, and the latest value of every key, in
+# expected.txt, in the format of "ldb --hex scan". Each DB has tables on several levels, keys
+# overwritten and deleted after they were flushed, and writes which are only in the write-ahead log.
+
+import os
+import shutil
+
+import plyvel
+import rocksdict
+
+
+def ops():
+    """Yields the writes of the fixtures, as (key, value) pairs, with None for the deletes."""
+    for round in range(3):
+        for i in range(2000):
+            yield b"key%05d" % i, b"value-%d-%05d-" % (round, i) + b"x" * (i % 300)
+        for i in range(0, 2000, 7 + round):
+            yield b"key%05d" % i, None
+    yield b"empty", b""
+    yield b"binary\x00\xff", bytes(range(256))
+
+
+def write_expected(path, kvs):
+    with open(path, "w") as f:
+        for key in sorted(kvs):
+            f.write("0x%s ==> 0x%s\n" % (key.hex().upper(), kvs[key].hex().upper()))
+
+
+def fixture(name, open_db, put, delete, flush, close):
+    shutil.rmtree(name, ignore_errors=True)
+    os.makedirs(name)
+    db = open_db(os.path.join(name, "db"))
+    kvs = {}
+    writes = list(ops())
+    # The last writes stay in the write-ahead log.
+    tail = len(writes) - 50
+    for n, (key, value) in enumerate(writes):
+        if value is None:
+            delete(db, key)
+            kvs.pop(key, None)
+        else:
+            put(db, key, value)
+            kvs[key] = value
+        if n == tail:
+            flush(db)
+    close(db)
+    write_expected(os.path.join(name, "expected.txt"), kvs)
+
+
+def leveldb():
+    fixture(
+        "leveldb",
+        lambda path: plyvel.DB(path, create_if_missing=True, write_buffer_size=64 << 10,
+                               compression="snappy"),
+        lambda db, k, v: db.put(k, v),
+        lambda db, k: db.delete(k),
+        # LevelDB has no flush: compacting a range flushes the memtable.
+        lambda db: db.compact_range(start=b"key00000", stop=b"key00100"),
+        lambda db: db.close(),
+    )
+
+
+def rocksdb(name, compression):
+    def open_db(path):
+        opt = rocksdict.Options()
+        opt.create_if_missing(True)
+        opt.set_write_buffer_size(64 << 10)
+        opt.set_compression_type(compression)
+        return rocksdict.Rdict(path, opt, raw_mode=True)
+
+    fixture(
+        name,
+        open_db,
+        lambda db, k, v: db.put(k, v),
+        lambda db, k: db.delete(k),
+        lambda db: db.flush(),
+        lambda db: db.close(),
+    )
+
+
+if __name__ == "__main__":
+    leveldb()
+    rocksdb("rocksdb", rocksdict.DBCompressionType.snappy())
+    rocksdb("rocksdb-zstd", rocksdict.DBCompressionType.zstd())
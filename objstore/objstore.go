@@ -0,0 +1,404 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+Package objstore streams objects to and from object storage, so that backups can be written to and
+restored from it without a local file. It supports s3:// URLs, and gs:// URLs through the
+S3-compatible XML API of Google Cloud Storage, authenticated with HMAC keys.
+
+Objects are written with multipart uploads, whose parts are uploaded concurrently, and read with
+GET requests which are resumed where they failed. The requests failing with a network error or a
+server error are retried.
+*/
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxPartSize and maxParts are the limits of the multipart uploads.
+const (
+	maxPartSize = 5 << 30
+	maxParts    = 10000
+)
+
+// Options are the options of the object storage client.
+type Options struct {
+	// Endpoint is the URL of the object storage service, like https://minio.local:9000. If empty,
+	// it is the endpoint of AWS S3 in Region for s3:// URLs, and https://storage.googleapis.com
+	// for gs:// URLs. The buckets are addressed in the path of a custom endpoint.
+	Endpoint string
+	// Region is the region of the bucket. It is us-east-1 if empty.
+	Region string
+
+	// The credentials used to sign the requests. For gs:// URLs, they are an HMAC key.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PartSize is the size of the parts of the multipart uploads. The objects smaller than it are
+	// uploaded in a single request. It is doubled every 1000 parts, so that objects of several
+	// TBs fit in the 10000 parts of an upload. It should be at least 5MB.
+	PartSize int64
+	// Concurrency is the number of parts uploaded concurrently. The writers hold up to
+	// Concurrency+1 parts in memory.
+	Concurrency int
+	// MaxRetries is the number of times a failed request is retried.
+	MaxRetries int
+
+	// SSE is the server-side encryption of the objects written, AES256 or aws:kms. It is ignored
+	// for gs:// URLs, whose objects are always encrypted.
+	SSE string
+	// KMSKeyID is the KMS key the objects written are encrypted with.
+	KMSKeyID string
+	// CustomerKey is the 32 bytes key the objects are encrypted with, if not nil. It must be set
+	// both to write and read them.
+	CustomerKey []byte
+
+	// HTTPClient is the client the requests are sent with. It is http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// DefaultOptions returns the default options for rawurl, with the credentials and region read from
+// the environment: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION
+// for s3:// URLs, and GCS_ACCESS_KEY_ID and GCS_SECRET_ACCESS_KEY for gs:// URLs.
+func DefaultOptions(rawurl string) Options {
+	opt := Options{
+		PartSize:    64 << 20,
+		Concurrency: 4,
+		MaxRetries:  5,
+	}
+	if strings.HasPrefix(rawurl, "gs://") {
+		opt.AccessKeyID = os.Getenv("GCS_ACCESS_KEY_ID")
+		opt.SecretAccessKey = os.Getenv("GCS_SECRET_ACCESS_KEY")
+		return opt
+	}
+	opt.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	opt.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	opt.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	opt.Region = os.Getenv("AWS_REGION")
+	return opt
+}
+
+// IsURL returns true if s is an object storage URL, which can be passed to NewWriter and
+// NewReader.
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, "s3://") || strings.HasPrefix(s, "gs://")
+}
+
+// Delete deletes the object at rawurl. Deleting an object which doesn't exist succeeds.
+func Delete(ctx context.Context, rawurl string, opt Options) error {
+	o, err := newObject(rawurl, opt)
+	if err != nil {
+		return err
+	}
+	resp, err := o.do(ctx, http.MethodDelete, nil, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "while deleting the object")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Error is the error returned by the object storage service for a failed request.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("objstore: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// retryable returns true if the request can succeed when retried.
+func (e *Error) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests ||
+		e.Code == "InternalError" || e.Code == "SlowDown"
+}
+
+// object is an object in a bucket.
+type object struct {
+	opt    Options
+	scheme string
+	bucket string
+	key    string
+	client *http.Client
+}
+
+func newObject(rawurl string, opt Options) (*object, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" && u.Scheme != "gs" {
+		return nil, errors.Errorf("objstore: unsupported URL scheme %q", u.Scheme)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, errors.Errorf("objstore: URL %q must be like %s://bucket/key", rawurl, u.Scheme)
+	}
+	if opt.Region == "" {
+		opt.Region = "us-east-1"
+		if u.Scheme == "gs" {
+			opt.Region = "auto"
+		}
+	}
+	if opt.PartSize <= 0 {
+		opt.PartSize = 64 << 20
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = 1
+	}
+	if opt.CustomerKey != nil && len(opt.CustomerKey) != 32 {
+		return nil, errors.New("objstore: the customer key must be 32 bytes")
+	}
+	client := opt.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &object{opt: opt, scheme: u.Scheme, bucket: u.Host, key: key, client: client}, nil
+}
+
+// url returns the URL of the object, with the query.
+func (o *object) url(query url.Values) string {
+	var u string
+	switch {
+	case o.opt.Endpoint != "":
+		u = strings.TrimSuffix(o.opt.Endpoint, "/") + "/" + o.bucket + "/" + uriEncode(o.key, false)
+	case o.scheme == "gs":
+		u = "https://storage.googleapis.com/" + o.bucket + "/" + uriEncode(o.key, false)
+	default:
+		u = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", o.bucket, o.opt.Region,
+			uriEncode(o.key, false))
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	return u
+}
+
+// setSSE sets the headers of the server-side encryption. The upload parts and the reads only need
+// the customer key, while the creation of the object needs all of them.
+func (o *object) setSSE(h http.Header, create bool) {
+	if o.scheme == "gs" {
+		if o.opt.CustomerKey != nil {
+			sum := sha256.Sum256(o.opt.CustomerKey)
+			h.Set("x-goog-encryption-algorithm", "AES256")
+			h.Set("x-goog-encryption-key", base64.StdEncoding.EncodeToString(o.opt.CustomerKey))
+			h.Set("x-goog-encryption-key-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		} else if create && o.opt.KMSKeyID != "" {
+			h.Set("x-goog-encryption-kms-key-name", o.opt.KMSKeyID)
+		}
+		return
+	}
+	if o.opt.CustomerKey != nil {
+		sum := md5.Sum(o.opt.CustomerKey)
+		h.Set("x-amz-server-side-encryption-customer-algorithm", "AES256")
+		h.Set("x-amz-server-side-encryption-customer-key",
+			base64.StdEncoding.EncodeToString(o.opt.CustomerKey))
+		h.Set("x-amz-server-side-encryption-customer-key-MD5",
+			base64.StdEncoding.EncodeToString(sum[:]))
+		return
+	}
+	if !create {
+		return
+	}
+	if o.opt.SSE != "" {
+		h.Set("x-amz-server-side-encryption", o.opt.SSE)
+	}
+	if o.opt.KMSKeyID != "" {
+		h.Set("x-amz-server-side-encryption-aws-kms-key-id", o.opt.KMSKeyID)
+	}
+}
+
+// do sends a request, retrying it while it fails with a retryable error. The body of the response
+// must be closed by the caller. The responses with a status other than 2xx are returned as *Error.
+func (o *object) do(ctx context.Context, method string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		resp, err = o.send(ctx, method, query, header, body)
+		if err == nil {
+			return resp, nil
+		}
+		if e, ok := err.(*Error); ok && !e.retryable() {
+			return nil, err
+		}
+		if attempt >= o.opt.MaxRetries || ctx.Err() != nil {
+			break
+		}
+		if err := sleep(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (o *object) send(ctx context.Context, method string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, o.url(query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	o.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode}
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if xml.Unmarshal(buf, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return nil, e
+}
+
+// sleep waits before the retry of the attempt, with an exponential backoff.
+func sleep(ctx context.Context, attempt int) error {
+	d := 100 * time.Millisecond << uint(attempt)
+	if d > 10*time.Second || d <= 0 {
+		d = 10 * time.Second
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sign signs the request with AWS Signature Version 4, which both S3 and GCS accept.
+func (o *object) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if o.opt.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", o.opt.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + o.opt.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+o.opt.SecretAccessKey), date)
+	key = hmacSHA256(key, o.opt.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		o.opt.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query with its keys sorted, as expected by the signature.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes all the bytes of s but the unreserved characters, and the slashes unless
+// encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
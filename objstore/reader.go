@@ -0,0 +1,156 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Reader reads an object. If reading the object fails midway, it is read again from where it
+// failed.
+type Reader struct {
+	ctx  context.Context
+	o    *object
+	body io.ReadCloser
+	// off is the offset read up to, and size the size of the object.
+	off  int64
+	size int64
+}
+
+// NewReader returns a Reader reading the object at rawurl, like s3://bucket/path/to/key. The
+// requests are canceled once ctx is done.
+func NewReader(ctx context.Context, rawurl string, opt Options) (*Reader, error) {
+	o, err := newObject(rawurl, opt)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{ctx: ctx, o: o, size: -1}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open gets the object from the offset read up to.
+func (r *Reader) open() error {
+	h := make(http.Header)
+	r.o.setSSE(h, false)
+	if r.off > 0 {
+		h.Set("Range", "bytes="+strconv.FormatInt(r.off, 10)+"-")
+	}
+	resp, err := r.o.do(r.ctx, http.MethodGet, nil, h, nil)
+	if err != nil {
+		return errors.Wrap(err, "while reading the object")
+	}
+	if r.size < 0 {
+		r.size = resp.ContentLength
+	}
+	r.body = resp.Body
+	return nil
+}
+
+// Size returns the size of the object, or -1 if it isn't known.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Read reads from the object.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.body == nil {
+		return 0, errors.New("objstore: read from a closed Reader")
+	}
+	for attempt := 0; ; attempt++ {
+		n, err := r.body.Read(p)
+		r.off += int64(n)
+		if err == io.EOF && (r.size < 0 || r.off >= r.size) {
+			return n, io.EOF
+		}
+		if err == nil || n > 0 {
+			return n, nil
+		}
+		// The connection failed, or was closed before the end of the object.
+		if attempt >= r.o.opt.MaxRetries || r.ctx.Err() != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.body.Close()
+		r.body = nil
+		if err := sleep(r.ctx, attempt); err != nil {
+			return 0, err
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close closes the Reader.
+func (r *Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// ReadAt reads len(p) bytes of the object at rawurl from off, with a single ranged request. Unlike
+// the Reader, it doesn't keep a connection open, so it suits the small random reads of the parts
+// of a large object.
+func ReadAt(ctx context.Context, rawurl string, p []byte, off int64, opt Options) error {
+	o, err := newObject(rawurl, opt)
+	if err != nil {
+		return err
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	h := make(http.Header)
+	o.setSSE(h, false)
+	h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	for attempt := 0; ; attempt++ {
+		resp, err := o.do(ctx, http.MethodGet, nil, h, nil)
+		if err != nil {
+			return errors.Wrapf(err, "while reading the object at offset %d", off)
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return errors.Errorf("objstore: the range of the object wasn't returned, status: %d",
+				resp.StatusCode)
+		}
+		_, err = io.ReadFull(resp.Body, p)
+		resp.Body.Close()
+		if err == nil {
+			return nil
+		}
+		// The connection failed, or was closed before the end of the range.
+		if attempt >= o.opt.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		if err := sleep(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
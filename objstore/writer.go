@@ -0,0 +1,277 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Writer writes an object. The object is only created once Close returns without error, so a
+// failed write doesn't leave a partial object behind.
+type Writer struct {
+	ctx context.Context
+	o   *object
+
+	buf      []byte
+	partSize int64
+	partNum  int
+	uploadID string
+
+	// throttle bounds the number of parts being uploaded.
+	throttle chan struct{}
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	parts []completedPart
+	err   error
+
+	closed bool
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// NewWriter returns a Writer writing the object at rawurl, like s3://bucket/path/to/key. The
+// requests are canceled once ctx is done.
+func NewWriter(ctx context.Context, rawurl string, opt Options) (*Writer, error) {
+	o, err := newObject(rawurl, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		ctx:      ctx,
+		o:        o,
+		partSize: o.opt.PartSize,
+		throttle: make(chan struct{}, o.opt.Concurrency),
+	}, nil
+}
+
+// Write buffers p, and uploads the buffered data once it fills a part.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("objstore: write to a closed Writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		if err := w.firstErr(); err != nil {
+			return n, err
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.partSize)
+		}
+		m := int(w.partSize) - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if int64(len(w.buf)) == w.partSize {
+			if err := w.uploadPart(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// uploadPart uploads the buffer as the next part, in the background.
+func (w *Writer) uploadPart() error {
+	if w.uploadID == "" {
+		if err := w.createUpload(); err != nil {
+			w.setErr(err)
+			return err
+		}
+	}
+	if w.partNum == maxParts {
+		err := errors.New("objstore: the object is too large")
+		w.setErr(err)
+		return err
+	}
+	w.partNum++
+	num, buf := w.partNum, w.buf
+	w.buf = nil
+	if w.partNum%1000 == 0 && w.partSize*2 <= maxPartSize {
+		w.partSize *= 2
+	}
+
+	select {
+	case w.throttle <- struct{}{}:
+	case <-w.ctx.Done():
+		w.setErr(w.ctx.Err())
+		return w.ctx.Err()
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.throttle }()
+		query := url.Values{
+			"partNumber": {strconv.Itoa(num)},
+			"uploadId":   {w.uploadID},
+		}
+		h := make(http.Header)
+		w.o.setSSE(h, false)
+		resp, err := w.o.do(w.ctx, http.MethodPut, query, h, buf)
+		if err != nil {
+			w.setErr(errors.Wrapf(err, "while uploading part %d", num))
+			return
+		}
+		resp.Body.Close()
+		w.mu.Lock()
+		w.parts = append(w.parts, completedPart{PartNumber: num, ETag: resp.Header.Get("ETag")})
+		w.mu.Unlock()
+	}()
+	return nil
+}
+
+func (w *Writer) createUpload() error {
+	h := make(http.Header)
+	w.o.setSSE(h, true)
+	resp, err := w.o.do(w.ctx, http.MethodPost, url.Values{"uploads": {""}}, h, nil)
+	if err != nil {
+		return errors.Wrap(err, "while creating the multipart upload")
+	}
+	defer resp.Body.Close()
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return errors.Wrap(err, "while reading the multipart upload")
+	}
+	if res.UploadID == "" {
+		return errors.New("objstore: no upload ID returned for the multipart upload")
+	}
+	w.uploadID = res.UploadID
+	return nil
+}
+
+// Close uploads the data left and creates the object. If it fails, the object isn't created.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.firstErr(); err != nil {
+		return w.abort(err)
+	}
+	if w.uploadID == "" {
+		// The object fits in a part, so it is uploaded in a single request.
+		h := make(http.Header)
+		w.o.setSSE(h, true)
+		resp, err := w.o.do(w.ctx, http.MethodPut, nil, h, w.buf)
+		if err != nil {
+			return errors.Wrap(err, "while uploading the object")
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(); err != nil {
+			return w.abort(err)
+		}
+	}
+	w.wg.Wait()
+	if err := w.firstErr(); err != nil {
+		return w.abort(err)
+	}
+	if err := w.complete(); err != nil {
+		return w.abort(err)
+	}
+	return nil
+}
+
+// Abort discards the data written, without creating the object.
+func (w *Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.abort(nil)
+}
+
+// abort aborts the multipart upload, and returns err.
+func (w *Writer) abort(err error) error {
+	w.wg.Wait()
+	if w.uploadID == "" {
+		return err
+	}
+	// The upload is aborted even if ctx is done, so that its parts aren't left behind.
+	query := url.Values{"uploadId": {w.uploadID}}
+	resp, aerr := w.o.do(context.Background(), http.MethodDelete, query, nil, nil)
+	if aerr == nil {
+		resp.Body.Close()
+	} else if err == nil {
+		err = errors.Wrap(aerr, "while aborting the multipart upload")
+	}
+	return err
+}
+
+func (w *Writer) complete() error {
+	sort.Slice(w.parts, func(i, j int) bool { return w.parts[i].PartNumber < w.parts[j].PartNumber })
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadId": {w.uploadID}}
+	resp, err := w.o.do(w.ctx, http.MethodPost, query, nil, body)
+	if err != nil {
+		return errors.Wrap(err, "while completing the multipart upload")
+	}
+	defer resp.Body.Close()
+	// The completion can fail after the status was sent, in which case the body is an error.
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(buf, []byte("<Error>")) {
+		e := &Error{StatusCode: resp.StatusCode}
+		if err := xml.Unmarshal(buf, e); err != nil {
+			return err
+		}
+		return e
+	}
+	return nil
+}
+
+func (w *Writer) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *Writer) firstErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"time"
+)
+
+// OpenProgress is the progress of the opening of a DB, passed to Options.OnOpenProgress. The
+// write-ahead logs of the memtables are replayed first, then the tables are opened.
+type OpenProgress struct {
+	// LogBytesReplayed is the size of the write-ahead logs replayed so far, and LogBytes the size
+	// of all of them.
+	LogBytesReplayed int64
+	LogBytes         int64
+	// TablesOpened is the number of tables opened so far, and Tables the number of tables in the
+	// MANIFEST.
+	TablesOpened int
+	Tables       int
+	Elapsed      time.Duration
+}
+
+// openProgress reports the progress of the opening of the DB to Options.OnOpenProgress.
+type openProgress struct {
+	fn    func(OpenProgress)
+	start time.Time
+
+	sync.Mutex
+	p OpenProgress
+}
+
+func newOpenProgress(fn func(OpenProgress), tables int) *openProgress {
+	return &openProgress{fn: fn, start: time.Now(), p: OpenProgress{Tables: tables}}
+}
+
+// update applies f to the progress, and reports it. The progress is reported by one goroutine at a
+// time, in the order of the updates.
+func (o *openProgress) update(f func(p *OpenProgress)) {
+	if o == nil || o.fn == nil {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	f(&o.p)
+	o.p.Elapsed = time.Since(o.start)
+	o.fn(o.p)
+}
+
+// numOpenWorkers returns the number of goroutines opening the tables and the memtables.
+func (opt *Options) numOpenWorkers() int {
+	if opt.NumOpenWorkers < 1 {
+		return 1
+	}
+	return opt.NumOpenWorkers
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumOpenWorkers(4)
+
+	// The first keys are flushed to a table on close.
+	db0, err := Open(opt)
+	require.NoError(t, err)
+	h := testHelper{db: db0, t: t}
+	h.writeRange(0, 99)
+	require.NoError(t, db0.Close())
+
+	// The next keys are left in two memtables, to be replayed from their WALs.
+	db0, err = Open(opt)
+	require.NoError(t, err)
+	h.db = db0
+	h.writeRange(100, 199)
+	db0.imm = append(db0.imm, db0.mt)
+	db0.mt, err = db0.newMemTable()
+	require.NoError(t, err)
+	h.writeRange(200, 299)
+	numTables := len(db0.Tables())
+	require.NotZero(t, numTables)
+
+	// Simulate a crash by not closing db0, but releasing the locks.
+	if db0.dirLockGuard != nil {
+		require.NoError(t, db0.dirLockGuard.release())
+		db0.dirLockGuard = nil
+	}
+	if db0.valueDirGuard != nil {
+		require.NoError(t, db0.valueDirGuard.release())
+		db0.valueDirGuard = nil
+	}
+
+	var progress []OpenProgress
+	db1, err := Open(opt.WithOnOpenProgress(func(p OpenProgress) {
+		progress = append(progress, p)
+	}))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db1.Close()) }()
+	h.db = db1
+	h.readRange(0, 299)
+
+	require.NotEmpty(t, progress)
+	for i := 1; i < len(progress); i++ {
+		require.True(t, progress[i].LogBytesReplayed >= progress[i-1].LogBytesReplayed)
+		require.True(t, progress[i].TablesOpened >= progress[i-1].TablesOpened)
+		require.True(t, progress[i].Elapsed >= progress[i-1].Elapsed)
+	}
+	last := progress[len(progress)-1]
+	require.True(t, last.LogBytes > 0)
+	require.Equal(t, last.LogBytes, last.LogBytesReplayed)
+	require.Equal(t, numTables, last.Tables)
+	require.Equal(t, numTables, last.TablesOpened)
+}
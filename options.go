@@ -27,6 +27,7 @@ import (
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
 
+	"github.com/dgraph-io/badger/v3/objstore"
 	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/table"
 	"github.com/dgraph-io/badger/v3/y"
@@ -51,17 +52,27 @@ type Options struct {
 
 	SyncWrites        bool
 	NumVersionsToKeep int
+	VersionRetention  time.Duration
 	ReadOnly          bool
+	Secondary         bool
 	Logger            Logger
+	StructuredLogger  StructuredLogger
 	Compression       options.CompressionType
 	InMemory          bool
+	TempSpillDir      string
+	MemoryBudget      int64
 	MetricsEnabled    bool
+	Tracer            Tracer
+	SlowLogThreshold  time.Duration
+	OnOpenProgress    func(OpenProgress)
 	// Sets the Stream.numGo field
 	NumGoroutines int
 
 	// Fine tuning options.
 
 	MemTableSize        int64
+	MemTableShards      int
+	MemTableMmapDir     string
 	BaseTableSize       int64
 	BaseLevelSize       int64
 	LevelSizeMultiplier int
@@ -71,23 +82,63 @@ type Options struct {
 	VLogPercentile float64
 	ValueThreshold int64
 	NumMemtables   int
+	NumFlushers    int
+	NumOpenWorkers int
 	// Changing BlockSize across DB runs will not break badger. The block size is
 	// read from the block index stored at the end of the table.
 	BlockSize          int
 	BloomFalsePositive float64
+	BloomPrefixLength  int
+	FilterPolicy       table.FilterPolicy
 	BlockCacheSize     int64
 	IndexCacheSize     int64
+	FilterCacheSize    int64
+	IndexPartitionSize int
 
-	NumLevelZeroTables      int
-	NumLevelZeroTablesStall int
+	TablePropertiesCollectors []table.TablePropertiesCollectorFactory
+
+	IOBackend y.IOBackend
+	FS        y.FS
 
-	ValueLogFileSize   int64
-	ValueLogMaxEntries uint32
+	RemoteTables        string
+	RemoteTablesOptions objstore.Options
 
-	NumCompactors        int
-	CompactL0OnClose     bool
-	LmaxCompaction       bool
-	ZSTDCompressionLevel int
+	PinnedBlockCacheSize     int64
+	PinnedBlockCacheLevels   int
+	CompressedBlockCacheSize int64
+
+	NumLevelZeroTables      int
+	NumLevelZeroTablesStall int
+	MaxWriteStall           time.Duration
+
+	CommitMaxDelay      time.Duration
+	CommitMaxBatchBytes int64
+	WALSyncInterval     time.Duration
+	NumRecycledWALs     int
+	ManifestRewriteSize int64
+
+	ValueLogFileSize       int64
+	ValueLogMaxEntries     uint32
+	ValueLogGCInterval     time.Duration
+	ValueLogTargetSpaceAmp float64
+	ValueLogPunchHoles     bool
+	LargeValueDir          string
+	LargeValueThreshold    int64
+
+	NumCompactors          int
+	MaxSubcompactions      int
+	TableBuilderArenaSize  int64
+	CompactionStyle        options.CompactionStyle
+	TieredSizeRatio        int
+	CompactionGarbageRatio float64
+	TTLCompactionRatio     float64
+	ExpiryScanInterval     time.Duration
+	CompactL0OnClose       bool
+	LmaxCompaction         bool
+	MergeTinyTables        bool
+	ZSTDCompressionLevel   int
+	CompactionDirectIO     bool
+	CompactionRateLimit    int64
 
 	// When set, checksum will be validated for each entry read from the value log file.
 	VerifyValueChecksum bool
@@ -95,14 +146,24 @@ type Options struct {
 	// Encryption related options.
 	EncryptionKey                 []byte        // encryption key
 	EncryptionKeyRotationDuration time.Duration // key rotation duration
+	KeyProvider                   KeyProvider   // provider of the encryption key
+	EncryptionMode                options.EncryptionMode
 
 	// BypassLockGuard will bypass the lock guard on badger. Bypassing lock
 	// guard can cause data corruption if multiple badger instances are using
 	// the same directory. Use this options with caution.
 	BypassLockGuard bool
 
+	// RecoverManifest rebuilds the MANIFEST from the tables, if it is missing or corrupt.
+	RecoverManifest bool
+
 	// ChecksumVerificationMode decides when db should verify checksums for SSTable blocks.
 	ChecksumVerificationMode options.ChecksumVerificationMode
+	// LevelChecksumVerificationModes overrides ChecksumVerificationMode for the tables of the
+	// first len(LevelChecksumVerificationModes) levels.
+	LevelChecksumVerificationModes []options.ChecksumVerificationMode
+	// BlockChecksumAlgorithm is the algorithm used to calculate the checksums of SSTable blocks.
+	BlockChecksumAlgorithm options.ChecksumAlgorithm
 
 	// AllowStopTheWorld determines whether the DropPrefix will be blocking/non-blocking.
 	AllowStopTheWorld bool
@@ -112,6 +173,10 @@ type Options struct {
 	// conflict detection is disabled.
 	DetectConflicts bool
 
+	// ConflictDetails determines whether transactions remember the keys they read, so a
+	// conflict can be reported as a ConflictError carrying the conflicting keys.
+	ConflictDetails bool
+
 	// NamespaceOffset specifies the offset from where the next 8 bytes contains the namespace.
 	NamespaceOffset int
 
@@ -140,6 +205,7 @@ func DefaultOptions(path string) Options {
 		ValueDir: path,
 
 		MemTableSize:        64 << 20,
+		MemTableShards:      1,
 		BaseTableSize:       2 << 20,
 		BaseLevelSize:       10 << 20,
 		TableSizeMultiplier: 2,
@@ -150,9 +216,15 @@ func DefaultOptions(path string) Options {
 		AllowStopTheWorld:   true,
 
 		NumCompactors:           4, // Run at least 2 compactors. Zero-th compactor prioritizes L0.
+		MaxSubcompactions:       5,
+		CompactionStyle:         options.LeveledCompaction,
+		TieredSizeRatio:         1,
 		NumLevelZeroTables:      5,
 		NumLevelZeroTablesStall: 15,
 		NumMemtables:            15,
+		NumFlushers:             1,
+		ManifestRewriteSize:     16 << 20,
+		NumOpenWorkers:          3,
 		BloomFalsePositive:      0.01,
 		BlockSize:               4 * 1024,
 		SyncWrites:              false,
@@ -162,6 +234,7 @@ func DefaultOptions(path string) Options {
 		Compression:             options.Snappy,
 		BlockCacheSize:          256 << 20,
 		IndexCacheSize:          0,
+		FilterCacheSize:         0,
 
 		// The following benchmarks were done on a 4 KB block size (default block size). The
 		// compression is ratio supposed to increase with increasing compression level but since the
@@ -183,6 +256,9 @@ func DefaultOptions(path string) Options {
 
 		ValueLogMaxEntries: 1000000,
 
+		ValueLogTargetSpaceAmp: 2.0,
+		LargeValueThreshold:    1 << 20,
+
 		VLogPercentile: 0.0,
 		ValueThreshold: maxValueThreshold,
 
@@ -204,16 +280,36 @@ func buildTableOptions(db *DB) table.Options {
 		TableSize:            uint64(opt.BaseTableSize),
 		BlockSize:            opt.BlockSize,
 		BloomFalsePositive:   opt.BloomFalsePositive,
+		BloomPrefixLength:    opt.BloomPrefixLength,
+		FilterPolicy:         opt.FilterPolicy,
+		PropertiesCollectors: tablePropertiesCollectors(opt.TablePropertiesCollectors),
+		IndexPartitionSize:   opt.IndexPartitionSize,
 		ChkMode:              opt.ChecksumVerificationMode,
+		ChecksumAlgorithm:    opt.BlockChecksumAlgorithm,
 		Compression:          opt.Compression,
 		ZSTDCompressionLevel: opt.ZSTDCompressionLevel,
+		EncryptionMode:       opt.EncryptionMode,
 		BlockCache:           db.blockCache,
 		IndexCache:           db.indexCache,
-		AllocPool:            db.allocPool,
+		FilterCache:          db.filterCache,
+		CompressedBlockCache: db.compressedBlockCache,
+		IOBackend:            opt.IOBackend,
+		FS:                   opt.FS,
+		ArenaPool:            db.allocPool,
 		DataKey:              dk,
 	}
 }
 
+// buildLevelTableOptions returns the table options of the tables at level.
+func buildLevelTableOptions(db *DB, level int) table.Options {
+	topt := buildTableOptions(db)
+	topt.ChkMode = db.opt.checksumVerificationMode(level)
+	if db.pinnedBlockCache != nil && level < db.opt.PinnedBlockCacheLevels {
+		topt.BlockCache = db.pinnedBlockCache
+	}
+	return topt
+}
+
 const (
 	maxValueThreshold = (1 << 20) // 1 MB
 )
@@ -236,6 +332,64 @@ func LSMOnlyOptions(path string) Options {
 	return DefaultOptions(path).WithValueThreshold(maxValueThreshold /* 1 MB */)
 }
 
+// HDDOptions follows from DefaultOptions, tuned for spinning disks, where seeks are expensive.
+// Values are kept in the LSM tree, so that reading them doesn't need another seek in the value
+// log. Bigger tables and blocks mean fewer files and fewer reads per lookup, and fewer compactors
+// mean fewer concurrent streams of IO for the disk head to switch between.
+func HDDOptions(path string) Options {
+	return DefaultOptions(path).
+		WithValueThreshold(maxValueThreshold).
+		WithBaseTableSize(8 << 20).
+		WithBaseLevelSize(64 << 20).
+		WithBlockSize(16 << 10).
+		WithMemTableSize(128 << 20).
+		WithNumCompactors(2).
+		WithMaxSubcompactions(1)
+}
+
+// NVMeOptions follows from DefaultOptions, tuned for NVMe drives, which serve many concurrent
+// random reads. Values bigger than 1 KB are written to the value log, which keeps the LSM tree
+// small and makes compactions cheaper, since reading them back is fast. More compactors and
+// subcompactions use the parallelism of the drive.
+func NVMeOptions(path string) Options {
+	return DefaultOptions(path).
+		WithValueThreshold(1 << 10).
+		WithNumCompactors(8).
+		WithMaxSubcompactions(8).
+		WithNumGoroutines(16)
+}
+
+// LowMemoryOptions follows from DefaultOptions, tuned to use little memory, at the cost of
+// throughput. The memtables and caches are small, and the table indices are cached in a bounded
+// index cache instead of all being kept in memory.
+func LowMemoryOptions(path string) Options {
+	return DefaultOptions(path).
+		WithMemTableSize(16 << 20).
+		WithNumMemtables(3).
+		WithNumLevelZeroTables(3).
+		WithNumLevelZeroTablesStall(8).
+		WithBlockCacheSize(16 << 20).
+		WithIndexCacheSize(16 << 20).
+		WithValueLogFileSize(64 << 20).
+		WithNumCompactors(2).
+		WithNumGoroutines(2)
+}
+
+// BulkLoadOptions follows from DefaultOptions, tuned for loading a lot of data quickly. Big
+// memtables, and a level 0 which can grow large before writes stall, absorb the writes, while
+// conflict detection, which isn't needed by a single writer, is disabled. Level 0 is compacted
+// when the DB is closed. Once the data is loaded, the DB should be opened again with the options
+// it is served with, or tuned with DB.SetOptions.
+func BulkLoadOptions(path string) Options {
+	return DefaultOptions(path).
+		WithMemTableSize(256 << 20).
+		WithNumMemtables(5).
+		WithNumLevelZeroTables(10).
+		WithNumLevelZeroTablesStall(30).
+		WithDetectConflicts(false).
+		WithCompactL0OnClose(true)
+}
+
 // parseCompression returns badger.compressionType and compression level given compression string
 // of format compression-type:compression-level
 func parseCompression(cStr string) (options.CompressionType, int, error) {
@@ -398,6 +552,70 @@ func (opt Options) WithSyncWrites(val bool) Options {
 	return opt
 }
 
+// WithCommitMaxDelay returns a new Options value with CommitMaxDelay set to the given value.
+//
+// CommitMaxDelay sets how long the writes wait for other writes to be batched with them. Writing a
+// larger batch to disk at once amortizes the syncs with SyncWrites set, at the cost of the latency
+// of the writes. With zero, a batch is written as soon as the previous one is done.
+//
+// The default value of CommitMaxDelay is 0.
+func (opt Options) WithCommitMaxDelay(val time.Duration) Options {
+	opt.CommitMaxDelay = val
+	return opt
+}
+
+// WithCommitMaxBatchBytes returns a new Options value with CommitMaxBatchBytes set to the given
+// value.
+//
+// CommitMaxBatchBytes sets the estimated size in bytes at which a batch of writes stops taking more
+// writes, and is written as soon as the previous batch is done, even before CommitMaxDelay has
+// passed. Zero means no limit.
+//
+// The default value of CommitMaxBatchBytes is 0.
+func (opt Options) WithCommitMaxBatchBytes(val int64) Options {
+	opt.CommitMaxBatchBytes = val
+	return opt
+}
+
+// WithWALSyncInterval returns a new Options value with WALSyncInterval set to the given value.
+//
+// WALSyncInterval sets how often the WALs of the memtables, and the latest value log files, are
+// synced to disk in the background. It bounds the writes lost to a hard reboot with SyncWrites set
+// to false, without syncing every write. With SyncWrites set, the writes are synced anyway, once
+// per batch. Zero disables the background syncs.
+//
+// The default value of WALSyncInterval is 0.
+func (opt Options) WithWALSyncInterval(val time.Duration) Options {
+	opt.WALSyncInterval = val
+	return opt
+}
+
+// WithNumRecycledWALs returns a new Options value with NumRecycledWALs set to the given value.
+//
+// NumRecycledWALs sets how many WAL files of the flushed memtables are kept to be reused by the
+// new memtables, instead of being deleted. Writing over the blocks already allocated to a file
+// makes its syncs cheaper than growing a new one.
+//
+// The default value of NumRecycledWALs is 0.
+func (opt Options) WithNumRecycledWALs(val int) Options {
+	opt.NumRecycledWALs = val
+	return opt
+}
+
+// WithManifestRewriteSize returns a new Options value with ManifestRewriteSize set to the given
+// value.
+//
+// ManifestRewriteSize is the size above which the MANIFEST is rewritten with only the tables of the
+// DB, once it has grown to twice its size after the last rewrite. The MANIFEST is also rewritten
+// once most of its records are the deletions of compacted tables.
+//
+// The default value of ManifestRewriteSize is 16 MB. It is never rewritten because of its size if
+// ManifestRewriteSize is 0.
+func (opt Options) WithManifestRewriteSize(val int64) Options {
+	opt.ManifestRewriteSize = val
+	return opt
+}
+
 // WithNumVersionsToKeep returns a new Options value with NumVersionsToKeep set to the given value.
 //
 // NumVersionsToKeep sets how many versions to keep per key at most.
@@ -408,6 +626,23 @@ func (opt Options) WithNumVersionsToKeep(val int) Options {
 	return opt
 }
 
+// WithVersionRetention returns a new Options value with VersionRetention set to the given value.
+//
+// VersionRetention sets for how long all the versions of a key are kept, irrespective of
+// NumVersionsToKeep. Compactions only discard the versions committed more than VersionRetention
+// ago, keeping NumVersionsToKeep of them as usual, which includes the version which was current at
+// that time. Deleted and expired keys are kept around for VersionRetention as well.
+//
+// The time of commit is tracked in memory, so all the versions present when the DB is opened are
+// retained for VersionRetention after that. VersionRetention is ignored in managed mode, where
+// SetDiscardTs should be used instead.
+//
+// The default value of VersionRetention is 0, which disables it.
+func (opt Options) WithVersionRetention(val time.Duration) Options {
+	opt.VersionRetention = val
+	return opt
+}
+
 // WithNumGoroutines sets the number of goroutines to be used in Stream.
 //
 // The default value of NumGoroutines is 8.
@@ -429,6 +664,21 @@ func (opt Options) WithReadOnly(val bool) Options {
 	return opt
 }
 
+// WithSecondary returns a new Options value with Secondary set to the given value.
+//
+// When Secondary is true the DB is opened in read-only mode without locking its directories, so it
+// can be opened while another process has it opened read-write. The DB is read as it was when it
+// was opened: DB.CatchUp reads the MANIFEST, memtables and value log files again to see the writes
+// done since. This allows reading a live DB from another process without copying it. The options
+// which size the files, like MemTableSize and ValueLogFileSize, must be the same as the ones of the
+// process which opened the DB read-write.
+//
+// The default value of Secondary is false.
+func (opt Options) WithSecondary(val bool) Options {
+	opt.Secondary = val
+	return opt
+}
+
 // WithMetricsEnabled returns a new Options value with MetricsEnabled set to the given value.
 //
 // When MetricsEnabled is set to false, then the DB will be opened and no badger metrics
@@ -454,13 +704,63 @@ func (opt Options) WithLogger(val Logger) Options {
 	return opt
 }
 
+// WithTracer returns a new Options value with Tracer set to the given value.
+//
+// Tracer starts the spans around transaction commits, gets, value log reads, iterator prefetches
+// and compactions. The spans of gets have an event for each memtable and level looked up, so that
+// slow gets can be attributed to a level. The module github.com/dgraph-io/badger/v3/tracing
+// provides a Tracer using an OpenTelemetry TracerProvider.
+//
+// The default value of Tracer is nil, which disables the tracing.
+func (opt Options) WithTracer(val Tracer) Options {
+	opt.Tracer = val
+	return opt
+}
+
+// WithStructuredLogger returns a new Options value with StructuredLogger set to the given value.
+//
+// StructuredLogger is used for the logs of the compactions, the flushes and the value log GC, which
+// have machine-readable fields. The module github.com/dgraph-io/badger/v3/logging provides
+// adapters for zap and slog.
+//
+// The default value of StructuredLogger is nil, in which case these logs are written to Logger,
+// with their fields formatted as key=value pairs.
+func (opt Options) WithStructuredLogger(val StructuredLogger) Options {
+	opt.StructuredLogger = val
+	return opt
+}
+
+// WithOnOpenProgress returns a new Options value with OnOpenProgress set to the given value.
+//
+// OnOpenProgress is called while the DB is opened, after each write-ahead log replayed and each
+// table opened, with the progress of the open. It is called by one goroutine at a time, and must
+// not block for long.
+//
+// The default value of OnOpenProgress is nil.
+func (opt Options) WithOnOpenProgress(val func(OpenProgress)) Options {
+	opt.OnOpenProgress = val
+	return opt
+}
+
+// WithSlowLogThreshold returns a new Options value with SlowLogThreshold set to the given value.
+//
+// SlowLogThreshold is the duration above which gets, commits, flushes and compactions are recorded
+// in the slow log, retrievable with DB.SlowLog. The gets are recorded with the time spent in each
+// memtable and level looked up.
+//
+// The default value of SlowLogThreshold is 0, which disables the slow log.
+func (opt Options) WithSlowLogThreshold(val time.Duration) Options {
+	opt.SlowLogThreshold = val
+	return opt
+}
+
 // WithLoggingLevel returns a new Options value with logging level of the
 // default logger set to the given value.
 // LoggingLevel sets the level of logging. It should be one of DEBUG, INFO,
 // WARNING or ERROR levels.
 //
 // The default value of LoggingLevel is INFO.
-func (opt Options) WithLoggingLevel(val loggingLevel) Options {
+func (opt Options) WithLoggingLevel(val LogLevel) Options {
 	opt.Logger = defaultLogger(val)
 	return opt
 }
@@ -536,6 +836,32 @@ func (opt Options) WithNumMemtables(val int) Options {
 	return opt
 }
 
+// WithNumOpenWorkers returns a new Options value with NumOpenWorkers set to the given value.
+//
+// NumOpenWorkers sets the number of goroutines opening the tables, and verifying their checksums
+// if ChecksumVerificationMode requires it, and replaying the write-ahead logs of the memtables when
+// the DB is opened. More workers help to open a big DB on fast disks, or on disks with a high
+// latency.
+//
+// The default value of NumOpenWorkers is 3.
+func (opt Options) WithNumOpenWorkers(val int) Options {
+	opt.NumOpenWorkers = val
+	return opt
+}
+
+// WithNumFlushers returns a new Options value with NumFlushers set to the given value.
+//
+// NumFlushers sets the number of goroutines flushing the immutable memtables to L0 concurrently.
+// The tables are still added to L0 in the order of the memtables. More flushers help to clear a
+// backlog of memtables after a burst of writes, which would otherwise stall the writes once
+// NumMemtables is reached.
+//
+// The default value of NumFlushers is 1.
+func (opt Options) WithNumFlushers(val int) Options {
+	opt.NumFlushers = val
+	return opt
+}
+
 // WithMemTableSize returns a new Options value with MemTableSize set to the given value.
 //
 // MemTableSize sets the maximum size in bytes for memtable table.
@@ -546,6 +872,44 @@ func (opt Options) WithMemTableSize(val int64) Options {
 	return opt
 }
 
+// WithMemTableShards returns a new Options value with MemTableShards set to the given value.
+//
+// MemTableShards sets the number of skiplists a memtable is split into, by the hash of the keys.
+// The shards of a large write batch are filled concurrently, so that writes can make use of
+// multiple cores. The memtable is full once any of its shards reaches MemTableSize divided by
+// MemTableShards, as its shards share a WAL. Every shard is then flushed into its own L0 table,
+// and the shards are flushed concurrently, up to NumFlushers at a time. Since a flush adds up to
+// MemTableShards tables to L0, NumLevelZeroTables and NumLevelZeroTablesStall should be raised
+// along with it. A transaction with EnableAutoChunking must fit in one shard.
+//
+// Every shard has its own arena, which leaves room for a whole write batch on top of its share of
+// MemTableSize, as all the entries of a batch could go to the same shard. A batch takes up to
+// about 15% of MemTableSize, plus as much for the nodes of its entries, so the arenas of a
+// memtable take about MemTableSize * (1 + 0.3 * MemTableShards), instead of 1.3 * MemTableSize
+// with a single shard. The arenas are allocated up front, in the Go heap unless MemTableMmapDir
+// is set.
+//
+// The default value of MemTableShards is 1.
+func (opt Options) WithMemTableShards(val int) Options {
+	opt.MemTableShards = val
+	return opt
+}
+
+// WithMemTableMmapDir returns a new Options value with MemTableMmapDir set to the given value.
+//
+// MemTableMmapDir is the directory the arenas of the skiplists of the memtables are
+// memory-mapped from, instead of being allocated in the Go heap. This keeps the memtables out of
+// the Go heap, and lets the OS page them out. The files are only scratch space, the memtables
+// being recovered from their WAL. They are deleted once the memtables are flushed, and the ones
+// left by a crash are removed when the DB is opened. MemTableMmapDir must not be used by another
+// DB at the same time.
+//
+// The default value of MemTableMmapDir is "", which allocates the arenas in the Go heap.
+func (opt Options) WithMemTableMmapDir(dir string) Options {
+	opt.MemTableMmapDir = dir
+	return opt
+}
+
 // WithBloomFalsePositive returns a new Options value with BloomFalsePositive set
 // to the given value.
 //
@@ -562,6 +926,58 @@ func (opt Options) WithBloomFalsePositive(val float64) Options {
 	return opt
 }
 
+// WithBloomPrefixLength returns a new Options value with BloomPrefixLength set to the given value.
+//
+// BloomPrefixLength sets the length of the key prefixes which are added to the bloom filter of
+// every SSTable, along with the whole keys. Iterators with a Prefix at least this long skip the
+// tables whose bloom filter says they don't have the prefix, instead of opening every table
+// which overlaps with it. This works best when the prefix scans use a fixed length prefix, e.g.,
+// a tenant or table ID, and BloomPrefixLength is set to that length.
+//
+// Tables built with a different BloomPrefixLength, or before it was set, are still read
+// correctly, but only tables built with a BloomPrefixLength no longer than the Prefix of an
+// iterator can be skipped by it.
+//
+// The default value of BloomPrefixLength is 0 which means only whole keys are added to the bloom
+// filters.
+func (opt Options) WithBloomPrefixLength(val int) Options {
+	opt.BloomPrefixLength = val
+	return opt
+}
+
+// WithFilterPolicy returns a new Options value with FilterPolicy set to the given value.
+//
+// FilterPolicy sets the kind of filters built for the SSTables, which are checked for key
+// existence before reading a key from a table. table.XorFilterPolicy builds xor filters, which
+// use less memory than Bloom filters for the same false positive rate, at the cost of slower
+// table builds. The false positive rate is set via BloomFalsePositive for all the policies.
+//
+// Changing FilterPolicy across DB runs will not break badger. Every table records the policy it
+// was built with, so existing tables keep using their filters until they are compacted. A custom
+// FilterPolicy has to be set again when the DB is reopened, so the tables built with it can use
+// their filters.
+//
+// The default value of FilterPolicy is nil which means Bloom filters are used.
+func (opt Options) WithFilterPolicy(val table.FilterPolicy) Options {
+	opt.FilterPolicy = val
+	return opt
+}
+
+// WithTablePropertiesCollectors returns a new Options value with TablePropertiesCollectors set to
+// the given value.
+//
+// TablePropertiesCollectors are called to create a collector for every SSTable built, be it by a
+// memtable flush, a compaction or a stream writer. The collectors see every key added to the
+// table and return custom properties, e.g., the number of entries of every tenant, which are
+// stored in the table and returned by DB.Tables in TableInfo.Properties.
+//
+// The default value of TablePropertiesCollectors is nil.
+func (opt Options) WithTablePropertiesCollectors(
+	collectors ...table.TablePropertiesCollectorFactory) Options {
+	opt.TablePropertiesCollectors = collectors
+	return opt
+}
+
 // WithBlockSize returns a new Options value with BlockSize set to the given value.
 //
 // BlockSize sets the size of any block in SSTable. SSTable is divided into multiple blocks
@@ -590,6 +1006,21 @@ func (opt Options) WithNumLevelZeroTablesStall(val int) Options {
 	return opt
 }
 
+// WithMaxWriteStall returns a new Options value with MaxWriteStall set to the given value.
+//
+// MaxWriteStall sets for how long the writes wait for room in the memtables while they are
+// stalled, e.g., because level 0 has NumLevelZeroTablesStall tables and the memtables can't be
+// flushed. The writes stalled for longer fail with a StallError, which is an ErrStalled, so that
+// the callers can shed load instead of piling up. The stall is measured from when it began, so
+// the writes which come later fail right away for as long as it lasts. Zero means the writes wait
+// for as long as the stall lasts.
+//
+// The default value of MaxWriteStall is 0.
+func (opt Options) WithMaxWriteStall(val time.Duration) Options {
+	opt.MaxWriteStall = val
+	return opt
+}
+
 // WithBaseLevelSize sets the maximum size target for the base level.
 //
 // The default value is 10MB.
@@ -616,6 +1047,78 @@ func (opt Options) WithValueLogMaxEntries(val uint32) Options {
 	return opt
 }
 
+// WithValueLogGCInterval returns a new Options value with ValueLogGCInterval set to the given
+// value.
+//
+// ValueLogGCInterval sets how often Badger checks the space amplification of the value log, as
+// estimated from the discard stats collected during compactions. If it is above
+// ValueLogTargetSpaceAmp, value log files are garbage collected until it is back within the
+// target, or no more files can be rewritten. This removes the need to call RunValueLogGC
+// periodically.
+//
+// The default value of ValueLogGCInterval is 0, which disables scheduled value log GC.
+func (opt Options) WithValueLogGCInterval(val time.Duration) Options {
+	opt.ValueLogGCInterval = val
+	return opt
+}
+
+// WithValueLogTargetSpaceAmp returns a new Options value with ValueLogTargetSpaceAmp set to the
+// given value.
+//
+// ValueLogTargetSpaceAmp is the ratio of the size of the value log to the size of the live data in
+// it, above which scheduled value log GC rewrites files. It must be greater than 1. Lower values
+// reclaim more space at the cost of more rewrites. It is only used if ValueLogGCInterval is set.
+//
+// The default value of ValueLogTargetSpaceAmp is 2.
+func (opt Options) WithValueLogTargetSpaceAmp(val float64) Options {
+	opt.ValueLogTargetSpaceAmp = val
+	return opt
+}
+
+// WithValueLogPunchHoles returns a new Options value with ValueLogPunchHoles set to the given
+// value.
+//
+// When ValueLogPunchHoles is set, value log GC reclaims the space of the discarded values by
+// punching holes in the value log files, instead of moving the live entries to a new file. This
+// avoids rewriting large values which are still live, at the cost of keeping the value log files
+// around. Only the values spanning at least a whole 4KB block can be punched out, so it is mostly
+// useful for large values. It requires a filesystem supporting fallocate(FALLOC_FL_PUNCH_HOLE),
+// like ext4 or XFS on Linux. Otherwise, the files are rewritten as usual. The entries are marked
+// in the files before their values are punched out, so that the holes are told apart from the
+// values zeroed out by a torn write, which are reported as corrupted.
+//
+// The default value of ValueLogPunchHoles is false.
+func (opt Options) WithValueLogPunchHoles(b bool) Options {
+	opt.ValueLogPunchHoles = b
+	return opt
+}
+
+// WithLargeValueDir returns a new Options value with LargeValueDir set to the given value.
+//
+// LargeValueDir is the path of the directory where the large values are stored, in value log
+// files of their own. The values of size at least LargeValueThreshold are written there, while the
+// smaller ones are stored in ValueDir as usual. This allows storing large blobs on cheaper and
+// slower storage, and keeping the rest of the data on fast storage. Reads are routed to the right
+// directory transparently. LargeValueDir must be different from Dir and ValueDir.
+//
+// The default value of LargeValueDir is "", which stores all the values in ValueDir.
+func (opt Options) WithLargeValueDir(val string) Options {
+	opt.LargeValueDir = val
+	return opt
+}
+
+// WithLargeValueThreshold returns a new Options value with LargeValueThreshold set to the given
+// value.
+//
+// LargeValueThreshold sets the minimum size of the values stored in LargeValueDir. It is only used
+// if LargeValueDir is set.
+//
+// The default value of LargeValueThreshold is 1 MB.
+func (opt Options) WithLargeValueThreshold(val int64) Options {
+	opt.LargeValueThreshold = val
+	return opt
+}
+
 // WithNumCompactors sets the number of compaction workers to run concurrently.  Setting this to
 // zero stops compactions, which could eventually cause writes to block forever.
 //
@@ -625,6 +1128,94 @@ func (opt Options) WithNumCompactors(val int) Options {
 	return opt
 }
 
+// WithMaxSubcompactions sets the maximum number of key ranges a single compaction is split into.
+// The key ranges are compacted in parallel and their tables are added together to the next level,
+// so that a compaction of a few huge tables doesn't run on a single goroutine. Setting this to 0 or
+// 1 compacts the whole key range on one goroutine.
+//
+// The default value of MaxSubcompactions is 5.
+func (opt Options) WithMaxSubcompactions(val int) Options {
+	opt.MaxSubcompactions = val
+	return opt
+}
+
+// WithTableBuilderArenaSize returns a new Options value with TableBuilderArenaSize set to the given
+// value.
+//
+// TableBuilderArenaSize caps the memory of the allocators the table builders of the flushes and
+// the concurrent compactions and subcompactions share. The builders reuse the idle allocators,
+// smallest first, and once the cap is reached, the idle allocators are released and the new
+// builders wait for the running ones to finish, which bounds the peak memory of heavy
+// compactions. The cap is soft: a builder which waits for more than a second allocates over it.
+// The allocators are accounted with their initial sizes while they are used, and their growth is
+// accounted once their builders finish.
+//
+// The default value of TableBuilderArenaSize is 0, which doesn't cap the memory.
+func (opt Options) WithTableBuilderArenaSize(val int64) Options {
+	opt.TableBuilderArenaSize = val
+	return opt
+}
+
+// WithCompactionStyle sets the compaction style of the DB. With options.TieredCompaction, every
+// level is a single sorted run. L0 is merged into the first non-empty level when it has about the
+// same size, or moved to the empty level above it otherwise, and a level is merged into the next
+// one only when it has about the same size, as set by TieredSizeRatio. This writes the data much
+// fewer times than options.LeveledCompaction, at the cost of more tables to read in lookups and
+// iterations.
+//
+// The default value of CompactionStyle is options.LeveledCompaction.
+func (opt Options) WithCompactionStyle(style options.CompactionStyle) Options {
+	opt.CompactionStyle = style
+	return opt
+}
+
+// WithTieredSizeRatio sets the size ratio, in percent, used by options.TieredCompaction. Two sorted
+// runs are merged if the size of the older run is at most (100 + TieredSizeRatio)% of the size of
+// the newer one.
+//
+// The default value of TieredSizeRatio is 1.
+func (opt Options) WithTieredSizeRatio(val int) Options {
+	opt.TieredSizeRatio = val
+	return opt
+}
+
+// WithCompactionGarbageRatio sets the fraction of garbage, which makes a level worth compacting
+// even if it is within its target size. The garbage of a table is estimated from its stale data
+// and its delete markers, along with the data they shadow in the levels below. When set, the
+// compactions also pick the tables with the most garbage first, so that deletes free the disk
+// space sooner. Setting this to 0 disables it.
+//
+// The default value of CompactionGarbageRatio is 0.
+func (opt Options) WithCompactionGarbageRatio(val float64) Options {
+	opt.CompactionGarbageRatio = val
+	return opt
+}
+
+// WithTTLCompactionRatio enables the compactions of the expired entries. When set, the tables whose
+// entries have all expired are deleted without being rewritten, as long as no older versions of
+// their keys are in the levels below. The tables with at least this fraction of expired keys are
+// compacted, even if their level is within its target size. Setting this to 0 disables it.
+//
+// The default value of TTLCompactionRatio is 0.
+func (opt Options) WithTTLCompactionRatio(val float64) Options {
+	opt.TTLCompactionRatio = val
+	return opt
+}
+
+// WithExpiryScanInterval returns a new Options value with ExpiryScanInterval set to the given
+// value.
+//
+// ExpiryScanInterval makes Badger index the keys written with an expiry by their ExpiresAt, and
+// delete the expired ones at each interval, instead of leaving them to the compactions.
+// The deleted keys are reported to the OnExpired event listeners. Only the keys written by
+// transactions while it is set are indexed. It has no effect in managed mode.
+//
+// The default value of ExpiryScanInterval is 0, which disables the expiry index.
+func (opt Options) WithExpiryScanInterval(val time.Duration) Options {
+	opt.ExpiryScanInterval = val
+	return opt
+}
+
 // WithCompactL0OnClose determines whether Level 0 should be compacted before closing the DB.  This
 // ensures that both reads and writes are efficient when the DB is opened later.
 //
@@ -634,6 +1225,18 @@ func (opt Options) WithCompactL0OnClose(val bool) Options {
 	return opt
 }
 
+// WithMergeTinyTables determines whether runs of adjacent tiny tables within a level should be
+// merged into bigger tables in the background, without compacting them to the next level. Tiny
+// tables are typically created by small flushes, and each of them adds to the per table overhead
+// and the number of iterators needed to read a level. The merge only runs when the compactors are
+// otherwise idle.
+//
+// The default value of MergeTinyTables is false.
+func (opt Options) WithMergeTinyTables(val bool) Options {
+	opt.MergeTinyTables = val
+	return opt
+}
+
 // WithEncryptionKey is used to encrypt the data with AES. Type of AES is used based on the key
 // size. For example 16 bytes will use AES-128. 24 bytes will use AES-192. 32 bytes will
 // use AES-256.
@@ -642,6 +1245,43 @@ func (opt Options) WithEncryptionKey(key []byte) Options {
 	return opt
 }
 
+// WithKeyProvider returns a new Options value with KeyProvider set to the given value.
+//
+// KeyProvider provides the master key encrypting the data keys, in place of EncryptionKey, so that
+// it can be kept in a KMS, Vault or an HSM instead of in a file next to the DB. The master key is
+// fetched when the DB is opened, and the key registry is re-encrypted with its current version
+// when it was rotated, which is checked whenever a new data key is created. DB.RotateMasterKey
+// rotates it.
+//
+// A DB encrypted with EncryptionKey is switched to the KeyProvider by opening it with both of
+// them, and an unencrypted DB is encrypted by opening it with the KeyProvider.
+//
+// The default value of KeyProvider is nil.
+func (opt Options) WithKeyProvider(val KeyProvider) Options {
+	opt.KeyProvider = val
+	return opt
+}
+
+// WithEncryptionMode returns a new Options value with EncryptionMode set to the given value.
+//
+// EncryptionMode is how the table blocks and the value log entries are encrypted. options.AESGCM
+// authenticates them, so that their tampering is detected when they are read, at the cost of 16
+// more bytes per block and entry. The mode can be changed when the DB is reopened: the tables
+// written by the compactions and the new value log files use the new mode, while the older ones
+// are still read with the mode they were written with.
+//
+// The default value of EncryptionMode is options.AESCTR.
+func (opt Options) WithEncryptionMode(val options.EncryptionMode) Options {
+	opt.EncryptionMode = val
+	return opt
+}
+
+// encrypted returns true if the data is encrypted, with EncryptionKey or the master key of the
+// KeyProvider.
+func (opt *Options) encrypted() bool {
+	return len(opt.EncryptionKey) > 0 || opt.KeyProvider != nil
+}
+
 // WithEncryptionKeyRotationDuration returns new Options value with the duration set to
 // the given value.
 //
@@ -665,6 +1305,8 @@ func (opt Options) WithCompression(cType options.CompressionType) Options {
 // WithVerifyValueChecksum is used to set VerifyValueChecksum. When VerifyValueChecksum is set to
 // true, checksum will be verified for every entry read from the value log. If the value is stored
 // in SST (value size less than value threshold) then the checksum validation will not be done.
+// A corrupted value is reported by a *ValueChecksumError, which identifies the value log file and
+// the offset of the corrupted entry.
 //
 // The default value of VerifyValueChecksum is False.
 func (opt Options) WithVerifyValueChecksum(val bool) Options {
@@ -683,6 +1325,48 @@ func (opt Options) WithChecksumVerificationMode(cvMode options.ChecksumVerificat
 	return opt
 }
 
+// WithLevelChecksumVerificationModes returns a new Options value with
+// LevelChecksumVerificationModes set to the given value.
+//
+// LevelChecksumVerificationModes sets the checksum verification mode of the tables of every level,
+// starting from level 0. The levels without a mode use ChecksumVerificationMode. For example,
+// setting options.OnBlockRead for the first two levels and options.OnCompactionRead for the rest
+// verifies the blocks of the small, frequently compacted levels on every read, while the blocks of
+// the bigger levels are only verified when they are compacted. A table uses the mode of the level
+// it is written to, or of the level it is in when the DB is opened.
+//
+// The default value of LevelChecksumVerificationModes is nil.
+func (opt Options) WithLevelChecksumVerificationModes(
+	modes ...options.ChecksumVerificationMode) Options {
+	opt.LevelChecksumVerificationModes = modes
+	return opt
+}
+
+// checksumVerificationMode returns the checksum verification mode of the tables at level.
+func (opt *Options) checksumVerificationMode(level int) options.ChecksumVerificationMode {
+	if level >= 0 && level < len(opt.LevelChecksumVerificationModes) {
+		return opt.LevelChecksumVerificationModes[level]
+	}
+	return opt.ChecksumVerificationMode
+}
+
+// WithBlockChecksumAlgorithm returns a new Options value with BlockChecksumAlgorithm set to the
+// given value.
+//
+// BlockChecksumAlgorithm sets the algorithm used to calculate the checksums of SSTable blocks.
+// options.XXHash64 can be used instead of options.CRC32C, and options.NoChecksum stores no
+// checksum at all, so the blocks are never verified. The table indices always have a CRC32C
+// checksum.
+//
+// Changing BlockChecksumAlgorithm across DB runs will not break badger. Every block records the
+// algorithm of its checksum.
+//
+// The default value of BlockChecksumAlgorithm is options.CRC32C.
+func (opt Options) WithBlockChecksumAlgorithm(algo options.ChecksumAlgorithm) Options {
+	opt.BlockChecksumAlgorithm = algo
+	return opt
+}
+
 // WithAllowStopTheWorld returns a new Options value with AllowStopTheWorld set to the given value.
 //
 // AllowStopTheWorld indicates whether the call to DropPrefix should block the writes or not.
@@ -721,6 +1405,46 @@ func (opt Options) WithInMemory(b bool) Options {
 	return opt
 }
 
+// WithTempSpillDir returns a new Options value with TempSpillDir set to the given value.
+//
+// TempSpillDir is the directory the tables of the levels below level 0 are temporarily written to
+// in InMemory mode, once the tables kept in memory exceed MemoryBudget. The memtables and the level
+// 0 tables always stay in memory. This bounds the memory used by a large InMemory DB, while keeping
+// most reads from memory.
+//
+// The spilled tables are only a temporary extension of the memory, not a way to persist the DB:
+// they aren't in a MANIFEST, so like the rest of an InMemory DB, they are lost when the DB is
+// closed or crashes. The DB removes them when it's closed, and the ones left by a crash when it's
+// opened again. TempSpillDir must thus hold nothing but the tables spilled by the DB, and not be
+// used by another DB at the same time, which its lock file prevents.
+//
+// The default value of TempSpillDir is "", which keeps all the tables in memory.
+func (opt Options) WithTempSpillDir(dir string) Options {
+	opt.TempSpillDir = dir
+	return opt
+}
+
+// WithMemoryBudget returns a new Options value with MemoryBudget set to the given value.
+//
+// MemoryBudget is a soft limit on the memory used by the memtables, the block, index and filter
+// caches and the value buffers of the iterators. Close to the
+// budget, the memtable is flushed before it is full and the caches are shrunk, down to 1/16th of
+// their sizes. Over the budget, the writes also wait for the memtables being flushed, instead of
+// filling new ones. The caches grow back once the memory used is below 3/4 of the budget. The
+// memory accounted is returned by DB.MemoryUsage.
+//
+// In InMemory mode, MemoryBudget is also the size of the tables kept in memory, after which the
+// new tables of the levels below level 0 are written to TempSpillDir, if it is set. That size is
+// separate from the memory limited above, and can be exceeded by the level 0 tables and by the
+// tables of one compaction.
+//
+// The default value of MemoryBudget is 0, which doesn't limit the memory, and writes all the
+// tables below level 0 to TempSpillDir in InMemory mode.
+func (opt Options) WithMemoryBudget(budget int64) Options {
+	opt.MemoryBudget = budget
+	return opt
+}
+
 // WithZSTDCompressionLevel returns a new Options value with ZSTDCompressionLevel set
 // to the given value.
 //
@@ -758,6 +1482,23 @@ func (opt Options) WithBypassLockGuard(b bool) Options {
 	return opt
 }
 
+// WithRecoverManifest returns a new Options value with RecoverManifest set to the given value.
+//
+// When RecoverManifest is set, Open rebuilds the MANIFEST from the footers of the tables if it is
+// missing, or if it can't be read, like Repair with RebuildManifest does. The tables which can't
+// be read are moved to the "quarantine" directory of the DB. The rebuilt MANIFEST puts the tables
+// which don't overlap any other in the last level, and the other ones in level 0, so it may bring
+// back the tables which were compacted, but not deleted yet, and the older versions of their keys.
+//
+// Without RecoverManifest, Open fails with ErrManifestMissing if the MANIFEST is missing but the
+// directory has tables, and with the error reading it if it is corrupt.
+//
+// The default value of RecoverManifest is false.
+func (opt Options) WithRecoverManifest(b bool) Options {
+	opt.RecoverManifest = b
+	return opt
+}
+
 // WithIndexCacheSize returns a new Options value with IndexCacheSize set to
 // the given value.
 //
@@ -776,6 +1517,167 @@ func (opt Options) WithIndexCacheSize(size int64) Options {
 	return opt
 }
 
+// WithCompactionDirectIO returns a new Options value with CompactionDirectIO set to the given
+// value.
+//
+// When set, compactions read and write the tables with O_DIRECT, bypassing the page cache. This
+// way, heavy compactions don't evict the hot pages of the mmap'ed tables, at the cost of slower
+// compactions. It is ignored on platforms other than Linux, on file systems which don't support
+// O_DIRECT, and in InMemory mode.
+//
+// The default value of CompactionDirectIO is false.
+func (opt Options) WithCompactionDirectIO(b bool) Options {
+	opt.CompactionDirectIO = b
+	return opt
+}
+
+// WithCompactionRateLimit returns a new Options value with CompactionRateLimit set to the given
+// value.
+//
+// CompactionRateLimit is the number of bytes per second the compactions can write, across all the
+// compactors. Limiting it leaves more disk bandwidth to the reads and the memtable flushes, at the
+// cost of compactions lagging behind heavy writes, which can stall them. It can be changed while
+// the DB is open, with DB.SetOptions.
+//
+// The default value of CompactionRateLimit is 0, which means the rate isn't limited.
+func (opt Options) WithCompactionRateLimit(bytesPerSec int64) Options {
+	opt.CompactionRateLimit = bytesPerSec
+	return opt
+}
+
+// WithIOBackend returns a new Options value with IOBackend set to the given value.
+//
+// If set, the table blocks and the value log entries are read via the IO backend (see
+// y.NewIOBackend), instead of the mmap'ed files. The io_uring backend submits the reads of
+// concurrent readers, like an iterator prefetching values, together. The backend is not closed
+// by the DB.
+//
+// The default value of IOBackend is nil, which means the mmap'ed files are read.
+func (opt Options) WithIOBackend(backend y.IOBackend) Options {
+	opt.IOBackend = backend
+	return opt
+}
+
+// WithFS returns a new Options value with FS set to the given value.
+//
+// FS is the file system the files of the DB are kept in, Dir and ValueDir being paths in it. With
+// y.NewMemFS, the files are kept in memory, but they're written and replayed like on disk, which
+// lets the tests reopen a DB, or fail the file operations, without touching the disk. The
+// directories are only locked on the file system of the OS.
+//
+// The default value of FS is nil, which means the file system of the OS is used.
+func (opt Options) WithFS(val y.FS) Options {
+	opt.FS = val
+	return opt
+}
+
+// WithRemoteTables returns a new Options value with RemoteTables set to the given value.
+//
+// RemoteTables is an object storage URL, like s3://bucket/path, under which the compactions write
+// the tables of the last level, which hold most of the data and are the least read. Only the
+// index of these tables is kept in their local file, while their blocks are read from object
+// storage, and cached in the block cache. The MANIFEST records the URL of every remote table, so
+// the tables already written are still read from there if RemoteTables changes. The objects are
+// deleted with their tables, so the path must not be shared with another DB.
+//
+// The default value of RemoteTables is "", which means all the tables are kept on disk.
+func (opt Options) WithRemoteTables(rawurl string) Options {
+	opt.RemoteTables = rawurl
+	return opt
+}
+
+// WithRemoteTablesOptions returns a new Options value with RemoteTablesOptions set to the given
+// value.
+//
+// RemoteTablesOptions are the options of the object storage client the remote tables are written,
+// read and deleted with (see WithRemoteTables).
+//
+// The default value of RemoteTablesOptions is the zero value, which has no credentials.
+// objstore.DefaultOptions reads them from the environment.
+func (opt Options) WithRemoteTablesOptions(val objstore.Options) Options {
+	opt.RemoteTablesOptions = val
+	return opt
+}
+
+// WithPinnedBlockCacheSize returns a new Options value with PinnedBlockCacheSize set to the
+// given value.
+//
+// The blocks of the tables in the top PinnedBlockCacheLevels levels, which hold the most
+// recently written data, are cached in a cache of this size instead of the block cache. This
+// way, reads and scans of the lower levels can't evict them. The table indices and bloom
+// filters have caches of their own, see WithIndexCacheSize and WithFilterCacheSize.
+//
+// The default value of PinnedBlockCacheSize is 0, which means those blocks are cached in the
+// block cache.
+func (opt Options) WithPinnedBlockCacheSize(size int64) Options {
+	opt.PinnedBlockCacheSize = size
+	return opt
+}
+
+// WithPinnedBlockCacheLevels returns a new Options value with PinnedBlockCacheLevels set to the
+// given value.
+//
+// The blocks of the tables in the top PinnedBlockCacheLevels levels are cached in the pinned
+// block cache (see WithPinnedBlockCacheSize). Iterators with IteratorOptions.Scan set still
+// add the blocks of these levels to the cache.
+//
+// The default value of PinnedBlockCacheLevels is 0.
+func (opt Options) WithPinnedBlockCacheLevels(levels int) Options {
+	opt.PinnedBlockCacheLevels = levels
+	return opt
+}
+
+// WithCompressedBlockCacheSize returns a new Options value with CompressedBlockCacheSize set to
+// the given value.
+//
+// This value specifies how much memory should be used to cache compressed blocks, after
+// decryption. On a block cache miss, a block found in this cache only has to be decompressed,
+// instead of being read from the file and decrypted. Since compressed blocks are smaller, a
+// small block cache combined with a large compressed block cache holds more blocks in the same
+// memory, at the cost of decompressing them more often. Blocks of tables which are neither
+// compressed nor encrypted aren't stored in it.
+//
+// The default value of CompressedBlockCacheSize is 0, which means the cache is disabled.
+func (opt Options) WithCompressedBlockCacheSize(size int64) Options {
+	opt.CompressedBlockCacheSize = size
+	return opt
+}
+
+// WithFilterCacheSize returns a new Options value with FilterCacheSize set to
+// the given value.
+//
+// This value specifies how much memory should be used to cache the bloom filters
+// of encrypted tables, separately from the index cache. This way, the filters
+// don't get evicted by the block offsets of large tables. The filters of tables
+// which aren't encrypted are read directly from the mmap'ed table.
+//
+// Zero value for FilterCacheSize means the filters are read from the table
+// indices, and are cached with them in the index cache.
+//
+// The default value of FilterCacheSize is 0.
+func (opt Options) WithFilterCacheSize(size int64) Options {
+	opt.FilterCacheSize = size
+	return opt
+}
+
+// WithIndexPartitionSize returns a new Options value with IndexPartitionSize set to
+// the given value.
+//
+// IndexPartitionSize sets the number of block offsets stored in each partition of a table index.
+// Tables with more blocks than this store their block offsets in partitions, which are read on
+// demand and cached in the index cache, instead of in the index itself. This keeps the memory
+// used by the indices of very large tables small, at the cost of an extra lookup when a
+// partition is not cached.
+//
+// Changing IndexPartitionSize across DB runs will not break badger. It only applies to the tables
+// built afterwards.
+//
+// The default value of IndexPartitionSize is 0 which means the indices are never partitioned.
+func (opt Options) WithIndexPartitionSize(val int) Options {
+	opt.IndexPartitionSize = val
+	return opt
+}
+
 // WithDetectConflicts returns a new Options value with DetectConflicts set to the given value.
 //
 // Detect conflicts options determines if the transactions would be checked for
@@ -790,6 +1692,20 @@ func (opt Options) WithDetectConflicts(b bool) Options {
 	return opt
 }
 
+// WithConflictDetails returns a new Options value with ConflictDetails set to the given value.
+//
+// When ConflictDetails is set to true, update transactions keep a copy of every key they read, in
+// addition to its fingerprint. If such a transaction fails to commit due to a conflict, the
+// returned error is a *ConflictError containing the keys which caused the conflict. The error
+// still matches ErrConflict via errors.Is. This option adds memory overhead to every update
+// transaction, so it is meant for debugging contention issues.
+//
+// The default value of ConflictDetails is false.
+func (opt Options) WithConflictDetails(b bool) Options {
+	opt.ConflictDetails = b
+	return opt
+}
+
 // WithNamespaceOffset returns a new Options value with NamespaceOffset set to the given value. DB
 // will expect the namespace in each key at the 8 bytes starting from NamespaceOffset. A negative
 // value means that namespace is not stored in the key.
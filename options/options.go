@@ -29,6 +29,22 @@ const (
 	// OnTableAndBlockRead indicates checksum should be verified
 	// on SSTable opening and on every block read.
 	OnTableAndBlockRead
+	// OnCompactionRead indicates checksum should be verified only for the SSTable blocks read by
+	// compactions, including the blocks found in the block cache. Lookups and iterators don't
+	// verify any checksum.
+	OnCompactionRead
+)
+
+// ChecksumAlgorithm specifies the algorithm used to calculate the checksum of SSTable blocks.
+type ChecksumAlgorithm uint32
+
+const (
+	// CRC32C indicates that the checksum is calculated using CRC32 with the Castagnoli table.
+	CRC32C ChecksumAlgorithm = 0
+	// XXHash64 indicates that the checksum is calculated using xxHash64.
+	XXHash64 ChecksumAlgorithm = 1
+	// NoChecksum indicates that the blocks have no checksum, so they are never verified.
+	NoChecksum ChecksumAlgorithm = 2
 )
 
 // CompressionType specifies how a block should be compressed.
@@ -42,3 +58,28 @@ const (
 	// ZSTD mode indicates that a block is compressed using ZSTD algorithm.
 	ZSTD CompressionType = 2
 )
+
+// CompactionStyle specifies how the compactions move the data between the levels.
+type CompactionStyle int
+
+const (
+	// LeveledCompaction keeps the size of every level a multiple of the size of the level above it,
+	// by compacting a few tables at a time into the next level.
+	LeveledCompaction CompactionStyle = iota
+	// TieredCompaction keeps each level as a single sorted run, and merges a level into the next one
+	// only once both have about the same size. It writes the data fewer times than
+	// LeveledCompaction, at the cost of reading more tables in lookups and iterations.
+	TieredCompaction
+)
+
+// EncryptionMode specifies how the table blocks and the value log entries are encrypted.
+type EncryptionMode uint32
+
+const (
+	// AESCTR mode indicates that the data is encrypted using AES in CTR mode, which doesn't detect
+	// tampering.
+	AESCTR EncryptionMode = 0
+	// AESGCM mode indicates that the data is encrypted using AES in GCM mode, which authenticates
+	// it, so that tampering is detected when it is decrypted.
+	AESGCM EncryptionMode = 1
+)
@@ -17,10 +17,13 @@
 package badger
 
 import (
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3/options"
+	"github.com/stretchr/testify/require"
 )
 
 func TestOptions(t *testing.T) {
@@ -58,6 +61,95 @@ func TestOptions(t *testing.T) {
 	})
 }
 
+func TestOptionsPresets(t *testing.T) {
+	presets := map[string]func(string) Options{
+		"hdd":        HDDOptions,
+		"nvme":       NVMeOptions,
+		"low memory": LowMemoryOptions,
+		"bulk load":  BulkLoadOptions,
+	}
+	for name, preset := range presets {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "badger-test")
+			require.NoError(t, err)
+			defer removeDir(dir)
+			db, err := Open(preset(dir).WithLoggingLevel(WARNING))
+			require.NoError(t, err)
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte("key"), make([]byte, 2<<10))
+			}))
+			require.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		lc := db.lc
+		numRunning := func() int {
+			lc.compactorsLock.Lock()
+			defer lc.compactorsLock.Unlock()
+			return len(lc.compactors)
+		}
+		require.Equal(t, 4, numRunning())
+
+		require.NoError(t, db.SetOptions(db.Opts().
+			WithNumCompactors(6).
+			WithCompactionRateLimit(1<<20).
+			WithValueThreshold(32).
+			WithBlockCacheSize(1<<20)))
+		opt := db.Opts()
+		require.Equal(t, 6, opt.NumCompactors)
+		require.Equal(t, int64(1<<20), opt.CompactionRateLimit)
+		require.Equal(t, int64(32), opt.ValueThreshold)
+		require.Equal(t, int64(1<<20), opt.BlockCacheSize)
+		require.Equal(t, int64(1<<20), db.blockCache.MaxCost())
+		require.Equal(t, 6, numRunning())
+
+		// The values bigger than the new ValueThreshold are written to the value log.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), make([]byte, 100))
+		}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			require.NotZero(t, item.meta&bitValuePointer)
+			return nil
+		}))
+
+		// The extra compactors stop.
+		require.NoError(t, db.SetOptions(db.Opts().WithNumCompactors(2)))
+		require.Eventually(t, func() bool { return numRunning() == 2 }, 5*time.Second,
+			10*time.Millisecond)
+
+		// None of the options is changed if one of them is invalid.
+		for _, invalid := range []Options{
+			db.Opts().WithNumCompactors(8).WithIndexCacheSize(1 << 20),
+			db.Opts().WithNumCompactors(1),
+			db.Opts().WithBlockCacheSize(0),
+			db.Opts().WithCompactionRateLimit(-1),
+			db.Opts().WithValueThreshold(2 << 20),
+		} {
+			require.Error(t, db.SetOptions(invalid))
+		}
+		require.Equal(t, 2, db.Opts().NumCompactors)
+		require.Zero(t, db.Opts().IndexCacheSize)
+	})
+}
+
+func TestCompactionLimiter(t *testing.T) {
+	var l compactionLimiter
+	start := time.Now()
+	l.wait(10 << 20)
+	require.WithinDuration(t, start, time.Now(), 50*time.Millisecond)
+
+	l.setRate(10 << 20)
+	for i := 0; i < 3; i++ {
+		l.wait(1 << 20)
+	}
+	require.True(t, time.Since(start) >= 300*time.Millisecond)
+}
+
 // optionsEqual just compares the values of two Options structs
 func optionsEqual(o1, o2 Options) bool {
 	o1v := reflect.ValueOf(&o1).Elem()
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// Shard is the range of keys [Start, End) scanned by one goroutine of a ParallelIterator. A nil
+// Start or End leaves the shard unbounded on that side.
+type Shard struct {
+	ID    int
+	Start []byte
+	End   []byte
+}
+
+// ParallelIterator scans the keys concurrently, in shards split at the boundaries of the tables.
+// All the shards are read at the same timestamp. It is meant for analytical scans using multiple
+// cores within one process. Unlike Stream, it delivers the items, in order within each shard.
+type ParallelIterator struct {
+	txn       *Txn
+	opt       IteratorOptions
+	numShards int
+	shards    []Shard
+}
+
+// NewParallelIterator creates a new ParallelIterator, splitting the keys iterated over with the
+// given options in about numShards shards. Remember to close the iterator once done.
+func (db *DB) NewParallelIterator(opt IteratorOptions, numShards int) *ParallelIterator {
+	if db.opt.managedTxns {
+		panic("This API can not be called in managed mode.")
+	}
+	return db.newParallelIterator(db.NewTransaction(false), opt, numShards)
+}
+
+// NewParallelIteratorAt creates a new ParallelIterator reading at the given timestamp. Should only
+// be used with managed DB.
+func (db *DB) NewParallelIteratorAt(readTs uint64, opt IteratorOptions,
+	numShards int) *ParallelIterator {
+	if !db.opt.managedTxns {
+		panic("This API can only be called in managed mode.")
+	}
+	return db.newParallelIterator(db.NewTransactionAt(readTs, false), opt, numShards)
+}
+
+func (db *DB) newParallelIterator(txn *Txn, opt IteratorOptions,
+	numShards int) *ParallelIterator {
+	if numShards < 1 {
+		numShards = 1
+	}
+	pi := &ParallelIterator{txn: txn, opt: opt, numShards: numShards}
+	opt.setBounds()
+
+	var start []byte
+	for _, r := range db.Ranges(opt.Prefix, numShards) {
+		if len(r.right) == 0 {
+			break
+		}
+		end := y.ParseKey(r.right)
+		if bytes.Compare(end, start) <= 0 {
+			continue
+		}
+		pi.addShard(&opt, start, end)
+		start = end
+	}
+	pi.addShard(&opt, start, nil)
+	return pi
+}
+
+// addShard adds the shard [start, end), narrowed down to the bounds of the iteration, unless it's
+// empty.
+func (pi *ParallelIterator) addShard(opt *IteratorOptions, start, end []byte) {
+	if opt.lower != nil && (start == nil || bytes.Compare(start, opt.lower) < 0) {
+		start = opt.lower
+	}
+	if opt.upper != nil && (end == nil || bytes.Compare(end, opt.upper) > 0) {
+		end = opt.upper
+	}
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return
+	}
+	pi.shards = append(pi.shards, Shard{
+		ID:    len(pi.shards),
+		Start: y.SafeCopy(nil, start),
+		End:   y.SafeCopy(nil, end),
+	})
+}
+
+// Shards returns the shards of the iteration.
+func (pi *ParallelIterator) Shards() []Shard {
+	return pi.shards
+}
+
+// Run scans all the shards, calling fn with every item. The shards are scanned concurrently by up
+// to numShards goroutines, so fn must be safe for concurrent use. The calls for the items of a
+// shard are serial and in the order of the iteration. The item is only valid within the call.
+// Run stops, and returns the error, as soon as fn returns an error or the context is canceled.
+func (pi *ParallelIterator) Run(ctx context.Context, fn func(s Shard, item *Item) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	shardCh := make(chan Shard, len(pi.shards))
+	for _, s := range pi.shards {
+		shardCh <- s
+	}
+	close(shardCh)
+
+	scan := func(s Shard) error {
+		opt := pi.opt
+		opt.LowerBound, opt.UpperBound = s.Start, s.End
+		it := pi.txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			if err := fn(s, it.Item()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	numGo := pi.numShards
+	if numGo > len(pi.shards) {
+		numGo = len(pi.shards)
+	}
+	errCh := make(chan error, numGo)
+	var wg sync.WaitGroup
+	for i := 0; i < numGo; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range shardCh {
+				if err := scan(s); err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	// Report the first error, rather than the cancellation it caused in the other goroutines.
+	return <-errCh
+}
+
+// Close discards the transaction the iterator reads from. It must be called once done.
+func (pi *ParallelIterator) Close() {
+	pi.txn.Discard()
+}
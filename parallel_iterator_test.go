@@ -0,0 +1,112 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0).WithBaseTableSize(1 << 14)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	n := 5000
+	batch := db.NewWriteBatch()
+	for i := 0; i < n; i++ {
+		val := make([]byte, 100)
+		rand.Read(val)
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%04d", i)), val))
+	}
+	require.NoError(t, batch.Flush())
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	_, err = db.CompactRange(CompactRangeOptions{})
+	require.NoError(t, err)
+
+	scan := func(iopt IteratorOptions, numShards int) []string {
+		pi := db.NewParallelIterator(iopt, numShards)
+		defer pi.Close()
+		shards := pi.Shards()
+		require.NotEmpty(t, shards)
+
+		var mu sync.Mutex
+		keys := make(map[int][]string)
+		require.NoError(t, pi.Run(context.Background(), func(s Shard, item *Item) error {
+			mu.Lock()
+			defer mu.Unlock()
+			keys[s.ID] = append(keys[s.ID], string(item.Key()))
+			return nil
+		}))
+		var all []string
+		for _, s := range shards {
+			// The keys of a shard are delivered in order, and lie within the shard.
+			sk := keys[s.ID]
+			require.True(t, sort.StringsAreSorted(sk))
+			if len(sk) > 0 {
+				require.True(t, s.Start == nil || bytes.Compare([]byte(sk[0]), s.Start) >= 0)
+				require.True(t, s.End == nil || bytes.Compare([]byte(sk[len(sk)-1]), s.End) < 0)
+			}
+			all = append(all, sk...)
+		}
+		return all
+	}
+	expected := func(from, to int) []string {
+		var out []string
+		for i := from; i < to; i++ {
+			out = append(out, fmt.Sprintf("key%04d", i))
+		}
+		return out
+	}
+
+	pi := db.NewParallelIterator(DefaultIteratorOptions, 4)
+	require.Greater(t, len(pi.Shards()), 1)
+	pi.Close()
+
+	require.Equal(t, expected(0, n), scan(DefaultIteratorOptions, 4))
+	require.Equal(t, expected(0, n), scan(DefaultIteratorOptions, 1))
+	require.Equal(t, expected(1000, 2000), scan(IteratorOptions{Prefix: []byte("key1")}, 4))
+	require.Equal(t, expected(1234, 4321), scan(IteratorOptions{
+		LowerBound: []byte("key1234"), UpperBound: []byte("key4321")}, 8))
+
+	// An error stops the scan, and is returned.
+	errStop := errors.New("stop")
+	pi = db.NewParallelIterator(DefaultIteratorOptions, 4)
+	defer pi.Close()
+	err = pi.Run(context.Background(), func(s Shard, item *Item) error {
+		if bytes.Equal(item.Key(), []byte("key2500")) {
+			return errStop
+		}
+		return nil
+	})
+	require.Equal(t, errStop, err)
+}
@@ -25,15 +25,18 @@ const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
 type EncryptionAlgo int32
 
 const (
-	EncryptionAlgo_aes EncryptionAlgo = 0
+	EncryptionAlgo_aes     EncryptionAlgo = 0
+	EncryptionAlgo_aes_gcm EncryptionAlgo = 1
 )
 
 var EncryptionAlgo_name = map[int32]string{
 	0: "aes",
+	1: "aes_gcm",
 }
 
 var EncryptionAlgo_value = map[string]int32{
-	"aes": 0,
+	"aes":     0,
+	"aes_gcm": 1,
 }
 
 func (x EncryptionAlgo) String() string {
@@ -337,6 +340,7 @@ type ManifestChange struct {
 	KeyId          uint64                   `protobuf:"varint,4,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
 	EncryptionAlgo EncryptionAlgo           `protobuf:"varint,5,opt,name=encryption_algo,json=encryptionAlgo,proto3,enum=badgerpb3.EncryptionAlgo" json:"encryption_algo,omitempty"`
 	Compression    uint32                   `protobuf:"varint,6,opt,name=compression,proto3" json:"compression,omitempty"`
+	RemoteUrl      string                   `protobuf:"bytes,7,opt,name=remote_url,json=remoteUrl,proto3" json:"remote_url,omitempty"`
 }
 
 func (m *ManifestChange) Reset()         { *m = ManifestChange{} }
@@ -414,6 +418,13 @@ func (m *ManifestChange) GetCompression() uint32 {
 	return 0
 }
 
+func (m *ManifestChange) GetRemoteUrl() string {
+	if m != nil {
+		return m.RemoteUrl
+	}
+	return ""
+}
+
 type Checksum struct {
 	Algo Checksum_Algorithm `protobuf:"varint,1,opt,name=algo,proto3,enum=badgerpb3.Checksum_Algorithm" json:"algo,omitempty"`
 	Sum  uint64             `protobuf:"varint,2,opt,name=sum,proto3" json:"sum,omitempty"`
@@ -471,6 +482,7 @@ type DataKey struct {
 	Data      []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
 	Iv        []byte `protobuf:"bytes,3,opt,name=iv,proto3" json:"iv,omitempty"`
 	CreatedAt int64  `protobuf:"varint,4,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Prefix    []byte `protobuf:"bytes,5,opt,name=prefix,proto3" json:"prefix,omitempty"`
 }
 
 func (m *DataKey) Reset()         { *m = DataKey{} }
@@ -534,6 +546,13 @@ func (m *DataKey) GetCreatedAt() int64 {
 	return 0
 }
 
+func (m *DataKey) GetPrefix() []byte {
+	if m != nil {
+		return m.Prefix
+	}
+	return nil
+}
+
 type Match struct {
 	Prefix      []byte `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
 	IgnoreBytes string `protobuf:"bytes,2,opt,name=ignore_bytes,json=ignoreBytes,proto3" json:"ignore_bytes,omitempty"`
@@ -603,52 +622,54 @@ func init() {
 func init() { proto.RegisterFile("badgerpb3.proto", fileDescriptor_6d729c99bbc38987) }
 
 var fileDescriptor_6d729c99bbc38987 = []byte{
-	// 705 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x54, 0xdd, 0x6e, 0xda, 0x58,
-	0x10, 0xc6, 0xc6, 0xfc, 0x0d, 0x84, 0xb0, 0x47, 0xbb, 0x2b, 0x47, 0xab, 0xb0, 0xc4, 0xd1, 0xee,
-	0xa2, 0x95, 0x16, 0xb4, 0x50, 0xf5, 0xa6, 0x57, 0xfc, 0xb8, 0x0a, 0x82, 0x28, 0xd2, 0x69, 0x14,
-	0xa5, 0xbd, 0x41, 0x07, 0x7b, 0x00, 0x0b, 0xb0, 0xad, 0xe3, 0x83, 0x15, 0x1e, 0xa2, 0x52, 0x5f,
-	0xa2, 0xef, 0xd2, 0xcb, 0x5c, 0xf6, 0xb2, 0x4a, 0x5e, 0xa4, 0x3a, 0xc7, 0x0e, 0x85, 0x8b, 0xde,
-	0xcd, 0xf7, 0xcd, 0x78, 0x66, 0x3c, 0xdf, 0xcc, 0x81, 0xd3, 0x19, 0x73, 0x17, 0xc8, 0xc3, 0x59,
-	0xb7, 0x15, 0xf2, 0x40, 0x04, 0xa4, 0xb4, 0x27, 0xac, 0xcf, 0x3a, 0xe8, 0xe3, 0x3b, 0x52, 0x83,
-	0xec, 0x0a, 0x77, 0xa6, 0xd6, 0xd0, 0x9a, 0x15, 0x2a, 0x4d, 0xf2, 0x2b, 0xe4, 0x62, 0xb6, 0xde,
-	0xa2, 0xa9, 0x2b, 0x2e, 0x01, 0xe4, 0x0f, 0x28, 0x6d, 0x23, 0xe4, 0xd3, 0x0d, 0x0a, 0x66, 0x66,
-	0x95, 0xa7, 0x28, 0x89, 0x6b, 0x14, 0x8c, 0x98, 0x50, 0x88, 0x91, 0x47, 0x5e, 0xe0, 0x9b, 0x46,
-	0x43, 0x6b, 0x1a, 0xf4, 0x05, 0x92, 0x73, 0x00, 0x7c, 0x08, 0x3d, 0x8e, 0xd1, 0x94, 0x09, 0x33,
-	0xa7, 0x9c, 0xa5, 0x94, 0xe9, 0x09, 0x42, 0xc0, 0x50, 0x09, 0xf3, 0x2a, 0xa1, 0xb2, 0x65, 0xa5,
-	0x48, 0x70, 0x64, 0x9b, 0xa9, 0xe7, 0x9a, 0xd0, 0xd0, 0x9a, 0x27, 0xb4, 0x98, 0x10, 0x23, 0x97,
-	0xfc, 0x09, 0xe5, 0xd4, 0xe9, 0x06, 0x3e, 0x9a, 0xe5, 0x86, 0xd6, 0x2c, 0x52, 0x48, 0xa8, 0x61,
-	0xe0, 0x23, 0xf9, 0x1b, 0x8c, 0x95, 0xe7, 0xbb, 0x66, 0xa5, 0xa1, 0x35, 0xab, 0x1d, 0xd2, 0xfa,
-	0x31, 0x81, 0xf1, 0x5d, 0x6b, 0xec, 0xf9, 0x2e, 0x55, 0x7e, 0xeb, 0x1f, 0x30, 0x24, 0x22, 0x05,
-	0xc8, 0x8e, 0xed, 0xf7, 0xb5, 0x0c, 0xa9, 0x40, 0x71, 0xd8, 0xbb, 0xed, 0x4d, 0x25, 0xd2, 0x48,
-	0x11, 0x8c, 0xb7, 0xa3, 0x89, 0x5d, 0xd3, 0xad, 0x21, 0xe4, 0xc7, 0x77, 0x13, 0x2f, 0x12, 0xe4,
-	0x1c, 0xf4, 0x55, 0x6c, 0x6a, 0x8d, 0x6c, 0xb3, 0xdc, 0x39, 0x39, 0x4a, 0x4c, 0xf5, 0x55, 0x2c,
-	0xfb, 0x66, 0xeb, 0x75, 0xe0, 0x4c, 0x39, 0xce, 0x55, 0xdf, 0x06, 0x2d, 0x2a, 0x82, 0xe2, 0xdc,
-	0xba, 0x82, 0x5f, 0xae, 0x99, 0xef, 0xcd, 0x31, 0x12, 0x83, 0x25, 0xf3, 0x17, 0xf8, 0x0e, 0x05,
-	0xe9, 0x42, 0xc1, 0x51, 0x20, 0x4a, 0xb3, 0x9e, 0x1d, 0x64, 0x3d, 0x0e, 0xa7, 0x2f, 0x91, 0xd6,
-	0x47, 0x1d, 0xaa, 0xc7, 0x3e, 0x52, 0x05, 0x7d, 0xe4, 0x2a, 0x09, 0x0d, 0xaa, 0x8f, 0x5c, 0xd2,
-	0x05, 0xfd, 0x26, 0x54, 0xf2, 0x55, 0x3b, 0x97, 0x3f, 0x4d, 0xd9, 0xba, 0x09, 0x91, 0x33, 0xe1,
-	0x05, 0x3e, 0xd5, 0x6f, 0x42, 0x29, 0xfb, 0x04, 0x63, 0x5c, 0x2b, 0x71, 0x4f, 0x68, 0x02, 0xc8,
-	0x6f, 0x90, 0x5f, 0xe1, 0x4e, 0x2a, 0x91, 0x08, 0x9b, 0x5b, 0xe1, 0x6e, 0xe4, 0x92, 0x3e, 0x9c,
-	0xa2, 0xef, 0xf0, 0x5d, 0x28, 0x3f, 0x9f, 0xb2, 0xf5, 0x22, 0x50, 0xda, 0x56, 0x8f, 0xfe, 0xc0,
-	0xde, 0x47, 0xf4, 0xd6, 0x8b, 0x80, 0x56, 0xf1, 0x08, 0x93, 0x06, 0x94, 0x9d, 0x60, 0x13, 0x72,
-	0x8c, 0xd4, 0xe2, 0xe4, 0x55, 0xd9, 0x43, 0xca, 0xba, 0x84, 0xd2, 0xbe, 0x47, 0x02, 0x90, 0x1f,
-	0x50, 0xbb, 0x77, 0x6b, 0xd7, 0x32, 0xd2, 0x1e, 0xda, 0x13, 0xfb, 0xd6, 0xae, 0x69, 0x56, 0x0c,
-	0xc5, 0xc1, 0x12, 0x9d, 0x55, 0xb4, 0xdd, 0x90, 0xff, 0xc1, 0x50, 0xbd, 0x68, 0xaa, 0x97, 0xf3,
-	0x83, 0x5e, 0x5e, 0x42, 0x5a, 0xb2, 0x34, 0xf7, 0xc4, 0x72, 0x43, 0x55, 0xa8, 0xdc, 0xff, 0x68,
-	0xbb, 0x51, 0xc3, 0x32, 0xa8, 0x34, 0xad, 0xbf, 0xa0, 0xb4, 0x0f, 0x4a, 0xaa, 0x0e, 0xba, 0x9d,
-	0x41, 0xb2, 0x21, 0xf7, 0xf7, 0x57, 0x2c, 0x5a, 0xbe, 0x7e, 0x55, 0xd3, 0x2c, 0x07, 0x0a, 0x43,
-	0x26, 0xd8, 0x18, 0x77, 0x07, 0x43, 0xd2, 0x0e, 0x87, 0x44, 0xc0, 0x70, 0x99, 0x60, 0xe9, 0x1d,
-	0x29, 0x5b, 0x4a, 0xe5, 0xc5, 0xe9, 0xfd, 0xe8, 0x5e, 0x2c, 0xef, 0xc3, 0xe1, 0xc8, 0x04, 0xba,
-	0xf2, 0x3e, 0xe4, 0x8c, 0xb3, 0xb4, 0x94, 0x32, 0x3d, 0x61, 0xf5, 0x21, 0x77, 0xcd, 0x84, 0xb3,
-	0x24, 0xbf, 0x43, 0x3e, 0xe4, 0x38, 0xf7, 0x1e, 0xd2, 0x4b, 0x4d, 0x11, 0xb9, 0x80, 0x8a, 0xb7,
-	0xf0, 0x03, 0x8e, 0xd3, 0xd9, 0x4e, 0x60, 0xa4, 0x6a, 0x95, 0x68, 0x39, 0xe1, 0xfa, 0x92, 0xfa,
-	0xf7, 0x0c, 0xaa, 0xc7, 0x4a, 0xc8, 0x9d, 0x67, 0x18, 0xd5, 0x32, 0xfd, 0x37, 0x5f, 0x9e, 0xea,
-	0xda, 0xe3, 0x53, 0x5d, 0xfb, 0xf6, 0x54, 0xd7, 0x3e, 0x3d, 0xd7, 0x33, 0x8f, 0xcf, 0xf5, 0xcc,
-	0xd7, 0xe7, 0x7a, 0xe6, 0xc3, 0xc5, 0xc2, 0x13, 0xcb, 0xed, 0xac, 0xe5, 0x04, 0x9b, 0xb6, 0xbb,
-	0xe0, 0x2c, 0x5c, 0xfe, 0xe7, 0x05, 0xed, 0x64, 0x9e, 0xed, 0xb8, 0xdb, 0x0e, 0x67, 0xb3, 0xbc,
-	0x7a, 0x52, 0xba, 0xdf, 0x03, 0x00, 0x00, 0xff, 0xff, 0x43, 0xc8, 0xf6, 0xac, 0x65, 0x04, 0x00,
-	0x00,
+	// 738 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x54, 0xcd, 0x6e, 0xeb, 0x44,
+	0x14, 0xce, 0x38, 0x6e, 0x12, 0x9f, 0xa4, 0xb9, 0x61, 0x04, 0xc8, 0x08, 0x35, 0xf8, 0xfa, 0x8a,
+	0x4b, 0x84, 0x44, 0x2a, 0x1a, 0xc4, 0x86, 0x55, 0x9a, 0x18, 0xdd, 0x28, 0xad, 0x2a, 0x0d, 0xa5,
+	0xba, 0xb0, 0xb1, 0x26, 0xf6, 0xa9, 0x63, 0xc5, 0x7f, 0x1a, 0x4f, 0xac, 0x1b, 0xf1, 0x12, 0xbc,
+	0x04, 0x3b, 0x1e, 0x84, 0x65, 0x97, 0x2c, 0x51, 0xfb, 0x22, 0x68, 0xc6, 0x69, 0x49, 0x16, 0xec,
+	0xce, 0xf7, 0x9d, 0xcf, 0x67, 0xce, 0x9c, 0x6f, 0x8e, 0xe1, 0xd5, 0x8a, 0x87, 0x11, 0x8a, 0x62,
+	0x35, 0x19, 0x17, 0x22, 0x97, 0x39, 0xb5, 0x5e, 0x08, 0xf7, 0x0f, 0x03, 0x8c, 0xe5, 0x1d, 0x1d,
+	0x40, 0x73, 0x83, 0x3b, 0x9b, 0x38, 0x64, 0xd4, 0x63, 0x2a, 0xa4, 0x1f, 0xc3, 0x49, 0xc5, 0x93,
+	0x2d, 0xda, 0x86, 0xe6, 0x6a, 0x40, 0x3f, 0x07, 0x6b, 0x5b, 0xa2, 0xf0, 0x53, 0x94, 0xdc, 0x6e,
+	0xea, 0x4c, 0x47, 0x11, 0xd7, 0x28, 0x39, 0xb5, 0xa1, 0x5d, 0xa1, 0x28, 0xe3, 0x3c, 0xb3, 0x4d,
+	0x87, 0x8c, 0x4c, 0xf6, 0x0c, 0xe9, 0x19, 0x00, 0x7e, 0x28, 0x62, 0x81, 0xa5, 0xcf, 0xa5, 0x7d,
+	0xa2, 0x93, 0xd6, 0x9e, 0x99, 0x4a, 0x4a, 0xc1, 0xd4, 0x05, 0x5b, 0xba, 0xa0, 0x8e, 0xd5, 0x49,
+	0xa5, 0x14, 0xc8, 0x53, 0x3f, 0x0e, 0x6d, 0x70, 0xc8, 0xe8, 0x94, 0x75, 0x6a, 0x62, 0x11, 0xd2,
+	0x2f, 0xa0, 0xbb, 0x4f, 0x86, 0x79, 0x86, 0x76, 0xd7, 0x21, 0xa3, 0x0e, 0x83, 0x9a, 0x9a, 0xe7,
+	0x19, 0xd2, 0xb7, 0x60, 0x6e, 0xe2, 0x2c, 0xb4, 0x7b, 0x0e, 0x19, 0xf5, 0x2f, 0xe8, 0xf8, 0xbf,
+	0x09, 0x2c, 0xef, 0xc6, 0xcb, 0x38, 0x0b, 0x99, 0xce, 0xbb, 0x5f, 0x81, 0xa9, 0x10, 0x6d, 0x43,
+	0x73, 0xe9, 0xfd, 0x32, 0x68, 0xd0, 0x1e, 0x74, 0xe6, 0xd3, 0xdb, 0xa9, 0xaf, 0x10, 0xa1, 0x1d,
+	0x30, 0x7f, 0x5c, 0x5c, 0x79, 0x03, 0xc3, 0x9d, 0x43, 0x6b, 0x79, 0x77, 0x15, 0x97, 0x92, 0x9e,
+	0x81, 0xb1, 0xa9, 0x6c, 0xe2, 0x34, 0x47, 0xdd, 0x8b, 0xd3, 0xa3, 0xc2, 0xcc, 0xd8, 0x54, 0xaa,
+	0x6f, 0x9e, 0x24, 0x79, 0xe0, 0x0b, 0xbc, 0xd7, 0x7d, 0x9b, 0xac, 0xa3, 0x09, 0x86, 0xf7, 0xee,
+	0x3b, 0xf8, 0xe8, 0x9a, 0x67, 0xf1, 0x3d, 0x96, 0x72, 0xb6, 0xe6, 0x59, 0x84, 0x3f, 0xa1, 0xa4,
+	0x13, 0x68, 0x07, 0x1a, 0x94, 0xfb, 0xaa, 0x9f, 0x1d, 0x54, 0x3d, 0x96, 0xb3, 0x67, 0xa5, 0xfb,
+	0xa7, 0x01, 0xfd, 0xe3, 0x1c, 0xed, 0x83, 0xb1, 0x08, 0xb5, 0x85, 0x26, 0x33, 0x16, 0x21, 0x9d,
+	0x80, 0x71, 0x53, 0x68, 0xfb, 0xfa, 0x17, 0x6f, 0xfe, 0xb7, 0xe4, 0xf8, 0xa6, 0x40, 0xc1, 0x65,
+	0x9c, 0x67, 0xcc, 0xb8, 0x29, 0x94, 0xed, 0x57, 0x58, 0x61, 0xa2, 0xcd, 0x3d, 0x65, 0x35, 0xa0,
+	0x9f, 0x40, 0x6b, 0x83, 0x3b, 0xe5, 0x44, 0x6d, 0xec, 0xc9, 0x06, 0x77, 0x8b, 0x90, 0x5e, 0xc2,
+	0x2b, 0xcc, 0x02, 0xb1, 0x2b, 0xd4, 0xe7, 0x3e, 0x4f, 0xa2, 0x5c, 0x7b, 0xdb, 0x3f, 0xba, 0x81,
+	0xf7, 0xa2, 0x98, 0x26, 0x51, 0xce, 0xfa, 0x78, 0x84, 0xa9, 0x03, 0xdd, 0x20, 0x4f, 0x0b, 0x81,
+	0xa5, 0x7e, 0x38, 0x2d, 0x7d, 0xec, 0x21, 0xa5, 0x1e, 0x8f, 0xc0, 0x34, 0x97, 0xe8, 0x6f, 0x45,
+	0x62, 0xb7, 0x1d, 0x32, 0xb2, 0x98, 0x55, 0x33, 0x3f, 0x8b, 0xc4, 0x7d, 0x03, 0xd6, 0xcb, 0x15,
+	0x28, 0x40, 0x6b, 0xc6, 0xbc, 0xe9, 0xad, 0x37, 0x68, 0xa8, 0x78, 0xee, 0x5d, 0x79, 0xb7, 0xde,
+	0x80, 0xb8, 0x15, 0x74, 0x66, 0x6b, 0x0c, 0x36, 0xe5, 0x36, 0xa5, 0xdf, 0x82, 0xa9, 0x5b, 0x25,
+	0xba, 0xd5, 0xb3, 0x83, 0x56, 0x9f, 0x25, 0x63, 0xd5, 0x99, 0x88, 0xe5, 0x3a, 0x65, 0x5a, 0xaa,
+	0xd6, 0xa3, 0xdc, 0xa6, 0x7a, 0x96, 0x26, 0x53, 0xa1, 0xfb, 0x25, 0x58, 0x2f, 0xa2, 0xfa, 0xd4,
+	0xd9, 0xe4, 0x62, 0x56, 0x3f, 0xa0, 0xf7, 0xef, 0xdf, 0xf1, 0x72, 0xfd, 0xfd, 0x77, 0x03, 0xe2,
+	0xfe, 0x06, 0xed, 0x39, 0x97, 0x7c, 0x89, 0xbb, 0x83, 0x19, 0x92, 0xc3, 0x19, 0x52, 0x30, 0x43,
+	0x2e, 0xf9, 0x7e, 0xcd, 0x74, 0xac, 0x9c, 0x8c, 0xab, 0xfd, 0x7a, 0x19, 0x71, 0xa5, 0x26, 0x10,
+	0x08, 0xe4, 0x12, 0x43, 0xb5, 0x3e, 0xca, 0x82, 0x26, 0xb3, 0xf6, 0xcc, 0x54, 0xd2, 0x4f, 0xa1,
+	0x55, 0x08, 0xbc, 0x8f, 0x3f, 0xe8, 0xe9, 0xf7, 0xd8, 0x1e, 0xb9, 0x97, 0x70, 0x72, 0xcd, 0x65,
+	0xb0, 0x3e, 0x10, 0x90, 0x43, 0x01, 0x7d, 0x0d, 0xbd, 0x38, 0xca, 0x72, 0x81, 0xfe, 0x6a, 0x27,
+	0xb1, 0xd4, 0x3d, 0x58, 0xac, 0x5b, 0x73, 0x97, 0x8a, 0xfa, 0xfa, 0x2d, 0xf4, 0x8f, 0x0d, 0x54,
+	0xab, 0xc2, 0xb1, 0x1c, 0x34, 0x68, 0x17, 0xda, 0x1c, 0x4b, 0x3f, 0x0a, 0xd2, 0x01, 0xb9, 0xfc,
+	0xe1, 0xaf, 0xc7, 0x21, 0x79, 0x78, 0x1c, 0x92, 0x7f, 0x1e, 0x87, 0xe4, 0xf7, 0xa7, 0x61, 0xe3,
+	0xe1, 0x69, 0xd8, 0xf8, 0xfb, 0x69, 0xd8, 0xf8, 0xf5, 0x75, 0x14, 0xcb, 0xf5, 0x76, 0x35, 0x0e,
+	0xf2, 0xf4, 0x3c, 0x8c, 0x04, 0x2f, 0xd6, 0xdf, 0xc4, 0xf9, 0x79, 0x3d, 0xf4, 0xf3, 0x6a, 0x72,
+	0x5e, 0xac, 0x56, 0x2d, 0xfd, 0x5b, 0x9a, 0xfc, 0x3b, 0x00, 0x4c, 0x44, 0xec, 0x36, 0xa9, 0x04,
+	0x00, 0x00,
 }
 
 func (m *KV) Marshal() (dAtA []byte, err error) {
@@ -831,6 +852,13 @@ func (m *ManifestChange) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.RemoteUrl) > 0 {
+		i -= len(m.RemoteUrl)
+		copy(dAtA[i:], m.RemoteUrl)
+		i = encodeVarintBadgerpb3(dAtA, i, uint64(len(m.RemoteUrl)))
+		i--
+		dAtA[i] = 0x3a
+	}
 	if m.Compression != 0 {
 		i = encodeVarintBadgerpb3(dAtA, i, uint64(m.Compression))
 		i--
@@ -917,6 +945,13 @@ func (m *DataKey) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Prefix) > 0 {
+		i -= len(m.Prefix)
+		copy(dAtA[i:], m.Prefix)
+		i = encodeVarintBadgerpb3(dAtA, i, uint64(len(m.Prefix)))
+		i--
+		dAtA[i] = 0x2a
+	}
 	if m.CreatedAt != 0 {
 		i = encodeVarintBadgerpb3(dAtA, i, uint64(m.CreatedAt))
 		i--
@@ -1089,6 +1124,10 @@ func (m *ManifestChange) Size() (n int) {
 	if m.Compression != 0 {
 		n += 1 + sovBadgerpb3(uint64(m.Compression))
 	}
+	l = len(m.RemoteUrl)
+	if l > 0 {
+		n += 1 + l + sovBadgerpb3(uint64(l))
+	}
 	return n
 }
 
@@ -1127,6 +1166,10 @@ func (m *DataKey) Size() (n int) {
 	if m.CreatedAt != 0 {
 		n += 1 + sovBadgerpb3(uint64(m.CreatedAt))
 	}
+	l = len(m.Prefix)
+	if l > 0 {
+		n += 1 + l + sovBadgerpb3(uint64(l))
+	}
 	return n
 }
 
@@ -1765,6 +1808,38 @@ func (m *ManifestChange) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RemoteUrl", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBadgerpb3
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthBadgerpb3
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthBadgerpb3
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RemoteUrl = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipBadgerpb3(dAtA[iNdEx:])
@@ -2009,6 +2084,40 @@ func (m *DataKey) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Prefix", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBadgerpb3
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthBadgerpb3
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthBadgerpb3
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Prefix = append(m.Prefix[:0], dAtA[iNdEx:postIndex]...)
+			if m.Prefix == nil {
+				m.Prefix = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipBadgerpb3(dAtA[iNdEx:])
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"math"
+
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// CreatePrefixKey creates a data key for the keys with the given prefix, like those of a tenant,
+// so that they can be crypto-shredded with ShredPrefix. The DB must be encrypted, and the prefix
+// must not be a prefix of another prefix with a data key, or the other way around. It does nothing
+// if the prefix already has a data key.
+//
+// The compactions keep the keys with the prefix in their own tables, encrypted with its data key.
+// Their values are kept in the tables too, instead of in the value log, so they count fully
+// towards the size limit of a transaction, and large values fail with ErrTxnTooBig. The values
+// written to the value log before the prefix had a data key stay there until ShredPrefix rewrites
+// the value log files holding them, or the value log GC does. The keys in the memtables,
+// their write-ahead logs and the level 0 tables are encrypted with the data keys of the DB, until
+// they are compacted. So are the keys written before the prefix had a data key, until their tables
+// are compacted.
+func (db *DB) CreatePrefixKey(prefix []byte) error {
+	if db.opt.ReadOnly {
+		return errorf(CodeReadOnly, "Attempting to create a data key in read-only mode.")
+	}
+	if !db.shouldEncrypt() {
+		return errorf(CodeInvalidArgument, "Cannot create a data key for a prefix of a DB "+
+			"which isn't encrypted")
+	}
+	if _, err := db.registry.AddPrefixKey(prefix); err != nil {
+		return y.Wrapf(err, "while creating the data key of the prefix %q", prefix)
+	}
+	return nil
+}
+
+// ShredPrefix drops the keys with the given prefix, which has a data key created by
+// CreatePrefixKey, and destroys its data key. The copies of the tables encrypted with it, in
+// backups of the files of the DB or on the disk, can't be decrypted anymore. The backups made
+// with DB.Backup or a Stream, which are decrypted, aren't. The value log files holding values of
+// the prefix, written before it had a data key, are rewritten without them.
+//
+// It blocks the writes and stops the compactions while the keys are dropped, like
+// DropPrefixBlocking.
+func (db *DB) ShredPrefix(prefix []byte) error {
+	if db.opt.ReadOnly {
+		return errorf(CodeReadOnly, "Attempting to drop data in read-only mode.")
+	}
+	// The new tables aren't encrypted with the data key anymore.
+	dk := db.registry.detachPrefixKey(prefix)
+	if dk == nil {
+		return errorf(CodeInvalidArgument, "The prefix %q has no data key", prefix)
+	}
+	// The deleted keys and old versions of the prefix are dropped too, so that no table is
+	// encrypted with the data key anymore.
+	err := db.dropPrefixBlocking([][]byte{prefix}, true)
+	if err == nil && db.lc.usesDataKey(dk.KeyId) {
+		err = errorf(CodeRejected, "Some tables are still encrypted with the data key of the "+
+			"prefix %q", prefix)
+	}
+	if err == nil && !db.opt.InMemory {
+		err = db.vlog.shredPrefix(prefix)
+	}
+	if err != nil {
+		db.registry.reattachPrefixKey(dk)
+		return err
+	}
+	return db.registry.removeDataKey(dk.KeyId)
+}
+
+// valueThresholdFor returns the value threshold of the entry with the given key. The values of
+// the keys of the prefixes with a data key are kept in the tables, so that they are only
+// encrypted with it.
+func (db *DB) valueThresholdFor(key []byte) int64 {
+	if db.registry.prefixDataKey(key) != nil {
+		return math.MaxInt64
+	}
+	return db.valueThreshold()
+}
+
+// usesDataKey returns true if a table of the levels is encrypted with the data key with the given
+// ID.
+func (s *levelsController) usesDataKey(id uint64) bool {
+	for _, l := range s.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if t.KeyID() == id {
+				l.RUnlock()
+				return true
+			}
+		}
+		l.RUnlock()
+	}
+	return false
+}
+
+// shredPrefix rewrites the value log files, and the large value log files, holding entries with
+// the given prefix, which has been dropped, so that the files only keep the live entries. The
+// value log must have been rotated after the prefix was dropped.
+func (vlog *valueLog) shredPrefix(prefix []byte) error {
+	for _, l := range []*valueLog{vlog, vlog.large} {
+		if l == nil {
+			continue
+		}
+		// Wait for the GC in progress, and keep the GC from picking the files meanwhile.
+		l.garbageCh <- struct{}{}
+		err := l.rewritePrefix(prefix)
+		<-l.garbageCh
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vlog *valueLog) rewritePrefix(prefix []byte) error {
+	vlog.filesLock.RLock()
+	var lfs []*logFile
+	for _, fid := range vlog.sortedFids() {
+		if fid != vlog.maxFid {
+			lfs = append(lfs, vlog.filesMap[fid])
+		}
+	}
+	vlog.filesLock.RUnlock()
+
+	for _, lf := range lfs {
+		var found bool
+		if _, err := lf.iterate(true, 0, func(e Entry, vp valuePointer) error {
+			if found = bytes.HasPrefix(e.Key, prefix); found {
+				return errStop
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if _, _, err := vlog.rewrite(context.Background(), lf); err != nil {
+			return y.Wrapf(err, "while rewriting the value log file %s", lf.path)
+		}
+		vlog.discardStats.Update(lf.fid, -1)
+	}
+	return nil
+}
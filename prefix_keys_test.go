@@ -0,0 +1,165 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShredPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithEncryptionKey([]byte("badgerkey16bytes")).
+		WithBlockCacheSize(10 << 20).WithIndexCacheSize(10 << 20).WithValueThreshold(64)
+	tenants := [][]byte{[]byte("a/"), []byte("b/")}
+	prefixes := append(tenants, []byte("c/"))
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for _, p := range tenants {
+		require.NoError(t, db.CreatePrefixKey(p))
+	}
+	require.NoError(t, db.CreatePrefixKey(tenants[0]))
+	require.Error(t, db.CreatePrefixKey([]byte("a/x")))
+	require.Error(t, db.CreatePrefixKey([]byte("a")))
+
+	val := make([]byte, 128)
+	for i := 0; i < 300; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, p := range prefixes {
+				key := []byte(fmt.Sprintf("%s%04d", p, i))
+				if err := txn.Set(key, val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	// The values of the tenants are kept in the tables.
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for _, p := range prefixes {
+			item, err := txn.Get([]byte(fmt.Sprintf("%s%04d", p, 0)))
+			require.NoError(t, err)
+			require.Equal(t, !bytes.Equal(p, []byte("c/")), item.meta&bitValuePointer == 0)
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	_, err = db.CompactRange(CompactRangeOptions{})
+	require.NoError(t, err)
+	// Each tenant has its own tables, encrypted with its data key.
+	ids := make(map[string]uint64)
+	for _, p := range tenants {
+		ids[string(p)] = db.registry.prefixDataKey(p).KeyId
+	}
+	var n int
+	for _, l := range db.lc.levels {
+		for _, tbl := range l.tables {
+			left, right := y.ParseKey(tbl.Smallest()), y.ParseKey(tbl.Biggest())
+			require.Equal(t, left[:2], right[:2])
+			if id, ok := ids[string(left[:2])]; ok {
+				require.Equal(t, id, tbl.KeyID())
+				n++
+			} else {
+				require.NotEqual(t, ids["a/"], tbl.KeyID())
+				require.NotEqual(t, ids["b/"], tbl.KeyID())
+			}
+		}
+	}
+	require.NotZero(t, n)
+
+	require.NoError(t, db.ShredPrefix(tenants[0]))
+	require.Error(t, db.ShredPrefix(tenants[0]))
+	_, err = db.registry.DataKey(ids["a/"])
+	require.Equal(t, CodeEncryption, ErrorCode(err))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for _, p := range prefixes {
+			_, err := txn.Get([]byte(fmt.Sprintf("%s%04d", p, 299)))
+			if bytes.Equal(p, tenants[0]) {
+				require.Equal(t, ErrKeyNotFound, err)
+			} else {
+				require.NoError(t, err)
+			}
+		}
+		return nil
+	}))
+	require.NotNil(t, db.registry.prefixDataKey([]byte("b/0000")))
+	require.Nil(t, db.registry.prefixDataKey([]byte("a/0000")))
+}
+
+func TestShredPrefixValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithEncryptionKey([]byte("badgerkey16bytes")).
+		WithBlockCacheSize(10 << 20).WithIndexCacheSize(10 << 20).WithValueThreshold(64)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	// The values written before the prefix has a data key go to the value log.
+	val := make([]byte, 128)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, p := range []string{"a/", "c/"} {
+				if err := txn.Set([]byte(fmt.Sprintf("%s%04d", p, i)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	require.NoError(t, db.CreatePrefixKey([]byte("a/")))
+	require.NoError(t, db.ShredPrefix([]byte("a/")))
+
+	// No value log file holds the values of the prefix anymore.
+	var entries int
+	for _, lf := range db.vlog.filesMap {
+		_, err := lf.iterate(true, 0, func(e Entry, vp valuePointer) error {
+			require.False(t, bytes.HasPrefix(e.Key, []byte("a/")), "key: %q", e.Key)
+			entries++
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	require.NotZero(t, entries)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			_, err := txn.Get([]byte(fmt.Sprintf("a/%04d", i)))
+			require.Equal(t, ErrKeyNotFound, err)
+			item, err := txn.Get([]byte(fmt.Sprintf("c/%04d", i)))
+			require.NoError(t, err)
+			require.Equal(t, val, getItemValue(t, item))
+		}
+		return nil
+	}))
+}
@@ -17,6 +17,9 @@
 package badger
 
 import (
+	"bytes"
+	"path"
+	"regexp"
 	"sync"
 	"sync/atomic"
 
@@ -26,11 +29,70 @@ import (
 	"github.com/dgraph-io/ristretto/z"
 )
 
+// KeyMatcher decides whether a key should be delivered to a subscriber. Matchers are evaluated on
+// the publisher side, so a subscriber only receives the keys it matches.
+type KeyMatcher interface {
+	Match(key []byte) bool
+}
+
+type rangeMatcher struct {
+	start, end []byte
+}
+
+func (m rangeMatcher) Match(key []byte) bool {
+	if bytes.Compare(key, m.start) < 0 {
+		return false
+	}
+	return len(m.end) == 0 || bytes.Compare(key, m.end) < 0
+}
+
+// KeyRange returns a KeyMatcher which matches the keys in the range [start, end). An empty end
+// leaves the range unbounded on the right.
+func KeyRange(start, end []byte) KeyMatcher {
+	return rangeMatcher{start: y.SafeCopy(nil, start), end: y.SafeCopy(nil, end)}
+}
+
+type regexpMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m regexpMatcher) Match(key []byte) bool {
+	return m.re.Match(key)
+}
+
+// KeyRegexp returns a KeyMatcher which matches the keys accepted by the compiled regular
+// expression re.
+func KeyRegexp(re *regexp.Regexp) KeyMatcher {
+	return regexpMatcher{re: re}
+}
+
+type globMatcher struct {
+	pattern string
+}
+
+func (m globMatcher) Match(key []byte) bool {
+	ok, _ := path.Match(m.pattern, string(key))
+	return ok
+}
+
+// KeyGlob returns a KeyMatcher which matches the keys against a shell glob pattern, using the
+// syntax of path.Match. An error is returned if the pattern is malformed.
+func KeyGlob(pattern string) (KeyMatcher, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return globMatcher{pattern: pattern}, nil
+}
+
 type subscriber struct {
 	id        uint64
 	matches   []pb.Match
+	matchers  []KeyMatcher
 	sendCh    chan *pb.KVList
 	subCloser *z.Closer
+	// replication is set for the subscribers of ReplicationStream, which get the internal meta of
+	// the entries.
+	replication bool
 	// this will be atomic pointer which will be used to
 	// track whether the subscriber is active or not
 	active *uint64
@@ -42,6 +104,8 @@ type publisher struct {
 	subscribers map[uint64]subscriber
 	nextID      uint64
 	indexer     *trie.Trie
+	// filtered holds the ids of the subscribers which use KeyMatchers instead of prefix matches.
+	filtered map[uint64]struct{}
 }
 
 func newPublisher() *publisher {
@@ -50,6 +114,7 @@ func newPublisher() *publisher {
 		subscribers: make(map[uint64]subscriber),
 		nextID:      0,
 		indexer:     trie.NewTrie(),
+		filtered:    make(map[uint64]struct{}),
 	}
 }
 
@@ -90,22 +155,47 @@ func (p *publisher) publishUpdates(reqs requests) {
 	for _, req := range reqs {
 		for _, e := range req.Entries {
 			ids := p.indexer.Get(e.Key)
+			if len(p.filtered) > 0 {
+				key := y.ParseKey(e.Key)
+				for id := range p.filtered {
+					if p.subscribers[id].matchKey(key) {
+						ids[id] = struct{}{}
+					}
+				}
+			}
 			if len(ids) == 0 {
 				continue
 			}
 			k := y.SafeCopy(nil, e.Key)
+			val, md := splitUserMetadata(e.meta, e.Value)
 			kv := &pb.KV{
 				Key:       y.ParseKey(k),
-				Value:     y.SafeCopy(nil, e.Value),
+				Value:     y.SafeCopy(nil, val),
 				Meta:      []byte{e.UserMeta},
+				UserMeta:  kvUserMeta(e.UserMeta, md),
 				ExpiresAt: e.ExpiresAt,
 				Version:   y.ParseTs(k),
 			}
+			var replKV *pb.KV
 			for id := range ids {
 				if _, ok := batchedUpdates[id]; !ok {
 					batchedUpdates[id] = &pb.KVList{}
 				}
-				batchedUpdates[id].Kv = append(batchedUpdates[id].Kv, kv)
+				if !p.subscribers[id].replication {
+					batchedUpdates[id].Kv = append(batchedUpdates[id].Kv, kv)
+					continue
+				}
+				if replKV == nil {
+					replKV = &pb.KV{
+						Key:       kv.Key,
+						Value:     kv.Value,
+						UserMeta:  kv.UserMeta,
+						Meta:      []byte{e.meta &^ (bitTxn | bitFinTxn | bitUserMetadata)},
+						ExpiresAt: e.ExpiresAt,
+						Version:   kv.Version,
+					}
+				}
+				batchedUpdates[id].Kv = append(batchedUpdates[id].Kv, replKV)
 			}
 		}
 	}
@@ -117,7 +207,17 @@ func (p *publisher) publishUpdates(reqs requests) {
 	}
 }
 
-func (p *publisher) newSubscriber(c *z.Closer, matches []pb.Match) subscriber {
+func (s subscriber) matchKey(key []byte) bool {
+	for _, m := range s.matchers {
+		if m.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *publisher) newSubscriber(c *z.Closer, matches []pb.Match, matchers []KeyMatcher,
+	replication bool) subscriber {
 	p.Lock()
 	defer p.Unlock()
 	ch := make(chan *pb.KVList, 1000)
@@ -126,19 +226,31 @@ func (p *publisher) newSubscriber(c *z.Closer, matches []pb.Match) subscriber {
 	p.nextID++
 	active := uint64(1)
 	s := subscriber{
-		active:    &active,
-		id:        id,
-		matches:   matches,
-		sendCh:    ch,
-		subCloser: c,
+		active:      &active,
+		id:          id,
+		matches:     matches,
+		matchers:    matchers,
+		sendCh:      ch,
+		subCloser:   c,
+		replication: replication,
 	}
 	p.subscribers[id] = s
 	for _, m := range matches {
 		p.indexer.AddMatch(m, id)
 	}
+	if len(matchers) > 0 {
+		p.filtered[id] = struct{}{}
+	}
 	return s
 }
 
+// replicationMatcher matches all the keys, but the internal ones.
+type replicationMatcher struct{}
+
+func (replicationMatcher) Match(key []byte) bool {
+	return !bytes.HasPrefix(key, badgerPrefix)
+}
+
 // cleanSubscribers stops all the subscribers. Ideally, It should be called while closing DB.
 func (p *publisher) cleanSubscribers() {
 	p.Lock()
@@ -148,6 +260,7 @@ func (p *publisher) cleanSubscribers() {
 			p.indexer.DeleteMatch(m, id)
 		}
 		delete(p.subscribers, id)
+		delete(p.filtered, id)
 		s.subCloser.SignalAndWait()
 	}
 }
@@ -161,6 +274,7 @@ func (p *publisher) deleteSubscriber(id uint64) {
 		}
 	}
 	delete(p.subscribers, id)
+	delete(p.filtered, id)
 }
 
 func (p *publisher) sendUpdates(reqs requests) {
@@ -19,6 +19,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"regexp"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -164,3 +165,56 @@ func TestMultiplePrefix(t *testing.T) {
 		wg.Wait()
 	})
 }
+
+func TestSubscribeMatchers(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		glob, err := KeyGlob("user/*/email")
+		require.NoError(t, err)
+		_, err = KeyGlob("[")
+		require.Error(t, err)
+
+		var mu sync.Mutex
+		var got []string
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var subWg sync.WaitGroup
+		subWg.Add(1)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			subWg.Done()
+			err := db.SubscribeMatchers(ctx, func(kvs *pb.KVList) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, kv := range kvs.GetKv() {
+					got = append(got, string(kv.Key))
+				}
+				if len(got) == 4 {
+					wg.Done()
+				}
+				return nil
+			}, KeyRange([]byte("b"), []byte("d")), KeyRegexp(regexp.MustCompile("^x[0-9]+$")), glob)
+			require.Equal(t, context.Canceled, err)
+		}()
+		subWg.Wait()
+		// Give the subscriber a moment to register.
+		time.Sleep(100 * time.Millisecond)
+		keys := []string{"a", "b", "c1", "d", "x12", "xy", "user/1/email", "user/1/name"}
+		for _, k := range keys {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(k), []byte("v"))
+			}))
+		}
+		wg.Wait()
+		cancel()
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, []string{"b", "c1", "x12", "user/1/email"}, got)
+	})
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		err := db.SubscribeMatchers(context.Background(), func(kvs *pb.KVList) error {
+			return nil
+		})
+		require.Equal(t, ErrInvalidRequest, err)
+	})
+}
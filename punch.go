@@ -0,0 +1,202 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// holeAlign is the alignment of the holes punched in value log files. Only the blocks which lie
+// completely within the value of a discarded entry are punched, so the header and key of the entry
+// stay intact, and the log file can still be iterated over.
+const holeAlign = 4 << 10
+
+// errPunchUnsupported is returned by punchHole if the OS or filesystem can't punch holes.
+var errPunchUnsupported = errors.New("Punching holes is not supported")
+
+// holeRange returns the range of the file which is punched for an entry whose value starts at
+// offset valueOff and has length vlen. The range is empty if the value doesn't span a whole block.
+func holeRange(valueOff, vlen int64) (int64, int64) {
+	start := (valueOff + holeAlign - 1) &^ (holeAlign - 1)
+	end := (valueOff + vlen) &^ (holeAlign - 1)
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// punchedChecksum returns the checksum of a value log entry marked with bitPunched, which has the
+// header h, and the key and value kv starting at offset valueOff-klen. The blocks of the hole range
+// of the value are taken as zeros, so that the checksum holds both before and after they are
+// punched.
+func punchedChecksum(h header, kv []byte, valueOff int64) uint32 {
+	var hbuf [maxHeaderSize]byte
+	hash := crc32.New(y.CastagnoliCrcTable)
+	y.Check2(hash.Write(hbuf[:h.Encode(hbuf[:])]))
+	start, end := holeRange(valueOff, int64(h.vlen))
+	s, e := int(h.klen)+int(start-valueOff), int(h.klen)+int(end-valueOff)
+	y.Check2(hash.Write(kv[:s]))
+	var zeros [holeAlign]byte
+	for i := s; i < e; i += holeAlign {
+		y.Check2(hash.Write(zeros[:]))
+	}
+	y.Check2(hash.Write(kv[e:]))
+	return hash.Sum32()
+}
+
+// isValueLog returns true if lf is a value log file. Only their entries can be punched out.
+func (lf *logFile) isValueLog() bool {
+	return strings.HasSuffix(lf.path, ".vlog")
+}
+
+// markPunched sets bitPunched in the header of the entry at offset, whose encoded length, without
+// its checksum, is sz, and rewrites its checksum accordingly. The marked entries are skipped when
+// the log file is iterated over, while a value which is zeroed out without the mark, by a torn
+// write, is reported as corrupted.
+func (lf *logFile) markPunched(offset, sz uint32) error {
+	buf := lf.Data[offset : offset+sz]
+	var h header
+	hlen := h.Decode(buf)
+	h.meta |= bitPunched
+	valueOff := int64(offset) + int64(hlen) + int64(h.klen)
+	var crcBuf [crc32.Size]byte
+	binary.BigEndian.PutUint32(crcBuf[:], punchedChecksum(h, buf[hlen:], valueOff))
+	if _, err := lf.Fd.WriteAt(crcBuf[:], int64(offset+sz)); err != nil {
+		return y.Wrapf(err, "while marking the entry at offset %d of %s", offset, lf.path)
+	}
+	_, err := lf.Fd.WriteAt([]byte{h.meta}, int64(offset))
+	return y.Wrapf(err, "while marking the entry at offset %d of %s", offset, lf.path)
+}
+
+// punchHoles reclaims the space used by the discarded entries of the given log file, by punching
+// holes in the file. Unlike rewrite, it doesn't move the live entries nor remove the file.
+func (vlog *valueLog) punchHoles(ctx context.Context, f *logFile, res *ValueLogGCResult) error {
+	vlog.filesLock.RLock()
+	for _, fid := range vlog.filesToBeDeleted {
+		if fid == f.fid {
+			vlog.filesLock.RUnlock()
+			return errors.Errorf("value log file already marked for deletion fid: %d", fid)
+		}
+	}
+	maxFid := vlog.maxFid
+	y.AssertTruef(uint32(f.fid) < maxFid, "fid to punch: %d. Current max fid: %d", f.fid, maxFid)
+	vlog.filesLock.RUnlock()
+
+	// Don't let the file be closed or removed while we punch holes in it.
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	before, err := diskUsage(f.Fd)
+	if err != nil {
+		return err
+	}
+	vlog.opt.logw(INFO, "Punching holes in value log file", "fid", f.fid)
+	// The entries are marked before their values are punched out, so that the holes are never
+	// taken for a corruption.
+	var holes [][2]int64
+	fe := func(e Entry, vp valuePointer) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ts := vlog.db.orc.readTs()
+		vs, err := vlog.db.get(y.KeyWithTs(y.ParseKey(e.Key), ts))
+		if err != nil {
+			return err
+		}
+		if !discardEntry(e, vs, vlog.db) {
+			var cur valuePointer
+			cur.Decode(vs.Value)
+			// Same as in rewrite, only the entry the LSM tree points to is live.
+			if cur.Fid == f.fid && cur.Offset == e.offset {
+				return nil
+			}
+		}
+		valueOff := int64(e.offset) + int64(e.hlen) + int64(len(e.Key))
+		start, end := holeRange(valueOff, int64(len(e.Value)))
+		if start == end {
+			return nil
+		}
+		holes = append(holes, [2]int64{start, end})
+		return f.markPunched(vp.Offset, vp.Len-crc32.Size)
+	}
+	if _, err := f.iterate(vlog.opt.ReadOnly, 0, fe); err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	if len(holes) == 0 {
+		return ErrNoRewrite
+	}
+	if err := f.Fd.Sync(); err != nil {
+		return y.Wrapf(err, "while syncing the marks of the punched entries of %s", f.path)
+	}
+	var punched int
+	for _, hole := range holes {
+		if err := punchHole(f.Fd, hole[0], hole[1]-hole[0]); err != nil {
+			if err == errPunchUnsupported && punched > 0 {
+				return errors.Errorf("Unable to punch holes in %s anymore", f.path)
+			}
+			return err
+		}
+		punched++
+	}
+
+	after, err := diskUsage(f.Fd)
+	if err != nil {
+		return err
+	}
+	vlog.opt.logw(INFO, "Punched holes in value log file", "fid", f.fid, "holes", punched,
+		"bytes_reclaimed", before-after)
+	res.FilesPunched++
+	if before > after {
+		res.BytesReclaimed += before - after
+	}
+	return nil
+}
+
+// punchOrRewrite reclaims the space of the discarded entries of the log file, by punching holes in
+// it if ValueLogPunchHoles is set and supported, or by rewriting it otherwise.
+func (vlog *valueLog) punchOrRewrite(ctx context.Context, f *logFile,
+	res *ValueLogGCResult) error {
+	if vlog.opt.ValueLogPunchHoles && atomic.LoadInt32(&vlog.noPunch) == 0 {
+		err := vlog.punchHoles(ctx, f, res)
+		if err != errPunchUnsupported {
+			return err
+		}
+		vlog.opt.Warningf("Unable to punch holes in value log files. Rewriting them instead.")
+		atomic.StoreInt32(&vlog.noPunch, 1)
+	}
+	size := int64(atomic.LoadUint32(&f.size))
+	moved, movedSize, err := vlog.rewrite(ctx, f)
+	if err != nil {
+		return err
+	}
+	res.FilesRewritten++
+	res.EntriesMoved += moved
+	if size > movedSize {
+		res.BytesReclaimed += size - movedSize
+	}
+	return nil
+}
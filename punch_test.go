@@ -0,0 +1,171 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHoleRange(t *testing.T) {
+	start, end := holeRange(100, holeAlign)
+	require.Equal(t, start, end)
+	start, end = holeRange(100, 3*holeAlign)
+	require.Equal(t, int64(holeAlign), start)
+	require.Equal(t, int64(3*holeAlign), end)
+}
+
+func TestZeroedWALEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := Open(getTestOptions(dir).WithValueLogPunchHoles(true))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	val := make([]byte, 3*holeAlign)
+	rand.Read(val)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("key%d", i)), val)
+		}))
+	}
+	wal := db.mt.wal
+	var offsets []uint32
+	_, err = wal.iterate(true, 0, func(e Entry, vp valuePointer) error {
+		offsets = append(offsets, vp.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, offsets, 3)
+
+	// A page of the second entry is lost, and reads as zeros. The WAL is truncated there, instead
+	// of skipping the entry as if its value was punched out.
+	start, end := holeRange(int64(offsets[1])+64, int64(len(val))-64)
+	require.True(t, start < end)
+	copy(wal.Data[start:start+holeAlign], make([]byte, holeAlign))
+	var n int
+	validEnd, err := wal.iterate(true, 0, func(Entry, valuePointer) error {
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, offsets[1], validEnd)
+}
+
+func TestValueGCPunchHoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+	opt.ValueLogPunchHoles = true
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sz := 32 << 10
+	vals := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key%d", i)
+		v := make([]byte, sz)
+		rand.Read(v)
+		vals[k] = v
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(k), v))
+		}))
+	}
+	// Overwrite every other key.
+	for i := 0; i < 100; i += 2 {
+		k := fmt.Sprintf("key%d", i)
+		vals[k] = []byte("small")
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(k), vals[k]))
+		}))
+	}
+
+	db.vlog.filesLock.RLock()
+	fid := db.vlog.sortedFids()[0]
+	lf := db.vlog.filesMap[fid]
+	db.vlog.discardStats.Update(fid, int64(lf.size/2))
+	db.vlog.filesLock.RUnlock()
+
+	res, err := db.RunValueLogGC(0.4)
+	require.NoError(t, err)
+	if res.FilesRewritten == 1 {
+		t.Skip("The filesystem doesn't support punching holes")
+	}
+	require.Equal(t, 1, res.FilesPunched)
+	require.Equal(t, 0, res.EntriesMoved)
+	require.True(t, res.BytesReclaimed > 0)
+
+	// The punched entries are marked, and skipped when the file is iterated over.
+	var marked, unmarked, live int
+	for off := uint32(vlogHeaderSize); off < lf.size; {
+		var h header
+		hlen := h.Decode(lf.Data[off:])
+		if h.klen == 0 {
+			break
+		}
+		switch {
+		case h.meta&bitPunched > 0:
+			marked++
+		case h.meta&bitFinTxn == 0:
+			unmarked++
+		}
+		off += uint32(hlen) + h.klen + h.vlen + crc32.Size
+	}
+	_, err = lf.iterate(true, 0, func(Entry, valuePointer) error {
+		live++
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotZero(t, marked)
+	require.Equal(t, unmarked, live)
+
+	check := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for k, v := range vals {
+				item, err := txn.Get([]byte(k))
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(v, getItemValue(t, item)), "key: %s", k)
+			}
+			return nil
+		}))
+	}
+	check()
+
+	// The punched file can still be rewritten. The punched entries are skipped.
+	db.vlog.filesLock.RLock()
+	_, ok := db.vlog.filesMap[fid]
+	db.vlog.filesLock.RUnlock()
+	require.True(t, ok)
+	moved, _, err := db.vlog.rewrite(context.Background(), lf)
+	require.NoError(t, err)
+	require.True(t, moved > 0)
+	check()
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// AppliedIndex is a persisted cell holding the index of the last raft entry applied to the state
+// machine stored in the DB. It should be updated along with the changes of the entries, in the
+// same Txn or WriteBatch, so that it is persisted with them.
+type AppliedIndex struct {
+	db  *DB
+	key []byte
+}
+
+// AppliedIndex returns the applied index cell stored under key.
+func (db *DB) AppliedIndex(key []byte) *AppliedIndex {
+	return &AppliedIndex{db: db, key: y.SafeCopy(nil, key)}
+}
+
+// Get returns the applied index, or 0 if it was never set.
+func (a *AppliedIndex) Get() (uint64, error) {
+	var index uint64
+	err := a.db.View(func(txn *Txn) error {
+		item, err := txn.Get(a.key)
+		if err == ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return errors.Errorf("Invalid applied index of %d bytes", len(val))
+			}
+			index = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	return index, err
+}
+
+func encodeIndex(index uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], index)
+	return buf[:]
+}
+
+// SetTxn sets the applied index in txn, so that it is committed atomically with the other writes
+// of txn.
+func (a *AppliedIndex) SetTxn(txn *Txn, index uint64) error {
+	return txn.Set(a.key, encodeIndex(index))
+}
+
+// Flush sets the applied index as the last write of wb, and flushes wb. The transactions of a
+// WriteBatch are written in order, so once the index is persisted, all the writes of wb are too.
+func (a *AppliedIndex) Flush(wb *WriteBatch, index uint64) error {
+	if err := wb.Set(a.key, encodeIndex(index)); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// InstallSnapshot atomically replaces the keys in [start, end) with the latest versions of the keys
+// read from r, which is in the format written by Stream.Backup. An empty end leaves the range
+// unbounded. The readers see either all the old keys or all the new ones: the transactions started
+// during the install wait for it, like for a commit. The transactions running concurrently don't
+// conflict with the install. ErrInvalidRequest is returned if r has keys outside of the range.
+//
+// If applied isn't nil, it is set to index along with the keys. It is set to 0 before they are
+// written, so that it reads 0 after a restart if the install was interrupted by a crash, or if it
+// failed. The range is partially replaced in those cases, and the snapshot must be installed again.
+//
+// InstallSnapshot can't be used in managed mode.
+func (db *DB) InstallSnapshot(r io.Reader, start, end []byte, applied *AppliedIndex,
+	index uint64) error {
+	if db.opt.managedTxns {
+		return ErrManagedTxn
+	}
+	inRange := rangeMatcher{start: start, end: end}
+
+	// Reserve two versions: the old keys are deleted at ts, and the new ones written at ts+1. The
+	// transactions started from now on read at ts+1 or later, so they wait for both to be done.
+	o := db.orc
+	o.Lock()
+	readTs := o.nextTxnTs - 1
+	ts := o.nextTxnTs
+	o.nextTxnTs += 2
+	o.readMark.Begin(readTs)
+	o.txnMark.Begin(ts)
+	o.txnMark.Begin(ts + 1)
+	o.Unlock()
+	defer func() {
+		o.txnMark.Done(ts)
+		o.txnMark.Done(ts + 1)
+	}()
+	y.Check(o.txnMark.WaitForMark(context.Background(), readTs))
+	txn := db.newTransaction(false, true)
+	txn.readTs = readTs
+	defer txn.Discard()
+
+	isApplied := func(key []byte) bool {
+		return applied != nil && bytes.Equal(key, applied.key)
+	}
+	ldr := db.NewKVLoader(16)
+	if applied != nil {
+		if err := ldr.Set(&pb.KV{Key: applied.key, Value: encodeIndex(0), Version: ts}); err != nil {
+			return err
+		}
+	}
+	opt := DefaultIteratorOptions
+	opt.PrefetchValues = false
+	it := txn.NewIterator(opt)
+	for it.Seek(start); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if !inRange.Match(key) {
+			break
+		}
+		if isApplied(key) {
+			continue
+		}
+		kv := &pb.KV{Key: y.SafeCopy(nil, key), Version: ts, Meta: []byte{bitDelete}}
+		if err := ldr.Set(kv); err != nil {
+			it.Close()
+			return err
+		}
+	}
+	it.Close()
+
+	var lastKey []byte
+	err := readFrom(r, func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			// The versions of a key are sorted from the latest one. Only it is installed.
+			if kv.StreamDone || bytes.Equal(kv.Key, lastKey) {
+				continue
+			}
+			lastKey = kv.Key
+			if !inRange.Match(kv.Key) {
+				return ErrInvalidRequest
+			}
+			var meta byte
+			if len(kv.Meta) > 0 {
+				meta = kv.Meta[0]
+			}
+			if isDeletedOrExpired(meta, kv.ExpiresAt) || isApplied(kv.Key) {
+				continue
+			}
+			if err := ldr.Set(&pb.KV{
+				Key:       kv.Key,
+				Value:     kv.Value,
+				UserMeta:  kv.UserMeta,
+				ExpiresAt: kv.ExpiresAt,
+				Version:   ts + 1,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Wait for the pending writes, and keep the first error.
+		_ = ldr.Finish()
+		return err
+	}
+	if applied != nil {
+		kv := &pb.KV{Key: applied.key, Value: encodeIndex(index), Version: ts + 1}
+		if err := ldr.Set(kv); err != nil {
+			return err
+		}
+	}
+	return ldr.Finish()
+}
+
+// EntryLog stores the entries of a log, like a raft log, keyed by their index under a prefix. It
+// keeps the entries contiguous: there is never a hole between its first and last index, even if
+// the process crashes while it is written to. The indices start at 1. EntryLog is safe for
+// concurrent use, but the keys under its prefix must not be written otherwise.
+//
+// EntryLog can't be used in managed mode.
+type EntryLog struct {
+	sync.RWMutex
+	db     *DB
+	prefix []byte
+	// first and last are the first and the last index of the entries. last is first-1 if the log
+	// is empty.
+	first, last uint64
+}
+
+// OpenEntryLog opens the entry log stored under prefix. The log is empty if it doesn't exist.
+func (db *DB) OpenEntryLog(prefix []byte) (*EntryLog, error) {
+	if db.opt.managedTxns {
+		return nil, ErrManagedTxn
+	}
+	if len(prefix) == 0 {
+		return nil, ErrEmptyKey
+	}
+	l := &EntryLog{db: db, prefix: y.SafeCopy(nil, prefix), first: 1}
+	err := db.View(func(txn *Txn) error {
+		// The key at the prefix holds the first index, once the log was compacted.
+		item, err := txn.Get(l.prefix)
+		switch {
+		case err == nil:
+			if err := item.Value(func(val []byte) error {
+				if len(val) != 8 {
+					return errorf(CodeCorruption, "Invalid first index of the entry log %q: %x",
+						l.prefix, val)
+				}
+				l.first = binary.BigEndian.Uint64(val)
+				return nil
+			}); err != nil {
+				return err
+			}
+		case err != ErrKeyNotFound:
+			return err
+		}
+
+		opt := DefaultIteratorOptions
+		opt.PrefetchValues = false
+		opt.Prefix = l.prefix
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		it.Seek(l.key(0))
+		if !it.Valid() {
+			l.last = l.first - 1
+			return nil
+		}
+		// Compact removes the entries before writing the first index, so the entries can start
+		// after it.
+		if first := l.index(it.Item().Key()); first > l.first {
+			l.first = first
+		}
+
+		opt.Reverse = true
+		rit := txn.NewIterator(opt)
+		defer rit.Close()
+		rit.Seek(l.key(1<<64 - 1))
+		l.last = l.index(rit.Item().Key())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *EntryLog) key(index uint64) []byte {
+	key := make([]byte, len(l.prefix)+8)
+	copy(key, l.prefix)
+	binary.BigEndian.PutUint64(key[len(l.prefix):], index)
+	return key
+}
+
+func (l *EntryLog) index(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(l.prefix):])
+}
+
+// FirstIndex returns the index of the first entry of the log. The entries before it were removed by
+// Compact.
+func (l *EntryLog) FirstIndex() uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.first
+}
+
+// LastIndex returns the index of the last entry of the log. It is FirstIndex()-1 if the log is
+// empty.
+func (l *EntryLog) LastIndex() uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.last
+}
+
+// Entries returns the entries in [lo, hi). It returns ErrLogCompacted if lo is before the first
+// index, and ErrLogUnavailable if hi is after the last index plus one.
+func (l *EntryLog) Entries(lo, hi uint64) ([][]byte, error) {
+	l.RLock()
+	defer l.RUnlock()
+	if lo < l.first {
+		return nil, ErrLogCompacted
+	}
+	if hi > l.last+1 || lo > hi {
+		return nil, ErrLogUnavailable
+	}
+	entries := make([][]byte, 0, hi-lo)
+	err := l.db.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		opt.Prefix = l.prefix
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		next := lo
+		for it.Seek(l.key(lo)); it.Valid() && next < hi; it.Next() {
+			item := it.Item()
+			if index := l.index(item.Key()); index != next {
+				return errors.Errorf("Entry %d is missing from the entry log", next)
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, val)
+			next++
+		}
+		if next < hi {
+			return errors.Errorf("Entry %d is missing from the entry log", next)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Append writes the entries at index, index+1 and so on. The entries at and after index are
+// replaced, like when a raft follower gets entries conflicting with its log. The entries before
+// the first index are skipped. ErrLogHole is returned if index is after the last index plus one.
+func (l *EntryLog) Append(index uint64, entries ...[]byte) error {
+	l.Lock()
+	defer l.Unlock()
+	if index > l.last+1 {
+		return ErrLogHole
+	}
+	if index < l.first {
+		if index+uint64(len(entries)) <= l.first {
+			return nil
+		}
+		entries = entries[l.first-index:]
+		index = l.first
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// The transactions of a WriteBatch are written in order. The entries being replaced are
+	// deleted first, from the last one, and then the new entries are written in order, so whatever
+	// part of them is written, there is no hole, and no old entry is left after a new one.
+	wb := l.db.NewWriteBatch()
+	defer wb.Cancel()
+	for i := l.last; i+1 > index; i-- {
+		if err := wb.Delete(l.key(i)); err != nil {
+			return err
+		}
+	}
+	for i, e := range entries {
+		if err := wb.Set(l.key(index+uint64(i)), e); err != nil {
+			return err
+		}
+	}
+	last := index + uint64(len(entries)) - 1
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	l.last = last
+	return nil
+}
+
+// Compact removes the entries before index, which becomes the first index. It returns
+// ErrLogUnavailable if index is after the last index plus one.
+func (l *EntryLog) Compact(index uint64) error {
+	l.Lock()
+	defer l.Unlock()
+	if index <= l.first {
+		return nil
+	}
+	if index > l.last+1 {
+		return ErrLogUnavailable
+	}
+
+	// The entries are deleted from the first one, and then the first index is written, so
+	// whatever part of them is written, there is no hole.
+	wb := l.db.NewWriteBatch()
+	defer wb.Cancel()
+	for i := l.first; i < index; i++ {
+		if err := wb.Delete(l.key(i)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Set(l.prefix, encodeIndex(index)); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	l.first = index
+	return nil
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppliedIndex(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		applied := db.AppliedIndex([]byte("applied"))
+		index, err := applied.Get()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), index)
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			if err := txn.Set([]byte("foo"), []byte("bar")); err != nil {
+				return err
+			}
+			return applied.SetTxn(txn, 5)
+		}))
+		index, err = applied.Get()
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), index)
+
+		wb := db.NewWriteBatch()
+		defer wb.Cancel()
+		require.NoError(t, wb.Set([]byte("foo"), []byte("baz")))
+		require.NoError(t, applied.Flush(wb, 6))
+		index, err = applied.Get()
+		require.NoError(t, err)
+		require.Equal(t, uint64(6), index)
+	})
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	leader, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, leader.Close()) }()
+
+	require.NoError(t, leader.Update(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("data/%02d", i))
+			if err := txn.Set(key, []byte("old")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// The snapshot has the latest versions of the keys, and no deleted key.
+	require.NoError(t, leader.Update(func(txn *Txn) error {
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("data/%02d", i))
+			if err := txn.Set(key, []byte("new")); err != nil {
+				return err
+			}
+		}
+		return txn.Delete([]byte("data/09"))
+	}))
+	var snapshot bytes.Buffer
+	stream := leader.NewStream()
+	stream.Prefix = []byte("data/")
+	_, err = stream.Backup(&snapshot, 0)
+	require.NoError(t, err)
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, key := range []string{"a", "data/05", "data/50", "data/99", "z"} {
+				if err := txn.Set([]byte(key), []byte("follower")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		applied := db.AppliedIndex([]byte("applied"))
+		data := snapshot.Bytes()
+		require.NoError(t, db.InstallSnapshot(bytes.NewReader(data), []byte("data/"),
+			[]byte("data0"), applied, 42))
+
+		index, err := applied.Get()
+		require.NoError(t, err)
+		require.Equal(t, uint64(42), index)
+		got := make(map[string]string)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				val, err := it.Item().ValueCopy(nil)
+				require.NoError(t, err)
+				got[string(it.Item().Key())] = string(val)
+			}
+			return nil
+		}))
+		require.Len(t, got, 12)
+		require.Equal(t, "follower", got["a"])
+		require.Equal(t, "follower", got["z"])
+		require.Equal(t, "new", got["data/00"])
+		require.Equal(t, "old", got["data/05"])
+		require.NotContains(t, got, "data/09")
+		require.NotContains(t, got, "data/50")
+
+		// The keys out of the range are rejected.
+		err = db.InstallSnapshot(bytes.NewReader(data), []byte("a"), []byte("b"), nil, 0)
+		require.Equal(t, ErrInvalidRequest, err)
+	})
+}
+
+func TestEntryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	l, err := db.OpenEntryLog([]byte("log"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), l.FirstIndex())
+	require.Equal(t, uint64(0), l.LastIndex())
+	require.Equal(t, ErrLogHole, l.Append(2, []byte("e2")))
+
+	entry := func(i int) []byte { return []byte(fmt.Sprintf("e%d", i)) }
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, l.Append(uint64(i), entry(i)))
+	}
+	entries, err := l.Entries(3, 6)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{entry(3), entry(4), entry(5)}, entries)
+	_, err = l.Entries(5, 12)
+	require.Equal(t, ErrLogUnavailable, err)
+
+	// Appending before the last entry replaces the entries after it.
+	require.NoError(t, l.Append(8, []byte("x8")))
+	require.Equal(t, uint64(8), l.LastIndex())
+	entries, err = l.Entries(7, 9)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{entry(7), []byte("x8")}, entries)
+
+	require.NoError(t, l.Compact(4))
+	require.Equal(t, uint64(4), l.FirstIndex())
+	_, err = l.Entries(3, 5)
+	require.Equal(t, ErrLogCompacted, err)
+	// The entries before the first index are skipped.
+	require.NoError(t, l.Append(2, entry(2), entry(3), entry(4), entry(5)))
+	require.Equal(t, uint64(5), l.LastIndex())
+
+	require.NoError(t, db.Close())
+	db, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	l, err = db.OpenEntryLog([]byte("log"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), l.FirstIndex())
+	require.Equal(t, uint64(5), l.LastIndex())
+	entries, err = l.Entries(4, 6)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{entry(4), entry(5)}, entries)
+
+	// A log compacted up to its end is empty, and keeps its first index.
+	require.NoError(t, l.Compact(6))
+	l, err = db.OpenEntryLog([]byte("log"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), l.FirstIndex())
+	require.Equal(t, uint64(5), l.LastIndex())
+	require.NoError(t, l.Append(6, entry(6)))
+}
+
+func TestEntryLogCorruptFirstIndex(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("log"), []byte("bad"))
+		}))
+		_, err := db.OpenEntryLog([]byte("log"))
+		require.Error(t, err)
+		require.Equal(t, CodeCorruption, ErrorCode(err))
+	})
+}
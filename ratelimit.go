@@ -0,0 +1,280 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// maxLimiterRetries is the number of times a rate limiter retries its transaction on a conflict.
+const maxLimiterRetries = 100
+
+// maxBucketTTL bounds the TTL of a token bucket, which would overflow a time.Duration for tiny
+// rates.
+const maxBucketTTL = 100 * 365 * 24 * time.Hour
+
+// RateLimiter is a fixed-window rate limiter persisted in Badger. Each key gets its own counter
+// per window, stored under the limiter's prefix with a TTL, so expired windows are removed by
+// compactions without any cleanup. A RateLimiter is safe for concurrent use, because the counters
+// are updated in conflict-checked transactions.
+type RateLimiter struct {
+	db     *DB
+	prefix []byte
+	limit  uint64
+	window time.Duration
+	now    func() time.Time
+}
+
+// NewRateLimiter returns a RateLimiter which allows at most limit events per window for each
+// key. The counters are stored under the given prefix, which should not be used for other data.
+//
+// The rate limiter relies on conflict detection to serialize concurrent updates. So, it can not
+// be used with managed transactions or with DetectConflicts set to false.
+func (db *DB) NewRateLimiter(prefix []byte, limit uint64, window time.Duration) (
+	*RateLimiter, error) {
+	if err := checkLimiterDB(db); err != nil {
+		return nil, err
+	}
+	if limit == 0 || window < time.Second {
+		return nil, errors.Errorf("invalid rate limit %d per %s, window must be at least 1s",
+			limit, window)
+	}
+	return &RateLimiter{
+		db:     db,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+	}, nil
+}
+
+func checkLimiterDB(db *DB) error {
+	switch {
+	case db.opt.managedTxns:
+		return ErrManagedTxn
+	case !db.opt.DetectConflicts:
+		return errors.New("Rate limiters need DetectConflicts to be enabled")
+	}
+	return nil
+}
+
+// counterKey returns the key of the counter for the current window, and the time at which the
+// window ends. The key is length-prefixed, so that the counters of a key never share a prefix
+// with those of another key.
+func (rl *RateLimiter) counterKey(key []byte) ([]byte, time.Time) {
+	now := rl.now()
+	idx := now.UnixNano() / int64(rl.window)
+	end := time.Unix(0, (idx+1)*int64(rl.window))
+
+	k := make([]byte, 0, len(rl.prefix)+4+len(key)+8)
+	k = append(k, rl.prefix...)
+	k = append(k, y.U32ToBytes(uint32(len(key)))...)
+	k = append(k, key...)
+	k = append(k, y.U64ToBytes(uint64(idx))...)
+	return k, end
+}
+
+func readUint64(txn *Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
+	switch {
+	case err == ErrKeyNotFound:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	var num uint64
+	err = item.Value(func(v []byte) error {
+		if len(v) != 8 {
+			return errors.Errorf("invalid counter of length %d for key %q", len(v), key)
+		}
+		num = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	return num, err
+}
+
+// updateWithRetry runs fn in an update transaction, retrying it if the transaction conflicts.
+func updateWithRetry(db *DB, fn func(txn *Txn) error) error {
+	var err error
+	for i := 0; i < maxLimiterRetries; i++ {
+		if err = db.Update(fn); !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// Allow is a shorthand for AllowN(key, 1).
+func (rl *RateLimiter) Allow(key []byte) (bool, error) {
+	return rl.AllowN(key, 1)
+}
+
+// AllowN reports whether n events may happen for the key in the current window. If they may, the
+// events are counted against the limit of the key.
+func (rl *RateLimiter) AllowN(key []byte, n uint64) (bool, error) {
+	var allowed bool
+	err := updateWithRetry(rl.db, func(txn *Txn) error {
+		allowed = false
+		ck, end := rl.counterKey(key)
+		count, err := readUint64(txn, ck)
+		if err != nil {
+			return err
+		}
+		if count+n > rl.limit || count+n < count {
+			return nil
+		}
+		allowed = true
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], count+n)
+		e := NewEntry(ck, buf[:])
+		// ExpiresAt has a granularity of seconds. Round it up so the counter outlives the window.
+		e.ExpiresAt = uint64(end.Add(time.Second - 1).Unix())
+		return txn.SetEntry(e)
+	})
+	return allowed, err
+}
+
+// Remaining returns the number of events still allowed for the key in the current window.
+func (rl *RateLimiter) Remaining(key []byte) (uint64, error) {
+	var count uint64
+	err := rl.db.View(func(txn *Txn) error {
+		ck, _ := rl.counterKey(key)
+		var err error
+		count, err = readUint64(txn, ck)
+		return err
+	})
+	if err != nil || count >= rl.limit {
+		return 0, err
+	}
+	return rl.limit - count, nil
+}
+
+// TokenBucket is a token bucket rate limiter persisted in Badger. Each key has its own bucket
+// which holds up to capacity tokens and is refilled at a constant rate. The state of a bucket is
+// stored with a TTL equal to the time it takes to refill it completely, so idle buckets are
+// removed from the DB. Like RateLimiter, a TokenBucket is safe for concurrent use.
+type TokenBucket struct {
+	db       *DB
+	prefix   []byte
+	capacity float64
+	rate     float64 // Tokens added per second.
+	now      func() time.Time
+}
+
+// NewTokenBucket returns a TokenBucket with the given capacity, refilled with rate tokens per
+// second. The buckets are stored under the given prefix, which should not be used for other data.
+//
+// The token bucket relies on conflict detection to serialize concurrent updates. So, it can not
+// be used with managed transactions or with DetectConflicts set to false.
+func (db *DB) NewTokenBucket(prefix []byte, capacity uint64, rate float64) (*TokenBucket, error) {
+	if err := checkLimiterDB(db); err != nil {
+		return nil, err
+	}
+	if capacity == 0 || rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return nil, errors.Errorf("invalid token bucket with capacity %d and rate %f",
+			capacity, rate)
+	}
+	return &TokenBucket{
+		db:       db,
+		prefix:   prefix,
+		capacity: float64(capacity),
+		rate:     rate,
+		now:      time.Now,
+	}, nil
+}
+
+func (tb *TokenBucket) bucketKey(key []byte) []byte {
+	k := make([]byte, 0, len(tb.prefix)+len(key))
+	k = append(k, tb.prefix...)
+	return append(k, key...)
+}
+
+// tokens returns the number of tokens in the bucket stored at key, at time now.
+func (tb *TokenBucket) tokens(txn *Txn, key []byte, now time.Time) (float64, error) {
+	item, err := txn.Get(key)
+	switch {
+	case err == ErrKeyNotFound:
+		return tb.capacity, nil
+	case err != nil:
+		return 0, err
+	}
+	var tokens float64
+	err = item.Value(func(v []byte) error {
+		if len(v) != 16 {
+			return errors.Errorf("invalid token bucket of length %d for key %q", len(v), key)
+		}
+		tokens = math.Float64frombits(binary.BigEndian.Uint64(v[:8]))
+		last := time.Unix(0, int64(binary.BigEndian.Uint64(v[8:])))
+		if elapsed := now.Sub(last); elapsed > 0 {
+			tokens += elapsed.Seconds() * tb.rate
+		}
+		return nil
+	})
+	return math.Min(tokens, tb.capacity), err
+}
+
+// Take is a shorthand for TakeN(key, 1).
+func (tb *TokenBucket) Take(key []byte) (bool, error) {
+	return tb.TakeN(key, 1)
+}
+
+// TakeN takes n tokens from the bucket of the key. It returns false, without taking any tokens,
+// if the bucket doesn't have enough of them.
+func (tb *TokenBucket) TakeN(key []byte, n uint64) (bool, error) {
+	bk := tb.bucketKey(key)
+	var taken bool
+	err := updateWithRetry(tb.db, func(txn *Txn) error {
+		taken = false
+		now := tb.now()
+		tokens, err := tb.tokens(txn, bk, now)
+		if err != nil {
+			return err
+		}
+		if tokens < float64(n) {
+			return nil
+		}
+		taken = true
+		tokens -= float64(n)
+
+		var buf [16]byte
+		binary.BigEndian.PutUint64(buf[:8], math.Float64bits(tokens))
+		binary.BigEndian.PutUint64(buf[8:], uint64(now.UnixNano()))
+		e := NewEntry(bk, buf[:])
+		// Once the bucket is full again, its state is the same as that of a missing bucket.
+		refill := (tb.capacity - tokens) / tb.rate * float64(time.Second)
+		ttl := time.Duration(math.Min(refill, float64(maxBucketTTL)))
+		e.ExpiresAt = uint64(now.Add(ttl + time.Second).Unix())
+		return txn.SetEntry(e)
+	})
+	return taken, err
+}
+
+// Tokens returns the number of tokens currently available in the bucket of the key.
+func (tb *TokenBucket) Tokens(key []byte) (float64, error) {
+	var tokens float64
+	err := tb.db.View(func(txn *Txn) error {
+		var err error
+		tokens, err = tb.tokens(txn, tb.bucketKey(key), tb.now())
+		return err
+	})
+	return tokens, err
+}
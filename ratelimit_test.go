@@ -0,0 +1,139 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		rl, err := db.NewRateLimiter([]byte("rl/"), 10, time.Minute)
+		require.NoError(t, err)
+		now := time.Now().Truncate(time.Minute)
+		rl.now = func() time.Time { return now }
+
+		var allowed int64
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := rl.Allow([]byte("tenant1"))
+				require.NoError(t, err)
+				if ok {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int64(10), allowed)
+
+		rem, err := rl.Remaining([]byte("tenant1"))
+		require.NoError(t, err)
+		require.Zero(t, rem)
+		rem, err = rl.Remaining([]byte("tenant2"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), rem)
+
+		ok, err := rl.AllowN([]byte("tenant2"), 11)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// A new window resets the limit.
+		now = now.Add(time.Minute)
+		ok, err = rl.Allow([]byte("tenant1"))
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		_, err := db.NewTokenBucket([]byte("tb/"), 5, 0)
+		require.Error(t, err)
+
+		tb, err := db.NewTokenBucket([]byte("tb/"), 5, 1)
+		require.NoError(t, err)
+		now := time.Now()
+		tb.now = func() time.Time { return now }
+
+		key := []byte("tenant")
+		ok, err := tb.TakeN(key, 5)
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = tb.Take(key)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		now = now.Add(2 * time.Second)
+		tokens, err := tb.Tokens(key)
+		require.NoError(t, err)
+		require.InDelta(t, 2.0, tokens, 0.001)
+
+		ok, err = tb.TakeN(key, 2)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		// The bucket never holds more than its capacity.
+		now = now.Add(time.Hour)
+		tokens, err = tb.Tokens(key)
+		require.NoError(t, err)
+		require.Equal(t, 5.0, tokens)
+	})
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		rl, err := db.NewRateLimiter([]byte("rl/"), 10, time.Minute)
+		require.NoError(t, err)
+		// The counters of a key don't share a prefix with those of a longer key.
+		k1, _ := rl.counterKey([]byte("tenant"))
+		k2, _ := rl.counterKey([]byte("tenant1"))
+		require.False(t, bytes.HasPrefix(k2, k1[:len(k1)-8]))
+	})
+}
+
+func TestTokenBucketTinyRate(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		tb, err := db.NewTokenBucket([]byte("tb/"), 5, 1e-300)
+		require.NoError(t, err)
+
+		key := []byte("tenant")
+		ok, err := tb.TakeN(key, 5)
+		require.NoError(t, err)
+		require.True(t, ok)
+		// The bucket doesn't expire, which would refill it.
+		ok, err = tb.Take(key)
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get(tb.bucketKey(key))
+			require.NoError(t, err)
+			now := time.Now()
+			require.Greater(t, item.ExpiresAt(), uint64(now.Unix()))
+			require.LessOrEqual(t, item.ExpiresAt(), uint64(now.Add(maxBucketTTL).Unix())+1)
+			return nil
+		}))
+	})
+}
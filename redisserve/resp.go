@@ -0,0 +1,122 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisserve
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxArgs and maxBulkLen bound the size of a request, so that a bad client can't make the
+	// server allocate too much memory.
+	maxArgs    = 1 << 20
+	maxBulkLen = 512 << 20
+)
+
+// errProtocol is returned for a request which isn't valid RESP. The connection is closed after it.
+var errProtocol = errors.New("Protocol error")
+
+// readCommand reads a command, either as an array of bulk strings, or inline as a line of
+// arguments separated by spaces.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, errProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		sz, err := strconv.Atoi(string(line[1:]))
+		if err != nil || sz < 0 || sz > maxBulkLen {
+			return nil, errProtocol
+		}
+		buf := make([]byte, sz+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(buf, []byte("\r\n")) {
+			return nil, errProtocol
+		}
+		args = append(args, buf[:sz])
+	}
+	return args, nil
+}
+
+// readLine reads a line ending with \r\n, or \n for the inline commands, without its ending.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// respWriter writes the replies of the commands.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) err(msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func (w respWriter) int(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w respWriter) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
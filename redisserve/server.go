@@ -0,0 +1,572 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redisserve serves a Badger DB over the Redis protocol (RESP), so that Redis clients can
+// use it as a persistent cache. It supports the GET, SET, DEL, EXPIRE, TTL, MGET and SCAN
+// commands, along with PING, ECHO and QUIT.
+//
+//	srv := redisserve.NewServer(db)
+//	go srv.ListenAndServe(":6379")
+//	defer srv.Close()
+package redisserve
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe once Close was called.
+var ErrServerClosed = errors.New("redisserve: Server closed")
+
+const (
+	// maxCursors is the number of SCAN cursors kept. The oldest ones are dropped past it.
+	maxCursors = 1024
+	// defaultScanCount is the number of keys returned by SCAN if COUNT isn't given.
+	defaultScanCount = 10
+	// maxTxnRetries is the number of times a command is retried on a transaction conflict.
+	maxTxnRetries = 10
+)
+
+// Server serves a DB over RESP. Use NewServer to create it.
+type Server struct {
+	db *badger.DB
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+
+	// cursors maps the SCAN cursors to the key the scans continue from. cursorIDs are the cursors,
+	// from the oldest one.
+	cursorMu   sync.Mutex
+	cursors    map[uint64][]byte
+	cursorIDs  []uint64
+	nextCursor uint64
+}
+
+// NewServer returns a server of db. The DB is not closed by the server.
+func NewServer(db *badger.DB) *Server {
+	return &Server{
+		db:         db,
+		listeners:  make(map[net.Listener]struct{}),
+		conns:      make(map[net.Conn]struct{}),
+		cursors:    make(map[uint64][]byte),
+		nextCursor: 1,
+	}
+}
+
+// ListenAndServe listens on the TCP address addr, and serves the connections. It blocks until
+// Close is called, and then returns ErrServerClosed.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the connections accepted by l. It blocks until Close is called, and then returns
+// ErrServerClosed. l is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes the connections, and waits for their commands to be done.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err == errProtocol {
+			w.err("ERR Protocol error")
+			w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if quit := s.handle(w, args); quit {
+			w.Flush()
+			return
+		}
+		// Reply to the pipelined commands at once.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle runs a command, and writes its reply. It returns true if the connection must be closed.
+func (s *Server) handle(w respWriter, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	arity := func(min int) bool {
+		if len(args) < min {
+			w.err("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+			return false
+		}
+		return true
+	}
+
+	var err error
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "ECHO":
+		if arity(1) {
+			w.bulk(args[0])
+		}
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "COMMAND":
+		// Sent by redis-cli on connect. An empty reply is fine.
+		w.array(0)
+	case "GET":
+		if arity(1) {
+			err = s.get(w, args[0])
+		}
+	case "MGET":
+		if arity(1) {
+			err = s.mget(w, args)
+		}
+	case "SET":
+		if arity(2) {
+			err = s.set(w, args)
+		}
+	case "DEL":
+		if arity(1) {
+			err = s.del(w, args)
+		}
+	case "EXPIRE":
+		if arity(2) {
+			err = s.expire(w, args[0], args[1])
+		}
+	case "TTL":
+		if arity(1) {
+			err = s.ttl(w, args[0])
+		}
+	case "SCAN":
+		if arity(1) {
+			err = s.scan(w, args)
+		}
+	default:
+		w.err("ERR unknown command '" + strings.ToLower(name) + "'")
+	}
+	if err != nil {
+		w.err("ERR " + err.Error())
+	}
+	return false
+}
+
+// update runs fn in a transaction, retrying it on conflicts.
+func (s *Server) update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for i := 0; i < maxTxnRetries; i++ {
+		if err = s.db.Update(fn); !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Server) get(w respWriter, key []byte) error {
+	var val []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	switch err {
+	case nil:
+		w.bulk(val)
+	case badger.ErrKeyNotFound, badger.ErrEmptyKey:
+		w.null()
+	default:
+		return err
+	}
+	return nil
+}
+
+func (s *Server) mget(w respWriter, keys [][]byte) error {
+	vals := make([][]byte, len(keys))
+	err := s.db.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound || err == badger.ErrEmptyKey {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if vals[i], err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.array(len(vals))
+	for _, val := range vals {
+		if val == nil {
+			w.null()
+		} else {
+			w.bulk(val)
+		}
+	}
+	return nil
+}
+
+// set runs SET key value [EX seconds | PX milliseconds] [NX | XX].
+func (s *Server) set(w respWriter, args [][]byte) error {
+	key, val := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) {
+				w.err("ERR syntax error")
+				return nil
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				w.err("ERR invalid expire time in 'set' command")
+				return nil
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			w.err("ERR syntax error")
+			return nil
+		}
+	}
+	if nx && xx {
+		w.err("ERR syntax error")
+		return nil
+	}
+
+	var skipped bool
+	err := s.update(func(txn *badger.Txn) error {
+		skipped = false
+		if nx || xx {
+			_, err := txn.Get(key)
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			exists := err == nil
+			if nx && exists || xx && !exists {
+				skipped = true
+				return nil
+			}
+		}
+		e := badger.NewEntry(key, val)
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		return txn.SetEntry(e)
+	})
+	if err != nil {
+		return err
+	}
+	if skipped {
+		w.null()
+	} else {
+		w.simple("OK")
+	}
+	return nil
+}
+
+func (s *Server) del(w respWriter, keys [][]byte) error {
+	var n int64
+	err := s.update(func(txn *badger.Txn) error {
+		n = 0
+		for _, key := range keys {
+			_, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound || err == badger.ErrEmptyKey {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.int(n)
+	return nil
+}
+
+// expire runs EXPIRE key seconds. The value is written again with the new TTL. A TTL which isn't
+// positive deletes the key, like in Redis.
+func (s *Server) expire(w respWriter, key, seconds []byte) error {
+	n, err := strconv.ParseInt(string(seconds), 10, 64)
+	if err != nil {
+		w.err("ERR value is not an integer or out of range")
+		return nil
+	}
+	var found bool
+	err = s.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		found = err == nil
+		if err == badger.ErrKeyNotFound || err == badger.ErrEmptyKey {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return txn.Delete(key)
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		e := badger.NewEntry(key, val).WithMeta(item.UserMeta()).
+			WithTTL(time.Duration(n) * time.Second)
+		return txn.SetEntry(e)
+	})
+	if err != nil {
+		return err
+	}
+	if found {
+		w.int(1)
+	} else {
+		w.int(0)
+	}
+	return nil
+}
+
+// ttl runs TTL key. It replies -2 if the key doesn't exist, and -1 if it has no TTL.
+func (s *Server) ttl(w respWriter, key []byte) error {
+	var expiresAt uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		expiresAt = item.ExpiresAt()
+		return nil
+	})
+	switch {
+	case err == badger.ErrKeyNotFound || err == badger.ErrEmptyKey:
+		w.int(-2)
+	case err != nil:
+		return err
+	case expiresAt == 0:
+		w.int(-1)
+	default:
+		left := int64(expiresAt) - time.Now().Unix()
+		if left < 0 {
+			left = 0
+		}
+		w.int(left)
+	}
+	return nil
+}
+
+// scan runs SCAN cursor [MATCH pattern] [COUNT count]. The cursors are kept by the server, and
+// map to the key the scan continues from. The patterns use the syntax of path.Match.
+func (s *Server) scan(w respWriter, args [][]byte) error {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		w.err("ERR invalid cursor")
+		return nil
+	}
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = s.cursorKey(cursor); !ok {
+			w.err("ERR invalid cursor")
+			return nil
+		}
+	}
+	count := defaultScanCount
+	var matcher badger.KeyMatcher
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.err("ERR syntax error")
+			return nil
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			if matcher, err = badger.KeyGlob(string(args[i+1])); err != nil {
+				w.err("ERR invalid pattern")
+				return nil
+			}
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count <= 0 {
+				w.err("ERR syntax error")
+				return nil
+			}
+		default:
+			w.err("ERR syntax error")
+			return nil
+		}
+	}
+
+	var keys [][]byte
+	var next []byte
+	err = s.db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		// Like in Redis, COUNT is the number of keys looked at, not the number returned.
+		var seen int
+		for it.Seek(start); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if seen == count {
+				next = it.Item().KeyCopy(nil)
+				return nil
+			}
+			seen++
+			if matcher == nil || matcher.Match(key) {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var nextCursor uint64
+	if next != nil {
+		nextCursor = s.newCursor(next)
+	}
+	w.array(2)
+	w.bulk([]byte(strconv.FormatUint(nextCursor, 10)))
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+	return nil
+}
+
+func (s *Server) newCursor(key []byte) uint64 {
+	s.cursorMu.Lock()
+	defer s.cursorMu.Unlock()
+	id := s.nextCursor
+	s.nextCursor++
+	s.cursors[id] = key
+	s.cursorIDs = append(s.cursorIDs, id)
+	if len(s.cursorIDs) > maxCursors {
+		delete(s.cursors, s.cursorIDs[0])
+		s.cursorIDs = s.cursorIDs[1:]
+	}
+	return id
+}
+
+func (s *Server) cursorKey(id uint64) ([]byte, bool) {
+	s.cursorMu.Lock()
+	defer s.cursorMu.Unlock()
+	key, ok := s.cursors[id]
+	return key, ok
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisserve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// client is a minimal RESP client. Its replies are strings, nil, int64 or []interface{}.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *client) do(args ...string) interface{} {
+	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return c.read()
+}
+
+func (c *client) read() interface{} {
+	line, err := readLine(c.r)
+	require.NoError(c.t, err)
+	switch line[0] {
+	case '+':
+		return string(line[1:])
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		require.NoError(c.t, err)
+		return n
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		require.NoError(c.t, err)
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, buf)
+		require.NoError(c.t, err)
+		return string(buf[:n])
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		require.NoError(c.t, err)
+		res := make([]interface{}, n)
+		for i := range res {
+			res[i] = c.read()
+		}
+		return res
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewServer(db)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	require.Equal(t, "PONG", c.do("PING"))
+	require.Equal(t, "OK", c.do("SET", "foo", "bar"))
+	require.Equal(t, "bar", c.do("GET", "foo"))
+	require.Nil(t, c.do("GET", "missing"))
+	require.Nil(t, c.do("SET", "foo", "baz", "NX"))
+	require.Nil(t, c.do("SET", "other", "baz", "XX"))
+	require.Equal(t, "OK", c.do("SET", "bar", "1", "EX", "100"))
+	require.Equal(t, []interface{}{"bar", nil, "1"}, c.do("MGET", "foo", "missing", "bar"))
+
+	require.Equal(t, int64(-1), c.do("TTL", "foo"))
+	require.Equal(t, int64(1), c.do("EXPIRE", "foo", "50"))
+	ttl := c.do("TTL", "foo").(int64)
+	require.True(t, ttl > 40 && ttl <= 50, "ttl %d", ttl)
+	require.Equal(t, int64(0), c.do("EXPIRE", "missing", "50"))
+	require.Equal(t, int64(-2), c.do("TTL", "missing"))
+
+	require.Equal(t, int64(2), c.do("DEL", "foo", "bar", "missing"))
+	require.Nil(t, c.do("GET", "foo"))
+
+	// Inline commands work too.
+	fmt.Fprintf(conn, "SET inline value\r\n")
+	require.Equal(t, "OK", c.read())
+	require.Equal(t, int64(1), c.do("DEL", "inline"))
+
+	for i := 0; i < 25; i++ {
+		require.Equal(t, "OK", c.do("SET", fmt.Sprintf("key%02d", i), "v"))
+	}
+	require.Equal(t, "OK", c.do("SET", "other", "v"))
+	var keys []interface{}
+	cursor := "0"
+	for {
+		res := c.do("SCAN", cursor, "MATCH", "key*", "COUNT", "7").([]interface{})
+		keys = append(keys, res[1].([]interface{})...)
+		cursor = res[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	require.Len(t, keys, 25)
+	require.Equal(t, "key00", keys[0])
+	require.Equal(t, "key24", keys[24])
+	require.Error(t, c.do("SCAN", "12345").(error))
+
+	require.Error(t, c.do("UNKNOWN").(error))
+	require.Error(t, c.do("GET").(error))
+	require.Equal(t, "OK", c.do("QUIT"))
+
+	require.NoError(t, srv.Close())
+	require.Equal(t, ErrServerClosed, <-errCh)
+}
+
+func TestUpdateConflictDetails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING).
+		WithConflictDetails(true))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	srv := NewServer(db)
+
+	// The conflicts are retried when they are reported as a *ConflictError too.
+	key := []byte("key")
+	write := func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(key, []byte("value"))
+	}
+	attempts := 0
+	require.NoError(t, srv.update(func(txn *badger.Txn) error {
+		attempts++
+		if err := write(txn); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return db.Update(write)
+		}
+		return nil
+	}))
+	require.Equal(t, 2, attempts)
+}
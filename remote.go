@@ -0,0 +1,62 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/dgraph-io/badger/v3/table"
+)
+
+// remoteFile is the copy of a table file in object storage.
+type remoteFile struct {
+	url string
+	opt objstore.Options
+}
+
+func (f *remoteFile) ReadAt(buf []byte, off int64) error {
+	return objstore.ReadAt(context.Background(), f.url, buf, off, f.opt)
+}
+
+func (f *remoteFile) Create(wt io.WriterTo) error {
+	w, err := objstore.NewWriter(context.Background(), f.url, f.opt)
+	if err != nil {
+		return err
+	}
+	if _, err := wt.WriteTo(w); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+func (f *remoteFile) Delete() error {
+	return objstore.Delete(context.Background(), f.url, f.opt)
+}
+
+func (f *remoteFile) URL() string { return f.url }
+
+// newRemoteFile returns the remote file of the table fileID, under Options.RemoteTables.
+func newRemoteFile(opt Options, fileID uint64) *remoteFile {
+	return &remoteFile{
+		url: strings.TrimSuffix(opt.RemoteTables, "/") + "/" + table.IDToFilename(fileID),
+		opt: opt.RemoteTablesOptions,
+	}
+}
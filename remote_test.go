@@ -0,0 +1,132 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/stretchr/testify/require"
+)
+
+// newObjectServer returns a minimal object storage server, for the objects uploaded in a single
+// request, which are read with ranged requests.
+func newObjectServer(t *testing.T) (*httptest.Server, map[string][]byte, *sync.Mutex) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			buf, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			objects[r.URL.Path] = buf
+		case http.MethodGet:
+			buf, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			bounds := strings.Split(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-")
+			start, err := strconv.Atoi(bounds[0])
+			require.NoError(t, err)
+			end, err := strconv.Atoi(bounds[1])
+			require.NoError(t, err)
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(buf[start : end+1])
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	return srv, objects, &mu
+}
+
+func TestRemoteTables(t *testing.T) {
+	srv, objects, mu := newObjectServer(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).
+		WithRemoteTables("s3://bucket/tables/").
+		WithRemoteTablesOptions(objstore.Options{
+			Endpoint: srv.URL, AccessKeyID: "id", SecretAccessKey: "secret"})
+	opt.MemTableSize = 1 << 16
+	opt.ValueThreshold = 1 << 10
+	opt.BlockCacheSize = 1 << 20
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	val := make([]byte, 100)
+	wb := db.NewWriteBatch()
+	for i := 0; i < 10000; i++ {
+		require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%05d", i)), val))
+	}
+	require.NoError(t, wb.Flush())
+	// Closing the DB flushes the memtables, so that Flatten compacts all the data.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Flatten(1))
+
+	// The tables of the last level are remote, and the MANIFEST has their URL.
+	var remote int
+	for _, ti := range db.Tables() {
+		if ti.Level != opt.MaxLevels-1 {
+			continue
+		}
+		url := db.manifest.manifest.Tables[ti.ID].RemoteURL
+		require.Equal(t, fmt.Sprintf("s3://bucket/tables/%06d.sst", ti.ID), url)
+		mu.Lock()
+		require.Contains(t, objects, fmt.Sprintf("/bucket/tables/%06d.sst", ti.ID))
+		mu.Unlock()
+		remote++
+	}
+	require.NotZero(t, remote)
+	require.NoError(t, db.Close())
+
+	// The remote tables are opened again from the URLs in the MANIFEST.
+	db, err = Open(opt.WithRemoteTables(""))
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 10000; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoError(t, err)
+			got, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, val, got)
+		}
+		return nil
+	}))
+
+	// The objects are deleted with their tables.
+	require.NoError(t, db.DropAll())
+	mu.Lock()
+	require.Empty(t, objects)
+	mu.Unlock()
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,576 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto"
+	"github.com/pkg/errors"
+)
+
+// defaultQuarantineDir is the directory the corrupt tables are moved to, relative to the directory
+// of the DB.
+const defaultQuarantineDir = "quarantine"
+
+// RepairOptions are the options of Repair.
+type RepairOptions struct {
+	// RebuildManifest rebuilds the MANIFEST from the tables, even if it can be read.
+	RebuildManifest bool
+	// QuarantineDir is the directory the corrupt tables are moved to. A relative path is relative
+	// to the directory of the DB. It defaults to "quarantine".
+	QuarantineDir string
+	// DryRun only reports what would be repaired, without changing any file.
+	DryRun bool
+}
+
+// RepairReport describes what Repair found and fixed.
+type RepairReport struct {
+	// ManifestErr is the error reading the MANIFEST, if it couldn't be read.
+	ManifestErr error
+	// ManifestRebuilt is set if the MANIFEST was rebuilt from the tables, and ManifestRewritten if
+	// it was rewritten without the tables which are missing or quarantined.
+	ManifestRebuilt   bool
+	ManifestRewritten bool
+	// Tables is the number of valid tables.
+	Tables int
+	// QuarantinedTables are the tables which couldn't be read.
+	QuarantinedTables []QuarantinedTable
+	// MissingTables are the IDs of the tables in the MANIFEST without a file.
+	MissingTables []uint64
+	// UnreferencedTables are the IDs of the valid tables which aren't in the MANIFEST. They are
+	// left over by compactions, and deleted when the DB is opened.
+	UnreferencedTables []uint64
+	// TruncatedLogs are the value log and memtable files with a torn tail.
+	TruncatedLogs []TruncatedLog
+}
+
+// QuarantinedTable is a table moved to the quarantine directory by Repair.
+type QuarantinedTable struct {
+	ID  uint64
+	Err error
+}
+
+// TruncatedLog is a log file truncated after its last valid entry by Repair.
+type TruncatedLog struct {
+	Path      string
+	Size      int64
+	ValidSize int64
+}
+
+// repairTable is a valid table found by Repair.
+type repairTable struct {
+	id                uint64
+	manifest          TableManifest
+	smallest, biggest []byte
+}
+
+// Repair repairs the DB in opt.Dir, which must not be open, so that it can be opened again. It
+// rebuilds the MANIFEST from the tables if it can't be read, moves the tables which can't be read
+// to a quarantine directory, and truncates the value log and memtable files after their last valid
+// entry.
+//
+// A rebuilt MANIFEST puts the tables which don't overlap any other in the last level, and the other
+// ones in level 0, where their versions are merged when they are read. It may bring back the
+// tables which were compacted, but not deleted yet, and the older versions of their keys.
+func Repair(opt Options, ropt RepairOptions) (*RepairReport, error) {
+	if opt.InMemory {
+		return nil, errors.New("Cannot repair an in-memory DB")
+	}
+	if err := checkAndSetOptions(&opt); err != nil {
+		return nil, err
+	}
+	opt.ReadOnly = ropt.DryRun
+	if ropt.QuarantineDir == "" {
+		ropt.QuarantineDir = defaultQuarantineDir
+	}
+	if !filepath.IsAbs(ropt.QuarantineDir) {
+		ropt.QuarantineDir = filepath.Join(opt.Dir, ropt.QuarantineDir)
+	}
+
+	for _, dir := range repairDirs(opt) {
+		guard, err := acquireDirectoryLock(dir, lockFile, opt.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		defer guard.release()
+	}
+	registry, err := OpenKeyRegistry(KeyRegistryOptions{
+		Dir:           opt.Dir,
+		ReadOnly:      true,
+		EncryptionKey: opt.EncryptionKey,
+		KeyProvider:   opt.KeyProvider,
+		FS:            opt.FS,
+	})
+	if err != nil {
+		return nil, y.Wrapf(err, "while opening the key registry")
+	}
+
+	report := &RepairReport{}
+	if err := repairTables(opt, ropt, registry, report); err != nil {
+		return report, err
+	}
+	if err := repairLogs(opt, registry, report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// repairDirs returns the directories of the files of the DB.
+func repairDirs(opt Options) []string {
+	dirs := []string{opt.Dir}
+	for _, dir := range []string{opt.ValueDir, opt.LargeValueDir} {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		dup := false
+		for _, d := range dirs {
+			if a, err := filepath.Abs(d); err == nil && a == abs {
+				dup = true
+			}
+		}
+		if !dup {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// repairTables checks the tables and the MANIFEST, quarantines the corrupt tables, and rewrites
+// or rebuilds the MANIFEST if needed.
+func repairTables(opt Options, ropt RepairOptions, registry *KeyRegistry,
+	report *RepairReport) error {
+	ids, err := tableIDs(opt.FS, opt.Dir)
+	if err != nil {
+		return err
+	}
+	// A missing MANIFEST is only an error if there are tables.
+	mf, err := readManifest(opt)
+	if os.IsNotExist(err) && len(ids) == 0 {
+		mf, err = createManifest(), nil
+	}
+	report.ManifestErr = err
+	rebuild := ropt.RebuildManifest || err != nil
+	var tables []repairTable
+	var indexCache *ristretto.Cache
+	if opt.encrypted() {
+		if indexCache, err = ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1 << 10,
+			MaxCost:     64 << 20,
+			BufferItems: 64,
+		}); err != nil {
+			return err
+		}
+		defer indexCache.Close()
+	}
+	for _, id := range ids {
+		var formats []TableManifest
+		tm, ok := mf.Tables[id]
+		if ok && !rebuild {
+			formats = []TableManifest{tm}
+		} else {
+			formats = tableFormats(opt, registry)
+			if opt.RemoteTables != "" {
+				formats = withRemoteFormats(formats, newRemoteFile(opt, id).url)
+			}
+		}
+		t, err := checkTable(opt, id, formats, registry, indexCache)
+		if err != nil {
+			report.QuarantinedTables = append(report.QuarantinedTables,
+				QuarantinedTable{ID: id, Err: err})
+			continue
+		}
+		if ok && !rebuild {
+			t.manifest.Level = tm.Level
+		}
+		tables = append(tables, t)
+		if !ok && !rebuild {
+			report.UnreferencedTables = append(report.UnreferencedTables, id)
+		}
+	}
+	report.Tables = len(tables)
+
+	found := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		found[id] = struct{}{}
+	}
+	if !rebuild {
+		for id := range mf.Tables {
+			if _, ok := found[id]; !ok {
+				report.MissingTables = append(report.MissingTables, id)
+			}
+		}
+		sort.Slice(report.MissingTables, func(i, j int) bool {
+			return report.MissingTables[i] < report.MissingTables[j]
+		})
+	}
+
+	if !ropt.DryRun && len(report.QuarantinedTables) > 0 {
+		if err := opt.FS.MkdirAll(ropt.QuarantineDir, 0700); err != nil {
+			return err
+		}
+		for _, qt := range report.QuarantinedTables {
+			name := table.IDToFilename(qt.ID)
+			if err := opt.FS.Rename(filepath.Join(opt.Dir, name),
+				filepath.Join(ropt.QuarantineDir, name)); err != nil {
+				return y.Wrapf(err, "while quarantining table %d", qt.ID)
+			}
+		}
+	}
+
+	var quarantinedInManifest bool
+	for _, qt := range report.QuarantinedTables {
+		if _, ok := mf.Tables[qt.ID]; ok {
+			quarantinedInManifest = true
+		}
+	}
+	if !rebuild && len(report.MissingTables) == 0 && !quarantinedInManifest {
+		return nil
+	}
+
+	// Only the valid tables in the MANIFEST are kept, unless it's rebuilt.
+	m := createManifest()
+	if rebuild {
+		assignRebuiltLevels(tables, opt.MaxLevels-1)
+	}
+	for _, t := range tables {
+		if _, ok := mf.Tables[t.id]; ok || rebuild {
+			m.Tables[t.id] = t.manifest
+		}
+	}
+	report.ManifestRebuilt = rebuild
+	report.ManifestRewritten = !rebuild
+	if ropt.DryRun {
+		return nil
+	}
+	fp, _, err := helpRewrite(opt.FS, opt.Dir, &m, opt.ExternalMagicVersion)
+	if err != nil {
+		return y.Wrapf(err, "while rewriting the MANIFEST")
+	}
+	return fp.Close()
+}
+
+// recoverManifest rebuilds the MANIFEST from the tables if it is missing, but there are tables, or
+// if it is corrupt. It is called by Open, with the directories locked, if Options.RecoverManifest
+// is set.
+func recoverManifest(opt Options) error {
+	_, merr := readManifest(opt)
+	switch {
+	case merr == nil:
+		return nil
+	case os.IsNotExist(merr):
+		ids, err := tableIDs(opt.FS, opt.Dir)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+	case ErrorCode(merr) != CodeCorruption:
+		// The MANIFEST of another version, or an I/O error, is reported by Open.
+		return nil
+	}
+	opt.Warningf("Rebuilding the MANIFEST from the tables: %v", merr)
+
+	registry, err := OpenKeyRegistry(KeyRegistryOptions{
+		Dir:           opt.Dir,
+		ReadOnly:      true,
+		EncryptionKey: opt.EncryptionKey,
+		KeyProvider:   opt.KeyProvider,
+		FS:            opt.FS,
+	})
+	if err != nil {
+		return y.Wrapf(err, "while opening the key registry")
+	}
+	ropt := RepairOptions{
+		RebuildManifest: true,
+		QuarantineDir:   filepath.Join(opt.Dir, defaultQuarantineDir),
+	}
+	report := &RepairReport{}
+	if err := repairTables(opt, ropt, registry, report); err != nil {
+		return err
+	}
+	opt.Warningf("MANIFEST rebuilt with %d tables. %d tables quarantined in %s", report.Tables,
+		len(report.QuarantinedTables), ropt.QuarantineDir)
+	return nil
+}
+
+// readManifest reads the MANIFEST of the DB.
+func readManifest(opt Options) (Manifest, error) {
+	fp, err := opt.FS.OpenFile(filepath.Join(opt.Dir, ManifestFilename), os.O_RDONLY, 0)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer fp.Close()
+	mf, _, err := replayManifestFile(fp, opt.ExternalMagicVersion)
+	return mf, err
+}
+
+// tableIDs returns the sorted IDs of the tables in dir.
+func tableIDs(fs y.FS, dir string) ([]uint64, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, f := range files {
+		if id, ok := table.ParseFileID(f.Name()); ok && !f.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// tableFormats returns the compressions and data keys a table not in the MANIFEST may have been
+// written with, the ones of the options first.
+func tableFormats(opt Options, registry *KeyRegistry) []TableManifest {
+	var keyIDs []uint64
+	registry.RLock()
+	for id := range registry.dataKeys {
+		keyIDs = append(keyIDs, id)
+	}
+	registry.RUnlock()
+	// The latest keys are the most likely ones, and the tables are only in plain text if the DB
+	// isn't encrypted, or was encrypted later.
+	sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i] > keyIDs[j] })
+	if opt.encrypted() {
+		keyIDs = append(keyIDs, 0)
+	} else {
+		keyIDs = append([]uint64{0}, keyIDs...)
+	}
+
+	compressions := []options.CompressionType{opt.Compression}
+	for _, c := range []options.CompressionType{options.None, options.Snappy, options.ZSTD} {
+		if c != opt.Compression {
+			compressions = append(compressions, c)
+		}
+	}
+	modes := []options.EncryptionMode{opt.EncryptionMode}
+	for _, m := range []options.EncryptionMode{options.AESCTR, options.AESGCM} {
+		if m != opt.EncryptionMode {
+			modes = append(modes, m)
+		}
+	}
+	var formats []TableManifest
+	for _, id := range keyIDs {
+		for _, m := range modes {
+			for _, c := range compressions {
+				formats = append(formats,
+					TableManifest{KeyID: id, Compression: c, EncryptionMode: m})
+			}
+			if id == 0 {
+				// The tables in plain text have no encryption mode.
+				break
+			}
+		}
+	}
+	return formats
+}
+
+// withRemoteFormats appends the formats of the table if its blocks are only in object storage, at
+// url, to the formats of the table if it's local.
+func withRemoteFormats(formats []TableManifest, url string) []TableManifest {
+	n := len(formats)
+	for _, f := range formats[:n] {
+		f.RemoteURL = url
+		formats = append(formats, f)
+	}
+	return formats
+}
+
+// checkTable opens the table with each of the formats, until one of them can read all its blocks,
+// and returns the last error otherwise.
+func checkTable(opt Options, id uint64, formats []TableManifest, registry *KeyRegistry,
+	indexCache *ristretto.Cache) (repairTable, error) {
+	var err error
+	for _, f := range formats {
+		var t repairTable
+		if t, err = openRepairTable(opt, id, f, registry, indexCache); err == nil {
+			return t, nil
+		}
+	}
+	return repairTable{}, err
+}
+
+func openRepairTable(opt Options, id uint64, f TableManifest, registry *KeyRegistry,
+	indexCache *ristretto.Cache) (rt repairTable, rerr error) {
+	var dk *pb.DataKey
+	if f.KeyID != 0 {
+		var err error
+		if dk, err = registry.DataKey(f.KeyID); err != nil {
+			return rt, err
+		}
+	}
+	flags := os.O_RDWR
+	if opt.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	mf, err := y.OpenMmapFile(opt.FS, table.NewFilename(id, opt.Dir), flags, 0)
+	if err != nil {
+		return rt, err
+	}
+	var t *table.Table
+	// A corrupt table may make its reads panic.
+	defer func() {
+		if r := recover(); r != nil {
+			rerr = errors.Errorf("%v", r)
+		}
+		if t != nil {
+			_ = t.Close(-1)
+		} else if rerr != nil {
+			_ = mf.Close(-1)
+		}
+	}()
+	topt := table.Options{
+		BlockSize:      opt.BlockSize,
+		ChkMode:        options.NoVerification,
+		Compression:    f.Compression,
+		DataKey:        dk,
+		FS:             opt.FS,
+		IndexCache:     indexCache,
+		EncryptionMode: f.EncryptionMode,
+	}
+	if f.RemoteURL != "" {
+		// The blocks of a remote table are only in object storage.
+		rf := &remoteFile{url: f.RemoteURL, opt: opt.RemoteTablesOptions}
+		t, err = table.OpenRemoteTable(mf, rf, topt)
+	} else {
+		t, err = table.OpenTable(mf, topt)
+	}
+	if err != nil {
+		return rt, err
+	}
+	if err := t.VerifyChecksum(); err != nil {
+		return rt, err
+	}
+	return repairTable{
+		id:       id,
+		manifest: f,
+		smallest: y.Copy(t.Smallest()),
+		biggest:  y.Copy(t.Biggest()),
+	}, nil
+}
+
+// assignRebuiltLevels puts the tables which don't overlap any other in the last level, and the
+// other ones in level 0.
+func assignRebuiltLevels(tables []repairTable, lastLevel int) {
+	byKey := make([]int, len(tables))
+	for i := range byKey {
+		byKey[i] = i
+	}
+	sort.Slice(byKey, func(i, j int) bool {
+		return y.CompareKeys(tables[byKey[i]].smallest, tables[byKey[j]].smallest) < 0
+	})
+	overlaps := make([]bool, len(tables))
+	// The biggest key so far, and the table it's in.
+	var biggest []byte
+	last := -1
+	for _, i := range byKey {
+		t := tables[i]
+		if last >= 0 && bytes.Compare(y.ParseKey(t.smallest), y.ParseKey(biggest)) <= 0 {
+			overlaps[i] = true
+			overlaps[last] = true
+		}
+		if last < 0 || y.CompareKeys(t.biggest, biggest) > 0 {
+			biggest, last = t.biggest, i
+		}
+	}
+	for i := range tables {
+		tables[i].manifest.Level = uint8(lastLevel)
+		if overlaps[i] {
+			tables[i].manifest.Level = 0
+		}
+	}
+}
+
+// repairLogs truncates the value log and memtable files after their last valid entry, if they are
+// followed by anything else than zeros.
+func repairLogs(opt Options, registry *KeyRegistry, report *RepairReport) error {
+	type logPath struct {
+		path string
+		fid  uint32
+	}
+	var paths []logPath
+	for _, dir := range repairDirs(opt) {
+		files, err := opt.FS.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			name := f.Name()
+			ext := filepath.Ext(name)
+			if f.IsDir() || (ext != ".vlog" && ext != memFileExt) {
+				continue
+			}
+			var fid uint32
+			if _, err := fmt.Sscanf(strings.TrimSuffix(name, ext), "%d", &fid); err != nil {
+				continue
+			}
+			// A file without a full header is bootstrapped again when the DB is opened.
+			if f.Size() < vlogHeaderSize {
+				continue
+			}
+			paths = append(paths, logPath{path: filepath.Join(dir, name), fid: fid})
+		}
+	}
+
+	flags := os.O_RDWR
+	if opt.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	for _, p := range paths {
+		lf := &logFile{fid: p.fid, path: p.path, registry: registry, opt: opt}
+		if err := lf.open(p.path, flags, 0); err != nil {
+			return y.Wrapf(err, "while opening %s", p.path)
+		}
+		// The entries which can't be read are cut off like the torn ones.
+		end, _ := lf.iterate(true, 0, func(Entry, valuePointer) error { return nil })
+		size := int64(len(lf.Data))
+		torn := false
+		for _, b := range lf.Data[end:] {
+			if b != 0 {
+				torn = true
+				break
+			}
+		}
+		if torn {
+			report.TruncatedLogs = append(report.TruncatedLogs,
+				TruncatedLog{Path: p.path, Size: size, ValidSize: int64(end)})
+			if !opt.ReadOnly {
+				if err := lf.Truncate(int64(end)); err != nil {
+					_ = lf.Close(-1)
+					return y.Wrapf(err, "while truncating %s", p.path)
+				}
+			}
+		}
+		if err := lf.Close(-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRepairTestDB writes n keys twice, so that the DB has tables in level 0 and in the last level.
+func writeRepairTestDB(t *testing.T, opt Options, n int) {
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for round := 0; round < 2; round++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("key%04d", i))
+				if err := txn.Set(key, []byte(fmt.Sprintf("value%d-%d", i, round))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+		db, err = Open(opt)
+		require.NoError(t, err)
+		if round == 0 {
+			_, err = db.CompactRange(CompactRangeOptions{})
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, db.Close())
+}
+
+func checkRepairTestDB(t *testing.T, opt Options, n int) {
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value%d-1", i), string(getItemValue(t, item)))
+		}
+		return nil
+	}))
+}
+
+func TestRepairManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0)
+	writeRepairTestDB(t, opt, 100)
+
+	// Nothing to repair.
+	report, err := Repair(opt, RepairOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &RepairReport{Tables: 2}, report)
+
+	manifest := filepath.Join(dir, ManifestFilename)
+	require.NoError(t, ioutil.WriteFile(manifest, []byte("garbage"), 0600))
+	_, err = Open(opt)
+	require.Error(t, err)
+
+	report, err = Repair(opt, RepairOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Error(t, report.ManifestErr)
+	require.True(t, report.ManifestRebuilt)
+	data, err := ioutil.ReadFile(manifest)
+	require.NoError(t, err)
+	require.Equal(t, "garbage", string(data))
+
+	report, err = Repair(opt, RepairOptions{})
+	require.NoError(t, err)
+	require.True(t, report.ManifestRebuilt)
+	require.Equal(t, 2, report.Tables)
+
+	// The tables overlap, so they were both put in level 0.
+	db, err := Open(opt.WithCompactL0OnClose(false))
+	require.NoError(t, err)
+	tables := db.Tables()
+	require.Len(t, tables, 2)
+	for _, ti := range tables {
+		require.Equal(t, 0, ti.Level)
+	}
+	require.NoError(t, db.Close())
+	checkRepairTestDB(t, opt, 100)
+}
+
+func TestRepairQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0).WithCompactL0OnClose(false)
+	writeRepairTestDB(t, opt, 100)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	var l0 uint64
+	for _, ti := range db.Tables() {
+		if ti.Level == 0 {
+			l0 = ti.ID
+		}
+	}
+	require.NoError(t, db.Close())
+	require.NotZero(t, l0)
+
+	// Corrupt the first block of the level 0 table, and remove the other table.
+	fname := table.NewFilename(l0, dir)
+	data, err := ioutil.ReadFile(fname)
+	require.NoError(t, err)
+	for i := 10; i < 100; i++ {
+		data[i] ^= 0xff
+	}
+	require.NoError(t, ioutil.WriteFile(fname, data, 0600))
+	ids, err := tableIDs(y.OSFS, dir)
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+	for _, id := range ids {
+		if id != l0 {
+			require.NoError(t, os.Remove(table.NewFilename(id, dir)))
+		}
+	}
+
+	report, err := Repair(opt, RepairOptions{})
+	require.NoError(t, err)
+	require.Len(t, report.QuarantinedTables, 1)
+	require.Equal(t, l0, report.QuarantinedTables[0].ID)
+	require.Error(t, report.QuarantinedTables[0].Err)
+	require.Len(t, report.MissingTables, 1)
+	require.True(t, report.ManifestRewritten)
+	require.Zero(t, report.Tables)
+	_, err = os.Stat(filepath.Join(dir, "quarantine", table.IDToFilename(l0)))
+	require.NoError(t, err)
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.Empty(t, db.Tables())
+	require.NoError(t, db.Close())
+}
+
+func TestRepairTornLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(32)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key"), make([]byte, 100))
+	}))
+	require.NoError(t, db.Close())
+
+	vlog := vlogFilePath(dir, 1)
+	fi, err := os.Stat(vlog)
+	require.NoError(t, err)
+	f, err := os.OpenFile(vlog, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("torn entry"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	report, err := Repair(opt, RepairOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, []TruncatedLog{{Path: vlog, Size: fi.Size() + 10, ValidSize: fi.Size()}},
+		report.TruncatedLogs)
+	report, err = Repair(opt, RepairOptions{})
+	require.NoError(t, err)
+	require.Len(t, report.TruncatedLogs, 1)
+	fi2, err := os.Stat(vlog)
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), fi2.Size())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Len(t, getItemValue(t, item), 100)
+		return nil
+	}))
+}
+
+func TestAssignRebuiltLevels(t *testing.T) {
+	tbl := func(smallest, biggest string, version uint64) repairTable {
+		return repairTable{
+			smallest: y.KeyWithTs([]byte(smallest), version),
+			biggest:  y.KeyWithTs([]byte(biggest), version),
+		}
+	}
+	tables := []repairTable{
+		tbl("a", "c", 1),
+		tbl("d", "f", 1),
+		tbl("e", "g", 2),
+		tbl("h", "j", 1),
+		// Another version of j.
+		tbl("j", "k", 3),
+		tbl("x", "z", 1),
+	}
+	assignRebuiltLevels(tables, 6)
+	var levels []uint8
+	for _, t := range tables {
+		levels = append(levels, t.manifest.Level)
+	}
+	require.Equal(t, []uint8{6, 0, 0, 0, 0, 6}, levels)
+}
+
+func TestRecoverManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0)
+	writeRepairTestDB(t, opt, 100)
+	manifest := filepath.Join(dir, ManifestFilename)
+
+	// Without the MANIFEST, the tables aren't deleted, unless it is rebuilt.
+	require.NoError(t, os.Remove(manifest))
+	_, err = Open(opt)
+	require.True(t, errors.Is(err, ErrManifestMissing))
+	checkRepairTestDB(t, opt.WithRecoverManifest(true), 100)
+
+	// A corrupt record is rebuilt too.
+	fp, err := os.OpenFile(manifest, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = fp.WriteAt([]byte{'X'}, 15)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+	_, err = Open(opt)
+	require.Equal(t, CodeCorruption, ErrorCode(err))
+	checkRepairTestDB(t, opt.WithRecoverManifest(true), 100)
+	checkRepairTestDB(t, opt, 100)
+}
+
+func TestRepairRemoteTables(t *testing.T) {
+	srv, _, _ := newObjectServer(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).
+		WithNumCompactors(0).
+		WithRemoteTables("s3://bucket/tables/").
+		WithRemoteTablesOptions(objstore.Options{
+			Endpoint: srv.URL, AccessKeyID: "id", SecretAccessKey: "secret"})
+	opt.FS = y.OSFS
+	writeRepairTestDB(t, opt, 100)
+	mf, err := readManifest(opt)
+	require.NoError(t, err)
+	var remote int
+	for _, tm := range mf.Tables {
+		if tm.RemoteURL != "" {
+			remote++
+		}
+	}
+	require.NotZero(t, remote)
+
+	// The remote tables are found in object storage when the MANIFEST is rebuilt.
+	require.NoError(t, os.Remove(filepath.Join(dir, ManifestFilename)))
+	report, err := Repair(opt, RepairOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.QuarantinedTables)
+	require.Equal(t, 2, report.Tables)
+	rebuilt, err := readManifest(opt)
+	require.NoError(t, err)
+	for id, tm := range mf.Tables {
+		require.Equal(t, tm.RemoteURL, rebuilt.Tables[id].RemoteURL)
+	}
+	checkRepairTestDB(t, opt, 100)
+}
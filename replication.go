@@ -0,0 +1,228 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// ReplicationStream writes the entries committed to the DB with a version newer than or equal to
+// since to w, so that a follower can apply them with ApplyReplicationStream. It first writes the
+// entries already in the DB, like Backup, and then the entries as they are committed. It blocks
+// until ctx is done, the DB is closed, or writing to w fails.
+//
+// The entries are written in the format of Backup. Once the entries already in the DB are
+// written, a list with a single KV with StreamDone set is written, whose version is the version
+// up to which the follower has caught up.
+func (db *DB) ReplicationStream(ctx context.Context, w io.Writer, since uint64) error {
+	// Subscribe before reading the DB, so that no commit is missed. The commits which are both
+	// read and received are written twice, which is harmless.
+	c := z.NewCloser(1)
+	s := db.pub.newSubscriber(c, nil, []KeyMatcher{replicationMatcher{}}, true)
+
+	// Queue the commits while reading the DB, so that the publisher isn't blocked.
+	var mu sync.Mutex
+	var queue []*pb.KVList
+	var dbClosed bool
+	notify := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer c.Done()
+		for {
+			select {
+			case <-c.HasBeenClosed():
+				mu.Lock()
+				dbClosed = true
+				mu.Unlock()
+			case <-stop:
+				return
+			case kvs := <-s.sendCh:
+				mu.Lock()
+				queue = append(queue, kvs)
+				mu.Unlock()
+			}
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+			if dbClosed {
+				return
+			}
+		}
+	}()
+	defer func() {
+		atomic.StoreUint64(s.active, 0)
+		close(stop)
+		wg.Wait()
+	drain:
+		for {
+			select {
+			case <-s.sendCh:
+			default:
+				break drain
+			}
+		}
+		db.pub.deleteSubscriber(s.id)
+	}()
+
+	var stream *Stream
+	var readTs uint64
+	if db.opt.managedTxns {
+		// The DB is read at its latest version, which is at least the version of the commits
+		// done before subscribing.
+		readTs = db.MaxVersion()
+		stream = db.NewStreamAt(math.MaxUint64)
+	} else {
+		// The commits done before subscribing are read. Reading at readTs waits for them.
+		txn := db.NewTransaction(false)
+		readTs = txn.readTs
+		txn.Discard()
+		stream = db.NewStream()
+	}
+	stream.LogPrefix = "DB.ReplicationStream"
+	stream.SinceTs = since
+	stream.KeyToList = stream.backupKeyToList(since)
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		out := list.Kv[:0]
+		for _, kv := range list.Kv {
+			if !kv.StreamDone {
+				out = append(out, kv)
+			}
+		}
+		list.Kv = out
+		return writeTo(list, w)
+	}
+	if err := stream.Orchestrate(ctx); err != nil {
+		return err
+	}
+	done := &pb.KVList{Kv: []*pb.KV{{Version: readTs, StreamDone: true}}}
+	if err := writeTo(done, w); err != nil {
+		return err
+	}
+
+	for {
+		mu.Lock()
+		lists, closed := queue, dbClosed
+		queue = nil
+		mu.Unlock()
+		for _, list := range lists {
+			out := list.Kv[:0]
+			for _, kv := range list.Kv {
+				if kv.Version >= since {
+					out = append(out, kv)
+				}
+			}
+			list.Kv = out
+			if len(list.Kv) == 0 {
+				continue
+			}
+			if err := writeTo(list, w); err != nil {
+				return err
+			}
+		}
+		if closed {
+			return ErrDBClosed
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// ApplyReplicationStream applies the entries written by ReplicationStream, read from r, to the DB.
+// It returns when r returns io.EOF, ctx is done, or applying the entries fails. The entries keep
+// their versions, so the DB should not be written to otherwise.
+//
+// It returns the version the DB caught up to: all the entries with an older version are applied.
+// It can be passed as the since of the next ReplicationStream, to resume the replication. It is
+// zero if the stream ended before the follower caught up, in which case the replication should be
+// resumed from the previous since.
+//
+// The DB can be read while the entries are applied, but until it caught up, the reads can see some
+// of the entries of a transaction and not the others.
+func (db *DB) ApplyReplicationStream(ctx context.Context, r io.Reader) (uint64, error) {
+	var caughtUp, applied uint64
+	err := readFrom(r, func(list *pb.KVList) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ldr := db.NewKVLoader(16)
+		var maxVersion uint64
+		for _, kv := range list.Kv {
+			if kv.StreamDone {
+				caughtUp = kv.Version
+				continue
+			}
+			if err := ldr.Set(kv); err != nil {
+				return err
+			}
+			if kv.Version > maxVersion {
+				maxVersion = kv.Version
+			}
+		}
+		if err := ldr.Finish(); err != nil {
+			return err
+		}
+		if maxVersion > applied {
+			applied = maxVersion
+		}
+		// The commits are received in order once caught up, but the entries of a transaction can
+		// be split over lists, so only the older versions are known to be complete.
+		if caughtUp > 0 && applied > caughtUp {
+			caughtUp = applied
+		}
+		if caughtUp > applied {
+			db.advanceReadTs(caughtUp)
+		} else {
+			db.advanceReadTs(applied)
+		}
+		return nil
+	})
+	return caughtUp, err
+}
+
+// advanceReadTs makes the versions up to ts readable by the new transactions, once entries with
+// these versions were written directly, like by ApplyReplicationStream.
+func (db *DB) advanceReadTs(ts uint64) {
+	if db.opt.managedTxns {
+		return
+	}
+	o := db.orc
+	o.Lock()
+	defer o.Unlock()
+	if ts < o.nextTxnTs {
+		return
+	}
+	o.nextTxnTs = ts + 1
+	o.txnMark.Done(ts)
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationStream(t *testing.T) {
+	primaryDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(primaryDir)
+	followerDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(followerDir)
+
+	primary, err := Open(getTestOptions(primaryDir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, primary.Close()) }()
+	follower, err := Open(getTestOptions(followerDir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, follower.Close()) }()
+
+	set := func(start, end int) {
+		require.NoError(t, primary.Update(func(txn *Txn) error {
+			for i := start; i < end; i++ {
+				key := []byte(fmt.Sprintf("key%03d", i))
+				if err := txn.Set(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	// The value of key 0 must be read from the value log.
+	require.NoError(t, primary.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key000"), make([]byte, 2<<10))
+	}))
+	set(1, 50)
+	require.NoError(t, primary.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("key001"))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- primary.ReplicationStream(ctx, pw, 0)
+		pw.Close()
+	}()
+	type applyResult struct {
+		caughtUp uint64
+		err      error
+	}
+	applyRes := make(chan applyResult, 1)
+	go func() {
+		caughtUp, err := follower.ApplyReplicationStream(context.Background(), pr)
+		applyRes <- applyResult{caughtUp, err}
+	}()
+
+	// The commits done while replicating are applied too.
+	set(50, 100)
+	require.NoError(t, primary.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("key002"))
+	}))
+
+	get := func(key string) ([]byte, error) {
+		var val []byte
+		err := follower.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			val, err = item.ValueCopy(nil)
+			return err
+		})
+		return val, err
+	}
+	require.Eventually(t, func() bool {
+		_, err1 := get("key099")
+		_, err2 := get("key002")
+		return err1 == nil && err2 == ErrKeyNotFound
+	}, 10*time.Second, 10*time.Millisecond)
+	// Wait for a commit done after the follower caught up.
+	require.NoError(t, primary.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("key003"))
+	}))
+	require.Eventually(t, func() bool {
+		_, err := get("key003")
+		return err == ErrKeyNotFound
+	}, 10*time.Second, 10*time.Millisecond)
+
+	val, err := get("key000")
+	require.NoError(t, err)
+	require.Len(t, val, 2<<10)
+	val, err = get("key050")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value50"), val)
+	_, err = get("key001")
+	require.Equal(t, ErrKeyNotFound, err)
+	// The internal keys aren't replicated.
+	require.NoError(t, follower.View(func(txn *Txn) error {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		var n int
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		require.Equal(t, 97, n)
+		return nil
+	}))
+
+	cancel()
+	require.Equal(t, context.Canceled, <-streamErr)
+	res := <-applyRes
+	require.NoError(t, res.err)
+	require.Equal(t, primary.MaxVersion(), res.caughtUp)
+
+	// The replication resumes from the version the follower caught up to.
+	set(100, 110)
+	ctx, cancel = context.WithCancel(context.Background())
+	pr, pw = io.Pipe()
+	go func() {
+		streamErr <- primary.ReplicationStream(ctx, pw, res.caughtUp)
+		pw.Close()
+	}()
+	go func() {
+		caughtUp, err := follower.ApplyReplicationStream(context.Background(), pr)
+		applyRes <- applyResult{caughtUp, err}
+	}()
+	require.Eventually(t, func() bool {
+		_, err := get("key109")
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	// Wait for a commit done after the follower caught up.
+	set(110, 111)
+	require.Eventually(t, func() bool {
+		_, err := get("key110")
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	require.Equal(t, context.Canceled, <-streamErr)
+	res = <-applyRes
+	require.NoError(t, res.err)
+	require.Equal(t, primary.MaxVersion(), res.caughtUp)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"time"
+)
+
+// commitMark records that all the timestamps up to ts were committed before start+interval.
+type commitMark struct {
+	ts    uint64
+	start time.Time
+}
+
+// commitLog maps commit timestamps to the time they were committed at, with a granularity of
+// interval. It is used to find the versions written within VersionRetention, which must not be
+// discarded by compactions. The log only covers the commits since the DB was opened. All the
+// versions written before that are considered to be committed at open time.
+type commitLog struct {
+	retention time.Duration
+	interval  time.Duration
+	marks     []commitMark
+}
+
+func newCommitLog(retention time.Duration) *commitLog {
+	// Keep around a thousand marks, no matter how long the retention is.
+	interval := retention / 1000
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return &commitLog{retention: retention, interval: interval}
+}
+
+// add records that ts was committed at time now. The timestamps must be added in increasing order.
+func (cl *commitLog) add(ts uint64, now time.Time) {
+	if n := len(cl.marks); n > 0 && now.Before(cl.marks[n-1].start.Add(cl.interval)) {
+		cl.marks[n-1].ts = ts
+		return
+	}
+	cl.marks = append(cl.marks, commitMark{ts: ts, start: now})
+
+	// Drop the marks older than the one which discardBefore would return.
+	cutoff := now.Add(-cl.retention)
+	var i int
+	for i+1 < len(cl.marks) && !cl.marks[i+1].start.Add(cl.interval).After(cutoff) {
+		i++
+	}
+	cl.marks = cl.marks[i:]
+}
+
+// discardBefore returns the latest timestamp which was surely committed more than retention before
+// now. Versions above it must be kept. It returns zero if there is no such timestamp.
+func (cl *commitLog) discardBefore(now time.Time) uint64 {
+	cutoff := now.Add(-cl.retention)
+	var ts uint64
+	for _, m := range cl.marks {
+		if m.start.Add(cl.interval).After(cutoff) {
+			break
+		}
+		ts = m.ts
+	}
+	return ts
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitLog(t *testing.T) {
+	cl := newCommitLog(time.Hour)
+	require.Equal(t, 3600*time.Millisecond, cl.interval)
+
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	// Two commits per interval, for an hour.
+	var ts uint64
+	for d := time.Duration(0); d < time.Hour; d += cl.interval / 2 {
+		ts++
+		cl.add(ts, at(d))
+	}
+	require.Equal(t, 1000, len(cl.marks))
+
+	require.Zero(t, cl.discardBefore(at(30*time.Minute)))
+	// An hour after the start, only the first interval is surely older than retention.
+	require.Equal(t, uint64(2), cl.discardBefore(at(time.Hour+cl.interval)))
+	require.Equal(t, uint64(1000), cl.discardBefore(at(time.Hour+500*cl.interval)))
+	require.Equal(t, ts, cl.discardBefore(at(3*time.Hour)))
+
+	// Adding a commit much later drops all but the last mark older than retention.
+	cl.add(ts+1, at(3*time.Hour))
+	require.Equal(t, 2, len(cl.marks))
+	require.Equal(t, ts, cl.discardBefore(at(3*time.Hour)))
+}
+
+func TestVersionRetention(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1).
+		WithVersionRetention(time.Hour)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// Move the read watermark beyond the versions used below.
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte("other"), nil)
+			}))
+		}
+		require.Greater(t, db.orc.readMark.DoneUntil(), uint64(4))
+
+		l0 := []keyValVersion{{"foo", "bar", 4, 0}, {"foo", "bar", 3, 0}}
+		l1 := []keyValVersion{{"foo", "bar", 2, 0}, {"foo", "bar", 1, 0}}
+		createAndOpen(db, l0, 0)
+		createAndOpen(db, l1, 1)
+
+		// Pretend versions up to 2 were committed two hours ago.
+		db.orc.Lock()
+		db.orc.commits.marks = []commitMark{{ts: 2, start: time.Now().Add(-2 * time.Hour)}}
+		db.orc.Unlock()
+		require.Equal(t, uint64(2), db.orc.discardAtOrBelow())
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 1
+		require.NoError(t, db.lc.runCompactDef(-1, 0, cdef))
+
+		// Versions 3 and 4 are within retention. Version 2 was current two hours ago.
+		require.NoError(t, db.View(func(txn *Txn) error {
+			history, err := txn.GetHistory([]byte("foo"), 0)
+			require.NoError(t, err)
+			var versions []uint64
+			for _, kv := range history {
+				versions = append(versions, kv.Version)
+			}
+			require.Equal(t, []uint64{4, 3, 2}, versions)
+			return nil
+		}))
+	})
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"google.golang.org/grpc"
+)
+
+// Client is a client of the Badger service. The errors it returns are gRPC status errors, whose
+// code can be read with status.Code.
+type Client struct {
+	c BadgerClient
+}
+
+// NewClient returns a Client calling the service over cc.
+func NewClient(cc *grpc.ClientConn) *Client {
+	return &Client{c: NewBadgerClient(cc)}
+}
+
+// Get returns the latest version of key. It returns badger.ErrKeyNotFound if key isn't found.
+func (c *Client) Get(ctx context.Context, key []byte) (*pb.KV, error) {
+	resp, err := c.c.Get(ctx, &GetRequest{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Found {
+		return nil, badger.ErrKeyNotFound
+	}
+	return resp.Kv, nil
+}
+
+// BatchGet returns the latest versions of keys, in the order of keys, read from the same snapshot.
+// The KVs of the keys which aren't found are nil.
+func (c *Client) BatchGet(ctx context.Context, keys [][]byte) ([]*pb.KV, error) {
+	resp, err := c.c.BatchGet(ctx, &BatchGetRequest{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]*pb.KV, len(resp.Results))
+	for i, r := range resp.Results {
+		if r.Found {
+			kvs[i] = r.Kv
+		}
+	}
+	return kvs, nil
+}
+
+// Mutate applies mutations atomically. Nothing is applied if it returns an error.
+func (c *Client) Mutate(ctx context.Context, mutations ...*Mutation) error {
+	_, err := c.c.Mutate(ctx, &MutateRequest{Mutations: mutations})
+	return err
+}
+
+// Scan calls fn on the keys selected by req, in order. It stops and returns the error of fn if fn
+// fails.
+func (c *Client) Scan(ctx context.Context, req *ScanRequest, fn func(kv *pb.KV) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.c.Scan(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			if err := fn(kv); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Subscribe calls fn on the changes of the keys matched by matches, or of all the keys if there
+// are none. It blocks until ctx is done, the server ends the call, or fn fails.
+func (c *Client) Subscribe(ctx context.Context, matches []*pb.Match,
+	fn func(list *pb.KVList) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.c.Subscribe(ctx, &SubscribeRequest{Matches: matches})
+	if err != nil {
+		return err
+	}
+	for {
+		list, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(list); err != nil {
+			return err
+		}
+	}
+}
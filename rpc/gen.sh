@@ -0,0 +1,8 @@
+#!/bin/bash
+
+# Run this script from anywhere: it runs protoc from the root of the repository, so that
+# rpc.proto finds pb/badgerpb3.proto where it imports it from.
+
+cd "$(dirname "$0")/.."
+go install github.com/gogo/protobuf/protoc-gen-gogofaster@latest
+protoc --gogofaster_out=. --gogofaster_opt=plugins=grpc,paths=source_relative -I=. rpc/rpc.proto
@@ -0,0 +1,12 @@
+module github.com/dgraph-io/badger/v3/rpc
+
+go 1.12
+
+require (
+	github.com/dgraph-io/badger/v3 v3.0.0
+	github.com/gogo/protobuf v1.3.2
+	github.com/stretchr/testify v1.7.0
+	google.golang.org/grpc v1.20.1
+)
+
+replace github.com/dgraph-io/badger/v3 => ../
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+Package rpc serves a DB over gRPC, so that services which can't embed badger can use it as a
+lightweight key-value server. The service is defined in rpc.proto:
+
+	s := grpc.NewServer()
+	rpc.RegisterBadgerServer(s, rpc.NewServer(db))
+	s.Serve(lis)
+
+Client is a Go client of the service.
+*/
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultBatchSize is the number of keys per ScanResponse if ScanRequest.BatchSize is zero.
+const defaultBatchSize = 100
+
+// Server implements the Badger service on a DB.
+type Server struct {
+	db *badger.DB
+}
+
+// NewServer returns a Server reading from and writing to db. db should not be in managed mode.
+func NewServer(db *badger.DB) *Server {
+	return &Server{db: db}
+}
+
+// Get implements BadgerServer.
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	var resp *GetResponse
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		resp, err = get(txn, req.Key)
+		return err
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return resp, nil
+}
+
+// BatchGet implements BadgerServer.
+func (s *Server) BatchGet(ctx context.Context, req *BatchGetRequest) (*BatchGetResponse, error) {
+	resp := &BatchGetResponse{Results: make([]*GetResponse, 0, len(req.Keys))}
+	err := s.db.View(func(txn *badger.Txn) error {
+		for _, key := range req.Keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			r, err := get(txn, key)
+			if err != nil {
+				return err
+			}
+			resp.Results = append(resp.Results, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return resp, nil
+}
+
+// Mutate implements BadgerServer.
+func (s *Server) Mutate(ctx context.Context, req *MutateRequest) (*MutateResponse, error) {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		for _, m := range req.Mutations {
+			var err error
+			switch m.Op {
+			case Mutation_SET:
+				e := badger.NewEntry(m.Key, m.Value).WithMeta(byte(m.UserMeta))
+				if m.TtlSeconds > 0 {
+					e = e.WithTTL(time.Duration(m.TtlSeconds) * time.Second)
+				}
+				err = txn.SetEntry(e)
+			case Mutation_DELETE:
+				err = txn.Delete(m.Key)
+			default:
+				return status.Errorf(codes.InvalidArgument, "unknown mutation op: %d", m.Op)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &MutateResponse{}, nil
+}
+
+// Scan implements BadgerServer.
+func (s *Server) Scan(req *ScanRequest, stream Badger_ScanServer) error {
+	batchSize := int(req.BatchSize)
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+	ctx := stream.Context()
+	err := s.db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = req.Prefix
+		opt.PrefetchValues = !req.KeysOnly
+		it := txn.NewIterator(opt)
+		defer it.Close()
+
+		start := req.Start
+		if bytes.Compare(start, req.Prefix) < 0 {
+			start = req.Prefix
+		}
+		var batch []*pb.KV
+		var count uint32
+		for it.Seek(start); it.Valid(); it.Next() {
+			if req.Limit > 0 && count == req.Limit {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			kv, err := toKV(it.Item(), !req.KeysOnly)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, kv)
+			count++
+			if len(batch) == batchSize {
+				if err := stream.Send(&ScanResponse{Kvs: batch}); err != nil {
+					return err
+				}
+				batch = nil
+			}
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		return stream.Send(&ScanResponse{Kvs: batch})
+	})
+	return toStatus(err)
+}
+
+// Subscribe implements BadgerServer. The call returns once it is canceled by the client.
+func (s *Server) Subscribe(req *SubscribeRequest, stream Badger_SubscribeServer) error {
+	matches := make([]pb.Match, 0, len(req.Matches))
+	for _, m := range req.Matches {
+		matches = append(matches, *m)
+	}
+	if len(matches) == 0 {
+		// The empty prefix matches all the keys.
+		matches = append(matches, pb.Match{})
+	}
+	err := s.db.Subscribe(stream.Context(), stream.Send, matches)
+	if err == context.Canceled {
+		return nil
+	}
+	return toStatus(err)
+}
+
+// get returns the GetResponse of key in txn.
+func get(txn *badger.Txn, key []byte) (*GetResponse, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return &GetResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	kv, err := toKV(item, true)
+	if err != nil {
+		return nil, err
+	}
+	return &GetResponse{Kv: kv, Found: true}, nil
+}
+
+// toKV copies the item into a KV, without its value if withValue is false.
+func toKV(item *badger.Item, withValue bool) (*pb.KV, error) {
+	kv := &pb.KV{
+		Key:       item.KeyCopy(nil),
+		UserMeta:  []byte{item.UserMeta()},
+		Version:   item.Version(),
+		ExpiresAt: item.ExpiresAt(),
+	}
+	if withValue {
+		var err error
+		if kv.Value, err = item.ValueCopy(nil); err != nil {
+			return nil, err
+		}
+	}
+	return kv, nil
+}
+
+// toStatus converts the errors of the DB into gRPC status errors, so that the clients get the
+// right codes. The errors which are already status errors are returned as is.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var code codes.Code
+	switch err {
+	case badger.ErrEmptyKey, badger.ErrInvalidKey, badger.ErrBannedKey, badger.ErrInvalidRequest:
+		code = codes.InvalidArgument
+	case badger.ErrTxnTooBig:
+		code = codes.ResourceExhausted
+	case badger.ErrConflict:
+		code = codes.Aborted
+	case badger.ErrDBClosed, badger.ErrBlockedWrites:
+		code = codes.Unavailable
+	case context.Canceled:
+		code = codes.Canceled
+	case context.DeadlineExceeded:
+		code = codes.DeadlineExceeded
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	RegisterBadgerServer(s, NewServer(db))
+	go s.Serve(l)
+	defer s.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+	c := NewClient(cc)
+	ctx := context.Background()
+
+	require.NoError(t, c.Mutate(ctx,
+		&Mutation{Key: []byte("foo"), Value: []byte("bar"), UserMeta: 7},
+		&Mutation{Key: []byte("ttl"), Value: []byte("v"), TtlSeconds: 100}))
+	kv, err := c.Get(ctx, []byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), kv.Value)
+	require.Equal(t, []byte{7}, kv.UserMeta)
+	require.NotZero(t, kv.Version)
+	kv, err = c.Get(ctx, []byte("ttl"))
+	require.NoError(t, err)
+	require.True(t, kv.ExpiresAt > uint64(time.Now().Unix()))
+	_, err = c.Get(ctx, []byte("missing"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	_, err = c.Get(ctx, nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	kvs, err := c.BatchGet(ctx, [][]byte{[]byte("foo"), []byte("missing"), []byte("ttl")})
+	require.NoError(t, err)
+	require.Len(t, kvs, 3)
+	require.Equal(t, []byte("bar"), kvs[0].Value)
+	require.Nil(t, kvs[1])
+	require.Equal(t, []byte("v"), kvs[2].Value)
+
+	// A failing mutation fails the whole request.
+	err = c.Mutate(ctx,
+		&Mutation{Op: Mutation_DELETE, Key: []byte("foo")},
+		&Mutation{Key: []byte("!badger!key"), Value: []byte("v")})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = c.Get(ctx, []byte("foo"))
+	require.NoError(t, err)
+	require.NoError(t, c.Mutate(ctx, &Mutation{Op: Mutation_DELETE, Key: []byte("foo")}))
+	_, err = c.Get(ctx, []byte("foo"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+
+	var muts []*Mutation
+	for i := 0; i < 25; i++ {
+		muts = append(muts, &Mutation{Key: []byte(fmt.Sprintf("key%02d", i)), Value: []byte("v")})
+	}
+	require.NoError(t, c.Mutate(ctx, muts...))
+	scan := func(req *ScanRequest) []string {
+		var keys []string
+		require.NoError(t, c.Scan(ctx, req, func(kv *pb.KV) error {
+			require.Equal(t, !req.KeysOnly, kv.Value != nil)
+			keys = append(keys, string(kv.Key))
+			return nil
+		}))
+		return keys
+	}
+	keys := scan(&ScanRequest{Prefix: []byte("key"), BatchSize: 10})
+	require.Len(t, keys, 25)
+	require.Equal(t, "key00", keys[0])
+	require.Equal(t, "key24", keys[24])
+	keys = scan(&ScanRequest{Prefix: []byte("key"), Start: []byte("key20"), KeysOnly: true})
+	require.Equal(t, []string{"key20", "key21", "key22", "key23", "key24"}, keys)
+	keys = scan(&ScanRequest{Limit: 2})
+	require.Equal(t, []string{"key00", "key01"}, keys)
+}
+
+func TestServerSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	RegisterBadgerServer(s, NewServer(db))
+	go s.Serve(l)
+	defer s.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+	c := NewClient(cc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan *pb.KV, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Subscribe(ctx, []*pb.Match{{Prefix: []byte("sub")}}, func(list *pb.KVList) error {
+			for _, kv := range list.Kv {
+				got <- kv
+			}
+			return nil
+		})
+	}()
+
+	// The subscription starts asynchronously, so write until a change is received.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var kv *pb.KV
+	for kv == nil {
+		select {
+		case kv = <-got:
+		case <-ticker.C:
+			require.NoError(t, c.Mutate(context.Background(),
+				&Mutation{Key: []byte("other"), Value: []byte("v")},
+				&Mutation{Key: []byte("sub1"), Value: []byte("v")}))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change received")
+		}
+	}
+	require.Equal(t, []byte("sub1"), kv.Key)
+
+	cancel()
+	err = <-errCh
+	require.Equal(t, codes.Canceled, status.Code(err))
+}
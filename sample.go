@@ -0,0 +1,148 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// KeySample is a key picked by SampleKeys.
+type KeySample struct {
+	Key     []byte
+	Version uint64
+	// Size is the size of the key and of its value, including the value stored in the value log.
+	Size int64
+	// Level is the level of the table the key was picked from.
+	Level int
+}
+
+// SampleOptions are the options of SampleKeys.
+type SampleOptions struct {
+	// Prefix restricts the sample to the keys with this prefix.
+	Prefix []byte
+	// Seed seeds the random picks. Zero seeds them with the current time.
+	Seed int64
+}
+
+// sampleTable is a table SampleKeys picks keys from.
+type sampleTable struct {
+	t     *table.Table
+	level int
+}
+
+// SampleKeys returns a random sample of n keys of the tables, to estimate the distribution of the
+// keys and of their sizes without scanning them. A table is picked with a probability
+// proportional to its number of keys, and a key is picked from a random block of the table, so
+// the sample is about uniform. With a prefix, only the blocks which may hold keys with the prefix
+// are counted and picked from. The keys are picked independently, so a key can be picked more
+// than once.
+//
+// Each version of a key is an entry of the tables, so the keys with more versions are more likely
+// to be picked. The deleted and expired entries are skipped, along with the keys of the memtables.
+// Fewer than n keys are returned if not enough keys were found, like when few keys have the
+// prefix.
+func (db *DB) SampleKeys(n int, opt SampleOptions) ([]KeySample, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	seed := opt.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+
+	var tables []sampleTable
+	var cumulative []int64
+	var total int64
+	for _, l := range db.lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if t.KeyCount() == 0 || !tableMayHavePrefix(t, opt.Prefix) {
+				continue
+			}
+			t.IncrRef()
+			tables = append(tables, sampleTable{t: t, level: l.level})
+		}
+		l.RUnlock()
+	}
+	defer func() {
+		for _, st := range tables {
+			_ = st.t.DecrRef()
+		}
+	}()
+	for _, st := range tables {
+		keys, err := st.t.PrefixKeyCount(opt.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		total += int64(keys)
+		cumulative = append(cumulative, total)
+	}
+	if total == 0 {
+		return nil, nil
+	}
+
+	var samples []KeySample
+	// The picks are retried for the entries skipped, up to a limit.
+	for attempts := 10*n + 100; attempts > 0 && len(samples) < n; attempts-- {
+		pick := r.Int63n(total)
+		i := sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > pick })
+		st := tables[i]
+		k, vs, err := st.t.RandomEntry(r, opt.Prefix)
+		if err != nil {
+			return samples, err
+		}
+		key := y.ParseKey(k)
+		switch {
+		case k == nil,
+			bytes.HasPrefix(key, badgerPrefix),
+			isDeletedOrExpired(vs.Meta, vs.ExpiresAt):
+			continue
+		}
+		size := int64(len(key) + len(vs.Value))
+		if vs.Meta&bitValuePointer > 0 {
+			var vp valuePointer
+			vp.Decode(vs.Value)
+			size = int64(len(key)) + int64(vp.Len)
+		}
+		samples = append(samples, KeySample{
+			Key:     key,
+			Version: y.ParseTs(k),
+			Size:    size,
+			Level:   st.level,
+		})
+	}
+	return samples, nil
+}
+
+// tableMayHavePrefix returns false if the range of the table excludes the keys with the prefix.
+func tableMayHavePrefix(t *table.Table, prefix []byte) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+	smallest, biggest := y.ParseKey(t.Smallest()), y.ParseKey(t.Biggest())
+	if bytes.Compare(biggest, prefix) < 0 {
+		return false
+	}
+	return bytes.Compare(smallest, prefix) <= 0 || bytes.HasPrefix(smallest, prefix)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(1 << 10)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	samples, err := db.SampleKeys(10, SampleOptions{})
+	require.NoError(t, err)
+	require.Empty(t, samples)
+
+	// The keys of a have small values, and the keys of b values in the value log.
+	for _, prefix := range []string{"a", "b"} {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 2000; i++ {
+				val := []byte("value")
+				if prefix == "b" {
+					val = make([]byte, 2000)
+				}
+				if err := txn.Set([]byte(fmt.Sprintf("%s%04d", prefix, i)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 2000; i++ {
+			if err := txn.Delete([]byte(fmt.Sprintf("c%04d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// Closing the DB flushes the memtable.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	samples, err = db.SampleKeys(1000, SampleOptions{Seed: 1})
+	require.NoError(t, err)
+	require.Len(t, samples, 1000)
+	var a, b int
+	for _, s := range samples {
+		require.NotZero(t, s.Version)
+		switch s.Key[0] {
+		case 'a':
+			a++
+			require.Equal(t, int64(len(s.Key)+len("value")), s.Size)
+		case 'b':
+			b++
+			require.Greater(t, s.Size, int64(2000))
+		default:
+			require.Fail(t, "Deleted key sampled", "key: %q", s.Key)
+		}
+	}
+	// Both prefixes have the same number of keys.
+	require.InDelta(t, 500, a, 100)
+	require.InDelta(t, 500, b, 100)
+
+	samples, err = db.SampleKeys(100, SampleOptions{Prefix: []byte("b"), Seed: 1})
+	require.NoError(t, err)
+	require.Len(t, samples, 100)
+	for _, s := range samples {
+		require.True(t, bytes.HasPrefix(s.Key, []byte("b")))
+	}
+	// The keys are only picked from the blocks which may have the prefix, so a prefix with few keys
+	// of the table is sampled as well.
+	samples, err = db.SampleKeys(100, SampleOptions{Prefix: []byte("a01"), Seed: 1})
+	require.NoError(t, err)
+	require.Len(t, samples, 100)
+	for _, s := range samples {
+		require.True(t, bytes.HasPrefix(s.Key, []byte("a01")))
+	}
+	samples, err = db.SampleKeys(100, SampleOptions{Prefix: []byte("d")})
+	require.NoError(t, err)
+	require.Empty(t, samples)
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/pkg/errors"
+)
+
+// ScrubOptions are the options of DB.Scrub.
+type ScrubOptions struct {
+	// BytesPerSec limits the rate at which the files are read. The rate isn't limited if it is 0.
+	BytesPerSec int64
+	// SkipTables and SkipValueLog skip the tables and the value log files.
+	SkipTables   bool
+	SkipValueLog bool
+}
+
+// ScrubReport is the result of DB.Scrub.
+type ScrubReport struct {
+	Tables        int
+	ValueLogFiles int
+	// Bytes is the number of bytes read from the files.
+	Bytes    int64
+	Duration time.Duration
+	// Corrupt are the files whose checksums don't match their data.
+	Corrupt []CorruptFile
+}
+
+// CorruptFile is a file found corrupt by DB.Scrub.
+type CorruptFile struct {
+	Path string
+	// Err is an Error derived from ErrCorruptFile, which tells where the file is corrupt.
+	Err error
+}
+
+// Scrub reads every block of the tables and every entry of the value log files, and verifies
+// their checksums, so that the corruption of the data which is rarely read is found while it can
+// still be restored from a backup. The blocks are read from the files, not from the caches, and
+// at most opt.BytesPerSec bytes are read per second, so that Scrub can run in the background
+// without slowing down the DB. The newest value log file, which may be written to, isn't read.
+//
+// The corrupt files are returned in the report, and logged. Scrub only fails if ctx is done
+// before it completes, or if the DB is closed, which interrupts it.
+func (db *DB) Scrub(ctx context.Context, opt ScrubOptions) (*ScrubReport, error) {
+	if db.IsClosed() {
+		return nil, ErrDBClosed
+	}
+	closer := db.closers.scrub
+	closer.AddRunning(1)
+	defer closer.Done()
+	userCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-closer.HasBeenClosed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	start := time.Now()
+	report := &ScrubReport{}
+	throttle := newBandwidthThrottle(opt.BytesPerSec)
+	read := func(n int) error {
+		report.Bytes += int64(n)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return throttle.wait(ctx, n)
+	}
+	corrupt := func(path string, offset int64, err error) {
+		err = fileError(ErrCorruptFile, path, offset, err)
+		db.opt.logw(ERROR, "Scrub found a corrupt file", "path", path, "error", err)
+		report.Corrupt = append(report.Corrupt, CorruptFile{Path: path, Err: err})
+	}
+
+	var err error
+	if !opt.SkipTables {
+		err = db.lc.scrub(ctx, read, func(t *table.Table, err error) {
+			report.Tables++
+			var ce *table.CorruptError
+			switch {
+			case errors.As(err, &ce):
+				corrupt(ce.Path, ce.Offset, ce.Err)
+			case err != nil:
+				corrupt(t.Filename(), -1, err)
+			}
+		})
+	}
+	if err == nil && !opt.SkipValueLog && !db.opt.InMemory {
+		err = db.vlog.scrub(ctx, read, func(lf *logFile, end uint32, err error) {
+			report.ValueLogFiles++
+			if err != nil {
+				corrupt(lf.path, int64(end), err)
+			}
+		})
+	}
+	report.Duration = time.Since(start)
+	if err != nil && userCtx.Err() == nil {
+		// The context was canceled by Close.
+		err = ErrDBClosed
+	}
+	return report, err
+}
+
+// scrub scrubs the tables of all the levels. done is called with the error of every table, or
+// nil if it isn't corrupt.
+func (s *levelsController) scrub(ctx context.Context, read func(n int) error,
+	done func(t *table.Table, err error)) error {
+	var tables []*table.Table
+	for _, l := range s.levels {
+		l.RLock()
+		tables = tables[:0]
+		for _, t := range l.tables {
+			tables = append(tables, t)
+			t.IncrRef()
+		}
+		l.RUnlock()
+
+		for i, t := range tables {
+			err := t.Scrub(read)
+			if cerr := ctx.Err(); cerr != nil {
+				for _, t := range tables[i:] {
+					_ = t.DecrRef()
+				}
+				return cerr
+			}
+			done(t, err)
+			if err := t.DecrRef(); err != nil {
+				s.kv.opt.Errorf("unable to decrease reference of table: %s while "+
+					"scrubbing with error: %s", t.Filename(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// scrub scrubs the files of the value log, and of the large value log if there is one, except for
+// the newest ones, which may be written to. done is called with the end of the valid entries of
+// every file, and the error found after them, or nil if the file isn't corrupt.
+func (vlog *valueLog) scrub(ctx context.Context, read func(n int) error,
+	done func(lf *logFile, end uint32, err error)) error {
+	// The files are deleted by the value log GC only once there are no iterators.
+	vlog.incrIteratorCount()
+	defer func() {
+		if err := vlog.decrIteratorCount(); err != nil {
+			vlog.opt.Errorf("while scrubbing the value log: %v", err)
+		}
+	}()
+
+	var lfs []*logFile
+	for _, l := range []*valueLog{vlog, vlog.large} {
+		if l == nil {
+			continue
+		}
+		l.filesLock.RLock()
+		for _, fid := range l.sortedFids() {
+			if fid != l.maxFid {
+				lfs = append(lfs, l.filesMap[fid])
+			}
+		}
+		l.filesLock.RUnlock()
+	}
+
+	for _, lf := range lfs {
+		// The file is read in chunks, and it's only read locked while a chunk is read, so that the
+		// scrub doesn't hold up DropAll or Close while it waits for the rate limit.
+		end := uint32(vlogHeaderSize)
+		for {
+			if !vlog.logFor(lf.fid).rlockFile(lf) {
+				// The file was deleted by DropAll.
+				break
+			}
+			size := atomic.LoadUint32(&lf.size)
+			var n uint32
+			next, err := lf.iterate(true, end, func(e Entry, vp valuePointer) error {
+				if n += vp.Len; n >= scrubChunkSize {
+					return errStop
+				}
+				return nil
+			})
+			lf.lock.RUnlock()
+			if err == nil && next > end {
+				err = read(int(next - end))
+				end = next
+			}
+			if cerr := ctx.Err(); cerr != nil {
+				return cerr
+			}
+			if err == nil && n >= scrubChunkSize {
+				continue
+			}
+			if err == nil && end < size {
+				err = errors.Errorf("invalid entry in the %d bytes of the file", size)
+			}
+			done(lf, end, err)
+			break
+		}
+	}
+	return nil
+}
+
+// scrubChunkSize is the number of bytes of the entries of a value log file scrubbed at once.
+const scrubChunkSize = 1 << 20
+
+// rlockFile read locks lf, unless it was deleted.
+func (vlog *valueLog) rlockFile(lf *logFile) bool {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	if vlog.filesMap[lf.fid] != lf {
+		return false
+	}
+	lf.lock.RLock()
+	return true
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).
+		WithValueThreshold(32).
+		WithValueLogFileSize(1 << 20)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	val := make([]byte, 1000)
+	for i := 0; i < 3000; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%06d", i)), val, 0)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	report, err := db.Scrub(context.Background(), ScrubOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Corrupt)
+	require.NotZero(t, report.Tables)
+	require.Equal(t, 3, report.ValueLogFiles)
+	require.True(t, report.Bytes > 3000*1000, "bytes: %d", report.Bytes)
+
+	// The rate limit makes the scrub time out.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = db.Scrub(ctx, ScrubOptions{BytesPerSec: 1 << 20, SkipTables: true})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.NoError(t, db.Close())
+
+	// Corrupt the first block of a table, and an entry in the middle of a value log file.
+	corrupt := func(name string, off int64) {
+		fd, err := os.OpenFile(name, os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer fd.Close()
+		buf := make([]byte, 1)
+		_, err = fd.ReadAt(buf, off)
+		require.NoError(t, err)
+		buf[0] ^= 0xff
+		_, err = fd.WriteAt(buf, off)
+		require.NoError(t, err)
+	}
+	tables, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	require.NotEmpty(t, tables)
+	corrupt(tables[0], 20)
+	vlog := filepath.Join(dir, "000002.vlog")
+	corrupt(vlog, 1<<19)
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	report, err = db.Scrub(context.Background(), ScrubOptions{})
+	require.NoError(t, err)
+	require.Len(t, report.Corrupt, 2)
+	require.Equal(t, tables[0], report.Corrupt[0].Path)
+	require.Contains(t, report.Corrupt[0].Err.Error(), "block: 0")
+	require.Equal(t, CodeCorruption, ErrorCode(report.Corrupt[0].Err))
+	require.Equal(t, vlog, report.Corrupt[1].Path)
+}
+
+func TestScrubInterruptedByClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).
+		WithValueThreshold(32).
+		WithValueLogFileSize(1 << 20)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	val := make([]byte, 1000)
+	for i := 0; i < 3000; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%06d", i)), val, 0)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	errCh := make(chan error, 1)
+	go func() {
+		// Reading the value log files takes about a minute at this rate.
+		_, err := db.Scrub(context.Background(), ScrubOptions{BytesPerSec: 64 << 10, SkipTables: true})
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, db.Close())
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, ErrDBClosed, <-errCh)
+}
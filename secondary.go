@@ -0,0 +1,343 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// maxCatchUpRetries is the number of times the MANIFEST is read again, when a table it references
+// was deleted before it could be opened.
+const maxCatchUpRetries = 10
+
+// errTableDeleted is returned when a table of the MANIFEST was deleted before it could be opened.
+var errTableDeleted = errors.New("Table was deleted")
+
+// CatchUp makes the writes done since the DB was opened, or since the last CatchUp, by the process
+// which opened it read-write visible. It reads the MANIFEST, memtables and value log files again:
+// the new files are opened, and the deleted ones closed. It returns ErrNotSecondary if the DB
+// isn't opened in Secondary mode.
+//
+// The transactions started after CatchUp returns see the writes. The memtables are only read up to
+// the last complete transaction, so a transaction being written is seen by the next CatchUp.
+func (db *DB) CatchUp() error {
+	if !db.opt.Secondary {
+		return ErrNotSecondary
+	}
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	if err := db.catchUp(); err != nil {
+		return err
+	}
+	db.advanceReadTs(db.MaxVersion())
+	return nil
+}
+
+// catchUp opens the files created by the process which opened the DB read-write, and closes the
+// ones it deleted.
+func (db *DB) catchUp() error {
+	db.catchUpLock.Lock()
+	defer db.catchUpLock.Unlock()
+
+	if db.opt.encrypted() {
+		if err := db.registry.reload(); err != nil {
+			return y.Wrapf(err, "while reading key registry")
+		}
+	}
+	// The value pointers of the memtables and tables point to the value log files.
+	if err := db.vlog.refreshFiles(); err != nil {
+		return err
+	}
+	if db.vlog.large != nil {
+		if err := db.vlog.large.refreshFiles(); err != nil {
+			return err
+		}
+	}
+
+	// The memtables are read before the MANIFEST: a memtable flushed after it was read is in the
+	// tables of the MANIFEST, so no write is missed when it is dropped.
+	imm, opened, flushed, err := db.catchUpMemTables()
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		err = db.lc.catchUp()
+		if err != errTableDeleted || i == maxCatchUpRetries {
+			break
+		}
+	}
+	if err != nil {
+		for _, mt := range opened {
+			mt.DecrRef()
+		}
+		return err
+	}
+
+	db.lock.Lock()
+	db.imm = imm
+	db.lock.Unlock()
+	for _, mt := range flushed {
+		mt.DecrRef()
+	}
+	return nil
+}
+
+// catchUpMemTables replays the new entries of the memtables, and opens the new memtables. It
+// returns the memtables, the new ones among them, and the ones which were flushed since.
+func (db *DB) catchUpMemTables() (imm, opened, flushed []*memTable, err error) {
+	fids, err := memFids(db.opt.FS, db.opt.Dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	current := make(map[int]*memTable)
+	db.lock.RLock()
+	for _, mt := range db.imm {
+		current[int(mt.wal.fid)] = mt
+	}
+	db.lock.RUnlock()
+	fail := func(err error) ([]*memTable, []*memTable, []*memTable, error) {
+		for _, mt := range opened {
+			mt.DecrRef()
+		}
+		return nil, nil, nil, err
+	}
+
+	for _, fid := range fids {
+		if mt, ok := current[fid]; ok && sameLogFile(mt.wal) {
+			delete(current, fid)
+			if err := mt.UpdateSkipList(); err != nil {
+				return fail(err)
+			}
+			imm = append(imm, mt)
+			continue
+		}
+		path := db.mtFilePath(fid)
+		ready, err := logFileReady(db.opt.FS, path)
+		if err != nil {
+			return fail(err)
+		}
+		if !ready {
+			continue
+		}
+		mt, err := db.openMemTable(fid, os.O_RDONLY)
+		if err != nil {
+			if _, serr := db.opt.FS.Stat(path); os.IsNotExist(serr) {
+				// It was flushed since it was listed.
+				continue
+			}
+			return fail(y.Wrapf(err, "while opening fid: %d", fid))
+		}
+		imm = append(imm, mt)
+		opened = append(opened, mt)
+	}
+	for _, mt := range current {
+		flushed = append(flushed, mt)
+	}
+	return imm, opened, flushed, nil
+}
+
+// catchUp makes the levels match the MANIFEST written by the process which opened the DB
+// read-write. It returns errTableDeleted if a table was deleted before it could be opened.
+func (s *levelsController) catchUp() error {
+	mf, err := readManifest(s.kv.opt)
+	if err != nil {
+		return y.Wrapf(err, "while reading MANIFEST")
+	}
+
+	type levelTable struct {
+		level int
+		t     *table.Table
+	}
+	current := make(map[uint64]levelTable)
+	for _, l := range s.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			current[t.ID()] = levelTable{level: l.level, t: t}
+		}
+		l.RUnlock()
+	}
+
+	tables := make([][]*table.Table, len(s.levels))
+	var opened []*table.Table
+	for id, tf := range mf.Tables {
+		fname := table.NewFilename(id, s.kv.opt.Dir)
+		lt, ok := current[id]
+		if ok && lt.level == int(tf.Level) && sameFile(s.kv.opt.FS, lt.t.Fd, fname) {
+			delete(current, id)
+			tables[tf.Level] = append(tables[tf.Level], lt.t)
+			continue
+		}
+		t, err := s.openTable(id, tf, nil)
+		if err != nil {
+			_ = decrRefs(opened)
+			if _, serr := s.kv.opt.FS.Stat(fname); os.IsNotExist(serr) {
+				return errTableDeleted
+			}
+			return y.Wrapf(err, "Opening table %d", id)
+		}
+		opened = append(opened, t)
+		tables[tf.Level] = append(tables[tf.Level], t)
+	}
+
+	// All the levels are replaced at once, so that a read doesn't miss the keys moved from a level
+	// to the next one.
+	for _, l := range s.levels {
+		l.Lock()
+	}
+	for i, l := range s.levels {
+		l.setTables(tables[i])
+	}
+	for _, l := range s.levels {
+		l.Unlock()
+	}
+
+	var removed []*table.Table
+	for _, lt := range current {
+		removed = append(removed, lt.t)
+	}
+	return decrRefs(removed)
+}
+
+// refreshFiles opens the value log files created since they were opened, and closes the deleted
+// ones.
+func (vlog *valueLog) refreshFiles() error {
+	files, err := vlog.opt.FS.ReadDir(vlog.dirPath)
+	if err != nil {
+		return errFile(err, vlog.dirPath, "Unable to open log dir.")
+	}
+	present := make(map[uint32]struct{})
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".vlog") {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".vlog"), 10, 31)
+		if err != nil {
+			return errFile(err, file.Name(), "Unable to parse log id.")
+		}
+		present[uint32(fid)+vlog.fidBase] = struct{}{}
+	}
+
+	var closed []*logFile
+	vlog.filesLock.Lock()
+	for fid, lf := range vlog.filesMap {
+		if _, ok := present[fid]; ok && sameLogFile(lf) {
+			delete(present, fid)
+			continue
+		}
+		// The file was deleted, or replaced by another one.
+		delete(vlog.filesMap, fid)
+		closed = append(closed, lf)
+	}
+	for fid := range present {
+		path := vlog.fpath(fid)
+		ready, err := logFileReady(vlog.opt.FS, path)
+		if err != nil {
+			vlog.filesLock.Unlock()
+			return err
+		}
+		if !ready {
+			continue
+		}
+		lf := &logFile{
+			fid:      fid,
+			path:     path,
+			registry: vlog.db.registry,
+			opt:      vlog.opt,
+		}
+		if err := lf.open(path, os.O_RDONLY, 2*vlog.opt.ValueLogFileSize); err != nil {
+			if _, serr := vlog.opt.FS.Stat(path); os.IsNotExist(serr) {
+				continue
+			}
+			vlog.filesLock.Unlock()
+			return y.Wrapf(err, "Open existing file: %q", path)
+		}
+		vlog.filesMap[fid] = lf
+		if fid > vlog.maxFid {
+			vlog.maxFid = fid
+		}
+	}
+	vlog.filesLock.Unlock()
+
+	for _, lf := range closed {
+		// Wait for the reads of the file to be done.
+		lf.lock.Lock()
+		err := lf.Close(-1)
+		lf.lock.Unlock()
+		if err != nil {
+			return y.Wrapf(err, "while closing file: %s", lf.path)
+		}
+	}
+	return nil
+}
+
+// sameLogFile returns true if the file at the path of lf is still the file lf has open, and it
+// wasn't truncated.
+func sameLogFile(lf *logFile) bool {
+	fi, err := lf.opt.FS.Stat(lf.path)
+	if err != nil {
+		return false
+	}
+	ofi, err := lf.Fd.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, ofi) && fi.Size() >= int64(len(lf.Data))
+}
+
+// sameFile returns true if the file at path is still f.
+func sameFile(fs y.FS, f *os.File, path string) bool {
+	fi, err := fs.Stat(path)
+	if err != nil {
+		return false
+	}
+	ofi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, ofi)
+}
+
+// logFileReady returns true if the log file at path exists, and its header was written by the
+// process which created it.
+func logFileReady(fs y.FS, path string) (bool, error) {
+	f, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var header [vlogHeaderSize]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	// The base IV is random, so it is only zero until the header is written.
+	return !bytes.Equal(header[8:], make([]byte, vlogHeaderSize-8)), nil
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).
+		WithMemTableSize(1 << 18).
+		WithValueThreshold(1 << 10).
+		WithNumCompactors(0)
+	primary, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, primary.Close()) }()
+	require.Equal(t, ErrNotSecondary, primary.CatchUp())
+
+	value := func(i, round int) string {
+		if i%10 == 0 {
+			// Stored in the value log.
+			return fmt.Sprintf("%02000d", i+round)
+		}
+		return fmt.Sprintf("value%d-%d", i, round)
+	}
+	write := func(round int) {
+		require.NoError(t, primary.Update(func(txn *Txn) error {
+			for i := 0; i < 200; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(value(i, round))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	check := func(db *DB, round int) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 200; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+				require.NoError(t, err)
+				require.Equal(t, value(i, round), string(getItemValue(t, item)))
+			}
+			return nil
+		}))
+	}
+
+	// The secondary reads the memtable of the primary, while it has the DB open.
+	write(0)
+	secondary, err := Open(opt.WithSecondary(true))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, secondary.Close()) }()
+	check(secondary, 0)
+
+	write(1)
+	check(secondary, 0)
+	require.NoError(t, secondary.CatchUp())
+	check(secondary, 1)
+
+	// The memtables are flushed and compacted by the primary, which deletes their files.
+	for round := 2; round < 30; round++ {
+		write(round)
+	}
+	require.Eventually(t, func() bool {
+		return len(primary.Tables()) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	_, err = primary.CompactRange(CompactRangeOptions{})
+	require.NoError(t, err)
+	check(secondary, 1)
+	require.NoError(t, secondary.CatchUp())
+	check(secondary, 29)
+	require.NotEmpty(t, secondary.Tables())
+	require.Equal(t, len(primary.Tables()), len(secondary.Tables()))
+
+	require.Equal(t, ErrReadOnlyTxn, secondary.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key"), []byte("value"))
+	}))
+}
@@ -17,10 +17,11 @@
 package skl
 
 import (
+	"os"
 	"sync/atomic"
 	"unsafe"
 
-	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
 )
 
 const (
@@ -38,6 +39,7 @@ type Arena struct {
 	n          uint32
 	shouldGrow bool
 	buf        []byte
+	mf         *z.MmapFile // Only set for file-backed arenas.
 }
 
 // newArena returns a new arena.
@@ -51,10 +53,32 @@ func newArena(n int64) *Arena {
 	return out
 }
 
+// newMmapArena returns a new arena backed by a memory-mapped file of size n. The file is created
+// if it doesn't exist, and it is deleted when the arena is released.
+func newMmapArena(fname string, n int64) (*Arena, error) {
+	mf, err := z.OpenMmapFile(fname, os.O_CREATE|os.O_RDWR, int(n))
+	switch {
+	case err == nil:
+		// The file already existed. Clear out whatever it contained.
+		z.Memclr(mf.Data)
+	case err != z.NewFile:
+		return nil, err
+	}
+	return &Arena{n: 1, buf: mf.Data, mf: mf}, nil
+}
+
+// release deletes the file backing the arena, if any.
+func (s *Arena) release() error {
+	if s.mf == nil {
+		return nil
+	}
+	return s.mf.Delete()
+}
+
 func (s *Arena) allocate(sz uint32) uint32 {
 	offset := atomic.AddUint32(&s.n, sz)
 	if !s.shouldGrow {
-		y.AssertTrue(int(offset) <= len(s.buf))
+		assertTrue(int(offset) <= len(s.buf))
 		return offset - sz
 	}
 
@@ -72,7 +96,7 @@ func (s *Arena) allocate(sz uint32) uint32 {
 			growBy = sz
 		}
 		newBuf := make([]byte, len(s.buf)+int(growBy))
-		y.AssertTrue(len(s.buf) == copy(newBuf, s.buf))
+		assertTrue(len(s.buf) == copy(newBuf, s.buf))
 		s.buf = newBuf
 	}
 	return offset - sz
@@ -102,7 +126,7 @@ func (s *Arena) putNode(height int) uint32 {
 // val buffer. Returns an offset into buf. User is responsible for remembering
 // size of val. We could also store this size inside arena but the encoding and
 // decoding will incur some overhead.
-func (s *Arena) putVal(v y.ValueStruct) uint32 {
+func (s *Arena) putVal(v ValueStruct) uint32 {
 	l := uint32(v.EncodedSize())
 	offset := s.allocate(l)
 	v.Encode(s.buf[offset:])
@@ -113,7 +137,7 @@ func (s *Arena) putKey(key []byte) uint32 {
 	keySz := uint32(len(key))
 	offset := s.allocate(keySz)
 	buf := s.buf[offset : offset+keySz]
-	y.AssertTrue(len(key) == copy(buf, key))
+	assertTrue(len(key) == copy(buf, key))
 	return offset
 }
 
@@ -133,7 +157,7 @@ func (s *Arena) getKey(offset uint32, size uint16) []byte {
 
 // getVal returns byte slice at offset. The given size should be just the value
 // size and should NOT include the meta bytes.
-func (s *Arena) getVal(offset uint32, size uint32) (ret y.ValueStruct) {
+func (s *Arena) getVal(offset uint32, size uint32) (ret ValueStruct) {
 	ret.Decode(s.buf[offset : offset+size])
 	return
 }
@@ -0,0 +1,79 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package skl
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzSkiplist puts the keys encoded in data into a skiplist, and compares it against a map.
+// Each operation in data is a key length byte, a version byte, followed by the key.
+//
+// $ go test -run=XXX -fuzz=FuzzSkiplist
+func FuzzSkiplist(f *testing.F) {
+	f.Add([]byte("\x01\x01a\x01\x02a\x02\x01ab\x00\x00"))
+	f.Add([]byte("\x03\x05foo\x03\x05foo\x03\x04bar"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		l := NewGrowingSkiplist(1 << 10)
+		defer l.DecrRef()
+		model := make(map[string][]byte)
+		for len(data) >= 2 {
+			n, version := int(data[0]%16), uint64(data[1])
+			data = data[2:]
+			if n > len(data) {
+				n = len(data)
+			}
+			key := KeyWithTs(data[:n], version)
+			data = data[n:]
+			val := append([]byte{}, key...)
+			l.Put(key, ValueStruct{Value: val})
+			model[string(key)] = val
+		}
+
+		keys := make([][]byte, 0, len(model))
+		for k := range model {
+			keys = append(keys, []byte(k))
+		}
+		sort.Slice(keys, func(i, j int) bool { return CompareKeys(keys[i], keys[j]) < 0 })
+
+		it := l.NewIterator()
+		defer it.Close()
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			require.Less(t, i, len(keys))
+			require.Equal(t, keys[i], it.Key())
+			require.Equal(t, model[string(keys[i])], it.Value().Value)
+			i++
+		}
+		require.Equal(t, len(keys), i)
+
+		for _, k := range keys {
+			require.True(t, bytes.Equal(model[string(k)], l.Get(k).Value))
+			require.Equal(t, ParseTs(k), l.Get(k).Version)
+			it.Seek(k)
+			require.True(t, it.Valid())
+			require.Equal(t, k, it.Key())
+		}
+	})
+}
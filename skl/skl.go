@@ -38,7 +38,6 @@ import (
 	"sync/atomic"
 	"unsafe"
 
-	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
 )
 
@@ -96,13 +95,18 @@ func (s *Skiplist) DecrRef() {
 	if s.OnClose != nil {
 		s.OnClose()
 	}
+	// DecrRef can't return an error. A file-backed arena failing to delete its file leaves a
+	// stale file behind, which is overwritten if the same path is used again.
+	if s.arena != nil {
+		_ = s.arena.release()
+	}
 
 	// Indicate we are closed. Good for testing.  Also, lets GC reclaim memory. Race condition
 	// here would suggest we are accessing skiplist when we are supposed to have no reference!
 	s.arena = nil
 }
 
-func newNode(arena *Arena, key []byte, v y.ValueStruct, height int) *node {
+func newNode(arena *Arena, key []byte, v ValueStruct, height int) *node {
 	// The base level is already allocated in the node struct.
 	nodeOffset := arena.putNode(height)
 	keyOffset := arena.putKey(key)
@@ -128,8 +132,23 @@ func decodeValue(value uint64) (valOffset uint32, valSize uint32) {
 
 // NewSkiplist makes a new empty skiplist, with a given arena size
 func NewSkiplist(arenaSize int64) *Skiplist {
-	arena := newArena(arenaSize)
-	head := newNode(arena, nil, y.ValueStruct{}, maxHeight)
+	return newSkiplist(newArena(arenaSize))
+}
+
+// NewSkiplistMmap makes a new empty skiplist, whose arena of the given size is a memory-mapped
+// file at fname instead of heap memory. This allows for skiplists bigger than the available
+// memory, and keeps the arena out of the Go heap. The file is only scratch space. It is deleted
+// once the skiplist is released, and can't be used to reopen the skiplist.
+func NewSkiplistMmap(fname string, arenaSize int64) (*Skiplist, error) {
+	arena, err := newMmapArena(fname, arenaSize)
+	if err != nil {
+		return nil, err
+	}
+	return newSkiplist(arena), nil
+}
+
+func newSkiplist(arena *Arena) *Skiplist {
+	head := newNode(arena, nil, ValueStruct{}, maxHeight)
 	ho := arena.getNodeOffset(head)
 	return &Skiplist{
 		height:     1,
@@ -171,8 +190,8 @@ func (s *node) casNextOffset(h int, old, val uint32) bool {
 // Returns true if key is strictly > n.key.
 // If n is nil, this is an "end" marker and we return false.
 //func (s *Skiplist) keyIsAfterNode(key []byte, n *node) bool {
-//	y.AssertTrue(n != s.head)
-//	return n != nil && y.CompareKeys(key, n.key) > 0
+//	assertTrue(n != s.head)
+//	return n != nil && CompareKeys(key, n.key) > 0
 //}
 
 func (s *Skiplist) randomHeight() int {
@@ -222,7 +241,7 @@ func (s *Skiplist) findNear(key []byte, less bool, allowEqual bool) (*node, bool
 		}
 
 		nextKey := next.key(s.arena)
-		cmp := y.CompareKeys(key, nextKey)
+		cmp := CompareKeys(key, nextKey)
 		if cmp > 0 {
 			// x.key < next.key < key. We can continue to move right.
 			x = next
@@ -279,7 +298,7 @@ func (s *Skiplist) findSpliceForLevel(key []byte, before uint32, level int) (uin
 			return before, next
 		}
 		nextKey := nextNode.key(s.arena)
-		cmp := y.CompareKeys(key, nextKey)
+		cmp := CompareKeys(key, nextKey)
 		if cmp == 0 {
 			// Equality case.
 			return next, next
@@ -297,7 +316,7 @@ func (s *Skiplist) getHeight() int32 {
 }
 
 // Put inserts the key-value pair.
-func (s *Skiplist) Put(key []byte, v y.ValueStruct) {
+func (s *Skiplist) Put(key []byte, v ValueStruct) {
 	// Since we allow overwrite, we may not need to create a new node. We might not even need to
 	// increase the height. Let's defer these actions.
 
@@ -336,13 +355,13 @@ func (s *Skiplist) Put(key []byte, v y.ValueStruct) {
 	for i := 0; i < height; i++ {
 		for {
 			if s.arena.getNode(prev[i]) == nil {
-				y.AssertTrue(i > 1) // This cannot happen in base level.
+				assertTrue(i > 1) // This cannot happen in base level.
 				// We haven't computed prev, next for this level because height exceeds old listHeight.
 				// For these levels, we expect the lists to be sparse, so we can just search from head.
 				prev[i], next[i] = s.findSpliceForLevel(key, s.headOffset, i)
 				// Someone adds the exact same key before we are able to do so. This can only happen on
 				// the base level. But we know we are not on the base level.
-				y.AssertTrue(prev[i] != next[i])
+				assertTrue(prev[i] != next[i])
 			}
 			x.tower[i] = next[i]
 			pnode := s.arena.getNode(prev[i])
@@ -355,7 +374,7 @@ func (s *Skiplist) Put(key []byte, v y.ValueStruct) {
 			// because it is unlikely that lots of nodes are inserted between prev[i] and next[i].
 			prev[i], next[i] = s.findSpliceForLevel(key, prev[i], i)
 			if prev[i] == next[i] {
-				y.AssertTruef(i == 0, "Equality can happen only on base level: %d", i)
+				assertTruef(i == 0, "Equality can happen only on base level: %d", i)
 				vo := s.arena.putVal(v)
 				encValue := encodeValue(vo, v.EncodedSize())
 				prevNode := s.arena.getNode(prev[i])
@@ -394,20 +413,20 @@ func (s *Skiplist) findLast() *node {
 
 // Get gets the value associated with the key. It returns a valid value if it finds equal or earlier
 // version of the same key.
-func (s *Skiplist) Get(key []byte) y.ValueStruct {
+func (s *Skiplist) Get(key []byte) ValueStruct {
 	n, _ := s.findNear(key, false, true) // findGreaterOrEqual.
 	if n == nil {
-		return y.ValueStruct{}
+		return ValueStruct{}
 	}
 
 	nextKey := s.arena.getKey(n.keyOffset, n.keySize)
-	if !y.SameKey(key, nextKey) {
-		return y.ValueStruct{}
+	if !sameKey(key, nextKey) {
+		return ValueStruct{}
 	}
 
 	valOffset, valSize := n.getValueOffset()
 	vs := s.arena.getVal(valOffset, valSize)
-	vs.Version = y.ParseTs(nextKey)
+	vs.Version = ParseTs(nextKey)
 	return vs
 }
 
@@ -443,7 +462,7 @@ func (s *Iterator) Key() []byte {
 }
 
 // Value returns value.
-func (s *Iterator) Value() y.ValueStruct {
+func (s *Iterator) Value() ValueStruct {
 	valOffset, valSize := s.n.getValueOffset()
 	return s.list.arena.getVal(valOffset, valSize)
 }
@@ -455,13 +474,13 @@ func (s *Iterator) ValueUint64() uint64 {
 
 // Next advances to the next position.
 func (s *Iterator) Next() {
-	y.AssertTrue(s.Valid())
+	assertTrue(s.Valid())
 	s.n = s.list.getNext(s.n, 0)
 }
 
 // Prev advances to the previous position.
 func (s *Iterator) Prev() {
-	y.AssertTrue(s.Valid())
+	assertTrue(s.Valid())
 	s.n, _ = s.list.findNear(s.Key(), true, false) // find <. No equality allowed.
 }
 
@@ -534,7 +553,7 @@ func (s *UniIterator) Seek(key []byte) {
 func (s *UniIterator) Key() []byte { return s.iter.Key() }
 
 // Value implements y.Interface
-func (s *UniIterator) Value() y.ValueStruct { return s.iter.Value() }
+func (s *UniIterator) Value() ValueStruct { return s.iter.Value() }
 
 // Valid implements y.Interface
 func (s *UniIterator) Valid() bool { return s.iter.Valid() }
@@ -562,11 +581,11 @@ func NewBuilder(arenaSize int64) *Builder {
 const debug = false
 
 // Add must be used to add keys in a sorted order.
-func (b *Builder) Add(k []byte, v y.ValueStruct) {
+func (b *Builder) Add(k []byte, v ValueStruct) {
 	if debug {
-		if len(b.prevKey) > 0 && y.CompareKeys(k, b.prevKey) <= 0 {
+		if len(b.prevKey) > 0 && CompareKeys(k, b.prevKey) <= 0 {
 			panic(fmt.Sprintf("new key: %s <= prev key: %s\n",
-				y.ParseKey(k), y.ParseKey(b.prevKey)))
+				ParseKey(k), ParseKey(b.prevKey)))
 		}
 		b.prevKey = append(b.prevKey[:0], k...)
 	}
@@ -20,16 +20,19 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"go/build"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
-
-	"github.com/dgraph-io/badger/v3/y"
 )
 
 const arenaSize = 1 << 20
@@ -51,6 +54,22 @@ func length(s *Skiplist) int {
 	return count
 }
 
+// TestImports checks that the skiplist only depends on package kv of Badger, which only depends on
+// the standard library, and on ristretto/z.
+func TestImports(t *testing.T) {
+	pkg, err := build.ImportDir(".", 0)
+	require.NoError(t, err)
+	for _, imp := range pkg.Imports {
+		if !strings.Contains(strings.Split(imp, "/")[0], ".") {
+			continue // The standard library.
+		}
+		require.Contains(t, []string{
+			"github.com/dgraph-io/badger/v3/kv",
+			"github.com/dgraph-io/ristretto/z",
+		}, imp)
+	}
+}
+
 func TestEmpty(t *testing.T) {
 	key := []byte("aaa")
 	l := NewSkiplist(arenaSize)
@@ -96,34 +115,34 @@ func TestBasic(t *testing.T) {
 
 	// Try inserting values.
 	// Somehow require.Nil doesn't work when checking for unsafe.Pointer(nil).
-	l.Put(y.KeyWithTs([]byte("key1"), 0), y.ValueStruct{Value: val1, Meta: 55, UserMeta: 0})
-	l.Put(y.KeyWithTs([]byte("key2"), 2), y.ValueStruct{Value: val2, Meta: 56, UserMeta: 0})
-	l.Put(y.KeyWithTs([]byte("key3"), 0), y.ValueStruct{Value: val3, Meta: 57, UserMeta: 0})
+	l.Put(KeyWithTs([]byte("key1"), 0), ValueStruct{Value: val1, Meta: 55, UserMeta: 0})
+	l.Put(KeyWithTs([]byte("key2"), 2), ValueStruct{Value: val2, Meta: 56, UserMeta: 0})
+	l.Put(KeyWithTs([]byte("key3"), 0), ValueStruct{Value: val3, Meta: 57, UserMeta: 0})
 
-	v := l.Get(y.KeyWithTs([]byte("key"), 0))
+	v := l.Get(KeyWithTs([]byte("key"), 0))
 	require.True(t, v.Value == nil)
 
-	v = l.Get(y.KeyWithTs([]byte("key1"), 0))
+	v = l.Get(KeyWithTs([]byte("key1"), 0))
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00042", string(v.Value))
 	require.EqualValues(t, 55, v.Meta)
 
-	v = l.Get(y.KeyWithTs([]byte("key2"), 0))
+	v = l.Get(KeyWithTs([]byte("key2"), 0))
 	require.True(t, v.Value == nil)
 
-	v = l.Get(y.KeyWithTs([]byte("key3"), 0))
+	v = l.Get(KeyWithTs([]byte("key3"), 0))
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00062", string(v.Value))
 	require.EqualValues(t, 57, v.Meta)
 
-	l.Put(y.KeyWithTs([]byte("key3"), 1), y.ValueStruct{Value: val4, Meta: 12, UserMeta: 0})
-	v = l.Get(y.KeyWithTs([]byte("key3"), 1))
+	l.Put(KeyWithTs([]byte("key3"), 1), ValueStruct{Value: val4, Meta: 12, UserMeta: 0})
+	v = l.Get(KeyWithTs([]byte("key3"), 1))
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00072", string(v.Value))
 	require.EqualValues(t, 12, v.Meta)
 
-	l.Put(y.KeyWithTs([]byte("key4"), 1), y.ValueStruct{Value: val5, Meta: 60, UserMeta: 0})
-	v = l.Get(y.KeyWithTs([]byte("key4"), 1))
+	l.Put(KeyWithTs([]byte("key4"), 1), ValueStruct{Value: val5, Meta: 60, UserMeta: 0})
+	v = l.Get(KeyWithTs([]byte("key4"), 1))
 	require.NotNil(t, v.Value)
 	require.EqualValues(t, val5, v.Value)
 	require.EqualValues(t, 60, v.Meta)
@@ -135,14 +154,14 @@ func TestConcurrentBasic(t *testing.T) {
 	l := NewSkiplist(arenaSize)
 	var wg sync.WaitGroup
 	key := func(i int) []byte {
-		return y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0)
+		return KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0)
 	}
 	for i := 0; i < n; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
 			l.Put(key(i),
-				y.ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
+				ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
 		}(i)
 	}
 	wg.Wait()
@@ -166,7 +185,7 @@ func TestConcurrentBasicBigValues(t *testing.T) {
 	l := NewSkiplist(arenaSize)
 	var wg sync.WaitGroup
 	key := func(i int) []byte {
-		return y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0)
+		return KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0)
 	}
 	BigValue := func(i int) []byte {
 		return []byte(fmt.Sprintf("%01048576d", i)) // Have 1 MB value which is > math.MaxUint16.
@@ -176,7 +195,7 @@ func TestConcurrentBasicBigValues(t *testing.T) {
 		go func(i int) {
 			defer wg.Done()
 			l.Put(key(i),
-				y.ValueStruct{Value: BigValue(i), Meta: 0, UserMeta: 0})
+				ValueStruct{Value: BigValue(i), Meta: 0, UserMeta: 0})
 		}(i)
 	}
 	wg.Wait()
@@ -197,7 +216,7 @@ func TestConcurrentBasicBigValues(t *testing.T) {
 // TestOneKey will read while writing to one single key.
 func TestOneKey(t *testing.T) {
 	const n = 100
-	key := y.KeyWithTs([]byte("thekey"), 0)
+	key := KeyWithTs([]byte("thekey"), 0)
 	l := NewSkiplist(arenaSize)
 	defer l.DecrRef()
 
@@ -206,7 +225,7 @@ func TestOneKey(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			l.Put(key, y.ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
+			l.Put(key, ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
 		}(i)
 	}
 	// We expect that at least some write made it such that some read returns a value.
@@ -235,103 +254,103 @@ func TestFindNear(t *testing.T) {
 	defer l.DecrRef()
 	for i := 0; i < 1000; i++ {
 		key := fmt.Sprintf("%05d", i*10+5)
-		l.Put(y.KeyWithTs([]byte(key), 0), y.ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
+		l.Put(KeyWithTs([]byte(key), 0), ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
 	}
 
-	n, eq := l.findNear(y.KeyWithTs([]byte("00001"), 0), false, false)
+	n, eq := l.findNear(KeyWithTs([]byte("00001"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("00001"), 0), false, true)
+	n, eq = l.findNear(KeyWithTs([]byte("00001"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("00001"), 0), true, false)
+	n, eq = l.findNear(KeyWithTs([]byte("00001"), 0), true, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("00001"), 0), true, true)
+	n, eq = l.findNear(KeyWithTs([]byte("00001"), 0), true, true)
 	require.Nil(t, n)
 	require.False(t, eq)
 
-	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), false, false)
+	n, eq = l.findNear(KeyWithTs([]byte("00005"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("00015"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("00015"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), false, true)
+	n, eq = l.findNear(KeyWithTs([]byte("00005"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
 	require.True(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), true, false)
+	n, eq = l.findNear(KeyWithTs([]byte("00005"), 0), true, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), true, true)
+	n, eq = l.findNear(KeyWithTs([]byte("00005"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("00005"), 0), string(n.key(l.arena)))
 	require.True(t, eq)
 
-	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), false, false)
+	n, eq = l.findNear(KeyWithTs([]byte("05555"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05565"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05565"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), false, true)
+	n, eq = l.findNear(KeyWithTs([]byte("05555"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
 	require.True(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), true, false)
+	n, eq = l.findNear(KeyWithTs([]byte("05555"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05545"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05545"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), true, true)
+	n, eq = l.findNear(KeyWithTs([]byte("05555"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
 	require.True(t, eq)
 
-	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), false, false)
+	n, eq = l.findNear(KeyWithTs([]byte("05558"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05565"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05565"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), false, true)
+	n, eq = l.findNear(KeyWithTs([]byte("05558"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05565"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05565"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), true, false)
+	n, eq = l.findNear(KeyWithTs([]byte("05558"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), true, true)
+	n, eq = l.findNear(KeyWithTs([]byte("05558"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("05555"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
 
-	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), false, false)
+	n, eq = l.findNear(KeyWithTs([]byte("09995"), 0), false, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), false, true)
+	n, eq = l.findNear(KeyWithTs([]byte("09995"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
 	require.True(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), true, false)
+	n, eq = l.findNear(KeyWithTs([]byte("09995"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("09985"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("09985"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), true, true)
+	n, eq = l.findNear(KeyWithTs([]byte("09995"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
 	require.True(t, eq)
 
-	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), false, false)
+	n, eq = l.findNear(KeyWithTs([]byte("59995"), 0), false, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), false, true)
+	n, eq = l.findNear(KeyWithTs([]byte("59995"), 0), false, true)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), true, false)
+	n, eq = l.findNear(KeyWithTs([]byte("59995"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
-	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), true, true)
+	n, eq = l.findNear(KeyWithTs([]byte("59995"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, y.KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
+	require.EqualValues(t, KeyWithTs([]byte("09995"), 0), string(n.key(l.arena)))
 	require.False(t, eq)
 }
 
@@ -346,8 +365,8 @@ func TestIteratorNext(t *testing.T) {
 	it.SeekToFirst()
 	require.False(t, it.Valid())
 	for i := n - 1; i >= 0; i-- {
-		l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
-			y.ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
+		l.Put(KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+			ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
 	}
 	it.SeekToFirst()
 	for i := 0; i < n; i++ {
@@ -370,8 +389,8 @@ func TestIteratorPrev(t *testing.T) {
 	it.SeekToFirst()
 	require.False(t, it.Valid())
 	for i := 0; i < n; i++ {
-		l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
-			y.ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
+		l.Put(KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+			ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
 	}
 	it.SeekToLast()
 	for i := n - 1; i >= 0; i-- {
@@ -398,52 +417,52 @@ func TestIteratorSeek(t *testing.T) {
 	// 1000, 1010, 1020, ..., 1990.
 	for i := n - 1; i >= 0; i-- {
 		v := i*10 + 1000
-		l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i*10+1000)), 0),
-			y.ValueStruct{Value: newValue(v), Meta: 0, UserMeta: 0})
+		l.Put(KeyWithTs([]byte(fmt.Sprintf("%05d", i*10+1000)), 0),
+			ValueStruct{Value: newValue(v), Meta: 0, UserMeta: 0})
 	}
 	it.SeekToFirst()
 	require.True(t, it.Valid())
 	v := it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.Seek(y.KeyWithTs([]byte("01000"), 0))
+	it.Seek(KeyWithTs([]byte("01000"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.Seek(y.KeyWithTs([]byte("01005"), 0))
+	it.Seek(KeyWithTs([]byte("01005"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01010", v.Value)
 
-	it.Seek(y.KeyWithTs([]byte("01010"), 0))
+	it.Seek(KeyWithTs([]byte("01010"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01010", v.Value)
 
-	it.Seek(y.KeyWithTs([]byte("99999"), 0))
+	it.Seek(KeyWithTs([]byte("99999"), 0))
 	require.False(t, it.Valid())
 
 	// Try SeekForPrev.
-	it.SeekForPrev(y.KeyWithTs([]byte("00"), 0))
+	it.SeekForPrev(KeyWithTs([]byte("00"), 0))
 	require.False(t, it.Valid())
 
-	it.SeekForPrev(y.KeyWithTs([]byte("01000"), 0))
+	it.SeekForPrev(KeyWithTs([]byte("01000"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.SeekForPrev(y.KeyWithTs([]byte("01005"), 0))
+	it.SeekForPrev(KeyWithTs([]byte("01005"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.SeekForPrev(y.KeyWithTs([]byte("01010"), 0))
+	it.SeekForPrev(KeyWithTs([]byte("01010"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01010", v.Value)
 
-	it.SeekForPrev(y.KeyWithTs([]byte("99999"), 0))
+	it.SeekForPrev(KeyWithTs([]byte("99999"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01990", v.Value)
@@ -455,7 +474,7 @@ func randomKey(rng *rand.Rand) []byte {
 	key2 := rng.Uint32()
 	binary.LittleEndian.PutUint32(b, key)
 	binary.LittleEndian.PutUint32(b[4:], key2)
-	return y.KeyWithTs(b, 0)
+	return KeyWithTs(b, 0)
 }
 
 func TestBuilder(t *testing.T) {
@@ -464,13 +483,13 @@ func TestBuilder(t *testing.T) {
 	buf := make([]byte, 8)
 	for i := 0; i < N; i++ {
 		binary.BigEndian.PutUint64(buf, uint64(i))
-		key := y.KeyWithTs(buf, 0)
-		b.Add(key, y.ValueStruct{Value: []byte("00072")})
+		key := KeyWithTs(buf, 0)
+		b.Add(key, ValueStruct{Value: []byte("00072")})
 	}
 	sl := b.s
 	for i := 0; i < N; i++ {
 		binary.BigEndian.PutUint64(buf, uint64(i))
-		key := y.KeyWithTs(buf, 0)
+		key := KeyWithTs(buf, 0)
 		v := sl.Get(key)
 		require.NotNil(t, v.Value)
 		require.EqualValues(t, "00072", string(v.Value))
@@ -483,7 +502,7 @@ func TestBuilder(t *testing.T) {
 	i := 0
 	for it.Valid() {
 		binary.BigEndian.PutUint64(buf, uint64(i))
-		key := y.KeyWithTs(buf, 0)
+		key := KeyWithTs(buf, 0)
 		require.Equal(t, key, it.Key())
 		it.Next()
 		i++
@@ -491,6 +510,37 @@ func TestBuilder(t *testing.T) {
 	require.Equal(t, N, i)
 }
 
+func TestSkiplistMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skl-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "arena")
+	l, err := NewSkiplistMmap(fname, arenaSize)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		key := KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0)
+		l.Put(key, ValueStruct{Value: newValue(i), Meta: 55, UserMeta: 0})
+	}
+	require.Equal(t, 1000, length(l))
+
+	it := l.NewIterator()
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.EqualValues(t, newValue(i), it.Value().Value)
+		require.EqualValues(t, 55, it.Value().Meta)
+		i++
+	}
+	require.NoError(t, it.Close())
+	require.Equal(t, 1000, i)
+
+	// The file is deleted once the skiplist is released.
+	require.FileExists(t, fname)
+	l.DecrRef()
+	_, err = os.Stat(fname)
+	require.True(t, os.IsNotExist(err))
+}
+
 // Standard test. Some fraction is read. Some fraction is write. Writes have
 // to go through mutex lock.
 func BenchmarkReadWrite(b *testing.B) {
@@ -511,7 +561,7 @@ func BenchmarkReadWrite(b *testing.B) {
 							count++
 						}
 					} else {
-						l.Put(randomKey(rng), y.ValueStruct{Value: value, Meta: 0, UserMeta: 0})
+						l.Put(randomKey(rng), ValueStruct{Value: value, Meta: 0, UserMeta: 0})
 					}
 				}
 			})
@@ -559,7 +609,25 @@ func BenchmarkWrite(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 		for pb.Next() {
-			l.Put(randomKey(rng), y.ValueStruct{Value: value, Meta: 0, UserMeta: 0})
+			l.Put(randomKey(rng), ValueStruct{Value: value, Meta: 0, UserMeta: 0})
+		}
+	})
+}
+
+func BenchmarkWriteMmap(b *testing.B) {
+	dir, err := ioutil.TempDir("", "skl-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	value := newValue(123)
+	l, err := NewSkiplistMmap(filepath.Join(dir, "arena"), int64((b.N+1)*MaxNodeSize))
+	require.NoError(b, err)
+	defer l.DecrRef()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			l.Put(randomKey(rng), ValueStruct{Value: value, Meta: 0, UserMeta: 0})
 		}
 	})
 }
@@ -577,8 +645,8 @@ func BenchmarkSortedWrites(b *testing.B) {
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			binary.BigEndian.PutUint64(buf, uint64(i))
-			key := y.KeyWithTs(buf, 0)
-			bl.Add(key, y.ValueStruct{Value: []byte("00072")})
+			key := KeyWithTs(buf, 0)
+			bl.Add(key, ValueStruct{Value: []byte("00072")})
 		}
 	})
 
@@ -588,8 +656,8 @@ func BenchmarkSortedWrites(b *testing.B) {
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			binary.BigEndian.PutUint64(buf, uint64(i))
-			key := y.KeyWithTs(buf, 0)
-			bl.Put(key, y.ValueStruct{Value: []byte("00072")})
+			key := KeyWithTs(buf, 0)
+			bl.Put(key, ValueStruct{Value: []byte("00072")})
 		}
 	})
 
@@ -599,8 +667,8 @@ func BenchmarkSortedWrites(b *testing.B) {
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			binary.BigEndian.PutUint64(buf, uint64(i))
-			key := y.KeyWithTs(buf, 0)
-			v := y.ValueStruct{Value: []byte("00072")}
+			key := KeyWithTs(buf, 0)
+			v := ValueStruct{Value: []byte("00072")}
 			vbuf := make([]byte, v.EncodedSize())
 			v.Encode(vbuf)
 
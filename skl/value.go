@@ -0,0 +1,73 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package skl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3/kv"
+)
+
+// ValueStruct represents the value info that can be associated with a key, but also the internal
+// Meta field. It is kv.ValueStruct, so the skiplist encodes the values the same way as Badger.
+type ValueStruct = kv.ValueStruct
+
+// The skiplist orders keys the same way as Badger does. Every key must have an 8 byte version
+// suffix, as added by KeyWithTs. Keys are sorted by the part without the suffix first, and then in
+// descending order of their versions. The functions below call the ones in package kv, which
+// only depends on the standard library.
+
+// KeyWithTs returns the key with the version ts appended to it.
+func KeyWithTs(key []byte, ts uint64) []byte {
+	return kv.KeyWithTs(key, ts)
+}
+
+// ParseTs parses the version from a key created by KeyWithTs.
+func ParseTs(key []byte) uint64 {
+	return kv.ParseTs(key)
+}
+
+// ParseKey returns the key without its version suffix.
+func ParseKey(key []byte) []byte {
+	return kv.ParseKey(key)
+}
+
+// CompareKeys compares the keys without their versions, and then their versions. The keys must
+// have versions.
+func CompareKeys(key1, key2 []byte) int {
+	return kv.CompareKeys(key1, key2)
+}
+
+func sameKey(src, dst []byte) bool {
+	if len(src) != len(dst) {
+		return false
+	}
+	return bytes.Equal(ParseKey(src), ParseKey(dst))
+}
+
+func assertTrue(b bool) {
+	if !b {
+		panic("skl: assert failed")
+	}
+}
+
+func assertTruef(b bool, format string, args ...interface{}) {
+	if !b {
+		panic(fmt.Sprintf("skl: "+format, args...))
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"time"
+)
+
+// slowLogCapacity is the number of entries kept in the slow log.
+const slowLogCapacity = 256
+
+// SlowOp is the kind of an operation recorded in the slow log.
+type SlowOp int
+
+const (
+	SlowGet SlowOp = iota
+	SlowCommit
+	SlowFlush
+	SlowCompaction
+)
+
+func (op SlowOp) String() string {
+	switch op {
+	case SlowGet:
+		return "get"
+	case SlowCommit:
+		return "commit"
+	case SlowFlush:
+		return "flush"
+	case SlowCompaction:
+		return "compaction"
+	}
+	return "unknown"
+}
+
+// SlowLogLookup is the lookup of a key in a memtable or a level, done by a get.
+type SlowLogLookup struct {
+	// Level is the level looked up, or -1 for a memtable.
+	Level    int
+	Found    bool
+	Duration time.Duration
+}
+
+// SlowLogEntry describes an operation which took longer than Options.SlowLogThreshold.
+type SlowLogEntry struct {
+	Op       SlowOp
+	Start    time.Time
+	Duration time.Duration
+	// KeyFingerprint is the hash of the key of a get, as used for conflict detection.
+	KeyFingerprint uint64
+	// Lookups are the memtables and the levels looked up by a get, in order.
+	Lookups []SlowLogLookup
+	// Entries is the number of entries committed.
+	Entries int
+	// Bytes is the size of the entries committed, of the table flushed, or of the tables
+	// compacted.
+	Bytes int64
+	// Level and OutputLevel are the levels a compaction is from and into.
+	Level       int
+	OutputLevel int
+	Err         error
+}
+
+// slowLog is a ring buffer of the latest slow operations.
+type slowLog struct {
+	sync.Mutex
+	entries []SlowLogEntry
+	next    int // Index of the next entry to overwrite, once entries is full.
+}
+
+func (l *slowLog) add(e SlowLogEntry) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.entries) < slowLogCapacity {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % slowLogCapacity
+}
+
+// recordSlow adds the entry to the slow log, if its duration exceeds SlowLogThreshold.
+func (db *DB) recordSlow(e SlowLogEntry) {
+	if db.opt.SlowLogThreshold <= 0 || e.Duration < db.opt.SlowLogThreshold {
+		return
+	}
+	db.slowLog.add(e)
+}
+
+// SlowLog returns the latest operations which took longer than Options.SlowLogThreshold, oldest
+// first. At most 256 operations are kept.
+func (db *DB) SlowLog() []SlowLogEntry {
+	l := &db.slowLog
+	l.Lock()
+	defer l.Unlock()
+	res := make([]SlowLogEntry, 0, len(l.entries))
+	res = append(res, l.entries[l.next:]...)
+	return append(res, l.entries[:l.next]...)
+}
+
+// getTrace records the lookups of a get, as events of its span and, if the slow log is enabled,
+// with the time spent on each of them. A nil getTrace records nothing.
+type getTrace struct {
+	span    Span
+	last    time.Time // Zero if the lookups aren't timed.
+	lookups []SlowLogLookup
+}
+
+// lookup records the lookup of the key in a memtable or a level. level is -1 for a memtable.
+func (gt *getTrace) lookup(level int, found bool) {
+	if gt == nil {
+		return
+	}
+	if !gt.last.IsZero() {
+		now := time.Now()
+		gt.lookups = append(gt.lookups,
+			SlowLogLookup{Level: level, Found: found, Duration: now.Sub(gt.last)})
+		gt.last = now
+	}
+	if !gt.span.IsRecording() {
+		return
+	}
+	name := "memtable"
+	attrs := []Attribute{boolAttr("found", found)}
+	if level >= 0 {
+		name = "level"
+		attrs = append(attrs, intAttr("level", int64(level)))
+	}
+	gt.span.AddEvent(name, attrs...)
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	// Every operation takes at least a nanosecond, so all of them are recorded.
+	opt := getTestOptions(dir).WithSlowLogThreshold(time.Nanosecond)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("foo"), []byte("bar"))
+	}))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("missing"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+
+	entries := db.SlowLog()
+	require.Len(t, entries, 2)
+	require.Equal(t, SlowCommit, entries[0].Op)
+	require.Equal(t, 1, entries[0].Entries)
+	require.NoError(t, entries[0].Err)
+
+	get := entries[1]
+	require.Equal(t, SlowGet, get.Op)
+	require.Equal(t, z.MemHash([]byte("missing")), get.KeyFingerprint)
+	// The memtable and all the levels are looked up.
+	require.Len(t, get.Lookups, 1+db.opt.MaxLevels)
+	require.Equal(t, -1, get.Lookups[0].Level)
+	for i, l := range get.Lookups[1:] {
+		require.Equal(t, i, l.Level)
+		require.False(t, l.Found)
+	}
+}
+
+func TestSlowLogRing(t *testing.T) {
+	db := &DB{}
+	for i := 0; i < slowLogCapacity+10; i++ {
+		db.slowLog.add(SlowLogEntry{Entries: i})
+	}
+	entries := db.SlowLog()
+	require.Len(t, entries, slowLogCapacity)
+	for i, e := range entries {
+		require.Equal(t, i+10, e.Entries)
+	}
+}
@@ -63,6 +63,13 @@ type Stream struct {
 	// Note: Calls to ChooseKey are concurrent.
 	ChooseKey func(item *Item) bool
 
+	// KeyFilter is invoked on each new key before ChooseKey, and the key is skipped if it returns
+	// false. Unlike ChooseKey, it doesn't get the item, so it is cheaper to filter on the key
+	// alone. KeyFilter can be left nil to select all keys.
+	//
+	// Note: Calls to KeyFilter are concurrent.
+	KeyFilter func(key []byte) bool
+
 	// KeyToList, similar to ChooseKey, is only invoked on the highest version of the value. It
 	// is upto the caller to iterate over the versions and generate zero, one or more KVs. It
 	// is expected that the user would advance the iterator to go through the versions of the
@@ -79,6 +86,17 @@ type Stream struct {
 	// Note: Calls to KeyToList are concurrent.
 	KeyToList func(key []byte, itr *Iterator) (*pb.KVList, error)
 
+	// Transform is invoked on each KV generated by KeyToList, before it is batched up for Send. It
+	// returns the KV to send, which can be kv modified in place, or nil to drop it. If it returns
+	// an error, Orchestrate stops and returns it. Transform can be left nil to send the KVs as is.
+	//
+	// Note: Calls to Transform are concurrent.
+	Transform func(kv *pb.KV) (*pb.KV, error)
+
+	// OnRangeDone is invoked each time the iteration over a key range is done, to report the
+	// progress of Stream. Calls to OnRangeDone are serial.
+	OnRangeDone func(p RangeProgress)
+
 	// This is the method where Stream sends the final output. All calls to Send are done by a
 	// single goroutine, i.e. logic within Send method can expect single threaded execution.
 	Send func(buf *z.Buffer) error
@@ -95,6 +113,24 @@ type Stream struct {
 	doneMarkers  bool
 	scanned      uint64 // used to estimate the ETA for data scan.
 	numProducers int32
+	numRanges    int32
+	rangesDone   int32
+	progressMu   sync.Mutex
+}
+
+// RangeProgress is the progress of Stream, reported to OnRangeDone once the iteration over the key
+// range [Left, Right) is done. A nil Left or Right is the start or the end of the DB.
+type RangeProgress struct {
+	Left  []byte
+	Right []byte
+	// KeysScanned is the number of keys iterated over in the range, and KeysSent the number of
+	// them which were picked. KVsSent is the number of KVs sent for them.
+	KeysScanned int
+	KeysSent    int
+	KVsSent     int
+	// RangesDone is the number of ranges done, out of RangesTotal.
+	RangesDone  int
+	RangesTotal int
 }
 
 // SendDoneMarkers when true would send out done markers on the stream. False by default.
@@ -130,7 +166,7 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 		kv.ExpiresAt = item.ExpiresAt()
 		// As we do full copy, we need to transmit only if it is a delete key or not.
 		kv.Meta = []byte{item.meta & bitDelete}
-		kv.UserMeta = a.Copy([]byte{item.UserMeta()})
+		kv.UserMeta = a.Copy(kvUserMeta(item.UserMeta(), item.UserMetadata()))
 
 		list.Kv = append(list.Kv, kv)
 		if st.db.opt.NumVersionsToKeep == 1 {
@@ -158,6 +194,7 @@ func (st *Stream) produceRanges(ctx context.Context) {
 	y.AssertTrue(ranges[0].left == nil)
 	y.AssertTrue(ranges[len(ranges)-1].right == nil)
 	st.db.opt.Infof("Number of ranges found: %d\n", len(ranges))
+	atomic.StoreInt32(&st.numRanges, int32(len(ranges)))
 
 	// Sort in descending order of size.
 	sort.Slice(ranges, func(i, j int) bool {
@@ -204,6 +241,7 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 			return nil
 		}
 
+		progress := RangeProgress{Left: kr.left, Right: kr.right}
 		var prevKey []byte
 		for itr.Seek(kr.left); itr.Valid(); {
 			// it.Valid would only return true for keys with the provided Prefix in iterOpts.
@@ -219,7 +257,12 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 				break
 			}
 
+			progress.KeysScanned++
+
 			// Check if we should pick this key.
+			if st.KeyFilter != nil && !st.KeyFilter(item.Key()) {
+				continue
+			}
 			if st.ChooseKey != nil && !st.ChooseKey(item) {
 				continue
 			}
@@ -234,7 +277,17 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 			if list == nil || len(list.Kv) == 0 {
 				continue
 			}
+			progress.KeysSent++
 			for _, kv := range list.Kv {
+				if st.Transform != nil {
+					if kv, err = st.Transform(kv); err != nil {
+						return err
+					}
+					if kv == nil {
+						continue
+					}
+				}
+				progress.KVsSent++
 				kv.StreamId = streamId
 				KVToBuffer(kv, outList)
 				if outList.LenNoPadding() < batchSize {
@@ -253,7 +306,17 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 			}
 			KVToBuffer(kv, outList)
 		}
-		return sendIt()
+		if err := sendIt(); err != nil {
+			return err
+		}
+		if st.OnRangeDone != nil {
+			st.progressMu.Lock()
+			progress.RangesDone = int(atomic.AddInt32(&st.rangesDone, 1))
+			progress.RangesTotal = int(atomic.LoadInt32(&st.numRanges))
+			st.OnRangeDone(progress)
+			st.progressMu.Unlock()
+		}
+		return nil
 	}
 
 	for {
@@ -406,16 +469,22 @@ func (st *Stream) copyTablesOver(ctx context.Context, tableMatrix [][]*table.Tab
 				t.ID(), level, humanize.IBytes(uint64(t.Size())))
 			tableManifest := manifest.Tables[t.ID()]
 			change := pb.ManifestChange{
-				Op:    pb.ManifestChange_CREATE,
-				Level: uint32(level),
-				KeyId: tableManifest.KeyID,
-				// Hard coding it, since we're supporting only AES for now.
-				EncryptionAlgo: pb.EncryptionAlgo_aes,
+				// The receiver needs the ID to read the blocks of AES-GCM tables.
+				Id:             t.ID(),
+				Op:             pb.ManifestChange_CREATE,
+				Level:          uint32(level),
+				KeyId:          tableManifest.KeyID,
+				EncryptionAlgo: pb.EncryptionAlgo(tableManifest.EncryptionMode),
 				Compression:    uint32(tableManifest.Compression),
 			}
 
 			buf, err := change.Marshal()
 			y.Check(err)
+			data, err := t.Content()
+			if err != nil {
+				out.Release()
+				return err
+			}
 
 			// We send the table along with level to the destination, so they'd know where to
 			// place the tables. We'd send all the tables first, before we start streaming. So, the
@@ -423,7 +492,7 @@ func (st *Stream) copyTablesOver(ctx context.Context, tableMatrix [][]*table.Tab
 			kv := &pb.KV{
 				// Key can be used for MANIFEST.
 				Key:   buf,
-				Value: t.Data,
+				Value: data,
 				Kind:  pb.KV_FILE,
 			}
 			KVToBuffer(kv, out)
@@ -447,13 +516,17 @@ func (st *Stream) copyTablesOver(ctx context.Context, tableMatrix [][]*table.Tab
 // return that error. Orchestrate can be called multiple times, but in serial order.
 func (st *Stream) Orchestrate(ctx context.Context) error {
 	if st.FullCopy {
-		if !st.db.opt.managedTxns || st.SinceTs != 0 || st.ChooseKey != nil && st.KeyToList != nil {
+		// The tables copied over can't be filtered or transformed.
+		if !st.db.opt.managedTxns || st.SinceTs != 0 || st.ChooseKey != nil && st.KeyToList != nil ||
+			st.KeyFilter != nil || st.Transform != nil {
 			panic("Got invalid stream options when doing full copy")
 		}
 	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	st.rangeCh = make(chan keyRange, 3) // Contains keys for posting lists.
+	atomic.StoreInt32(&st.numRanges, 0)
+	atomic.StoreInt32(&st.rangesDone, 0)
 
 	// kvChan should only have a small capacity to ensure that we don't buffer up too much data if
 	// sending is slow. Page size is set to 4MB, which is used to lazily cap the size of each
@@ -555,7 +628,7 @@ func (st *Stream) Orchestrate(ctx context.Context) error {
 	newIterator := func(threadId int) *Iterator {
 		var itrs []y.Iterator
 		for _, mt := range memTables {
-			itrs = append(itrs, mt.sl.NewUniIterator(false))
+			itrs = append(itrs, mt.NewUniIterator(false))
 		}
 		if tables := tableMatrix[0]; len(tables) > 0 {
 			itrs = append(itrs, iteratorsReversed(tables, 0)...)
@@ -0,0 +1,303 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+const (
+	streamCheckpointFilename        = "STREAMCHECKPOINT"
+	streamCheckpointRewriteFilename = "STREAMCHECKPOINT-REWRITE"
+)
+
+// StreamCheckpoint is the progress of an interrupted StreamWriter, returned by
+// StreamWriter.PrepareResumable.
+type StreamCheckpoint struct {
+	// Ranges are the ranges of keys which were written, with all their versions.
+	Ranges []CheckpointRange
+	// MaxVersion is the highest version written.
+	MaxVersion uint64
+}
+
+// CheckpointRange is the range of keys [First, Last] written by a stream.
+type CheckpointRange struct {
+	First []byte
+	Last  []byte
+}
+
+// Contains returns true if key was written, so that it must not be written again. It can be used
+// as the Stream.KeyFilter of the stream resuming the writes, with its result negated.
+func (c *StreamCheckpoint) Contains(key []byte) bool {
+	i := sort.Search(len(c.Ranges), func(i int) bool {
+		return bytes.Compare(c.Ranges[i].Last, key) >= 0
+	})
+	return i < len(c.Ranges) && bytes.Compare(c.Ranges[i].First, key) <= 0
+}
+
+// checkpointState is the state persisted in the checkpoint file.
+type checkpointState struct {
+	// Level is the level the tables are written to.
+	Level      int
+	MaxVersion uint64
+	// Tables are the tables written up to the checkpoint. The other tables of Level are deleted
+	// when resuming.
+	Tables []uint64
+	Ranges []CheckpointRange
+}
+
+// streamCheckpointer persists the progress of a StreamWriter. The tables of a stream are created
+// concurrently, so the progress of a stream only moves forward once all its earlier tables are
+// created.
+type streamCheckpointer struct {
+	sync.Mutex
+	db    *DB
+	state checkpointState
+	// prev are the ranges written before resuming, sorted, which the tables must not overlap.
+	prev []CheckpointRange
+	// streams are the ranges written by the streams since resuming, keyed by stream id.
+	streams map[uint32]*CheckpointRange
+	// pending are the tables created out of order, keyed by stream id and sequence number, and
+	// next is the sequence number of the next table of each stream.
+	pending map[uint32]map[int]checkpointTable
+	next    map[uint32]int
+}
+
+type checkpointTable struct {
+	id         uint64
+	maxVersion uint64
+	first      []byte
+	last       []byte
+}
+
+func newStreamCheckpointer(db *DB, state checkpointState) *streamCheckpointer {
+	c := &streamCheckpointer{
+		db:      db,
+		state:   state,
+		prev:    mergeRanges(state.Ranges),
+		streams: make(map[uint32]*CheckpointRange),
+		pending: make(map[uint32]map[int]checkpointTable),
+		next:    make(map[uint32]int),
+	}
+	return c
+}
+
+// mergeRanges sorts the ranges and merges the overlapping ones. A stream resumed around the ranges
+// written before resuming has a range overlapping them.
+func mergeRanges(ranges []CheckpointRange) []CheckpointRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].First, ranges[j].First) < 0
+	})
+	var merged []CheckpointRange
+	for _, r := range ranges {
+		n := len(merged)
+		if n > 0 && bytes.Compare(r.First, merged[n-1].Last) <= 0 {
+			if bytes.Compare(r.Last, merged[n-1].Last) > 0 {
+				merged[n-1].Last = r.Last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// readStreamCheckpoint returns the checkpoint in dir, or nil if there is none.
+func readStreamCheckpoint(fs y.FS, dir string) (*checkpointState, error) {
+	buf, err := y.ReadFile(fs, filepath.Join(dir, streamCheckpointFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state checkpointState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, errors.Wrapf(err, "while reading stream checkpoint")
+	}
+	return &state, nil
+}
+
+// removeStreamCheckpoint removes the checkpoint in dir, once the writes are done.
+func removeStreamCheckpoint(fs y.FS, dir string) error {
+	err := fs.Remove(filepath.Join(dir, streamCheckpointFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// overlaps returns an error if key was written before resuming, and true if a range written
+// before resuming is between lastKey and key, in which case a table can't contain both.
+func (c *streamCheckpointer) overlaps(lastKey, key []byte) (bool, error) {
+	i := sort.Search(len(c.prev), func(i int) bool {
+		return bytes.Compare(c.prev[i].Last, key) >= 0
+	})
+	if i < len(c.prev) && bytes.Compare(c.prev[i].First, key) <= 0 {
+		return false, errors.Errorf("key %x was already written before the checkpoint", key)
+	}
+	// prev[i-1] is the last range before key.
+	return len(lastKey) > 0 && i > 0 && bytes.Compare(c.prev[i-1].Last, lastKey) > 0, nil
+}
+
+// tableCreated records that the table of the stream with the sequence number seq was created,
+// with the keys [first, last], and persists the checkpoint if the progress of the stream moved.
+func (c *streamCheckpointer) tableCreated(streamID uint32, seq int, t checkpointTable) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.pending[streamID] == nil {
+		c.pending[streamID] = make(map[int]checkpointTable)
+	}
+	c.pending[streamID][seq] = t
+
+	moved := false
+	for {
+		next := c.next[streamID]
+		t, ok := c.pending[streamID][next]
+		if !ok {
+			break
+		}
+		delete(c.pending[streamID], next)
+		c.next[streamID] = next + 1
+		moved = true
+		if t.id == 0 {
+			// The builder was empty.
+			continue
+		}
+		c.state.Tables = append(c.state.Tables, t.id)
+		if t.maxVersion > c.state.MaxVersion {
+			c.state.MaxVersion = t.maxVersion
+		}
+		r := c.streams[streamID]
+		if r == nil {
+			r = &CheckpointRange{First: t.first}
+			c.streams[streamID] = r
+		}
+		r.Last = t.last
+	}
+	if !moved {
+		return nil
+	}
+	return c.persist()
+}
+
+// persist writes the checkpoint, after syncing the value log so that the values of the tables
+// written are durable.
+func (c *streamCheckpointer) persist() error {
+	if err := c.db.vlog.sync(); err != nil {
+		return err
+	}
+	state := c.state
+	state.Ranges = append([]CheckpointRange{}, c.prev...)
+	for _, r := range c.streams {
+		state.Ranges = append(state.Ranges, *r)
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	dir := c.db.opt.Dir
+	rewritePath := filepath.Join(dir, streamCheckpointRewriteFilename)
+	fp, err := y.OpenTruncFileFS(c.db.opt.FS, rewritePath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, streamCheckpointFilename)
+	if err := c.db.opt.FS.Rename(rewritePath, path); err != nil {
+		return err
+	}
+	// The tables written are registered in the directory along with the checkpoint.
+	return c.db.syncDir(dir)
+}
+
+// checkpoint returns the checkpoint to resume from.
+func (c *streamCheckpointer) checkpoint() *StreamCheckpoint {
+	return &StreamCheckpoint{
+		Ranges:     append([]CheckpointRange{}, c.prev...),
+		MaxVersion: c.state.MaxVersion,
+	}
+}
+
+// resumeFrom deletes the tables written after the checkpoint in state, so that the writes can be
+// resumed from it. It returns an error if the DB doesn't match the checkpoint.
+func (sw *StreamWriter) resumeFrom(state *checkpointState) error {
+	lc := sw.db.lc
+	if state.Level <= 0 || state.Level >= len(lc.levels) {
+		return errors.Errorf("Invalid stream checkpoint level: %d", state.Level)
+	}
+	keep := make(map[uint64]struct{}, len(state.Tables))
+	for _, id := range state.Tables {
+		keep[id] = struct{}{}
+	}
+	var toDel []*table.Table
+	var changes []*pb.ManifestChange
+	for _, l := range lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if _, ok := keep[t.ID()]; ok && l.level == state.Level {
+				delete(keep, t.ID())
+				continue
+			}
+			if l.level != state.Level {
+				l.RUnlock()
+				return errors.Errorf("Level %d has tables not written by the StreamWriter, "+
+					"the DB can't be resumed from its checkpoint", l.level)
+			}
+			toDel = append(toDel, t)
+			changes = append(changes, newDeleteChange(t.ID()))
+		}
+		l.RUnlock()
+	}
+	if len(keep) > 0 {
+		return errors.Errorf("%d tables of the stream checkpoint are missing, the DB can't be "+
+			"resumed from it", len(keep))
+	}
+	if len(changes) > 0 {
+		sw.db.opt.Infof("Deleting %d tables written after the stream checkpoint\n", len(toDel))
+		if err := sw.db.manifest.addChanges(changes); err != nil {
+			return err
+		}
+		if err := lc.levels[state.Level].deleteTables(toDel); err != nil {
+			return err
+		}
+	}
+	// The writers write at the level just above prevLevel.
+	sw.prevLevel = state.Level + 1
+	sw.maxVersion = state.MaxVersion
+	return nil
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// StreamCopyOptions are the options of StreamCopy.
+type StreamCopyOptions struct {
+	// Prefixes are the prefixes of the keys to copy. All the keys are copied if it is empty.
+	Prefixes [][]byte
+	// SinceTs only copies the versions newer than it, like the since argument of Backup.
+	SinceTs uint64
+	// ReadTs is the version at which the source is read. It must be set if the source is a
+	// managed DB, and is ignored otherwise.
+	ReadTs uint64
+	// Replace deletes all the data of the destination, and writes the keys with a StreamWriter,
+	// which is much faster. Otherwise the keys are added to the data of the destination, like Load
+	// does, and the destination must not run other transactions during the copy.
+	Replace bool
+	// BytesPerSec limits the rate at which the keys are copied. The rate isn't limited if it is 0.
+	BytesPerSec int64
+	// NumGo is the number of goroutines iterating over the source. Defaults to the
+	// NumGoroutines option of the source.
+	NumGo int
+	// MaxPendingWrites is the number of pending writes to the destination, if Replace isn't set.
+	// Defaults to 256.
+	MaxPendingWrites int
+}
+
+// StreamCopy copies the keys of src to dst with the Stream framework, without an intermediate
+// backup, so that a range of keys can be moved between two DBs opened in the same process. Only
+// the latest versions of the keys are copied, and deleted or expired keys are skipped. It returns
+// the max version of the keys copied, which can be passed as opt.SinceTs to copy the keys written
+// afterwards. ctx cancels the copy.
+func StreamCopy(ctx context.Context, src, dst *DB, opt StreamCopyOptions) (uint64, error) {
+	if src == dst {
+		return 0, errors.New("StreamCopy: the source and the destination are the same DB")
+	}
+	var stream *Stream
+	if src.opt.managedTxns {
+		if opt.ReadTs == 0 {
+			return 0, errors.New("StreamCopy: ReadTs must be set for a managed source")
+		}
+		stream = src.NewStreamAt(opt.ReadTs)
+	} else {
+		stream = src.NewStream()
+	}
+	stream.LogPrefix = "Badger.StreamCopy"
+	stream.SinceTs = opt.SinceTs
+	if opt.NumGo > 0 {
+		stream.NumGo = opt.NumGo
+	}
+	switch len(opt.Prefixes) {
+	case 0:
+	case 1:
+		stream.Prefix = opt.Prefixes[0]
+	default:
+		// Iterate over the common prefix of all the prefixes, and skip the other keys.
+		stream.Prefix = commonPrefix(opt.Prefixes)
+		stream.KeyFilter = func(key []byte) bool {
+			for _, p := range opt.Prefixes {
+				if bytes.HasPrefix(key, p) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	var maxVersion uint64
+	throttle := newBandwidthThrottle(opt.BytesPerSec)
+	write := func(buf *z.Buffer, fn func(buf *z.Buffer) error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := buf.SliceIterate(func(s []byte) error {
+			var kv pb.KV
+			if err := kv.Unmarshal(s); err != nil {
+				return err
+			}
+			if kv.Version > maxVersion {
+				maxVersion = kv.Version
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := fn(buf); err != nil {
+			return err
+		}
+		return throttle.wait(ctx, buf.LenNoPadding())
+	}
+
+	if opt.Replace {
+		sw := dst.NewStreamWriter()
+		defer sw.Cancel()
+		if err := sw.Prepare(); err != nil {
+			return 0, err
+		}
+		stream.Send = func(buf *z.Buffer) error {
+			return write(buf, sw.Write)
+		}
+		if err := stream.Orchestrate(ctx); err != nil {
+			return 0, err
+		}
+		return maxVersion, sw.Flush()
+	}
+
+	if opt.MaxPendingWrites <= 0 {
+		opt.MaxPendingWrites = 256
+	}
+	ldr := dst.NewKVLoader(opt.MaxPendingWrites)
+	stream.Send = func(buf *z.Buffer) error {
+		return write(buf, func(buf *z.Buffer) error {
+			return buf.SliceIterate(func(s []byte) error {
+				kv := new(pb.KV)
+				if err := kv.Unmarshal(s); err != nil {
+					return err
+				}
+				return ldr.Set(kv)
+			})
+		})
+	}
+	if err := stream.Orchestrate(ctx); err != nil {
+		return 0, err
+	}
+	if err := ldr.Finish(); err != nil {
+		return 0, err
+	}
+	if !dst.opt.managedTxns && maxVersion >= dst.orc.nextTxnTs {
+		// Like Load, make the versions copied visible to the reads of dst.
+		dst.orc.nextTxnTs = maxVersion + 1
+		dst.orc.txnMark.Done(maxVersion)
+	}
+	return maxVersion, nil
+}
+
+// commonPrefix returns the longest common prefix of prefixes.
+func commonPrefix(prefixes [][]byte) []byte {
+	common := prefixes[0]
+	for _, p := range prefixes[1:] {
+		n := 0
+		for n < len(common) && n < len(p) && common[n] == p[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	return common
+}
+
+// bandwidthThrottle limits the rate at which bytes are processed, by sleeping until the bytes
+// processed so far are within the rate.
+type bandwidthThrottle struct {
+	bytesPerSec int64
+	start       time.Time
+	total       int64
+}
+
+func newBandwidthThrottle(bytesPerSec int64) *bandwidthThrottle {
+	return &bandwidthThrottle{bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+// wait records that n bytes were processed, and sleeps until they are within the rate.
+func (t *bandwidthThrottle) wait(ctx context.Context, n int) error {
+	if t.bytesPerSec <= 0 {
+		return nil
+	}
+	t.total += int64(n)
+	due := t.start.Add(time.Duration(float64(t.total) / float64(t.bytesPerSec) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamCopy(t *testing.T) {
+	src, err := Open(DefaultOptions("").WithInMemory(true).WithLoggingLevel(WARNING))
+	require.NoError(t, err)
+	defer src.Close()
+	wb := src.NewWriteBatch()
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("%s%03d", prefix, i)
+			require.NoError(t, wb.Set([]byte(key), []byte("value-"+key)))
+		}
+	}
+	require.NoError(t, wb.Flush())
+	require.NoError(t, src.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("a000"))
+	}))
+
+	count := func(db *DB) map[string]int {
+		counts := make(map[string]int)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				require.Equal(t, "value-"+string(item.Key()), string(getItemValue(t, item)))
+				counts[string(item.Key()[:1])]++
+			}
+			return nil
+		}))
+		return counts
+	}
+
+	for _, replace := range []bool{false, true} {
+		t.Run(fmt.Sprintf("replace=%v", replace), func(t *testing.T) {
+			dst, err := Open(DefaultOptions("").WithInMemory(true).WithLoggingLevel(WARNING))
+			require.NoError(t, err)
+			defer dst.Close()
+			require.NoError(t, dst.Update(func(txn *Txn) error {
+				return txn.Set([]byte("d000"), []byte("value-d000"))
+			}))
+
+			version, err := StreamCopy(context.Background(), src, dst, StreamCopyOptions{
+				Prefixes: [][]byte{[]byte("a"), []byte("c")},
+				Replace:  replace,
+			})
+			require.NoError(t, err)
+			require.Equal(t, src.MaxVersion(), version)
+			expected := map[string]int{"a": 99, "c": 100, "d": 1}
+			if replace {
+				delete(expected, "d")
+			}
+			require.Equal(t, expected, count(dst))
+
+			// The keys written afterwards are copied incrementally.
+			require.NoError(t, src.Update(func(txn *Txn) error {
+				return txn.Set([]byte("a000"), []byte("value-a000"))
+			}))
+			_, err = StreamCopy(context.Background(), src, dst, StreamCopyOptions{
+				Prefixes: [][]byte{[]byte("a")},
+				SinceTs:  version,
+			})
+			require.NoError(t, err)
+			expected["a"]++
+			require.Equal(t, expected, count(dst))
+			require.NoError(t, src.Update(func(txn *Txn) error {
+				return txn.Delete([]byte("a000"))
+			}))
+		})
+	}
+}
+
+func TestBandwidthThrottle(t *testing.T) {
+	th := newBandwidthThrottle(100 << 10)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, th.wait(context.Background(), 2<<10))
+	}
+	// 20KB at 100KB/s take 200ms.
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(190*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, th.wait(ctx, 100<<10))
+}
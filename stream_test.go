@@ -30,6 +30,7 @@ import (
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -324,3 +325,70 @@ func TestStreamCustomKeyToList(t *testing.T) {
 	require.NoError(t, stream.Orchestrate(ctxb))
 	require.Zero(t, len(res))
 }
+
+func TestStreamFilterTransform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := OpenManaged(DefaultOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	for _, prefix := range []string{"p0", "p1", "p2"} {
+		txn := db.NewTransactionAt(math.MaxUint64, true)
+		for i := 1; i <= 100; i++ {
+			require.NoError(t, txn.SetEntry(NewEntry(keyWithPrefix(prefix, i), value(i))))
+		}
+		require.NoError(t, txn.CommitAt(5, nil))
+	}
+
+	stream := db.NewStreamAt(math.MaxUint64)
+	stream.LogPrefix = "Testing"
+	// Only the keys of p1 are picked, and the odd ones dropped by Transform.
+	stream.KeyFilter = func(key []byte) bool {
+		return strings.HasPrefix(string(key), "p1")
+	}
+	stream.Transform = func(kv *pb.KV) (*pb.KV, error) {
+		_, i := keyToInt(kv.Key)
+		if i%2 == 1 {
+			return nil, nil
+		}
+		kv.Value = []byte("transformed")
+		return kv, nil
+	}
+	var progress []RangeProgress
+	stream.OnRangeDone = func(p RangeProgress) {
+		progress = append(progress, p)
+	}
+	c := &collector{}
+	stream.Send = c.Send
+	require.NoError(t, stream.Orchestrate(ctxb))
+
+	require.Len(t, c.kv, 50)
+	for _, kv := range c.kv {
+		prefix, i := keyToInt(kv.Key)
+		require.Equal(t, "p1", prefix)
+		require.Zero(t, i%2)
+		require.Equal(t, []byte("transformed"), kv.Value)
+	}
+
+	require.NotEmpty(t, progress)
+	var scanned, sent, kvs int
+	for i, p := range progress {
+		require.Equal(t, i+1, p.RangesDone)
+		require.Equal(t, len(progress), p.RangesTotal)
+		scanned += p.KeysScanned
+		sent += p.KeysSent
+		kvs += p.KVsSent
+	}
+	require.Equal(t, 300, scanned)
+	require.Equal(t, 100, sent)
+	require.Equal(t, 50, kvs)
+
+	// A failing Transform stops the stream.
+	stream.Transform = func(kv *pb.KV) (*pb.KV, error) {
+		return nil, errors.New("transform failed")
+	}
+	require.EqualError(t, stream.Orchestrate(ctxb), "transform failed")
+}
@@ -54,6 +54,9 @@ type StreamWriter struct {
 	// Writer might receive tables first, and then receive keys. If true, that means we have
 	// started processing keys.
 	processingKeys bool
+	// ckpt persists the progress of the writes, if the StreamWriter was prepared with
+	// PrepareResumable.
+	ckpt *streamCheckpointer
 }
 
 // NewStreamWriter creates a StreamWriter. Right after creating StreamWriter, Prepare must be
@@ -128,6 +131,61 @@ func (sw *StreamWriter) PrepareIncremental() error {
 	return nil
 }
 
+// PrepareResumable is like Prepare, but it also persists checkpoints of the keys written, so that
+// a bulk load interrupted by a crash or by Cancel can be resumed instead of started over. If the
+// DB has a checkpoint, the tables written after it are deleted and the checkpoint is returned.
+// The keys in it must not be written again, which can be done by setting the Stream.KeyFilter of
+// the stream being written to skip the keys the checkpoint Contains. If the DB has no checkpoint,
+// all its data is deleted like Prepare does, and nil is returned.
+//
+// The tables must not be changed by compactions until the writes are done, so the DB being
+// resumed should be opened with NumCompactors set to 0. Tables and KV_FILE entries can't be
+// written by a resumable StreamWriter. The checkpoint is removed by Flush.
+func (sw *StreamWriter) PrepareResumable() (*StreamCheckpoint, error) {
+	if sw.db.opt.InMemory {
+		// Nothing outlives the DB, so there is nothing to resume.
+		return nil, sw.Prepare()
+	}
+	state, err := readStreamCheckpoint(sw.db.opt.FS, sw.db.opt.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		if err := sw.Prepare(); err != nil {
+			return nil, err
+		}
+		sw.writeLock.Lock()
+		defer sw.writeLock.Unlock()
+		sw.ckpt = newStreamCheckpointer(sw.db, checkpointState{Level: len(sw.db.lc.levels) - 1})
+		return nil, sw.ckpt.persist()
+	}
+
+	sw.writeLock.Lock()
+	defer sw.writeLock.Unlock()
+
+	// Ensure that done() is never called more than once.
+	var once sync.Once
+	f, err := sw.db.prepareToDrop()
+	if err != nil {
+		sw.done = func() { once.Do(f) }
+		return nil, err
+	}
+	sw.db.stopCompactions()
+	done := func() {
+		sw.db.startCompactions()
+		f()
+	}
+	sw.done = func() { once.Do(done) }
+
+	if err := sw.resumeFrom(state); err != nil {
+		return nil, err
+	}
+	sw.ckpt = newStreamCheckpointer(sw.db, *state)
+	sw.db.opt.Infof("Resuming stream writes from checkpoint with %d tables at level %d\n",
+		len(state.Tables), state.Level)
+	return sw.ckpt.checkpoint(), nil
+}
+
 // Write writes KVList to DB. Each KV within the list contains the stream id which StreamWriter
 // would use to demux the writes. Write is thread safe and can be called concurrently by multiple
 // goroutines.
@@ -158,7 +216,7 @@ func (sw *StreamWriter) Write(buf *z.Buffer) error {
 		}
 		switch kv.Kind {
 		case pb.KV_DATA_KEY:
-			y.AssertTrue(len(sw.db.opt.EncryptionKey) > 0)
+			y.AssertTrue(sw.db.opt.encrypted())
 			var dk pb.DataKey
 			if err := proto.Unmarshal(kv.Value, &dk); err != nil {
 				return errors.Wrapf(err, "unmarshal failed %s", kv.Value)
@@ -179,6 +237,9 @@ func (sw *StreamWriter) Write(buf *z.Buffer) error {
 			if sw.processingKeys {
 				return errors.New("Received pb.KV_FILE after pb.KV_KEY")
 			}
+			if sw.ckpt != nil {
+				return errors.New("Received pb.KV_FILE in a resumable stream write")
+			}
 			var change pb.ManifestChange
 			if err := proto.Unmarshal(kv.Key, &change); err != nil {
 				return errors.Wrap(err, "unable to unmarshal manifest change")
@@ -209,23 +270,26 @@ func (sw *StreamWriter) Write(buf *z.Buffer) error {
 		}
 
 		sw.processingKeys = true
-		var meta, userMeta byte
+		var meta byte
 		if len(kv.Meta) > 0 {
 			meta = kv.Meta[0]
 		}
-		if len(kv.UserMeta) > 0 {
-			userMeta = kv.UserMeta[0]
+		userMeta, md := parseKVUserMeta(kv.UserMeta)
+		if err := checkUserMetadata(md); err != nil {
+			return err
 		}
 		if sw.maxVersion < kv.Version {
 			sw.maxVersion = kv.Version
 		}
 		e := &Entry{
-			Key:       y.KeyWithTs(kv.Key, kv.Version),
-			Value:     y.Copy(kv.Value),
-			UserMeta:  userMeta,
-			ExpiresAt: kv.ExpiresAt,
-			meta:      meta,
+			Key:          y.KeyWithTs(kv.Key, kv.Version),
+			Value:        y.Copy(kv.Value),
+			UserMeta:     userMeta,
+			UserMetadata: md,
+			ExpiresAt:    kv.ExpiresAt,
+			meta:         meta &^ bitUserMetadata,
 		}
+		e.encodeUserMetadata()
 		// If the value can be collocated with the key in LSM tree, we can skip
 		// writing the value to value log.
 		req := streamReqs[kv.StreamId]
@@ -354,12 +418,20 @@ func (sw *StreamWriter) Flush() error {
 	if err := sw.db.syncDir(sw.db.opt.Dir); err != nil {
 		return err
 	}
-	return sw.db.lc.validate()
+	if err := sw.db.lc.validate(); err != nil {
+		return err
+	}
+	if sw.ckpt != nil {
+		// All the keys were written, so there is nothing left to resume.
+		return removeStreamCheckpoint(sw.db.opt.FS, sw.db.opt.Dir)
+	}
+	return nil
 }
 
 // Cancel signals all goroutines to exit. Calling defer sw.Cancel() immediately after creating a new StreamWriter
 // ensures that writes are unblocked even upon early return. Note that dropAll() is not called here, so any
-// partially written data will not be erased until a new StreamWriter is initialized.
+// partially written data will not be erased until a new StreamWriter is initialized. The checkpoint of a
+// StreamWriter prepared with PrepareResumable is kept, so that the writes can be resumed.
 func (sw *StreamWriter) Cancel() {
 	sw.writeLock.Lock()
 	defer sw.writeLock.Unlock()
@@ -395,12 +467,17 @@ type sortedWriter struct {
 	level    int
 	streamID uint32
 	reqCh    chan *request
+	// ckpt is set if the StreamWriter persists checkpoints. firstKey is the first key of the
+	// builder, and seq the sequence number of the builder in the stream.
+	ckpt     *streamCheckpointer
+	firstKey []byte
+	seq      int
 	// Have separate closer for each writer, as it can be closed at any time.
 	closer *z.Closer
 }
 
 func (sw *StreamWriter) newWriter(streamID uint32) (*sortedWriter, error) {
-	bopts := buildTableOptions(sw.db)
+	bopts := buildLevelTableOptions(sw.db, sw.prevLevel-1)
 	for i := 2; i < sw.db.opt.MaxLevels; i++ {
 		bopts.TableSize *= uint64(sw.db.opt.TableSizeMultiplier)
 	}
@@ -409,11 +486,12 @@ func (sw *StreamWriter) newWriter(streamID uint32) (*sortedWriter, error) {
 		opts:     bopts,
 		streamID: streamID,
 		throttle: sw.throttle,
-		builder:  table.NewTableBuilder(bopts),
 		reqCh:    make(chan *request, 3),
 		closer:   z.NewCloser(1),
 		level:    sw.prevLevel - 1, // Write at the level just above the one we were writing to.
+		ckpt:     sw.ckpt,
 	}
+	w.builder = w.newBuilder()
 
 	go w.handleRequests()
 	return w, nil
@@ -430,7 +508,7 @@ func (w *sortedWriter) handleRequests() {
 			// writer (and not the sender) to determine if the Value goes to vlog or stays in SST
 			// only. In managed mode, we do not write values to vlog and hence we would not have
 			// req.Ptrs initialized.
-			if w.db.opt.managedTxns || e.skipVlogAndSetThreshold(w.db.valueThreshold()) {
+			if w.db.opt.managedTxns || e.skipVlogAndSetThreshold(w.db.valueThresholdFor(e.Key)) {
 				vs = y.ValueStruct{
 					Value:     e.Value,
 					Meta:      e.meta,
@@ -440,7 +518,7 @@ func (w *sortedWriter) handleRequests() {
 			} else {
 				vptr := req.Ptrs[i]
 				vs = y.ValueStruct{
-					Value:     vptr.Encode(),
+					Value:     e.encodedPointer(vptr),
 					Meta:      e.meta | bitValuePointer,
 					UserMeta:  e.UserMeta,
 					ExpiresAt: e.ExpiresAt,
@@ -475,13 +553,25 @@ func (w *sortedWriter) Add(key []byte, vs y.ValueStruct) error {
 
 	sameKey := y.SameKey(key, w.lastKey)
 
+	// The tables must not overlap the ranges written before resuming from a checkpoint.
+	var cut bool
+	if w.ckpt != nil && !sameKey {
+		var err error
+		if cut, err = w.ckpt.overlaps(y.ParseKey(w.lastKey), y.ParseKey(key)); err != nil {
+			return err
+		}
+	}
+
 	// Same keys should go into the same SSTable.
-	if !sameKey && w.builder.ReachedCapacity() {
+	if !sameKey && (w.builder.ReachedCapacity() || cut) {
 		if err := w.send(false); err != nil {
 			return err
 		}
 	}
 
+	if w.builder.Empty() {
+		w.firstKey = y.SafeCopy(w.firstKey, y.ParseKey(key))
+	}
 	w.lastKey = y.SafeCopy(w.lastKey, key)
 	var vp valuePointer
 	if vs.Meta&bitValuePointer > 0 {
@@ -496,8 +586,19 @@ func (w *sortedWriter) send(done bool) error {
 	if err := w.throttle.Do(); err != nil {
 		return err
 	}
+	seq := w.seq
+	w.seq++
+	first, last := y.Copy(w.firstKey), y.Copy(y.ParseKey(w.lastKey))
 	go func(builder *table.Builder) {
-		err := w.createTable(builder)
+		id, maxVersion, err := w.createTable(builder)
+		if err == nil && w.ckpt != nil {
+			err = w.ckpt.tableCreated(w.streamID, seq, checkpointTable{
+				id:         id,
+				maxVersion: maxVersion,
+				first:      first,
+				last:       last,
+			})
+		}
 		w.throttle.Done(err)
 	}(w.builder)
 	// If done is true, this indicates we can close the writer.
@@ -507,10 +608,17 @@ func (w *sortedWriter) send(done bool) error {
 		return nil
 	}
 
-	w.builder = table.NewTableBuilder(w.opts)
+	w.builder = w.newBuilder()
 	return nil
 }
 
+// newBuilder returns a builder for the next table, with a newly reserved file ID.
+func (w *sortedWriter) newBuilder() *table.Builder {
+	opts := w.opts
+	opts.TableID = w.db.lc.reserveFileID()
+	return table.NewTableBuilder(opts)
+}
+
 // Done is called once we are done writing all keys and valueStructs
 // to sortedWriter. It completes writing current SST to disk.
 func (w *sortedWriter) Done() error {
@@ -524,26 +632,28 @@ func (w *sortedWriter) Done() error {
 	return w.send(true)
 }
 
-func (w *sortedWriter) createTable(builder *table.Builder) error {
+// createTable creates the table of builder, and returns its ID and max version. The ID is 0 if
+// builder is empty, in which case no table is created.
+func (w *sortedWriter) createTable(builder *table.Builder) (uint64, uint64, error) {
 	defer builder.Close()
 	if builder.Empty() {
 		builder.Finish()
-		return nil
+		return 0, 0, nil
 	}
 
-	fileID := w.db.lc.reserveFileID()
+	fileID := builder.Opts().TableID
 	var tbl *table.Table
-	if w.db.opt.InMemory {
+	if w.db.lc.keepInMemory(w.level) {
 		data := builder.Finish()
 		var err error
 		if tbl, err = table.OpenInMemoryTable(data, fileID, builder.Opts()); err != nil {
-			return err
+			return 0, 0, err
 		}
 	} else {
 		var err error
-		fname := table.NewFilename(fileID, w.db.opt.Dir)
+		fname := table.NewFilename(fileID, w.db.tableDir())
 		if tbl, err = table.CreateTable(fname, builder); err != nil {
-			return err
+			return 0, 0, err
 		}
 	}
 	lc := w.db.lc
@@ -551,23 +661,25 @@ func (w *sortedWriter) createTable(builder *table.Builder) error {
 	lhandler := lc.levels[w.level]
 	// Now that table can be opened successfully, let's add this to the MANIFEST.
 	change := &pb.ManifestChange{
-		Id:          tbl.ID(),
-		KeyId:       tbl.KeyID(),
-		Op:          pb.ManifestChange_CREATE,
-		Level:       uint32(lhandler.level),
-		Compression: uint32(tbl.CompressionType()),
+		Id:             tbl.ID(),
+		KeyId:          tbl.KeyID(),
+		Op:             pb.ManifestChange_CREATE,
+		Level:          uint32(lhandler.level),
+		Compression:    uint32(tbl.CompressionType()),
+		EncryptionAlgo: pb.EncryptionAlgo(tbl.EncryptionMode()),
 	}
 	if err := w.db.manifest.addChanges([]*pb.ManifestChange{change}); err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	// We are not calling lhandler.replaceTables() here, as it sorts tables on every addition.
 	// We can sort all tables only once during Flush() call.
 	lhandler.addTable(tbl)
 
+	maxVersion := tbl.MaxVersion()
 	// Release the ref held by OpenTable.
 	_ = tbl.DecrRef()
 	w.db.opt.Infof("Table created: %d at level: %d for stream: %d. Size: %s\n",
 		fileID, lhandler.level, w.streamID, humanize.IBytes(uint64(tbl.Size())))
-	return nil
+	return fileID, maxVersion, nil
 }
@@ -676,3 +676,88 @@ func TestStreamWriterIncremental(t *testing.T) {
 		})
 	})
 }
+
+func TestStreamWriterResumable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.BaseTableSize = 1 << 15
+	opt.NumCompactors = 0
+
+	// Two streams of 2000 keys each, written in batches of 100 keys.
+	const numKeys = 2000
+	value := make([]byte, 4<<10)
+	y.Check2(rand.Read(value))
+	key := func(i int) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		return k
+	}
+	write := func(sw *StreamWriter, from, to int, skip func(key []byte) bool) {
+		for i := from; i < to; i += 100 {
+			buf := z.NewBuffer(10<<20, "test")
+			for j := i; j < i+100 && j < to; j++ {
+				for _, streamID := range []uint32{1, 2} {
+					k := key(int(streamID-1)*numKeys + j)
+					if skip != nil && skip(k) {
+						continue
+					}
+					KVToBuffer(&pb.KV{Key: k, Value: value, Version: 20, StreamId: streamID}, buf)
+				}
+			}
+			require.NoError(t, sw.Write(buf))
+			require.NoError(t, buf.Release())
+		}
+	}
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	sw := db.NewStreamWriter()
+	cp, err := sw.PrepareResumable()
+	require.NoError(t, err)
+	require.Nil(t, cp)
+	// Write half of the keys, and give up.
+	write(sw, 0, numKeys/2, nil)
+	sw.Cancel()
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	sw = db.NewStreamWriter()
+	cp, err = sw.PrepareResumable()
+	require.NoError(t, err)
+	require.NotNil(t, cp)
+	require.Equal(t, uint64(20), cp.MaxVersion)
+	require.Len(t, cp.Ranges, 2)
+	require.True(t, cp.Contains(key(0)))
+	require.True(t, cp.Contains(key(numKeys)))
+	require.False(t, cp.Contains(key(numKeys-1)))
+	written := 0
+	for i := 0; i < 2*numKeys; i++ {
+		if cp.Contains(key(i)) {
+			written++
+		}
+	}
+	require.Greater(t, written, 0)
+
+	// Resume the writes, skipping the keys which were written.
+	write(sw, 0, numKeys, cp.Contains)
+	require.NoError(t, sw.Flush())
+	_, err = os.Stat(dir + "/" + streamCheckpointFilename)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		i := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, key(i), it.Item().Key())
+			require.Equal(t, value, getItemValue(t, it.Item()))
+			i++
+		}
+		require.Equal(t, 2*numKeys, i)
+		return nil
+	}))
+}
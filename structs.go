@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"time"
 	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
 type valuePointer struct {
@@ -145,6 +147,9 @@ type Entry struct {
 	offset    uint32 // offset is an internal field.
 	UserMeta  byte
 	meta      byte
+	// UserMetadata is stored along with the value, and can be read from an Item without reading
+	// the value. It can be at most MaxUserMetadataSize bytes long.
+	UserMetadata []byte
 
 	// Fields maintained internally.
 	hlen         int // Length of the header.
@@ -161,6 +166,9 @@ func (e *Entry) estimateSizeAndSetThreshold(threshold int64) int64 {
 	}
 	k := int64(len(e.Key))
 	v := int64(len(e.Value))
+	if len(e.UserMetadata) > 0 {
+		v += int64(len(e.UserMetadata)) + 1
+	}
 	if v < e.valThreshold {
 		return k + v + 2 // Meta, UserMeta
 	}
@@ -199,6 +207,85 @@ func (e *Entry) WithMeta(meta byte) *Entry {
 	return e
 }
 
+// WithUserMetadata adds the user metadata md to Entry e. Unlike the byte set by WithMeta, md can
+// be up to MaxUserMetadataSize bytes long, so it can tag the value with things like its schema
+// version or origin, without wrapping the value. It is stored alongside the key, even if the value
+// is stored in the value log, so Item.UserMetadata doesn't need to read the value.
+func (e *Entry) WithUserMetadata(md []byte) *Entry {
+	e.UserMetadata = md
+	return e
+}
+
+// encodeUserMetadata appends the user metadata of e to its value, which is how it is stored.
+func (e *Entry) encodeUserMetadata() {
+	if len(e.UserMetadata) == 0 {
+		return
+	}
+	val := make([]byte, 0, len(e.Value)+len(e.UserMetadata)+1)
+	val = append(val, e.Value...)
+	e.Value = appendUserMetadata(val, e.UserMetadata)
+	e.meta |= bitUserMetadata
+	e.UserMetadata = nil
+}
+
+// encodedPointer returns vp encoded, followed by the user metadata of e, if any.
+func (e *Entry) encodedPointer(vp valuePointer) []byte {
+	buf := vp.Encode()
+	if e.meta&bitUserMetadata == 0 {
+		return buf
+	}
+	_, md := splitUserMetadata(e.meta, e.Value)
+	return appendUserMetadata(buf, md)
+}
+
+// MaxUserMetadataSize is the maximum size of the user metadata of an entry.
+const MaxUserMetadataSize = 64
+
+// checkUserMetadata returns an error if md is too long to be the user metadata of an entry.
+func checkUserMetadata(md []byte) error {
+	if len(md) > MaxUserMetadataSize {
+		return errors.Errorf("UserMetadata with size %d exceeded %d limit", len(md),
+			MaxUserMetadataSize)
+	}
+	return nil
+}
+
+// appendUserMetadata appends md, followed by its length, to buf.
+func appendUserMetadata(buf, md []byte) []byte {
+	buf = append(buf, md...)
+	return append(buf, byte(len(md)))
+}
+
+// splitUserMetadata splits a value stored with meta into the value, or value pointer, and the user
+// metadata which follows it.
+func splitUserMetadata(meta byte, val []byte) ([]byte, []byte) {
+	if meta&bitUserMetadata == 0 || len(val) == 0 {
+		return val, nil
+	}
+	end := len(val) - 1 - int(val[len(val)-1])
+	if end < 0 {
+		return val, nil
+	}
+	return val[:end], val[end : len(val)-1]
+}
+
+// kvUserMeta returns the UserMeta field of a pb.KV: the user meta byte, followed by the user
+// metadata.
+func kvUserMeta(userMeta byte, md []byte) []byte {
+	out := make([]byte, 0, 1+len(md))
+	out = append(out, userMeta)
+	return append(out, md...)
+}
+
+// parseKVUserMeta returns the user meta byte and the user metadata of the UserMeta field of a
+// pb.KV.
+func parseKVUserMeta(b []byte) (byte, []byte) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return b[0], b[1:]
+}
+
 // WithDiscard adds a marker to Entry e. This means all the previous versions of the key (of the
 // Entry) will be eligible for garbage collection.
 // This method is only useful if you have set a higher limit for options.NumVersionsToKeep. The
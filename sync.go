@@ -0,0 +1,153 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// syncMark is the watermark of the writes synced to disk. The batches of writes are numbered in
+// the order they're written, and the syncer moves the watermark up to the last batch written
+// before each of its syncs.
+type syncMark struct {
+	written uint64 // The number of the batches written. Accessed atomically.
+
+	sync.Mutex
+	synced   uint64        // The number of the batches synced.
+	err      error         // The error of the last sync, if it failed.
+	advanced chan struct{} // Closed, and replaced, after every sync.
+
+	syncCh chan struct{} // Wakes up the syncer.
+}
+
+func newSyncMark() *syncMark {
+	return &syncMark{
+		advanced: make(chan struct{}),
+		syncCh:   make(chan struct{}, 1),
+	}
+}
+
+// request asks the syncer to sync, without waiting for it.
+func (m *syncMark) request() {
+	select {
+	case m.syncCh <- struct{}{}:
+	default:
+	}
+}
+
+// done records the outcome of a sync of the batches up to written, and wakes up the waiters.
+func (m *syncMark) done(written uint64, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if err == nil && written > m.synced {
+		m.synced = written
+	}
+	m.err = err
+	close(m.advanced)
+	m.advanced = make(chan struct{})
+}
+
+// behind returns whether some of the writes aren't synced yet.
+func (m *syncMark) behind() bool {
+	m.Lock()
+	defer m.Unlock()
+	return atomic.LoadUint64(&m.written) > m.synced
+}
+
+// syncer syncs the writes of Txn.CommitAsync in the background, and all the writes every
+// WALSyncInterval. It's only run with SyncWrites or WALSyncInterval set.
+func (db *DB) syncer(lc *z.Closer) {
+	defer lc.Done()
+	var tick <-chan time.Time
+	if db.opt.WALSyncInterval > 0 {
+		ticker := time.NewTicker(db.opt.WALSyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-db.syncMark.syncCh:
+			db.syncWrites()
+		case <-tick:
+			if db.syncMark.behind() {
+				db.syncWrites()
+			}
+		case <-lc.HasBeenClosed():
+			// Leave no waiter behind.
+			db.syncWrites()
+			return
+		}
+	}
+}
+
+// syncWrites syncs the WALs of the memtables and the latest value log files, and moves the
+// watermark up to the writes done before.
+func (db *DB) syncWrites() {
+	written := atomic.LoadUint64(&db.syncMark.written)
+	err := func() error {
+		mts, decr := db.getMemTables()
+		defer decr()
+		for _, mt := range mts {
+			if err := mt.SyncWAL(); err != nil {
+				return err
+			}
+		}
+		return db.vlog.syncLatest()
+	}()
+	if err != nil {
+		db.opt.Errorf("Error while syncing writes: %v", err)
+	}
+	db.health.record(SubsystemWrite, err)
+	db.syncMark.done(written, err)
+}
+
+// WaitForSync waits until all the writes acked so far are synced to disk, including the ones of
+// Txn.CommitAsync, which are synced in the background. It returns the error of the sync, if it
+// fails. Without SyncWrites or WALSyncInterval, the writes are never synced on their own, and
+// WaitForSync returns right away.
+func (db *DB) WaitForSync(ctx context.Context) error {
+	if db.closers.syncer == nil {
+		return nil
+	}
+	m := db.syncMark
+	target := atomic.LoadUint64(&m.written)
+	var woken bool
+	for {
+		m.Lock()
+		synced, err, advanced := m.synced, m.err, m.advanced
+		m.Unlock()
+		if synced >= target {
+			return nil
+		}
+		// Don't fail on the error of a sync that ran before this call.
+		if woken && err != nil {
+			return err
+		}
+		m.request()
+		select {
+		case <-advanced:
+			woken = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
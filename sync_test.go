@@ -0,0 +1,236 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithSyncWrites(true).WithValueThreshold(32).
+		WithCommitMaxDelay(50 * time.Millisecond)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	n := 100
+	// Getting the read timestamp of a transaction waits for the earlier commits. Get all of them
+	// first, so the commits go through concurrently.
+	txns := make([]*Txn, n)
+	for i := range txns {
+		txns[i] = db.NewTransaction(true)
+	}
+	var wg sync.WaitGroup
+	var failed int32
+	for i, txn := range txns {
+		// Half of the values go to the value log.
+		val := []byte(fmt.Sprintf("%064d", i))
+		if i%2 == 0 {
+			val = val[:8]
+		}
+		require.NoError(t, txn.Set([]byte(fmt.Sprintf("key%03d", i)), val))
+		wg.Add(1)
+		cb := func(err error) {
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+			wg.Done()
+		}
+		if i%10 == 0 {
+			txn.CommitWith(cb)
+		} else {
+			txn.CommitAsync(cb)
+		}
+	}
+	wg.Wait()
+	require.Zero(t, atomic.LoadInt32(&failed))
+	// The commits were batched together within CommitMaxDelay.
+	written := atomic.LoadUint64(&db.syncMark.written)
+	require.Less(t, written, uint64(n))
+
+	require.NoError(t, db.WaitForSync(context.Background()))
+	db.syncMark.Lock()
+	require.GreaterOrEqual(t, db.syncMark.synced, written)
+	db.syncMark.Unlock()
+
+	// A canceled wait returns right away.
+	txnSet(t, db, []byte("key"), []byte("val"), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.WaitForSync(ctx)
+	require.True(t, err == nil || err == context.Canceled)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt.WithSyncWrites(false))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			val := []byte(fmt.Sprintf("%064d", i))
+			if i%2 == 0 {
+				val = val[:8]
+			}
+			require.Equal(t, val, getItemValue(t, item))
+		}
+		return nil
+	}))
+	// Without SyncWrites, there's nothing to wait for.
+	txnSet(t, db, []byte("key"), []byte("val"), 0)
+	require.NoError(t, db.WaitForSync(context.Background()))
+}
+
+func TestWALSyncInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithWALSyncInterval(10 * time.Millisecond)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NotNil(t, db.closers.syncer)
+
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+	}
+	// The writes get synced in the background, without asking for it.
+	written := atomic.LoadUint64(&db.syncMark.written)
+	require.Eventually(t, func() bool {
+		db.syncMark.Lock()
+		defer db.syncMark.Unlock()
+		return db.syncMark.synced >= written
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, db.WaitForSync(context.Background()))
+}
+
+func TestRecycledWALs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithSyncWrites(true).WithMemTableSize(1 << 20).
+		WithValueThreshold(1 << 10).WithNumRecycledWALs(2)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	first, err := os.Stat(db.mtFilePath(db.nextMemFid - 1))
+	require.NoError(t, err)
+
+	value := func(r int) []byte {
+		return append(bytes.Repeat([]byte("v"), 512), byte(r))
+	}
+	for r := 0; r < 10; r++ {
+		txn := db.NewTransaction(true)
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if err := txn.Set(key, value(r)); err == ErrTxnTooBig {
+				require.NoError(t, txn.Commit())
+				txn = db.NewTransaction(true)
+				require.NoError(t, txn.Set(key, value(r)))
+			} else {
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, txn.Commit())
+	}
+	require.Greater(t, db.nextMemFid, 5)
+
+	// The WAL of the first memtable went round, under the names of the later ones.
+	fids, err := memFids(y.OSFS, dir)
+	require.NoError(t, err)
+	var reused bool
+	for _, fid := range fids {
+		fi, err := os.Stat(db.mtFilePath(fid))
+		require.NoError(t, err)
+		reused = reused || os.SameFile(first, fi)
+	}
+	require.True(t, reused)
+
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 1000; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+				require.NoError(t, err)
+				require.Equal(t, value(9), getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+	check(db)
+	require.NoError(t, db.Close())
+	// The recycled WALs left unused are removed on close.
+	fids, err = memFids(y.OSFS, dir)
+	require.NoError(t, err)
+	require.Empty(t, fids)
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(db)
+}
+
+func TestRecycledWALStaleEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := Open(getTestOptions(dir).WithNumRecycledWALs(1))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	lf := db.mt.wal
+	write := func(n int) {
+		var buf bytes.Buffer
+		for i := 0; i < n; i++ {
+			e := &Entry{Key: y.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), 1), Value: []byte("v")}
+			require.NoError(t, lf.writeEntry(&buf, e, db.opt))
+		}
+	}
+	count := func() int {
+		var n int
+		_, err := lf.iterate(true, 0, func(Entry, valuePointer) error {
+			n++
+			return nil
+		})
+		require.NoError(t, err)
+		return n
+	}
+	write(100)
+	require.Equal(t, 100, count())
+	stale := append([]byte{}, lf.Data[:lf.writeAt]...)
+
+	// The WAL is recycled, and a page of the new entries is lost after a crash, exposing the
+	// entries of the same size written before the WAL was recycled.
+	lf.writeAt = vlogHeaderSize
+	require.NoError(t, lf.bootstrap())
+	write(10)
+	copy(lf.Data[lf.writeAt:], stale[lf.writeAt:])
+	require.Equal(t, 10, count())
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+const (
+	// minArenaClass is the size of the allocators of the smallest size class. Each class holds
+	// allocators twice as big as the previous one.
+	minArenaClass = 1 << 20
+	// numArenaClasses is the number of size classes, up to the allocators of 1GB and above.
+	numArenaClasses = 11
+	// maxArenaIdleSize is the size idle allocators are trimmed to.
+	maxArenaIdleSize = 400 << 20
+	// maxArenaWait is how long Get waits for the allocators in use to be returned, once they
+	// reach the max size of the pool, before it allocates over it.
+	maxArenaWait = time.Second
+	// arenaFreeInterval is how often an idle allocator is released, while Get isn't called.
+	arenaFreeInterval = 2 * time.Second
+)
+
+// ArenaPool is a pool of allocators shared by the table builders of the flushes and the
+// compactions running concurrently. The idle allocators are kept by size class, so a builder
+// reuses the smallest one big enough for its table, instead of growing a small one or holding a
+// big one for a small table.
+//
+// The memory of all the allocators, in use or idle, can be capped. Once it reaches the cap, the
+// idle allocators are released, and Get waits for the allocators in use to be returned. The cap is
+// soft: Get allocates over it if none is returned within a second, since the builders of a stream
+// can hold their allocators for as long as the stream lasts. An allocator in use can't be measured
+// while it grows, so it's accounted with its size at Get until it's returned. Return then accounts
+// its growth, releasing the idle allocators, and the returned one if needed, to get back under
+// the cap.
+type ArenaPool struct {
+	numGets int64 // Atomic.
+	maxIdle int
+	maxSize int64
+	closer  *z.Closer
+
+	sync.Mutex
+	idle    [numArenaClasses][]*z.Allocator
+	numIdle int
+	// idleSize and inUseSize are the sizes of the idle allocators and of those in use. The size of
+	// an allocator in use is accounted as it was when it was returned by Get, until it's returned.
+	idleSize  int64
+	inUseSize int64
+	inUse     map[*z.Allocator]int64
+	// returned is closed, and replaced, when an allocator is returned.
+	returned chan struct{}
+}
+
+// NewArenaPool returns a pool keeping up to maxIdle idle allocators. If maxSize is positive, it is
+// the max size of the allocators of the pool.
+func NewArenaPool(maxIdle int, maxSize int64) *ArenaPool {
+	p := &ArenaPool{
+		maxIdle:  maxIdle,
+		maxSize:  maxSize,
+		closer:   z.NewCloser(1),
+		inUse:    make(map[*z.Allocator]int64),
+		returned: make(chan struct{}),
+	}
+	go p.freeIdle()
+	return p
+}
+
+// arenaClass returns the size class of allocators of sz bytes.
+func arenaClass(sz int) int {
+	class := 0
+	for sz >= minArenaClass<<uint(class+1) && class < numArenaClasses-1 {
+		class++
+	}
+	return class
+}
+
+// Get returns an allocator of at least sz bytes. It must be returned with Return once it isn't
+// used anymore.
+func (p *ArenaPool) Get(sz int, tag string) *z.Allocator {
+	if p == nil {
+		return z.NewAllocator(sz, tag)
+	}
+	atomic.AddInt64(&p.numGets, 1)
+	p.Lock()
+	defer p.Unlock()
+
+	// Reuse the smallest idle allocator big enough. The allocators of the class of sz can be a bit
+	// smaller, but they are still better than a new one.
+	for class := arenaClass(sz); class < numArenaClasses; class++ {
+		if n := len(p.idle[class]); n > 0 {
+			a := p.idle[class][n-1]
+			p.idle[class] = p.idle[class][:n-1]
+			p.numIdle--
+			size := int64(a.Allocated())
+			p.idleSize -= size
+			p.inUseSize += size
+			p.inUse[a] = size
+			a.Reset()
+			a.Tag = tag
+			return a
+		}
+	}
+
+	deadline := time.Now().Add(maxArenaWait)
+	for p.maxSize > 0 && p.idleSize+p.inUseSize+int64(sz) > p.maxSize {
+		if p.releaseIdle() {
+			continue
+		}
+		if p.inUseSize == 0 || !p.waitForReturn(deadline) {
+			break
+		}
+	}
+	a := z.NewAllocator(sz, tag)
+	size := int64(a.Allocated())
+	p.inUseSize += size
+	p.inUse[a] = size
+	return a
+}
+
+// releaseIdle releases the biggest idle allocator, if any. p must be locked.
+func (p *ArenaPool) releaseIdle() bool {
+	for class := numArenaClasses - 1; class >= 0; class-- {
+		if n := len(p.idle[class]); n > 0 {
+			a := p.idle[class][n-1]
+			p.idle[class] = p.idle[class][:n-1]
+			p.numIdle--
+			p.idleSize -= int64(a.Allocated())
+			a.Release()
+			return true
+		}
+	}
+	return false
+}
+
+// waitForReturn waits until an allocator is returned, or until the deadline. It returns false if
+// the deadline passed. p must be locked, and it is unlocked while waiting.
+func (p *ArenaPool) waitForReturn(deadline time.Time) bool {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+	returned := p.returned
+	p.Unlock()
+	defer p.Lock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-returned:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Return returns an allocator obtained with Get. It is kept for reuse if the pool has room for it,
+// or released otherwise. If it grew over the cap while in use, the idle allocators are released
+// first, biggest first, until it fits.
+func (p *ArenaPool) Return(a *z.Allocator) {
+	if a == nil {
+		return
+	}
+	if p == nil {
+		a.Release()
+		return
+	}
+	a.TrimTo(maxArenaIdleSize)
+
+	p.Lock()
+	defer p.Unlock()
+	p.inUseSize -= p.inUse[a]
+	delete(p.inUse, a)
+	close(p.returned)
+	p.returned = make(chan struct{})
+
+	size := int64(a.Allocated())
+	for p.maxSize > 0 && p.idleSize+p.inUseSize+size > p.maxSize && p.releaseIdle() {
+	}
+	if p.numIdle >= p.maxIdle || (p.maxSize > 0 && p.idleSize+p.inUseSize+size > p.maxSize) {
+		a.Release()
+		return
+	}
+	class := arenaClass(int(size))
+	p.idle[class] = append(p.idle[class], a)
+	p.numIdle++
+	p.idleSize += size
+}
+
+// Size returns the size of the allocators of the pool, in use or idle.
+func (p *ArenaPool) Size() int64 {
+	if p == nil {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.idleSize + p.inUseSize
+}
+
+// freeIdle releases an idle allocator every arenaFreeInterval, while Get isn't called.
+func (p *ArenaPool) freeIdle() {
+	defer p.closer.Done()
+
+	ticker := time.NewTicker(arenaFreeInterval)
+	defer ticker.Stop()
+	var last int64
+	for {
+		select {
+		case <-p.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		if gets := atomic.LoadInt64(&p.numGets); gets != last {
+			last = gets
+			continue
+		}
+		p.Lock()
+		p.releaseIdle()
+		p.Unlock()
+	}
+}
+
+// Release releases the idle allocators. The allocators in use are released when they are
+// returned.
+func (p *ArenaPool) Release() {
+	if p == nil {
+		return
+	}
+	p.closer.SignalAndWait()
+	p.Lock()
+	defer p.Unlock()
+	for p.releaseIdle() {
+	}
+	p.maxIdle = 0
+}
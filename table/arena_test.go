@@ -0,0 +1,103 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArenaPoolSizeClasses(t *testing.T) {
+	p := NewArenaPool(8, 0)
+	defer p.Release()
+
+	small := p.Get(1<<20, "small")
+	big := p.Get(16<<20, "big")
+	p.Return(small)
+	p.Return(big)
+	require.Equal(t, int64(small.Allocated()+big.Allocated()), p.Size())
+
+	// Each builder gets the smallest idle allocator big enough for it.
+	a := p.Get(8<<20, "test")
+	require.True(t, a == big)
+	b := p.Get(1<<20, "test")
+	require.True(t, b == small)
+	c := p.Get(1<<20, "test")
+	require.True(t, c != small && c != big)
+	p.Return(a)
+	p.Return(b)
+	p.Return(c)
+}
+
+func TestArenaPoolMaxSize(t *testing.T) {
+	p := NewArenaPool(8, 4<<20)
+	defer p.Release()
+
+	// The idle allocators are released to make room for the new ones.
+	a := p.Get(2<<20, "test")
+	p.Return(a)
+	b := p.Get(4<<20, "test")
+	require.True(t, b != a)
+	require.Equal(t, int64(b.Allocated()), p.Size())
+
+	// Once the cap is reached, Get waits for an allocator to be returned.
+	returned := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		p.Return(b)
+		close(returned)
+	}()
+	c := p.Get(4<<20, "test")
+	select {
+	case <-returned:
+	default:
+		t.Fatal("Get didn't wait for an allocator to be returned")
+	}
+
+	// The cap is soft: Get allocates over it if no allocator is returned.
+	start := time.Now()
+	d := p.Get(4<<20, "test")
+	require.True(t, time.Since(start) >= maxArenaWait)
+	require.True(t, p.Size() > 4<<20)
+	p.Return(c)
+	p.Return(d)
+	require.True(t, p.Size() <= 4<<20)
+}
+
+func TestArenaPoolGrowth(t *testing.T) {
+	const maxSize = 7 << 19
+	p := NewArenaPool(8, maxSize)
+	defer p.Release()
+
+	a := p.Get(1<<20, "test")
+	b := p.Get(1<<20, "test")
+	p.Return(b)
+	require.Equal(t, int64(a.Allocated()+b.Allocated()), p.Size())
+
+	// The growth of an allocator in use is accounted once it's returned, releasing the idle
+	// allocators to stay under the cap.
+	a.Allocate(2 << 20)
+	size := int64(a.Allocated())
+	require.True(t, size+int64(b.Allocated()) > maxSize)
+	p.Return(a)
+	require.Equal(t, size, p.Size())
+	c := p.Get(1<<20, "test")
+	require.True(t, c == a)
+	p.Return(c)
+}
@@ -17,7 +17,9 @@
 package table
 
 import (
+	"bytes"
 	"crypto/aes"
+	"io"
 	"math"
 	"runtime"
 	"sync"
@@ -73,6 +75,7 @@ type bblock struct {
 	baseKey      []byte   // Base key for the current block.
 	entryOffsets []uint32 // Offsets of entries present in current block.
 	end          int      // Points to the end offset of the block.
+	idx          int      // Index of the block in the table.
 }
 
 // Builder is used in building a table.
@@ -86,6 +89,9 @@ type Builder struct {
 	lenOffsets    uint32
 	estimatedSize uint32
 	keyHashes     []uint32 // Used for building the bloomfilter.
+	prefixHashes  []uint32 // Hashes of the key prefixes, also added to the bloomfilter.
+	lastPrefix    []byte
+	collectors    []TablePropertiesCollector
 	opts          *Options
 	maxVersion    uint64
 	onDiskSize    uint32
@@ -131,15 +137,20 @@ func NewTableBuilder(opts Options) *Builder {
 	if sz > maxAllocatorInitialSz {
 		sz = maxAllocatorInitialSz
 	}
-	b := &Builder{
-		alloc: opts.AllocPool.Get(sz, "TableBuilder"),
-		opts:  &opts,
+	b := &Builder{opts: &opts}
+	if opts.ArenaPool != nil {
+		b.alloc = opts.ArenaPool.Get(sz, "TableBuilder")
+	} else {
+		b.alloc = opts.AllocPool.Get(sz, "TableBuilder")
 	}
 	b.alloc.Tag = "Builder"
 	b.curBlock = &bblock{
 		data: b.alloc.Allocate(opts.BlockSize + padding),
 	}
 	b.opts.tableCapacity = uint64(float64(b.opts.TableSize) * 0.95)
+	for _, newCollector := range opts.PropertiesCollectors {
+		b.collectors = append(b.collectors, newCollector())
+	}
 
 	// If encryption or compression is not enabled, do not start compression/encryption goroutines
 	// and write directly to the buffer.
@@ -181,7 +192,7 @@ func (b *Builder) handleBlock() {
 			blockBuf = out
 		}
 		if b.shouldEncrypt() {
-			out, err := b.encrypt(blockBuf)
+			out, err := b.encrypt(blockBuf, aeadBlock, item.idx)
 			y.Check(y.Wrapf(err, "Error while encrypting block in table builder."))
 			blockBuf = out
 		}
@@ -201,6 +212,10 @@ func (b *Builder) handleBlock() {
 
 // Close closes the TableBuilder.
 func (b *Builder) Close() {
+	if b.opts.ArenaPool != nil {
+		b.opts.ArenaPool.Return(b.alloc)
+		return
+	}
 	b.opts.AllocPool.Return(b.alloc)
 }
 
@@ -220,10 +235,20 @@ func (b *Builder) keyDiff(newKey []byte) []byte {
 
 func (b *Builder) addHelper(key []byte, v y.ValueStruct, vpLen uint32) {
 	b.keyHashes = append(b.keyHashes, y.Hash(y.ParseKey(key)))
+	if pl := b.opts.BloomPrefixLength; pl > 0 {
+		// Keys are added in sorted order, so every prefix only needs to be added once.
+		if uk := y.ParseKey(key); len(uk) >= pl && !bytes.Equal(uk[:pl], b.lastPrefix) {
+			b.lastPrefix = append(b.lastPrefix[:0], uk[:pl]...)
+			b.prefixHashes = append(b.prefixHashes, y.Hash(b.lastPrefix))
+		}
+	}
 
 	if version := y.ParseTs(key); version > b.maxVersion {
 		b.maxVersion = version
 	}
+	for _, c := range b.collectors {
+		c.Add(y.ParseKey(key), y.ParseTs(key), v)
+	}
 
 	// diffKey stores the difference of key with baseKey.
 	var diffKey []byte
@@ -279,12 +304,13 @@ func (b *Builder) finishBlock() {
 	b.append(y.U32SliceToBytes(b.curBlock.entryOffsets))
 	b.append(y.U32ToBytes(uint32(len(b.curBlock.entryOffsets))))
 
-	checksum := b.calculateChecksum(b.curBlock.data[:b.curBlock.end])
+	checksum := b.blockChecksum(b.curBlock.data[:b.curBlock.end])
 
 	// Append the block checksum and its length.
 	b.append(checksum)
 	b.append(y.U32ToBytes(uint32(len(checksum))))
 
+	b.curBlock.idx = len(b.blockList)
 	b.blockList = append(b.blockList, b.curBlock)
 	atomic.AddUint32(&b.uncompressedSize, uint32(b.curBlock.end))
 
@@ -323,6 +349,9 @@ func (b *Builder) shouldFinishBlock(key []byte, value y.ValueStruct) bool {
 		// IV is added at the end of the block, while encrypting.
 		// So, size of IV is added to estimatedSize.
 		estimatedSize += aes.BlockSize
+		if b.opts.EncryptionMode == options.AESGCM {
+			estimatedSize += y.AEADTagSize
+		}
 	}
 
 	// Integer overflow check for table size.
@@ -394,10 +423,13 @@ The table structure looks like
 +---------+------------+-----------+---------------+
 | Block 5 | Block 6    | Block ... | Block N       |
 +---------+------------+-----------+---------------+
+| Partition 1 (optional) | ... | Partition M       |
++---------+------------+-----------+---------------+
 | Index   | Index Size | Checksum  | Checksum Size |
 +---------+------------+-----------+---------------+
 */
 // In case the data is encrypted, the "IV" is added to the end of the index.
+// The index partitions are only written if the table has more than IndexPartitionSize blocks.
 func (b *Builder) Finish() []byte {
 	bd := b.Done()
 	buf := make([]byte, bd.Size)
@@ -407,11 +439,12 @@ func (b *Builder) Finish() []byte {
 }
 
 type buildData struct {
-	blockList []*bblock
-	index     []byte
-	checksum  []byte
-	Size      int
-	alloc     *z.Allocator
+	blockList  []*bblock
+	partitions [][]byte
+	index      []byte
+	checksum   []byte
+	Size       int
+	alloc      *z.Allocator
 }
 
 func (bd *buildData) Copy(dst []byte) int {
@@ -419,6 +452,15 @@ func (bd *buildData) Copy(dst []byte) int {
 	for _, bl := range bd.blockList {
 		written += copy(dst[written:], bl.data[:bl.end])
 	}
+	return written + bd.copyIndex(dst[written:])
+}
+
+// copyIndex copies what follows the data blocks, the index partitions and the index, to dst.
+func (bd *buildData) copyIndex(dst []byte) int {
+	var written int
+	for _, p := range bd.partitions {
+		written += copy(dst[written:], p)
+	}
 	written += copy(dst[written:], bd.index)
 	written += copy(dst[written:], y.U32ToBytes(uint32(len(bd.index))))
 
@@ -427,13 +469,58 @@ func (bd *buildData) Copy(dst []byte) int {
 	return written
 }
 
+// dataSize returns the size of the data blocks.
+func (bd *buildData) dataSize() int {
+	var sz int
+	for _, bl := range bd.blockList {
+		sz += bl.end
+	}
+	return sz
+}
+
+// WriteTo writes the table to w, like Copy.
+func (bd *buildData) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	write := func(data []byte) error {
+		n, err := w.Write(data)
+		written += int64(n)
+		return err
+	}
+	for _, bl := range bd.blockList {
+		if err := write(bl.data[:bl.end]); err != nil {
+			return written, err
+		}
+	}
+	for _, p := range bd.partitions {
+		if err := write(p); err != nil {
+			return written, err
+		}
+	}
+	for _, data := range [][]byte{
+		bd.index, y.U32ToBytes(uint32(len(bd.index))),
+		bd.checksum, y.U32ToBytes(uint32(len(bd.checksum))),
+	} {
+		if err := write(data); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
 func (b *Builder) Done() buildData {
 	b.finishBlock() // This will never start a new block.
+
+	// The filter is built while the block handlers compress and encrypt the last blocks.
+	filter := make(chan []byte, 1)
+	go func() {
+		filter <- b.buildFilter()
+	}()
 	if b.blockChan != nil {
 		close(b.blockChan)
 	}
 	// Wait for block handler to finish.
 	b.wg.Wait()
+	f := <-filter
 
 	if len(b.blockList) == 0 {
 		return buildData{}
@@ -443,26 +530,38 @@ func (b *Builder) Done() buildData {
 		alloc:     b.alloc,
 	}
 
-	var f y.Filter
-	if b.opts.BloomFalsePositive > 0 {
-		bits := y.BloomBitsPerKey(len(b.keyHashes), b.opts.BloomFalsePositive)
-		f = y.NewFilter(b.keyHashes, bits)
-	}
-	index, dataSize := b.buildIndex(f)
+	index, partitions, dataSize := b.buildIndex(f)
 
 	var err error
 	if b.shouldEncrypt() {
-		index, err = b.encrypt(index)
+		index, err = b.encrypt(index, aeadIndex, 0)
 		y.Check(err)
 	}
 	checksum := b.calculateChecksum(index)
 
 	bd.index = index
+	bd.partitions = partitions
 	bd.checksum = checksum
 	bd.Size = int(dataSize) + len(index) + len(checksum) + 4 + 4
+	for _, p := range partitions {
+		bd.Size += len(p)
+	}
 	return bd
 }
 
+// buildFilter builds the filter of the keys, and of their prefixes. It is nil if the tables have
+// no filter.
+func (b *Builder) buildFilter() []byte {
+	if b.opts.BloomFalsePositive <= 0 || len(b.keyHashes) == 0 {
+		return nil
+	}
+	hashes := b.keyHashes
+	if len(b.prefixHashes) > 0 {
+		hashes = append(hashes, b.prefixHashes...)
+	}
+	return b.opts.filterPolicy().NewFilter(hashes, b.opts.BloomFalsePositive)
+}
+
 func (b *Builder) calculateChecksum(data []byte) []byte {
 	// Build checksum for the index.
 	checksum := pb.Checksum{
@@ -485,6 +584,23 @@ func (b *Builder) calculateChecksum(data []byte) []byte {
 	return chksum
 }
 
+// blockChecksum returns the checksum of a block, calculated using the configured algorithm. It is
+// empty if the blocks have no checksum.
+func (b *Builder) blockChecksum(data []byte) []byte {
+	var algo pb.Checksum_Algorithm
+	switch b.opts.ChecksumAlgorithm {
+	case options.NoChecksum:
+		return nil
+	case options.XXHash64:
+		algo = pb.Checksum_XXHash64
+	default:
+		return b.calculateChecksum(data)
+	}
+	chksum, err := proto.Marshal(&pb.Checksum{Sum: y.CalculateChecksum(data, algo), Algo: algo})
+	y.Check(err)
+	return chksum
+}
+
 // DataKey returns datakey of the builder.
 func (b *Builder) DataKey() *pb.DataKey {
 	return b.opts.DataKey
@@ -495,12 +611,24 @@ func (b *Builder) Opts() *Options {
 }
 
 // encrypt will encrypt the given data and appends IV to the end of the encrypted data.
-// This should be only called only after checking shouldEncrypt method.
-func (b *Builder) encrypt(data []byte) ([]byte, error) {
+// This should be only called only after checking shouldEncrypt method. With AES-GCM, kind and idx
+// locate the data in the table, and are authenticated together with the table ID.
+func (b *Builder) encrypt(data []byte, kind byte, idx int) ([]byte, error) {
 	iv, err := y.GenerateIV()
 	if err != nil {
 		return data, y.Wrapf(err, "Error while generating IV in Builder.encrypt")
 	}
+	if b.opts.EncryptionMode == options.AESGCM {
+		// The tag is added at the end of the encrypted data, followed by the IV.
+		sz := len(data) + y.AEADTagSize
+		dst := b.alloc.Allocate(sz + len(iv))
+		ad := additionalData(b.opts.TableID, kind, idx)
+		if _, err = y.Seal(dst[:0], data, ad, b.DataKey().Data, iv); err != nil {
+			return data, y.Wrapf(err, "Error while encrypting in Builder.encrypt")
+		}
+		y.AssertTrue(len(iv) == copy(dst[sz:], iv))
+		return dst, nil
+	}
 	needSz := len(data) + len(iv)
 	dst := b.alloc.Allocate(needSz)
 
@@ -535,25 +663,37 @@ func (b *Builder) compressData(data []byte) ([]byte, error) {
 	return nil, errors.New("Unsupported compression type")
 }
 
-func (b *Builder) buildIndex(bloom []byte) ([]byte, uint32) {
+func (b *Builder) buildIndex(bloom []byte) ([]byte, [][]byte, uint32) {
 	builder := fbs.NewBuilder(3 << 20)
 
-	boList, dataSize := b.writeBlockOffsets(builder)
-	// Write block offset vector the the idxBuilder.
-	fb.TableIndexStartOffsetsVector(builder, len(boList))
-
-	// Write individual block offsets in reverse order to work around how Flatbuffers expects it.
-	for i := len(boList) - 1; i >= 0; i-- {
-		builder.PrependUOffsetT(boList[i])
+	var boList []fbs.UOffsetT
+	var partitions [][]byte
+	var dataSize, partitionSize uint32
+	if ps := b.opts.IndexPartitionSize; ps > 0 && len(b.blockList) > ps {
+		partitions, dataSize = b.buildPartitions()
+		boList = b.writePartitionOffsets(builder, partitions, dataSize)
+		partitionSize = uint32(ps)
+	} else {
+		boList, dataSize = b.writeBlockOffsets(builder, b.blockList, 0)
 	}
-	boEnd := builder.EndVector(len(boList))
+	// Write block offset vector the the idxBuilder.
+	boEnd := writeOffsetsVector(builder, boList)
 
 	var bfoff fbs.UOffsetT
 	// Write the bloom filter.
 	if len(bloom) > 0 {
 		bfoff = builder.CreateByteVector(bloom)
 	}
+	var propoff fbs.UOffsetT
+	if len(b.collectors) > 0 {
+		props, err := encodeProperties(b.collectors)
+		y.Check(err)
+		propoff = builder.CreateByteVector(props)
+	}
 	b.onDiskSize += dataSize
+	for _, p := range partitions {
+		b.onDiskSize += uint32(len(p))
+	}
 	fb.TableIndexStart(builder)
 	fb.TableIndexAddOffsets(builder, boEnd)
 	fb.TableIndexAddBloomFilter(builder, bfoff)
@@ -562,21 +702,100 @@ func (b *Builder) buildIndex(bloom []byte) ([]byte, uint32) {
 	fb.TableIndexAddKeyCount(builder, uint32(len(b.keyHashes)))
 	fb.TableIndexAddOnDiskSize(builder, b.onDiskSize)
 	fb.TableIndexAddStaleDataSize(builder, uint32(b.staleDataSize))
+	fb.TableIndexAddPartitionSize(builder, partitionSize)
+	fb.TableIndexAddNumBlocks(builder, uint32(len(b.blockList)))
+	if len(bloom) > 0 {
+		fb.TableIndexAddBloomPrefixLength(builder, uint32(b.opts.BloomPrefixLength))
+		fb.TableIndexAddFilterPolicy(builder, b.opts.filterPolicy().ID())
+	}
+	fb.TableIndexAddProperties(builder, propoff)
 	builder.Finish(fb.TableIndexEnd(builder))
 
 	buf := builder.FinishedBytes()
 	index := fb.GetRootAsTableIndex(buf, 0)
 	// Mutate the ondisk size to include the size of the index as well.
 	y.AssertTrue(index.MutateOnDiskSize(index.OnDiskSize() + uint32(len(buf))))
-	return buf, dataSize
+	return buf, partitions, dataSize
+}
+
+// writeOffsetsVector writes the given block offsets as the offsets vector of a TableIndex.
+func writeOffsetsVector(builder *fbs.Builder, boList []fbs.UOffsetT) fbs.UOffsetT {
+	fb.TableIndexStartOffsetsVector(builder, len(boList))
+
+	// Write individual block offsets in reverse order to work around how Flatbuffers expects it.
+	for i := len(boList) - 1; i >= 0; i-- {
+		builder.PrependUOffsetT(boList[i])
+	}
+	return builder.EndVector(len(boList))
 }
 
-// writeBlockOffsets writes all the blockOffets in b.offsets and returns the
-// offsets for the newly written items.
-func (b *Builder) writeBlockOffsets(builder *fbs.Builder) ([]fbs.UOffsetT, uint32) {
+// buildPartitions splits the block offsets into partitions of IndexPartitionSize offsets each.
+// Every partition is a TableIndex holding only the offsets, followed by its checksum and the
+// checksum length, just like a block. It returns the partitions and the size of the data blocks.
+/*
++-----------------+------------------+----------+-----------------+
+| TableIndex      | IV (if encrypted)| Checksum | Checksum Length |
++-----------------+------------------+----------+-----------------+
+*/
+func (b *Builder) buildPartitions() ([][]byte, uint32) {
+	ps := b.opts.IndexPartitionSize
+	var partitions [][]byte
 	var startOffset uint32
+	for i := 0; i < len(b.blockList); i += ps {
+		end := i + ps
+		if end > len(b.blockList) {
+			end = len(b.blockList)
+		}
+		builder := fbs.NewBuilder(ps * 64)
+		var boList []fbs.UOffsetT
+		boList, startOffset = b.writeBlockOffsets(builder, b.blockList[i:end], startOffset)
+		boEnd := writeOffsetsVector(builder, boList)
+		fb.TableIndexStart(builder)
+		fb.TableIndexAddOffsets(builder, boEnd)
+		builder.Finish(fb.TableIndexEnd(builder))
+
+		data := builder.FinishedBytes()
+		if b.shouldEncrypt() {
+			var err error
+			data, err = b.encrypt(data, aeadPartition, i/ps)
+			y.Check(err)
+		}
+		checksum := b.calculateChecksum(data)
+		p := b.alloc.Allocate(len(data) + len(checksum) + 4)
+		n := copy(p, data)
+		n += copy(p[n:], checksum)
+		copy(p[n:], y.U32ToBytes(uint32(len(checksum))))
+		partitions = append(partitions, p)
+	}
+	return partitions, startOffset
+}
+
+// writePartitionOffsets writes a key,offset,len triple for each of the partitions, which are
+// placed right after the data blocks. The key of a partition is the base key of its first block.
+func (b *Builder) writePartitionOffsets(
+	builder *fbs.Builder, partitions [][]byte, dataSize uint32) []fbs.UOffsetT {
+	ps := b.opts.IndexPartitionSize
+	var uoffs []fbs.UOffsetT
+	startOffset := dataSize
+	for i, p := range partitions {
+		k := builder.CreateByteVector(b.blockList[i*ps].baseKey)
+
+		fb.BlockOffsetStart(builder)
+		fb.BlockOffsetAddKey(builder, k)
+		fb.BlockOffsetAddOffset(builder, startOffset)
+		fb.BlockOffsetAddLen(builder, uint32(len(p)))
+		uoffs = append(uoffs, fb.BlockOffsetEnd(builder))
+		startOffset += uint32(len(p))
+	}
+	return uoffs
+}
+
+// writeBlockOffsets writes the blockOffets of the given blocks, the first of which starts at
+// startOffset. It returns the offsets for the newly written items and the end of the last block.
+func (b *Builder) writeBlockOffsets(
+	builder *fbs.Builder, blocks []*bblock, startOffset uint32) ([]fbs.UOffsetT, uint32) {
 	var uoffs []fbs.UOffsetT
-	for _, bl := range b.blockList {
+	for _, bl := range blocks {
 		uoff := b.writeBlockOffset(builder, bl, startOffset)
 		uoffs = append(uoffs, uoff)
 		startOffset += uint32(bl.end)
@@ -67,6 +67,18 @@ func TestTableIndex(t *testing.T) {
 				IndexCache:         cache,
 			},
 		},
+		{
+			// Authenticated encryption mode.
+			name: "Only AES-GCM encryption",
+			opts: Options{
+				BlockSize:          4 * 1024,
+				BloomFalsePositive: 0.01,
+				TableSize:          30 << 20,
+				DataKey:            &pb.DataKey{Data: key},
+				EncryptionMode:     options.AESGCM,
+				IndexCache:         cache,
+			},
+		},
 		{
 			// Compression mode.
 			name: "Only compression",
@@ -96,9 +108,10 @@ func TestTableIndex(t *testing.T) {
 	for _, tt := range subTest {
 		t.Run(tt.name, func(t *testing.T) {
 			opt := tt.opts
+			opt.TableID = uint64(rand.Uint32())
 			builder := NewTableBuilder(opt)
 			defer builder.Close()
-			filename := fmt.Sprintf("%s%c%d.sst", os.TempDir(), os.PathSeparator, rand.Uint32())
+			filename := NewFilename(opt.TableID, os.TempDir())
 
 			blockFirstKeys := make([][]byte, 0)
 			blockCount := 0
@@ -139,6 +152,174 @@ func TestTableIndex(t *testing.T) {
 	}
 }
 
+func TestPartitionedIndex(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+
+	subTest := []struct {
+		name string
+		opts Options
+	}{
+		{
+			name: "No encyption/compression",
+			opts: Options{BlockSize: 1024, BloomFalsePositive: 0.01},
+		},
+		{
+			name: "Compression and encryption",
+			opts: Options{
+				BlockSize:            1024,
+				BloomFalsePositive:   0.01,
+				Compression:          options.ZSTD,
+				ZSTDCompressionLevel: 3,
+				DataKey:              &pb.DataKey{Data: key},
+				IndexCache:           cache,
+			},
+		},
+	}
+	for _, tt := range subTest {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.ChkMode = options.OnTableAndBlockRead
+			plain := buildTestTable(t, "key", 10000, opts)
+			defer plain.DecrRef()
+
+			opts.IndexPartitionSize = 7
+			tbl := buildTestTable(t, "key", 10000, opts)
+			defer tbl.DecrRef()
+
+			require.Equal(t, 0, plain.cheapIndex().PartitionSize)
+			require.Equal(t, 7, tbl.cheapIndex().PartitionSize)
+			require.Equal(t, plain.offsetsLength(), tbl.offsetsLength())
+			require.Greater(t, plain.IndexSize(), tbl.IndexSize())
+			require.NoError(t, tbl.VerifyChecksum())
+
+			// The partitions must hold the same block offsets as the single level index.
+			var pbo, tbo fb.BlockOffset
+			for i := 0; i < plain.offsetsLength(); i++ {
+				require.NoError(t, plain.offsets(&pbo, i))
+				require.NoError(t, tbl.offsets(&tbo, i))
+				require.Equal(t, pbo.KeyBytes(), tbo.KeyBytes())
+				require.Equal(t, pbo.Offset(), tbo.Offset())
+				require.Equal(t, pbo.Len(), tbo.Len())
+			}
+			require.Error(t, tbl.offsets(&tbo, tbl.offsetsLength()))
+			require.Equal(t, plain.KeySplits(10, nil), tbl.KeySplits(10, nil))
+			require.Equal(t, y.ParseKey(plain.Biggest()), y.ParseKey(tbl.Biggest()))
+
+			it := tbl.NewIterator(0)
+			defer it.Close()
+			count := 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.Equal(t, fmt.Sprintf("key%04d", count), string(y.ParseKey(it.Key())))
+				count++
+			}
+			require.Equal(t, 10000, count)
+			for _, i := range []int{0, 1, 777, 5000, 9999} {
+				it.seek(y.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), 0))
+				require.True(t, it.Valid())
+				require.Equal(t, fmt.Sprintf("%d", i), string(it.Value().Value))
+			}
+		})
+	}
+}
+
+func TestPartitionedIndexCacheEviction(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+
+	opts := Options{
+		BlockSize:          1024,
+		BloomFalsePositive: 0.01,
+		DataKey:            &pb.DataKey{Data: key},
+		IndexCache:         cache,
+		IndexPartitionSize: 7,
+	}
+	tbl := buildTestTable(t, "key", 10000, opts)
+	var ko fb.BlockOffset
+	for i := 0; i < tbl.offsetsLength(); i++ {
+		require.NoError(t, tbl.offsets(&ko, i))
+	}
+	cache.Wait()
+	_, ok := cache.Get(tbl.partitionKey(0))
+	require.True(t, ok)
+
+	// Deleting the table must delete its partitions from the cache.
+	require.NoError(t, tbl.DecrRef())
+	cache.Wait()
+	for i := 0; i*7 < tbl.offsetsLength(); i++ {
+		_, ok := cache.Get(tbl.partitionKey(i))
+		require.False(t, ok, "partition %d", i)
+	}
+}
+
+type versionRangeCollector struct {
+	min, max uint64
+	count    int
+}
+
+func (c *versionRangeCollector) Add(key []byte, version uint64, value y.ValueStruct) {
+	if c.count == 0 || version < c.min {
+		c.min = version
+	}
+	if version > c.max {
+		c.max = version
+	}
+	c.count++
+}
+
+func (c *versionRangeCollector) Finish() map[string][]byte {
+	return map[string][]byte{
+		"min":   y.U64ToBytes(c.min),
+		"max":   y.U64ToBytes(c.max),
+		"count": y.U64ToBytes(uint64(c.count)),
+	}
+}
+
+func TestTableProperties(t *testing.T) {
+	opts := getTestTableOptions()
+	tbl := buildTestTable(t, "key", 100, opts)
+	props, err := tbl.Properties()
+	require.NoError(t, err)
+	require.Nil(t, props)
+	tbl.DecrRef()
+
+	opts.PropertiesCollectors = []TablePropertiesCollectorFactory{
+		func() TablePropertiesCollector { return &versionRangeCollector{} },
+	}
+	b := NewTableBuilder(opts)
+	defer b.Close()
+	for i := 0; i < 1000; i++ {
+		k := y.KeyWithTs([]byte(fmt.Sprintf("%016x", i)), uint64(i+10))
+		b.Add(k, y.ValueStruct{Value: []byte("v")}, 0)
+	}
+	filename := fmt.Sprintf("%s%c%d.sst", os.TempDir(), os.PathSeparator, rand.Uint32())
+	tbl, err = CreateTable(filename, b)
+	require.NoError(t, err)
+	defer tbl.DecrRef()
+
+	props, err = tbl.Properties()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{
+		"min":   y.U64ToBytes(10),
+		"max":   y.U64ToBytes(1009),
+		"count": y.U64ToBytes(1000),
+	}, props)
+}
+
 func TestInvalidCompression(t *testing.T) {
 	keyPrefix := "key"
 	opts := Options{BlockSize: 4 << 10, Compression: options.ZSTD}
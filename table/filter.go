@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import "github.com/dgraph-io/badger/v3/y"
+
+// FilterPolicy builds and queries the filters stored in the table index, which are used to skip
+// the tables that don't have a key.
+type FilterPolicy interface {
+	// ID identifies the filter encoding. It is stored in the table index, so that a table is
+	// always read with the policy it was built with. IDs below 128 are reserved for the policies
+	// in this package.
+	ID() uint8
+	// NewFilter returns a filter for the given key hashes with the given false positive rate.
+	// The hashes may have duplicates.
+	NewFilter(hashes []uint32, falsePositive float64) []byte
+	// MayContain returns whether the filter may contain the key hash.
+	MayContain(filter []byte, hash uint32) bool
+}
+
+var (
+	// BloomFilterPolicy builds Bloom filters. It is the default policy.
+	BloomFilterPolicy FilterPolicy = bloomFilterPolicy{}
+	// XorFilterPolicy builds xor filters, which are smaller than Bloom filters for the same
+	// false positive rate, but take longer to build.
+	XorFilterPolicy FilterPolicy = xorFilterPolicy{}
+)
+
+type bloomFilterPolicy struct{}
+
+func (bloomFilterPolicy) ID() uint8 { return 0 }
+
+func (bloomFilterPolicy) NewFilter(hashes []uint32, falsePositive float64) []byte {
+	bits := y.BloomBitsPerKey(len(hashes), falsePositive)
+	return y.NewFilter(hashes, bits)
+}
+
+func (bloomFilterPolicy) MayContain(filter []byte, hash uint32) bool {
+	return y.Filter(filter).MayContain(hash)
+}
+
+type xorFilterPolicy struct{}
+
+func (xorFilterPolicy) ID() uint8 { return 1 }
+
+func (xorFilterPolicy) NewFilter(hashes []uint32, falsePositive float64) []byte {
+	return y.NewXorFilter(hashes, falsePositive)
+}
+
+func (xorFilterPolicy) MayContain(filter []byte, hash uint32) bool {
+	return y.XorFilter(filter).MayContain(hash)
+}
+
+// filterPolicy returns the policy to build the filters with.
+func (opt *Options) filterPolicy() FilterPolicy {
+	if opt.FilterPolicy == nil {
+		return BloomFilterPolicy
+	}
+	return opt.FilterPolicy
+}
+
+// filterPolicyByID returns the policy which built filters with the given ID, or nil if it is not
+// known.
+func (opt *Options) filterPolicyByID(id uint8) FilterPolicy {
+	if opt.FilterPolicy != nil && opt.FilterPolicy.ID() == id {
+		return opt.FilterPolicy
+	}
+	for _, p := range []FilterPolicy{BloomFilterPolicy, XorFilterPolicy} {
+		if p.ID() == id {
+			return p
+		}
+	}
+	return nil
+}
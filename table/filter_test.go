@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto"
+	"github.com/stretchr/testify/require"
+)
+
+// allKeysPolicy is a custom policy whose filters contain every key.
+type allKeysPolicy struct{}
+
+func (allKeysPolicy) ID() uint8                               { return 200 }
+func (allKeysPolicy) NewFilter([]uint32, float64) []byte      { return []byte{1} }
+func (allKeysPolicy) MayContain(filter []byte, _ uint32) bool { return len(filter) == 1 }
+
+func TestFilterPolicy(t *testing.T) {
+	missing := func(tbl *Table) int {
+		var n int
+		for i := 0; i < 10000; i++ {
+			if tbl.DoesNotHave(y.Hash([]byte(fmt.Sprintf("missing%d", i)))) {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, policy := range []FilterPolicy{nil, BloomFilterPolicy, XorFilterPolicy} {
+		t.Run(fmt.Sprintf("%T", policy), func(t *testing.T) {
+			opts := getTestTableOptions()
+			opts.FilterPolicy = policy
+			tbl := buildTestTable(t, "key", 10000, opts)
+			defer tbl.DecrRef()
+
+			require.Equal(t, opts.filterPolicy().ID(), tbl.fetchIndex().FilterPolicy())
+			for i := 0; i < 10000; i++ {
+				require.False(t, tbl.DoesNotHave(y.Hash([]byte(key("key", i)))))
+			}
+			require.Greater(t, missing(tbl), 9000)
+		})
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		opts := getTestTableOptions()
+		opts.FilterPolicy = allKeysPolicy{}
+		tbl := buildTestTable(t, "key", 100, opts)
+		defer tbl.DecrRef()
+		require.True(t, tbl.hasBloomFilter)
+		require.Equal(t, 0, missing(tbl))
+
+		// Without the custom policy, the filter can't be read and the table has to be searched.
+		opts.FilterPolicy = nil
+		tbl2, err := OpenTable(tbl.MmapFile, opts)
+		require.NoError(t, err)
+		require.False(t, tbl2.hasBloomFilter)
+		require.Equal(t, 0, missing(tbl2))
+	})
+}
+
+func TestFilterCache(t *testing.T) {
+	newCache := func() *ristretto.Cache {
+		cache, err := ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1000,
+			MaxCost:     1 << 20,
+			BufferItems: 64,
+			Metrics:     true,
+		})
+		require.NoError(t, err)
+		return cache
+	}
+	dk := make([]byte, 32)
+	_, err := rand.Read(dk)
+	require.NoError(t, err)
+
+	opts := getTestTableOptions()
+	opts.DataKey = &pb.DataKey{Data: dk}
+	opts.IndexCache = newCache()
+	opts.FilterCache = newCache()
+	tbl := buildTestTable(t, "key", 1000, opts)
+	defer tbl.DecrRef()
+
+	require.False(t, tbl.DoesNotHave(y.Hash([]byte(key("key", 0)))))
+	opts.FilterCache.Wait()
+	require.Equal(t, uint64(1), opts.FilterCache.Metrics.KeysAdded())
+
+	// Evicting all the indices doesn't evict the filter.
+	opts.IndexCache.Clear()
+	for i := 0; i < 1000; i++ {
+		require.False(t, tbl.DoesNotHave(y.Hash([]byte(key("key", i)))))
+	}
+	require.Equal(t, uint64(1000), opts.FilterCache.Metrics.Hits())
+	require.Equal(t, uint64(1), opts.FilterCache.Metrics.Misses())
+}
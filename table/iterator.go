@@ -20,9 +20,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"os"
 	"sort"
+	"sync/atomic"
 
 	"github.com/dgraph-io/badger/v3/fb"
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/y"
 )
 
@@ -181,7 +185,13 @@ type Iterator struct {
 
 	// Internally, Iterator is bidirectional. However, we only expose the
 	// unidirectional functionality for now.
-	opt int // Valid options are REVERSED and NOCACHE.
+	opt int // Valid options are REVERSED, NOCACHE, VERIFY and DIRECT.
+
+	direct y.File // Opened on the first block read with the DIRECT option.
+
+	// lower and upper are the keys, without the timestamp, bounding the iteration to
+	// [lower, upper). They're nil if unset.
+	lower, upper []byte
 }
 
 // NewIterator returns a new iterator of the Table
@@ -194,9 +204,51 @@ func (t *Table) NewIterator(opt int) *Iterator {
 // Close closes the iterator (and it must be called).
 func (itr *Iterator) Close() error {
 	itr.bi.Close()
+	if itr.direct != nil {
+		// The file was only read, so there's nothing to lose if closing it fails.
+		_ = itr.direct.Close()
+	}
 	return itr.t.DecrRef()
 }
 
+// SetBounds restricts the iteration to the keys in [lower, upper). The keys must not have the
+// timestamp, and an empty key leaves that side unbounded. The blocks outside the bounds are
+// skipped without being read. SetBounds must be called before the iterator is positioned.
+func (itr *Iterator) SetBounds(lower, upper []byte) {
+	itr.lower, itr.upper = nil, nil
+	if len(lower) > 0 {
+		itr.lower = lower
+	}
+	if len(upper) > 0 {
+		itr.upper = upper
+	}
+}
+
+// checkBounds invalidates the iterator if it moved out of the bounds.
+func (itr *Iterator) checkBounds() {
+	if itr.err != nil {
+		return
+	}
+	if itr.opt&REVERSED == 0 {
+		if itr.upper != nil && bytes.Compare(y.ParseKey(itr.Key()), itr.upper) >= 0 {
+			itr.err = io.EOF
+		}
+		return
+	}
+	if itr.lower != nil && bytes.Compare(y.ParseKey(itr.Key()), itr.lower) < 0 {
+		itr.err = io.EOF
+	}
+}
+
+// blockBaseKey returns the user key, without the timestamp, of the first entry of the block idx.
+func (itr *Iterator) blockBaseKey(idx int) ([]byte, error) {
+	var ko fb.BlockOffset
+	if err := itr.t.offsets(&ko, idx); err != nil {
+		return nil, err
+	}
+	return y.ParseKey(ko.KeyBytes()), nil
+}
+
 func (itr *Iterator) reset() {
 	itr.bpos = 0
 	itr.err = nil
@@ -211,6 +263,30 @@ func (itr *Iterator) useCache() bool {
 	return itr.opt&NOCACHE == 0
 }
 
+// block returns the block at idx. With the VERIFY option, the checksum of the block is verified if
+// the table verifies checksums OnCompactionRead, unless it has been verified already.
+func (itr *Iterator) block(idx int) (*block, error) {
+	// The blocks of remote tables aren't in their local file.
+	if itr.opt&DIRECT != 0 && itr.direct == nil && itr.t.remote == nil {
+		fd, err := y.OpenDirectFile(itr.t.opt.fs(), itr.t.Filename(), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, y.Wrapf(err, "while opening table: %s", itr.t.Filename())
+		}
+		itr.direct = fd
+	}
+	b, err := itr.t.loadBlock(idx, itr.useCache(), itr.direct)
+	if err != nil || itr.opt&VERIFY == 0 || itr.t.opt.ChkMode != options.OnCompactionRead ||
+		atomic.LoadInt32(&b.verified) == 1 {
+		return b, err
+	}
+	if err := b.verifyCheckSum(); err != nil {
+		b.decrRef()
+		return nil, y.Wrapf(err, "checksum validation failed for table: %s, block: %d",
+			itr.t.Filename(), idx)
+	}
+	return b, nil
+}
+
 func (itr *Iterator) seekToFirst() {
 	numBlocks := itr.t.offsetsLength()
 	if numBlocks == 0 {
@@ -218,7 +294,7 @@ func (itr *Iterator) seekToFirst() {
 		return
 	}
 	itr.bpos = 0
-	block, err := itr.t.block(itr.bpos, itr.useCache())
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -237,7 +313,7 @@ func (itr *Iterator) seekToLast() {
 		return
 	}
 	itr.bpos = numBlocks - 1
-	block, err := itr.t.block(itr.bpos, itr.useCache())
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -251,7 +327,7 @@ func (itr *Iterator) seekToLast() {
 
 func (itr *Iterator) seekHelper(blockIdx int, key []byte) {
 	itr.bpos = blockIdx
-	block, err := itr.t.block(blockIdx, itr.useCache())
+	block, err := itr.block(blockIdx)
 	if err != nil {
 		itr.err = err
 		return
@@ -273,11 +349,22 @@ func (itr *Iterator) seekFrom(key []byte, whence int) {
 	}
 
 	var ko fb.BlockOffset
+	var err error
 	idx := sort.Search(itr.t.offsetsLength(), func(idx int) bool {
-		// Offsets should never return false since we're iterating within the OffsetsLength.
-		y.AssertTrue(itr.t.offsets(&ko, idx))
+		// Offsets can only fail to be read from an index partition, since we're iterating
+		// within the OffsetsLength.
+		if err != nil {
+			return false
+		}
+		if err = itr.t.offsets(&ko, idx); err != nil {
+			return false
+		}
 		return y.CompareKeys(ko.KeyBytes(), key) > 0
 	})
+	if err != nil {
+		itr.err = err
+		return
+	}
 	if idx == 0 {
 		// The smallest key in our table is already strictly > key. We can return that.
 		// This is like a SeekToFirst.
@@ -328,7 +415,19 @@ func (itr *Iterator) next() {
 	}
 
 	if len(itr.bi.data) == 0 {
-		block, err := itr.t.block(itr.bpos, itr.useCache())
+		if itr.upper != nil {
+			baseKey, err := itr.blockBaseKey(itr.bpos)
+			if err != nil {
+				itr.err = err
+				return
+			}
+			if bytes.Compare(baseKey, itr.upper) >= 0 {
+				// This block, and all the blocks after it, are beyond the upper bound.
+				itr.err = io.EOF
+				return
+			}
+		}
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
@@ -358,7 +457,20 @@ func (itr *Iterator) prev() {
 	}
 
 	if len(itr.bi.data) == 0 {
-		block, err := itr.t.block(itr.bpos, itr.useCache())
+		// All the keys of this block are smaller than the first key of the next block. If that
+		// one is below the lower bound, so is this block, and all the blocks before it.
+		if itr.lower != nil && itr.bpos+1 < itr.t.offsetsLength() {
+			baseKey, err := itr.blockBaseKey(itr.bpos + 1)
+			if err != nil {
+				itr.err = err
+				return
+			}
+			if bytes.Compare(baseKey, itr.lower) < 0 {
+				itr.err = io.EOF
+				return
+			}
+		}
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
@@ -407,29 +519,48 @@ func (itr *Iterator) Next() {
 	} else {
 		itr.prev()
 	}
+	itr.checkBounds()
 }
 
 // Rewind follows the y.Iterator interface
 func (itr *Iterator) Rewind() {
-	if itr.opt&REVERSED == 0 {
+	switch {
+	case itr.opt&REVERSED == 0 && itr.lower != nil:
+		itr.seek(y.KeyWithTs(itr.lower, math.MaxUint64))
+	case itr.opt&REVERSED == 0:
 		itr.seekToFirst()
-	} else {
+	case itr.upper != nil:
+		// The smallest version of the upper bound comes right after all the keys below it.
+		itr.seekForPrev(y.KeyWithTs(itr.upper, math.MaxUint64))
+	default:
 		itr.seekToLast()
 	}
+	itr.checkBounds()
 }
 
 // Seek follows the y.Iterator interface
 func (itr *Iterator) Seek(key []byte) {
 	if itr.opt&REVERSED == 0 {
+		if itr.lower != nil && bytes.Compare(y.ParseKey(key), itr.lower) < 0 {
+			key = y.KeyWithTs(itr.lower, math.MaxUint64)
+		}
 		itr.seek(key)
 	} else {
+		if itr.upper != nil && bytes.Compare(y.ParseKey(key), itr.upper) >= 0 {
+			key = y.KeyWithTs(itr.upper, math.MaxUint64)
+		}
 		itr.seekForPrev(key)
 	}
+	itr.checkBounds()
 }
 
 var (
 	REVERSED int = 2
 	NOCACHE  int = 4
+	// VERIFY verifies the checksum of the blocks read, for tables using OnCompactionRead.
+	VERIFY int = 8
+	// DIRECT reads the blocks with O_DIRECT, bypassing the page cache.
+	DIRECT int = 16
 )
 
 // ConcatIterator concatenates the sequences defined by several iterators.  (It only works with
@@ -440,6 +571,8 @@ type ConcatIterator struct {
 	iters   []*Iterator // Corresponds to tables.
 	tables  []*Table    // Disregarding reversed, this is in ascending order.
 	options int         // Valid options are REVERSED and NOCACHE.
+
+	lower, upper []byte // Passed on to the iterators of the tables. See Iterator.SetBounds.
 }
 
 // NewConcatIterator creates a new concatenated iterator
@@ -461,6 +594,12 @@ func NewConcatIterator(tbls []*Table, opt int) *ConcatIterator {
 	}
 }
 
+// SetBounds restricts the iteration to the keys in [lower, upper), as Iterator.SetBounds does.
+// It must be called before the iterator is positioned.
+func (s *ConcatIterator) SetBounds(lower, upper []byte) {
+	s.lower, s.upper = lower, upper
+}
+
 func (s *ConcatIterator) setIdx(idx int) {
 	s.idx = idx
 	if idx < 0 || idx >= len(s.iters) {
@@ -469,6 +608,7 @@ func (s *ConcatIterator) setIdx(idx int) {
 	}
 	if s.iters[idx] == nil {
 		s.iters[idx] = s.tables[idx].NewIterator(s.options)
+		s.iters[idx].SetBounds(s.lower, s.upper)
 	}
 	s.cur = s.iters[s.idx]
 }
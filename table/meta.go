@@ -0,0 +1,225 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// Meta is what opening a table reads from its index and its last block. It can be kept, and
+// passed to OpenTableWithMeta to open the table again without verifying the checksum of its index,
+// decrypting it, or reading its biggest key. The tables are immutable, and the Meta is only used
+// if the ID, the size and the checksum of the index of the table match it, so a Meta kept for a
+// table which was deleted since can't be mistaken for another one.
+type Meta struct {
+	ID   uint64
+	Size int64
+	// IndexChecksum is the checksum of the index, as stored in the footer of the table.
+	IndexChecksum []byte
+	IndexLen      int
+
+	Smallest, Biggest []byte
+
+	MaxVersion        uint64
+	KeyCount          uint32
+	UncompressedSize  uint32
+	OnDiskSize        uint32
+	BloomFilterLength int
+	OffsetsLength     int
+	BloomPrefixLength int
+	PartitionSize     int
+
+	// FilterPolicy is the ID of the policy which built the filter, if HasFilter is set.
+	FilterPolicy uint8
+	HasFilter    bool
+	// Filter is the decrypted filter of an encrypted table, if it was in the filter cache. It is
+	// put back in the filter cache when the table is opened. The filters of the tables which
+	// aren't encrypted are read from the table files.
+	Filter []byte
+}
+
+// Meta returns the Meta of the table.
+func (t *Table) Meta() *Meta {
+	c := t.cheapIndex()
+	m := &Meta{
+		ID:                t.id,
+		Size:              int64(t.tableSize),
+		IndexChecksum:     t.indexChecksum,
+		IndexLen:          t.indexLen,
+		Smallest:          t.smallest,
+		Biggest:           t.biggest,
+		MaxVersion:        c.MaxVersion,
+		KeyCount:          c.KeyCount,
+		UncompressedSize:  c.UncompressedSize,
+		OnDiskSize:        c.OnDiskSize,
+		BloomFilterLength: c.BloomFilterLength,
+		OffsetsLength:     c.OffsetsLength,
+		BloomPrefixLength: c.BloomPrefixLength,
+		PartitionSize:     c.PartitionSize,
+		HasFilter:         t.hasBloomFilter,
+	}
+	if t.filter != nil {
+		m.FilterPolicy = t.filter.ID()
+	}
+	if t.hasBloomFilter && t.shouldDecrypt() && t.opt.FilterCache != nil {
+		if val, ok := t.opt.FilterCache.Get(t.filterKey()); ok && val != nil {
+			m.Filter = val.([]byte)
+		}
+	}
+	return m
+}
+
+// OpenTableWithMeta is like OpenTable, or OpenRemoteTable if rf isn't nil, but it takes what it
+// would read from the index and the last block of the table from meta, if meta matches the table.
+func OpenTableWithMeta(mf *z.MmapFile, rf RemoteFile, meta *Meta, opts Options) (*Table, error) {
+	return openTable(mf, rf, meta, opts)
+}
+
+// initFromMeta initializes the table from meta, instead of from its index and last block. It
+// returns false if meta doesn't match the table.
+func (t *Table) initFromMeta(meta *Meta) bool {
+	if meta.ID != t.id || meta.Size != int64(t.tableSize) {
+		return false
+	}
+	checksum, err := t.readFooter()
+	if err != nil || t.indexLen != meta.IndexLen || !bytes.Equal(checksum, meta.IndexChecksum) {
+		return false
+	}
+	t.indexChecksum = meta.IndexChecksum
+	if !t.shouldDecrypt() {
+		// This points to the mmap'ed buffer, so it doesn't read the index.
+		index, err := t.readTableIndex()
+		if err != nil {
+			return false
+		}
+		t._index = index
+	}
+	t._cheap = &cheapIndex{
+		MaxVersion:        meta.MaxVersion,
+		KeyCount:          meta.KeyCount,
+		UncompressedSize:  meta.UncompressedSize,
+		OnDiskSize:        meta.OnDiskSize,
+		BloomFilterLength: meta.BloomFilterLength,
+		OffsetsLength:     meta.OffsetsLength,
+		BloomPrefixLength: meta.BloomPrefixLength,
+		PartitionSize:     meta.PartitionSize,
+	}
+	if meta.HasFilter {
+		t.filter = t.opt.filterPolicyByID(meta.FilterPolicy)
+		t.hasBloomFilter = t.filter != nil
+	}
+	t.smallest, t.biggest = meta.Smallest, meta.Biggest
+	if meta.Filter != nil && t.hasBloomFilter && t.shouldDecrypt() && t.opt.FilterCache != nil {
+		t.opt.FilterCache.Set(t.filterKey(), meta.Filter, int64(len(meta.Filter)))
+	}
+	return true
+}
+
+// Encode appends the encoding of m to dst.
+func (m *Meta) Encode(dst []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		dst = append(dst, buf[:binary.PutUvarint(buf[:], v)]...)
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		dst = append(dst, b...)
+	}
+	putUvarint(m.ID)
+	putUvarint(uint64(m.Size))
+	putBytes(m.IndexChecksum)
+	putUvarint(uint64(m.IndexLen))
+	putBytes(m.Smallest)
+	putBytes(m.Biggest)
+	putUvarint(m.MaxVersion)
+	putUvarint(uint64(m.KeyCount))
+	putUvarint(uint64(m.UncompressedSize))
+	putUvarint(uint64(m.OnDiskSize))
+	putUvarint(uint64(m.BloomFilterLength))
+	putUvarint(uint64(m.OffsetsLength))
+	putUvarint(uint64(m.BloomPrefixLength))
+	putUvarint(uint64(m.PartitionSize))
+	putUvarint(uint64(m.FilterPolicy))
+	if m.HasFilter {
+		putUvarint(1)
+	} else {
+		putUvarint(0)
+	}
+	putBytes(m.Filter)
+	return dst
+}
+
+// DecodeMeta decodes a Meta encoded by Meta.Encode at the start of data. It returns the Meta and
+// the rest of data.
+func DecodeMeta(data []byte) (*Meta, []byte, error) {
+	var err error
+	uvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = errors.New("invalid table meta")
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+	bytes := func() []byte {
+		sz := uvarint()
+		if err != nil {
+			return nil
+		}
+		if sz > uint64(len(data)) {
+			err = errors.New("invalid table meta")
+			return nil
+		}
+		if sz == 0 {
+			return nil
+		}
+		b := data[:sz:sz]
+		data = data[sz:]
+		return b
+	}
+	m := &Meta{
+		ID:                uvarint(),
+		Size:              int64(uvarint()),
+		IndexChecksum:     bytes(),
+		IndexLen:          int(uvarint()),
+		Smallest:          bytes(),
+		Biggest:           bytes(),
+		MaxVersion:        uvarint(),
+		KeyCount:          uint32(uvarint()),
+		UncompressedSize:  uint32(uvarint()),
+		OnDiskSize:        uint32(uvarint()),
+		BloomFilterLength: int(uvarint()),
+		OffsetsLength:     int(uvarint()),
+		BloomPrefixLength: int(uvarint()),
+		PartitionSize:     int(uvarint()),
+		FilterPolicy:      uint8(uvarint()),
+		HasFilter:         uvarint() == 1,
+		Filter:            bytes(),
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, data, nil
+}
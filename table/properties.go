@@ -0,0 +1,78 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// TablePropertiesCollector collects custom properties of a table while it is being built. The
+// properties are stored in the table index and can be read via Table.Properties.
+type TablePropertiesCollector interface {
+	// Add is called for every key added to the table, in the order of the keys. key doesn't have
+	// the version. If the value is stored in the value log, value.Value is the encoded value
+	// pointer and value.Meta has the value pointer bit set.
+	Add(key []byte, version uint64, value y.ValueStruct)
+	// Finish returns the properties of the table. It is called once all the keys are added. If
+	// multiple collectors return a property with the same name, the one returned by the last
+	// collector is stored.
+	Finish() map[string][]byte
+}
+
+// TablePropertiesCollectorFactory returns a new collector for every table built.
+type TablePropertiesCollectorFactory func() TablePropertiesCollector
+
+// encodeProperties returns the properties of all the collectors, encoded as a KVList.
+func encodeProperties(collectors []TablePropertiesCollector) ([]byte, error) {
+	props := make(map[string][]byte)
+	for _, c := range collectors {
+		for name, val := range c.Finish() {
+			props[name] = val
+		}
+	}
+	list := &pb.KVList{}
+	for name, val := range props {
+		list.Kv = append(list.Kv, &pb.KV{Key: []byte(name), Value: val})
+	}
+	// Sort the properties, so the same properties are always encoded the same way.
+	sort.Slice(list.Kv, func(i, j int) bool {
+		return bytes.Compare(list.Kv[i].Key, list.Kv[j].Key) < 0
+	})
+	return list.Marshal()
+}
+
+// Properties returns the custom properties stored in the table by the properties collectors. It
+// returns nil if the table has none.
+func (t *Table) Properties() (map[string][]byte, error) {
+	data := t.fetchIndex().PropertiesBytes()
+	if len(data) == 0 {
+		return nil, nil
+	}
+	list := &pb.KVList{}
+	if err := list.Unmarshal(data); err != nil {
+		return nil, y.Wrapf(err, "while reading properties of table: %s", t.Filename())
+	}
+	props := make(map[string][]byte, len(list.Kv))
+	for _, kv := range list.Kv {
+		props[string(kv.Key)] = kv.Value
+	}
+	return props, nil
+}
@@ -21,9 +21,12 @@ import (
 	"crypto/aes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -61,38 +64,111 @@ type Options struct {
 	// ChkMode is the checksum verification mode for Table.
 	ChkMode options.ChecksumVerificationMode
 
+	// ChecksumAlgorithm is the algorithm used for the checksums of the blocks. The index is
+	// always checksummed with CRC32C.
+	ChecksumAlgorithm options.ChecksumAlgorithm
+
 	// Options for Table builder.
 
 	// BloomFalsePositive is the false positive probabiltiy of bloom filter.
 	BloomFalsePositive float64
 
+	// FilterPolicy builds the filters of the tables. Bloom filters are used if it is nil. Tables
+	// are always read with the policy they were built with.
+	FilterPolicy FilterPolicy
+
+	// PropertiesCollectors create the collectors of the custom properties stored in the tables.
+	PropertiesCollectors []TablePropertiesCollectorFactory
+
+	// BloomPrefixLength, if greater than zero, adds the first BloomPrefixLength bytes of every
+	// key to the bloom filter as well, so prefix iterations can skip the tables which don't have
+	// the prefix.
+	BloomPrefixLength int
+
 	// BlockSize is the size of each block inside SSTable in bytes.
 	BlockSize int
 
+	// IndexPartitionSize is the number of block offsets stored in each partition of the index.
+	// If a table has more blocks than this, its block offsets are split into partitions which
+	// are loaded on demand, and only the index of partitions is kept in memory. Zero disables
+	// partitioning.
+	IndexPartitionSize int
+
 	// DataKey is the key used to decrypt the encrypted text.
 	DataKey *pb.DataKey
 
 	// Compression indicates the compression algorithm used for block compression.
 	Compression options.CompressionType
 
+	// EncryptionMode indicates how the blocks and the index are encrypted with the DataKey.
+	EncryptionMode options.EncryptionMode
+
+	// TableID is the ID of the table being built. With AES-GCM, it's authenticated with every
+	// block, so it must match the ID the table is opened with.
+	TableID uint64
+
 	// Block cache is used to cache decompressed and decrypted blocks.
 	BlockCache *ristretto.Cache
 	IndexCache *ristretto.Cache
+	// CompressedBlockCache is used to cache compressed blocks, after decryption. On a block cache
+	// miss, the block is decompressed from it instead of being read from the file.
+	CompressedBlockCache *ristretto.Cache
+	// FilterCache is used to cache the bloom filters of encrypted tables. If it is nil, the
+	// filters are read from the index.
+	FilterCache *ristretto.Cache
 
 	AllocPool *z.AllocatorPool
+	// ArenaPool, if set, is used instead of AllocPool for the allocators of the table builders.
+	ArenaPool *ArenaPool
+
+	// IOBackend, if set, is used to read the blocks instead of the mmap'ed file.
+	IOBackend y.IOBackend
+
+	// DirectIO makes CreateTable write the table with O_DIRECT, bypassing the page cache.
+	DirectIO bool
+
+	// FS is the file system the table files are in. The file system of the OS is used if it is
+	// nil.
+	FS y.FS
 
 	// ZSTDCompressionLevel is the ZSTD compression level used for compressing blocks.
 	ZSTDCompressionLevel int
 }
 
+// fs returns the file system the table files are in.
+func (opts *Options) fs() y.FS {
+	if opts.FS == nil {
+		return y.OSFS
+	}
+	return opts.FS
+}
+
 // TableInterface is useful for testing.
 type TableInterface interface {
 	Smallest() []byte
 	Biggest() []byte
 	DoesNotHave(hash uint32) bool
+	DoesNotHavePrefix(prefix []byte) bool
 	MaxVersion() uint64
 }
 
+// CorruptError is the error of the corrupt data found in the file Path of a table, at Offset. The
+// DB returns it as an Error derived from badger.ErrCorruptFile.
+type CorruptError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("corrupt data in table %s at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+// Unwrap returns the error describing the corrupt data.
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
 // Table represents a loaded table file with the info we have about it.
 type Table struct {
 	sync.Mutex
@@ -112,12 +188,30 @@ type Table struct {
 	CreatedAt      time.Time
 	indexStart     int
 	indexLen       int
+	indexChecksum  []byte // The marshaled checksum of the index, as stored in the footer.
 	hasBloomFilter bool
+	filter         FilterPolicy // Policy that built the bloom filter of this table.
 
-	IsInmemory bool // Set to true if the table is on level 0 and opened in memory.
+	IsInmemory bool          // Set to true if the table is opened in memory.
+	file       y.BackendFile // Reads the blocks if Options.IOBackend is set, or the table is remote.
+	remote     RemoteFile    // The copy of the table in object storage, if the table is remote.
 	opt        *Options
 }
 
+// RemoteFile is the copy of a table file kept in object storage. The data blocks of a remote table
+// are only there: its local file has the size of the table, but the blocks are a hole in it, and
+// only the index is written.
+type RemoteFile interface {
+	// ReadAt reads len(buf) bytes of the file at off.
+	ReadAt(buf []byte, off int64) error
+	// Create creates the file with the data written by wt.
+	Create(wt io.WriterTo) error
+	// Delete deletes the file.
+	Delete() error
+	// URL returns the URL of the file.
+	URL() string
+}
+
 type cheapIndex struct {
 	MaxVersion        uint64
 	KeyCount          uint32
@@ -125,6 +219,11 @@ type cheapIndex struct {
 	OnDiskSize        uint32
 	BloomFilterLength int
 	OffsetsLength     int
+	// BloomPrefixLength is the length of the key prefixes added to the bloom filter.
+	BloomPrefixLength int
+	// PartitionSize is the number of block offsets in each index partition. It is zero if the
+	// index is not partitioned, in which case the block offsets are stored in the index itself.
+	PartitionSize int
 }
 
 func (t *Table) cheapIndex() *cheapIndex {
@@ -154,6 +253,11 @@ func (t *Table) CompressionType() options.CompressionType {
 	return t.opt.Compression
 }
 
+// EncryptionMode returns how the blocks and the index of the table are encrypted.
+func (t *Table) EncryptionMode() options.EncryptionMode {
+	return t.opt.EncryptionMode
+}
+
 // IncrRef increments the refcount (having to do with whether the file should be deleted)
 func (t *Table) IncrRef() {
 	atomic.AddInt32(&t.ref, 1)
@@ -169,6 +273,19 @@ func (t *Table) DecrRef() error {
 		// Delete all blocks from the cache.
 		for i := 0; i < t.offsetsLength(); i++ {
 			t.opt.BlockCache.Del(t.blockCacheKey(i))
+			t.opt.CompressedBlockCache.Del(t.blockCacheKey(i))
+		}
+		t.opt.FilterCache.Del(t.filterKey())
+		// Delete the index partitions from the cache. They are only cached if the table is
+		// encrypted.
+		if ps := t.cheapIndex().PartitionSize; ps > 0 {
+			for i := 0; i*ps < t.offsetsLength(); i++ {
+				t.opt.IndexCache.Del(t.partitionKey(i))
+			}
+		}
+		if t.opt.ReadOnly {
+			// The file belongs to the process which opened the DB read-write.
+			return t.Close(-1)
 		}
 		if err := t.Delete(); err != nil {
 			return err
@@ -177,6 +294,18 @@ func (t *Table) DecrRef() error {
 	return nil
 }
 
+// Delete removes the table file, and its copy in object storage if the table is remote. The file
+// isn't truncated, so that it can still be read by a DB opened in Secondary mode which has it open.
+func (t *Table) Delete() error {
+	if err := y.DeleteMmapFile(t.opt.fs(), t.MmapFile); err != nil {
+		return err
+	}
+	if t.remote != nil {
+		return t.remote.Delete()
+	}
+	return nil
+}
+
 // BlockEvictHandler is used to reuse the byte slice stored in the block on cache eviction.
 func BlockEvictHandler(value interface{}) {
 	if b, ok := value.(*block); ok {
@@ -193,6 +322,7 @@ type block struct {
 	chkLen            int      // checksum length.
 	freeMe            bool     // used to determine if the blocked should be reused.
 	ref               int32
+	verified          int32 // Set to 1 once the checksum is verified. Atomic.
 }
 
 var NumBlocks int32
@@ -247,17 +377,31 @@ func (b *block) size() int64 {
 		cap(b.data) + cap(b.checksum) + cap(b.entryOffsets)*4)
 }
 
-func (b block) verifyCheckSum() error {
+func (b *block) verifyCheckSum() error {
+	// Blocks built with NoChecksum have nothing to verify.
+	if len(b.checksum) == 0 {
+		return nil
+	}
 	cs := &pb.Checksum{}
 	if err := proto.Unmarshal(b.checksum, cs); err != nil {
 		return y.Wrapf(err, "unable to unmarshal checksum for block")
 	}
-	return y.VerifyChecksum(b.data, cs)
+	if err := y.VerifyChecksum(b.data, cs); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&b.verified, 1)
+	return nil
 }
 
 func CreateTable(fname string, builder *Builder) (*Table, error) {
+	if err := checkTableID(fname, builder.opts); err != nil {
+		return nil, err
+	}
 	bd := builder.Done()
-	mf, err := newFile(fname, bd.Size)
+	if builder.opts.DirectIO {
+		return createTableDirect(fname, &bd, *builder.opts)
+	}
+	mf, err := newFile(builder.opts.fs(), fname, bd.Size)
 	if err != nil {
 		return nil, err
 	}
@@ -270,8 +414,45 @@ func CreateTable(fname string, builder *Builder) (*Table, error) {
 	return OpenTable(mf, *builder.opts)
 }
 
-func newFile(fname string, sz int) (*z.MmapFile, error) {
-	mf, err := z.OpenMmapFile(fname, os.O_CREATE|os.O_RDWR|os.O_EXCL, sz)
+// CreateRemoteTable writes the table built by builder to rf, and then writes the local file of the
+// table at fname, without the data blocks. The blocks of the table are read from rf.
+func CreateRemoteTable(fname string, builder *Builder, rf RemoteFile) (*Table, error) {
+	if err := checkTableID(fname, builder.opts); err != nil {
+		return nil, err
+	}
+	bd := builder.Done()
+	if err := rf.Create(&bd); err != nil {
+		return nil, y.Wrapf(err, "while uploading table to %s", rf.URL())
+	}
+	mf, err := newFile(builder.opts.fs(), fname, bd.Size)
+	if err != nil {
+		_ = rf.Delete()
+		return nil, err
+	}
+	// The blocks aren't written, so that they don't take up space on disk.
+	written := bd.dataSize()
+	written += bd.copyIndex(mf.Data[written:])
+	y.AssertTrue(written == len(mf.Data))
+	if err := z.Msync(mf.Data); err != nil {
+		return nil, y.Wrapf(err, "while calling msync on %s", fname)
+	}
+	return openTable(mf, rf, nil, *builder.opts)
+}
+
+// checkTableID returns an error if a table built with opts can't be opened as fname, because its
+// AES-GCM additional data was built with another table ID.
+func checkTableID(fname string, opts *Options) error {
+	if opts.DataKey == nil || opts.EncryptionMode != options.AESGCM {
+		return nil
+	}
+	if id, ok := ParseFileID(fname); !ok || id != opts.TableID {
+		return errors.Errorf("table ID %d doesn't match the file name: %s", opts.TableID, fname)
+	}
+	return nil
+}
+
+func newFile(fs y.FS, fname string, sz int) (*z.MmapFile, error) {
+	mf, err := y.OpenMmapFile(fs, fname, os.O_CREATE|os.O_RDWR|os.O_EXCL, sz)
 	if err == z.NewFile {
 		// Expected.
 	} else if err != nil {
@@ -282,8 +463,35 @@ func newFile(fname string, sz int) (*z.MmapFile, error) {
 	return mf, nil
 }
 
+// createTableDirect writes the table with O_DIRECT, so that it doesn't fill the page cache, and
+// then mmaps it.
+func createTableDirect(fname string, bd *buildData, opts Options) (*Table, error) {
+	fd, err := y.OpenDirectFile(opts.fs(), fname, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, y.Wrapf(err, "while creating table: %s", fname)
+	}
+	w := y.NewDirectWriter(fd, 1<<20)
+	written, err := bd.WriteTo(w)
+	if err == nil {
+		y.AssertTrue(written == int64(bd.Size))
+		err = w.Finish()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, y.Wrapf(err, "while writing table: %s", fname)
+	}
+
+	mf, err := y.OpenMmapFile(opts.fs(), fname, os.O_RDWR, 0)
+	if err != nil {
+		return nil, y.Wrapf(err, "while opening table: %s", fname)
+	}
+	return OpenTable(mf, opts)
+}
+
 func CreateTableFromBuffer(fname string, buf []byte, opts Options) (*Table, error) {
-	mf, err := newFile(fname, len(buf))
+	mf, err := newFile(opts.fs(), fname, len(buf))
 	if err != nil {
 		return nil, err
 	}
@@ -302,6 +510,16 @@ func CreateTableFromBuffer(fname string, buf []byte, opts Options) (*Table, erro
 // -- consider t.Close() instead). The fd has to writeable because we call Truncate on it before
 // deleting. Checksum for all blocks of table is verified based on value of chkMode.
 func OpenTable(mf *z.MmapFile, opts Options) (*Table, error) {
+	return openTable(mf, nil, nil, opts)
+}
+
+// OpenRemoteTable is like OpenTable, but opens a remote table, whose data blocks are read from rf
+// instead of the local file mf.
+func OpenRemoteTable(mf *z.MmapFile, rf RemoteFile, opts Options) (*Table, error) {
+	return openTable(mf, rf, nil, opts)
+}
+
+func openTable(mf *z.MmapFile, rf RemoteFile, meta *Meta, opts Options) (*Table, error) {
 	// BlockSize is used to compute the approximate size of the decompressed
 	// block. It should not be zero if the table is compressed.
 	if opts.BlockSize == 0 && opts.Compression != options.None {
@@ -328,9 +546,17 @@ func OpenTable(mf *z.MmapFile, opts Options) (*Table, error) {
 		tableSize:  int(fileInfo.Size()),
 		CreatedAt:  fileInfo.ModTime(),
 	}
+	if rf != nil {
+		t.remote = rf
+		t.file = rf
+	} else if opts.IOBackend != nil {
+		t.file = opts.IOBackend.NewFile(mf.Fd)
+	}
 
-	if err := t.initBiggestAndSmallest(); err != nil {
-		return nil, y.Wrapf(err, "failed to initialize table")
+	if meta == nil || !t.initFromMeta(meta) {
+		if err := t.initBiggestAndSmallest(); err != nil {
+			return nil, y.Wrapf(err, "failed to initialize table")
+		}
 	}
 
 	if opts.ChkMode == options.OnTableRead || opts.ChkMode == options.OnTableAndBlockRead {
@@ -442,43 +668,71 @@ func (t *Table) read(off, sz int) ([]byte, error) {
 	return t.Bytes(off, sz)
 }
 
+// readBlock reads the block data at off, via the IO backend if there's one.
+func (t *Table) readBlock(off, sz int) ([]byte, error) {
+	if t.file == nil {
+		return t.read(off, sz)
+	}
+	buf := make([]byte, sz)
+	if err := t.file.ReadAt(buf, int64(off)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func (t *Table) readNoFail(off, sz int) []byte {
 	res, err := t.read(off, sz)
 	y.Check(err)
 	return res
 }
 
-// initIndex reads the index and populate the necessary table fields and returns
-// first block offset
-func (t *Table) initIndex() (*fb.BlockOffset, error) {
+// readFooter reads the footer of the table, and sets the position and the length of its index. It
+// returns the marshaled checksum of the index.
+func (t *Table) readFooter() ([]byte, error) {
 	readPos := t.tableSize
 
 	// Read checksum len from the last 4 bytes.
 	readPos -= 4
+	if readPos < 0 {
+		return nil, t.corruptError(0, errors.New("table too small. Data corrupted"))
+	}
 	buf := t.readNoFail(readPos, 4)
 	checksumLen := int(y.BytesToU32(buf))
-	if checksumLen < 0 {
-		return nil, errors.New("checksum length less than zero. Data corrupted")
+	if checksumLen < 0 || checksumLen > readPos-4 {
+		return nil, t.corruptError(readPos,
+			errors.New("invalid checksum length. Data corrupted"))
 	}
 
 	// Read checksum.
-	expectedChk := &pb.Checksum{}
 	readPos -= checksumLen
-	buf = t.readNoFail(readPos, checksumLen)
-	if err := proto.Unmarshal(buf, expectedChk); err != nil {
-		return nil, err
-	}
+	checksum := t.readNoFail(readPos, checksumLen)
 
 	// Read index size from the footer.
 	readPos -= 4
 	buf = t.readNoFail(readPos, 4)
 	t.indexLen = int(y.BytesToU32(buf))
+	if t.indexLen < 0 || t.indexLen > readPos {
+		return nil, t.corruptError(readPos, errors.New("invalid index length. Data corrupted"))
+	}
+	t.indexStart = readPos - t.indexLen
+	return checksum, nil
+}
 
-	// Read index.
-	readPos -= t.indexLen
-	t.indexStart = readPos
-	data := t.readNoFail(readPos, t.indexLen)
+// initIndex reads the index and populate the necessary table fields and returns
+// first block offset
+func (t *Table) initIndex() (*fb.BlockOffset, error) {
+	checksum, err := t.readFooter()
+	if err != nil {
+		return nil, err
+	}
+	expectedChk := &pb.Checksum{}
+	if err := proto.Unmarshal(checksum, expectedChk); err != nil {
+		return nil, err
+	}
+	t.indexChecksum = checksum
 
+	// Read index.
+	data := t.readNoFail(t.indexStart, t.indexLen)
 	if err := y.VerifyChecksum(data, expectedChk); err != nil {
 		return nil, y.Wrapf(err, "failed to verify checksum for table: %s", t.Filename())
 	}
@@ -498,16 +752,25 @@ func (t *Table) initIndex() (*fb.BlockOffset, error) {
 		OnDiskSize:        index.OnDiskSize(),
 		OffsetsLength:     index.OffsetsLength(),
 		BloomFilterLength: index.BloomFilterLength(),
+		PartitionSize:     int(index.PartitionSize()),
+		BloomPrefixLength: int(index.BloomPrefixLength()),
+	}
+	if t._cheap.PartitionSize > 0 {
+		t._cheap.OffsetsLength = int(index.NumBlocks())
 	}
 
-	t.hasBloomFilter = len(index.BloomFilterBytes()) > 0
+	// Tables with a filter built by an unknown policy are treated as having no filter.
+	t.filter = t.opt.filterPolicyByID(index.FilterPolicy())
+	t.hasBloomFilter = len(index.BloomFilterBytes()) > 0 && t.filter != nil
 
+	// The key of the first partition is the base key of the first block.
 	var bo fb.BlockOffset
 	y.AssertTrue(index.Offsets(&bo, 0))
 	return &bo, nil
 }
 
-// KeySplits splits the table into at least n ranges based on the block offsets.
+// KeySplits splits the table into at least n ranges based on the block offsets. The splits are
+// only hints, so it stops at the first block offset it fails to read.
 func (t *Table) KeySplits(n int, prefix []byte) []string {
 	if n == 0 {
 		return nil
@@ -525,7 +788,9 @@ func (t *Table) KeySplits(n int, prefix []byte) []string {
 		if i >= oLen {
 			i = oLen - 1
 		}
-		y.AssertTrue(t.offsets(&bo, i))
+		if err := t.offsets(&bo, i); err != nil {
+			break
+		}
 		if bytes.HasPrefix(bo.KeyBytes(), prefix) {
 			res = append(res, string(bo.KeyBytes()))
 		}
@@ -533,6 +798,95 @@ func (t *Table) KeySplits(n int, prefix []byte) []string {
 	return res
 }
 
+// prefixBlocks returns the range [lo, hi) of the blocks which may hold keys with prefix. All the
+// blocks may hold keys with an empty prefix.
+func (t *Table) prefixBlocks(prefix []byte) (int, int, error) {
+	n := t.offsetsLength()
+	if len(prefix) == 0 {
+		return 0, n, nil
+	}
+	var bo fb.BlockOffset
+	var err error
+	search := func(f func(key []byte) bool) int {
+		return sort.Search(n, func(i int) bool {
+			if err != nil {
+				return false
+			}
+			if err = t.offsets(&bo, i); err != nil {
+				return false
+			}
+			return f(y.ParseKey(bo.KeyBytes()))
+		})
+	}
+	// The keys with prefix start in the block before the first one starting at or after prefix,
+	// and end before the first block starting after them.
+	lo := search(func(key []byte) bool { return bytes.Compare(key, prefix) >= 0 })
+	if lo > 0 {
+		lo--
+	}
+	hi := search(func(key []byte) bool {
+		return bytes.Compare(key, prefix) > 0 && !bytes.HasPrefix(key, prefix)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi, nil
+}
+
+// PrefixKeyCount estimates the number of keys of the table with prefix, from the number of its
+// blocks which may hold them.
+func (t *Table) PrefixKeyCount(prefix []byte) (uint32, error) {
+	lo, hi, err := t.prefixBlocks(prefix)
+	if err != nil || lo == hi {
+		return 0, err
+	}
+	n := uint64(t.KeyCount()) * uint64(hi-lo) / uint64(t.offsetsLength())
+	if n == 0 {
+		n = 1
+	}
+	return uint32(n), nil
+}
+
+// RandomEntry returns an entry of the table with prefix, picked with r: a block is picked
+// uniformly among the blocks which may hold keys with prefix, and an entry of the block. The
+// blocks have about the same size, so the entries of the blocks with smaller values are less
+// likely to be picked. If the entry picked doesn't have prefix, which only happens in the first
+// and the last of the blocks, the key returned is nil, and another entry should be picked. The key
+// and the value are copies.
+func (t *Table) RandomEntry(r *rand.Rand, prefix []byte) ([]byte, y.ValueStruct, error) {
+	if t.offsetsLength() == 0 {
+		return nil, y.ValueStruct{}, errors.New("Table has no blocks")
+	}
+	lo, hi, err := t.prefixBlocks(prefix)
+	if err != nil || lo == hi {
+		return nil, y.ValueStruct{}, err
+	}
+	idx := lo + r.Intn(hi-lo)
+	b, err := t.block(idx, false)
+	if err != nil {
+		return nil, y.ValueStruct{}, y.Wrapf(err, "while reading block %d of table %d", idx, t.id)
+	}
+	bi := &blockIterator{tableID: t.id, blockID: idx}
+	bi.setBlock(b)
+	defer bi.Close()
+	if len(bi.entryOffsets) == 0 {
+		return nil, y.ValueStruct{}, errors.Errorf("Block %d of table %d is empty", idx, t.id)
+	}
+	bi.setIdx(r.Intn(len(bi.entryOffsets)))
+	if bi.err != nil {
+		return nil, y.ValueStruct{}, bi.err
+	}
+	if !bytes.HasPrefix(y.ParseKey(bi.key), prefix) {
+		return nil, y.ValueStruct{}, nil
+	}
+	var vs y.ValueStruct
+	vs.Decode(y.Copy(bi.val))
+	return y.Copy(bi.key), vs, nil
+}
+
 func (t *Table) fetchIndex() *fb.TableIndex {
 	if !t.shouldDecrypt() {
 		return t._index
@@ -551,14 +905,118 @@ func (t *Table) fetchIndex() *fb.TableIndex {
 	return index
 }
 
-func (t *Table) offsets(ko *fb.BlockOffset, i int) bool {
-	return t.fetchIndex().Offsets(ko, i)
+// fetchFilter returns the bloom filter of the table. Like the index, it points to the mmap'ed
+// buffer if there's no encryption. Otherwise, it is copied out of the decrypted index and stored
+// in the filter cache, if there is one.
+func (t *Table) fetchFilter() []byte {
+	if !t.shouldDecrypt() || t.opt.FilterCache == nil {
+		return t.fetchIndex().BloomFilterBytes()
+	}
+	if val, ok := t.opt.FilterCache.Get(t.filterKey()); ok && val != nil {
+		return val.([]byte)
+	}
+
+	filter := y.Copy(t.fetchIndex().BloomFilterBytes())
+	t.opt.FilterCache.Set(t.filterKey(), filter, int64(len(filter)))
+	return filter
+}
+
+// offsets reads the block offset of block i into ko. It fails if i is out of range, or if the
+// index partition holding the block offset can't be read.
+func (t *Table) offsets(ko *fb.BlockOffset, i int) error {
+	var ok bool
+	if ps := t.cheapIndex().PartitionSize; ps == 0 {
+		ok = t.fetchIndex().Offsets(ko, i)
+	} else if i >= 0 && i < t.offsetsLength() {
+		partition, err := t.fetchPartition(i / ps)
+		if err != nil {
+			return err
+		}
+		ok = partition.Offsets(ko, i%ps)
+	}
+	if !ok {
+		return errors.Errorf("block %d out of index in table: %s", i, t.Filename())
+	}
+	return nil
+}
+
+// fetchPartition returns the index partition holding the block offsets of blocks
+// [idx*PartitionSize, (idx+1)*PartitionSize). Like the index, a partition points to the mmap'ed
+// buffer if there's no encryption. Otherwise, it is decrypted and stored in the index cache.
+func (t *Table) fetchPartition(idx int) (*fb.TableIndex, error) {
+	if !t.shouldDecrypt() {
+		return t.readPartition(idx, false)
+	}
+
+	if t.opt.IndexCache == nil {
+		panic("Index Cache must be set for encrypted workloads")
+	}
+	key := t.partitionKey(idx)
+	if val, ok := t.opt.IndexCache.Get(key); ok && val != nil {
+		return val.(*fb.TableIndex), nil
+	}
+
+	partition, err := t.readPartition(idx, false)
+	if err != nil {
+		return nil, err
+	}
+	t.opt.IndexCache.Set(key, partition, int64(len(partition.Table().Bytes)))
+	return partition, nil
+}
+
+// readPartition reads the index partition at idx from the sst, verifying its checksum if
+// verify is true.
+func (t *Table) readPartition(idx int, verify bool) (*fb.TableIndex, error) {
+	var po fb.BlockOffset
+	if !t.fetchIndex().Offsets(&po, idx) {
+		return nil, errors.Errorf("index partition %d out of range in table: %s",
+			idx, t.Filename())
+	}
+	data, err := t.read(int(po.Offset()), int(po.Len()))
+	if err != nil {
+		return nil, y.Wrapf(err, "failed to read index partition %d from file: %s",
+			idx, t.Filename())
+	}
+
+	// Read checksum len from the last 4 bytes.
+	readPos := len(data) - 4
+	chkLen := int(y.BytesToU32(data[readPos:]))
+	if chkLen > readPos {
+		return nil, errors.Errorf("invalid checksum length for index partition %d in table: %s",
+			idx, t.Filename())
+	}
+	readPos -= chkLen
+	if verify {
+		cs := &pb.Checksum{}
+		if err := proto.Unmarshal(data[readPos:readPos+chkLen], cs); err != nil {
+			return nil, y.Wrapf(err, "unable to unmarshal checksum for index partition")
+		}
+		if err := y.VerifyChecksum(data[:readPos], cs); err != nil {
+			return nil, y.Wrapf(err, "failed to verify checksum for index partition %d", idx)
+		}
+	}
+	data = data[:readPos]
+
+	// Decrypt the partition if it is encrypted.
+	if t.shouldDecrypt() {
+		if data, err = t.decrypt(data, false, aeadPartition, idx); err != nil {
+			return nil, y.Wrapf(err,
+				"Error while decrypting index partition %d for the table %d", idx, t.id)
+		}
+	}
+	return fb.GetRootAsTableIndex(data, 0), nil
 }
 
 // block function return a new block. Each block holds a ref and the byte
 // slice stored in the block will be reused when the ref becomes zero. The
 // caller should release the block by calling block.decrRef() on it.
 func (t *Table) block(idx int, useCache bool) (*block, error) {
+	return t.loadBlock(idx, useCache, nil)
+}
+
+// loadBlock is like block, but reads the block data from direct instead of the table file if it
+// isn't nil. direct must be opened with y.OpenDirectFile.
+func (t *Table) loadBlock(idx int, useCache bool, direct y.File) (*block, error) {
 	y.AssertTruef(idx >= 0, "idx=%d", idx)
 	if idx >= t.offsetsLength() {
 		return nil, errors.New("block out of index")
@@ -577,7 +1035,9 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 	}
 
 	var ko fb.BlockOffset
-	y.AssertTrue(t.offsets(&ko, idx))
+	if err := t.offsets(&ko, idx); err != nil {
+		return nil, err
+	}
 	blk := &block{
 		offset: int(ko.Offset()),
 		ref:    1,
@@ -586,36 +1046,84 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 	atomic.AddInt32(&NumBlocks, 1)
 
 	var err error
-	if blk.data, err = t.read(blk.offset, int(ko.Len())); err != nil {
-		return nil, y.Wrapf(err,
-			"failed to read from file: %s at offset: %d, len: %d",
-			t.Fd.Name(), blk.offset, ko.Len())
+	if data, ok := t.compressedBlock(idx); ok {
+		// The cached block is already decrypted.
+		blk.data = data
+	} else {
+		if direct != nil {
+			blk.data, err = y.ReadDirect(direct, int64(blk.offset), int(ko.Len()))
+		} else {
+			blk.data, err = t.readBlock(blk.offset, int(ko.Len()))
+		}
+		if err != nil {
+			return nil, y.Wrapf(err,
+				"failed to read from file: %s at offset: %d, len: %d",
+				t.Fd.Name(), blk.offset, ko.Len())
+		}
+
+		if t.shouldDecrypt() {
+			// Decrypt the block if it is encrypted.
+			if blk.data, err = t.decrypt(blk.data, true, aeadBlock, idx); err != nil {
+				return nil, err
+			}
+			// blk.data is allocated via Calloc. So, do free.
+			blk.freeMe = true
+		}
+		if useCache {
+			t.setCompressedBlock(idx, blk.data)
+		}
 	}
 
-	if t.shouldDecrypt() {
-		// Decrypt the block if it is encrypted.
-		if blk.data, err = t.decrypt(blk.data, true); err != nil {
+	if err = t.decodeBlock(blk, int(ko.Len())); err != nil {
+		return nil, err
+	}
+
+	// Verify checksum on if checksum verification mode is OnRead on OnStartAndRead.
+	if t.opt.ChkMode == options.OnBlockRead || t.opt.ChkMode == options.OnTableAndBlockRead {
+		if err = blk.verifyCheckSum(); err != nil {
 			return nil, err
 		}
-		// blk.data is allocated via Calloc. So, do free.
-		blk.freeMe = true
 	}
 
-	if err = t.decompress(blk); err != nil {
-		return nil, y.Wrapf(err,
+	blk.incrRef()
+	if useCache && t.opt.BlockCache != nil {
+		key := t.blockCacheKey(idx)
+		// incrRef should never return false here because we're calling it on a
+		// new block with ref=1.
+		y.AssertTrue(blk.incrRef())
+
+		// Decrement the block ref if we could not insert it in the cache.
+		if !t.opt.BlockCache.Set(key, blk, blk.size()) {
+			blk.decrRef()
+		}
+		// We have added an OnReject func in our cache, which gets called in case the block is not
+		// admitted to the cache. So, every block would be accounted for.
+	}
+	return blk, nil
+}
+
+// decodeBlock decompresses the data of blk, read from the size bytes of the table file at its
+// offset, and reads its checksum and the offsets of its entries.
+func (t *Table) decodeBlock(blk *block, size int) error {
+	if err := t.decompress(blk); err != nil {
+		return y.Wrapf(err,
 			"failed to decode compressed data in file: %s at offset: %d, len: %d",
-			t.Fd.Name(), blk.offset, ko.Len())
+			t.Fd.Name(), blk.offset, size)
 	}
 
 	// Read meta data related to block.
 	readPos := len(blk.data) - 4 // First read checksum length.
+	if readPos < 0 {
+		return t.corruptError(blk.offset,
+			errors.Errorf("block of %d bytes is too short", len(blk.data)))
+	}
 	blk.chkLen = int(y.BytesToU32(blk.data[readPos : readPos+4]))
 
 	// Checksum length greater than block size could happen if the table was compressed and
 	// it was opened with an incorrect compression algorithm (or the data was corrupted).
-	if blk.chkLen > len(blk.data) {
-		return nil, errors.New("invalid checksum length. Either the data is " +
-			"corrupted or the table options are incorrectly set")
+	if blk.chkLen > readPos-4 {
+		return t.corruptError(blk.offset, errors.New("invalid checksum length. Either the data "+
+			"is corrupted or the table options are incorrectly set"))
 	}
 
 	// Read checksum and store it
@@ -626,6 +1134,10 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 	numEntries := int(y.BytesToU32(blk.data[readPos : readPos+4]))
 	entriesIndexStart := readPos - (numEntries * 4)
 	entriesIndexEnd := entriesIndexStart + numEntries*4
+	if numEntries < 0 || entriesIndexStart < 0 {
+		return t.corruptError(blk.offset,
+			errors.Errorf("invalid number of entries %d in block", numEntries))
+	}
 
 	blk.entryOffsets = y.BytesToU32Slice(blk.data[entriesIndexStart:entriesIndexEnd])
 
@@ -634,29 +1146,38 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 	// Drop checksum and checksum length.
 	// The checksum is calculated for actual data + entry index + index length
 	blk.data = blk.data[:readPos+4]
+	return nil
+}
 
-	// Verify checksum on if checksum verification mode is OnRead on OnStartAndRead.
-	if t.opt.ChkMode == options.OnBlockRead || t.opt.ChkMode == options.OnTableAndBlockRead {
-		if err = blk.verifyCheckSum(); err != nil {
-			return nil, err
-		}
-	}
+// useCompressedBlockCache returns whether the blocks of the table are stored in the compressed
+// block cache. It's only worth it if the blocks have to be decompressed or decrypted.
+func (t *Table) useCompressedBlockCache() bool {
+	return t.opt.CompressedBlockCache != nil &&
+		(t.opt.Compression != options.None || t.shouldDecrypt())
+}
 
-	blk.incrRef()
-	if useCache && t.opt.BlockCache != nil {
-		key := t.blockCacheKey(idx)
-		// incrRef should never return false here because we're calling it on a
-		// new block with ref=1.
-		y.AssertTrue(blk.incrRef())
+// compressedBlock returns the decrypted, but still compressed, data of the block at idx from the
+// compressed block cache.
+func (t *Table) compressedBlock(idx int) ([]byte, bool) {
+	if !t.useCompressedBlockCache() {
+		return nil, false
+	}
+	val, ok := t.opt.CompressedBlockCache.Get(t.blockCacheKey(idx))
+	if !ok || val == nil {
+		return nil, false
+	}
+	return val.([]byte), true
+}
 
-		// Decrement the block ref if we could not insert it in the cache.
-		if !t.opt.BlockCache.Set(key, blk, blk.size()) {
-			blk.decrRef()
-		}
-		// We have added an OnReject func in our cache, which gets called in case the block is not
-		// admitted to the cache. So, every block would be accounted for.
+// setCompressedBlock stores a copy of the decrypted, but still compressed, data of the block at
+// idx in the compressed block cache. The data is copied, because it could point to the mmap'ed
+// buffer or get freed along with the block.
+func (t *Table) setCompressedBlock(idx int, data []byte) {
+	if !t.useCompressedBlockCache() {
+		return
 	}
-	return blk, nil
+	cp := y.Copy(data)
+	t.opt.CompressedBlockCache.Set(t.blockCacheKey(idx), cp, int64(len(cp)))
 }
 
 // blockCacheKey is used to store blocks in the block cache.
@@ -677,6 +1198,18 @@ func (t *Table) indexKey() uint64 {
 	return t.id
 }
 
+// filterKey is used to store the bloom filter in the filter cache.
+func (t *Table) filterKey() uint64 {
+	return t.id
+}
+
+// partitionKey returns the cache key for the index partition at idx. Table IDs fit in the lower
+// 32 bits, so the partitions never collide with the index itself.
+func (t *Table) partitionKey(idx int) uint64 {
+	y.AssertTrue(t.id < math.MaxUint32)
+	return uint64(idx+1)<<32 | t.id
+}
+
 // IndexSize is the size of table index in bytes.
 func (t *Table) IndexSize() int {
 	return t.indexLen
@@ -697,9 +1230,42 @@ func (t *Table) Biggest() []byte { return t.biggest }
 // Filename is NOT the file name.  Just kidding, it is.
 func (t *Table) Filename() string { return t.Fd.Name() }
 
+// corruptError returns the CorruptError of the corrupt data at off in the file of the table,
+// described by err.
+func (t *Table) corruptError(off int, err error) error {
+	var path string
+	if t.Fd != nil {
+		// The in-memory tables have no file.
+		path = t.Fd.Name()
+	}
+	return &CorruptError{Path: path, Offset: int64(off), Err: err}
+}
+
 // ID is the table's ID number (used to make the file name).
 func (t *Table) ID() uint64 { return t.id }
 
+// RemoteURL returns the URL of the copy of the table in object storage, or "" if the table isn't
+// remote.
+func (t *Table) RemoteURL() string {
+	if t.remote == nil {
+		return ""
+	}
+	return t.remote.URL()
+}
+
+// Content returns the content of the table file. The data blocks of a remote table are read from
+// object storage, while the mmap'ed file is returned for the other tables.
+func (t *Table) Content() ([]byte, error) {
+	if t.remote == nil {
+		return t.Data, nil
+	}
+	buf := make([]byte, t.tableSize)
+	if err := t.remote.ReadAt(buf, 0); err != nil {
+		return nil, y.Wrapf(err, "while reading table from %s", t.remote.URL())
+	}
+	return buf, nil
+}
+
 // DoesNotHave returns true if and only if the table does not have the key hash.
 // It does a bloom filter lookup.
 func (t *Table) DoesNotHave(hash uint32) bool {
@@ -708,15 +1274,30 @@ func (t *Table) DoesNotHave(hash uint32) bool {
 	}
 
 	y.NumLSMBloomHitsAdd(t.opt.MetricsEnabled, "DoesNotHave_ALL", 1)
-	index := t.fetchIndex()
-	bf := index.BloomFilterBytes()
-	mayContain := y.Filter(bf).MayContain(hash)
+	mayContain := t.filter.MayContain(t.fetchFilter(), hash)
 	if !mayContain {
 		y.NumLSMBloomHitsAdd(t.opt.MetricsEnabled, "DoesNotHave_HIT", 1)
 	}
 	return !mayContain
 }
 
+// DoesNotHavePrefix returns true if the table has no key with the given prefix. It does a bloom
+// filter lookup, which is only possible if the prefixes were added to the filter while building
+// the table and the given prefix is at least as long as them.
+func (t *Table) DoesNotHavePrefix(prefix []byte) bool {
+	pl := t.cheapIndex().BloomPrefixLength
+	if !t.hasBloomFilter || pl == 0 || len(prefix) < pl {
+		return false
+	}
+
+	y.NumLSMBloomHitsAdd(t.opt.MetricsEnabled, "DoesNotHavePrefix_ALL", 1)
+	mayContain := t.filter.MayContain(t.fetchFilter(), y.Hash(prefix[:pl]))
+	if !mayContain {
+		y.NumLSMBloomHitsAdd(t.opt.MetricsEnabled, "DoesNotHavePrefix_HIT", 1)
+	}
+	return !mayContain
+}
+
 // CoveredByPrefix returns true if all the keys in the table are prefixed by the given prefix.
 func (t *Table) CoveredByPrefix(prefix []byte) bool {
 	return bytes.HasPrefix(y.ParseKey(t.Biggest()), prefix) &&
@@ -729,7 +1310,7 @@ func (t *Table) readTableIndex() (*fb.TableIndex, error) {
 	var err error
 	// Decrypt the table index if it is encrypted.
 	if t.shouldDecrypt() {
-		if data, err = t.decrypt(data, false); err != nil {
+		if data, err = t.decrypt(data, false, aeadIndex, 0); err != nil {
 			return nil, y.Wrapf(err,
 				"Error while decrypting table index for the table %d in readTableIndex", t.id)
 		}
@@ -740,8 +1321,14 @@ func (t *Table) readTableIndex() (*fb.TableIndex, error) {
 // VerifyChecksum verifies checksum for all blocks of table. This function is called by
 // OpenTable() function. This function is also called inside levelsController.VerifyChecksum().
 func (t *Table) VerifyChecksum() error {
-	ti := t.fetchIndex()
-	for i := 0; i < ti.OffsetsLength(); i++ {
+	if t.cheapIndex().PartitionSize > 0 {
+		for i := 0; i < t.fetchIndex().OffsetsLength(); i++ {
+			if _, err := t.readPartition(i, true); err != nil {
+				return y.Wrapf(err, "checksum validation failed for table: %s", t.Filename())
+			}
+		}
+	}
+	for i := 0; i < t.offsetsLength(); i++ {
 		b, err := t.block(i, true)
 		if err != nil {
 			return y.Wrapf(err, "checksum validation failed for table: %s, block: %d, offset:%d",
@@ -762,6 +1349,60 @@ func (t *Table) VerifyChecksum() error {
 	return nil
 }
 
+// Scrub reads the index partitions and the blocks of the table from its file, bypassing the
+// caches, and verifies their checksums, whatever the checksum verification mode. done is called
+// with the size of every block read, and Scrub stops with the error it returns.
+func (t *Table) Scrub(done func(n int) error) error {
+	if t.cheapIndex().PartitionSize > 0 {
+		for i := 0; i < t.fetchIndex().OffsetsLength(); i++ {
+			if _, err := t.readPartition(i, true); err != nil {
+				return y.Wrapf(err, "checksum validation failed for table: %s", t.Filename())
+			}
+		}
+	}
+	for i := 0; i < t.offsetsLength(); i++ {
+		var ko fb.BlockOffset
+		if err := t.offsets(&ko, i); err != nil {
+			return err
+		}
+		if err := t.scrubBlock(i, &ko); err != nil {
+			return y.Wrapf(err, "checksum validation failed for table: %s, block: %d, offset:%d",
+				t.Filename(), i, ko.Offset())
+		}
+		if done != nil {
+			if err := done(int(ko.Len())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scrubBlock reads the block idx at ko from the table file, and verifies its checksum.
+func (t *Table) scrubBlock(idx int, ko *fb.BlockOffset) error {
+	blk := &block{
+		offset: int(ko.Offset()),
+		ref:    1,
+	}
+	defer blk.decrRef()
+	atomic.AddInt32(&NumBlocks, 1)
+
+	var err error
+	if blk.data, err = t.readBlock(blk.offset, int(ko.Len())); err != nil {
+		return err
+	}
+	if t.shouldDecrypt() {
+		if blk.data, err = t.decrypt(blk.data, true, aeadBlock, idx); err != nil {
+			return err
+		}
+		blk.freeMe = true
+	}
+	if err := t.decodeBlock(blk, int(ko.Len())); err != nil {
+		return err
+	}
+	return blk.verifyCheckSum()
+}
+
 // shouldDecrypt tells whether to decrypt or not. We decrypt only if the datakey exist
 // for the table.
 func (t *Table) shouldDecrypt() bool {
@@ -777,20 +1418,58 @@ func (t *Table) KeyID() uint64 {
 	return 0
 }
 
-// decrypt decrypts the given data. It should be called only after checking shouldDecrypt.
-func (t *Table) decrypt(data []byte, viaCalloc bool) ([]byte, error) {
+// Kinds of the encrypted parts of a table, authenticated with AES-GCM.
+const (
+	aeadBlock byte = iota
+	aeadPartition
+	aeadIndex
+)
+
+// additionalData returns the AES-GCM additional data of part idx of the given kind in the table
+// with the given ID. It binds the ciphertext to its position, so that blocks can't be swapped
+// within a table or copied into another one. Blocks are encrypted in parallel, before their
+// offsets are known, so the block index stands in for the offset. The offset of each block is
+// read from the index, which is authenticated itself.
+func additionalData(tableID uint64, kind byte, idx int) []byte {
+	ad := make([]byte, 13)
+	binary.BigEndian.PutUint64(ad, tableID)
+	ad[8] = kind
+	binary.BigEndian.PutUint32(ad[9:], uint32(idx))
+	return ad
+}
+
+// decrypt decrypts the given data. It should be called only after checking shouldDecrypt. kind
+// and idx must be the ones the data was encrypted with, see Builder.encrypt.
+func (t *Table) decrypt(data []byte, viaCalloc bool, kind byte, idx int) ([]byte, error) {
 	// Last BlockSize bytes of the data is the IV.
 	iv := data[len(data)-aes.BlockSize:]
 	// Rest all bytes are data.
 	data = data[:len(data)-aes.BlockSize]
 
+	sz := len(data)
+	if t.opt.EncryptionMode == options.AESGCM {
+		// The data ends with the authentication tag.
+		if sz < y.AEADTagSize {
+			return nil, y.Wrapf(y.ErrChecksumMismatch, "while decrypt: data too short")
+		}
+		sz -= y.AEADTagSize
+	}
 	var dst []byte
 	if viaCalloc {
-		dst = z.Calloc(len(data), "Table.Decrypt")
+		dst = z.Calloc(sz, "Table.Decrypt")
 	} else {
-		dst = make([]byte, len(data))
+		dst = make([]byte, sz)
 	}
-	if err := y.XORBlock(dst, data, t.opt.DataKey.Data, iv); err != nil {
+	var err error
+	if t.opt.EncryptionMode == options.AESGCM {
+		_, err = y.Open(dst[:0], data, additionalData(t.id, kind, idx), t.opt.DataKey.Data, iv)
+	} else {
+		err = y.XORBlock(dst, data, t.opt.DataKey.Data, iv)
+	}
+	if err != nil {
+		if viaCalloc {
+			z.Free(dst)
+		}
 		return nil, y.Wrapf(err, "while decrypt")
 	}
 	return dst, nil
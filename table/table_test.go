@@ -21,6 +21,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math/rand"
 	"os"
 	"sort"
@@ -30,7 +31,9 @@ import (
 	"time"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/dgraph-io/badger/v3/fb"
 	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto"
 	"github.com/stretchr/testify/require"
@@ -65,11 +68,12 @@ func buildTestTable(t *testing.T, prefix string, n int, opts Options) *Table {
 
 // keyValues is n by 2 where n is number of pairs.
 func buildTable(t *testing.T, keyValues [][]string, opts Options) *Table {
+	opts.TableID = uint64(rand.Uint32())
 	b := NewTableBuilder(opts)
 	defer b.Close()
 	// TODO: Add test for file garbage collection here. No files should be left after the tests here.
 
-	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
+	filename := NewFilename(opts.TableID, os.TempDir())
 
 	sort.Slice(keyValues, func(i, j int) bool {
 		return keyValues[i][0] < keyValues[j][0]
@@ -84,6 +88,54 @@ func buildTable(t *testing.T, keyValues [][]string, opts Options) *Table {
 	return tbl
 }
 
+func TestRandomEntry(t *testing.T) {
+	opts := getTestTableOptions()
+	table := buildTestTable(t, "key", 5000, opts)
+	defer table.DecrRef()
+	require.Greater(t, table.offsetsLength(), 1)
+
+	r := rand.New(rand.NewSource(1))
+	seen := make(map[string]struct{})
+	for i := 0; i < 1000; i++ {
+		k, vs, err := table.RandomEntry(r, nil)
+		require.NoError(t, err)
+		key := string(y.ParseKey(k))
+		var n int
+		_, err = fmt.Sscanf(key, "key%04d", &n)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%d", n), string(vs.Value))
+		seen[key] = struct{}{}
+	}
+	// The keys are picked from all over the table.
+	require.Greater(t, len(seen), 500)
+
+	// With a prefix, the keys are only picked from the blocks which may hold it.
+	count, err := table.PrefixKeyCount([]byte("key12"))
+	require.NoError(t, err)
+	require.InDelta(t, 100, count, 150)
+	seen = make(map[string]struct{})
+	var misses int
+	for i := 0; i < 1000; i++ {
+		k, _, err := table.RandomEntry(r, []byte("key12"))
+		require.NoError(t, err)
+		if k == nil {
+			misses++
+			continue
+		}
+		require.True(t, bytes.HasPrefix(y.ParseKey(k), []byte("key12")))
+		seen[string(k)] = struct{}{}
+	}
+	require.Less(t, misses, 900)
+	require.Greater(t, len(seen), 50)
+
+	count, err = table.PrefixKeyCount([]byte("aaa"))
+	require.NoError(t, err)
+	require.Zero(t, count)
+	k, _, err := table.RandomEntry(r, []byte("aaa"))
+	require.NoError(t, err)
+	require.Nil(t, k)
+}
+
 func TestTableIterator(t *testing.T) {
 	for _, n := range []int{99, 100, 101} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
@@ -212,6 +264,50 @@ func TestSeekForPrev(t *testing.T) {
 	}
 }
 
+func TestIteratorBounds(t *testing.T) {
+	opts := getTestTableOptions()
+	table := buildTestTable(t, "k", 10000, opts)
+	defer table.DecrRef()
+
+	collect := func(it *Iterator) []string {
+		var out []string
+		for ; it.Valid(); it.Next() {
+			out = append(out, string(y.ParseKey(it.Key())))
+		}
+		return out
+	}
+
+	it := table.NewIterator(0)
+	defer it.Close()
+	it.SetBounds([]byte("k1000"), []byte("k1003"))
+	it.Rewind()
+	require.Equal(t, []string{"k1000", "k1001", "k1002"}, collect(it))
+	it.Seek(y.KeyWithTs([]byte("a"), 0))
+	require.Equal(t, []string{"k1000", "k1001", "k1002"}, collect(it))
+	it.Seek(y.KeyWithTs([]byte("k1002"), 0))
+	require.Equal(t, []string{"k1002"}, collect(it))
+	it.Seek(y.KeyWithTs([]byte("k1003"), 0))
+	require.False(t, it.Valid())
+
+	rit := table.NewIterator(REVERSED)
+	defer rit.Close()
+	rit.SetBounds([]byte("k1000"), []byte("k1003"))
+	rit.Rewind()
+	require.Equal(t, []string{"k1002", "k1001", "k1000"}, collect(rit))
+	rit.Seek(y.KeyWithTs([]byte("z"), 0))
+	require.Equal(t, []string{"k1002", "k1001", "k1000"}, collect(rit))
+	rit.Seek(y.KeyWithTs([]byte("k0999"), 0))
+	require.False(t, rit.Valid())
+
+	// An open side iterates up to the end of the table.
+	it.SetBounds([]byte("k9998"), nil)
+	it.Rewind()
+	require.Equal(t, []string{"k9998", "k9999"}, collect(it))
+	rit.SetBounds(nil, []byte("k0002"))
+	rit.Rewind()
+	require.Equal(t, []string{"k0001", "k0000"}, collect(rit))
+}
+
 func TestIterateFromStart(t *testing.T) {
 	// Vary the number of elements added.
 	for _, n := range []int{99, 100, 101, 199, 200, 250, 9999, 10000} {
@@ -454,6 +550,17 @@ func TestConcatIterator(t *testing.T) {
 		vs = it.Value()
 		require.EqualValues(t, "9999", string(vs.Value))
 	}
+	{
+		// The bounds are passed on to the iterators of all the tables.
+		it := NewConcatIterator([]*Table{tbl, tbl2, tbl3}, 0)
+		defer it.Close()
+		it.SetBounds([]byte("keya9999"), []byte("keyb0001"))
+		var keys []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(y.ParseKey(it.Key())))
+		}
+		require.Equal(t, []string{"keya9999", "keyb0000"}, keys)
+	}
 }
 
 func TestMergingIterator(t *testing.T) {
@@ -694,6 +801,152 @@ func TestTableChecksum(t *testing.T) {
 	})
 }
 
+func TestBlockChecksumAlgorithm(t *testing.T) {
+	// corrupt flips a byte of a value in the first block of the table.
+	corrupt := func(t *testing.T, tbl *Table) {
+		idx := bytes.Index(tbl.Data, []byte("value0000"))
+		require.Greater(t, idx, 0)
+		tbl.Data[idx] = 'V'
+	}
+	build := func(t *testing.T, algo options.ChecksumAlgorithm) *Table {
+		kvs := make([][]string, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			kvs = append(kvs, []string{key("key", i), fmt.Sprintf("value%04d", i)})
+		}
+		opts := Options{BlockSize: 4 << 10, BloomFalsePositive: 0.01, ChecksumAlgorithm: algo}
+		return buildTable(t, kvs, opts)
+	}
+
+	for _, algo := range []options.ChecksumAlgorithm{options.CRC32C, options.XXHash64} {
+		tbl := build(t, algo)
+		require.NoError(t, tbl.VerifyChecksum())
+		corrupt(t, tbl)
+		require.Error(t, tbl.VerifyChecksum())
+		require.NoError(t, tbl.DecrRef())
+	}
+
+	// Blocks without checksums are never verified.
+	tbl := build(t, options.NoChecksum)
+	defer tbl.DecrRef()
+	corrupt(t, tbl)
+	require.NoError(t, tbl.VerifyChecksum())
+	b, err := tbl.block(0, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, b.chkLen)
+	b.decrRef()
+}
+
+func TestAuthenticatedEncryption(t *testing.T) {
+	build := func(t *testing.T, mode options.EncryptionMode) *Table {
+		kvs := make([][]string, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			kvs = append(kvs, []string{key("key", i), fmt.Sprintf("value%04d", i)})
+		}
+		dk := make([]byte, 32)
+		_, err := rand.Read(dk)
+		require.NoError(t, err)
+		cache, err := ristretto.NewCache(&cacheConfig)
+		require.NoError(t, err)
+		opts := Options{BlockSize: 4 << 10, BloomFalsePositive: 0.01,
+			ChecksumAlgorithm: options.NoChecksum, DataKey: &pb.DataKey{Data: dk},
+			EncryptionMode: mode, IndexCache: cache}
+		tbl := buildTable(t, kvs, opts)
+		require.Equal(t, mode, tbl.EncryptionMode())
+		// Flip a byte of the first block, which has no checksum.
+		tbl.Data[10]++
+		return tbl
+	}
+
+	tbl := build(t, options.AESCTR)
+	b, err := tbl.block(0, false)
+	require.NoError(t, err)
+	b.decrRef()
+	require.NoError(t, tbl.DecrRef())
+
+	tbl = build(t, options.AESGCM)
+	defer tbl.DecrRef()
+	_, err = tbl.block(0, false)
+	require.ErrorIs(t, err, y.ErrChecksumMismatch)
+}
+
+func TestAuthenticatedEncryptionTamper(t *testing.T) {
+	kvs := make([][]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kvs = append(kvs, []string{key("key", i), fmt.Sprintf("value%04d", i)})
+	}
+	dk := make([]byte, 32)
+	_, err := rand.Read(dk)
+	require.NoError(t, err)
+	cache, err := ristretto.NewCache(&cacheConfig)
+	require.NoError(t, err)
+	opts := Options{BlockSize: 4 << 10, BloomFalsePositive: 0.01,
+		DataKey: &pb.DataKey{Data: dk}, EncryptionMode: options.AESGCM, IndexCache: cache}
+
+	t.Run("copied table", func(t *testing.T) {
+		tbl := buildTable(t, kvs, opts)
+		defer tbl.DecrRef()
+		_, err := OpenInMemoryTable(y.Copy(tbl.Data), tbl.ID()+1, &opts)
+		require.ErrorIs(t, err, y.ErrChecksumMismatch)
+	})
+	t.Run("swapped blocks", func(t *testing.T) {
+		tbl := buildTable(t, kvs, opts)
+		defer tbl.DecrRef()
+		// Find two blocks of the same length, and swap them.
+		var ko1, ko2 fb.BlockOffset
+		i, j := -1, -1
+		for i2 := 0; i2 < tbl.offsetsLength() && j < 0; i2++ {
+			require.NoError(t, tbl.offsets(&ko2, i2))
+			for i1 := 0; i1 < i2; i1++ {
+				require.NoError(t, tbl.offsets(&ko1, i1))
+				if ko1.Len() == ko2.Len() {
+					i, j = i1, i2
+					break
+				}
+			}
+		}
+		require.GreaterOrEqual(t, j, 0, "no blocks of the same length")
+		b1 := tbl.Data[ko1.Offset() : ko1.Offset()+ko1.Len()]
+		b2 := tbl.Data[ko2.Offset() : ko2.Offset()+ko2.Len()]
+		tmp := y.Copy(b1)
+		copy(b1, b2)
+		copy(b2, tmp)
+
+		_, err := tbl.block(i, false)
+		require.ErrorIs(t, err, y.ErrChecksumMismatch)
+		_, err = tbl.block(j, false)
+		require.ErrorIs(t, err, y.ErrChecksumMismatch)
+	})
+}
+
+func TestChecksumOnCompactionRead(t *testing.T) {
+	kvs := make([][]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		kvs = append(kvs, []string{key("key", i), fmt.Sprintf("value%04d", i)})
+	}
+	opts := Options{BlockSize: 4 << 10, BloomFalsePositive: 0.01}
+	tbl := buildTable(t, kvs, opts)
+	idx := bytes.Index(tbl.Data, []byte("value0000"))
+	require.Greater(t, idx, 0)
+	tbl.Data[idx] = 'V'
+
+	opts.ChkMode = options.OnCompactionRead
+	tbl, err := OpenTable(tbl.MmapFile, opts)
+	require.NoError(t, err)
+	defer tbl.DecrRef()
+
+	// Regular reads don't verify the blocks.
+	it := tbl.NewIterator(0)
+	it.Rewind()
+	require.True(t, it.Valid())
+	require.NoError(t, it.Close())
+
+	it = tbl.NewIterator(NOCACHE | VERIFY)
+	defer it.Close()
+	it.Rewind()
+	require.False(t, it.Valid())
+	require.Contains(t, it.err.Error(), "checksum")
+}
+
 var cacheConfig = ristretto.Config{
 	NumCounters: 1000000 * 10,
 	MaxCost:     1000000,
@@ -896,3 +1149,203 @@ func TestMaxVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, N, int(table.MaxVersion()))
 }
+
+func TestCompressedBlockCache(t *testing.T) {
+	iterate := func(t *testing.T, tbl *Table) {
+		it := tbl.NewIterator(0)
+		defer it.Close()
+		var i int
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, key("key", i), string(y.ParseKey(it.Key())))
+			require.Equal(t, fmt.Sprintf("%d", i), string(it.Value().Value))
+			i++
+		}
+		require.Equal(t, 10000, i)
+	}
+	test := func(t *testing.T, opts Options) *ristretto.Cache {
+		cache, err := ristretto.NewCache(&cacheConfig)
+		require.NoError(t, err)
+		opts.CompressedBlockCache = cache
+		tbl := buildTestTable(t, "key", 10000, opts)
+		defer func() { require.NoError(t, tbl.DecrRef()) }()
+
+		iterate(t, tbl)
+		cache.Wait()
+		iterate(t, tbl)
+		return cache
+	}
+
+	t.Run("compression", func(t *testing.T) {
+		cache := test(t, getTestTableOptions())
+		require.Greater(t, cache.Metrics.KeysAdded(), uint64(1))
+		require.Equal(t, cache.Metrics.KeysAdded(), cache.Metrics.Hits())
+	})
+	t.Run("encryption", func(t *testing.T) {
+		opts := getTestTableOptions()
+		opts.Compression = options.None
+		dk := make([]byte, 32)
+		_, err := rand.Read(dk)
+		require.NoError(t, err)
+		opts.DataKey = &pb.DataKey{Data: dk}
+		cache, err := ristretto.NewCache(&cacheConfig)
+		require.NoError(t, err)
+		opts.IndexCache = cache
+		cache = test(t, opts)
+		require.Greater(t, cache.Metrics.KeysAdded(), uint64(1))
+		require.Equal(t, cache.Metrics.KeysAdded(), cache.Metrics.Hits())
+	})
+	t.Run("no compression", func(t *testing.T) {
+		opts := getTestTableOptions()
+		opts.Compression = options.None
+		cache := test(t, opts)
+		require.Zero(t, cache.Metrics.KeysAdded())
+	})
+}
+
+func TestDirectIO(t *testing.T) {
+	opts := getTestTableOptions()
+	tbl := buildTestTable(t, "key", 10000, opts)
+	defer tbl.DecrRef()
+	opts.DirectIO = true
+	direct := buildTestTable(t, "key", 10000, opts)
+	defer direct.DecrRef()
+
+	// The tables are the same, however they were written.
+	require.Equal(t, tbl.Size(), direct.Size())
+	require.Equal(t, tbl.Data, direct.Data)
+
+	for _, opt := range []int{DIRECT, DIRECT | REVERSED} {
+		it := direct.NewIterator(opt | NOCACHE)
+		var count int
+		for it.Rewind(); it.Valid(); it.Next() {
+			i := count
+			if opt&REVERSED != 0 {
+				i = 9999 - count
+			}
+			require.Equal(t, key("key", i), string(y.ParseKey(it.Key())))
+			require.Equal(t, fmt.Sprintf("%d", i), string(it.Value().Value))
+			count++
+		}
+		require.NotNil(t, it.direct)
+		require.NoError(t, it.Close())
+		require.Equal(t, 10000, count)
+	}
+}
+
+// memRemoteFile is a RemoteFile kept in memory.
+type memRemoteFile struct {
+	data    []byte
+	deleted bool
+	reads   int
+}
+
+func (f *memRemoteFile) ReadAt(buf []byte, off int64) error {
+	f.reads++
+	copy(buf, f.data[off:])
+	return nil
+}
+
+func (f *memRemoteFile) Create(wt io.WriterTo) error {
+	var buf bytes.Buffer
+	_, err := wt.WriteTo(&buf)
+	f.data = buf.Bytes()
+	return err
+}
+
+func (f *memRemoteFile) Delete() error {
+	f.deleted = true
+	return nil
+}
+
+func (f *memRemoteFile) URL() string { return "mem://table" }
+
+func TestRemoteTable(t *testing.T) {
+	opts := getTestTableOptions()
+	opts.IndexPartitionSize = 4
+	tbl := buildTestTable(t, "key", 10000, opts)
+	defer tbl.DecrRef()
+
+	b := NewTableBuilder(opts)
+	defer b.Close()
+	for i := 0; i < 10000; i++ {
+		b.Add(y.KeyWithTs([]byte(key("key", i)), 0),
+			y.ValueStruct{Value: []byte(fmt.Sprintf("%d", i)), Meta: 'A'}, 0)
+	}
+	rf := &memRemoteFile{}
+	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
+	remote, err := CreateRemoteTable(filename, b, rf)
+	require.NoError(t, err)
+	require.Equal(t, "mem://table", remote.RemoteURL())
+	require.Equal(t, "", tbl.RemoteURL())
+
+	// The remote copy is the whole table, while the local file only holds what follows the
+	// blocks.
+	require.Equal(t, tbl.Data, rf.data)
+	content, err := remote.Content()
+	require.NoError(t, err)
+	require.Equal(t, tbl.Data, content)
+	var ko fb.BlockOffset
+	require.NoError(t, tbl.offsets(&ko, tbl.offsetsLength()-1))
+	dataSize := int(ko.Offset() + ko.Len())
+	require.Equal(t, make([]byte, dataSize), remote.Data[:dataSize])
+	require.Equal(t, tbl.Data[dataSize:], remote.Data[dataSize:])
+
+	for _, opt := range []int{NOCACHE, DIRECT | NOCACHE | REVERSED} {
+		it := remote.NewIterator(opt)
+		var count int
+		for it.Rewind(); it.Valid(); it.Next() {
+			i := count
+			if opt&REVERSED != 0 {
+				i = 9999 - count
+			}
+			require.Equal(t, key("key", i), string(y.ParseKey(it.Key())))
+			require.Equal(t, fmt.Sprintf("%d", i), string(it.Value().Value))
+			count++
+		}
+		require.Nil(t, it.direct)
+		require.NoError(t, it.Close())
+		require.Equal(t, 10000, count)
+	}
+	require.NotZero(t, rf.reads)
+
+	require.NoError(t, remote.DecrRef())
+	require.True(t, rf.deleted)
+	_, err = os.Stat(filename)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOpenTableWithMeta(t *testing.T) {
+	opts := getTestTableOptions()
+	tbl := buildTestTable(t, "key", 10000, opts)
+	defer tbl.DecrRef()
+
+	meta, rest, err := DecodeMeta(tbl.Meta().Encode(nil))
+	require.NoError(t, err)
+	require.Empty(t, rest)
+	require.Equal(t, tbl.Meta(), meta)
+
+	tbl2, err := OpenTableWithMeta(tbl.MmapFile, nil, meta, opts)
+	require.NoError(t, err)
+	require.Equal(t, tbl.Smallest(), tbl2.Smallest())
+	require.Equal(t, tbl.Biggest(), tbl2.Biggest())
+	require.Equal(t, tbl.KeyCount(), tbl2.KeyCount())
+	require.True(t, tbl2.hasBloomFilter)
+	for i := 0; i < 10000; i++ {
+		require.False(t, tbl2.DoesNotHave(y.Hash([]byte(key("key", i)))))
+	}
+	it := tbl2.NewIterator(0)
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	require.NoError(t, it.Close())
+	require.Equal(t, 10000, count)
+
+	// A meta which doesn't match the table is ignored.
+	meta.IndexChecksum = append([]byte{}, meta.IndexChecksum...)
+	meta.IndexChecksum[len(meta.IndexChecksum)-1]++
+	meta.Biggest = y.KeyWithTs([]byte("aaa"), 0)
+	tbl3, err := OpenTableWithMeta(tbl.MmapFile, nil, meta, opts)
+	require.NoError(t, err)
+	require.Equal(t, tbl.Biggest(), tbl3.Biggest())
+}
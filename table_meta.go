@@ -0,0 +1,170 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TableMetaFileName is the file the table.Meta of the tables are kept in, while the DB is
+	// closed. Opening the DB takes the indices, the filters and the biggest keys of the tables
+	// from it, instead of reading and verifying them.
+	TableMetaFileName        = "TABLEMETA"
+	tableMetaRewriteFileName = "REWRITE-TABLEMETA"
+
+	tableMetaVersion = 1
+)
+
+// writeTableMeta writes the table.Meta of the tables of the levels to TableMetaFileName. It is
+// called on close, once the compactions are stopped.
+//
+// The file is:
+//
+//	version (1 byte) | encrypted (1 byte) | IV (16 bytes, if encrypted) | payload | CRC (4 bytes)
+//
+// where the payload is the number of tables, as a uvarint, followed by their encoded table.Meta.
+// The payload is encrypted with the master key of the key registry, and the CRC is that of the
+// plain payload.
+func (s *levelsController) writeTableMeta() error {
+	db := s.kv
+	var metas []*table.Meta
+	for _, l := range s.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			metas = append(metas, t.Meta())
+		}
+		l.RUnlock()
+	}
+	var buf [binary.MaxVarintLen64]byte
+	payload := append([]byte{}, buf[:binary.PutUvarint(buf[:], uint64(len(metas)))]...)
+	for _, m := range metas {
+		payload = m.Encode(payload)
+	}
+	crc := crc32.Checksum(payload, y.CastagnoliCrcTable)
+
+	out := []byte{tableMetaVersion, 0}
+	if key := db.registry.encryptionKey(); len(key) > 0 {
+		iv, err := y.GenerateIV()
+		if err != nil {
+			return err
+		}
+		if payload, err = y.XORBlockAllocate(payload, key, iv); err != nil {
+			return y.Wrapf(err, "while encrypting %s", TableMetaFileName)
+		}
+		out[1] = 1
+		out = append(out, iv...)
+	}
+	out = append(out, payload...)
+	out = append(out, y.U32ToBytes(crc)...)
+
+	tmpPath := filepath.Join(db.opt.Dir, tableMetaRewriteFileName)
+	fp, err := y.OpenTruncFileFS(db.opt.FS, tmpPath, true)
+	if err != nil {
+		return y.Wrapf(err, "while opening %s", tmpPath)
+	}
+	if _, err := fp.Write(out); err != nil {
+		// In Windows the files should be closed before doing a Rename.
+		fp.Close()
+		return y.Wrapf(err, "while writing %s", tmpPath)
+	}
+	if err := fp.Close(); err != nil {
+		return y.Wrapf(err, "while closing %s", tmpPath)
+	}
+	if err := db.opt.FS.Rename(tmpPath, filepath.Join(db.opt.Dir, TableMetaFileName)); err != nil {
+		return y.Wrapf(err, "while renaming %s", tmpPath)
+	}
+	return db.opt.FS.SyncDir(db.opt.Dir)
+}
+
+// readTableMeta reads the table.Meta of the tables from TableMetaFileName, by table ID. It returns
+// nil if there's no such file. The entries which don't match the tables, such as those of the
+// tables replaced by others with the same ID, are ignored when the tables are opened.
+func readTableMeta(db *DB) (map[uint64]*table.Meta, error) {
+	fp, err := db.opt.FS.OpenFile(filepath.Join(db.opt.Dir, TableMetaFileName), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(fp)
+	fp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	errCorrupt := errors.Errorf("%s is corrupted", TableMetaFileName)
+	if len(data) < 6 {
+		return nil, errCorrupt
+	}
+	if data[0] != tableMetaVersion {
+		return nil, errors.Errorf("unsupported %s version: %d", TableMetaFileName, data[0])
+	}
+	encrypted := data[1] == 1
+	crc := y.BytesToU32(data[len(data)-4:])
+	payload := data[2 : len(data)-4]
+	if encrypted {
+		key := db.registry.encryptionKey()
+		if len(key) == 0 || len(payload) < aes.BlockSize {
+			return nil, errors.Errorf("%s is encrypted, but the DB isn't", TableMetaFileName)
+		}
+		iv := payload[:aes.BlockSize]
+		if payload, err = y.XORBlockAllocate(payload[aes.BlockSize:], key, iv); err != nil {
+			return nil, err
+		}
+	}
+	if crc32.Checksum(payload, y.CastagnoliCrcTable) != crc {
+		return nil, errCorrupt
+	}
+
+	count, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, errCorrupt
+	}
+	payload = payload[n:]
+	metas := make(map[uint64]*table.Meta)
+	for i := uint64(0); i < count; i++ {
+		var m *table.Meta
+		if m, payload, err = table.DecodeMeta(payload); err != nil {
+			return nil, err
+		}
+		metas[m.ID] = m
+	}
+	if len(payload) != 0 {
+		return nil, errCorrupt
+	}
+	return metas, nil
+}
+
+// removeTableMeta removes TableMetaFileName, if it exists.
+func removeTableMeta(db *DB) error {
+	err := db.opt.FS.Remove(filepath.Join(db.opt.Dir, TableMetaFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return y.Wrapf(err, "while removing %s", TableMetaFileName)
+	}
+	return nil
+}
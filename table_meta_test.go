@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableMeta(t *testing.T) {
+	test := func(t *testing.T, opt Options) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		opt.Dir, opt.ValueDir = dir, dir
+
+		db, err := Open(opt)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := 0; j < 100; j++ {
+					k := []byte(fmt.Sprintf("key%d-%03d", i, j))
+					if err := txn.Set(k, k); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		// The memtable is flushed on close, before the sidecar is written.
+		require.NoError(t, db.Close())
+		db, err = Open(opt)
+		require.NoError(t, err)
+		tables := db.Tables()
+		require.NotEmpty(t, tables)
+		require.NoError(t, db.Close())
+		path := filepath.Join(dir, TableMetaFileName)
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+
+		check := func() {
+			db, err := Open(opt)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, db.Close()) }()
+			// The sidecar is removed once read.
+			_, err = os.Stat(path)
+			require.True(t, os.IsNotExist(err))
+			require.Equal(t, tables, db.Tables())
+			require.NoError(t, db.View(func(txn *Txn) error {
+				for i := 0; i < 3; i++ {
+					for j := 0; j < 100; j++ {
+						k := []byte(fmt.Sprintf("key%d-%03d", i, j))
+						item, err := txn.Get(k)
+						if err != nil {
+							return err
+						}
+						require.Equal(t, k, getItemValue(t, item))
+					}
+				}
+				return nil
+			}))
+		}
+		check()
+
+		// A corrupted sidecar is ignored.
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		data[len(data)/2]++
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		check()
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		test(t, getTestOptions(""))
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		opt := getTestOptions("").
+			WithEncryptionKey([]byte("badgerkey16bytes")).
+			WithIndexCacheSize(1 << 20)
+		test(t, opt)
+	})
+}
@@ -93,6 +93,20 @@ stream() {
   return 0
 }
 
+# The adapters of the tracing, the metrics and the logging, the RPC server and the CLI are nested
+# modules, so that the core module doesn't depend on OpenTelemetry, Prometheus, zap and gRPC.
+modules() {
+  set -e
+  for mod in tracing metrics logging rpc badger; do
+    echo "===> Testing module $mod"
+    pushd $mod
+    go vet ./...
+    go test $tags -timeout=25m -race ./...
+    popd
+  done
+  echo "==> DONE module tests"
+}
+
 write_coverage() {
   if [ $CI = "true" ]; then
     if [ -f cover_tmp.out ]; then
@@ -107,5 +121,6 @@ write_coverage() {
 # parallel --halt now,fail=1 --progress --line-buffer ::: stream manual root
 # run tests in sequence
 root
+modules
 stream
 manual
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+// Tracer starts the spans around transaction commits, gets, value log reads, iterator prefetches
+// and compactions. See Options.Tracer. The module github.com/dgraph-io/badger/v3/tracing provides
+// an OpenTelemetry Tracer.
+type Tracer interface {
+	// StartSpan starts a span named name, with the given attributes.
+	StartSpan(name string, attrs ...Attribute) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// IsRecording returns whether the span records its attributes and events. The attributes
+	// which are costly to compute are only set on the spans which record them.
+	IsRecording() bool
+	// SetAttributes sets the given attributes on the span.
+	SetAttributes(attrs ...Attribute)
+	// AddEvent adds an event named name, with the given attributes, to the span.
+	AddEvent(name string, attrs ...Attribute)
+	// End ends the span. err is the error of the operation, or nil if it succeeded.
+	End(err error)
+}
+
+// Attribute is an attribute of a span or of an event. Value is a bool or an int64.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func boolAttr(key string, val bool) Attribute {
+	return Attribute{Key: key, Value: val}
+}
+
+func intAttr(key string, val int64) Attribute {
+	return Attribute{Key: key, Value: val}
+}
+
+// noopSpan is the span returned by startSpan when tracing is disabled.
+type noopSpan struct{}
+
+func (noopSpan) IsRecording() bool             { return false }
+func (noopSpan) SetAttributes(...Attribute)    {}
+func (noopSpan) AddEvent(string, ...Attribute) {}
+func (noopSpan) End(error)                     {}
+
+// startSpan starts a span named name, if Options.Tracer is set. Otherwise it returns a noopSpan.
+// The span must be ended by the caller.
+func (db *DB) startSpan(name string, attrs ...Attribute) Span {
+	if db.opt.Tracer == nil {
+		return noopSpan{}
+	}
+	return db.opt.Tracer.StartSpan(name, attrs...)
+}
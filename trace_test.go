@@ -0,0 +1,150 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testSpan records the name, attributes and events of a span.
+type testSpan struct {
+	name       string
+	attrs      map[string]interface{}
+	events     []map[string]interface{}
+	eventNames []string
+	ended      bool
+	err        error
+}
+
+func (s *testSpan) IsRecording() bool { return true }
+
+func (s *testSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) AddEvent(name string, attrs ...Attribute) {
+	m := make(map[string]interface{})
+	for _, a := range attrs {
+		m[a.Key] = a.Value
+	}
+	s.eventNames = append(s.eventNames, name)
+	s.events = append(s.events, m)
+}
+
+// testTracer is a Tracer which records the spans started.
+type testTracer struct {
+	sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(name string, attrs ...Attribute) Span {
+	span := &testSpan{name: name, attrs: make(map[string]interface{})}
+	span.SetAttributes(attrs...)
+	t.Lock()
+	t.spans = append(t.spans, span)
+	t.Unlock()
+	return span
+}
+
+// find returns the spans with the given name.
+func (t *testTracer) find(name string) []*testSpan {
+	t.Lock()
+	defer t.Unlock()
+	var res []*testSpan
+	for _, s := range t.spans {
+		if s.name == name {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func TestTracing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	tracer := &testTracer{}
+	opt := getTestOptions(dir).WithTracer(tracer).WithValueThreshold(32)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	bigValue := make([]byte, 64)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Set([]byte("foo"), []byte("bar")))
+		return txn.Set([]byte("big"), bigValue)
+	}))
+	commits := tracer.find("Badger.Commit")
+	require.Len(t, commits, 1)
+	require.True(t, commits[0].ended)
+	require.NoError(t, commits[0].err)
+	require.Equal(t, int64(2), commits[0].attrs["entries"])
+	require.NotContains(t, commits[0].attrs, "conflict")
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("big"))
+		require.NoError(t, err)
+		_, err = item.ValueCopy(nil)
+		return err
+	}))
+	gets := tracer.find("Badger.Get")
+	require.Len(t, gets, 1)
+	require.True(t, gets[0].ended)
+	// The key is found in the memtable, without looking up the levels.
+	require.Equal(t, []string{"memtable"}, gets[0].eventNames)
+	require.Equal(t, true, gets[0].events[0]["found"])
+
+	reads := tracer.find("Badger.ValueLogRead")
+	require.Len(t, reads, 1)
+	require.True(t, reads[0].ended)
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("missing"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+	gets = tracer.find("Badger.Get")
+	require.Len(t, gets, 2)
+	// All the levels are looked up for a missing key.
+	require.Equal(t, "memtable", gets[1].eventNames[0])
+	require.Equal(t, "level", gets[1].eventNames[len(gets[1].eventNames)-1])
+	require.Equal(t, int64(db.opt.MaxLevels-1),
+		gets[1].events[len(gets[1].events)-1]["level"])
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+		}
+		return nil
+	}))
+	prefetches := tracer.find("Badger.Iterator.Prefetch")
+	require.Len(t, prefetches, 1)
+	require.Equal(t, int64(2), prefetches[0].attrs["items"])
+}
@@ -0,0 +1,12 @@
+module github.com/dgraph-io/badger/v3/tracing
+
+go 1.12
+
+require (
+	github.com/dgraph-io/badger/v3 v3.0.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+)
+
+replace github.com/dgraph-io/badger/v3 => ../
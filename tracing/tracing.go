@@ -0,0 +1,83 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tracing adapts an OpenTelemetry TracerProvider to the Tracer of Badger, so that the core
+// module of Badger doesn't depend on OpenTelemetry.
+package tracing
+
+import (
+	"context"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer got from the TracerProvider.
+const tracerName = "github.com/dgraph-io/badger/v3"
+
+// OTelTracer adapts an OpenTelemetry tracer to the Tracer of Badger.
+type OTelTracer struct {
+	t trace.Tracer
+}
+
+// NewOTelTracer returns an OTelTracer starting its spans with the tracer of tp.
+func NewOTelTracer(tp trace.TracerProvider) *OTelTracer {
+	return &OTelTracer{t: tp.Tracer(tracerName)}
+}
+
+// StartSpan starts an OpenTelemetry span named name, with the given attributes.
+func (o *OTelTracer) StartSpan(name string, attrs ...badger.Attribute) badger.Span {
+	_, span := o.t.Start(context.Background(), name, trace.WithAttributes(convert(attrs)...))
+	return otelSpan{span}
+}
+
+type otelSpan struct {
+	s trace.Span
+}
+
+func (o otelSpan) IsRecording() bool { return o.s.IsRecording() }
+
+func (o otelSpan) SetAttributes(attrs ...badger.Attribute) {
+	o.s.SetAttributes(convert(attrs)...)
+}
+
+func (o otelSpan) AddEvent(name string, attrs ...badger.Attribute) {
+	o.s.AddEvent(name, trace.WithAttributes(convert(attrs)...))
+}
+
+// End ends the span, recording err on it if it isn't nil.
+func (o otelSpan) End(err error) {
+	if err != nil {
+		o.s.RecordError(err)
+		o.s.SetStatus(codes.Error, err.Error())
+	}
+	o.s.End()
+}
+
+func convert(attrs []badger.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.Key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(a.Key, v))
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testSpan records the name, attributes, events and status of a span.
+type testSpan struct {
+	trace.Span // A noop span, for the methods which aren't recorded.
+	name       string
+	attrs      map[attribute.Key]attribute.Value
+	eventNames []string
+	errs       []error
+	status     codes.Code
+	ended      bool
+}
+
+func (s *testSpan) IsRecording() bool { return true }
+
+func (s *testSpan) End(...trace.SpanEndOption) { s.ended = true }
+
+func (s *testSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) AddEvent(name string, _ ...trace.EventOption) {
+	s.eventNames = append(s.eventNames, name)
+}
+
+func (s *testSpan) RecordError(err error, _ ...trace.EventOption) { s.errs = append(s.errs, err) }
+
+func (s *testSpan) SetStatus(code codes.Code, _ string) { s.status = code }
+
+// testTracer is a trace.TracerProvider and a trace.Tracer which records the spans started.
+type testTracer struct {
+	sync.Mutex
+	name  string
+	spans []*testSpan
+}
+
+func (t *testTracer) Tracer(name string, _ ...trace.TracerOption) trace.Tracer {
+	t.name = name
+	return t
+}
+
+func (t *testTracer) Start(ctx context.Context, name string,
+	opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	noop := trace.SpanFromContext(context.Background())
+	span := &testSpan{Span: noop, name: name, attrs: make(map[attribute.Key]attribute.Value)}
+	span.SetAttributes(cfg.Attributes()...)
+	t.Lock()
+	t.spans = append(t.spans, span)
+	t.Unlock()
+	return ctx, span
+}
+
+func TestOTelTracer(t *testing.T) {
+	tp := &testTracer{}
+	tracer := NewOTelTracer(tp)
+	require.Equal(t, tracerName, tp.name)
+
+	span := tracer.StartSpan("span", badger.Attribute{Key: "entries", Value: int64(2)})
+	require.True(t, span.IsRecording())
+	span.SetAttributes(badger.Attribute{Key: "conflict", Value: true})
+	span.AddEvent("memtable", badger.Attribute{Key: "found", Value: false})
+	errFoo := errors.New("foo")
+	span.End(errFoo)
+
+	require.Len(t, tp.spans, 1)
+	s := tp.spans[0]
+	require.Equal(t, "span", s.name)
+	require.Equal(t, int64(2), s.attrs["entries"].AsInt64())
+	require.True(t, s.attrs["conflict"].AsBool())
+	require.Equal(t, []string{"memtable"}, s.eventNames)
+	require.Equal(t, []error{errFoo}, s.errs)
+	require.Equal(t, codes.Error, s.status)
+	require.True(t, s.ended)
+
+	tracer.StartSpan("ok").End(nil)
+	require.Len(t, tp.spans, 2)
+	require.Empty(t, tp.spans[1].errs)
+	require.Equal(t, codes.Unset, tp.spans[1].status)
+	require.True(t, tp.spans[1].ended)
+}
+
+func TestOTelTracerDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tp := &testTracer{}
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil).
+		WithTracer(NewOTelTracer(tp)))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("foo"), []byte("bar"))
+	}))
+	var commits []*testSpan
+	for _, s := range tp.spans {
+		if s.name == "Badger.Commit" {
+			commits = append(commits, s)
+		}
+	}
+	require.Len(t, commits, 1)
+	require.Equal(t, int64(1), commits[0].attrs["entries"].AsInt64())
+	require.True(t, commits[0].ended)
+}
@@ -21,11 +21,15 @@ import (
 	"context"
 	"encoding/hex"
 	"math"
+	"math/rand"
 	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/skl"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
@@ -49,6 +53,10 @@ type oracle struct {
 	discardTs uint64       // Used by ManagedDB.
 	readMark  *y.WaterMark // Used by DB.
 
+	// commits is used to keep the versions within VersionRetention. It is nil if VersionRetention
+	// is not set, or in managed mode.
+	commits *commitLog
+
 	// committedTxns contains all committed writes (contains fingerprints
 	// of keys written and their latest commit counter).
 	committedTxns []committedTxn
@@ -76,6 +84,9 @@ func newOracle(opt Options) *oracle {
 		txnMark:  &y.WaterMark{Name: "badger.TxnTimestamp"},
 		closer:   z.NewCloser(2),
 	}
+	if opt.VersionRetention > 0 && !opt.managedTxns {
+		orc.commits = newCommitLog(opt.VersionRetention)
+	}
 	orc.readMark.Init(orc.closer)
 	orc.txnMark.Init(orc.closer)
 	return orc
@@ -131,14 +142,26 @@ func (o *oracle) discardAtOrBelow() uint64 {
 		defer o.Unlock()
 		return o.discardTs
 	}
-	return o.readMark.DoneUntil()
+	ts := o.readMark.DoneUntil()
+	if o.commits != nil {
+		o.Lock()
+		defer o.Unlock()
+		if rts := o.commits.discardBefore(time.Now()); rts < ts {
+			ts = rts
+		}
+	}
+	return ts
 }
 
-// hasConflict must be called while having a lock.
-func (o *oracle) hasConflict(txn *Txn) bool {
+// conflictingKeys returns the fingerprints of the keys read by txn which have been written by
+// transactions committed after txn started. A non-empty result means that txn has a conflict.
+// conflictingKeys must be called while having a lock.
+func (o *oracle) conflictingKeys(txn *Txn) []uint64 {
 	if len(txn.reads) == 0 {
-		return false
+		return nil
 	}
+	var conflicts []uint64
+	seen := make(map[uint64]struct{})
 	for _, committedTxn := range o.committedTxns {
 		// If the committedTxn.ts is less than txn.readTs that implies that the
 		// committedTxn finished before the current transaction started.
@@ -151,21 +174,27 @@ func (o *oracle) hasConflict(txn *Txn) bool {
 		}
 
 		for _, ro := range txn.reads {
-			if _, has := committedTxn.conflictKeys[ro]; has {
-				return true
+			if _, has := committedTxn.conflictKeys[ro]; !has {
+				continue
+			}
+			if _, ok := seen[ro]; !ok {
+				seen[ro] = struct{}{}
+				conflicts = append(conflicts, ro)
 			}
 		}
 	}
 
-	return false
+	return conflicts
 }
 
-func (o *oracle) newCommitTs(txn *Txn) (uint64, bool) {
+// newCommitTs returns the commit timestamp for txn. If txn has a conflict, the fingerprints of the
+// conflicting keys are returned instead.
+func (o *oracle) newCommitTs(txn *Txn) (uint64, []uint64) {
 	o.Lock()
 	defer o.Unlock()
 
-	if o.hasConflict(txn) {
-		return 0, true
+	if conflicts := o.conflictingKeys(txn); len(conflicts) > 0 {
+		return 0, conflicts
 	}
 
 	var ts uint64
@@ -177,6 +206,9 @@ func (o *oracle) newCommitTs(txn *Txn) (uint64, bool) {
 		ts = o.nextTxnTs
 		o.nextTxnTs++
 		o.txnMark.Begin(ts)
+		if o.commits != nil {
+			o.commits.add(ts, time.Now())
+		}
 
 	} else {
 		// If commitTs is set, use it instead.
@@ -194,7 +226,7 @@ func (o *oracle) newCommitTs(txn *Txn) (uint64, bool) {
 		})
 	}
 
-	return ts, false
+	return ts, nil
 }
 
 func (o *oracle) doneRead(txn *Txn) {
@@ -254,6 +286,8 @@ type Txn struct {
 	db       *DB
 
 	reads []uint64 // contains fingerprints of keys read.
+	// readKeys maps the fingerprints of keys read to the keys. Only used with ConflictDetails.
+	readKeys map[uint64][]byte
 	// contains fingerprints of keys written. This is used for conflict detection.
 	conflictKeys map[uint64]struct{}
 	readsLock    sync.Mutex // guards the reads slice. See addReadKey.
@@ -261,10 +295,24 @@ type Txn struct {
 	pendingWrites   map[string]*Entry // cache stores any writes done by txn.
 	duplicateWrites []*Entry          // Used in managed mode to store duplicate entries.
 
+	// savepoints is the stack of active savepoints. The journal of undo records is only kept
+	// while there is at least one savepoint.
+	savepoints      []savepointState
+	journal         []undoRecord
+	nextSavepointID uint64
+
 	numIterators int32
 	discarded    bool
 	doneRead     bool
 	update       bool // update is used to conditionally keep track of reads.
+	chunked      bool // chunked is set by EnableAutoChunking.
+	internal     bool // internal allows writing the internal keys, with the badger prefix.
+
+	locks []uint64 // Fingerprints of the keys locked via Lock.
+
+	// unsafeItems are the items of Get whose values were read via ValueUnsafe. They hold read
+	// locks on the value log files until Discard, and count as an active iterator meanwhile.
+	unsafeItems []*Item
 }
 
 type pendingWritesIterator struct {
@@ -302,13 +350,19 @@ func (pi *pendingWritesIterator) Key() []byte {
 func (pi *pendingWritesIterator) Value() y.ValueStruct {
 	y.AssertTrue(pi.Valid())
 	entry := pi.entries[pi.nextIdx]
-	return y.ValueStruct{
+	vs := y.ValueStruct{
 		Value:     entry.Value,
 		Meta:      entry.meta,
 		UserMeta:  entry.UserMeta,
 		ExpiresAt: entry.ExpiresAt,
 		Version:   pi.readTs,
 	}
+	if len(entry.UserMetadata) > 0 {
+		// Store the user metadata the way it is stored in the memtables.
+		vs.Value = appendUserMetadata(append([]byte{}, entry.Value...), entry.UserMetadata)
+		vs.Meta |= bitUserMetadata
+	}
+	return vs
 }
 
 func (pi *pendingWritesIterator) Valid() bool {
@@ -345,14 +399,66 @@ func (txn *Txn) newPendingWritesIterator(reversed bool) *pendingWritesIterator {
 func (txn *Txn) checkSize(e *Entry) error {
 	count := txn.count + 1
 	// Extra bytes for the version in key.
-	size := txn.size + e.estimateSizeAndSetThreshold(txn.db.valueThreshold()) + 10
-	if count >= txn.db.opt.maxBatchCount || size >= txn.db.opt.maxBatchSize {
+	sz := e.estimateSizeAndSetThreshold(txn.db.valueThresholdFor(e.Key)) + 10
+	size := txn.size + sz
+	if txn.chunked {
+		// A chunked txn is split into batches on commit, but it must still fit in a single
+		// memtable, so that it can be replayed atomically from the WAL.
+		if sz >= txn.db.opt.maxBatchSize || txn.memtableSize(count, size) >= shardSize(txn.db.opt) {
+			return ErrTxnTooBig
+		}
+	} else if count >= txn.db.opt.maxBatchCount || size >= txn.db.opt.maxBatchSize {
 		return ErrTxnTooBig
 	}
 	txn.count, txn.size = count, size
 	return nil
 }
 
+// memtableSize returns an upper bound on the memtable space needed by count entries of the given
+// size.
+func (txn *Txn) memtableSize(count, size int64) int64 {
+	return size + count*int64(skl.MaxNodeSize)
+}
+
+// EnableAutoChunking lets the transaction grow beyond the limits of a single write batch. Instead
+// of returning ErrTxnTooBig once MaxBatchCount or MaxBatchSize is reached, the writes are split
+// into multiple batches on commit. All the batches are written with the same commit timestamp and
+// a single commit marker, so the transaction is still applied atomically, both for readers and
+// for crash recovery. A chunked transaction must fit in one memtable, so ErrTxnTooBig is returned
+// once its writes get close to the size of a memtable shard, i.e., MemTableSize divided by
+// MemTableShards.
+//
+// EnableAutoChunking must be called before any writes are done in the transaction.
+func (txn *Txn) EnableAutoChunking() error {
+	switch {
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case len(txn.pendingWrites) > 0:
+		return errors.New("EnableAutoChunking must be called before any writes")
+	}
+	txn.chunked = true
+	return nil
+}
+
+// splitIntoChunks splits the entries into chunks which fit in a single write batch.
+func (txn *Txn) splitIntoChunks(entries []*Entry) [][]*Entry {
+	var chunks [][]*Entry
+	var start int
+	var count, size int64
+	for i, e := range entries {
+		sz := e.estimateSizeAndSetThreshold(txn.db.valueThresholdFor(e.Key))
+		if i > start && (count+1 >= txn.db.opt.maxBatchCount || size+sz >= txn.db.opt.maxBatchSize) {
+			chunks = append(chunks, entries[start:i])
+			start, count, size = i, 0, 0
+		}
+		count++
+		size += sz
+	}
+	return append(chunks, entries[start:])
+}
+
 func exceedsSize(prefix string, max int64, key []byte) error {
 	return errors.Errorf("%s with size %d exceeded %d limit. %s:\n%s",
 		prefix, len(key), max, prefix, hex.Dump(key[:1<<10]))
@@ -389,7 +495,7 @@ func (txn *Txn) modify(e *Entry) error {
 		return ErrDiscardedTxn
 	case len(e.Key) == 0:
 		return ErrEmptyKey
-	case bytes.HasPrefix(e.Key, badgerPrefix):
+	case bytes.HasPrefix(e.Key, badgerPrefix) && !txn.internal:
 		return ErrInvalidKey
 	case len(e.Key) > maxKeySize:
 		// Key length can't be more than uint16, as determined by table::header.  To
@@ -402,6 +508,9 @@ func (txn *Txn) modify(e *Entry) error {
 		return exceedsSize("Value", txn.db.valueThreshold(), e.Value)
 	}
 
+	if err := checkUserMetadata(e.UserMetadata); err != nil {
+		return err
+	}
 	if err := txn.db.isBanned(e.Key); err != nil {
 		return err
 	}
@@ -409,6 +518,16 @@ func (txn *Txn) modify(e *Entry) error {
 		return err
 	}
 
+	oldEntry, hasOld := txn.pendingWrites[string(e.Key)]
+	if len(txn.savepoints) > 0 {
+		rec := undoRecord{key: string(e.Key), prev: oldEntry}
+		if txn.db.opt.DetectConflicts {
+			_, hasFp := txn.conflictKeys[z.MemHash(e.Key)]
+			rec.newFp = !hasFp
+		}
+		txn.journal = append(txn.journal, rec)
+	}
+
 	// The txn.conflictKeys is used for conflict detection. If conflict detection
 	// is disabled, we don't need to store key hashes in this map.
 	if txn.db.opt.DetectConflicts {
@@ -418,13 +537,99 @@ func (txn *Txn) modify(e *Entry) error {
 	// If a duplicate entry was inserted in managed mode, move it to the duplicate writes slice.
 	// Add the entry to duplicateWrites only if both the entries have different versions. For
 	// same versions, we will overwrite the existing entry.
-	if oldEntry, ok := txn.pendingWrites[string(e.Key)]; ok && oldEntry.version != e.version {
+	if hasOld && oldEntry.version != e.version {
 		txn.duplicateWrites = append(txn.duplicateWrites, oldEntry)
 	}
 	txn.pendingWrites[string(e.Key)] = e
 	return nil
 }
 
+// undoRecord records the state of a key in pendingWrites before it was modified.
+type undoRecord struct {
+	key   string
+	prev  *Entry // nil if the key was not in pendingWrites.
+	newFp bool   // true if the key's fingerprint was added to conflictKeys.
+}
+
+type savepointState struct {
+	id         uint64
+	journalLen int
+	numDups    int
+	count      int64
+	size       int64
+}
+
+// Savepoint marks a point in a transaction to which the pending writes can be rolled back. See
+// Txn.Savepoint.
+type Savepoint struct {
+	txn *Txn
+	id  uint64
+}
+
+// Savepoint creates a savepoint in the transaction. The writes done after the savepoint can be
+// undone by calling RollbackTo, without discarding the writes done before it. Savepoints can be
+// nested. Rolling back to a savepoint invalidates all the savepoints created after it, but the
+// savepoint itself stays valid and can be rolled back to again.
+//
+// Reads done after the savepoint are still tracked for conflict detection after a rollback.
+func (txn *Txn) Savepoint() (*Savepoint, error) {
+	switch {
+	case !txn.update:
+		return nil, ErrReadOnlyTxn
+	case txn.discarded:
+		return nil, ErrDiscardedTxn
+	}
+	txn.nextSavepointID++
+	txn.savepoints = append(txn.savepoints, savepointState{
+		id:         txn.nextSavepointID,
+		journalLen: len(txn.journal),
+		numDups:    len(txn.duplicateWrites),
+		count:      txn.count,
+		size:       txn.size,
+	})
+	return &Savepoint{txn: txn, id: txn.nextSavepointID}, nil
+}
+
+// RollbackTo undoes all the writes done in the transaction after the savepoint sp was created.
+// ErrInvalidSavepoint is returned if sp doesn't belong to this transaction, or if it was
+// invalidated by rolling back to an earlier savepoint.
+func (txn *Txn) RollbackTo(sp *Savepoint) error {
+	switch {
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case sp == nil || sp.txn != txn:
+		return ErrInvalidSavepoint
+	}
+	idx := -1
+	for i, state := range txn.savepoints {
+		if state.id == sp.id {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return ErrInvalidSavepoint
+	}
+	state := txn.savepoints[idx]
+
+	for i := len(txn.journal) - 1; i >= state.journalLen; i-- {
+		rec := txn.journal[i]
+		if rec.prev == nil {
+			delete(txn.pendingWrites, rec.key)
+		} else {
+			txn.pendingWrites[rec.key] = rec.prev
+		}
+		if rec.newFp {
+			delete(txn.conflictKeys, z.MemHash([]byte(rec.key)))
+		}
+	}
+	txn.journal = txn.journal[:state.journalLen]
+	txn.duplicateWrites = txn.duplicateWrites[:state.numDups]
+	txn.count, txn.size = state.count, state.size
+	txn.savepoints = txn.savepoints[:idx+1]
+	return nil
+}
+
 // Set adds a key-value pair to the database.
 // It will return ErrReadOnlyTxn if update flag was set to false when creating the transaction.
 //
@@ -482,6 +687,7 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 			item.meta = e.meta
 			item.val = e.Value
 			item.userMeta = e.UserMeta
+			item.userMetadata = e.UserMetadata
 			item.key = key
 			item.status = prefetched
 			item.version = txn.readTs
@@ -495,7 +701,27 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	}
 
 	seek := y.KeyWithTs(key, txn.readTs)
-	vs, err := txn.db.get(seek)
+	gt := getTrace{span: txn.db.startSpan("Badger.Get")}
+	var start time.Time
+	if txn.db.opt.MetricsEnabled || txn.db.opt.SlowLogThreshold > 0 {
+		start = time.Now()
+	}
+	if txn.db.opt.SlowLogThreshold > 0 {
+		gt.last = start
+	}
+	vs, err := txn.db.getTraced(seek, &gt)
+	gt.span.End(err)
+	if !start.IsZero() {
+		y.GetLatencyObserve(txn.db.opt.MetricsEnabled, time.Since(start))
+		txn.db.recordSlow(SlowLogEntry{
+			Op:             SlowGet,
+			Start:          start,
+			Duration:       time.Since(start),
+			KeyFingerprint: z.MemHash(key),
+			Lookups:        gt.lookups,
+			Err:            err,
+		})
+	}
 	if err != nil {
 		return nil, y.Wrapf(err, "DB::Get key: %q", key)
 	}
@@ -511,11 +737,127 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item.meta = vs.Meta
 	item.userMeta = vs.UserMeta
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
+	item.vptr, item.userMetadata = splitUserMetadata(item.meta, item.vptr)
 	item.txn = txn
 	item.expiresAt = vs.ExpiresAt
 	return item, nil
 }
 
+// GetAllVersions returns all the retained versions of the given keys, visible at the read
+// timestamp of the transaction, in a single pass over the LSM tree. This is useful for
+// reconciliation jobs which compare the contents of replicas.
+//
+// The returned list is sorted by key, and then by version in descending order. For each key, the
+// versions are returned until a delete marker, an expired entry or an entry with
+// BitDiscardEarlierVersions is found (all of them inclusive), or NumVersionsToKeep versions have
+// been returned. As with Stream, the Meta field of a KV is set to bitDelete for delete markers. Keys
+// which have no versions are not part of the list.
+func (txn *Txn) GetAllVersions(keys [][]byte) (*KVList, error) {
+	if txn.discarded {
+		return nil, ErrDiscardedTxn
+	}
+	sorted := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrEmptyKey
+		}
+		if err := txn.db.isBanned(key); err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	opt := DefaultIteratorOptions
+	opt.AllVersions = true
+	opt.PrefetchValues = false
+	itr := txn.NewIterator(opt)
+	defer itr.Close()
+
+	list := &KVList{}
+	var last []byte
+	for _, key := range sorted {
+		if last != nil && bytes.Equal(last, key) {
+			continue
+		}
+		last = key
+
+		err := appendVersions(list, itr, key, bitDelete, func(item *Item, count int) bool {
+			return count == txn.db.opt.NumVersionsToKeep ||
+				item.DiscardEarlierVersions() || item.IsDeletedOrExpired()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// appendVersions appends the versions of key to the list, in the order itr returns them, until
+// done returns true. It is called with the last item appended and the number of versions appended
+// so far. metaMask selects the meta bits which are copied into the KVs.
+func appendVersions(list *KVList, itr *Iterator, key []byte, metaMask byte,
+	done func(item *Item, count int) bool) error {
+	var count int
+	for itr.Seek(key); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if !bytes.Equal(item.Key(), key) {
+			break
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:       item.KeyCopy(nil),
+			Value:     val,
+			UserMeta:  kvUserMeta(item.UserMeta(), item.UserMetadata()),
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+			Meta:      []byte{item.meta & metaMask},
+		})
+		count++
+		if done(item, count) {
+			break
+		}
+	}
+	return nil
+}
+
+// GetHistory returns the versions of the key retained in the DB and visible at the read timestamp
+// of the transaction, in descending order of version. At most limit versions are returned, unless
+// limit is zero or negative. Unlike GetAllVersions, it doesn't stop at delete markers, expired
+// entries, or entries with BitDiscardEarlierVersions. The versions below them are returned until
+// compactions remove them. The Meta field of a KV has bitDelete set for delete markers and
+// BitDiscardEarlierVersions set for such entries. It returns nil if the key has no versions.
+func (txn *Txn) GetHistory(key []byte, limit int) ([]*pb.KV, error) {
+	switch {
+	case txn.discarded:
+		return nil, ErrDiscardedTxn
+	case len(key) == 0:
+		return nil, ErrEmptyKey
+	}
+	if err := txn.db.isBanned(key); err != nil {
+		return nil, err
+	}
+
+	opt := DefaultIteratorOptions
+	opt.AllVersions = true
+	opt.PrefetchValues = false
+	opt.Prefix = key
+	itr := txn.NewIterator(opt)
+	defer itr.Close()
+
+	list := &KVList{}
+	err := appendVersions(list, itr, key, bitDelete|BitDiscardEarlierVersions,
+		func(_ *Item, count int) bool {
+			return limit > 0 && count == limit
+		})
+	return list.Kv, err
+}
+
 func (txn *Txn) addReadKey(key []byte) {
 	if txn.update {
 		fp := z.MemHash(key)
@@ -526,10 +868,27 @@ func (txn *Txn) addReadKey(key []byte) {
 		// needs to be locked whenever we mark a key as read.
 		txn.readsLock.Lock()
 		txn.reads = append(txn.reads, fp)
+		if txn.readKeys != nil {
+			if _, ok := txn.readKeys[fp]; !ok {
+				txn.readKeys[fp] = y.SafeCopy(nil, key)
+			}
+		}
 		txn.readsLock.Unlock()
 	}
 }
 
+// releaseUnsafeItems releases the value log files read via ValueUnsafe by the items of Get.
+func (txn *Txn) releaseUnsafeItems() {
+	if len(txn.unsafeItems) == 0 {
+		return
+	}
+	for _, item := range txn.unsafeItems {
+		item.releaseValue()
+	}
+	txn.unsafeItems = nil
+	_ = txn.db.vlog.decrIteratorCount()
+}
+
 // Discard discards a created transaction. This method is very important and must be called. Commit
 // method calls this internally, however, calling this multiple times doesn't cause any issues. So,
 // this can safely be called via a defer right when transaction is created.
@@ -543,12 +902,17 @@ func (txn *Txn) Discard() {
 		panic("Unclosed iterator at time of Txn.Discard.")
 	}
 	txn.discarded = true
+	txn.releaseUnsafeItems()
+	txn.db.keyLocks.release(txn)
 	if !txn.db.orc.isManaged {
 		txn.db.orc.doneRead(txn)
 	}
 }
 
-func (txn *Txn) commitAndSend() (func() error, error) {
+// commitAndSend sends the writes of the transaction to the write channel. With async set, the
+// writes are acked before they're synced to disk. It gives up waiting for room in the write channel
+// once ctx is done.
+func (txn *Txn) commitAndSend(ctx context.Context, async bool) (func() error, error) {
 	orc := txn.db.orc
 	// Ensure that the order in which we get the commit timestamp is the same as
 	// the order in which we push these updates to the write channel. So, we
@@ -557,8 +921,14 @@ func (txn *Txn) commitAndSend() (func() error, error) {
 	orc.writeChLock.Lock()
 	defer orc.writeChLock.Unlock()
 
-	commitTs, conflict := orc.newCommitTs(txn)
-	if conflict {
+	commitTs, conflicts := orc.newCommitTs(txn)
+	if len(conflicts) > 0 {
+		keys := txn.keysForFingerprints(conflicts)
+		txn.db.conflicts.record(conflicts, keys)
+		y.NumTxnConflictsAdd(txn.db.opt.MetricsEnabled, 1)
+		if txn.db.opt.ConflictDetails {
+			return nil, &ConflictError{Fingerprints: conflicts, Keys: keys}
+		}
 		return nil, ErrConflict
 	}
 
@@ -581,7 +951,15 @@ func (txn *Txn) commitAndSend() (func() error, error) {
 
 	entries := make([]*Entry, 0, len(txn.pendingWrites)+len(txn.duplicateWrites)+1)
 
+	indexExpiry := txn.db.expiryIndexEnabled()
 	processEntry := func(e *Entry) {
+		if indexExpiry && e.ExpiresAt > 0 && e.meta&bitDelete == 0 {
+			ie := &Entry{Key: y.KeyWithTs(expiryIndexKey(e.ExpiresAt, e.Key), e.version)}
+			if keepTogether {
+				ie.meta |= bitTxn
+			}
+			entries = append(entries, ie)
+		}
 		// Suffix the keys with commit ts, so the key versions are sorted in
 		// descending order of commit timestamp.
 		e.Key = y.KeyWithTs(e.Key, e.version)
@@ -620,7 +998,11 @@ func (txn *Txn) commitAndSend() (func() error, error) {
 		entries = append(entries, e)
 	}
 
-	req, err := txn.db.sendToWriteCh(entries)
+	if txn.chunked {
+		return txn.sendChunks(ctx, entries, commitTs, async)
+	}
+
+	req, err := txn.db.sendTxnToWriteCh(ctx, entries, async)
 	if err != nil {
 		orc.doneCommit(commitTs)
 		return nil, err
@@ -636,6 +1018,35 @@ func (txn *Txn) commitAndSend() (func() error, error) {
 	return ret, nil
 }
 
+// sendChunks sends the entries of a chunked txn to the write channel. It must be called with
+// writeChLock held. The commitTs is only marked as done after all the chunks have been written, so
+// readers never see a partially applied transaction.
+//
+// Note that in managed mode, HandoverSkiplist could still rotate the memtable in between the
+// chunks, in which case the transaction is split across two WALs.
+func (txn *Txn) sendChunks(ctx context.Context, entries []*Entry, commitTs uint64,
+	async bool) (func() error, error) {
+	orc := txn.db.orc
+	reserve := txn.memtableSize(int64(len(entries)), txn.size)
+	chunks := txn.splitIntoChunks(entries)
+	reqs, err := txn.db.sendChunksToWriteCh(ctx, chunks, reserve, async)
+	if err != nil {
+		orc.doneCommit(commitTs)
+		return nil, err
+	}
+	ret := func() error {
+		var rerr error
+		for _, req := range reqs {
+			if err := req.Wait(); err != nil && rerr == nil {
+				rerr = err
+			}
+		}
+		orc.doneCommit(commitTs)
+		return rerr
+	}
+	return ret, nil
+}
+
 func (txn *Txn) commitPrecheck() error {
 	if txn.discarded {
 		return errors.New("Trying to commit a discarded txn")
@@ -662,7 +1073,8 @@ func (txn *Txn) commitPrecheck() error {
 //
 // 1. If there are no writes, return immediately.
 //
-// 2. Check if read rows were updated since txn started. If so, return ErrConflict.
+// 2. Check if read rows were updated since txn started. If so, return ErrConflict, or a
+// *ConflictError if ConflictDetails is enabled.
 //
 // 3. If no conflict, generate a commit timestamp and update written rows' commit ts.
 //
@@ -677,6 +1089,14 @@ func (txn *Txn) commitPrecheck() error {
 // If error is nil, the transaction is successfully committed. In case of a non-nil error, the LSM
 // tree won't be updated, so there's no need for any rollback.
 func (txn *Txn) Commit() error {
+	return txn.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit, but stops waiting for the writes once ctx is done, and returns
+// ctx.Err(). If the writes were already sent to the DB by then, they're still written in the
+// background, so the transaction may or may not be committed. The transaction is discarded either
+// way.
+func (txn *Txn) CommitContext(ctx context.Context) (rerr error) {
 	// txn.conflictKeys can be zero if conflict detection is turned off. So we
 	// should check txn.pendingWrites.
 	if len(txn.pendingWrites) == 0 {
@@ -686,17 +1106,56 @@ func (txn *Txn) Commit() error {
 	if err := txn.commitPrecheck(); err != nil {
 		return err
 	}
+	// Writing to the value log could wait for the read locks held by the values.
+	txn.releaseUnsafeItems()
 	defer txn.Discard()
 
-	txnCb, err := txn.commitAndSend()
+	entries := len(txn.pendingWrites) + len(txn.duplicateWrites)
+	span := txn.db.startSpan("Badger.Commit",
+		intAttr("entries", int64(entries)),
+		intAttr("bytes", txn.size))
+	start := time.Now()
+	defer func() {
+		y.CommitLatencyObserve(txn.db.opt.MetricsEnabled, time.Since(start))
+		txn.db.recordSlow(SlowLogEntry{
+			Op:       SlowCommit,
+			Start:    start,
+			Duration: time.Since(start),
+			Entries:  entries,
+			Bytes:    txn.size,
+			Err:      rerr,
+		})
+	}()
+	if err := ctx.Err(); err != nil {
+		span.End(err)
+		return err
+	}
+	txnCb, err := txn.commitAndSend(ctx, false)
 	if err != nil {
+		span.SetAttributes(boolAttr("conflict", errors.Is(err, ErrConflict)))
+		span.End(err)
 		return err
 	}
 	// If batchSet failed, LSM would not have been updated. So, no need to rollback anything.
 
 	// TODO: What if some of the txns successfully make it to value log, but others fail.
 	// Nothing gets updated to LSM, until a restart happens.
-	return txnCb()
+	if ctx.Done() == nil {
+		err = txnCb()
+	} else {
+		// txnCb only uses the requests, so it can complete after the transaction is discarded.
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- txnCb()
+		}()
+		select {
+		case err = <-errCh:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	span.End(err)
+	return err
 }
 
 type txnCb struct {
@@ -726,6 +1185,19 @@ func runTxnCallback(cb *txnCb) {
 // so it is safe to increment sync.WaitGroup before calling CommitWith, and
 // decrementing it in the callback; to block until all callbacks are run.
 func (txn *Txn) CommitWith(cb func(error)) {
+	txn.commitWith(cb, false)
+}
+
+// CommitAsync acts like CommitWith, but with SyncWrites set, the callback runs as soon as the
+// writes are in the value log and the memtable, before they're synced to disk. They're synced in
+// the background instead, and DB.WaitForSync waits until they are. This trades the durability of
+// the transaction on a hard reboot for the latency of the commit, per transaction. Without
+// SyncWrites, CommitAsync is the same as CommitWith.
+func (txn *Txn) CommitAsync(cb func(error)) {
+	txn.commitWith(cb, true)
+}
+
+func (txn *Txn) commitWith(cb func(error), async bool) {
 	if cb == nil {
 		panic("Nil callback provided to CommitWith")
 	}
@@ -743,10 +1215,11 @@ func (txn *Txn) CommitWith(cb func(error)) {
 		cb(err)
 		return
 	}
+	txn.releaseUnsafeItems()
 
 	defer txn.Discard()
 
-	commitCb, err := txn.commitAndSend()
+	commitCb, err := txn.commitAndSend(context.Background(), async)
 	if err != nil {
 		go runTxnCallback(&txnCb{user: cb, err: err})
 		return
@@ -806,6 +1279,9 @@ func (db *DB) newTransaction(update, isManaged bool) *Txn {
 			txn.conflictKeys = make(map[uint64]struct{})
 		}
 		txn.pendingWrites = make(map[string]*Entry)
+		if db.opt.ConflictDetails {
+			txn.readKeys = make(map[uint64][]byte)
+		}
 	}
 	if !isManaged {
 		txn.readTs = db.orc.readTs()
@@ -831,10 +1307,55 @@ func (db *DB) View(fn func(txn *Txn) error) error {
 	return fn(txn)
 }
 
+// NewReadTransactionAt creates a new read-only transaction, which reads the DB as of the given
+// read timestamp, i.e. it sees all the versions with Item.Version() <= readTs. This allows
+// reading older versions of keys without using managed mode. In managed mode, it is the same as
+// NewTransactionAt(readTs, false).
+//
+// The read timestamp can't be ahead of the latest commit. Note that older versions are only kept
+// for as long as NumVersionsToKeep allows. Once compactions discard the versions which were
+// visible at readTs, the transaction would see the key as missing.
+func (db *DB) NewReadTransactionAt(readTs uint64) (*Txn, error) {
+	if db.opt.managedTxns {
+		return db.NewTransactionAt(readTs, false), nil
+	}
+	txn := db.newTransaction(false, false)
+	if readTs > txn.readTs {
+		txn.Discard()
+		return nil, errors.Errorf("Read timestamp %d is ahead of the latest commit %d",
+			readTs, txn.readTs)
+	}
+	// The txn is not counted as a reader at readTs, so it doesn't hold back discardTs. Versions
+	// visible at readTs would be discarded by compactions anyway, if they're beyond
+	// NumVersionsToKeep.
+	db.orc.doneRead(txn)
+	txn.readTs = readTs
+	return txn, nil
+}
+
+// ViewAt is like View, but runs fn in a read-only transaction created via NewReadTransactionAt.
+func (db *DB) ViewAt(readTs uint64, fn func(txn *Txn) error) error {
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	txn, err := db.NewReadTransactionAt(readTs)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	return fn(txn)
+}
+
 // Update executes a function, creating and managing a read-write transaction
 // for the user. Error returned by the function is relayed by the Update method.
 // Update cannot be used with managed transactions.
 func (db *DB) Update(fn func(txn *Txn) error) error {
+	return db.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext is like Update, but commits the transaction with CommitContext.
+func (db *DB) UpdateContext(ctx context.Context, fn func(txn *Txn) error) error {
 	if db.IsClosed() {
 		return ErrDBClosed
 	}
@@ -848,5 +1369,72 @@ func (db *DB) Update(fn func(txn *Txn) error) error {
 		return err
 	}
 
-	return txn.Commit()
+	return txn.CommitContext(ctx)
+}
+
+// TxnRetryOptions is used to configure how RunTxnWithRetry retries a transaction.
+type TxnRetryOptions struct {
+	// MaxAttempts is the number of times the transaction is run, before ErrConflict is returned.
+	// Zero means it is retried until it commits, or the context is done.
+	MaxAttempts int
+	// InitialBackoff is the time waited before the first retry. It is doubled on each retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the time waited before a retry. Zero means no cap.
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the backoff which is randomized, between 0 and 1, so that the
+	// transactions which conflicted with each other aren't retried at the same time.
+	Jitter float64
+}
+
+// DefaultTxnRetryOptions are the default options of RunTxnWithRetry.
+var DefaultTxnRetryOptions = TxnRetryOptions{
+	MaxAttempts:    10,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     100 * time.Millisecond,
+	Jitter:         0.5,
+}
+
+// RunTxnWithRetry is like Update, but it runs fn in a new transaction again when the commit fails
+// with ErrConflict, waiting for an exponential backoff between the attempts. fn must therefore
+// only read and write through the transaction, and be safe to run several times.
+//
+// It returns the error of the last commit, ErrConflict or a *ConflictError with ConflictDetails,
+// once opt.MaxAttempts attempts conflicted, and the error of the context
+// if it is done before the transaction commits. The retries are counted by the
+// badger_v3_txn_retries_total metric.
+func (db *DB) RunTxnWithRetry(ctx context.Context, opt TxnRetryOptions,
+	fn func(txn *Txn) error) error {
+	if opt.Jitter < 0 || opt.Jitter > 1 {
+		return errors.Errorf("Invalid TxnRetryOptions.Jitter: %v. It must be between 0 and 1",
+			opt.Jitter)
+	}
+	backoff := opt.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := db.UpdateContext(ctx, fn)
+		if !errors.Is(err, ErrConflict) || attempt == opt.MaxAttempts {
+			return err
+		}
+		y.NumTxnRetriesAdd(db.opt.MetricsEnabled, 1)
+
+		wait := backoff
+		if opt.MaxBackoff > 0 && wait > opt.MaxBackoff {
+			wait = opt.MaxBackoff
+		}
+		wait -= time.Duration(opt.Jitter * rand.Float64() * float64(wait))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		if backoff < opt.MaxBackoff || opt.MaxBackoff <= 0 && backoff <= math.MaxInt64/2 {
+			backoff *= 2
+		}
+	}
 }
@@ -17,6 +17,10 @@
 package badger
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -162,6 +166,31 @@ func TestTxnCommitAsync(t *testing.T) {
 	})
 }
 
+func TestTxnCommitContext(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		txn := db.NewTransaction(true)
+		require.NoError(t, txn.Set([]byte("key1"), []byte("val1")))
+		require.Equal(t, context.Canceled, txn.CommitContext(ctx))
+		err := db.UpdateContext(ctx, func(txn *Txn) error {
+			return txn.Set([]byte("key2"), []byte("val2"))
+		})
+		require.Equal(t, context.Canceled, err)
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for _, key := range []string{"key1", "key2"} {
+				_, err := txn.Get([]byte(key))
+				require.Equal(t, ErrKeyNotFound, err)
+			}
+			return nil
+		}))
+		require.NoError(t, db.UpdateContext(context.Background(), func(txn *Txn) error {
+			return txn.Set([]byte("key2"), []byte("val2"))
+		}))
+	})
+}
+
 func TestTxnVersions(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		k := []byte("key")
@@ -964,3 +993,550 @@ func TestTxnGetters(t *testing.T) {
 		})
 	})
 }
+
+func TestTxnConflictStats(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		conflict := func(key []byte) {
+			txn := db.NewTransaction(true)
+			defer txn.Discard()
+			_, _ = txn.Get(key)
+			require.NoError(t, txn.Set(key, []byte("old")))
+
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set(key, []byte("new"))
+			}))
+			require.Equal(t, ErrConflict, txn.Commit())
+		}
+		conflict([]byte("cold"))
+		for i := 0; i < 3; i++ {
+			conflict([]byte(fmt.Sprintf("hot%d", i)))
+			conflict([]byte("hot"))
+		}
+
+		stats := db.ConflictStats(2)
+		require.Len(t, stats, 2)
+		require.Equal(t, []byte("hot"), stats[0].Key)
+		require.Equal(t, z.MemHash([]byte("hot")), stats[0].Fingerprint)
+		require.Equal(t, uint64(3), stats[0].Total)
+		require.InDelta(t, 3.0, stats[0].Count, 0.1)
+		require.Len(t, db.ConflictStats(-1), 5)
+	})
+}
+
+func TestTxnConflictStatsClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	hotKeys := expvar.Get("badger_v3_hot_conflict_keys").(*expvar.Map)
+	require.NotNil(t, hotKeys.Get(dir))
+	require.NoError(t, db.Close())
+	require.Nil(t, hotKeys.Get(dir))
+}
+
+func TestTxnSavepoint(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("existing"), []byte("v0"))
+		}))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("a"), []byte("a1")))
+		count, size := txn.count, txn.size
+
+		sp1, err := txn.Savepoint()
+		require.NoError(t, err)
+		require.NoError(t, txn.Set([]byte("a"), []byte("a2")))
+		require.NoError(t, txn.Set([]byte("b"), []byte("b1")))
+		require.NoError(t, txn.Delete([]byte("existing")))
+
+		sp2, err := txn.Savepoint()
+		require.NoError(t, err)
+		require.NoError(t, txn.Set([]byte("c"), []byte("c1")))
+
+		require.NoError(t, txn.RollbackTo(sp1))
+		// Rolling back to sp1 invalidates sp2, but not sp1.
+		require.Equal(t, ErrInvalidSavepoint, txn.RollbackTo(sp2))
+		require.NoError(t, txn.RollbackTo(sp1))
+		require.Equal(t, count, txn.count)
+		require.Equal(t, size, txn.size)
+		require.Len(t, txn.conflictKeys, 1)
+
+		checkVal := func(txn *Txn, key, val string) {
+			item, err := txn.Get([]byte(key))
+			if val == "" {
+				require.Equal(t, ErrKeyNotFound, err)
+				return
+			}
+			require.NoError(t, err)
+			v, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, val, string(v))
+		}
+		checkVal(txn, "a", "a1")
+		checkVal(txn, "b", "")
+		checkVal(txn, "existing", "v0")
+
+		require.NoError(t, txn.Set([]byte("d"), []byte("d1")))
+		require.NoError(t, txn.Commit())
+
+		other := db.NewTransaction(true)
+		defer other.Discard()
+		_, err = other.Savepoint()
+		require.NoError(t, err)
+		require.Equal(t, ErrInvalidSavepoint, other.RollbackTo(sp1))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			checkVal(txn, "a", "a1")
+			checkVal(txn, "b", "")
+			checkVal(txn, "c", "")
+			checkVal(txn, "d", "d1")
+			checkVal(txn, "existing", "v0")
+			return nil
+		}))
+
+		ro := db.NewTransaction(false)
+		defer ro.Discard()
+		_, err = ro.Savepoint()
+		require.Equal(t, ErrReadOnlyTxn, err)
+	})
+}
+
+func TestTxnConflictError(t *testing.T) {
+	opt := getTestOptions("").WithConflictDetails(true)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		_, err := txn.Get([]byte("read-only"))
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = txn.Get([]byte("untouched"))
+		require.Equal(t, ErrKeyNotFound, err)
+		require.NoError(t, txn.Set([]byte("other"), []byte("v")))
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("read-only"), []byte("v"))
+		}))
+
+		err = txn.Commit()
+		require.True(t, errors.Is(err, ErrConflict))
+		var cerr *ConflictError
+		require.True(t, errors.As(err, &cerr))
+		require.Equal(t, [][]byte{[]byte("read-only")}, cerr.Keys)
+		require.Equal(t, []uint64{z.MemHash([]byte("read-only"))}, cerr.Fingerprints)
+		require.Contains(t, err.Error(), `"read-only"`)
+	})
+}
+
+func TestTxnGetAllVersions(t *testing.T) {
+	opt := getTestOptions("")
+	opt.NumVersionsToKeep = 3
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		set := func(key, val string) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(key), []byte(val))
+			}))
+		}
+		for i := 0; i < 5; i++ {
+			set("a", fmt.Sprintf("a%d", i))
+		}
+		set("b", "b0")
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Delete([]byte("b"))
+		}))
+		set("b", "b1")
+		set("c", "c0")
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		list, err := txn.GetAllVersions([][]byte{[]byte("c"), []byte("missing"), []byte("b"),
+			[]byte("a"), []byte("b")})
+		require.NoError(t, err)
+
+		type kv struct {
+			key, val string
+			deleted  bool
+		}
+		var got []kv
+		for i, v := range list.Kv {
+			got = append(got, kv{string(v.Key), string(v.Value), v.Meta[0]&bitDelete > 0})
+			if i > 0 && bytes.Equal(v.Key, list.Kv[i-1].Key) {
+				require.Less(t, v.Version, list.Kv[i-1].Version)
+			}
+		}
+		require.Equal(t, []kv{
+			{"a", "a4", false}, {"a", "a3", false}, {"a", "a2", false},
+			{"b", "b1", false}, {"b", "", true},
+			{"c", "c0", false},
+		}, got)
+
+		_, err = txn.GetAllVersions([][]byte{nil})
+		require.Equal(t, ErrEmptyKey, err)
+	})
+}
+
+func TestTxnAutoChunking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir)
+	opt.MemTableSize = 1 << 20
+	opt.ValueThreshold = 1 << 12
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	// Fill the memtable partially, so the chunked txn needs a new one.
+	val := make([]byte, 1<<10)
+	for i := 0; i < 300; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("pre%04d", i)), val)
+		}))
+	}
+
+	const n = 500
+	write := func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	txn := db.NewTransaction(true)
+	require.Equal(t, ErrTxnTooBig, write(txn))
+	txn.Discard()
+
+	txn = db.NewTransaction(true)
+	require.NoError(t, txn.EnableAutoChunking())
+	require.NoError(t, write(txn))
+	require.Greater(t, txn.size, db.opt.maxBatchSize)
+	require.NoError(t, txn.Commit())
+
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+				require.NoError(t, err)
+				require.Equal(t, int64(len(val)), item.ValueSize())
+			}
+			return nil
+		}))
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(db)
+
+	txn = db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("foo"), nil))
+	require.Error(t, txn.EnableAutoChunking())
+	txn.Discard()
+}
+
+func TestTxnViewAt(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		var versions []uint64
+		for i := 0; i < 3; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set(key, []byte(fmt.Sprintf("val%d", i)))
+			}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				versions = append(versions, item.Version())
+				return nil
+			}))
+		}
+
+		for i, version := range versions {
+			require.NoError(t, db.ViewAt(version, func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, version, item.Version())
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("val%d", i), string(val))
+				return nil
+			}))
+		}
+		require.NoError(t, db.ViewAt(versions[0]-1, func(txn *Txn) error {
+			_, err := txn.Get(key)
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+		require.Error(t, db.ViewAt(versions[2]+1, func(txn *Txn) error { return nil }))
+	})
+}
+
+func TestTxnGetHistory(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		update := func(fn func(txn *Txn) error) {
+			require.NoError(t, db.Update(fn))
+		}
+		for i := 0; i < 2; i++ {
+			update(func(txn *Txn) error { return txn.Set(key, []byte(fmt.Sprintf("v%d", i))) })
+		}
+		update(func(txn *Txn) error { return txn.Delete(key) })
+		update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry(key, []byte("v2")).WithDiscard())
+		})
+		update(func(txn *Txn) error { return txn.Set([]byte("key2"), []byte("other")) })
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		history, err := txn.GetHistory(key, 0)
+		require.NoError(t, err)
+		var got []string
+		for i, kv := range history {
+			require.Equal(t, key, kv.Key)
+			if i > 0 {
+				require.Less(t, kv.Version, history[i-1].Version)
+			}
+			switch {
+			case kv.Meta[0]&bitDelete > 0:
+				got = append(got, "deleted")
+			case kv.Meta[0]&BitDiscardEarlierVersions > 0:
+				got = append(got, string(kv.Value)+"!")
+			default:
+				got = append(got, string(kv.Value))
+			}
+		}
+		require.Equal(t, []string{"v2!", "deleted", "v1", "v0"}, got)
+
+		history, err = txn.GetHistory(key, 2)
+		require.NoError(t, err)
+		require.Len(t, history, 2)
+
+		history, err = txn.GetHistory([]byte("missing"), 0)
+		require.NoError(t, err)
+		require.Empty(t, history)
+	})
+}
+
+func TestUserMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(32).WithVerifyValueChecksum(true)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	// The small value is stored in the LSM tree, and the big one in the value log.
+	values := map[string][]byte{
+		"small": []byte("value"),
+		"big":   bytes.Repeat([]byte("v"), 100),
+		"plain": []byte("no metadata"),
+	}
+	metadata := map[string][]byte{
+		"small": []byte("schema=1"),
+		"big":   bytes.Repeat([]byte("m"), MaxUserMetadataSize),
+	}
+	check := func(txn *Txn) {
+		for key, val := range values {
+			item, err := txn.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, metadata[key], item.UserMetadata(), key)
+			require.Equal(t, byte(7), item.UserMeta())
+			require.Equal(t, val, getItemValue(t, item), key)
+			r, err := item.ValueReader()
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, val, got, key)
+		}
+		for _, prefetch := range []bool{false, true} {
+			iopt := DefaultIteratorOptions
+			iopt.PrefetchValues = prefetch
+			it := txn.NewIterator(iopt)
+			var n int
+			for it.Rewind(); it.Valid(); it.Next() {
+				key := string(it.Item().Key())
+				require.Equal(t, metadata[key], it.Item().UserMetadata(), key)
+				require.Equal(t, values[key], getItemValue(t, it.Item()), key)
+				n++
+			}
+			it.Close()
+			require.Equal(t, len(values), n)
+		}
+	}
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for key, val := range values {
+			e := NewEntry([]byte(key), val).WithMeta(7).WithUserMetadata(metadata[key])
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		// The pending writes have their user metadata too.
+		check(txn)
+		return nil
+	}))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		check(txn)
+		return nil
+	}))
+	require.Error(t, db.Update(func(txn *Txn) error {
+		e := NewEntry([]byte("key"), nil).WithUserMetadata(make([]byte, MaxUserMetadataSize+1))
+		return txn.SetEntry(e)
+	}))
+
+	// The user metadata is kept in the tables, and in backups.
+	require.NoError(t, db.Close())
+	db, err = Open(opt.WithCompactL0OnClose(true))
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		check(txn)
+		return nil
+	}))
+	var buf bytes.Buffer
+	_, err = db.Backup(&buf, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	dir2, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir2)
+	db, err = Open(opt.WithDir(dir2).WithValueDir(dir2))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.Load(&buf, 16))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		check(txn)
+		return nil
+	}))
+}
+
+func TestRunTxnWithRetry(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("counter")
+		increment := func(txn *Txn) (int, error) {
+			n := 0
+			item, err := txn.Get(key)
+			switch {
+			case err == ErrKeyNotFound:
+			case err != nil:
+				return 0, err
+			default:
+				val, err := item.ValueCopy(nil)
+				if err != nil {
+					return 0, err
+				}
+				if n, err = strconv.Atoi(string(val)); err != nil {
+					return 0, err
+				}
+			}
+			return n + 1, txn.Set(key, []byte(strconv.Itoa(n+1)))
+		}
+		opt := TxnRetryOptions{MaxAttempts: 5, InitialBackoff: time.Millisecond, Jitter: 0.5}
+
+		// A conflicting write is committed during the first two attempts.
+		attempts := 0
+		require.NoError(t, db.RunTxnWithRetry(context.Background(), opt, func(txn *Txn) error {
+			attempts++
+			if _, err := increment(txn); err != nil {
+				return err
+			}
+			if attempts <= 2 {
+				return db.Update(func(txn *Txn) error {
+					_, err := increment(txn)
+					return err
+				})
+			}
+			return nil
+		}))
+		require.Equal(t, 3, attempts)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, "3", string(getItemValue(t, item)))
+			return nil
+		}))
+
+		// The errors of fn aren't retried.
+		attempts = 0
+		errFn := errors.New("fn failed")
+		require.Equal(t, errFn, db.RunTxnWithRetry(context.Background(), opt, func(txn *Txn) error {
+			attempts++
+			return errFn
+		}))
+		require.Equal(t, 1, attempts)
+
+		conflict := func(txn *Txn) error {
+			attempts++
+			if _, err := increment(txn); err != nil {
+				return err
+			}
+			return db.Update(func(txn *Txn) error {
+				_, err := increment(txn)
+				return err
+			})
+		}
+		attempts = 0
+		require.Equal(t, ErrConflict, db.RunTxnWithRetry(context.Background(), opt, conflict))
+		require.Equal(t, opt.MaxAttempts, attempts)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		attempts = 0
+		opt = TxnRetryOptions{InitialBackoff: time.Hour}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		require.Equal(t, context.Canceled, db.RunTxnWithRetry(ctx, opt, conflict))
+		require.Equal(t, 1, attempts)
+
+		opt.Jitter = 2
+		require.Error(t, db.RunTxnWithRetry(context.Background(), opt, conflict))
+	})
+}
+
+func TestRunTxnWithRetryConflictDetails(t *testing.T) {
+	dbOpt := getTestOptions("").WithConflictDetails(true)
+	runBadgerTest(t, &dbOpt, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		opt := TxnRetryOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+		write := func(txn *Txn) error {
+			if _, err := txn.Get(key); err != nil && err != ErrKeyNotFound {
+				return err
+			}
+			return txn.Set(key, []byte("value"))
+		}
+
+		// The commits fail with a *ConflictError, which is retried too.
+		attempts := 0
+		require.NoError(t, db.RunTxnWithRetry(context.Background(), opt, func(txn *Txn) error {
+			attempts++
+			if err := write(txn); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				return db.Update(write)
+			}
+			return nil
+		}))
+		require.Equal(t, 2, attempts)
+
+		attempts = 0
+		err := db.RunTxnWithRetry(context.Background(), opt, func(txn *Txn) error {
+			attempts++
+			if err := write(txn); err != nil {
+				return err
+			}
+			return db.Update(write)
+		})
+		var conflictErr *ConflictError
+		require.True(t, errors.As(err, &conflictErr))
+		require.True(t, errors.Is(err, ErrConflict))
+		require.Equal(t, opt.MaxAttempts, attempts)
+	})
+}
@@ -18,7 +18,6 @@ package badger
 
 import (
 	"encoding/hex"
-	"io/ioutil"
 	"math/rand"
 	"sync/atomic"
 	"time"
@@ -95,8 +94,8 @@ func (s *levelsController) reserveFileID() uint64 {
 	return id - 1
 }
 
-func getIDMap(dir string) map[uint64]struct{} {
-	fileInfos, err := ioutil.ReadDir(dir)
+func getIDMap(fs y.FS, dir string) map[uint64]struct{} {
+	fileInfos, err := fs.ReadDir(dir)
 	y.Check(err)
 	idMap := make(map[uint64]struct{})
 	for _, info := range fileInfos {
@@ -19,11 +19,11 @@ package badger
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
 	"fmt"
 	"hash"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"math"
 	"os"
 	"sort"
@@ -31,6 +31,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger/v3/skl"
 	"github.com/dgraph-io/badger/v3/y"
@@ -51,6 +52,10 @@ const (
 	BitDiscardEarlierVersions byte = 1 << 2 // Set if earlier versions can be discarded.
 	// Set if item shouldn't be discarded via compactions (used by merge operator)
 	bitMergeEntry byte = 1 << 3
+	// Set if the value is followed by the user metadata of the entry.
+	bitUserMetadata byte = 1 << 4
+	// Set in the value log if the value of the entry was punched out by GC.
+	bitPunched byte = 1 << 5
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
 	bitFinTxn byte = 1 << 7 // Set if the entry is to indicate end of txn in value log.
@@ -120,6 +125,9 @@ func (t *hashReader) Sum32() uint32 {
 // read. Returns error on failure.
 func (r *safeRead) Entry(reader io.Reader) (*Entry, error) {
 	tee := newHashReader(reader)
+	if r.lf.seeded {
+		y.Check2(tee.h.Write(r.lf.baseIV))
+	}
 	var h header
 	hlen, err := h.DecodeFrom(tee)
 	if err != nil {
@@ -140,20 +148,14 @@ func (r *safeRead) Entry(reader io.Reader) (*Entry, error) {
 	e := &Entry{}
 	e.offset = r.recordOffset
 	e.hlen = hlen
-	buf := make([]byte, h.klen+h.vlen)
+	buf := make([]byte, kl+vl+r.lf.tagSize())
 	if _, err := io.ReadFull(tee, buf[:]); err != nil {
 		if err == io.EOF {
 			err = errTruncate
 		}
 		return nil, err
 	}
-	if r.lf.encryptionEnabled() {
-		if buf, err = r.lf.decryptKV(buf[:], r.recordOffset); err != nil {
-			return nil, err
-		}
-	}
-	e.Key = buf[:h.klen]
-	e.Value = buf[h.klen:]
+	raw := buf
 	var crcBuf [crc32.Size]byte
 	if _, err := io.ReadFull(reader, crcBuf[:]); err != nil {
 		if err == io.EOF {
@@ -162,9 +164,27 @@ func (r *safeRead) Entry(reader io.Reader) (*Entry, error) {
 		return nil, err
 	}
 	crc := y.BytesToU32(crcBuf[:])
+	if h.meta&bitPunched > 0 && r.lf.isValueLog() {
+		valueOff := int64(e.offset) + int64(hlen) + int64(kl)
+		if crc != punchedChecksum(h, raw, valueOff) {
+			return nil, errTruncate
+		}
+		// The entry was discarded, and its value punched out by GC. Skip it.
+		r.recordOffset += uint32(hlen + len(raw) + crc32.Size)
+		return nil, nil
+	}
 	if crc != tee.Sum32() {
 		return nil, errTruncate
 	}
+	if r.lf.encryptionEnabled() {
+		// The checksum matches, so an entry failing authentication was tampered with.
+		var hbuf [maxHeaderSize]byte
+		if buf, err = r.lf.decryptKV(hbuf[:h.Encode(hbuf[:])], buf, r.recordOffset); err != nil {
+			return nil, err
+		}
+	}
+	e.Key = buf[:h.klen]
+	e.Value = buf[h.klen : h.klen+h.vlen]
 	e.meta = h.meta
 	e.UserMeta = h.userMeta
 	e.ExpiresAt = h.expiresAt
@@ -211,25 +231,31 @@ func (vlog *valueLog) calculateDiscardStat(f *logFile) (discardedRatio float64,
 	return float64(discarded) / float64(count), nil
 }
 
-func (vlog *valueLog) rewrite(f *logFile) error {
+// rewrite moves the live entries of the given log file to the newest log file, and removes the
+// file. It returns the number of entries moved, and their total size.
+func (vlog *valueLog) rewrite(ctx context.Context, f *logFile) (int, int64, error) {
 	vlog.filesLock.RLock()
 	for _, fid := range vlog.filesToBeDeleted {
 		if fid == f.fid {
 			vlog.filesLock.RUnlock()
-			return errors.Errorf("value log file already marked for deletion fid: %d", fid)
+			return 0, 0, errors.Errorf("value log file already marked for deletion fid: %d", fid)
 		}
 	}
 	maxFid := vlog.maxFid
 	y.AssertTruef(uint32(f.fid) < maxFid, "fid to move: %d. Current max fid: %d", f.fid, maxFid)
 	vlog.filesLock.RUnlock()
 
-	vlog.opt.Infof("Rewriting fid: %d", f.fid)
+	vlog.opt.logw(INFO, "Rewriting value log file", "fid", f.fid)
 	wb := make([]*Entry, 0, 1000)
 	var size int64
 
 	y.AssertTrue(vlog.db != nil)
 	var count, moved int
+	var movedSize int64
 	fe := func(e Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		count++
 		if count%100000 == 0 {
 			vlog.opt.Debugf("Processing entry %d", count)
@@ -275,7 +301,7 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 			ne.ExpiresAt = e.ExpiresAt
 			ne.Key = append([]byte{}, e.Key...)
 			ne.Value = append([]byte{}, e.Value...)
-			es := ne.estimateSizeAndSetThreshold(vlog.db.valueThreshold())
+			es := ne.estimateSizeAndSetThreshold(vlog.db.valueThresholdFor(ne.Key))
 			// Consider size of value as well while considering the total size
 			// of the batch. There have been reports of high memory usage in
 			// rewrite because we don't consider the value size. See #1292.
@@ -292,6 +318,7 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 			}
 			wb = append(wb, ne)
 			size += es
+			movedSize += int64(len(ne.Key) + len(ne.Value))
 		} else {
 			// It might be possible that the entry read from LSM Tree points to
 			// an older vlog file.  This can happen in the following situation.
@@ -350,8 +377,12 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 	_, err := f.iterate(vlog.opt.ReadOnly, 0, func(e Entry, vp valuePointer) error {
 		return fe(e)
 	})
+	if cerr := ctx.Err(); cerr != nil {
+		// The entries moved so far are harmless, as they are found in the newer files.
+		return 0, 0, cerr
+	}
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	batchSize := 1024
@@ -360,7 +391,7 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 		loops++
 		if batchSize == 0 {
 			vlog.db.opt.Warningf("We shouldn't reach batch size of zero.")
-			return ErrNoRewrite
+			return 0, 0, ErrNoRewrite
 		}
 		end := i + batchSize
 		if end > len(wb) {
@@ -372,13 +403,12 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 				batchSize = batchSize / 2
 				continue
 			}
-			return err
+			return 0, 0, err
 		}
 		i += batchSize
 	}
-	vlog.opt.Infof("Processed %d entries in %d loops", len(wb), loops)
-	vlog.opt.Infof("Total entries: %d. Moved: %d", count, moved)
-	vlog.opt.Infof("Removing fid: %d", f.fid)
+	vlog.opt.logw(INFO, "Rewrote value log file", "fid", f.fid, "entries", count,
+		"moved", moved, "batches", loops)
 	var deleteFileNow bool
 	// Entries written to LSM. Remove the older file now.
 	{
@@ -386,7 +416,7 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 		// Just a sanity-check.
 		if _, ok := vlog.filesMap[f.fid]; !ok {
 			vlog.filesLock.Unlock()
-			return errors.Errorf("Unable to find fid: %d", f.fid)
+			return 0, 0, errors.Errorf("Unable to find fid: %d", f.fid)
 		}
 		if vlog.iteratorCount() == 0 {
 			delete(vlog.filesMap, f.fid)
@@ -399,14 +429,17 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 
 	if deleteFileNow {
 		if err := vlog.deleteLogFile(f); err != nil {
-			return err
+			return 0, 0, err
 		}
 	}
-	return nil
+	return moved, movedSize, nil
 }
 
 func (vlog *valueLog) incrIteratorCount() {
 	atomic.AddInt32(&vlog.numActiveIterators, 1)
+	if vlog.large != nil {
+		vlog.large.incrIteratorCount()
+	}
 }
 
 func (vlog *valueLog) iteratorCount() int {
@@ -414,6 +447,11 @@ func (vlog *valueLog) iteratorCount() int {
 }
 
 func (vlog *valueLog) decrIteratorCount() error {
+	if vlog.large != nil {
+		if err := vlog.large.decrIteratorCount(); err != nil {
+			return err
+		}
+	}
 	num := atomic.AddInt32(&vlog.numActiveIterators, -1)
 	if num != 0 {
 		return nil
@@ -466,7 +504,7 @@ func (vlog *valueLog) dropAll() (int, error) {
 			count++
 		}
 		vlog.filesMap = make(map[uint32]*logFile)
-		vlog.maxFid = 0
+		vlog.maxFid = vlog.fidBase
 		return nil
 	}
 	if err := deleteAll(); err != nil {
@@ -477,6 +515,10 @@ func (vlog *valueLog) dropAll() (int, error) {
 	if _, err := vlog.createVlogFile(); err != nil { // Called while writes are stopped.
 		return count, err
 	}
+	if vlog.large != nil {
+		n, err := vlog.large.dropAll()
+		return count + n, err
+	}
 	return count, nil
 }
 
@@ -495,6 +537,8 @@ type valueLog struct {
 	filesToBeDeleted []uint32
 	// A refcount of iterators -- when this hits zero, we can delete the filesToBeDeleted.
 	numActiveIterators int32
+	// noPunch is set if punching holes in the log files failed because it's unsupported.
+	noPunch int32
 
 	db                *DB
 	writableLogOffset uint32 // read by read, written by write. Must access via atomics.
@@ -503,20 +547,39 @@ type valueLog struct {
 
 	garbageCh    chan struct{}
 	discardStats *discardStats
+
+	// large is the value log storing the values of size at least LargeValueThreshold, in
+	// LargeValueDir. It is nil if LargeValueDir is not set.
+	large *valueLog
+	// fidBase is added to the ids of the files in dirPath, so the file ids of all the value logs
+	// are distinct. It is zero for the main value log, and largeFidBase for the large one.
+	fidBase uint32
 }
 
+// largeFidBase is the first file id of the large value log. The value pointers of the large values
+// are routed to it using their file id.
+const largeFidBase = 1 << 31
+
 func vlogFilePath(dirPath string, fid uint32) string {
 	return fmt.Sprintf("%s%s%06d.vlog", dirPath, string(os.PathSeparator), fid)
 }
 
 func (vlog *valueLog) fpath(fid uint32) string {
-	return vlogFilePath(vlog.dirPath, fid)
+	return vlogFilePath(vlog.dirPath, fid-vlog.fidBase)
+}
+
+// logFor returns the value log which stores the file with the given id.
+func (vlog *valueLog) logFor(fid uint32) *valueLog {
+	if vlog.large != nil && fid >= largeFidBase {
+		return vlog.large
+	}
+	return vlog
 }
 
 func (vlog *valueLog) populateFilesMap() error {
 	vlog.filesMap = make(map[uint32]*logFile)
 
-	files, err := ioutil.ReadDir(vlog.dirPath)
+	files, err := vlog.opt.FS.ReadDir(vlog.dirPath)
 	if err != nil {
 		return errFile(err, vlog.dirPath, "Unable to open log dir.")
 	}
@@ -527,7 +590,7 @@ func (vlog *valueLog) populateFilesMap() error {
 			continue
 		}
 		fsz := len(file.Name())
-		fid, err := strconv.ParseUint(file.Name()[:fsz-5], 10, 32)
+		fid, err := strconv.ParseUint(file.Name()[:fsz-5], 10, 31)
 		if err != nil {
 			return errFile(err, file.Name(), "Unable to parse log id.")
 		}
@@ -535,6 +598,7 @@ func (vlog *valueLog) populateFilesMap() error {
 			return errFile(err, file.Name(), "Duplicate file found. Please delete one.")
 		}
 		found[fid] = struct{}{}
+		fid += uint64(vlog.fidBase)
 
 		lf := &logFile{
 			fid:      uint32(fid),
@@ -563,6 +627,10 @@ func (vlog *valueLog) createVlogFile() (*logFile, error) {
 	if err != z.NewFile && err != nil {
 		return nil, err
 	}
+	// The values written to the file would be lost with its directory entry.
+	if err := vlog.db.syncDir(vlog.dirPath); err != nil {
+		return nil, errFile(err, vlog.dirPath, "Sync value log dir")
+	}
 
 	vlog.filesLock.Lock()
 	vlog.filesMap[fid] = lf
@@ -595,18 +663,51 @@ func (vlog *valueLog) init(db *DB) {
 	vlog.dirPath = vlog.opt.ValueDir
 
 	vlog.garbageCh = make(chan struct{}, 1) // Only allow one GC at a time.
+	// In Secondary mode, the files are opened by DB.catchUp.
+	vlog.filesMap = make(map[uint32]*logFile)
 	lf, err := InitDiscardStats(vlog.opt)
 	y.Check(err)
 	vlog.discardStats = lf
+
+	if vlog.opt.LargeValueDir != "" {
+		vlog.large = &valueLog{
+			dirPath:   vlog.opt.LargeValueDir,
+			maxFid:    largeFidBase,
+			nextGCFid: largeFidBase,
+			db:        db,
+			opt:       db.opt,
+			garbageCh: make(chan struct{}, 1),
+			fidBase:   largeFidBase,
+			filesMap:  make(map[uint32]*logFile),
+		}
+		// The discard stats are kept next to the value log files.
+		opt := vlog.opt
+		opt.ValueDir = opt.LargeValueDir
+		lf, err := InitDiscardStats(opt)
+		y.Check(err)
+		vlog.large.discardStats = lf
+	}
 }
 
 func (vlog *valueLog) open(db *DB) error {
 	// We don't need to open any vlog files or collect stats for GC if DB is opened
-	// in InMemory mode. InMemory mode doesn't create any files/directories on disk.
-	if db.opt.InMemory {
+	// in InMemory mode. InMemory mode doesn't create any files/directories on disk. In Secondary
+	// mode, the files are opened by DB.catchUp.
+	if db.opt.InMemory || db.opt.Secondary {
 		return nil
 	}
 
+	if err := vlog.openFiles(); err != nil {
+		return err
+	}
+	if vlog.large != nil {
+		return y.Wrapf(vlog.large.openFiles(), "while opening value log in: %s",
+			vlog.large.dirPath)
+	}
+	return nil
+}
+
+func (vlog *valueLog) openFiles() error {
 	if err := vlog.populateFilesMap(); err != nil {
 		return err
 	}
@@ -688,6 +789,11 @@ func (vlog *valueLog) Close() error {
 			err = terr
 		}
 	}
+	if vlog.large != nil {
+		if terr := vlog.large.Close(); terr != nil && err == nil {
+			err = terr
+		}
+	}
 	return err
 }
 
@@ -718,6 +824,16 @@ type request struct {
 	Wg   sync.WaitGroup
 	Err  error
 	ref  int32
+
+	// reserve is the number of bytes the memtable must have room for before this request is
+	// written. It is set on the first request of a chunked transaction. See sendChunksToWriteCh.
+	reserve int64
+	// continued is set on the requests continuing a chunked transaction. They must be written to
+	// the same memtable as the previous request, so the transaction stays in a single WAL.
+	continued bool
+	// async is set on the requests of Txn.CommitAsync, which are acked before their writes are
+	// synced to disk. See DB.WaitForSync.
+	async bool
 }
 
 type handoverRequest struct {
@@ -727,12 +843,25 @@ type handoverRequest struct {
 	wg       sync.WaitGroup
 }
 
+// allAsync returns true if all the requests are acked before their writes are synced.
+func allAsync(reqs []*request) bool {
+	for _, req := range reqs {
+		if !req.async {
+			return false
+		}
+	}
+	return len(reqs) > 0
+}
+
 func (req *request) reset() {
 	req.Entries = req.Entries[:0]
 	req.Ptrs = req.Ptrs[:0]
 	req.Wg = sync.WaitGroup{}
 	req.Err = nil
 	req.ref = 0
+	req.reserve = 0
+	req.async = false
+	req.continued = false
 }
 
 func (req *request) IncrRef() {
@@ -778,7 +907,11 @@ func (vlog *valueLog) sync() error {
 	if vlog.opt.SyncWrites || vlog.opt.InMemory {
 		return nil
 	}
+	return vlog.syncLatest()
+}
 
+// syncLatest syncs the latest value log file to disk, irrespective of SyncWrites.
+func (vlog *valueLog) syncLatest() error {
 	vlog.filesLock.RLock()
 	maxFid := vlog.maxFid
 	curlf := vlog.filesMap[maxFid]
@@ -792,8 +925,13 @@ func (vlog *valueLog) sync() error {
 	curlf.lock.RLock()
 	vlog.filesLock.RUnlock()
 
+	start := time.Now()
 	err := curlf.Sync()
+	y.VlogSyncLatencyObserve(vlog.opt.MetricsEnabled, time.Since(start))
 	curlf.lock.RUnlock()
+	if err == nil && vlog.large != nil {
+		err = vlog.large.syncLatest()
+	}
 	return err
 }
 
@@ -801,6 +939,26 @@ func (vlog *valueLog) woffset() uint32 {
 	return atomic.LoadUint32(&vlog.writableLogOffset)
 }
 
+// rotate makes the value log, and the large value log, write to new files, unless their files are
+// empty. It must be called while the writes are blocked.
+func (vlog *valueLog) rotate() error {
+	for _, l := range []*valueLog{vlog, vlog.large} {
+		if l == nil || l.woffset() <= vlogHeaderSize {
+			continue
+		}
+		l.filesLock.RLock()
+		curlf := l.filesMap[l.maxFid]
+		l.filesLock.RUnlock()
+		if err := curlf.doneWriting(l.woffset()); err != nil {
+			return err
+		}
+		if _, err := l.createVlogFile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // validateWrites will check whether the given requests can fit into 4GB vlog file.
 // NOTE: 4GB is the maximum size we can create for vlog because value pointer offset is of type
 // uint32. If we create more than 4GB, it will overflow uint32. So, limiting the size to 4GB.
@@ -831,7 +989,7 @@ func (vlog *valueLog) validateWrites(reqs []*request) error {
 func estimateRequestSize(req *request) uint64 {
 	size := uint64(0)
 	for _, e := range req.Entries {
-		size += uint64(maxHeaderSize + len(e.Key) + len(e.Value) + crc32.Size)
+		size += uint64(maxHeaderSize + len(e.Key) + len(e.Value) + y.AEADTagSize + crc32.Size)
 	}
 	return size
 }
@@ -849,26 +1007,46 @@ func (vlog *valueLog) write(reqs []*request) error {
 		return y.Wrapf(err, "while validating writes")
 	}
 
-	vlog.filesLock.RLock()
-	maxFid := vlog.maxFid
-	curlf := vlog.filesMap[maxFid]
-	vlog.filesLock.RUnlock()
+	// The values are written to the main value log, or to the large value log if there is one and
+	// the value is large enough.
+	logs := []*valueLog{vlog}
+	if vlog.large != nil {
+		logs = append(logs, vlog.large)
+	}
+	curlfs := make([]*logFile, len(logs))
+	// Whether anything was written to the files since they were synced. The small values only go
+	// to the WAL of the memtable, and don't need the value log to be synced.
+	dirty := make([]bool, len(logs))
+	for i, l := range logs {
+		l.filesLock.RLock()
+		curlfs[i] = l.filesMap[l.maxFid]
+		l.filesLock.RUnlock()
+	}
 
 	defer func() {
-		if vlog.opt.SyncWrites {
-			if err := curlf.Sync(); err != nil {
-				vlog.opt.Errorf("Error while curlf sync: %v\n", err)
+		// The async requests are synced in the background, unless they're batched with others.
+		if vlog.opt.SyncWrites && !allAsync(reqs) {
+			for i, curlf := range curlfs {
+				if !dirty[i] {
+					continue
+				}
+				start := time.Now()
+				if err := curlf.Sync(); err != nil {
+					vlog.opt.Errorf("Error while curlf sync: %v\n", err)
+				}
+				y.VlogSyncLatencyObserve(vlog.opt.MetricsEnabled, time.Since(start))
 			}
 		}
 	}()
 
-	write := func(buf *bytes.Buffer) error {
+	write := func(i int, buf *bytes.Buffer) error {
 		if buf.Len() == 0 {
 			return nil
 		}
 
+		l, curlf := logs[i], curlfs[i]
 		n := uint32(buf.Len())
-		endOffset := atomic.AddUint32(&vlog.writableLogOffset, n)
+		endOffset := atomic.AddUint32(&l.writableLogOffset, n)
 		// Increase the file size if we cannot accommodate this entry.
 		if int(endOffset) >= len(curlf.Data) {
 			curlf.Truncate(int64(endOffset))
@@ -878,21 +1056,26 @@ func (vlog *valueLog) write(reqs []*request) error {
 		y.AssertTrue(copy(curlf.Data[start:], buf.Bytes()) == int(n))
 
 		atomic.StoreUint32(&curlf.size, endOffset)
+		dirty[i] = true
 		return nil
 	}
 
 	toDisk := func() error {
-		if vlog.woffset() > uint32(vlog.opt.ValueLogFileSize) ||
-			vlog.numEntriesWritten > vlog.opt.ValueLogMaxEntries {
-			if err := curlf.doneWriting(vlog.woffset()); err != nil {
-				return err
-			}
+		for i, l := range logs {
+			if l.woffset() > uint32(vlog.opt.ValueLogFileSize) ||
+				l.numEntriesWritten > vlog.opt.ValueLogMaxEntries {
+				if err := curlfs[i].doneWriting(l.woffset()); err != nil {
+					return err
+				}
 
-			newlf, err := vlog.createVlogFile()
-			if err != nil {
-				return err
+				newlf, err := l.createVlogFile()
+				if err != nil {
+					return err
+				}
+				// doneWriting synced the previous file.
+				curlfs[i] = newlf
+				dirty[i] = false
 			}
-			curlf = newlf
 		}
 		return nil
 	}
@@ -912,10 +1095,15 @@ func (vlog *valueLog) write(reqs []*request) error {
 				b.Ptrs = append(b.Ptrs, valuePointer{})
 				continue
 			}
+			var li int
+			if vlog.large != nil && int64(len(e.Value)) >= vlog.opt.LargeValueThreshold {
+				li = 1
+			}
+			l, curlf := logs[li], curlfs[li]
 			var p valuePointer
 
 			p.Fid = curlf.fid
-			p.Offset = vlog.woffset()
+			p.Offset = l.woffset()
 
 			// We should not store transaction marks in the vlog file because it will never have all
 			// the entries in a transaction. If we store entries with transaction marks then value
@@ -933,9 +1121,10 @@ func (vlog *valueLog) write(reqs []*request) error {
 
 			p.Len = uint32(plen)
 			b.Ptrs = append(b.Ptrs, p)
-			if err := write(buf); err != nil {
+			if err := write(li, buf); err != nil {
 				return err
 			}
+			l.numEntriesWritten++
 			written++
 			bytesWritten += buf.Len()
 			// No need to flush anything, we write to file directly via mmap.
@@ -943,7 +1132,6 @@ func (vlog *valueLog) write(reqs []*request) error {
 		y.NumWritesAdd(vlog.opt.MetricsEnabled, int64(written))
 		y.NumBytesWrittenAdd(vlog.opt.MetricsEnabled, int64(bytesWritten))
 
-		vlog.numEntriesWritten += uint32(written)
 		vlog.db.threshold.update(valueSizes)
 		// We write to disk here so that all entries that are part of the same transaction are
 		// written to the same vlog file.
@@ -957,6 +1145,9 @@ func (vlog *valueLog) write(reqs []*request) error {
 // Gets the logFile and acquires and RLock() for the mmap. You must call RUnlock on the file
 // (if non-nil)
 func (vlog *valueLog) getFileRLocked(vp valuePointer) (*logFile, error) {
+	if l := vlog.logFor(vp.Fid); l != vlog {
+		return l.getFileRLocked(vp)
+	}
 	vlog.filesLock.RLock()
 	defer vlog.filesLock.RUnlock()
 	ret, ok := vlog.filesMap[vp.Fid]
@@ -982,6 +1173,16 @@ func (vlog *valueLog) getFileRLocked(vp valuePointer) (*logFile, error) {
 	return ret, nil
 }
 
+// writable returns whether the value log file fid is the one being written.
+func (vlog *valueLog) writable(fid uint32) bool {
+	if l := vlog.logFor(fid); l != vlog {
+		return l.writable(fid)
+	}
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	return !vlog.opt.ReadOnly && fid == vlog.maxFid
+}
+
 // Read reads the value log at a given location.
 // TODO: Make this read private.
 func (vlog *valueLog) Read(vp valuePointer, _ *y.Slice) ([]byte, func(), error) {
@@ -1003,32 +1204,181 @@ func (vlog *valueLog) Read(vp valuePointer, _ *y.Slice) ([]byte, func(), error)
 		checksum := buf[len(buf)-crc32.Size:]
 		if hash.Sum32() != y.BytesToU32(checksum) {
 			runCallback(cb)
-			return nil, nil, y.Wrapf(y.ErrChecksumMismatch, "value corrupted for vp: %+v", vp)
+			return nil, nil, newValueChecksumError(lf, vp)
 		}
 	}
 	var h header
 	headerLen := h.Decode(buf)
 	kv := buf[headerLen:]
 	if lf.encryptionEnabled() {
-		kv, err = lf.decryptKV(kv, vp.Offset)
+		if lf.aead {
+			kv = buf[headerLen : len(buf)-crc32.Size]
+		}
+		kv, err = lf.decryptKV(buf[:headerLen], kv, vp.Offset)
+		if errors.Is(err, y.ErrChecksumMismatch) {
+			runCallback(cb)
+			return nil, nil, newValueChecksumError(lf, vp)
+		}
 		if err != nil {
 			return nil, cb, err
 		}
 	}
 	if uint32(len(kv)) < h.klen+h.vlen {
 		vlog.db.opt.Logger.Errorf("Invalid read: vp: %+v", vp)
-		return nil, nil, errors.Errorf("Invalid read: Len: %d read at:[%d:%d]",
-			len(kv), h.klen, h.klen+h.vlen)
+		runCallback(cb)
+		return nil, nil, fileError(ErrCorruptFile, lf.path, int64(vp.Offset),
+			errors.Errorf("Invalid read: Len: %d read at:[%d:%d]", len(kv), h.klen, h.klen+h.vlen))
 	}
 	return kv[h.klen : h.klen+h.vlen], cb, nil
 }
 
+// ValueChecksumError is returned when reading a value whose checksum in the value log doesn't
+// match, if VerifyValueChecksum is set. It identifies the corrupted entry of the value log.
+// errors.Is(err, y.ErrChecksumMismatch) reports true for a ValueChecksumError.
+type ValueChecksumError struct {
+	// Path is the path of the value log file.
+	Path string
+	// Fid is the id of the value log file.
+	Fid uint32
+	// Offset is the offset of the corrupted entry in the file.
+	Offset uint32
+	// Len is the length of the corrupted entry.
+	Len uint32
+}
+
+func newValueChecksumError(lf *logFile, vp valuePointer) *ValueChecksumError {
+	return &ValueChecksumError{Path: lf.path, Fid: vp.Fid, Offset: vp.Offset, Len: vp.Len}
+}
+
+func (e *ValueChecksumError) Error() string {
+	return fmt.Sprintf("%s in value log file %s at offset %d, length %d",
+		y.ErrChecksumMismatch, e.Path, e.Offset, e.Len)
+}
+
+// Is reports whether target is y.ErrChecksumMismatch.
+func (e *ValueChecksumError) Is(target error) bool {
+	return target == y.ErrChecksumMismatch
+}
+
+// Unwrap returns y.ErrChecksumMismatch.
+func (e *ValueChecksumError) Unwrap() error {
+	return y.ErrChecksumMismatch
+}
+
+// valueReader streams a value from a value log file. It reads the value from the memory map of the
+// file as it goes, decrypting it and computing its checksum incrementally.
+type valueReader struct {
+	lf     *logFile
+	vp     valuePointer
+	value  []byte
+	suffix []byte // Follows the value, but isn't read. Only used for the checksum.
+	crc    []byte
+	stream cipher.Stream
+	hash   hash.Hash32
+	closed bool
+}
+
+// newValueReader returns a reader for the value at the given pointer, without its last suffixLen
+// bytes. The log file stays read locked till the reader is closed.
+func (vlog *valueLog) newValueReader(vp valuePointer, suffixLen uint32) (*valueReader, error) {
+	buf, lf, err := vlog.readValueBytes(vp)
+	if err != nil {
+		runCallback(vlog.getUnlockCallback(lf))
+		return nil, err
+	}
+	vr := &valueReader{lf: lf, vp: vp}
+	var h header
+	headerLen := h.Decode(buf)
+	if uint32(len(buf)) < uint32(headerLen)+h.klen+h.vlen+uint32(lf.tagSize())+crc32.Size {
+		vr.Close()
+		return nil, fileError(ErrCorruptFile, lf.path, int64(vp.Offset),
+			errors.Errorf("Invalid read: Len: %d read at:[%d:%d]",
+				len(buf), headerLen, uint32(headerLen)+h.klen+h.vlen))
+	}
+	valueStart := uint32(headerLen) + h.klen
+	if suffixLen > h.vlen {
+		vr.Close()
+		return nil, errors.Errorf("Invalid value length %d, shorter than its suffix of %d bytes",
+			h.vlen, suffixLen)
+	}
+	valueEnd := valueStart + h.vlen - suffixLen
+	if lf.aead {
+		// The entry can only be authenticated as a whole, so it is decrypted upfront.
+		kv := buf[headerLen : len(buf)-crc32.Size]
+		if kv, err = lf.decryptKV(buf[:headerLen], kv, vp.Offset); err != nil {
+			vr.Close()
+			if errors.Is(err, y.ErrChecksumMismatch) {
+				return nil, newValueChecksumError(lf, vp)
+			}
+			return nil, err
+		}
+		vr.value = kv[h.klen : h.klen+h.vlen-suffixLen]
+		return vr, nil
+	}
+	vr.value = buf[valueStart:valueEnd]
+	vr.suffix = buf[valueEnd : valueStart+h.vlen]
+	vr.crc = buf[valueStart+h.vlen : valueStart+h.vlen+crc32.Size]
+
+	if vlog.opt.VerifyValueChecksum {
+		vr.hash = crc32.New(y.CastagnoliCrcTable)
+		// The checksum covers the header and the key as well.
+		vr.hash.Write(buf[:valueStart])
+	}
+	if lf.encryptionEnabled() {
+		if vr.stream, err = y.XORStream(lf.dataKey.Data, lf.generateIV(vp.Offset)); err != nil {
+			vr.Close()
+			return nil, err
+		}
+		// The key and the value are encrypted together. Skip the key.
+		key := make([]byte, h.klen)
+		vr.stream.XORKeyStream(key, key)
+	}
+	return vr, nil
+}
+
+func (vr *valueReader) Read(p []byte) (int, error) {
+	if vr.closed {
+		return 0, errors.New("Read on closed value reader")
+	}
+	if len(vr.value) == 0 {
+		if vr.hash != nil {
+			vr.hash.Write(vr.suffix)
+			vr.suffix = nil
+		}
+		if vr.hash != nil && vr.hash.Sum32() != y.BytesToU32(vr.crc) {
+			return 0, newValueChecksumError(vr.lf, vr.vp)
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, vr.value)
+	if vr.hash != nil {
+		vr.hash.Write(vr.value[:n])
+	}
+	if vr.stream != nil {
+		vr.stream.XORKeyStream(p[:n], p[:n])
+	}
+	vr.value = vr.value[n:]
+	return n, nil
+}
+
+// Close releases the log file. It is safe to call it more than once.
+func (vr *valueReader) Close() error {
+	if !vr.closed {
+		vr.closed = true
+		vr.lf.lock.RUnlock()
+	}
+	return nil
+}
+
 // getUnlockCallback will returns a function which unlock the logfile if the logfile is mmaped.
 // otherwise, it unlock the logfile and return nil.
 func (vlog *valueLog) getUnlockCallback(lf *logFile) func() {
 	if lf == nil {
 		return nil
 	}
+	if lf.runlock != nil {
+		return lf.runlock
+	}
 	return lf.lock.RUnlock
 }
 
@@ -1070,7 +1420,7 @@ LOOP:
 		}
 
 		// reset the counter so next time we will start from the start
-		vlog.nextGCFid = 0
+		vlog.nextGCFid = vlog.fidBase
 		return nil
 	}
 	lf, ok := vlog.filesMap[fid]
@@ -1087,13 +1437,13 @@ LOOP:
 		return nil
 	}
 	if thr := discardRatio * float64(fi.Size()); float64(discard) < thr {
-		vlog.opt.Debugf("Discard: %d less than threshold: %.0f for file: %s",
-			discard, thr, fi.Name())
+		vlog.opt.logw(DEBUG, "Value log file below discard threshold", "fid", fid,
+			"discard", discard, "threshold", int64(thr))
 		return nil
 	}
 	maxFid := atomic.LoadUint32(&vlog.maxFid)
 	if fid < maxFid {
-		vlog.opt.Infof("Found value log max discard fid: %d discard: %d\n", fid, discard)
+		vlog.opt.logw(INFO, "Picked value log file for GC", "fid", fid, "discard", discard)
 		lf, ok := vlog.filesMap[fid]
 		y.AssertTrue(ok)
 		return lf
@@ -1128,15 +1478,32 @@ type reason struct {
 	count   int
 }
 
-func (vlog *valueLog) doRunGC(lf *logFile) error {
-	_, span := otrace.StartSpan(context.Background(), "Badger.GC")
+// ValueLogGCResult describes the work done by a value log GC.
+type ValueLogGCResult struct {
+	// FilesRewritten is the number of value log files rewritten and removed.
+	FilesRewritten int
+	// FilesPunched is the number of value log files in which holes were punched, if
+	// ValueLogPunchHoles is set.
+	FilesPunched int
+	// BytesReclaimed is an estimate of the disk space reclaimed. It is the size of the rewritten
+	// files minus the size of the entries moved out of them, plus the space freed by punching holes.
+	BytesReclaimed int64
+	// EntriesMoved is the number of live entries moved out of the rewritten files.
+	EntriesMoved int
+	// Duration is the time taken by the GC, including picking and sampling the files.
+	Duration time.Duration
+}
+
+func (vlog *valueLog) doRunGC(ctx context.Context, lf *logFile, res *ValueLogGCResult) error {
+	ctx, span := otrace.StartSpan(ctx, "Badger.GC")
 	span.Annotatef(nil, "GC rewrite for: %v", lf.path)
 	defer span.End()
-	if err := vlog.rewrite(lf); err != nil {
+	if err := vlog.punchOrRewrite(ctx, lf, res); err != nil {
 		return err
 	}
 	// Remove the file from discardStats.
 	vlog.discardStats.Update(lf.fid, -1)
+	y.NumVlogGCRewritesAdd(vlog.opt.MetricsEnabled, 1)
 	return nil
 }
 
@@ -1148,9 +1515,13 @@ func (vlog *valueLog) waitOnGC(lc *z.Closer) {
 	// Block any GC in progress to finish, and don't allow any more writes to runGC by filling up
 	// the channel of size 1.
 	vlog.garbageCh <- struct{}{}
+	if vlog.large != nil {
+		vlog.large.garbageCh <- struct{}{}
+	}
 }
 
-func (vlog *valueLog) runGC(discardRatio float64) error {
+func (vlog *valueLog) runGC(ctx context.Context, discardRatio float64) (ValueLogGCResult, error) {
+	var res ValueLogGCResult
 	select {
 	case vlog.garbageCh <- struct{}{}:
 		// Pick a log file for GC.
@@ -1158,13 +1529,115 @@ func (vlog *valueLog) runGC(discardRatio float64) error {
 			<-vlog.garbageCh
 		}()
 
+		start := time.Now()
 		lf := vlog.pickLog(discardRatio)
 		if lf == nil {
-			return ErrNoRewrite
+			return res, ErrNoRewrite
 		}
-		return vlog.doRunGC(lf)
+		err := vlog.doRunGC(ctx, lf, &res)
+		res.Duration = time.Since(start)
+		return res, err
 	default:
-		return ErrRejected
+		return res, ErrRejected
+	}
+}
+
+// spaceAmplification returns the ratio of the total size of the value log files to the size of
+// the live data in them, as estimated from the discard stats.
+func (vlog *valueLog) spaceAmplification() float64 {
+	return spaceAmp(vlog.spaceUsage())
+}
+
+func spaceAmp(total, discard int64) float64 {
+	if total == 0 {
+		return 1
+	}
+	live := total - discard
+	if live <= 0 {
+		live = 1
+	}
+	return float64(total) / float64(live)
+}
+
+// spaceUsage returns the total size of the value log files, and the size of the discarded data in
+// them.
+func (vlog *valueLog) spaceUsage() (int64, int64) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	discards := make(map[uint32]int64)
+	vlog.discardStats.Lock()
+	vlog.discardStats.Iterate(func(fid, stats uint64) {
+		discards[uint32(fid)] = int64(stats)
+	})
+	vlog.discardStats.Unlock()
+
+	var total, discard int64
+	for fid, lf := range vlog.filesMap {
+		sz := int64(atomic.LoadUint32(&lf.size))
+		total += sz
+		if d := discards[fid]; d < sz {
+			discard += d
+		} else {
+			discard += sz
+		}
+	}
+	return total, discard
+}
+
+// runGCScheduler runs value log GC every ValueLogGCInterval, for as long as the space
+// amplification of the value log is above ValueLogTargetSpaceAmp.
+func (vlog *valueLog) runGCScheduler(lc *z.Closer) {
+	defer lc.Done()
+
+	ticker := time.NewTicker(vlog.opt.ValueLogGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lc.HasBeenClosed():
+			return
+		case <-ticker.C:
+			vlog.scheduledGC(lc)
+			if vlog.large != nil {
+				vlog.large.scheduledGC(lc)
+			}
+		}
+	}
+}
+
+func (vlog *valueLog) scheduledGC(lc *z.Closer) {
+	target := vlog.opt.ValueLogTargetSpaceAmp
+	// A file with discard ratio r on its own has a space amplification of 1/(1-r). Rewriting only
+	// the files above the target brings the value log towards it.
+	discardRatio := 1 - 1/target
+	for {
+		amp := vlog.spaceAmplification()
+		if amp <= target {
+			vlog.opt.logw(DEBUG, "Value log space amplification within target. Skipping GC",
+				"space_amplification", amp, "target", target)
+			return
+		}
+		select {
+		case <-lc.HasBeenClosed():
+			return
+		default:
+		}
+		vlog.opt.logw(INFO, "Value log space amplification above target. Running GC",
+			"space_amplification", amp, "target", target)
+		res, err := vlog.runGC(context.Background(), discardRatio)
+		switch err {
+		case nil:
+			vlog.opt.logw(INFO, "Scheduled value log GC done",
+				"files_rewritten", res.FilesRewritten, "files_punched", res.FilesPunched,
+				"entries_moved", res.EntriesMoved, "bytes_reclaimed", res.BytesReclaimed,
+				"duration", res.Duration)
+		case ErrNoRewrite, ErrRejected:
+			vlog.opt.logw(DEBUG, "Scheduled value log GC stopped", "reason", err)
+			return
+		default:
+			vlog.opt.logw(ERROR, "Scheduled value log GC failed", "error", err)
+			return
+		}
 	}
 }
 
@@ -1173,7 +1646,7 @@ func (vlog *valueLog) updateDiscardStats(stats map[uint32]int64) {
 		return
 	}
 	for fid, discard := range stats {
-		vlog.discardStats.Update(fid, discard)
+		vlog.logFor(fid).discardStats.Update(fid, discard)
 	}
 }
 
@@ -1181,9 +1654,11 @@ type vlogThreshold struct {
 	logger         Logger
 	percentile     float64
 	valueThreshold int64
-	valueCh        chan []int64
-	clearCh        chan bool
-	closer         *z.Closer
+	// optThreshold is the ValueThreshold option, which can be changed with DB.SetOptions. Atomic.
+	optThreshold int64
+	valueCh      chan []int64
+	clearCh      chan bool
+	closer       *z.Closer
 	// Metrics contains a running log of statistics like amount of data stored etc.
 	vlMetrics *z.HistogramData
 }
@@ -1213,6 +1688,7 @@ func initVlogThreshold(opt *Options) *vlogThreshold {
 		logger:         opt.Logger,
 		percentile:     opt.VLogPercentile,
 		valueThreshold: opt.ValueThreshold,
+		optThreshold:   opt.ValueThreshold,
 		valueCh:        make(chan []int64, 1000),
 		clearCh:        make(chan bool, 1),
 		closer:         z.NewCloser(1),
@@ -1220,11 +1696,17 @@ func initVlogThreshold(opt *Options) *vlogThreshold {
 	}
 }
 
-func (v *vlogThreshold) Clear(opt Options) {
-	atomic.StoreInt64(&v.valueThreshold, opt.ValueThreshold)
+func (v *vlogThreshold) Clear() {
+	atomic.StoreInt64(&v.valueThreshold, atomic.LoadInt64(&v.optThreshold))
 	v.clearCh <- true
 }
 
+// set changes the ValueThreshold option.
+func (v *vlogThreshold) set(val int64) {
+	atomic.StoreInt64(&v.optThreshold, val)
+	atomic.StoreInt64(&v.valueThreshold, val)
+}
+
 func (v *vlogThreshold) update(sizes []int64) {
 	v.valueCh <- sizes
 }
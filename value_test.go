@@ -18,7 +18,9 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -28,8 +30,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/y"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -197,7 +201,7 @@ func TestValueGCManaged(t *testing.T) {
 
 	for i := 0; i < 100; i++ {
 		// Try at max 100 times to GC even a single value log file.
-		if err := db.RunValueLogGC(0.0001); err == nil {
+		if _, err := db.RunValueLogGC(0.0001); err == nil {
 			return // Done
 		}
 	}
@@ -242,7 +246,7 @@ func TestValueGC(t *testing.T) {
 	//		return true
 	//	})
 
-	kv.vlog.rewrite(lf)
+	kv.vlog.rewrite(context.Background(), lf)
 	for i := 45; i < 100; i++ {
 		key := []byte(fmt.Sprintf("key%d", i))
 
@@ -300,7 +304,7 @@ func TestValueGC2(t *testing.T) {
 	//		return true
 	//	})
 
-	kv.vlog.rewrite(lf)
+	kv.vlog.rewrite(context.Background(), lf)
 	for i := 0; i < 5; i++ {
 		key := []byte(fmt.Sprintf("key%d", i))
 		require.NoError(t, kv.View(func(txn *Txn) error {
@@ -398,7 +402,7 @@ func TestValueGC3(t *testing.T) {
 	logFile := kv.vlog.filesMap[kv.vlog.sortedFids()[0]]
 	kv.vlog.filesLock.RUnlock()
 
-	kv.vlog.rewrite(logFile)
+	kv.vlog.rewrite(context.Background(), logFile)
 	it.Next()
 	require.True(t, it.Valid())
 	item = it.Item()
@@ -453,8 +457,8 @@ func TestValueGC4(t *testing.T) {
 	//		return true
 	//	})
 
-	kv.vlog.rewrite(lf0)
-	kv.vlog.rewrite(lf1)
+	kv.vlog.rewrite(context.Background(), lf0)
+	kv.vlog.rewrite(context.Background(), lf1)
 
 	require.NoError(t, kv.Close())
 
@@ -483,6 +487,263 @@ func TestValueGC4(t *testing.T) {
 	require.NoError(t, kv.Close())
 }
 
+func TestValueGCResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 1.0, db.ValueLogSpaceAmplification())
+
+	sz := 32 << 10
+	for i := 0; i < 100; i++ {
+		v := make([]byte, sz)
+		rand.Read(v)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(fmt.Sprintf("key%d", i)), v))
+		}))
+	}
+	// Delete every other key.
+	for i := 0; i < 100; i += 2 {
+		txnDelete(t, db, []byte(fmt.Sprintf("key%d", i)))
+	}
+
+	db.vlog.filesLock.RLock()
+	fid := db.vlog.sortedFids()[0]
+	lf := db.vlog.filesMap[fid]
+	db.vlog.discardStats.Update(fid, int64(lf.size/2))
+	db.vlog.filesLock.RUnlock()
+	amp := db.ValueLogSpaceAmplification()
+	require.True(t, amp > 1)
+
+	res, err := db.RunValueLogGC(0.4)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.FilesRewritten)
+	require.True(t, res.EntriesMoved > 0)
+	require.True(t, res.BytesReclaimed > 0)
+	require.True(t, res.BytesReclaimed < int64(lf.size))
+	require.True(t, res.Duration > 0)
+	require.True(t, db.ValueLogSpaceAmplification() < amp)
+
+	res, err = db.RunValueLogGC(1)
+	require.Equal(t, ErrInvalidRequest, err)
+	require.Equal(t, 0, res.FilesRewritten)
+}
+
+func TestValueGCContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sz := 32 << 10
+	for i := 0; i < 100; i++ {
+		v := make([]byte, sz)
+		rand.Read(v)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(fmt.Sprintf("key%d", i)), v))
+		}))
+	}
+	for i := 0; i < 100; i += 2 {
+		txnDelete(t, db, []byte(fmt.Sprintf("key%d", i)))
+	}
+
+	db.vlog.filesLock.RLock()
+	fid := db.vlog.sortedFids()[0]
+	lf := db.vlog.filesMap[fid]
+	db.vlog.discardStats.Update(fid, int64(lf.size/2))
+	db.vlog.filesLock.RUnlock()
+
+	// A canceled GC keeps the file, so it's picked again.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.RunValueLogGCContext(ctx, 0.4)
+	require.Equal(t, context.Canceled, err)
+
+	res, err := db.RunValueLogGCContext(context.Background(), 0.4)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.FilesRewritten)
+}
+
+func TestValueGCScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+	opt.ValueLogGCInterval = 100 * time.Millisecond
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sz := 32 << 10
+	for i := 0; i < 100; i++ {
+		v := make([]byte, sz)
+		rand.Read(v)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(fmt.Sprintf("key%d", i)), v))
+		}))
+	}
+	// Overwrite all the keys with values stored in the LSM tree.
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(fmt.Sprintf("key%d", i)), []byte("small")))
+		}))
+	}
+
+	db.vlog.filesLock.RLock()
+	fids := db.vlog.sortedFids()
+	require.True(t, len(fids) > 2)
+	for _, fid := range fids[:len(fids)-1] {
+		// Compactions would eventually find these values to be discarded as well.
+		lf := db.vlog.filesMap[fid]
+		db.vlog.discardStats.Update(fid, int64(lf.size))
+	}
+	db.vlog.filesLock.RUnlock()
+	require.True(t, db.vlog.spaceAmplification() > opt.ValueLogTargetSpaceAmp)
+
+	for i := 0; i < 100; i++ {
+		if db.vlog.spaceAmplification() <= opt.ValueLogTargetSpaceAmp {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, db.vlog.spaceAmplification() <= opt.ValueLogTargetSpaceAmp)
+	db.vlog.filesLock.RLock()
+	_, ok := db.vlog.filesMap[fids[0]]
+	db.vlog.filesLock.RUnlock()
+	require.False(t, ok, "file %d should have been garbage collected", fids[0])
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("small"), getItemValue(t, item))
+			return nil
+		}))
+	}
+}
+
+func TestValueGCSchedulerOptions(t *testing.T) {
+	opt := getTestOptions("").WithInMemory(true).WithValueLogGCInterval(time.Second)
+	opt.ValueLogTargetSpaceAmp = 1
+	_, err := Open(opt)
+	require.Error(t, err)
+}
+
+func TestLargeValueDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	largeDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(largeDir)
+
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+	opt.LargeValueDir = largeDir
+	opt.LargeValueThreshold = 16 << 10
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	vals := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key%d", i)
+		v := make([]byte, 2<<10)
+		if i%2 == 0 {
+			v = make([]byte, 32<<10)
+		}
+		rand.Read(v)
+		vals[k] = v
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(k), v))
+		}))
+	}
+	check := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for k, v := range vals {
+				item, err := txn.Get([]byte(k))
+				require.NoError(t, err)
+				require.Equal(t, v, getItemValue(t, item), "key: %s", k)
+				if item.meta&bitValuePointer == 0 {
+					continue
+				}
+				var vp valuePointer
+				vp.Decode(item.vptr)
+				require.Equal(t, len(v) >= 16<<10, vp.Fid >= largeFidBase, "key: %s", k)
+			}
+			return nil
+		}))
+	}
+	check()
+
+	// The small values fit in a single file, the large ones don't.
+	db.vlog.filesLock.RLock()
+	require.Equal(t, 1, len(db.vlog.filesMap))
+	db.vlog.filesLock.RUnlock()
+	db.vlog.large.filesLock.RLock()
+	fids := db.vlog.large.sortedFids()
+	db.vlog.large.filesLock.RUnlock()
+	require.True(t, len(fids) > 1)
+	require.Equal(t, uint32(largeFidBase+1), fids[0])
+	_, err = os.Stat(vlogFilePath(largeDir, 1))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	check()
+
+	// Overwrite the large values, and GC the first large value log file.
+	for i := 0; i < 100; i += 2 {
+		k := fmt.Sprintf("key%d", i)
+		vals[k] = []byte("small")
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte(k), vals[k]))
+		}))
+	}
+	db.vlog.large.filesLock.RLock()
+	lf := db.vlog.large.filesMap[fids[0]]
+	db.vlog.large.filesLock.RUnlock()
+	db.vlog.updateDiscardStats(map[uint32]int64{fids[0]: int64(lf.size)})
+	require.True(t, db.ValueLogSpaceAmplification() > 1)
+
+	res, err := db.RunValueLogGC(0.5)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.FilesRewritten)
+	require.Equal(t, 0, res.EntriesMoved)
+	_, err = os.Stat(vlogFilePath(largeDir, 1))
+	require.True(t, os.IsNotExist(err))
+	check()
+}
+
+func TestLargeValueDirOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	_, err = Open(getTestOptions(dir).WithLargeValueDir(dir))
+	require.Error(t, err)
+	_, err = Open(getTestOptions(dir).WithLargeValueDir(dir + "-large").WithLargeValueThreshold(0))
+	require.Error(t, err)
+}
+
 func TestPersistLFDiscardStats(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger-test")
 	require.NoError(t, err)
@@ -547,6 +808,171 @@ func TestPersistLFDiscardStats(t *testing.T) {
 	db.vlog.discardStats.Unlock()
 }
 
+func TestValueReader(t *testing.T) {
+	test := func(t *testing.T, db *DB) {
+		big := make([]byte, 1<<20)
+		rand.Read(big)
+		small := []byte("small")
+		txnSet(t, db, []byte("big"), big, 0)
+		txnSet(t, db, []byte("small"), small, 0)
+
+		read := func(key []byte) ([]byte, error) {
+			var out bytes.Buffer
+			err := db.View(func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				r, err := item.ValueReader()
+				if err != nil {
+					// The authenticated values are verified upfront.
+					return err
+				}
+				defer r.Close()
+				_, err = io.CopyBuffer(&out, r, make([]byte, 4<<10))
+				return err
+			})
+			return out.Bytes(), err
+		}
+		val, err := read([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big, val)
+		val, err = read([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, small, val)
+
+		// Corrupt the big value in the value log.
+		var vp valuePointer
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("big"))
+			require.NoError(t, err)
+			vp.Decode(item.vptr)
+			return nil
+		}))
+		lf, err := db.vlog.getFileRLocked(vp)
+		require.NoError(t, err)
+		lf.Data[vp.Offset+vp.Len/2]++
+		lf.lock.RUnlock()
+		_, err = read([]byte("big"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), y.ErrChecksumMismatch.Error())
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		opt := getTestOptions("")
+		opt.ValueThreshold = 1 << 10
+		opt.VerifyValueChecksum = true
+		runBadgerTest(t, &opt, test)
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		opt := getTestOptions("")
+		opt.ValueThreshold = 1 << 10
+		opt.VerifyValueChecksum = true
+		opt.EncryptionKey = make([]byte, 32)
+		rand.Read(opt.EncryptionKey)
+		opt.BlockCacheSize = 10 << 20
+		opt.IndexCacheSize = 10 << 20
+		runBadgerTest(t, &opt, test)
+	})
+	t.Run("authenticated", func(t *testing.T) {
+		// The tampering is detected without the checksum.
+		opt := getTestOptions("")
+		opt.ValueThreshold = 1 << 10
+		opt.EncryptionKey = make([]byte, 32)
+		rand.Read(opt.EncryptionKey)
+		opt.EncryptionMode = options.AESGCM
+		opt.BlockCacheSize = 10 << 20
+		opt.IndexCacheSize = 10 << 20
+		runBadgerTest(t, &opt, test)
+	})
+}
+
+func TestValueChecksumError(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 1 << 10
+	opt.VerifyValueChecksum = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		val := make([]byte, 4<<10)
+		rand.Read(val)
+		txnSet(t, db, []byte("key"), val, 0)
+
+		var vp valuePointer
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			vp.Decode(item.vptr)
+			return nil
+		}))
+		lf, err := db.vlog.getFileRLocked(vp)
+		require.NoError(t, err)
+		lf.Data[vp.Offset+vp.Len/2]++
+		lf.lock.RUnlock()
+
+		err = db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			return item.Value(func(v []byte) error {
+				require.Fail(t, "corrupted value shouldn't be returned")
+				return nil
+			})
+		})
+		require.True(t, errors.Is(err, y.ErrChecksumMismatch))
+		var cerr *ValueChecksumError
+		require.True(t, errors.As(err, &cerr))
+		require.Equal(t, vp.Fid, cerr.Fid)
+		require.Equal(t, vp.Offset, cerr.Offset)
+		require.Equal(t, vp.Len, cerr.Len)
+		require.Equal(t, lf.path, cerr.Path)
+	})
+}
+
+func TestValueAuthenticatedSwap(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 1 << 10
+	opt.EncryptionKey = make([]byte, 32)
+	rand.Read(opt.EncryptionKey)
+	opt.EncryptionMode = options.AESGCM
+	opt.BlockCacheSize = 10 << 20
+	opt.IndexCacheSize = 10 << 20
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		keys := [][]byte{[]byte("key1"), []byte("key2")}
+		vps := make([]valuePointer, len(keys))
+		for i, key := range keys {
+			val := make([]byte, 4<<10)
+			rand.Read(val)
+			txnSet(t, db, key, val, 0)
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				vps[i].Decode(item.vptr)
+				return nil
+			}))
+		}
+		require.Equal(t, vps[0].Fid, vps[1].Fid)
+		require.Equal(t, vps[0].Len, vps[1].Len)
+
+		// The entries have the same header, and their checksums stay valid.
+		lf, err := db.vlog.getFileRLocked(vps[0])
+		require.NoError(t, err)
+		e1 := lf.Data[vps[0].Offset : vps[0].Offset+vps[0].Len]
+		e2 := lf.Data[vps[1].Offset : vps[1].Offset+vps[1].Len]
+		tmp := y.Copy(e1)
+		copy(e1, e2)
+		copy(e2, tmp)
+		lf.lock.RUnlock()
+
+		for _, key := range keys {
+			err = db.View(func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				return item.Value(func(v []byte) error {
+					require.Fail(t, "swapped value shouldn't be returned")
+					return nil
+				})
+			})
+			require.True(t, errors.Is(err, y.ErrChecksumMismatch))
+		}
+	})
+}
+
 func TestValueChecksums(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger-test")
 	require.NoError(t, err)
@@ -759,11 +1185,12 @@ func TestValueLogTrigger(t *testing.T) {
 		txnDelete(t, kv, []byte(fmt.Sprintf("key%d", i)))
 	}
 
-	require.NoError(t, kv.RunValueLogGC(0.5))
+	_, err = kv.RunValueLogGC(0.5)
+	require.NoError(t, err)
 
 	require.NoError(t, kv.Close())
 
-	err = kv.RunValueLogGC(0.5)
+	_, err = kv.RunValueLogGC(0.5)
 	require.Equal(t, ErrRejected, err, "Error should be returned after closing DB.")
 }
 
@@ -944,7 +1371,7 @@ func TestBug578(t *testing.T) {
 
 		// Run value log GC a few times.
 		for i := 0; i < 5; i++ {
-			db.RunValueLogGC(0.5)
+			_, _ = db.RunValueLogGC(0.5)
 		}
 		h.readRange(0, 10)
 	}
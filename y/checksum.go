@@ -28,7 +28,10 @@ import (
 // ErrChecksumMismatch is returned at checksum mismatch.
 var ErrChecksumMismatch = errors.New("checksum mismatch")
 
-// CalculateChecksum calculates checksum for data using ct checksum type.
+// CalculateChecksum calculates checksum for data using ct checksum type. CRC32C uses the CRC
+// instructions of SSE 4.2 on amd64 and of ARMv8 on arm64, and XXHash64 has an assembly
+// implementation on amd64. XXHash64 is pure Go on arm64 until xxhash is upgraded to v2.2.0, which
+// adds an arm64 implementation.
 func CalculateChecksum(data []byte, ct pb.Checksum_Algorithm) uint64 {
 	switch ct {
 	case pb.Checksum_CRC32C:
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// DirectIOAlignment is the alignment of the buffers, offsets and lengths of the reads and writes
+// of files opened with OpenDirectFile.
+const DirectIOAlignment = 4096
+
+func alignUp(n int64) int64 {
+	return (n + DirectIOAlignment - 1) &^ (DirectIOAlignment - 1)
+}
+
+// AlignedBlock returns a zeroed buffer of size n, whose address is aligned to DirectIOAlignment.
+func AlignedBlock(n int) []byte {
+	buf := make([]byte, n+DirectIOAlignment)
+	addr := int64(uintptr(unsafe.Pointer(&buf[0])))
+	off := int(alignUp(addr) - addr)
+	return buf[off : off+n : off+n]
+}
+
+// ReadDirect reads sz bytes at off from fd, which was opened with OpenDirectFile. The read is
+// extended to aligned offsets, so off and sz don't need to be aligned.
+func ReadDirect(fd File, off int64, sz int) ([]byte, error) {
+	start := off &^ (DirectIOAlignment - 1)
+	end := alignUp(off + int64(sz))
+	buf := AlignedBlock(int(end - start))
+	n, err := fd.ReadAt(buf, start)
+	if int64(n) >= off+int64(sz)-start {
+		// The aligned read can go past the end of the file.
+		return buf[off-start : off-start+int64(sz)], nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, errors.Wrapf(err, "while reading %d bytes at offset %d from %s",
+		sz, off, fd.Name())
+}
+
+// DirectWriter writes to a file opened with OpenDirectFile, via an aligned buffer.
+type DirectWriter struct {
+	fd      File
+	buf     []byte
+	n       int
+	written int64
+}
+
+// NewDirectWriter returns a DirectWriter writing to fd from offset zero, with a buffer of at least
+// bufSize bytes.
+func NewDirectWriter(fd File, bufSize int) *DirectWriter {
+	return &DirectWriter{fd: fd, buf: AlignedBlock(int(alignUp(int64(bufSize))))}
+}
+
+// Write implements io.Writer.
+func (w *DirectWriter) Write(p []byte) (int, error) {
+	var total int
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		total += n
+		p = p[n:]
+		if w.n == len(w.buf) {
+			if err := w.flush(len(w.buf)); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (w *DirectWriter) flush(sz int) error {
+	if _, err := w.fd.WriteAt(w.buf[:sz], w.written); err != nil {
+		return errors.Wrapf(err, "while writing to %s", w.fd.Name())
+	}
+	w.written += int64(w.n)
+	w.n = 0
+	return nil
+}
+
+// Finish writes the buffered data, padded to an aligned length, truncates the file to the size
+// written and syncs it.
+func (w *DirectWriter) Finish() error {
+	if w.n > 0 {
+		sz := int(alignUp(int64(w.n)))
+		for i := w.n; i < sz; i++ {
+			w.buf[i] = 0
+		}
+		if err := w.flush(sz); err != nil {
+			return err
+		}
+	}
+	if err := w.fd.Truncate(w.written); err != nil {
+		return errors.Wrapf(err, "while truncating %s", w.fd.Name())
+	}
+	return errors.Wrapf(w.fd.Sync(), "while syncing %s", w.fd.Name())
+}
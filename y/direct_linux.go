@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"os"
+	"syscall"
+)
+
+// OpenDirectFile opens the file of fs with O_DIRECT, so that its reads and writes bypass the page
+// cache. If the file system doesn't support O_DIRECT, like tmpfs, the file is opened without it.
+func OpenDirectFile(fs FS, name string, flag int, perm os.FileMode) (File, error) {
+	fd, err := fs.OpenFile(name, flag|syscall.O_DIRECT, perm)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EINVAL {
+		return fs.OpenFile(name, flag, perm)
+	}
+	return fd, err
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "direct")
+
+	data := make([]byte, 3*DirectIOAlignment+100)
+	rand.Read(data)
+	fd, err := OpenDirectFile(OSFS, name, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0666)
+	require.NoError(t, err)
+	w := NewDirectWriter(fd, 1)
+	// Write in pieces which aren't aligned.
+	for off := 0; off < len(data); off += 1000 {
+		end := off + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := w.Write(data[off:end])
+		require.NoError(t, err)
+		require.Equal(t, end-off, n)
+	}
+	require.NoError(t, w.Finish())
+	require.NoError(t, fd.Close())
+
+	got, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	fd, err = OpenDirectFile(OSFS, name, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer fd.Close()
+	for i := 0; i < 100; i++ {
+		off := rand.Intn(len(data))
+		sz := rand.Intn(len(data)-off) + 1
+		buf, err := ReadDirect(fd, int64(off), sz)
+		require.NoError(t, err)
+		require.Equal(t, data[off:off+sz], buf)
+	}
+	_, err = ReadDirect(fd, int64(len(data)-10), 20)
+	require.Error(t, err)
+}
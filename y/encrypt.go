@@ -59,6 +59,52 @@ func XORBlockStream(w io.Writer, src, key, iv []byte) error {
 	return Wrapf(err, "XORBlockStream")
 }
 
+// XORStream returns a stream, which encrypts or decrypts data incrementally in the same way as
+// XORBlock.
+func XORStream(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// AEADTagSize is the size of the authentication tag appended by Seal.
+const AEADTagSize = 16
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, aes.BlockSize)
+}
+
+// Seal encrypts and authenticates src, along with the additional data ad, with AES-GCM, and
+// appends the result to dst. The result is AEADTagSize bytes longer than src. The IV is of AES
+// block size, and must never be reused with the same key.
+func Seal(dst, src, ad, key, iv []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, iv, src, ad), nil
+}
+
+// Open decrypts and authenticates src, sealed by Seal with the same additional data, key and IV,
+// and appends the result to dst. It returns ErrChecksumMismatch if src or ad were tampered with.
+func Open(dst, src, ad, key, iv []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(dst, iv, src, ad)
+	if err != nil {
+		return nil, Wrapf(ErrChecksumMismatch, "while authenticating the data: %v", err)
+	}
+	return out, nil
+}
+
 // GenerateIV generates IV.
 func GenerateIV() ([]byte, error) {
 	iv := make([]byte, aes.BlockSize)
@@ -62,3 +62,30 @@ func TestXORBlock(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, src, cp)
 }
+
+func TestSealOpen(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	iv, err := GenerateIV()
+	require.NoError(t, err)
+	src := make([]byte, 1024)
+	rand.Read(src)
+	ad := []byte("header")
+
+	sealed, err := Seal(nil, src, ad, key, iv)
+	require.NoError(t, err)
+	require.Len(t, sealed, len(src)+AEADTagSize)
+	out, err := Open(nil, sealed, ad, key, iv)
+	require.NoError(t, err)
+	require.Equal(t, src, out)
+
+	// Tampering with the data, the additional data or the tag is detected.
+	for _, i := range []int{0, len(src) / 2, len(sealed) - 1} {
+		sealed[i]++
+		_, err = Open(nil, sealed, ad, key, iv)
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+		sealed[i]--
+	}
+	_, err = Open(nil, sealed, []byte("Header"), key, iv)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
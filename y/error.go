@@ -63,13 +63,25 @@ func AssertTruef(b bool, format string, args ...interface{}) {
 	}
 }
 
+// wrapError is the error returned by Wrap and Wrapf out of debug mode. Unlike the errors of
+// errors.Wrap, it doesn't record the stack, but its cause is still found by errors.Is, errors.As
+// and errors.Cause.
+type wrapError struct {
+	msg string
+	err error
+}
+
+func (e *wrapError) Error() string { return e.msg }
+func (e *wrapError) Unwrap() error { return e.err }
+func (e *wrapError) Cause() error  { return e.err }
+
 // Wrap wraps errors from external lib.
 func Wrap(err error, msg string) error {
 	if !debugMode {
 		if err == nil {
 			return nil
 		}
-		return fmt.Errorf("%s err: %+v", msg, err)
+		return &wrapError{msg: fmt.Sprintf("%s err: %+v", msg, err), err: err}
 	}
 	return errors.Wrap(err, msg)
 }
@@ -80,7 +92,7 @@ func Wrapf(err error, format string, args ...interface{}) error {
 		if err == nil {
 			return nil
 		}
-		return fmt.Errorf(format+" error: %+v", append(args, err)...)
+		return &wrapError{msg: fmt.Sprintf(format+" error: %+v", append(args, err)...), err: err}
 	}
 	return errors.Wrapf(err, format, args...)
 }
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io"
+	"os"
+)
+
+// BackendFile reads from a table or value log file. Unlike io.ReaderAt, ReadAt always reads the
+// whole buffer, unless it fails. It must be safe for concurrent use.
+type BackendFile interface {
+	ReadAt(buf []byte, off int64) error
+}
+
+// IOBackend performs the reads of the table blocks and the value log entries, instead of
+// reading them from the mmap'ed files.
+type IOBackend interface {
+	// NewFile returns the BackendFile reading from fd. It is not used after fd is closed.
+	NewFile(fd *os.File) BackendFile
+	// Close releases the resources held by the backend. It must only be called once it's no
+	// longer used by any DB.
+	Close() error
+}
+
+// PreadBackend reads the files with one pread system call per read.
+var PreadBackend IOBackend = preadBackend{}
+
+type preadBackend struct{}
+
+func (preadBackend) NewFile(fd *os.File) BackendFile { return preadFile{fd} }
+func (preadBackend) Close() error                    { return nil }
+
+type preadFile struct {
+	fd *os.File
+}
+
+func (f preadFile) ReadAt(buf []byte, off int64) error {
+	// os.File.ReadAt already retries short reads.
+	n, err := f.fd.ReadAt(buf, off)
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	return err
+}
+
+// NewIOBackend returns an io_uring backend if the platform supports io_uring, and PreadBackend
+// otherwise.
+func NewIOBackend() IOBackend {
+	b, err := NewIOUringBackend(defaultIOUringEntries)
+	if err != nil {
+		return PreadBackend
+	}
+	return b
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOBackend(t *testing.T) {
+	f, err := ioutil.TempFile("", "badger-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+
+	test := func(t *testing.T, b IOBackend) {
+		file := b.NewFile(f)
+		var wg sync.WaitGroup
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < 100; i++ {
+					off := r.Intn(len(data))
+					buf := make([]byte, r.Intn(len(data)-off)+1)
+					require.NoError(t, file.ReadAt(buf, int64(off)))
+					require.Equal(t, data[off:off+len(buf)], buf)
+				}
+			}(int64(g))
+		}
+		wg.Wait()
+
+		// Reads past the end of the file fail.
+		require.Error(t, file.ReadAt(make([]byte, 10), int64(len(data)-5)))
+		require.NoError(t, b.Close())
+	}
+
+	t.Run("pread", func(t *testing.T) { test(t, PreadBackend) })
+	t.Run("io_uring", func(t *testing.T) {
+		b, err := NewIOUringBackend(8)
+		if err != nil {
+			t.Skipf("io_uring is not supported: %v", err)
+		}
+		test(t, b)
+	})
+}
+
+func TestIOUringClose(t *testing.T) {
+	f, err := ioutil.TempFile("", "badger-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(make([]byte, 1<<10))
+	require.NoError(t, err)
+
+	b, err := NewIOUringBackend(8)
+	if err != nil {
+		t.Skipf("io_uring is not supported: %v", err)
+	}
+	file := b.NewFile(f)
+	// The reads racing with Close either succeed or fail, without panicking.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file.ReadAt(make([]byte, 10), 0) == nil {
+			}
+		}()
+	}
+	require.NoError(t, b.Close())
+	wg.Wait()
+	require.ErrorIs(t, file.ReadAt(make([]byte, 10), 0), os.ErrClosed)
+	require.NoError(t, b.Close())
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// FS is the file system the files of a DB are kept in. The names are the paths the DB builds from
+// its directories.
+type FS interface {
+	// OpenFile opens the named file, like os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Rename renames a file, replacing the new one if it exists, like os.Rename.
+	Rename(oldpath, newpath string) error
+	// Remove removes a file or an empty directory, like os.Remove.
+	Remove(name string) error
+	// Stat returns the FileInfo of the named file, like os.Stat.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of a directory sorted by name, like ioutil.ReadDir.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	// MkdirAll creates a directory and its missing parents, like os.MkdirAll.
+	MkdirAll(path string, perm os.FileMode) error
+	// SyncDir syncs the entries of a directory, so that the files created, renamed and removed in
+	// it survive a crash.
+	SyncDir(dir string) error
+}
+
+// File is a file of an FS, which is read and written like an *os.File.
+//
+// The files which are mmap'ed, like the tables, the value log files and the write-ahead logs of the
+// memtables, must have a file descriptor, as their memory is read and written directly, so the
+// data written to it doesn't go through the File. They are either an *os.File, or wrap one, which
+// they return from an OSFile method. See OSFile.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Fd() uintptr
+}
+
+// OSFile returns the *os.File of f, which must be one, or wrap one returned by its OSFile method
+// if it isn't nil, to be mmap'ed or read and written with direct I/O.
+func OSFile(f File) (*os.File, error) {
+	switch f := f.(type) {
+	case *os.File:
+		return f, nil
+	case interface{ OSFile() *os.File }:
+		if fd := f.OSFile(); fd != nil {
+			return fd, nil
+		}
+	}
+	return nil, errors.Errorf("file %s has no file descriptor to mmap", f.Name())
+}
+
+// WritesSynced returns whether the files opened with flag sync their data on every write, like
+// the ones opened with O_DSYNC.
+func WritesSynced(flag int) bool {
+	return (datasyncFileFlag != 0 && flag&datasyncFileFlag == datasyncFileFlag) ||
+		flag&os.O_SYNC == os.O_SYNC
+}
+
+// OSFS is the file system of the operating system.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// A nil *os.File would make a File which isn't nil.
+		return nil, err
+	}
+	return f, nil
+}
+func (osFS) Rename(oldpath, newpath string) error          { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                      { return os.Remove(name) }
+func (osFS) Stat(name string) (os.FileInfo, error)         { return os.Stat(name) }
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error  { return os.MkdirAll(path, perm) }
+func (osFS) SyncDir(dir string) error                      { return syncDir(dir) }
+
+// ReadFile reads the named file of fs, like ioutil.ReadFile.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// OpenMmapFile opens the named file of fs and mmaps it, like z.OpenMmapFile.
+func OpenMmapFile(fs FS, name string, flag int, maxSz int) (*z.MmapFile, error) {
+	f, err := fs.OpenFile(name, flag, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open: %s", name)
+	}
+	fd, err := OSFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return z.OpenMmapFileUsing(fd, maxSz, flag != os.O_RDONLY)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the default upper bounds, in seconds, of the buckets of the latency
+// histograms.
+var DefaultLatencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// histogramData has the buckets of a Histogram and their counts. It is replaced when the buckets
+// are changed.
+type histogramData struct {
+	bounds []float64
+	counts []uint64 // Atomic. The last one is for the observations above all the bounds.
+	sumNs  int64    // Atomic
+	count  uint64   // Atomic
+}
+
+// Histogram is an expvar.Var which counts durations in buckets. It is safe for concurrent use.
+type Histogram struct {
+	data atomic.Value // *histogramData
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds, in seconds.
+func NewHistogram(bounds []float64) *Histogram {
+	h := &Histogram{}
+	h.SetBuckets(bounds)
+	return h
+}
+
+// SetBuckets replaces the bucket upper bounds, in seconds, and resets the histogram.
+func (h *Histogram) SetBuckets(bounds []float64) {
+	b := append([]float64{}, bounds...)
+	sort.Float64s(b)
+	h.data.Store(&histogramData{bounds: b, counts: make([]uint64, len(b)+1)})
+}
+
+// Observe adds the duration d to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	data := h.data.Load().(*histogramData)
+	i := sort.SearchFloat64s(data.bounds, d.Seconds())
+	atomic.AddUint64(&data.counts[i], 1)
+	atomic.AddInt64(&data.sumNs, int64(d))
+	atomic.AddUint64(&data.count, 1)
+}
+
+// Snapshot returns the bucket upper bounds, in seconds, with the cumulative number of observations
+// at or below each of them. It also returns the number of observations and their sum, in seconds.
+func (h *Histogram) Snapshot() (buckets map[float64]uint64, count uint64, sum float64) {
+	data := h.data.Load().(*histogramData)
+	buckets = make(map[float64]uint64, len(data.bounds))
+	var cum uint64
+	for i, b := range data.bounds {
+		cum += atomic.LoadUint64(&data.counts[i])
+		buckets[b] = cum
+	}
+	cum += atomic.LoadUint64(&data.counts[len(data.bounds)])
+	// The count is read after the buckets, so that it isn't smaller than the biggest bucket.
+	count = atomic.LoadUint64(&data.count)
+	if count < cum {
+		count = cum
+	}
+	return buckets, count, time.Duration(atomic.LoadInt64(&data.sumNs)).Seconds()
+}
+
+// String implements expvar.Var. It returns the cumulative counts of the buckets, keyed by their
+// upper bounds, along with the number of observations and their sum, as JSON.
+func (h *Histogram) String() string {
+	buckets, count, sum := h.Snapshot()
+	out := struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}{Buckets: make(map[string]uint64, len(buckets)+1), Count: count, Sum: sum}
+	for b, c := range buckets {
+		out.Buckets[strconv.FormatFloat(b, 'g', -1, 64)] = c
+	}
+	out.Buckets["+Inf"] = count
+	buf, _ := json.Marshal(out)
+	return string(buf)
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 0.1, 0.01})
+	h.Observe(5 * time.Millisecond)
+	h.Observe(100 * time.Millisecond)
+	h.Observe(500 * time.Millisecond)
+	h.Observe(2 * time.Second)
+
+	buckets, count, sum := h.Snapshot()
+	// The bounds are sorted, and an observation equal to a bound falls in its bucket.
+	require.Equal(t, map[float64]uint64{0.01: 1, 0.1: 2, 1: 3}, buckets)
+	require.Equal(t, uint64(4), count)
+	require.InDelta(t, 2.605, sum, 1e-9)
+
+	var out struct {
+		Buckets map[string]uint64
+		Count   uint64
+	}
+	require.NoError(t, json.Unmarshal([]byte(h.String()), &out))
+	require.Equal(t, uint64(4), out.Buckets["+Inf"])
+	require.Equal(t, uint64(2), out.Buckets["0.1"])
+	require.Equal(t, uint64(4), out.Count)
+
+	// Changing the buckets resets the histogram.
+	h.SetBuckets([]float64{0.5})
+	buckets, count, _ = h.Snapshot()
+	require.Equal(t, map[float64]uint64{0.5: 0}, buckets)
+	require.Equal(t, uint64(0), count)
+}
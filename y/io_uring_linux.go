@@ -0,0 +1,361 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultIOUringEntries is the size of the submission queue of the ring, which is the maximum
+	// number of reads submitted together.
+	defaultIOUringEntries = 256
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringFeatSingleMmap = 1 << 0
+	ioringEnterGetEvents = 1 << 0
+	ioringOpReadv        = 1
+
+	ioUringCQESize = 16
+)
+
+// The following structs mirror the ones in linux/io_uring.h.
+
+type ioSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+type ioCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+type ioUringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSQRingOffsets
+	cqOff                                                                  ioCQRingOffsets
+}
+
+type ioUringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type ioUringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ioUringRequest is a single read submitted to the ring.
+type ioUringRequest struct {
+	fd   int32
+	off  int64
+	iov  syscall.Iovec
+	res  int32
+	err  error // Set if the read couldn't be submitted.
+	done chan struct{}
+}
+
+// ioUringBackend reads the files via io_uring. A single goroutine owns the ring. It submits all
+// the reads pending at a time, like the ones of the goroutines prefetching the values of an
+// iterator, with a single system call.
+type ioUringBackend struct {
+	fd     int
+	sqRing []byte
+	cqRing []byte
+	sqeMem []byte
+
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []ioUringSQE
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    []ioUringCQE
+
+	// mu guards reqs against being closed while ReadAt sends to it.
+	mu      sync.RWMutex
+	closed  bool
+	reqs    chan *ioUringRequest
+	batch   []*ioUringRequest
+	stopped chan struct{}
+	// err is set once io_uring_enter fails. The reads aren't submitted anymore afterwards.
+	err error
+}
+
+// NewIOUringBackend returns an IOBackend using an io_uring with the given number of submission
+// queue entries. It returns an error if the kernel doesn't support io_uring.
+func NewIOUringBackend(entries uint32) (IOBackend, error) {
+	var p ioUringParams
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries),
+		uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "io_uring_setup")
+	}
+	b := &ioUringBackend{
+		fd:      int(fd),
+		reqs:    make(chan *ioUringRequest, p.sqEntries),
+		batch:   make([]*ioUringRequest, 0, p.sqEntries),
+		stopped: make(chan struct{}),
+	}
+	if err := b.mmapRings(&p); err != nil {
+		b.unmap()
+		syscall.Close(b.fd)
+		return nil, err
+	}
+	go b.loop()
+	return b, nil
+}
+
+func (b *ioUringBackend) mmapRings(p *ioUringParams) error {
+	mmap := func(off int64, sz uint32) ([]byte, error) {
+		data, err := unix.Mmap(b.fd, off, int(sz), unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_SHARED|unix.MAP_POPULATE)
+		return data, errors.Wrap(err, "while mmapping io_uring")
+	}
+
+	sqSize := p.sqOff.array + p.sqEntries*4
+	cqSize := p.cqOff.cqes + p.cqEntries*ioUringCQESize
+	single := p.features&ioringFeatSingleMmap != 0
+	if single && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	var err error
+	if b.sqRing, err = mmap(ioringOffSQRing, sqSize); err != nil {
+		return err
+	}
+	if single {
+		b.cqRing = b.sqRing
+	} else if b.cqRing, err = mmap(ioringOffCQRing, cqSize); err != nil {
+		return err
+	}
+	sqeSize := uint32(unsafe.Sizeof(ioUringSQE{}))
+	if b.sqeMem, err = mmap(ioringOffSQEs, p.sqEntries*sqeSize); err != nil {
+		return err
+	}
+
+	u32 := func(ring []byte, off uint32) *uint32 {
+		return (*uint32)(unsafe.Pointer(&ring[off]))
+	}
+	b.sqTail = u32(b.sqRing, p.sqOff.tail)
+	b.sqMask = *u32(b.sqRing, p.sqOff.ringMask)
+	b.sqArray = (*[1 << 28]uint32)(unsafe.Pointer(&b.sqRing[p.sqOff.array]))[:p.sqEntries:p.sqEntries]
+	b.sqes = (*[1 << 24]ioUringSQE)(unsafe.Pointer(&b.sqeMem[0]))[:p.sqEntries:p.sqEntries]
+	b.cqHead = u32(b.cqRing, p.cqOff.head)
+	b.cqTail = u32(b.cqRing, p.cqOff.tail)
+	b.cqMask = *u32(b.cqRing, p.cqOff.ringMask)
+	b.cqes = (*[1 << 24]ioUringCQE)(unsafe.Pointer(&b.cqRing[p.cqOff.cqes]))[:p.cqEntries:p.cqEntries]
+	return nil
+}
+
+func (b *ioUringBackend) unmap() {
+	if b.cqRing != nil && &b.cqRing[0] != &b.sqRing[0] {
+		unix.Munmap(b.cqRing)
+	}
+	for _, m := range [][]byte{b.sqRing, b.sqeMem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+}
+
+// loop submits the pending reads in batches, until the backend is closed.
+func (b *ioUringBackend) loop() {
+	defer close(b.stopped)
+	for {
+		req, ok := <-b.reqs
+		if !ok {
+			return
+		}
+		b.batch = append(b.batch[:0], req)
+	drain:
+		for len(b.batch) < cap(b.batch) {
+			select {
+			case req, ok := <-b.reqs:
+				if !ok {
+					break drain
+				}
+				b.batch = append(b.batch, req)
+			default:
+				break drain
+			}
+		}
+		if b.err != nil {
+			failRequests(b.batch, b.err)
+			continue
+		}
+		b.err = b.submit(b.batch)
+	}
+}
+
+// failRequests completes the given requests with err.
+func failRequests(reqs []*ioUringRequest, err error) {
+	for _, req := range reqs {
+		req.err = err
+		close(req.done)
+	}
+}
+
+// submit submits the reads of the batch and waits for all of them to complete. If io_uring_enter
+// fails, the reads which weren't completed are failed with its error, which is returned.
+func (b *ioUringBackend) submit(batch []*ioUringRequest) error {
+	// This goroutine is the only one producing submission queue entries.
+	tail := atomic.LoadUint32(b.sqTail)
+	for i, req := range batch {
+		idx := tail & b.sqMask
+		b.sqes[idx] = ioUringSQE{
+			opcode:   ioringOpReadv,
+			fd:       req.fd,
+			off:      uint64(req.off),
+			addr:     uint64(uintptr(unsafe.Pointer(&req.iov))),
+			len:      1,
+			userData: uint64(i),
+		}
+		b.sqArray[idx] = idx
+		tail++
+	}
+	atomic.StoreUint32(b.sqTail, tail)
+
+	toSubmit, completed := len(batch), 0
+	for completed < len(batch) {
+		n, _, errno := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(b.fd),
+			uintptr(toSubmit), 1, ioringEnterGetEvents, 0, 0)
+		switch errno {
+		case 0:
+			toSubmit -= int(n)
+		case syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+			// Interrupted or out of resources, so retry.
+		default:
+			// The kernel hasn't consumed the entries which weren't submitted, so they're taken
+			// back. The reads in flight are failed too: the wait only fails if completions were
+			// lost, or the ring is unusable.
+			atomic.StoreUint32(b.sqTail, tail-uint32(toSubmit))
+			b.reapCompletions(batch)
+			err := errors.Wrap(errno, "io_uring_enter")
+			for _, req := range batch {
+				select {
+				case <-req.done:
+				default:
+					req.err = err
+					close(req.done)
+				}
+			}
+			return err
+		}
+		completed += b.reapCompletions(batch)
+	}
+	return nil
+}
+
+// reapCompletions completes the reads of the batch found in the completion queue, and returns
+// their number.
+func (b *ioUringBackend) reapCompletions(batch []*ioUringRequest) int {
+	var n int
+	head, cqTail := atomic.LoadUint32(b.cqHead), atomic.LoadUint32(b.cqTail)
+	for ; head != cqTail; head++ {
+		cqe := &b.cqes[head&b.cqMask]
+		req := batch[cqe.userData]
+		req.res = cqe.res
+		close(req.done)
+		n++
+	}
+	atomic.StoreUint32(b.cqHead, head)
+	return n
+}
+
+func (b *ioUringBackend) NewFile(fd *os.File) BackendFile {
+	return &ioUringFile{b: b, f: fd, fd: int32(fd.Fd())}
+}
+
+func (b *ioUringBackend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.reqs)
+	b.mu.Unlock()
+	<-b.stopped
+	b.unmap()
+	return syscall.Close(b.fd)
+}
+
+type ioUringFile struct {
+	b  *ioUringBackend
+	f  *os.File
+	fd int32
+}
+
+func (f *ioUringFile) ReadAt(buf []byte, off int64) error {
+	for len(buf) > 0 {
+		req := &ioUringRequest{fd: f.fd, off: off, done: make(chan struct{})}
+		req.iov.Base = &buf[0]
+		req.iov.SetLen(len(buf))
+		f.b.mu.RLock()
+		if f.b.closed {
+			f.b.mu.RUnlock()
+			return &os.PathError{Op: "read", Path: f.f.Name(), Err: os.ErrClosed}
+		}
+		f.b.reqs <- req
+		f.b.mu.RUnlock()
+		<-req.done
+
+		switch errno := syscall.Errno(-req.res); {
+		case req.err != nil:
+			return &os.PathError{Op: "read", Path: f.f.Name(), Err: req.err}
+		case req.res == 0:
+			return io.ErrUnexpectedEOF
+		case req.res > 0:
+			buf = buf[req.res:]
+			off += int64(req.res)
+		case errno == syscall.EINTR || errno == syscall.EAGAIN:
+		default:
+			return &os.PathError{Op: "read", Path: f.f.Name(), Err: errno}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOUringEnterError(t *testing.T) {
+	f, err := ioutil.TempFile("", "badger-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(make([]byte, 1<<10))
+	require.NoError(t, err)
+
+	backend, err := NewIOUringBackend(8)
+	if err != nil {
+		t.Skipf("io_uring is not supported: %v", err)
+	}
+	b := backend.(*ioUringBackend)
+	file := b.NewFile(f)
+	require.NoError(t, file.ReadAt(make([]byte, 10), 0))
+
+	// io_uring_enter fails once the ring is closed, and the reads return its error.
+	require.NoError(t, syscall.Close(b.fd))
+	require.ErrorIs(t, file.ReadAt(make([]byte, 10), 0), syscall.EBADF)
+	require.ErrorIs(t, file.ReadAt(make([]byte, 10), 0), syscall.EBADF)
+	require.ErrorIs(t, b.Close(), syscall.EBADF)
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import "github.com/pkg/errors"
+
+const defaultIOUringEntries = 0
+
+// NewIOUringBackend returns an error, since io_uring is only available on Linux.
+func NewIOUringBackend(entries uint32) (IOBackend, error) {
+	return nil, errors.New("io_uring is only supported on Linux")
+}
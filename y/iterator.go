@@ -16,70 +16,11 @@
 
 package y
 
-import (
-	"bytes"
-	"encoding/binary"
-)
+import "github.com/dgraph-io/badger/v3/kv"
 
 // ValueStruct represents the value info that can be associated with a key, but also the internal
-// Meta field.
-type ValueStruct struct {
-	Meta      byte
-	UserMeta  byte
-	ExpiresAt uint64
-	Value     []byte
-
-	Version uint64 // This field is not serialized. Only for internal usage.
-}
-
-func sizeVarint(x uint64) (n int) {
-	for {
-		n++
-		x >>= 7
-		if x == 0 {
-			break
-		}
-	}
-	return n
-}
-
-// EncodedSize is the size of the ValueStruct when encoded
-func (v *ValueStruct) EncodedSize() uint32 {
-	sz := len(v.Value) + 2 // meta, usermeta.
-	enc := sizeVarint(v.ExpiresAt)
-	return uint32(sz + enc)
-}
-
-// Decode uses the length of the slice to infer the length of the Value field.
-func (v *ValueStruct) Decode(b []byte) {
-	v.Meta = b[0]
-	v.UserMeta = b[1]
-	var sz int
-	v.ExpiresAt, sz = binary.Uvarint(b[2:])
-	v.Value = b[2+sz:]
-}
-
-// Encode expects a slice of length at least v.EncodedSize().
-func (v *ValueStruct) Encode(b []byte) uint32 {
-	b[0] = v.Meta
-	b[1] = v.UserMeta
-	sz := binary.PutUvarint(b[2:], v.ExpiresAt)
-	n := copy(b[2+sz:], v.Value)
-	return uint32(2 + sz + n)
-}
-
-// EncodeTo should be kept in sync with the Encode function above. The reason
-// this function exists is to avoid creating byte arrays per key-value pair in
-// table/builder.go.
-func (v *ValueStruct) EncodeTo(buf *bytes.Buffer) {
-	buf.WriteByte(v.Meta)
-	buf.WriteByte(v.UserMeta)
-	var enc [binary.MaxVarintLen64]byte
-	sz := binary.PutUvarint(enc[:], v.ExpiresAt)
-
-	buf.Write(enc[:sz])
-	buf.Write(v.Value)
-}
+// Meta field. It is defined in package kv, which the skiplist shares.
+type ValueStruct = kv.ValueStruct
 
 // Iterator is an interface for a basic iterator.
 type Iterator interface {
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// createMemFile creates a memfd file named name.
+func createMemFile(name string) (memFile, error) {
+	fd, err := unix.MemfdCreate(filepath.Base(name), unix.MFD_CLOEXEC)
+	if err != nil {
+		return memFile{}, &os.PathError{Op: "memfd_create", Path: name, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), name)
+	return memFile{File: f, path: memFilePath(f, "")}, nil
+}
+
+// memFilePath returns the path f is reopened from: the memfd of f, in /proc.
+func memFilePath(f *os.File, _ string) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// remove closes the file. The memfd is freed once the files reopened from it are closed too.
+func (f memFile) remove() error {
+	return f.Close()
+}
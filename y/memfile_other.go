@@ -0,0 +1,55 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd netbsd openbsd solaris
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// createMemFile creates a temporary file, which takes the name name. There is no memfd outside of
+// Linux, but the temporary directory is often in memory.
+func createMemFile(name string) (memFile, error) {
+	tmp, err := ioutil.TempFile("", "badger-memfs-")
+	if err != nil {
+		return memFile{}, err
+	}
+	defer tmp.Close()
+	f := memFile{path: tmp.Name()}
+	if f.File, err = reopen(f, name, os.O_RDWR); err != nil {
+		os.Remove(f.path)
+		return memFile{}, err
+	}
+	return f, nil
+}
+
+// memFilePath returns the path f is reopened from: the temporary file it was created as.
+func memFilePath(_ *os.File, path string) string {
+	return path
+}
+
+// remove closes the file and removes its temporary file. The files reopened from it can still
+// be read and written until they're closed.
+func (f memFile) remove() error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.path)
+}
@@ -0,0 +1,238 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// memFS keeps the files in memory, as memfd files on Linux, which can be mmap'ed like the ones on
+// disk. On the other systems, the files are kept in temporary files, out of its directories.
+type memFS struct {
+	sync.Mutex
+	files map[string]memFile // By clean path. The opened files are reopened from these.
+	dirs  map[string]time.Time
+}
+
+// memFile is a file of a memFS.
+type memFile struct {
+	*os.File
+	// path is the path the file is reopened from.
+	path string
+}
+
+// NewMemFS returns an FS which keeps the files in memory, for the tests. Unlike a DB opened with
+// InMemory, a DB using it writes all its files like on disk, and can be closed and reopened with
+// the same FS. The files are gone once all the DBs using the FS are closed and it's dropped, or
+// on the systems other than Linux, once they're removed from it.
+func NewMemFS() (FS, error) {
+	return &memFS{
+		files: make(map[string]memFile),
+		// The relative paths are under ".".
+		dirs: map[string]time.Time{string(filepath.Separator): time.Now(), ".": time.Now()},
+	}, nil
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// parentExists must be called with the lock held.
+func (fs *memFS) parentExists(name string) bool {
+	_, ok := fs.dirs[filepath.Dir(name)]
+	return ok
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.Lock()
+	defer fs.Unlock()
+	f, ok := fs.files[name]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && (flag&os.O_CREATE == 0 || !fs.parentExists(name)):
+		return nil, notExist("open", name)
+	case !ok:
+		var err error
+		if f, err = createMemFile(name); err != nil {
+			return nil, err
+		}
+		fs.files[name] = f
+	}
+	nf, err := reopen(f, name, flag&^(os.O_CREATE|os.O_EXCL))
+	if err != nil {
+		return nil, err
+	}
+	return nf, nil
+}
+
+// reopen opens the file f again, under name. Unlike a dup of the file descriptor, the file gets
+// its own offset and flags, like opening it again on disk.
+func reopen(f memFile, name string, flag int) (*os.File, error) {
+	fd, err := unix.Open(f.path, flag|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (fs *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	fs.Lock()
+	defer fs.Unlock()
+	f, ok := fs.files[oldpath]
+	if !ok {
+		return notExist("rename", oldpath)
+	}
+	if !fs.parentExists(newpath) {
+		return notExist("rename", newpath)
+	}
+	if oldpath == newpath {
+		return nil
+	}
+	// The file is reopened under its new name, which its FileInfo takes.
+	nf, err := reopen(f, newpath, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	if old, ok := fs.files[newpath]; ok {
+		old.remove()
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = memFile{File: nf, path: memFilePath(nf, f.path)}
+	return f.Close()
+}
+
+func (fs *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.Lock()
+	defer fs.Unlock()
+	if f, ok := fs.files[name]; ok {
+		// The opened files keep the file alive until they're closed.
+		delete(fs.files, name)
+		return f.remove()
+	}
+	if _, ok := fs.dirs[name]; !ok {
+		return notExist("remove", name)
+	}
+	for path := range fs.files {
+		if filepath.Dir(path) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: unix.ENOTEMPTY}
+		}
+	}
+	for path := range fs.dirs {
+		if path != name && filepath.Dir(path) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: unix.ENOTEMPTY}
+		}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.stat(name)
+}
+
+// stat must be called with the lock held.
+func (fs *memFS) stat(name string) (os.FileInfo, error) {
+	if f, ok := fs.files[name]; ok {
+		return f.Stat()
+	}
+	if modTime, ok := fs.dirs[name]; ok {
+		return memDirInfo{name: filepath.Base(name), modTime: modTime}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (fs *memFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname = filepath.Clean(dirname)
+	fs.Lock()
+	defer fs.Unlock()
+	if _, ok := fs.dirs[dirname]; !ok {
+		return nil, notExist("open", dirname)
+	}
+	var names []string
+	for path := range fs.files {
+		if filepath.Dir(path) == dirname {
+			names = append(names, path)
+		}
+	}
+	for path := range fs.dirs {
+		if path != dirname && filepath.Dir(path) == dirname {
+			names = append(names, path)
+		}
+	}
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		fi, err := fs.stat(name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+func (fs *memFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	fs.Lock()
+	defer fs.Unlock()
+	for p := path; ; p = filepath.Dir(p) {
+		if _, ok := fs.files[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: unix.ENOTDIR}
+		}
+		if _, ok := fs.dirs[p]; ok {
+			break
+		}
+		fs.dirs[p] = time.Now()
+	}
+	return nil
+}
+
+func (fs *memFS) SyncDir(dir string) error {
+	if _, err := fs.Stat(dir); err != nil {
+		return err
+	}
+	// The entries of the directories are only in memory.
+	return nil
+}
+
+type memDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (fi memDirInfo) Name() string       { return fi.name }
+func (fi memDirInfo) Size() int64        { return 0 }
+func (fi memDirInfo) Mode() os.FileMode  { return os.ModeDir | 0700 }
+func (fi memDirInfo) ModTime() time.Time { return fi.modTime }
+func (fi memDirInfo) IsDir() bool        { return true }
+func (fi memDirInfo) Sys() interface{}   { return nil }
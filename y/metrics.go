@@ -17,7 +17,10 @@
 package y
 
 import (
+	"encoding/json"
 	"expvar"
+	"sync"
+	"time"
 )
 
 var (
@@ -27,6 +30,12 @@ var (
 	vlogSize *expvar.Map
 	// pendingWrites tracks the number of pending writes.
 	pendingWrites *expvar.Map
+	// hotConflictKeys has the keys causing the most transaction conflicts.
+	hotConflictKeys *expvar.Map
+	// vlogSpaceAmp has the estimated space amplification of the value log.
+	vlogSpaceAmp *expvar.Map
+	// cacheMetrics has the hits, misses and evictions of the block, index and filter caches.
+	cacheMetrics *expvar.Map
 
 	// These are cumulative
 
@@ -52,6 +61,25 @@ var (
 	numMemtableGets *expvar.Int
 	// numCompactionTables is the number of tables being compacted
 	numCompactionTables *expvar.Int
+	// numTxnConflicts is the number of transactions aborted due to conflicts
+	numTxnConflicts *expvar.Int
+	// numTxnRetries is the number of transactions retried after a conflict
+	numTxnRetries *expvar.Int
+	// numExpiredPurged is the number of expired keys deleted by the expiry scans
+	numExpiredPurged *expvar.Int
+	// numVlogGCRewrites is the number of value log files rewritten by GC
+	numVlogGCRewrites *expvar.Int
+
+	// getLatency is the latency of the gets
+	getLatency *Histogram
+	// commitLatency is the latency of the transaction commits
+	commitLatency *Histogram
+	// flushLatency is the latency of the memtable flushes
+	flushLatency *Histogram
+	// compactionLatency is the latency of the compactions
+	compactionLatency *Histogram
+	// vlogSyncLatency is the latency of the value log syncs
+	vlogSyncLatency *Histogram
 )
 
 // These variables are global and have cumulative values for all kv stores.
@@ -70,6 +98,36 @@ func init() {
 	vlogSize = expvar.NewMap("badger_v3_vlog_size_bytes")
 	pendingWrites = expvar.NewMap("badger_v3_pending_writes_total")
 	numCompactionTables = expvar.NewInt("badger_v3_compactions_current")
+	numTxnConflicts = expvar.NewInt("badger_v3_txn_conflicts_total")
+	numTxnRetries = expvar.NewInt("badger_v3_txn_retries_total")
+	hotConflictKeys = expvar.NewMap("badger_v3_hot_conflict_keys")
+	vlogSpaceAmp = expvar.NewMap("badger_v3_vlog_space_amplification")
+	cacheMetrics = expvar.NewMap("badger_v3_cache_metrics")
+	numExpiredPurged = expvar.NewInt("badger_v3_expired_keys_purged_total")
+	numVlogGCRewrites = expvar.NewInt("badger_v3_vlog_gc_rewrites_total")
+
+	getLatency = newLatencyHistogram("badger_v3_get_latency_seconds")
+	commitLatency = newLatencyHistogram("badger_v3_commit_latency_seconds")
+	flushLatency = newLatencyHistogram("badger_v3_flush_latency_seconds")
+	compactionLatency = newLatencyHistogram("badger_v3_compaction_latency_seconds")
+	vlogSyncLatency = newLatencyHistogram("badger_v3_vlog_sync_latency_seconds")
+}
+
+func newLatencyHistogram(name string) *Histogram {
+	h := NewHistogram(DefaultLatencyBuckets)
+	expvar.Publish(name, h)
+	return h
+}
+
+// SetLatencyBuckets replaces the bucket upper bounds, in seconds, of all the latency histograms,
+// and resets them. The histograms are shared by all the DBs of the process, so this should be
+// called before opening them.
+func SetLatencyBuckets(bounds []float64) {
+	for _, h := range []*Histogram{
+		getLatency, commitLatency, flushLatency, compactionLatency, vlogSyncLatency,
+	} {
+		h.SetBuckets(bounds)
+	}
 }
 
 func NumReadsAdd(enabled bool, val int64) {
@@ -108,6 +166,42 @@ func NumCompactionTablesAdd(enabled bool, val int64) {
 	addInt(enabled, numCompactionTables, val)
 }
 
+func NumTxnConflictsAdd(enabled bool, val int64) {
+	addInt(enabled, numTxnConflicts, val)
+}
+
+func NumTxnRetriesAdd(enabled bool, val int64) {
+	addInt(enabled, numTxnRetries, val)
+}
+
+func NumExpiredPurgedAdd(enabled bool, val int64) {
+	addInt(enabled, numExpiredPurged, val)
+}
+
+func NumVlogGCRewritesAdd(enabled bool, val int64) {
+	addInt(enabled, numVlogGCRewrites, val)
+}
+
+func GetLatencyObserve(enabled bool, d time.Duration) {
+	observe(enabled, getLatency, d)
+}
+
+func CommitLatencyObserve(enabled bool, d time.Duration) {
+	observe(enabled, commitLatency, d)
+}
+
+func FlushLatencyObserve(enabled bool, d time.Duration) {
+	observe(enabled, flushLatency, d)
+}
+
+func CompactionLatencyObserve(enabled bool, d time.Duration) {
+	observe(enabled, compactionLatency, d)
+}
+
+func VlogSyncLatencyObserve(enabled bool, d time.Duration) {
+	observe(enabled, vlogSyncLatency, d)
+}
+
 func LSMSizeSet(enabled bool, key string, val expvar.Var) {
 	storeToMap(enabled, lsmSize, key, val)
 }
@@ -120,6 +214,23 @@ func PendingWritesSet(enabled bool, key string, val expvar.Var) {
 	storeToMap(enabled, pendingWrites, key, val)
 }
 
+func HotConflictKeysSet(enabled bool, key string, val expvar.Var) {
+	storeToMap(enabled, hotConflictKeys, key, val)
+}
+
+// HotConflictKeysDelete removes the hot conflict keys of key, if they're still published by val.
+func HotConflictKeysDelete(enabled bool, key string, val expvar.Var) {
+	deleteFromMap(enabled, hotConflictKeys, key, val)
+}
+
+func VlogSpaceAmpSet(enabled bool, key string, val expvar.Var) {
+	storeToMap(enabled, vlogSpaceAmp, key, val)
+}
+
+func CacheMetricsSet(enabled bool, key string, val expvar.Var) {
+	storeToMap(enabled, cacheMetrics, key, val)
+}
+
 func NumLSMBloomHitsAdd(enabled bool, key string, val int64) {
 	addToMap(enabled, numLSMBloomHits, key, val)
 }
@@ -144,6 +255,14 @@ func addInt(enabled bool, metric *expvar.Int, val int64) {
 	metric.Add(val)
 }
 
+func observe(enabled bool, metric *Histogram, d time.Duration) {
+	if !enabled {
+		return
+	}
+
+	metric.Observe(d)
+}
+
 func addToMap(enabled bool, metric *expvar.Map, key string, val int64) {
 	if !enabled {
 		return
@@ -152,6 +271,42 @@ func addToMap(enabled bool, metric *expvar.Map, key string, val int64) {
 	metric.Add(key, val)
 }
 
+// FuncVar is an expvar.Var which, like expvar.Func, publishes the value returned by a function,
+// until it is cleared. The expvar maps are never freed, so a DB publishes its functions through
+// FuncVars, and clears them when it's closed, instead of being kept alive by the maps.
+type FuncVar struct {
+	sync.RWMutex
+	f func() interface{}
+}
+
+// NewFuncVar returns a FuncVar publishing the value returned by f.
+func NewFuncVar(f func() interface{}) *FuncVar {
+	return &FuncVar{f: f}
+}
+
+// Value returns the value returned by the function, or nil once the FuncVar is cleared.
+func (v *FuncVar) Value() interface{} {
+	v.RLock()
+	defer v.RUnlock()
+	if v.f == nil {
+		return nil
+	}
+	return v.f()
+}
+
+// String implements the expvar.Var interface.
+func (v *FuncVar) String() string {
+	s, _ := json.Marshal(v.Value())
+	return string(s)
+}
+
+// Clear drops the function, which isn't called anymore.
+func (v *FuncVar) Clear() {
+	v.Lock()
+	defer v.Unlock()
+	v.f = nil
+}
+
 func storeToMap(enabled bool, metric *expvar.Map, key string, val expvar.Var) {
 	if !enabled {
 		return
@@ -160,6 +315,17 @@ func storeToMap(enabled bool, metric *expvar.Map, key string, val expvar.Var) {
 	metric.Set(key, val)
 }
 
+// deleteFromMap removes key from metric, unless it was set to another value than val since.
+func deleteFromMap(enabled bool, metric *expvar.Map, key string, val expvar.Var) {
+	if !enabled {
+		return
+	}
+
+	if metric.Get(key) == val {
+		metric.Delete(key)
+	}
+}
+
 func getFromMap(enabled bool, metric *expvar.Map, key string) expvar.Var {
 	if !enabled {
 		return nil
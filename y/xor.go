@@ -0,0 +1,217 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// xorTrailerSize is the size of the seed, block length and fingerprint width stored at the end of
+// an XorFilter.
+const xorTrailerSize = 8 + 4 + 1
+
+// XorFilter is an encoded set of key hashes, as described in "Xor Filters: Faster and Smaller
+// Than Bloom and Cuckoo Filters" by Graf and Lemire. Every key is mapped to three slots, one in
+// each third of the filter, such that the XOR of their fingerprints is the fingerprint of the key.
+// For a false positive rate p, it uses about 1.23*log2(1/p) bits per key, which is less than
+// the 1.44*log2(1/p) bits per key needed by a Bloom filter.
+//
+// The fingerprints are bit packed and followed by the seed (8 bytes), the length of each third of
+// the filter (4 bytes) and the fingerprint width in bits (1 byte).
+type XorFilter []byte
+
+// xorFingerprintBits returns the fingerprint width for the false positive rate fp.
+func xorFingerprintBits(fp float64) int {
+	if fp <= 0 || fp >= 1 {
+		return 8
+	}
+	w := int(math.Ceil(math.Log2(1 / fp)))
+	switch {
+	case w < 1:
+		return 1
+	case w > 32:
+		return 32
+	}
+	return w
+}
+
+func murmurMix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// reduce maps hash uniformly to [0, n).
+func reduce(hash, n uint32) uint32 {
+	return uint32((uint64(hash) * uint64(n)) >> 32)
+}
+
+func xorSlots(h uint64, blockLen uint32) (uint32, uint32, uint32) {
+	return reduce(uint32(h), blockLen),
+		reduce(uint32(bits.RotateLeft64(h, 21)), blockLen) + blockLen,
+		reduce(uint32(bits.RotateLeft64(h, 42)), blockLen) + 2*blockLen
+}
+
+func xorFingerprint(h uint64, width uint8) uint32 {
+	fp := uint32(h ^ h>>32)
+	if width < 32 {
+		fp &= 1<<width - 1
+	}
+	return fp
+}
+
+// getBits returns the width bits at index i of the bit packed slice data.
+func getBits(data []byte, i uint32, width uint8) uint32 {
+	off := uint64(i) * uint64(width)
+	v := binary.LittleEndian.Uint64(data[off/8:]) >> (off % 8)
+	if width < 32 {
+		v &= 1<<width - 1
+	}
+	return uint32(v)
+}
+
+// orBits ORs val into the width bits at index i of the bit packed slice data.
+func orBits(data []byte, i uint32, width uint8, val uint32) {
+	off := uint64(i) * uint64(width)
+	v := binary.LittleEndian.Uint64(data[off/8:])
+	binary.LittleEndian.PutUint64(data[off/8:], v|uint64(val)<<(off%8))
+}
+
+// NewXorFilter returns a new XorFilter for the key hashes, with a false positive rate of at most
+// fp. It returns nil if there are no keys.
+func NewXorFilter(keys []uint32, fp float64) XorFilter {
+	// The construction fails on duplicate keys. So, dedup them first.
+	uniq := make([]uint32, len(keys))
+	copy(uniq, keys)
+	sort.Slice(uniq, func(i, j int) bool { return uniq[i] < uniq[j] })
+	n := 0
+	for i, k := range uniq {
+		if i == 0 || k != uniq[n-1] {
+			uniq[n] = k
+			n++
+		}
+	}
+	uniq = uniq[:n]
+	if n == 0 {
+		return nil
+	}
+
+	width := uint8(xorFingerprintBits(fp))
+	blockLen := uint32(32+math.Ceil(1.23*float64(n))) / 3
+	capacity := 3 * blockLen
+
+	type slot struct {
+		xormask uint64
+		count   uint32
+	}
+	type peeled struct {
+		hash uint64
+		idx  uint32
+	}
+	slots := make([]slot, capacity)
+	queue := make([]uint32, 0, capacity)
+	stack := make([]peeled, 0, n)
+
+	var seed uint64
+	for rounds := uint64(1); ; rounds++ {
+		seed = murmurMix64(rounds * 0x9e3779b97f4a7c15)
+		for i := range slots {
+			slots[i] = slot{}
+		}
+		for _, k := range uniq {
+			h := murmurMix64(uint64(k) + seed)
+			h0, h1, h2 := xorSlots(h, blockLen)
+			for _, s := range [3]uint32{h0, h1, h2} {
+				slots[s].xormask ^= h
+				slots[s].count++
+			}
+		}
+
+		// Peel the slots which are used by a single key, until none are left.
+		queue, stack = queue[:0], stack[:0]
+		for i := range slots {
+			if slots[i].count == 1 {
+				queue = append(queue, uint32(i))
+			}
+		}
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			if slots[i].count != 1 {
+				continue
+			}
+			h := slots[i].xormask
+			stack = append(stack, peeled{hash: h, idx: i})
+			h0, h1, h2 := xorSlots(h, blockLen)
+			for _, s := range [3]uint32{h0, h1, h2} {
+				slots[s].xormask ^= h
+				slots[s].count--
+				if slots[s].count == 1 {
+					queue = append(queue, s)
+				}
+			}
+		}
+		if len(stack) == n {
+			break
+		}
+	}
+
+	fpBytes := (uint64(capacity)*uint64(width) + 7) / 8
+	// The trailer is at least 8 bytes long, so the uint64 accesses of the last fingerprints don't
+	// go out of bounds.
+	f := make([]byte, int(fpBytes)+xorTrailerSize)
+	for i := len(stack) - 1; i >= 0; i-- {
+		p := stack[i]
+		h0, h1, h2 := xorSlots(p.hash, blockLen)
+		// The slot of this key is still zero, so XOR-ing all three slots is fine.
+		fp := xorFingerprint(p.hash, width) ^ getBits(f, h0, width) ^
+			getBits(f, h1, width) ^ getBits(f, h2, width)
+		orBits(f, p.idx, width, fp)
+	}
+	binary.LittleEndian.PutUint64(f[fpBytes:], seed)
+	binary.LittleEndian.PutUint32(f[fpBytes+8:], blockLen)
+	f[fpBytes+12] = width
+	return f
+}
+
+// MayContain returns whether the filter may contain the given key hash. False positives are
+// possible, where it returns true for keys not in the original set.
+func (f XorFilter) MayContain(h uint32) bool {
+	if len(f) < xorTrailerSize {
+		return false
+	}
+	tr := f[len(f)-xorTrailerSize:]
+	seed := binary.LittleEndian.Uint64(tr)
+	blockLen := binary.LittleEndian.Uint32(tr[8:])
+	width := tr[12]
+	if width == 0 || width > 32 ||
+		uint64(len(f)-xorTrailerSize) < (3*uint64(blockLen)*uint64(width)+7)/8 {
+		// Consider a filter we can't decode a match.
+		return true
+	}
+
+	hash := murmurMix64(uint64(h) + seed)
+	h0, h1, h2 := xorSlots(hash, blockLen)
+	fp := getBits(f, h0, width) ^ getBits(f, h1, width) ^ getBits(f, h2, width)
+	return fp == xorFingerprint(hash, width)
+}
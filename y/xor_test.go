@@ -0,0 +1,61 @@
+/*
+ * Copyright 2022 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXorFilter(t *testing.T) {
+	require.Nil(t, NewXorFilter(nil, 0.01))
+	require.False(t, XorFilter(nil).MayContain(Hash([]byte("foo"))))
+
+	for _, fp := range []float64{0.1, 0.01, 0.001} {
+		for _, n := range []int{1, 10, 1000, 100000} {
+			t.Run(fmt.Sprintf("fp=%v/n=%d", fp, n), func(t *testing.T) {
+				keys := make([]uint32, 0, 2*n)
+				for i := 0; i < n; i++ {
+					keys = append(keys, Hash([]byte(fmt.Sprintf("key%d", i))))
+				}
+				// Duplicates, like multiple versions of a key, must not break the construction.
+				keys = append(keys, keys...)
+				f := NewXorFilter(keys, fp)
+				for _, k := range keys {
+					require.True(t, f.MayContain(k))
+				}
+
+				var falsePositives int
+				for i := 0; i < 100000; i++ {
+					if f.MayContain(Hash([]byte(fmt.Sprintf("missing%d", i)))) {
+						falsePositives++
+					}
+				}
+				require.LessOrEqual(t, float64(falsePositives)/100000, fp*1.2)
+
+				if n >= 1000 {
+					// Compare with a Bloom filter of the same false positive rate as the xor filter.
+					bitsPerKey := float64(8*len(f)) / float64(n)
+					bloomBitsPerKey := 1.44 * float64(xorFingerprintBits(fp))
+					require.Less(t, bitsPerKey, bloomBitsPerKey)
+				}
+			})
+		}
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/dgraph-io/badger/v3/kv"
 	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
@@ -66,6 +67,15 @@ var (
 
 // OpenExistingFile opens an existing file, errors if it doesn't exist.
 func OpenExistingFile(filename string, flags Flags) (*os.File, error) {
+	f, err := OpenExistingFileFS(OSFS, filename, flags)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*os.File), nil
+}
+
+// OpenExistingFileFS opens an existing file of fs, errors if it doesn't exist.
+func OpenExistingFileFS(fs FS, filename string, flags Flags) (File, error) {
 	openFlags := os.O_RDWR
 	if flags&ReadOnly != 0 {
 		openFlags = os.O_RDONLY
@@ -74,7 +84,7 @@ func OpenExistingFile(filename string, flags Flags) (*os.File, error) {
 	if flags&Sync != 0 {
 		openFlags |= datasyncFileFlag
 	}
-	return os.OpenFile(filename, openFlags, 0)
+	return fs.OpenFile(filename, openFlags, 0)
 }
 
 // CreateSyncedFile creates a new file (using O_EXCL), errors if it already existed.
@@ -97,11 +107,38 @@ func OpenSyncedFile(filename string, sync bool) (*os.File, error) {
 
 // OpenTruncFile opens the file with O_RDWR | O_CREATE | O_TRUNC
 func OpenTruncFile(filename string, sync bool) (*os.File, error) {
+	f, err := OpenTruncFileFS(OSFS, filename, sync)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*os.File), nil
+}
+
+// OpenTruncFileFS opens the file of fs with O_RDWR | O_CREATE | O_TRUNC
+func OpenTruncFileFS(fs FS, filename string, sync bool) (File, error) {
 	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
 	if sync {
 		flags |= datasyncFileFlag
 	}
-	return os.OpenFile(filename, flags, 0600)
+	return fs.OpenFile(filename, flags, 0600)
+}
+
+// DeleteMmapFile unmaps, closes and removes the file of mf from fs. Unlike mf.Delete, it doesn't
+// truncate the file first, so that another process which has it mapped, like a DB opened in
+// Secondary mode, can still read it.
+func DeleteMmapFile(fs FS, mf *z.MmapFile) error {
+	// The data can be set without a file, in which case there is nothing to delete.
+	if mf.Fd == nil {
+		return nil
+	}
+	if err := z.Munmap(mf.Data); err != nil {
+		return errors.Wrapf(err, "while munmap file: %s", mf.Fd.Name())
+	}
+	mf.Data = nil
+	if err := mf.Fd.Close(); err != nil {
+		return errors.Wrapf(err, "while close file: %s", mf.Fd.Name())
+	}
+	return fs.Remove(mf.Fd.Name())
 }
 
 // SafeCopy does append(a[:0], src...).
@@ -140,12 +177,9 @@ func ParseTs(key []byte) uint64 {
 // CompareKeys checks the key without timestamp and checks the timestamp if keyNoTs
 // is same.
 // a<timestamp> would be sorted higher than aa<timestamp> if we use bytes.compare
-// All keys should have timestamp.
+// All keys should have timestamp. It calls kv.CompareKeys, which has assembly for amd64 and arm64.
 func CompareKeys(key1, key2 []byte) int {
-	if cmp := bytes.Compare(key1[:len(key1)-8], key2[:len(key2)-8]); cmp != 0 {
-		return cmp
-	}
-	return bytes.Compare(key1[len(key1)-8:], key2[len(key2)-8:])
+	return kv.CompareKeys(key1, key2)
 }
 
 // ParseKey parses the actual key from the key bytes.
@@ -180,6 +214,11 @@ func (s *Slice) Resize(sz int) []byte {
 	return s.buf[0:sz]
 }
 
+// Cap returns the capacity of the Slice's buffer.
+func (s *Slice) Cap() int {
+	return cap(s.buf)
+}
+
 // FixedDuration returns a string representation of the given duration with the
 // hours, minutes, and seconds.
 func FixedDuration(d time.Duration) string {
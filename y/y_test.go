@@ -258,11 +258,6 @@ func TestPagebufferReader4(t *testing.T) {
 	require.Equal(t, n, 0)
 }
 
-func TestSizeVarintForZero(t *testing.T) {
-	siz := sizeVarint(0)
-	require.Equal(t, 1, siz)
-}
-
 func TestEncodedSize(t *testing.T) {
 	valBufSize := uint32(rand.Int31n(1e5))
 	expiry := rand.Uint64()
@@ -304,3 +299,16 @@ func TestAllocatorReuse(t *testing.T) {
 	}
 	t.Logf("Allocator: %s\n", a)
 }
+
+func BenchmarkCalculateChecksum(b *testing.B) {
+	data := make([]byte, 4<<10)
+	rand.Read(data)
+	for _, algo := range []pb.Checksum_Algorithm{pb.Checksum_CRC32C, pb.Checksum_XXHash64} {
+		b.Run(algo.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				CalculateChecksum(data, algo)
+			}
+		})
+	}
+}